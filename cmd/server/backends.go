@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/backend"
+	"github.com/fdo-server-wrapper/internal/pipeline"
+	"github.com/fdo-server-wrapper/internal/proxy"
+)
+
+// roleBackend is one entry of the -backends file. Unset fields default to
+// the matching -backend flags.
+type roleBackend struct {
+	Type          string   `json:"type"`
+	Port          int      `json:"port"`
+	Args          []string `json:"args"`
+	Database      string   `json:"db"`
+	FDOPath       string   `json:"fdo_path"`
+	Image         string   `json:"image"`
+	ContainerName string   `json:"container_name"`
+	Volumes       []string `json:"volumes"`
+	Network       string   `json:"network"`
+	Standby       string   `json:"standby"`
+	// Type "pool" only
+	Strategy       string       `json:"strategy"`
+	Members        []poolMember `json:"members"`
+	HealthPath     string       `json:"health_path"`
+	HealthInterval string       `json:"health_interval"`
+}
+
+// poolMember is a server of a type "pool" role.
+type poolMember struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// configureBackends applies -backend, or -backends when set.
+func configureBackends(p *proxy.FDOProxy) error {
+	if backendsPath == "" {
+		if backendMode != "process" {
+			b, err := newBackend("", roleBackend{})
+			if err != nil {
+				return err
+			}
+			p.UseBackend(b)
+		}
+		if backendStandby != "" {
+			if err := p.AddStandby("", backendStandby, backendHealth); err != nil {
+				return fmt.Errorf("-backend-standby: %w", err)
+			}
+			slog.Info("FDO backend standby configured", "standby", backendStandby)
+		}
+		return nil
+	}
+	if backendStandby != "" {
+		return fmt.Errorf("-backend-standby does not apply to -backends; set standby per role")
+	}
+
+	b, err := os.ReadFile(backendsPath)
+	if err != nil {
+		return fmt.Errorf("read backends: %w", err)
+	}
+	var roles map[string]roleBackend
+	if err := pipeline.DecodeOptions(b, &roles); err != nil {
+		return fmt.Errorf("parse backends %s: %w", backendsPath, err)
+	}
+	if len(roles) == 0 {
+		return fmt.Errorf("backends %s: no roles", backendsPath)
+	}
+	for role := range roles {
+		switch role {
+		case proxy.RoleManufacturer, proxy.RoleRendezvous, proxy.RoleOwner:
+		default:
+			return fmt.Errorf("backends %s: unknown role %q: want manufacturer, rendezvous or owner", backendsPath, role)
+		}
+	}
+	// Add in a fixed order so port conflicts are reported the same way
+	for _, role := range []string{proxy.RoleManufacturer, proxy.RoleRendezvous, proxy.RoleOwner} {
+		rb, ok := roles[role]
+		if !ok {
+			continue
+		}
+		if rb.Type == "" {
+			rb.Type = backendMode
+		}
+		if rb.Type == "pool" {
+			if err := addPool(p, role, rb); err != nil {
+				return fmt.Errorf("backends %s: %w", backendsPath, err)
+			}
+			continue
+		}
+		if rb.Port <= 0 && rb.Type != "inprocess" {
+			return fmt.Errorf("backends %s: %s: port is required", backendsPath, role)
+		}
+		be, err := newBackend(role, rb)
+		if err != nil {
+			return fmt.Errorf("backends %s: %s: %w", backendsPath, role, err)
+		}
+		if err := p.AddBackend(role, be, rb.Port); err != nil {
+			return fmt.Errorf("backends %s: %w", backendsPath, err)
+		}
+		if rb.Standby != "" {
+			if err := p.AddStandby(role, rb.Standby, backendHealth); err != nil {
+				return fmt.Errorf("backends %s: %s: %w", backendsPath, role, err)
+			}
+			slog.Info("FDO role backend standby configured", "role", role, "standby", rb.Standby)
+		}
+		slog.Info("FDO role backend configured", "role", role, "type", rb.Type, "port", rb.Port)
+	}
+	return nil
+}
+
+// addPool serves role by the servers of a type "pool" entry.
+func addPool(p *proxy.FDOProxy, role string, rb roleBackend) error {
+	pool := proxy.Pool{Strategy: rb.Strategy, HealthPath: rb.HealthPath}
+	if rb.HealthInterval != "" {
+		d, err := time.ParseDuration(rb.HealthInterval)
+		if err != nil {
+			return fmt.Errorf("%s: health_interval: %w", role, err)
+		}
+		pool.HealthInterval = d
+	}
+	for _, m := range rb.Members {
+		pool.Members = append(pool.Members, proxy.PoolMember{URL: m.URL, Weight: m.Weight})
+	}
+	if err := p.AddPool(role, pool); err != nil {
+		return err
+	}
+	slog.Info("FDO role backend pool configured", "role", role, "strategy", rb.Strategy, "members", len(rb.Members))
+	return nil
+}
+
+// newBackend builds a backend from rb, filling unset fields from flags. A
+// role backend gets its own database and container name so roles sharing a
+// go-fdo tree or volume do not collide.
+func newBackend(role string, rb roleBackend) (proxy.Backend, error) {
+	if rb.Type == "" {
+		rb.Type = backendMode
+	}
+	suffix := "backend"
+	if role != "" {
+		suffix = role
+	}
+	switch rb.Type {
+	case "process":
+		if rb.FDOPath == "" {
+			rb.FDOPath = fdoPath
+		}
+		if rb.Database == "" {
+			rb.Database = "./fdo-" + suffix + ".db"
+		}
+		return backend.NewProcess(rb.FDOPath, rb.Database, rb.Args), nil
+	case "inprocess":
+		if rb.Database == "" {
+			rb.Database = "./fdo-" + suffix + ".db"
+		}
+		h, err := newInProcessHandler(rb.Database, rb.Args)
+		if err != nil {
+			return nil, err
+		}
+		return backend.NewInProcess(h), nil
+	case "container":
+		if rb.Image == "" {
+			rb.Image = backendImage
+		}
+		if rb.ContainerName == "" {
+			rb.ContainerName = backendName
+			if role != "" {
+				rb.ContainerName = "fdo-proxy-" + role
+			}
+		}
+		if rb.Database == "" {
+			rb.Database = "/data/fdo-" + suffix + ".db"
+		}
+		if rb.Volumes == nil {
+			for _, v := range strings.Split(backendVolumes, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					rb.Volumes = append(rb.Volumes, v)
+				}
+			}
+		}
+		if rb.Network == "" {
+			rb.Network = backendNetwork
+		}
+		return backend.NewContainer(backend.ContainerConfig{
+			Host:     containerEngine,
+			Image:    rb.Image,
+			Name:     rb.ContainerName,
+			Database: rb.Database,
+			Volumes:  rb.Volumes,
+			Network:  rb.Network,
+			Args:     rb.Args,
+		})
+	}
+	return nil, fmt.Errorf("invalid backend type %q: want process, inprocess, container or pool", rb.Type)
+}
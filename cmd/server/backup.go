@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/fdo-server-wrapper/internal/backup"
+	"github.com/fdo-server-wrapper/internal/version"
+)
+
+// stateFiles lists the state the proxy keeps on disk under these flags,
+// once deriveStatePaths has filled in their defaults.
+func stateFiles() []backup.File {
+	files := []backup.File{
+		{Name: "store.jsonl", Path: storePath, Lines: true},
+		{Name: "ledger-outbox.json", Path: ledgerOutbox, Lines: true},
+		{Name: "quarantine.json", Path: quarantineFile},
+		{Name: "tags.json", Path: tagsFile},
+		{Name: "features.json", Path: featuresFile},
+		{Name: "bans.json", Path: banFile},
+		{Name: "anomaly.json", Path: anomalyFile},
+		{Name: "serials.jsonl", Path: diSerialsFile, Lines: true},
+		{Name: "rvinfo-audit.jsonl", Path: rvinfoAudit, Lines: true},
+		{Name: "ownerkey-audit.jsonl", Path: ownerKeyAudit, Lines: true},
+		{Name: "admin-audit.jsonl", Path: adminAuditFile, Lines: true},
+		{Name: "anchor-pending.jsonl", Path: anchorPending, Lines: true},
+		{Name: "anchor", Path: anchorDir, Dir: true},
+		{Name: "receipts", Path: receiptDir, Dir: true},
+		{Name: "credentials", Path: vcOutDir, Dir: true},
+		{Name: "acme", Path: acmeCacheDir, Dir: true},
+	}
+	out := files[:0]
+	for _, f := range files {
+		if f.Path != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// runBackup writes the state files to path for -backup and returns the
+// exit status.
+func runBackup(path string) int {
+	files := stateFiles()
+	if storeDB != "" {
+		fmt.Fprintln(os.Stderr, "backup: the -store-db database is not included; back it up with pg_dump")
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "backup: no state files configured; set -store-path or the state file flags")
+		return 1
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "backup:", err)
+		return 1
+	}
+	m, err := backup.Write(f, files, version.Get().String())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		fmt.Fprintln(os.Stderr, "backup:", err)
+		return 1
+	}
+	for _, e := range m.Files {
+		fmt.Printf("%-22s %10d  %s\n", e.Name, e.Size, e.Path)
+	}
+	fmt.Printf("\n%d files backed up to %s\n", len(m.Files), path)
+	return 0
+}
+
+// runRestore restores a backup into the state files for -restore and
+// returns the exit status.
+func runRestore(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "restore:", err)
+		return 1
+	}
+	defer f.Close()
+	res, err := backup.Restore(f, stateFiles(), restoreForce)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "restore:", err)
+		if res == nil {
+			fmt.Fprintln(os.Stderr, "restore: nothing was changed")
+		}
+		return 1
+	}
+	for _, e := range res.Restored {
+		fmt.Printf("%-22s %10d  %s\n", e.Name, e.Size, e.Path)
+	}
+	for _, name := range res.Skipped {
+		fmt.Printf("%-22s skipped, not configured\n", name)
+	}
+	fmt.Printf("\n%d files restored from the backup of %s taken by %s\n", len(res.Restored), res.Manifest.CreatedAt.Format("2006-01-02 15:04:05Z"), res.Manifest.Version)
+	return 0
+}
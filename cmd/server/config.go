@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/features"
+	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/spiffe"
+)
+
+// envFlags are the flags defaulting to an environment variable.
+var envFlags = map[string]string{
+	"admin-token":          "FDO_PROXY_ADMIN_TOKEN",
+	"spiffe-endpoint":      spiffe.EndpointEnv,
+	"epcis-auth":           "FDO_PROXY_EPCIS_AUTH",
+	"anchor-auth":          "FDO_PROXY_ANCHOR_AUTH",
+	"log-redact-salt":      "FDO_PROXY_LOG_REDACT_SALT",
+	"otlp-logs-endpoint":   "OTEL_EXPORTER_OTLP_LOGS_ENDPOINT",
+	"otlp-headers":         "OTEL_EXPORTER_OTLP_HEADERS",
+	"alert-slack-webhook":  "FDO_PROXY_ALERT_SLACK_WEBHOOK",
+	"notify-slack-webhook": "FDO_PROXY_NOTIFY_SLACK_WEBHOOK",
+	"alert-pagerduty-key":  "FDO_PROXY_ALERT_PAGERDUTY_KEY",
+	"alert-opsgenie-key":   "FDO_PROXY_ALERT_OPSGENIE_KEY",
+	"store-db":             "FDO_PROXY_STORE_DB",
+	"rate-limit-redis":     "FDO_PROXY_RATE_LIMIT_REDIS",
+	"admin-audit-key":      "FDO_PROXY_ADMIN_AUDIT_KEY",
+}
+
+// secretFlags are the flags whose values /admin/config leaves out.
+var secretFlags = map[string]bool{
+	"admin-token":          true,
+	"epcis-auth":           true,
+	"anchor-auth":          true,
+	"log-redact-salt":      true,
+	"otlp-headers":         true,
+	"alert-slack-webhook":  true,
+	"notify-slack-webhook": true,
+	"alert-pagerduty-key":  true,
+	"alert-opsgenie-key":   true,
+	"admin-audit-key":      true,
+}
+
+// otherEnv are the environment variables read without a flag.
+var otherEnv = []string{"FDO_PROXY_STORE_KEY", "FDO_PROXY_SMTP_PASSWORD", "DOCKER_HOST", "PGPASSWORD"}
+
+// configFileFlags are the flags naming files read at startup that
+// /admin/config fingerprints. Private keys are left out.
+var configFileFlags = []string{
+	"pipeline", "backends", "sni-routes", "virtual-hosts", "listeners", "source-rules",
+	"owner-map", "tag-rules", "policies", "geoip-db", "prefetch-manifest", "jobs", "notify-config", "callbacks",
+	"commissioning-template",
+	"tls-cert", "tls-client-ca", "ca-cert", "client-cert",
+}
+
+// redacted replaces the values of secrets.
+const redacted = "[redacted]"
+
+// parsedFlags holds every flag's value as parsed, before startup fills in
+// defaults that depend on other flags.
+var parsedFlags map[string]string
+
+// snapshotFlags records parsedFlags; call it right after flag.Parse.
+func snapshotFlags() {
+	parsedFlags = make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		parsedFlags[f.Name] = f.Value.String()
+	})
+}
+
+// configValue is a flag's effective value and where it came from: the
+// command line ("flag"), an environment variable ("env"), startup filling
+// it in from other flags ("derived") or its default ("default").
+type configValue struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// configFile fingerprints a file named by a flag as it is now on disk.
+type configFile struct {
+	Path     string    `json:"path"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Modified time.Time `json:"modified,omitzero"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// effectiveConfig is what /admin/config returns.
+type effectiveConfig struct {
+	Flags map[string]configValue `json:"flags"`
+	// Environment lists the variables the proxy reads that are set, by
+	// name only; values read through a flag are in Flags.
+	Environment []string              `json:"environment"`
+	Files       map[string]configFile `json:"files"`
+	Maintenance proxy.DrainStatus     `json:"maintenance"`
+	Features    []features.State      `json:"features"`
+}
+
+// currentConfig returns a function reporting the effective configuration of
+// p: flags, environment, files and runtime overrides, without secrets.
+func currentConfig(p *proxy.FDOProxy, flags *features.Set) func() any {
+	return func() any {
+		cfg := effectiveConfig{
+			Flags:       make(map[string]configValue),
+			Environment: []string{},
+			Files:       make(map[string]configFile),
+			Maintenance: p.Maintenance(),
+			Features:    flags.All(),
+		}
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		flag.VisitAll(func(f *flag.Flag) {
+			v := configValue{Value: f.Value.String(), Source: "default"}
+			switch env := envFlags[f.Name]; {
+			case set[f.Name]:
+				v.Source = "flag"
+			case env != "" && os.Getenv(env) != "":
+				v.Source = "env"
+			}
+			if v.Value != parsedFlags[f.Name] {
+				v.Source = "derived"
+			}
+			if secretFlags[f.Name] && v.Value != "" {
+				v.Value = redacted
+			} else if u, err := url.Parse(v.Value); err == nil && u.User != nil {
+				v.Value = u.Redacted()
+			}
+			cfg.Flags[f.Name] = v
+		})
+		for _, env := range envFlags {
+			if os.Getenv(env) != "" {
+				cfg.Environment = append(cfg.Environment, env)
+			}
+		}
+		for _, env := range otherEnv {
+			if os.Getenv(env) != "" {
+				cfg.Environment = append(cfg.Environment, env)
+			}
+		}
+		sort.Strings(cfg.Environment)
+		for _, name := range configFileFlags {
+			if path := flag.Lookup(name).Value.String(); path != "" {
+				cfg.Files[name] = fingerprint(path)
+			}
+		}
+		return cfg
+	}
+}
+
+func fingerprint(path string) configFile {
+	f := configFile{Path: path}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	sum := sha256.Sum256(b)
+	f.SHA256 = hex.EncodeToString(sum[:])
+	f.Size = int64(len(b))
+	if fi, err := os.Stat(path); err == nil {
+		f.Modified = fi.ModTime().UTC()
+	}
+	return f
+}
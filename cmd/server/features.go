@@ -0,0 +1,19 @@
+package main
+
+import (
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/features"
+)
+
+// gateSinks defines a feature flag sink.<name> for every sink subscribed to
+// bus, on by default, and delivers events only to sinks whose flag is on.
+func gateSinks(bus *events.Bus, set *features.Set) {
+	flags := make(map[string]*features.Flag)
+	for _, name := range bus.Names() {
+		flags[name] = set.Define("sink."+name, "Deliver lifecycle events to the "+name+" sink", true)
+	}
+	bus.Gate(func(sink string) bool {
+		f, ok := flags[sink]
+		return !ok || f.Enabled()
+	})
+}
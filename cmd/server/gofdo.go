@@ -0,0 +1,187 @@
+//go:build gofdo
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo"
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/custom"
+	fdohttp "github.com/fido-device-onboard/go-fdo/http"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+	"github.com/fido-device-onboard/go-fdo/sqlite"
+)
+
+// newInProcessHandler builds a go-fdo server serving DI, TO0, TO1 and TO2
+// from the SQLite database at db, creating it and its keys on first use
+// as go-fdo's own server does. args take -db-pass, the database
+// passphrase, and -ext-http, the host:port put in new vouchers' RVInfo
+// (default -listen).
+func newInProcessHandler(db string, args []string) (http.Handler, error) {
+	fs := flag.NewFlagSet("inprocess", flag.ContinueOnError)
+	dbPass := fs.String("db-pass", "", "SQLite database passphrase")
+	extAddr := fs.String("ext-http", listenAddr, "Address devices reach the server at")
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("in-process backend args: %w", err)
+	}
+
+	state, err := sqlite.Open(db, *dbPass)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", db, err)
+	}
+	if err := ensureKeys(state); err != nil {
+		return nil, fmt.Errorf("keys in %s: %w", db, err)
+	}
+	rvInfo, err := newRvInfo(*extAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fdohttp.Handler{
+		Tokens: state,
+		DIResponder: &fdo.DIServer[custom.DeviceMfgInfo]{
+			Session:               state,
+			Vouchers:              state,
+			SignDeviceCertificate: custom.SignDeviceCertificate(state),
+			DeviceInfo: func(ctx context.Context, info *custom.DeviceMfgInfo, _ []*x509.Certificate) (string, protocol.PublicKey, error) {
+				key, chain, err := state.ManufacturerKey(info.KeyType)
+				if err != nil {
+					return "", protocol.PublicKey{}, err
+				}
+				pub, err := encodePublicKey(info.KeyType, info.KeyEncoding, key.Public(), chain)
+				if err != nil {
+					return "", protocol.PublicKey{}, err
+				}
+				return info.DeviceInfo, *pub, nil
+			},
+			RvInfo: func(context.Context, *fdo.Voucher) ([][]protocol.RvInstruction, error) {
+				return rvInfo, nil
+			},
+		},
+		TO0Responder: &fdo.TO0Server{Session: state, RVBlobs: state},
+		TO1Responder: &fdo.TO1Server{Session: state, RVBlobs: state},
+		TO2Responder: &fdo.TO2Server{Session: state, Vouchers: state, OwnerKeys: state},
+	}, nil
+}
+
+// newRvInfo directs devices to addr over HTTP for TO1 and TO2, which the
+// proxy routes back to this server.
+func newRvInfo(addr string) ([][]protocol.RvInstruction, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("in-process backend -ext-http %q: %w", addr, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("in-process backend -ext-http %q: invalid port", addr)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	prot, _ := cbor.Marshal(protocol.RVProtHTTP)
+	devPort, _ := cbor.Marshal(uint16(port))
+	ownerPort, _ := cbor.Marshal(uint16(port))
+	instructions := []protocol.RvInstruction{
+		{Variable: protocol.RVProtocol, Value: prot},
+		{Variable: protocol.RVDevPort, Value: devPort},
+		{Variable: protocol.RVOwnerPort, Value: ownerPort},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		v, _ := cbor.Marshal(ip)
+		instructions = append(instructions, protocol.RvInstruction{Variable: protocol.RVIPAddress, Value: v})
+	} else {
+		v, _ := cbor.Marshal(host)
+		instructions = append(instructions, protocol.RvInstruction{Variable: protocol.RVDns, Value: v})
+	}
+	return [][]protocol.RvInstruction{instructions}, nil
+}
+
+// encodePublicKey encodes the manufacturer key in the form the device asked
+// for.
+func encodePublicKey(typ protocol.KeyType, enc protocol.KeyEncoding, pub crypto.PublicKey, chain []*x509.Certificate) (*protocol.PublicKey, error) {
+	switch enc {
+	case protocol.X509KeyEnc, protocol.CoseKeyEnc:
+		return protocol.NewPublicKey(typ, pub, enc == protocol.CoseKeyEnc)
+	case protocol.X5ChainKeyEnc:
+		return protocol.NewPublicKey(typ, chain, false)
+	}
+	return nil, fmt.Errorf("unsupported key encoding %s", enc)
+}
+
+// ensureKeys creates the device CA, manufacturer and owner keys of a new
+// database, one of each supported type.
+func ensureKeys(state *sqlite.DB) error {
+	if _, _, err := state.ManufacturerKey(protocol.Secp384r1KeyType); err == nil {
+		return nil
+	} else if !errors.Is(err, fdo.ErrNotFound) {
+		return err
+	}
+	for _, typ := range []protocol.KeyType{protocol.Rsa2048RestrKeyType, protocol.Secp256r1KeyType, protocol.Secp384r1KeyType} {
+		for _, add := range []func(protocol.KeyType, crypto.PrivateKey, []*x509.Certificate) error{
+			state.AddManufacturerKey,
+			state.AddOwnerKey,
+		} {
+			key, chain, err := newKey(typ)
+			if err != nil {
+				return err
+			}
+			if err := add(typ, key, chain); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newKey generates a key of typ with a self-signed certificate.
+func newKey(typ protocol.KeyType) (crypto.Signer, []*x509.Certificate, error) {
+	var key crypto.Signer
+	var err error
+	switch typ {
+	case protocol.Rsa2048RestrKeyType:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case protocol.Secp256r1KeyType:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case protocol.Secp384r1KeyType:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	default:
+		return nil, nil, fmt.Errorf("unsupported key type %s", typ)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "fdo-proxy in-process " + typ.String()},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(30, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, []*x509.Certificate{cert}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !gofdo
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// newInProcessHandler is only available in binaries built with go-fdo; see
+// gofdo.go.
+func newInProcessHandler(db string, args []string) (http.Handler, error) {
+	return nil, errors.New("this binary does not link go-fdo; build it with -tags gofdo next to a go-fdo checkout to use -backend=inprocess")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/anchor"
+	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/reconcile"
+	"github.com/fdo-server-wrapper/internal/schedule"
+	"github.com/fdo-server-wrapper/internal/store"
+)
+
+// jobNames are the jobs -jobs can configure.
+var jobNames = []string{"anchor", "ledger-sync", "prefetch", "prune", "reconcile"}
+
+// newScheduler adds the recurring jobs of the features configured, on the
+// schedules of their interval flags unless -jobs sets others. Any of the
+// arguments may be nil. With -store-db, the jobs working on the state the
+// proxies share there run on one proxy at a time.
+func newScheduler(history store.Store, anchorer *anchor.Anchorer, passportClient *ledger.Client, reconciler *reconcile.Reconciler) (*schedule.Scheduler, error) {
+	var cfg schedule.Config
+	if jobsPath != "" {
+		c, err := schedule.LoadConfig(jobsPath)
+		if err != nil {
+			return nil, err
+		}
+		for name := range c {
+			if !slices.Contains(jobNames, name) {
+				return nil, fmt.Errorf("jobs %s: unknown job %q", jobsPath, name)
+			}
+		}
+		cfg = c
+	}
+
+	s := schedule.New(cfg)
+	if storeDB != "" {
+		db, err := openStoreDB()
+		if err != nil {
+			return nil, err
+		}
+		s.EnableLocking(db)
+	}
+	var jobs []schedule.Job
+	if history != nil {
+		retention := store.Retention{Details: retainDetails, Records: retainRecords}
+		if retention.Enabled() {
+			jobs = append(jobs, schedule.Job{Name: "prune", Schedule: every(pruneInterval), RunAtStart: true, Singleton: true, Run: store.Pruner(history, retention)})
+		}
+	}
+	if anchorer != nil {
+		jobs = append(jobs, schedule.Job{Name: "anchor", Schedule: every(anchorInterval), Run: anchorer.Flush})
+	}
+	if passportClient != nil && passportClient.OfflineEnabled() {
+		// Proxies sharing an outbox in the database sync it together
+		jobs = append(jobs, schedule.Job{Name: "ledger-sync", Schedule: every(ledgerSyncInterval), Run: passportClient.SyncPending})
+	}
+	if reconciler != nil {
+		jobs = append(jobs, schedule.Job{Name: "reconcile", Schedule: every(reconcileInterval), RunAtStart: true, Singleton: true, Run: reconciler.Run})
+	}
+	if (prefetchManifest != "" || prefetchAll) && passportClient != nil {
+		// A manifest that does not load stops startup; later runs read it
+		// again, so a new batch can be staged without a restart
+		if prefetchManifest != "" {
+			if _, err := ledger.LoadManifest(prefetchManifest); err != nil {
+				return nil, err
+			}
+		}
+		jobs = append(jobs, schedule.Job{Name: "prefetch", Schedule: "@startup", RunAtStart: true, Run: func(ctx context.Context) error {
+			return prefetch(ctx, passportClient)
+		}})
+	}
+	for _, j := range jobs {
+		if err := s.Add(j); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range s.Unused() {
+		slog.Warn("Job configured in -jobs is not available with these flags, ignoring", "job", name)
+	}
+	return s, nil
+}
+
+// every is the schedule of a job run every interval.
+func every(interval time.Duration) string {
+	return "@every " + interval.String()
+}
+
+// prefetch warms the passport cache with the products of -prefetch-manifest,
+// or with every product the service lists with -prefetch-all.
+func prefetch(ctx context.Context, c *ledger.Client) error {
+	if prefetchAll {
+		slog.Info("Prefetching every listed product passport")
+		res, err := c.PrefetchAll(ctx, ledger.MaxListLimit)
+		slog.Info("Passport prefetch complete",
+			"listed", res.Requested,
+			"loaded", res.Loaded,
+			"failed", res.Failed,
+			"duration", res.Duration)
+		if err != nil {
+			return fmt.Errorf("passport prefetch: %w", err)
+		}
+		return nil
+	}
+	uuids, err := ledger.LoadManifest(prefetchManifest)
+	if err != nil {
+		return err
+	}
+	slog.Info("Prefetching product passports", "manifest", prefetchManifest, "count", len(uuids))
+	res, err := c.Prefetch(ctx, uuids, prefetchConcurrency)
+	if err != nil {
+		return fmt.Errorf("passport prefetch skipped: %w", err)
+	}
+	slog.Info("Passport prefetch complete",
+		"requested", res.Requested,
+		"loaded", res.Loaded,
+		"failed", res.Failed,
+		"duration", res.Duration)
+	return nil
+}
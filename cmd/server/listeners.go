@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/fdo-server-wrapper/internal/pipeline"
+	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/revocation"
+)
+
+// listenerRoute is one entry of the -listeners file, keyed by address.
+// Role, URL, Pipeline, Cert and Key are as for a site; with Cert and Key
+// the listener speaks TLS under the -tls-* policy, with CoAP it serves FDO
+// over CoAP on UDP instead of HTTP.
+type listenerRoute struct {
+	siteRoute
+	// ClientCA requires devices to present a certificate from it; TLS only.
+	ClientCA string `json:"client_ca"`
+	// AcceptRoles limits the FDO messages taken (default: -accept-roles).
+	AcceptRoles []string `json:"accept_roles"`
+	// SourceRules is a -source-rules file replacing the proxy's rules.
+	SourceRules string `json:"source_rules"`
+	// CoAP makes the listener a CoAP gateway; it cannot take TLS.
+	CoAP bool `json:"coap"`
+}
+
+// configureListeners applies -listeners. Client certificates of listeners
+// are checked for revocation with checker, if set.
+func configureListeners(p *proxy.FDOProxy, checker *revocation.Checker) error {
+	if listenersPath == "" {
+		return nil
+	}
+	b, err := os.ReadFile(listenersPath)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", listenersPath, err)
+	}
+	var routes map[string]listenerRoute
+	if err := pipeline.DecodeOptions(b, &routes); err != nil {
+		return fmt.Errorf("parse %s: %w", listenersPath, err)
+	}
+	for addr, r := range routes {
+		site, err := newSite(r.siteRoute)
+		if err != nil {
+			return fmt.Errorf("listeners %s: %s: %w", listenersPath, addr, err)
+		}
+		cfg, err := listenerTLS(r, checker)
+		if err != nil {
+			return fmt.Errorf("listeners %s: %s: %w", listenersPath, addr, err)
+		}
+		var rules *proxy.SourceRules
+		if r.SourceRules != "" {
+			if rules, err = proxy.LoadSourceRules(r.SourceRules); err != nil {
+				return fmt.Errorf("listeners %s: %s: %w", listenersPath, addr, err)
+			}
+		}
+		l := proxy.Listener{Addr: addr, TLS: cfg, Site: site, AcceptRoles: r.AcceptRoles, SourceRules: rules, CoAP: r.CoAP}
+		if err := p.AddListener(l); err != nil {
+			return fmt.Errorf("listeners %s: %w", listenersPath, err)
+		}
+		slog.Info("Listener configured", "listen_addr", addr, "tls", cfg != nil, "coap", r.CoAP, "client_ca", r.ClientCA, "accept_roles", r.AcceptRoles, "source_rules", r.SourceRules, "role", r.Role, "url", r.URL, "pipeline", r.Pipeline)
+	}
+	return nil
+}
+
+// listenerTLS builds the TLS configuration of r, nil for plain HTTP.
+func listenerTLS(r listenerRoute, checker *revocation.Checker) (*tls.Config, error) {
+	if r.Cert == "" && r.Key == "" {
+		if r.ClientCA != "" {
+			return nil, fmt.Errorf("client_ca needs cert and key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.Cert, r.Key)
+	if err != nil {
+		return nil, err
+	}
+	policy := proxy.TLSPolicy{
+		MinVersion:   tlsMinVersion,
+		CipherSuites: splitList(tlsCiphers),
+		Curves:       splitList(tlsCurves),
+		ALPN:         splitList(tlsALPN),
+	}
+	if r.ClientCA != "" {
+		pem, err := os.ReadFile(r.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		policy.ClientCAs = x509.NewCertPool()
+		if !policy.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", r.ClientCA)
+		}
+	}
+	cfg, err := policy.Config([]tls.Certificate{cert})
+	if err != nil {
+		return nil, err
+	}
+	if r.ClientCA != "" && checker != nil {
+		cfg.VerifyConnection = checker.VerifyConnection("device")
+	}
+	return cfg, nil
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fdo-server-wrapper/internal/alert"
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/logging"
+	"github.com/fdo-server-wrapper/internal/metrics"
+	"github.com/fdo-server-wrapper/internal/notify"
+	"github.com/fdo-server-wrapper/internal/pipeline"
+	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/revocation"
+	"github.com/fdo-server-wrapper/internal/spiffe"
+)
+
+// The loaders below turn flags into the settings the proxy starts with.
+// Both the server and -validate-config call them, so a flag is refused by
+// one exactly when it is refused by the other.
+
+// flagError is a flag value the proxy refuses to start with.
+type flagError struct {
+	flag string
+	err  error
+}
+
+func (e *flagError) Error() string { return "-" + e.flag + ": " + e.err.Error() }
+
+func (e *flagError) Unwrap() error { return e.err }
+
+// invalid returns a flagError for flag.
+func invalid(flag string, format string, args ...any) *flagError {
+	return &flagError{flag, fmt.Errorf(format, args...)}
+}
+
+// checkFlags returns the flag values the proxy refuses on their own or in
+// combination, before any file is read.
+func checkFlags() []*flagError {
+	var errs []*flagError
+	fail := func(flag, format string, args ...any) {
+		errs = append(errs, invalid(flag, format, args...))
+	}
+
+	// Commands run instead of the proxy
+	if backupPath != "" && restorePath != "" {
+		fail("backup", "cannot be combined with -restore")
+	}
+	if restoreForce && restorePath == "" {
+		fail("restore-force", "requires -restore")
+	}
+	if migrateCmd != "" {
+		if storeDB == "" {
+			fail("migrate", "requires -store-db")
+		}
+		if err := checkMigrateCmd(migrateCmd); err != nil {
+			fail("migrate", "%v", err)
+		}
+	}
+
+	if (tlsSPIFFE || ledgerSPIFFE) && spiffeEndpoint == "" {
+		fail("spiffe-endpoint", "-tls-spiffe and -ledger-spiffe need -spiffe-endpoint or $%s", spiffe.EndpointEnv)
+	}
+	if acmeDomains != "" {
+		switch {
+		case tlsCert != "" || tlsSPIFFE:
+			fail("acme-domains", "cannot be combined with -tls-cert or -tls-spiffe")
+		case acmeCacheDir == "":
+			fail("acme-domains", "requires -acme-cache-dir")
+		}
+	}
+	if prefetchAll && prefetchManifest != "" {
+		fail("prefetch-all", "conflicts with -prefetch-manifest")
+	}
+	if passportDIRecords && productPassportBaseURL == "" {
+		fail("passport-di-records", "requires -product-base-url")
+	}
+	if commissioningTemplate != "" && commissioningCreateURL == "" {
+		fail("commissioning-template", "requires -commissioning-url")
+	}
+	for flag, n := range map[string]int{
+		"ledger-idle-conns":        ledgerIdleConns,
+		"ledger-max-conns":         ledgerMaxConns,
+		"ledger-tls-session-cache": ledgerSessionCache,
+	} {
+		if n < 0 {
+			fail(flag, "must not be negative")
+		}
+	}
+
+	if storePath != "" && storeDB != "" {
+		fail("store-db", "-store-path and -store-db are exclusive")
+	}
+	if storePath == "" && storeDB == "" {
+		if quarantineAt > 0 {
+			fail("quarantine-after", "requires -store-path or -store-db")
+		}
+		if reconcileURL != "" {
+			fail("reconcile-url", "requires -store-path or -store-db")
+		}
+	}
+
+	if rateLimitSource < 0 {
+		fail("rate-limit-source", "must not be negative")
+	}
+	if rateLimitDevice < 0 {
+		fail("rate-limit-device", "must not be negative")
+	}
+	if receiptKey != "" && receiptRate < 0 {
+		fail("receipt-rate", "must not be negative")
+	}
+	if deviceStatus && deviceStatusRate < 0 {
+		fail("device-status-rate", "must not be negative")
+	}
+	if penaltyAfter < 0 {
+		fail("penalty-after", "must not be negative")
+	} else if penaltyAfter > 0 {
+		switch {
+		case penaltyBase <= 0:
+			fail("penalty-base", "must be positive")
+		case penaltyMax < penaltyBase:
+			fail("penalty-max", "must not be shorter than -penalty-base")
+		case penaltyReset <= 0:
+			fail("penalty-reset", "must be positive")
+		}
+	}
+	if detectAnomalies {
+		if anomalyThreshold <= 0 {
+			fail("anomaly-threshold", "must be positive")
+		}
+		if anomalyLearning < 0 {
+			fail("anomaly-learning", "must not be negative")
+		}
+	}
+
+	if statsdAddr != "" && statsdFlavor != metrics.FlavorStatsD && statsdFlavor != metrics.FlavorDogStatsD {
+		fail("statsd-flavor", "invalid flavor %q: want %s or %s", statsdFlavor, metrics.FlavorStatsD, metrics.FlavorDogStatsD)
+	}
+	if alertRVExpiring && rvExpiryWarning <= 0 {
+		fail("alert-rv-expiring", "requires -rv-expiry-warning")
+	}
+	if alertPagerDutyKey != "" || alertOpsgenieKey != "" {
+		for _, r := range splitList(alertIncidentRules) {
+			if !slices.Contains(alert.RuleNames, r) {
+				fail("alert-incident-rules", "unknown rule %q: want one of %s", r, strings.Join(alert.RuleNames, ", "))
+			}
+		}
+	}
+	return errs
+}
+
+// checkMigrateCmd checks a -migrate command: up, down, status or a
+// version.
+func checkMigrateCmd(cmd string) error {
+	switch cmd {
+	case "up", "down", "status":
+		return nil
+	}
+	if v, err := strconv.Atoi(cmd); err != nil || v < 0 {
+		return fmt.Errorf("%q is not up, down, status or a version", cmd)
+	}
+	return nil
+}
+
+// statePaths are the state file flags that default to a file next to
+// -store-path, with the suffix of that file.
+var statePaths = []struct {
+	path   *string
+	suffix string
+}{
+	{&ledgerOutbox, ".ledger-outbox.json"},
+	{&quarantineFile, ".quarantine.json"},
+	{&tagsFile, ".tags.json"},
+	{&featuresFile, ".features.json"},
+	{&banFile, ".bans.json"},
+	{&anomalyFile, ".anomaly.json"},
+	{&diSerialsFile, ".serials.jsonl"},
+	{&rvinfoAudit, ".rvinfo.jsonl"},
+	{&ownerKeyAudit, ".ownerkey.jsonl"},
+	{&adminAuditFile, ".admin-audit.jsonl"},
+	{&receiptDir, ".receipts"},
+	{&anchorPending, ".anchor-pending.jsonl"},
+}
+
+// deriveStatePaths sets the state file flags left empty to their default
+// next to -store-path, as the server, -validate-config and -backup all
+// expect them.
+func deriveStatePaths() {
+	if storePath == "" {
+		return
+	}
+	for _, p := range statePaths {
+		if *p.path == "" {
+			*p.path = storePath + p.suffix
+		}
+	}
+}
+
+// logSettings are the logging options parsed from flags.
+type logSettings struct {
+	redact      logging.Mode
+	sample      logging.SampleRates
+	otlpHeaders map[string]string
+}
+
+// loadLogging parses the -log and -otlp flags.
+func loadLogging() (*logSettings, error) {
+	var s logSettings
+	var err error
+	if s.redact, err = logging.ParseMode(logRedact); err != nil {
+		return nil, &flagError{"log-redact", err}
+	}
+	if s.sample, err = logging.ParseSampleRates(logSample); err != nil {
+		return nil, &flagError{"log-sample", err}
+	}
+	if otlpLogsURL != "" {
+		if s.otlpHeaders, err = logging.ParseHeaders(otlpHeaders); err != nil {
+			return nil, &flagError{"otlp-headers", err}
+		}
+	}
+	return &s, nil
+}
+
+// loadRevocation returns the checker of -revocation-check, nil if it is
+// off.
+func loadRevocation() (*revocation.Checker, error) {
+	if revocationMode == "off" {
+		return nil, nil
+	}
+	mode, err := revocation.ParseMode(revocationMode)
+	if err != nil {
+		return nil, &flagError{"revocation-check", err}
+	}
+	return revocation.NewChecker(mode, revocationTTL, revocationTimeout), nil
+}
+
+// ledgerSettings are the ledger client options parsed from flags.
+type ledgerSettings struct {
+	pins []ledger.Pin
+	http ledger.HTTPOptions
+	dns  ledger.ResolverOptions
+}
+
+// loadLedger parses the -ledger flags tuning the passport service clients.
+func loadLedger() (*ledgerSettings, error) {
+	var s ledgerSettings
+	for _, v := range splitList(ledgerPins) {
+		pin, err := ledger.ParsePin(v)
+		if err != nil {
+			return nil, &flagError{"ledger-pins", err}
+		}
+		s.pins = append(s.pins, pin)
+	}
+	http2Mode, err := ledger.ParseHTTP2Mode(ledgerHTTP2)
+	if err != nil {
+		return nil, &flagError{"ledger-http2", err}
+	}
+	s.http = ledger.HTTPOptions{
+		Timeout:             ledgerTimeout,
+		DialTimeout:         ledgerDialTimeout,
+		TLSHandshakeTimeout: ledgerTLSHandshakeTimeout,
+		IdleConnTimeout:     ledgerIdleTimeout,
+		MaxIdleConnsPerHost: ledgerIdleConns,
+		MaxConnsPerHost:     ledgerMaxConns,
+		SessionCache:        ledgerSessionCache,
+		HTTP2:               http2Mode,
+	}
+	s.dns = ledger.ResolverOptions{CacheTTL: ledgerDNSCacheTTL, StaleTTL: ledgerDNSStaleTTL}
+	for _, v := range splitList(ledgerDNSServers) {
+		server, err := ledger.ParseDNSServer(v)
+		if err != nil {
+			return nil, &flagError{"ledger-dns-servers", err}
+		}
+		s.dns.Servers = append(s.dns.Servers, server)
+	}
+	for _, v := range splitList(ledgerHosts) {
+		host, addr, err := ledger.ParseHostPin(v)
+		if err != nil {
+			return nil, &flagError{"ledger-hosts", err}
+		}
+		if s.dns.Hosts == nil {
+			s.dns.Hosts = make(map[string][]string)
+		}
+		s.dns.Hosts[host] = append(s.dns.Hosts[host], addr)
+	}
+	return &s, nil
+}
+
+// resolving reports whether the proxy resolves the ledger hosts itself.
+func (s *ledgerSettings) resolving() bool {
+	return len(s.dns.Servers) > 0 || len(s.dns.Hosts) > 0 || s.dns.CacheTTL > 0 || s.dns.StaleTTL > 0
+}
+
+// loadTLS builds the listener's TLS configuration from the -tls flags, nil
+// without TLS. With -tls-spiffe or -acme-domains it holds no certificate
+// and the caller sets GetCertificate.
+func loadTLS() (*tls.Config, error) {
+	if tlsCert == "" && tlsKey == "" && !tlsSPIFFE && acmeDomains == "" {
+		return nil, nil
+	}
+	var certs []tls.Certificate
+	if !tlsSPIFFE && acmeDomains == "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			return nil, &flagError{"tls-cert", err}
+		}
+		certs = append(certs, cert)
+	}
+	tlsPolicy := proxy.TLSPolicy{
+		MinVersion:   tlsMinVersion,
+		CipherSuites: splitList(tlsCiphers),
+		Curves:       splitList(tlsCurves),
+		ALPN:         splitList(tlsALPN),
+	}
+	if tlsClientCA != "" {
+		pool, _, err := loadCertPool(tlsClientCA)
+		if err != nil {
+			return nil, &flagError{"tls-client-ca", err}
+		}
+		tlsPolicy.ClientCAs = pool
+	}
+	cfg, err := tlsPolicy.Config(certs)
+	if err != nil {
+		return nil, &flagError{"tls-policy", err}
+	}
+	return cfg, nil
+}
+
+// loadCertPool reads the PEM certificates in path.
+func loadCertPool(path string) (*x509.CertPool, int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	pool := x509.NewCertPool()
+	n := 0
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", path, err)
+		}
+		pool.AddCert(cert)
+		n++
+	}
+	if n == 0 {
+		return nil, 0, fmt.Errorf("%s: no certificates", path)
+	}
+	return pool, n, nil
+}
+
+// loadNotifier builds the notifier of -notify-config, sending through the
+// channels the notify flags configure.
+func loadNotifier() (*notify.Notifier, int, error) {
+	c, err := notify.LoadConfig(notifyConfig)
+	if err != nil {
+		return nil, 0, &flagError{"notify-config", err}
+	}
+	var channels []notify.Channel
+	if notifySlackURL != "" {
+		channels = append(channels, notify.NewSlack(notifySlackURL))
+	}
+	if notifyEmailTo != "" {
+		channels = append(channels, notify.NewEmail(notify.EmailOptions{
+			Addr:     alertSMTPAddr,
+			From:     alertEmailFrom,
+			To:       splitList(notifyEmailTo),
+			Username: alertSMTPUser,
+			Password: os.Getenv("FDO_PROXY_SMTP_PASSWORD"),
+		}))
+	}
+	n, err := notify.New(c, channels)
+	if err != nil {
+		return nil, 0, &flagError{"notify-config", fmt.Errorf("%s: %w", notifyConfig, err)}
+	}
+	return n, len(channels), nil
+}
+
+// loadPipeline returns the middleware stages of -pipeline, or those the
+// flags enable without it. registerBuiltins must have been called.
+func loadPipeline(bus *events.Bus) ([]pipeline.Stage, error) {
+	if pipelinePath == "" {
+		return defaultPipeline(bus), nil
+	}
+	cfg, err := pipeline.Load(pipelinePath)
+	if err != nil {
+		return nil, &flagError{"pipeline", err}
+	}
+	return cfg.Middleware, nil
+}
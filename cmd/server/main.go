@@ -2,94 +2,1207 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"log/slog"
+	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/fdo-server-wrapper/internal/acme"
+	"github.com/fdo-server-wrapper/internal/admin"
+	"github.com/fdo-server-wrapper/internal/alert"
+	"github.com/fdo-server-wrapper/internal/anchor"
+	"github.com/fdo-server-wrapper/internal/anomaly"
+	"github.com/fdo-server-wrapper/internal/audit"
+	"github.com/fdo-server-wrapper/internal/backend"
+	"github.com/fdo-server-wrapper/internal/ban"
+	"github.com/fdo-server-wrapper/internal/callback"
+	"github.com/fdo-server-wrapper/internal/epcis"
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/features"
+	"github.com/fdo-server-wrapper/internal/geo"
 	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/logging"
+	"github.com/fdo-server-wrapper/internal/metrics"
 	"github.com/fdo-server-wrapper/internal/middleware"
+	"github.com/fdo-server-wrapper/internal/ownerkey"
+	"github.com/fdo-server-wrapper/internal/owners"
+	"github.com/fdo-server-wrapper/internal/penalty"
+	"github.com/fdo-server-wrapper/internal/pipeline"
+	"github.com/fdo-server-wrapper/internal/policy"
 	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/quarantine"
+	"github.com/fdo-server-wrapper/internal/ratelimit"
+	"github.com/fdo-server-wrapper/internal/receipt"
+	"github.com/fdo-server-wrapper/internal/reconcile"
+	"github.com/fdo-server-wrapper/internal/redis"
+	"github.com/fdo-server-wrapper/internal/rendezvous"
+	"github.com/fdo-server-wrapper/internal/rvinfo"
+	"github.com/fdo-server-wrapper/internal/session"
+	"github.com/fdo-server-wrapper/internal/slo"
+	"github.com/fdo-server-wrapper/internal/spiffe"
+	"github.com/fdo-server-wrapper/internal/status"
+	"github.com/fdo-server-wrapper/internal/store"
+	"github.com/fdo-server-wrapper/internal/tags"
+	"github.com/fdo-server-wrapper/internal/to0"
+	"github.com/fdo-server-wrapper/internal/vc"
+	"github.com/fdo-server-wrapper/internal/version"
 )
 
 var (
 	// Proxy server flags
-	listenAddr string
-	fdoPath    string
+	listenAddr       string
+	fdoPath          string
+	adminAddr        string
+	adminToken       string
+	adminTokens      string
+	adminAuditFile   string
+	adminAuditKey    string
+	pipelinePath     string
+	inspectLimit     int
+	flushEvery       time.Duration
+	copyBuffer       int
+	maxSessions      int
+	rateLimitSource  float64
+	rateLimitDevice  float64
+	rateLimitRedis   string
+	penaltyAfter     int
+	penaltyBase      time.Duration
+	penaltyMax       time.Duration
+	penaltyReset     time.Duration
+	trustProxies     string
+	sourceRulesPath  string
+	forwardPaths     string
+	acceptRoles      string
+	sniRoutesPath    string
+	virtualHostsPath string
+	listenersPath    string
+	adminSources     string
+	tlsCert          string
+	tlsKey           string
+	tlsMinVersion    string
+	tlsCiphers       string
+	tlsCurves        string
+	tlsALPN          string
+	tlsClientCA      string
+	tlsSPIFFE        bool
+	acmeDomains      string
+	acmeEmail        string
+	acmeCacheDir     string
+	acmeDirectory    string
+	acmeHTTPAddr     string
+	spiffeEndpoint   string
+
+	// Backend flags
+	backendMode     string
+	backendImage    string
+	backendName     string
+	backendVolumes  string
+	backendNetwork  string
+	containerEngine string
+	backendsPath    string
+	backendStandby  string
+	backendHealth   time.Duration
+	rvinfoURL       string
+	rvinfoAudit     string
+	ownerKeyURL     string
+	ownerKeyAudit   string
+
+	// TO0 flags
+	to0TriggerURL   string
+	to0Retries      int
+	rvExpiryWarning time.Duration
 
 	// Passport service flags
 	productPassportBaseURL string
 	commissioningCreateURL string
+	commissioningTemplate  string
+	commissioningQueryURL  string
+	failureReportURL       string
+	registrationURL        string
+	keyRotationURL         string
 	caCertPath             string
+	ledgerPins             string
+	ledgerSPIFFE           bool
+	revocationMode         string
+	revocationTTL          time.Duration
+	revocationTimeout      time.Duration
 	clientCertPath         string
 	clientKeyPath          string
 	enableProductPassport  bool
+	passportDIRecords      bool
 	ownerID                string
+	ownerMapPath           string
+	tagRulesPath           string
+	policiesPath           string
+	geoIPPath              string
+	geoIPReload            time.Duration
+	kittingURL             string
+	kittingRequired        bool
+	verifyPayloads         string
+	observeServiceInfo     bool
+	detectGUIDReuse        bool
+	detectAnomalies        bool
+	anomalyThreshold       float64
+	anomalyLearning        time.Duration
+	anomalyFile            string
+	scrubResponses         bool
+	scrubServer            string
+
+	// Passport cache flags
+	passportCacheTTL    time.Duration
+	prefetchManifest    string
+	prefetchAll         bool
+	prefetchConcurrency int
+	negativeCacheTTL    time.Duration
+	lookupBackoffBase   time.Duration
+	lookupBackoffMax    time.Duration
+
+	// Ledger resilience flags
+	ledgerRetries          int
+	ledgerBreakerThreshold int
+	ledgerBreakerCooldown  time.Duration
+	ledgerOffline          bool
+	ledgerOutbox           string
+	ledgerSyncInterval     time.Duration
+
+	// Ledger HTTP client flags
+	ledgerTimeout             time.Duration
+	ledgerDialTimeout         time.Duration
+	ledgerTLSHandshakeTimeout time.Duration
+	ledgerIdleTimeout         time.Duration
+	ledgerIdleConns           int
+	ledgerMaxConns            int
+	ledgerSessionCache        int
+	ledgerHTTP2               string
+
+	// Ledger DNS flags
+	ledgerDNSServers  string
+	ledgerHosts       string
+	ledgerDNSCacheTTL time.Duration
+	ledgerDNSStaleTTL time.Duration
+
+	// Ledger wire logging flags
+	ledgerWireLog      bool
+	ledgerWireRedact   string
+	ledgerWireKeepChar int
+
+	// Attestation verification flags
+	attestVerifierURL string
+	attestTimeout     time.Duration
+	attestFailOpen    bool
+
+	// Verifiable Credential flags
+	vcIssuerID  string
+	vcIssuerKey string
+	vcKeyID     string
+	vcOutDir    string
+
+	// Onboarding receipt flags
+	receiptKey   string
+	receiptKeyID string
+	receiptDir   string
+	receiptRate  float64
+
+	// Device status flags
+	deviceStatus     bool
+	deviceStatusRate float64
+
+	// Local store flags
+	storePath      string
+	storeDB        string
+	migrateCmd     string
+	migrateAuto    bool
+	storeKeyFile   string
+	reportKeyPath  string
+	reportKeyID    string
+	retainDetails  time.Duration
+	quarantineAt   int
+	quarantineFile string
+	tagsFile       string
+	featuresFile   string
+	banFile        string
+	retainRecords  time.Duration
+	pruneInterval  time.Duration
+
+	// Duplicate DI flags
+	diDuplicates  string
+	diSerialsFile string
+
+	// Event sink flags
+	epcisCaptureURL  string
+	epcisEPCTemplate string
+	epcisReadPoint   string
+	epcisBizLocation string
+	epcisAuth        string
+
+	// Anchoring flags
+	anchorURL      string
+	anchorInterval time.Duration
+	anchorDir      string
+	anchorAuth     string
+	anchorPending  string
+
+	// Reconciliation flags
+	reconcileURL      string
+	reconcileInterval time.Duration
+	reconcileWindow   time.Duration
+	reconcileGrace    time.Duration
+	reconcileRepair   bool
+
+	// Scheduler flags
+	jobsPath string
+
+	// Logging flags
+	logRedact     string
+	logRedactSalt string
+	logSample     string
+	otlpLogsURL   string
+	otlpHeaders   string
+	otlpService   string
+
+	// Alerting flags
+	alertFailureRate   float64
+	alertFailureWindow time.Duration
+	alertFailureMin    int
+	alertBreakerOpen   time.Duration
+	alertGUIDReuse     time.Duration
+	alertRVExpiring    bool
+	alertOutsideWindow time.Duration
+	alertFailover      bool
+	alertBackendDown   time.Duration
+	alertAnomaly       time.Duration
+	alertPagerDutyKey  string
+	alertOpsgenieKey   string
+	alertOpsgenieURL   string
+	alertIncidentRules string
+	alertWebhookURL    string
+	alertSlackURL      string
+	alertEmailTo       string
+	alertEmailFrom     string
+	alertSMTPAddr      string
+	alertSMTPUser      string
+	notifyConfig       string
+	notifySlackURL     string
+	notifyEmailTo      string
+	callbacksPath      string
+
+	// SLO flags
+	sloSuccess  float64
+	sloDuration time.Duration
+	sloWindow   time.Duration
+
+	// StatsD flags
+	statsdAddr   string
+	statsdPrefix string
+	statsdFlavor string
+	statsdTags   string
 
 	// Debug flag
 	debug bool
+
+	// Validation flags
+	validateCfg   bool
+	validateReach bool
+
+	// Version flag
+	showVersion bool
+
+	// Backup flags
+	backupPath   string
+	restorePath  string
+	restoreForce bool
 )
 
 func init() {
 	// Proxy server flags
 	flag.StringVar(&listenAddr, "listen", "localhost:8080", "Address to listen on")
 	flag.StringVar(&fdoPath, "fdo-path", "../go-fdo", "Path to go-fdo repository")
+	flag.StringVar(&adminAddr, "admin-listen", "", "Address for the admin listener serving /metrics and /admin/* (disabled if empty)")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("FDO_PROXY_ADMIN_TOKEN"), "Bearer token required for /admin/* endpoints (default $FDO_PROXY_ADMIN_TOKEN)")
+	flag.StringVar(&adminTokens, "admin-tokens", "", "JSON file of further bearer tokens for /admin/* endpoints, keyed by the principal each authenticates in the admin audit trail")
+	flag.StringVar(&adminAuditFile, "admin-audit-file", "", "JSON Lines file of the tamper-evident trail of admin API changes (default <store-path>.admin-audit.jsonl, in memory without a store)")
+	flag.StringVar(&adminAuditKey, "admin-audit-key", os.Getenv("FDO_PROXY_ADMIN_AUDIT_KEY"), "Secret keying the admin audit trail's hash chain as HMAC-SHA256, so it cannot be rebuilt after an edit (default $FDO_PROXY_ADMIN_AUDIT_KEY; plain SHA-256 if empty)")
+	flag.StringVar(&adminSources, "admin-allow-sources", "", "Comma-separated networks allowed to reach -admin-listen, /metrics included (default: any)")
+	flag.StringVar(&pipelinePath, "pipeline", "", "JSON file declaring the ordered middleware chain and per-middleware options (default: chosen from flags)")
+	flag.IntVar(&inspectLimit, "inspect-limit", 1<<20, "Bytes of a message body middleware inspects; larger bodies stream through with only their start seen (0 buffers every body whole)")
+	flag.DurationVar(&flushEvery, "flush-interval", 0, "How often response bodies are flushed to devices while streaming (0 when the copy buffer fills, -1 after every write)")
+	flag.IntVar(&copyBuffer, "copy-buffer-size", 0, "Size of pooled buffers response bodies are copied through, in bytes (0 allocates 32 KiB per response)")
+	flag.StringVar(&trustProxies, "trusted-proxies", "", "Comma-separated networks of load balancers whose X-Forwarded-For names the device's address, e.g. 10.0.0.0/8")
+	flag.StringVar(&forwardPaths, "forward-paths", "/health", "Comma-separated paths besides FDO messages forwarded to the backend, a trailing /* allowing every path below; others get 404 (* forwards every path)")
+	flag.StringVar(&acceptRoles, "accept-roles", "", "Comma-separated roles this deployment serves (manufacturer, rendezvous, owner); FDO messages of other protocols are refused with 403 (default: all)")
+	flag.StringVar(&sourceRulesPath, "source-rules", "", "JSON file of CIDR allow/deny rules on clients reaching -listen and every -listeners address without source_rules of its own, optionally per protocol, e.g. only the factory subnet may reach DI")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM certificate chain served on -listen; with -tls-key, the listener speaks TLS (plain HTTP if empty)")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM private key for -tls-cert")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", "1.2", "Lowest TLS version the listener accepts: 1.2 or 1.3")
+	flag.StringVar(&tlsCiphers, "tls-cipher-suites", "", "Comma-separated TLS 1.2 cipher suites by IANA name, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 (default: Go's secure suites)")
+	flag.StringVar(&tlsCurves, "tls-curves", "", "Comma-separated key exchange curves in preference order: X25519, P256, P384, P521 (default: Go's)")
+	flag.StringVar(&tlsALPN, "tls-alpn", "", "Comma-separated ALPN protocols in preference order: h2, http/1.1 (default: h2,http/1.1)")
+	flag.BoolVar(&tlsSPIFFE, "tls-spiffe", false, "Serve the X.509 SVID from -spiffe-endpoint on -listen instead of -tls-cert/-tls-key, following its rotations")
+	flag.StringVar(&spiffeEndpoint, "spiffe-endpoint", os.Getenv(spiffe.EndpointEnv), "SPIFFE Workload API address, unix:///path or tcp://host:port (default $"+spiffe.EndpointEnv+")")
+	flag.StringVar(&acmeDomains, "acme-domains", "", "Comma-separated domains to obtain and renew a certificate for on -listen from an ACME CA instead of -tls-cert/-tls-key (disabled if empty)")
+	flag.StringVar(&acmeEmail, "acme-email", "", "Contact email for the ACME account, receiving expiry notices")
+	flag.StringVar(&acmeCacheDir, "acme-cache-dir", "", "Directory keeping the ACME account key and certificate across restarts (required with -acme-domains)")
+	flag.StringVar(&acmeDirectory, "acme-directory", acme.LetsEncrypt, "ACME directory URL of the CA")
+	flag.StringVar(&acmeHTTPAddr, "acme-http-listen", "", "Address answering ACME http-01 challenges and redirecting other requests to HTTPS, e.g. :80 (default: tls-alpn-01 on -listen only)")
+	flag.StringVar(&sniRoutesPath, "sni-routes", "", "JSON file mapping TLS server names on -listen to a backend role, middleware pipeline and certificate each, e.g. mfg.example.com to the manufacturer")
+	flag.StringVar(&virtualHostsPath, "virtual-hosts", "", "JSON file mapping Host headers on -listen to a backend role or URL and middleware pipeline each, e.g. one port fronting a manufacturer and an owner server")
+	flag.StringVar(&listenersPath, "listeners", "", "JSON file of further addresses to listen on, each with its own TLS certificate, accepted roles, backend and middleware pipeline, e.g. DI on the factory network and TO2 over TLS from the field")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "PEM CA certificates devices must present a client certificate from (device mTLS disabled if empty)")
+	flag.IntVar(&maxSessions, "max-sessions", 0, "Most FDO sessions in flight at once; the first message of any further session is refused (0 for no limit)")
+	flag.Float64Var(&rateLimitSource, "rate-limit-source", 0, "Most FDO sessions one client address may start per minute; further sessions are refused with 429 (0 for no limit)")
+	flag.Float64Var(&rateLimitDevice, "rate-limit-device", 0, "Most FDO sessions one device may start per minute, by GUID or, in DI, serial number (0 for no limit)")
+	flag.StringVar(&rateLimitRedis, "rate-limit-redis", os.Getenv("FDO_PROXY_RATE_LIMIT_REDIS"), "Redis URL keeping the buckets of -rate-limit-source, -rate-limit-device and policy rate limits, the bans and -penalty-after failures, so every proxy using it enforces them together (default $FDO_PROXY_RATE_LIMIT_REDIS; per proxy if empty)")
+	flag.IntVar(&penaltyAfter, "penalty-after", 0, "Ban a device from starting sessions after this many failed DI or TO2 attempts in a row, for longer after each further failure (disabled if 0)")
+	flag.DurationVar(&penaltyBase, "penalty-base", time.Minute, "First ban of -penalty-after; each further failure doubles it")
+	flag.DurationVar(&penaltyMax, "penalty-max", time.Hour, "Longest ban of -penalty-after")
+	flag.DurationVar(&penaltyReset, "penalty-reset", 24*time.Hour, "Forget a device's failures once it has gone this long without one and is not banned")
+
+	// Backend flags
+	flag.StringVar(&backendMode, "backend", "process", "How the go-fdo server is run: process (go run in -fdo-path), container, or inprocess (go-fdo linked into this binary, built with -tags gofdo)")
+	flag.StringVar(&backendImage, "backend-image", "", "go-fdo server image for -backend=container")
+	flag.StringVar(&backendName, "backend-container-name", "fdo-proxy-backend", "Name of the backend container, replaced if it exists")
+	flag.StringVar(&backendVolumes, "backend-volumes", "", "Comma-separated host-path:container-path[:ro] bind mounts for the backend container; mount /data to keep its database")
+	flag.StringVar(&backendNetwork, "backend-network", "", "Network the backend container joins (default: engine default)")
+	flag.StringVar(&backendsPath, "backends", "", "JSON file with a backend per FDO role (manufacturer, rendezvous, owner), routed to by protocol (default: one backend for every protocol)")
+	flag.StringVar(&backendStandby, "backend-standby", "", "URL of a standby FDO server taking new sessions while the backend fails its health checks, e.g. http://10.0.0.6:8080 (disabled if empty)")
+	flag.DurationVar(&backendHealth, "backend-health-interval", 10*time.Second, "How often a backend with a standby, or every backend with -alert-backend-down, is health-checked; it is down, and fails over, after 3 failed checks in a row")
+	flag.StringVar(&rvinfoURL, "rvinfo-url", "", "Manufacturer backend endpoint holding the RVInfo put in new vouchers, served as /admin/rvinfo (disabled if empty)")
+	flag.StringVar(&rvinfoAudit, "rvinfo-audit", "", "JSON Lines file recording RVInfo changes (default: <store-path>.rvinfo.jsonl, in memory without -store-path)")
+	flag.StringVar(&ownerKeyURL, "owner-key-url", "", "Owner backend endpoint rotating the owner key and re-signing outstanding vouchers, served as /admin/owner-key (disabled if empty)")
+	flag.StringVar(&ownerKeyAudit, "owner-key-audit", "", "JSON Lines file recording owner key rotations (default: <store-path>.ownerkey.jsonl, in memory without -store-path)")
+	flag.StringVar(&containerEngine, "container-engine", "", "Docker or Podman API endpoint, unix:///path or tcp://host:port (default: $DOCKER_HOST, else "+backend.DefaultEngineHost+")")
+
+	// TO0 flags
+	flag.StringVar(&to0TriggerURL, "to0-trigger-url", "", "Owner backend URL POSTed after each device completes DI to register it at the rendezvous server; {guid} is replaced (disabled if empty)")
+	flag.IntVar(&to0Retries, "to0-retries", 3, "Extra attempts when the owner backend does not have the voucher yet or fails")
+	flag.DurationVar(&rvExpiryWarning, "rv-expiry-warning", 0, "Warn this long before a device's rendezvous registration expires without the device having completed TO2 (disabled if 0)")
 
 	// Passport service flags
 	flag.StringVar(&productPassportBaseURL, "product-base-url", "", "Base URL for product item passport service (e.g., https://cmulk1.cymanii.org:8443)")
 	flag.StringVar(&commissioningCreateURL, "commissioning-url", "", "URL for commissioning passport creation (e.g., http://cmulk1.cymanii.org:8000/create-commissioning-passport)")
+	flag.StringVar(&commissioningTemplate, "commissioning-template", "", "Go template file rendering the JSON body of commissioning passport requests, for ledgers expecting another shape (default: the passport service's)")
+	flag.StringVar(&commissioningQueryURL, "commissioning-query-url", "", "Passport service endpoint answering which commissioning passports exist for a controller UUID, checked before offline sync and reconciliation send one again (disabled if empty)")
+	flag.StringVar(&registrationURL, "registration-url", "", "URL receiving rendezvous registration records for devices registered through -to0-trigger-url (disabled if empty)")
+	flag.StringVar(&keyRotationURL, "key-rotation-url", "", "URL receiving owner key rotation records for rotations made through -owner-key-url (disabled if empty)")
+	flag.StringVar(&failureReportURL, "failure-url", "", "URL receiving onboarding failure records (DI rejected, TO2 aborted, attestation rejected, passport mismatch) (disabled if empty)")
 	flag.StringVar(&caCertPath, "ca-cert", "", "Path to CA cert PEM for product passport mTLS")
+	flag.StringVar(&ledgerPins, "ledger-pins", "", "Comma-separated spki-sha256:<digest> or cert-sha256:<digest> pins; the product passport service's verified chain must contain a match (disabled if empty)")
+	flag.BoolVar(&ledgerSPIFFE, "ledger-spiffe", false, "Present the X.509 SVID from -spiffe-endpoint to the product passport service instead of -client-cert/-client-key")
+	flag.StringVar(&revocationMode, "revocation-check", "off", "Check OCSP/CRL revocation of the passport service and device mTLS certificates: off, soft (allow when status is unknown) or hard (refuse)")
+	flag.DurationVar(&revocationTTL, "revocation-cache-ttl", time.Hour, "Longest time a revocation answer is cached; responders' next update is honored when sooner")
+	flag.DurationVar(&revocationTimeout, "revocation-timeout", 5*time.Second, "Timeout for revocation checks of one certificate")
 	flag.StringVar(&clientCertPath, "client-cert", "", "Path to client cert PEM for product passport mTLS")
 	flag.StringVar(&clientKeyPath, "client-key", "", "Path to client key PEM for product passport mTLS")
 	flag.BoolVar(&enableProductPassport, "enable-product-passport", false, "Enable product item passport lookup during DI")
+	flag.BoolVar(&passportDIRecords, "passport-di-records", false, "Append an \"FDO DI COMPLETED\" record to the product item passport of each device completing DI (requires -product-base-url)")
 	flag.StringVar(&ownerID, "owner-id", "", "Owner ID for commissioning passports")
+	flag.StringVar(&kittingURL, "kitting-url", "", "Owner backend ServiceInfo module API receiving product passport configuration records before TO2; {guid} is replaced (disabled if empty)")
+	flag.BoolVar(&kittingRequired, "kitting-required", false, "Refuse TO2.HelloDevice when passport configuration cannot be delivered, instead of onboarding without it")
+	flag.StringVar(&ownerMapPath, "owner-map", "", "JSON file assigning devices to owners by GUID, serial or product ID, ahead of the product passport's owner and -owner-id")
+	flag.StringVar(&tagRulesPath, "tag-rules", "", "JSON file tagging devices by serial number prefix or product ID, on top of product passport and admin API tags")
+	flag.StringVar(&policiesPath, "policies", "", "JSON file scoping passport enforcement, attestation, rate limits and commissioning destinations to device tags")
+	flag.StringVar(&geoIPPath, "geoip-db", "", "MaxMind database (.mmdb) or CSV file of network,country locating device addresses for geofences, events and commissioning passports (disabled if empty)")
+	flag.DurationVar(&geoIPReload, "geoip-reload-interval", time.Minute, "How often -geoip-db is checked for changes and reloaded (0 disables)")
+	flag.BoolVar(&observeServiceInfo, "observe-serviceinfo", true, "Record FSIM modules and sizes exchanged in TO2 ServiceInfo per session")
+	flag.StringVar(&verifyPayloads, "verify-payloads", "off", "Check fdo.download/fdo.wget files against the product passport's artifact digests: off, flag or fail")
+	flag.BoolVar(&detectGUIDReuse, "detect-guid-reuse", false, "Flag TO2 from a GUID already in flight from another source or already onboarded (per -store-path)")
+	flag.BoolVar(&detectAnomalies, "detect-anomalies", false, "Raise anomaly events for onboarding rate spikes, failure bursts, unusual hours and new source networks")
+	flag.Float64Var(&anomalyThreshold, "anomaly-threshold", 4, "Standard deviations above the learned baseline at which attempts or failures in 5 minutes are a spike or burst")
+	flag.DurationVar(&anomalyLearning, "anomaly-learning", 7*24*time.Hour, "How long -detect-anomalies learns the baseline before raising anomalies")
+	flag.StringVar(&anomalyFile, "anomaly-file", "", "JSON file persisting the -detect-anomalies baseline (default <store-path>.anomaly.json, in memory without a store)")
+	flag.BoolVar(&scrubResponses, "scrub-responses", false, "Remove headers naming the backend software (Server, X-Powered-By, ...) and stack traces in error bodies from responses")
+	flag.StringVar(&scrubServer, "scrub-server", "", "Server header sent instead of the backend's with -scrub-responses (none if empty)")
+
+	// Passport cache flags
+	flag.DurationVar(&passportCacheTTL, "passport-cache-ttl", 0, "How long to cache product item passports (0 disables caching)")
+	flag.StringVar(&prefetchManifest, "prefetch-manifest", "", "CSV or JSON manifest of product UUIDs to preload into the passport cache at startup")
+	flag.BoolVar(&prefetchAll, "prefetch-all", false, "Preload every product passport the service lists into the passport cache at startup, page by page, instead of those of -prefetch-manifest")
+	flag.IntVar(&prefetchConcurrency, "prefetch-concurrency", 8, "Number of concurrent passport lookups during prefetch")
+	flag.DurationVar(&negativeCacheTTL, "passport-negative-ttl", 30*time.Second, "How long to remember that a product passport was not found (0 disables)")
+	flag.DurationVar(&lookupBackoffBase, "passport-backoff-base", time.Second, "Initial backoff after a failed passport lookup for a UUID (0 disables)")
+	flag.DurationVar(&lookupBackoffMax, "passport-backoff-max", time.Minute, "Maximum backoff between failed passport lookups for a UUID")
+
+	// Ledger resilience flags
+	flag.IntVar(&ledgerRetries, "ledger-retries", 0, "Extra attempts for product passport lookups on network errors or 5xx responses")
+	flag.IntVar(&ledgerBreakerThreshold, "ledger-breaker-threshold", 5, "Consecutive ledger failures that open an endpoint's circuit breaker (0 disables)")
+	flag.DurationVar(&ledgerBreakerCooldown, "ledger-breaker-cooldown", 30*time.Second, "How long an open ledger circuit breaker waits before a trial request")
+	flag.BoolVar(&ledgerOffline, "ledger-offline", false, "Keep onboarding while the passport service is unreachable, queueing passport writes and lookups and syncing them once it is back")
+	flag.StringVar(&ledgerOutbox, "ledger-outbox", "", "JSON Lines file persisting work queued by -ledger-offline (default <store-path>.ledger-outbox.json, in memory without a store)")
+	flag.DurationVar(&ledgerSyncInterval, "ledger-sync-interval", 30*time.Second, "How often -ledger-offline tries to sync queued work")
+
+	// Ledger HTTP client flags
+	flag.DurationVar(&ledgerTimeout, "ledger-timeout", 30*time.Second, "Timeout for a whole ledger request, reading the response included")
+	flag.DurationVar(&ledgerDialTimeout, "ledger-dial-timeout", 30*time.Second, "Timeout for opening a connection to the passport service")
+	flag.DurationVar(&ledgerTLSHandshakeTimeout, "ledger-tls-handshake-timeout", 10*time.Second, "Timeout for the TLS handshake with the passport service")
+	flag.DurationVar(&ledgerIdleTimeout, "ledger-idle-timeout", 90*time.Second, "How long an idle ledger connection is kept for reuse")
+	flag.IntVar(&ledgerIdleConns, "ledger-idle-conns", 2, "Idle ledger connections kept per host")
+	flag.IntVar(&ledgerMaxConns, "ledger-max-conns", 0, "Maximum ledger connections per host (0 for no limit)")
+	flag.IntVar(&ledgerSessionCache, "ledger-tls-session-cache", 0, "TLS sessions kept for resuming ledger connections without a full handshake (0 disables)")
+	flag.StringVar(&ledgerHTTP2, "ledger-http2", "auto", "HTTP/2 for ledger connections: auto, on or off")
+
+	// Ledger DNS flags
+	flag.StringVar(&ledgerDNSServers, "ledger-dns-servers", "", "Comma-separated DNS servers (host or host:port) asked in turn for the ledger hosts instead of the system resolver")
+	flag.StringVar(&ledgerHosts, "ledger-hosts", "", "Comma-separated host=address pairs pinning ledger hosts to IP addresses without asking DNS")
+	flag.DurationVar(&ledgerDNSCacheTTL, "ledger-dns-cache-ttl", 0, "How long resolved ledger host addresses are reused (0 disables)")
+	flag.DurationVar(&ledgerDNSStaleTTL, "ledger-dns-stale-ttl", 0, "How long after resolving them ledger host addresses are still used when DNS fails (0 disables)")
+
+	// Ledger wire logging flags
+	flag.BoolVar(&ledgerWireLog, "ledger-wire-log", false, "Log ledger request/response bodies at debug level (requires -debug or the debug_logging feature flag)")
+	flag.StringVar(&ledgerWireRedact, "ledger-wire-redact", "signature,cert", "Comma-separated JSON fields truncated in ledger wire logs")
+	flag.IntVar(&ledgerWireKeepChar, "ledger-wire-keep", 12, "Leading characters kept when truncating redacted ledger fields")
+
+	// Attestation verification flags
+	flag.StringVar(&attestVerifierURL, "attestation-verifier-url", "", "URL of an external verifier consulted on TO2.ProveDevice (disabled if empty)")
+	flag.DurationVar(&attestTimeout, "attestation-timeout", 5*time.Second, "Timeout for attestation verifier calls")
+	flag.BoolVar(&attestFailOpen, "attestation-fail-open", false, "Let devices proceed when the attestation verifier errors (explicit rejections always stop the device)")
+
+	// Verifiable Credential flags
+	flag.StringVar(&vcIssuerID, "vc-issuer-id", "", "Issuer identifier (DID or URL) for onboarding credentials")
+	flag.StringVar(&vcIssuerKey, "vc-issuer-key", "", "PEM private key (EC P-256/P-384, Ed25519 or RSA) that signs onboarding credentials (disabled if empty)")
+	flag.StringVar(&vcKeyID, "vc-key-id", "", "Key ID placed in the credential JWT header")
+	flag.StringVar(&vcOutDir, "vc-out-dir", "", "Directory to also store issued credentials as <guid>.jwt")
+
+	// Onboarding receipt flags
+	flag.StringVar(&receiptKey, "receipt-key", "", "PEM private key (EC P-256/P-384, Ed25519 or RSA) that signs the COSE onboarding receipts devices fetch from /receipts/{guid} (disabled if empty)")
+	flag.StringVar(&receiptKeyID, "receipt-key-id", "", "Key ID placed in the receipt COSE header")
+	flag.StringVar(&receiptDir, "receipt-dir", "", "Directory keeping onboarding receipts as <guid>.cose (default <store-path>.receipts, in memory without a store)")
+	flag.Float64Var(&receiptRate, "receipt-rate", 10, "Most receipt requests one client address may make per minute (0 for no limit)")
+
+	// Device status flags
+	flag.BoolVar(&deviceStatus, "device-status", false, "Answer devices and installer apps asking for their onboarding status at /status/{guid}?nonce=<NonceTO2ProveOV>")
+	flag.Float64Var(&deviceStatusRate, "device-status-rate", 10, "Most status requests one client address may make per minute (0 for no limit)")
+
+	// Local store flags
+	flag.StringVar(&storePath, "store-path", "", "JSON Lines file recording onboarding history for reports and exports (disabled if empty)")
+	flag.StringVar(&storeDB, "store-db", os.Getenv("FDO_PROXY_STORE_DB"), "PostgreSQL URL keeping onboarding history and the -ledger-offline outbox, shared by every proxy using it; instead of -store-path (default $FDO_PROXY_STORE_DB)")
+	flag.StringVar(&migrateCmd, "migrate", "", "Migrate the -store-db schema and exit: up, down (revert the last migration), a version to go to, or status")
+	flag.BoolVar(&migrateAuto, "migrate-auto", true, "Apply pending -store-db schema migrations at startup; if false the proxy refuses to start on an outdated schema")
+	flag.StringVar(&storeKeyFile, "store-key-file", "", "File holding a 32-byte key (raw, hex or base64) that encrypts the local store and ledger outbox at rest (or set $FDO_PROXY_STORE_KEY)")
+	flag.StringVar(&reportKeyPath, "report-signing-key", "", "PEM private key that signs compliance reports (defaults to -vc-issuer-key)")
+	flag.StringVar(&reportKeyID, "report-key-id", "", "Key ID placed in the report signature header")
+	flag.DurationVar(&retainDetails, "retain-details", 7*24*time.Hour, "How long per-session detail (evidence, source IP, serial) is kept in the local store (0 keeps forever)")
+	flag.DurationVar(&retainRecords, "retain-records", 365*24*time.Hour, "How long onboarding record summaries are kept in the local store (0 keeps forever)")
+	flag.IntVar(&quarantineAt, "quarantine-after", 0, "Quarantine a device after this many consecutive failed onboardings in the local store (disabled if 0)")
+	flag.StringVar(&quarantineFile, "quarantine-file", "", "JSON file persisting quarantined devices (default <store-path>.quarantine.json, in memory without a store)")
+	flag.StringVar(&tagsFile, "tags-file", "", "JSON file persisting device tags assigned through the admin API (default <store-path>.tags.json, in memory without a store)")
+	flag.StringVar(&banFile, "ban-file", "", "JSON file persisting the client addresses and devices banned through the admin API or by -penalty-after (default <store-path>.bans.json, in memory without a store; in Redis with -rate-limit-redis)")
+	flag.StringVar(&featuresFile, "features-file", "", "JSON file persisting feature flags switched through the admin API (default <store-path>.features.json, in memory without a store)")
+	flag.DurationVar(&pruneInterval, "prune-interval", time.Hour, "How often retention is applied to the local store")
+
+	// Duplicate DI flags
+	flag.StringVar(&diDuplicates, "di-duplicates", "off", "Handling of DI.AppStart for serial numbers that already completed DI: off, flag or block")
+	flag.StringVar(&diSerialsFile, "di-serials-file", "", "JSON Lines file of serial numbers that completed DI (default <store-path>.serials.jsonl, in memory without a store)")
+
+	// Event sink flags
+	flag.StringVar(&epcisCaptureURL, "epcis-capture-url", "", "EPCIS 2.0 capture endpoint for commissioning/decommissioning events (disabled if empty)")
+	flag.StringVar(&epcisEPCTemplate, "epcis-epc-template", "urn:uuid:{guid}", "EPC for a device in EPCIS events; {guid} is replaced with the device GUID")
+	flag.StringVar(&epcisReadPoint, "epcis-read-point", "", "EPCIS readPoint id attached to events (e.g. an SGLN URN)")
+	flag.StringVar(&epcisBizLocation, "epcis-biz-location", "", "EPCIS bizLocation id attached to events")
+	flag.StringVar(&epcisAuth, "epcis-auth", os.Getenv("FDO_PROXY_EPCIS_AUTH"), "Authorization header value for the EPCIS capture interface (default $FDO_PROXY_EPCIS_AUTH)")
+
+	// Anchoring flags
+	flag.StringVar(&anchorURL, "anchor-url", "", "Chain/notary endpoint receiving Merkle roots of commissioning passports (disabled if empty)")
+	flag.DurationVar(&anchorInterval, "anchor-interval", time.Hour, "How often pending commissioning passports are anchored")
+	flag.StringVar(&anchorDir, "anchor-dir", "", "Directory for anchored batch records with inclusion proofs")
+	flag.StringVar(&anchorPending, "anchor-pending-file", "", "JSON Lines file keeping commissioning passport hashes not yet anchored (default <store-path>.anchor-pending.jsonl, in memory without a store)")
+	flag.StringVar(&anchorAuth, "anchor-auth", os.Getenv("FDO_PROXY_ANCHOR_AUTH"), "Authorization header value for the anchoring endpoint (default $FDO_PROXY_ANCHOR_AUTH)")
+	flag.StringVar(&reconcileURL, "reconcile-url", "", "Passport service endpoint listing commissioning passports, compared with the local store on schedule (disabled if empty, requires -store-path)")
+	flag.DurationVar(&reconcileInterval, "reconcile-interval", 24*time.Hour, "How often local records are reconciled with the passport service")
+	flag.DurationVar(&reconcileWindow, "reconcile-window", 7*24*time.Hour, "How far back onboardings are reconciled")
+	flag.DurationVar(&reconcileGrace, "reconcile-grace", 10*time.Minute, "Onboardings more recent than this are left for the next reconciliation")
+	flag.BoolVar(&reconcileRepair, "reconcile-repair", false, "Create commissioning passports missing from the passport service again from the local records")
+
+	// Scheduler flags
+	flag.StringVar(&jobsPath, "jobs", "", "JSON file of cron-style schedules for the recurring jobs (prune, anchor, ledger-sync, reconcile, prefetch), enabling or disabling each")
+
+	// Logging flags
+	flag.StringVar(&logRedact, "log-redact", "off", "Redact device GUIDs, serial numbers and client IPs in logs: off, hash or truncate")
+	flag.StringVar(&logRedactSalt, "log-redact-salt", os.Getenv("FDO_PROXY_LOG_REDACT_SALT"), "Secret keying -log-redact=hash (default $FDO_PROXY_LOG_REDACT_SALT)")
+
+	flag.StringVar(&logSample, "log-sample", "", "Keep 1 in N routine per-message logs by FDO message type, e.g. 68=100,69=100 or *=10 (warnings and lifecycle logs are always kept)")
+
+	flag.StringVar(&otlpLogsURL, "otlp-logs-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_LOGS_ENDPOINT"), "OTLP/HTTP logs endpoint to also ship logs to, e.g. http://collector:4318/v1/logs (default $OTEL_EXPORTER_OTLP_LOGS_ENDPOINT)")
+	flag.StringVar(&otlpHeaders, "otlp-headers", os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), "Comma-separated key=value headers for OTLP export (default $OTEL_EXPORTER_OTLP_HEADERS)")
+	flag.StringVar(&otlpService, "otlp-service-name", "fdo-proxy", "service.name resource attribute for exported logs")
+
+	// Alerting flags
+	flag.Float64Var(&alertFailureRate, "alert-failure-rate", 0, "Alert when this fraction of onboardings fail within -alert-failure-window, e.g. 0.2 (disabled if 0)")
+	flag.DurationVar(&alertFailureWindow, "alert-failure-window", 15*time.Minute, "Sliding window for -alert-failure-rate")
+	flag.IntVar(&alertFailureMin, "alert-failure-min", 10, "Minimum onboardings in the window before -alert-failure-rate can fire")
+	flag.DurationVar(&alertBreakerOpen, "alert-breaker-open", 0, "Alert when a ledger circuit breaker stays open this long (disabled if 0)")
+	flag.DurationVar(&alertGUIDReuse, "alert-guid-reuse", 0, "Alert for this long after a device GUID is seen reused (requires -detect-guid-reuse, disabled if 0)")
+	flag.DurationVar(&alertAnomaly, "alert-anomaly", 0, "Alert for this long after unusual onboarding activity is detected (requires -detect-anomalies, disabled if 0)")
+	flag.BoolVar(&alertRVExpiring, "alert-rv-expiring", false, "Alert while rendezvous registrations are about to expire before TO2 (requires -rv-expiry-warning)")
+	flag.DurationVar(&alertOutsideWindow, "alert-outside-window", 0, "Alert for this long after a device is refused outside its -policies windows (disabled if 0)")
+	flag.BoolVar(&alertFailover, "alert-backend-failover", false, "Alert while new sessions go to a standby backend because the primary fails its health checks")
+	flag.DurationVar(&alertBackendDown, "alert-backend-down", 0, "Alert when a backend, or every member of a backend pool, fails its health checks this long, e.g. 2m; backends are then checked every -backend-health-interval (disabled if 0)")
+	flag.StringVar(&alertPagerDutyKey, "alert-pagerduty-key", os.Getenv("FDO_PROXY_ALERT_PAGERDUTY_KEY"), "PagerDuty Events API v2 routing key; -alert-incident-rules open and resolve incidents (default $FDO_PROXY_ALERT_PAGERDUTY_KEY)")
+	flag.StringVar(&alertOpsgenieKey, "alert-opsgenie-key", os.Getenv("FDO_PROXY_ALERT_OPSGENIE_KEY"), "Opsgenie API integration key; -alert-incident-rules create and close alerts (default $FDO_PROXY_ALERT_OPSGENIE_KEY)")
+	flag.StringVar(&alertOpsgenieURL, "alert-opsgenie-url", alert.OpsgenieURL, "Opsgenie API URL, https://api.eu.opsgenie.com for the EU region")
+	flag.StringVar(&alertIncidentRules, "alert-incident-rules", "backend_down,ledger_breaker_open", "Comma-separated alert rules that open incidents in PagerDuty and Opsgenie")
+	flag.StringVar(&alertWebhookURL, "alert-webhook-url", "", "URL receiving alert state changes as JSON POSTs")
+	flag.StringVar(&alertSlackURL, "alert-slack-webhook", os.Getenv("FDO_PROXY_ALERT_SLACK_WEBHOOK"), "Slack incoming webhook URL for alerts (default $FDO_PROXY_ALERT_SLACK_WEBHOOK)")
+	flag.StringVar(&alertEmailTo, "alert-email-to", "", "Comma-separated recipients for alert emails")
+	flag.StringVar(&alertEmailFrom, "alert-email-from", "fdo-proxy@localhost", "Sender address for alert and notification emails")
+	flag.StringVar(&alertSMTPAddr, "alert-smtp-addr", "localhost:25", "SMTP server (host:port) for alert and notification emails")
+	flag.StringVar(&alertSMTPUser, "alert-smtp-user", "", "SMTP username; the password is read from $FDO_PROXY_SMTP_PASSWORD")
+	flag.StringVar(&notifyConfig, "notify-config", "", "JSON file choosing the onboarding notifications to send (onboarded, denied, ledger_outage, anomaly), their channels and templates (disabled if empty)")
+	flag.StringVar(&notifySlackURL, "notify-slack-webhook", os.Getenv("FDO_PROXY_NOTIFY_SLACK_WEBHOOK"), "Slack incoming webhook URL for notifications (default $FDO_PROXY_NOTIFY_SLACK_WEBHOOK)")
+	flag.StringVar(&notifyEmailTo, "notify-email-to", "", "Comma-separated recipients for notification emails, sent through -alert-smtp-addr")
+	flag.StringVar(&callbacksPath, "callbacks", "", "JSON file of callback URLs called, per owner, with a templated payload when a device completes onboarding (disabled if empty)")
+
+	// SLO flags
+	flag.Float64Var(&sloSuccess, "slo-success", 0, "Onboarding SLO: the share of TO2 attempts that must complete over -slo-window, e.g. 0.99 (disabled if 0)")
+	flag.DurationVar(&sloDuration, "slo-duration", 0, "Onboarding SLO: the p95 duration of completed TO2 sessions over -slo-window, e.g. 90s (disabled if 0)")
+	flag.DurationVar(&sloWindow, "slo-window", 30*24*time.Hour, "Window the -slo-success and -slo-duration error budgets are counted over; at least 24h")
+
+	// StatsD flags
+	flag.StringVar(&statsdAddr, "statsd-addr", "", "StatsD/DogStatsD agent UDP address receiving the same metrics as /metrics (disabled if empty)")
+	flag.StringVar(&statsdPrefix, "statsd-prefix", "", "Prefix prepended to StatsD metric names (e.g. fdo.)")
+	flag.StringVar(&statsdFlavor, "statsd-flavor", metrics.FlavorStatsD, "StatsD dialect: statsd (labels folded into names) or dogstatsd (labels as tags)")
+	flag.StringVar(&statsdTags, "statsd-tags", "", "Comma-separated key:value tags added to every metric (dogstatsd only)")
 
 	// Debug flag
 	flag.BoolVar(&debug, "debug", false, "Enable debug logging")
+
+	// Validation flags
+	flag.BoolVar(&validateCfg, "validate-config", false, "Load and check the configuration (flags, files, certificates, keys, URLs), print a report and exit non-zero if anything is wrong, without starting")
+	flag.BoolVar(&validateReach, "validate-reachability", false, "With -validate-config, also check that the host of every configured URL accepts connections")
+
+	// Version flag
+	flag.BoolVar(&showVersion, "version", false, "Print the version and commit of the proxy and the detected go-fdo backend versions, and exit")
+
+	// Backup flags
+	flag.StringVar(&backupPath, "backup", "", "Write the local store, ledger outbox, device state files, audit trails, receipts, credentials, pending and anchored passport hashes and the ACME cache to this .tar.gz file and exit")
+	flag.StringVar(&restorePath, "restore", "", "Restore a -backup archive into the state file paths of these flags and exit; the proxy must be stopped")
+	flag.BoolVar(&restoreForce, "restore-force", false, "Let -restore replace existing state files")
 }
 
 func main() {
 	flag.Parse()
+	snapshotFlags()
+	deriveStatePaths()
+	if showVersion {
+		printVersion()
+		return
+	}
+	if validateCfg {
+		os.Exit(validateConfig())
+	}
+	if errs := checkFlags(); len(errs) > 0 {
+		for _, err := range errs {
+			slog.Error("Invalid flag", "flag", err.flag, "error", err.err)
+		}
+		os.Exit(1)
+	}
+	if backupPath != "" {
+		os.Exit(runBackup(backupPath))
+	}
+	if restorePath != "" {
+		os.Exit(runRestore(restorePath))
+	}
+	if migrateCmd != "" {
+		os.Exit(runMigrate(migrateCmd))
+	}
 
 	// Setup logging
+	logs, err := loadLogging()
+	if err != nil {
+		slog.Error("Invalid logging flags", "error", err)
+		os.Exit(1)
+	}
+	// The level can be switched at runtime by the debug_logging feature flag
+	var logLevel slog.LevelVar
 	if debug {
-		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})))
+		logLevel.Set(slog.LevelDebug)
+	}
+	if debug || logs.redact != logging.ModeOff || len(logs.sample) > 0 || otlpLogsURL != "" {
+		var h slog.Handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: &logLevel})
+		if otlpLogsURL != "" {
+			exp := logging.NewOTLPExporter(logging.OTLPOptions{
+				Endpoint:    otlpLogsURL,
+				Headers:     logs.otlpHeaders,
+				ServiceName: otlpService,
+			})
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				exp.Close(ctx)
+			}()
+			h = logging.Tee(h, exp.Handler(&logLevel))
+		}
+		h = logging.Handler(h, logging.NewRedactor(logs.redact, logRedactSalt))
+		slog.SetDefault(slog.New(logging.SampleHandler(h, logs.sample)))
+		if logs.redact == logging.ModeHash && logRedactSalt == "" {
+			slog.Warn("-log-redact=hash without -log-redact-salt; hashed serials and IPs can be reversed by brute force")
+		}
+	}
+
+	// Workload identity from SPIFFE
+	var svids *spiffe.Source
+	if tlsSPIFFE || ledgerSPIFFE {
+		svids, err = spiffe.Open(context.Background(), spiffeEndpoint)
+		if err != nil {
+			slog.Error("Failed to fetch X.509 SVID", "endpoint", spiffeEndpoint, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Revocation checks for mTLS peers
+	revocationChecker, err := loadRevocation()
+	if err != nil {
+		slog.Error("Invalid revocation flags", "error", err)
+		os.Exit(1)
 	}
 
 	// Initialize passport client if configured
 	var ledgerClient proxy.LedgerClient
-	if productPassportBaseURL != "" || commissioningCreateURL != "" {
+	var passportClient *ledger.Client
+	if productPassportBaseURL != "" || commissioningCreateURL != "" || failureReportURL != "" || registrationURL != "" || keyRotationURL != "" || reconcileURL != "" || commissioningQueryURL != "" {
+		settings, err := loadLedger()
+		if err != nil {
+			slog.Error("Invalid ledger flags", "error", err)
+			os.Exit(1)
+		}
 		c, err := ledger.NewClient(productPassportBaseURL, commissioningCreateURL, caCertPath, clientCertPath, clientKeyPath)
 		if err != nil {
 			slog.Warn("Passport client init failed", "error", err)
 		} else {
+			if (prefetchManifest != "" || prefetchAll) && passportCacheTTL <= 0 {
+				// Prefetching is pointless without somewhere to keep the results
+				passportCacheTTL = 12 * time.Hour
+				slog.Warn("Prefetch given without -passport-cache-ttl, caching for one shift", "ttl", passportCacheTTL)
+			}
+			if ledgerSPIFFE {
+				c.UseClientCertificate(svids.GetClientCertificate)
+			}
+			c.PinServer(settings.pins)
+			if revocationChecker != nil {
+				c.CheckRevocation(revocationChecker)
+			}
+			c.TuneHTTP(settings.http)
+			if settings.resolving() {
+				dns := settings.dns
+				c.UseResolver(dns)
+				slog.Info("Ledger hosts resolved by the proxy", "dns_servers", dns.Servers, "pinned_hosts", len(dns.Hosts), "cache_ttl", dns.CacheTTL, "stale_ttl", dns.StaleTTL)
+			}
+			c.EnableCache(passportCacheTTL)
+			c.EnableLookupBackoff(negativeCacheTTL, lookupBackoffBase, lookupBackoffMax)
+			c.EnableRetries(ledgerRetries)
+			c.EnableBreaker(ledgerBreakerThreshold, ledgerBreakerCooldown)
+			if ledgerOffline {
+				kw, err := storeKeyWrapper()
+				if err != nil {
+					slog.Error("Failed to load store key", "error", err)
+					os.Exit(1)
+				}
+				var outbox *ledger.Outbox
+				where := ledgerOutbox
+				if ledgerOutbox == "" && storeDB != "" {
+					db, err := openStoreDB()
+					if err == nil {
+						outbox, err = ledger.OpenSharedOutbox(context.Background(), db, kw)
+					}
+					if err != nil {
+						slog.Error("Failed to open shared ledger outbox", "error", err)
+						os.Exit(1)
+					}
+					where = db.String()
+				} else {
+					outbox, err = ledger.OpenOutbox(ledgerOutbox, kw)
+					if err != nil {
+						slog.Error("Failed to open ledger outbox", "path", ledgerOutbox, "error", err)
+						os.Exit(1)
+					}
+				}
+				c.EnableOffline(outbox)
+				slog.Info("Ledger offline mode enabled", "outbox", where, "sync_interval", ledgerSyncInterval, "offline", outbox.Offline())
+			}
+			c.EnableFailureReports(failureReportURL)
+			c.EnableRegistrationReports(registrationURL)
+			c.EnableKeyRotationReports(keyRotationURL)
+			c.EnableCommissioningList(reconcileURL)
+			c.EnableCommissioningQuery(commissioningQueryURL)
+			if commissioningTemplate != "" {
+				t, err := ledger.LoadCommissioningTemplate(commissioningTemplate)
+				if err != nil {
+					slog.Error("Invalid -commissioning-template", "path", commissioningTemplate, "error", err)
+					os.Exit(1)
+				}
+				c.UseCommissioningTemplate(t)
+				slog.Info("Commissioning requests shaped by template", "path", commissioningTemplate)
+			}
+			if ledgerWireLog {
+				if !debug {
+					slog.Warn("-ledger-wire-log has no effect until debug logging is on (-debug or the debug_logging feature flag)")
+				}
+				c.EnableWireLog(ledger.WireLogOptions{
+					RedactFields: strings.Split(ledgerWireRedact, ","),
+					KeepChars:    ledgerWireKeepChar,
+				})
+			}
 			ledgerClient = c
-			slog.Info("Passport client initialized", "product_base", productPassportBaseURL, "commissioning_url", commissioningCreateURL)
+			passportClient = c
+			slog.Info("Passport client initialized", "product_base", productPassportBaseURL, "commissioning_url", commissioningCreateURL, "cache_ttl", passportCacheTTL)
 		}
 	} else {
 		slog.Warn("Passport client not configured - functionality will be disabled")
 	}
 
 	// Create middleware
-	var middlewareList []proxy.Middleware
+	sessions := session.NewStore(0)
+
+	// Lifecycle event sinks
+	bus := events.NewBus(0)
+	if epcisCaptureURL != "" {
+		bus.Subscribe(epcis.NewSink(epcis.Options{
+			CaptureURL:    epcisCaptureURL,
+			EPCTemplate:   epcisEPCTemplate,
+			ReadPoint:     epcisReadPoint,
+			BizLocation:   epcisBizLocation,
+			Authorization: epcisAuth,
+		}))
+		slog.Info("EPCIS event emission enabled", "capture_url", epcisCaptureURL)
+	}
+	if passportClient != nil && passportClient.FailureReportsEnabled() {
+		bus.Subscribe(middleware.NewLedgerFailureSink(passportClient))
+		slog.Info("Onboarding failure reporting enabled", "url", failureReportURL)
+	}
+	var to0Trigger *to0.Trigger
+	if to0TriggerURL != "" {
+		to0Trigger = to0.NewTrigger(to0TriggerURL, ownerID, bus, to0Retries, 0)
+		bus.Subscribe(to0Trigger)
+		slog.Info("Automatic TO0 enabled", "url", to0TriggerURL)
+	}
+	if passportClient != nil && passportClient.RegistrationReportsEnabled() {
+		bus.Subscribe(middleware.NewLedgerRegistrationSink(passportClient))
+		slog.Info("Rendezvous registration reporting enabled", "url", registrationURL)
+	}
+	if passportClient != nil && passportDIRecords {
+		bus.Subscribe(middleware.NewLedgerPassportRecordSink(passportClient))
+		slog.Info("DI completion records enabled", "product_base", productPassportBaseURL)
+	}
+	var rvWatch *rendezvous.Watch
+	if rvExpiryWarning > 0 {
+		rvWatch = rendezvous.NewWatch(bus, rvExpiryWarning)
+		bus.Subscribe(rvWatch)
+		slog.Info("Rendezvous registration expiry monitoring enabled", "warning", rvExpiryWarning)
+	}
+	var history store.Store
+	var recorder *store.Recorder
+	switch {
+	case storePath != "":
+		kw, err := storeKeyWrapper()
+		if err != nil {
+			slog.Error("Failed to load store key", "error", err)
+			os.Exit(1)
+		}
+		st, err := store.OpenFile(storePath, kw)
+		if err != nil {
+			slog.Error("Failed to open local store", "path", storePath, "error", err)
+			os.Exit(1)
+		}
+		defer st.Close()
+		history = st
+		slog.Info("Recording onboarding history", "path", storePath, "encrypted", kw != nil)
+	case storeDB != "":
+		kw, err := storeKeyWrapper()
+		if err != nil {
+			slog.Error("Failed to load store key", "error", err)
+			os.Exit(1)
+		}
+		db, err := openStoreDB()
+		if err != nil {
+			slog.Error("Failed to open store database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		st, err := store.OpenPostgres(context.Background(), db, kw)
+		if err != nil {
+			slog.Error("Failed to open store database", "database", db.String(), "error", err)
+			os.Exit(1)
+		}
+		history = st
+		slog.Info("Recording onboarding history", "database", db.String(), "encrypted", kw != nil)
+	}
+	if history != nil {
+		recorder = store.NewRecorder(history)
+		bus.Subscribe(recorder)
+	}
+	quarantined, err := quarantine.Open(quarantineFile)
+	if err != nil {
+		slog.Error("Failed to open quarantine list", "path", quarantineFile, "error", err)
+		os.Exit(1)
+	}
+	if quarantineAt > 0 {
+		recorder.OnAdd(quarantine.Escalate(quarantined, history, quarantineAt))
+		slog.Info("Automatic quarantine enabled", "consecutive_failures", quarantineAt)
+	}
+	var anchorer *anchor.Anchorer
+	if anchorURL != "" {
+		a, err := anchor.New(anchor.Options{
+			URL:           anchorURL,
+			Dir:           anchorDir,
+			Authorization: anchorAuth,
+			PendingPath:   anchorPending,
+		})
+		if err != nil {
+			slog.Error("Anchoring init failed", "error", err)
+			os.Exit(1)
+		}
+		anchorer = a
+		bus.Subscribe(anchorer)
+		slog.Info("Commissioning passport anchoring enabled", "url", anchorURL, "interval", anchorInterval)
+	}
+
+	// Signed onboarding receipts, fetched by the devices themselves
+	var receipts *receipt.Issuer
+	if receiptKey != "" {
+		signer, err := vc.LoadSigner(receiptKey, receiptKeyID)
+		if err == nil {
+			receipts, err = receipt.New(signer, receiptDir)
+		}
+		if err != nil {
+			slog.Error("Onboarding receipts init failed", "error", err)
+			os.Exit(1)
+		}
+		bus.Subscribe(receipts)
+		slog.Info("Onboarding receipts enabled", "alg", signer.Alg(), "dir", receiptDir, "per_source", receiptRate)
+	}
+
+	// Onboarding status, asked for by the devices themselves
+	var statuses *status.Tracker
+	if deviceStatus {
+		statuses = status.New(sessions)
+		bus.Subscribe(statuses)
+		slog.Info("Device onboarding status enabled", "per_source", deviceStatusRate)
+	}
+
+	// Rate limit buckets, bans and device penalties, shared with the other
+	// proxies through Redis
+	var redisClient *redis.Client
+	var limiter ratelimit.Limiter = ratelimit.NewLocal()
+	if rateLimitRedis != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		redisClient, err = redis.Open(ctx, rateLimitRedis)
+		cancel()
+		if err != nil {
+			slog.Error("Failed to connect to -rate-limit-redis", "error", err)
+			os.Exit(1)
+		}
+		limiter = ratelimit.NewRedis(redisClient)
+		slog.Info("Rate limits shared through Redis", "redis", redisClient.String())
+	}
+	rateLimits := proxy.RateLimits{
+		Source: ratelimit.PerMinute(rateLimitSource, 0),
+		Device: ratelimit.PerMinute(rateLimitDevice, 0),
+	}
+	var bans *ban.List
+	if redisClient != nil {
+		bans = ban.OpenRedis(redisClient)
+	} else if bans, err = ban.Open(banFile); err != nil {
+		slog.Error("Failed to open ban list", "path", banFile, "error", err)
+		os.Exit(1)
+	}
+	var penalties *penalty.Box
+	if penaltyAfter > 0 {
+		opts := penalty.Options{After: penaltyAfter, Base: penaltyBase, Max: penaltyMax, Reset: penaltyReset}
+		if redisClient != nil {
+			penalties = penalty.NewRedis(redisClient, opts, bans)
+		} else {
+			penalties = penalty.New(opts, bans)
+		}
+		bus.Subscribe(penalties)
+		slog.Info("Penalties for repeated failures enabled", "after", penaltyAfter, "base", penaltyBase, "max", penaltyMax, "reset", penaltyReset, "shared", redisClient != nil)
+	}
+
+	// Onboarding notifications to Slack and email
+	if notifyConfig != "" {
+		n, channels, err := loadNotifier()
+		if err != nil {
+			slog.Error("Failed to load -notify-config", "error", err)
+			os.Exit(1)
+		}
+		bus.Subscribe(n)
+		if passportClient != nil {
+			passportClient.OnBreakerChange(n.LedgerBreaker)
+		}
+		slog.Info("Notifications enabled", "kinds", strings.Join(n.Kinds(), ","), "channels", channels)
+	}
 
-	// Add DI middleware if product passport is enabled
-	if enableProductPassport {
-		diMiddleware := middleware.NewDIMiddleware(ledgerClient, enableProductPassport)
-		middlewareList = append(middlewareList, diMiddleware)
-		slog.Info("DI middleware enabled for product passport")
+	// Completion callbacks to the owners' own backends
+	if callbacksPath != "" {
+		c, err := callback.Load(callbacksPath)
+		if err != nil {
+			slog.Error("Failed to load -callbacks", "error", err)
+			os.Exit(1)
+		}
+		bus.Subscribe(c)
+		slog.Info("Onboarding callbacks enabled", "path", callbacksPath, "callbacks", strings.Join(c.Names(), ","))
 	}
 
-	// Add TO2 middleware if owner ID is provided
-	if ownerID != "" {
-		to2Middleware := middleware.NewTO2Middleware(ledgerClient, ownerID)
-		middlewareList = append(middlewareList, to2Middleware)
-		slog.Info("TO2 middleware enabled for commissioning passport", "owner_id", ownerID)
+	// Onboarding SLOs, seeded from the history so a restart keeps the window
+	var slos *slo.Tracker
+	if sloSuccess != 0 || sloDuration != 0 {
+		slos, err = slo.New(slo.Options{Success: sloSuccess, Duration: sloDuration, Window: sloWindow})
+		if err != nil {
+			slog.Error("Invalid -slo-success, -slo-duration or -slo-window", "error", err)
+			os.Exit(1)
+		}
+		seeded := 0
+		if history != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			seeded, err = slos.Seed(ctx, history)
+			cancel()
+			if err != nil {
+				slog.Warn("Failed to read onboarding history for SLOs", "counted", seeded, "error", err)
+			}
+		}
+		bus.Subscribe(slos)
+		slog.Info("Onboarding SLOs enabled", "success", sloSuccess, "p95", sloDuration, "window", sloWindow, "seeded", seeded)
+	}
+
+	// Anomaly detection, raising events for the sinks above
+	var anomalies *anomaly.Detector
+	if detectAnomalies {
+		anomalies, err = anomaly.Open(bus, anomaly.Options{Threshold: anomalyThreshold, Learning: anomalyLearning}, anomalyFile)
+		if err != nil {
+			slog.Error("Failed to open anomaly baseline", "path", anomalyFile, "error", err)
+			os.Exit(1)
+		}
+		bus.Subscribe(anomalies)
+		slog.Info("Anomaly detection enabled", "threshold", anomalyThreshold, "learning", anomalyLearning, "path", anomalyFile)
+	}
+
+	// Runtime feature flags, switched through the admin API
+	featureFlags, err := features.Open(featuresFile)
+	if err != nil {
+		slog.Error("Failed to open feature flags", "path", featuresFile, "error", err)
+		os.Exit(1)
+	}
+	featureFlags.Define("debug_logging", "Log at debug level, including ledger bodies with -ledger-wire-log", debug).OnChange(func(on bool) {
+		level := slog.LevelInfo
+		if on {
+			level = slog.LevelDebug
+		}
+		logLevel.Set(level)
+		slog.SetLogLoggerLevel(level)
+	})
+	passportLookup := featureFlags.Define("passport_lookup", "Look product item passports up during DI where enabled", true)
+	passportEnforcement := featureFlags.Define("passport_enforcement", "Refuse DI of devices whose policy requires a product passport that cannot be retrieved", true)
+	gateSinks(bus, featureFlags)
+
+	var ownerMap *owners.Map
+	if ownerMapPath != "" {
+		m, err := owners.Load(ownerMapPath)
+		if err != nil {
+			slog.Error("Failed to load owner map", "path", ownerMapPath, "error", err)
+			os.Exit(1)
+		}
+		ownerMap = m
+		slog.Info("Per-device owner assignment enabled", "path", ownerMapPath, "entries", m.Len())
+	}
+	var tagRules *tags.Rules
+	if tagRulesPath != "" {
+		r, err := tags.LoadRules(tagRulesPath)
+		if err != nil {
+			slog.Error("Failed to load tag rules", "path", tagRulesPath, "error", err)
+			os.Exit(1)
+		}
+		tagRules = r
+		slog.Info("Device tag rules loaded", "path", tagRulesPath, "rules", r.Len())
+	}
+	tagger, err := tags.Open(tagsFile, tagRules)
+	if err != nil {
+		slog.Error("Failed to open device tags", "path", tagsFile, "error", err)
+		os.Exit(1)
+	}
+
+	var policies *policy.Set
+	if policiesPath != "" {
+		s, err := policy.Load(policiesPath)
+		if err != nil {
+			slog.Error("Failed to load policies", "path", policiesPath, "error", err)
+			os.Exit(1)
+		}
+		s.UseLimiter(limiter)
+		policies = s
+		slog.Info("Tag-scoped policies loaded", "path", policiesPath, "policies", s.Len())
+	}
+
+	// Reconcile local records with the passport service
+	var reconciler *reconcile.Reconciler
+	if reconcileURL != "" {
+		if passportClient == nil {
+			slog.Error("-reconcile-url needs a working passport client")
+			os.Exit(1)
+		}
+		if reconcileRepair && commissioningCreateURL == "" {
+			slog.Warn("-reconcile-repair without -commissioning-url; missing passports will only be reported")
+			reconcileRepair = false
+		}
+		reconciler = reconcile.New(history, passportClient, reconcile.Options{
+			Window: reconcileWindow,
+			Grace:  reconcileGrace,
+			Repair: reconcileRepair,
+			Exclude: func(r *store.Record) bool {
+				// Passports a policy sends elsewhere are not in this list
+				p := policies.Named(r.Policy)
+				return p != nil && p.CommissioningURL != ""
+			},
+		})
+		slog.Info("Reconciliation with the passport service enabled", "url", reconcileURL, "interval", reconcileInterval, "window", reconcileWindow, "repair", reconcileRepair)
+	}
+	var geoDB geo.DB
+	var geoReloader *geo.Reloader
+	if geoIPPath != "" {
+		r, err := geo.Open(geoIPPath)
+		if err != nil {
+			slog.Error("Failed to load GeoIP database", "path", geoIPPath, "error", err)
+			os.Exit(1)
+		}
+		geoDB, geoReloader = r, r
+		slog.Info("GeoIP database loaded", "path", geoIPPath, "reload_interval", geoIPReload)
+	}
+
+	// Assemble the middleware chain, from -pipeline or else from flags
+	registerBuiltins(&pipelineDeps{
+		ledger:              ledgerClient,
+		sessions:            sessions,
+		bus:                 bus,
+		history:             history,
+		quarantined:         quarantined,
+		owners:              ownerMap,
+		tags:                tagger,
+		policies:            policies,
+		geo:                 geoDB,
+		passportLookup:      passportLookup,
+		passportEnforcement: passportEnforcement,
+	})
+	stages, err := loadPipeline(bus)
+	if err != nil {
+		slog.Error("Failed to load middleware pipeline", "error", err)
+		os.Exit(1)
+	}
+	if pipelinePath != "" {
+		slog.Info("Middleware pipeline loaded", "path", pipelinePath, "stages", len(stages))
+	}
+	middlewareList, err := pipeline.Build(stages, inspectLimit)
+	if err != nil {
+		slog.Error("Middleware init failed", "error", err)
+		os.Exit(1)
+	}
+
+	var sourceRules *proxy.SourceRules
+	if sourceRulesPath != "" {
+		sourceRules, err = proxy.LoadSourceRules(sourceRulesPath)
+		if err != nil {
+			slog.Error("Failed to load source rules", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	var certManager *acme.Manager
+	if acmeDomains != "" {
+		certManager, err = acme.New(acme.Options{
+			DirectoryURL: acmeDirectory,
+			Email:        acmeEmail,
+			Domains:      splitList(acmeDomains),
+			CacheDir:     acmeCacheDir,
+		})
+		if err != nil {
+			slog.Error("ACME init failed", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	tlsConfig, err := loadTLS()
+	if err != nil {
+		slog.Error("TLS init failed", "error", err)
+		os.Exit(1)
+	}
+	if tlsConfig != nil {
+		if tlsSPIFFE {
+			tlsConfig.GetCertificate = svids.GetCertificate
+		}
+		if certManager != nil {
+			certManager.Configure(tlsConfig)
+		}
+		if tlsClientCA != "" && revocationChecker != nil {
+			tlsConfig.VerifyConnection = revocationChecker.VerifyConnection("device")
+		}
 	}
 
 	// Create and start proxy
 	proxy := proxy.NewFDOProxy(fdoPath, nil, listenAddr, ledgerClient, middlewareList)
+	proxy.EnableStreaming(flushEvery, copyBuffer)
+	proxy.LimitSessions(maxSessions)
+	if alertBackendDown > 0 {
+		proxy.WatchBackends(backendHealth)
+	}
+	proxy.Ban(bans)
+	if !rateLimits.Source.IsZero() || !rateLimits.Device.IsZero() {
+		proxy.LimitRates(limiter, rateLimits)
+		slog.Info("Session rate limits enabled", "per_source", rateLimitSource, "per_device", rateLimitDevice, "shared", rateLimitRedis != "")
+	}
+	if trustProxies != "" {
+		prefixes, err := parsePrefixes(trustProxies)
+		if err != nil {
+			slog.Error("Invalid -trusted-proxies", "error", err)
+			os.Exit(1)
+		}
+		proxy.TrustProxies(prefixes)
+	}
+	if tlsConfig != nil {
+		proxy.EnableTLS(tlsConfig)
+		slog.Info("TLS enabled", "min_version", tlsMinVersion, "cipher_suites", tlsCiphers, "curves", tlsCurves, "alpn", tlsALPN, "client_ca", tlsClientCA)
+	}
+	if forwardPaths != "*" {
+		if err := proxy.RestrictPaths(splitList(forwardPaths)); err != nil {
+			slog.Error("Invalid -forward-paths", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Forwarding only FDO messages and listed paths", "paths", forwardPaths)
+	}
+	if acceptRoles != "" {
+		if err := proxy.AcceptRoles(splitList(acceptRoles)); err != nil {
+			slog.Error("Invalid -accept-roles", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Accepting only the FDO messages of the roles served", "roles", acceptRoles)
+	}
+	if receipts != nil {
+		proxy.Serve("/receipts/", receipt.Handler(receipts, limiter, ratelimit.PerMinute(receiptRate, 0)))
+	}
+	if statuses != nil {
+		proxy.Serve("/status/", status.Handler(statuses, limiter, ratelimit.PerMinute(deviceStatusRate, 0)))
+	}
+	if sourceRules != nil {
+		proxy.RestrictSources(sourceRules)
+		slog.Info("Source rules enabled", "path", sourceRulesPath, "rules", len(sourceRules.Rules), "default", sourceRules.Default)
+	}
+	if err := configureBackends(proxy); err != nil {
+		slog.Error("Backend init failed", "error", err)
+		os.Exit(1)
+	}
+	if err := configureSNIRoutes(proxy, tlsConfig); err != nil {
+		slog.Error("SNI routes init failed", "error", err)
+		os.Exit(1)
+	}
+	if err := configureVirtualHosts(proxy); err != nil {
+		slog.Error("Virtual hosts init failed", "error", err)
+		os.Exit(1)
+	}
+	if err := configureListeners(proxy, revocationChecker); err != nil {
+		slog.Error("Listeners init failed", "error", err)
+		os.Exit(1)
+	}
 
 	// Setup graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -99,16 +1212,362 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	stopped := make(chan struct{})
 	go func() {
 		<-sigChan
 		slog.Info("Shutdown signal received, stopping proxy...")
 		cancel()
+		stopCtx, stop := context.WithTimeout(context.Background(), 15*time.Second)
+		defer stop()
+		proxy.Stop(stopCtx)
+		if anchorer != nil {
+			// Anchor what is pending rather than drop it
+			flushCtx, flush := context.WithTimeout(context.Background(), 30*time.Second)
+			anchorer.Flush(flushCtx)
+			flush()
+		}
+		if anomalies != nil {
+			if err := anomalies.Save(); err != nil {
+				slog.Error("Failed to save anomaly baseline", "error", err)
+			}
+		}
+		close(stopped)
 	}()
 
+	// Obtain and renew the ACME certificate
+	if certManager != nil {
+		go certManager.Run(ctx)
+		if acmeHTTPAddr != "" {
+			challenges := &http.Server{Addr: acmeHTTPAddr, Handler: certManager.HTTPHandler(nil), ReadHeaderTimeout: 10 * time.Second}
+			go func() {
+				<-ctx.Done()
+				challenges.Close()
+			}()
+			go func() {
+				if err := challenges.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					slog.Error("ACME challenge listener failed", "listen_addr", acmeHTTPAddr, "error", err)
+				}
+			}()
+		}
+		slog.Info("ACME certificates enabled", "domains", acmeDomains, "directory", acmeDirectory, "http_challenges", acmeHTTPAddr)
+	}
+
+	// Follow SVID rotations
+	if svids != nil {
+		go svids.Run(ctx)
+	}
+
+	// Refresh the SLO metrics
+	if slos != nil {
+		go slos.Run(ctx, 30*time.Second)
+	}
+
+	// Evaluate alert rules
+	if alerts := alertEngine(); alerts != nil {
+		go alerts.Run(ctx)
+	}
+
+	// Push metrics to StatsD
+	if statsdAddr != "" {
+		var tags []string
+		for _, t := range strings.Split(statsdTags, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tags = append(tags, t)
+			}
+		}
+		sd, err := metrics.NewStatsD(metrics.Default, metrics.StatsDOptions{
+			Addr:   statsdAddr,
+			Prefix: statsdPrefix,
+			Flavor: statsdFlavor,
+			Tags:   tags,
+		})
+		if err != nil {
+			slog.Error("Failed to start StatsD emitter", "error", err)
+			os.Exit(1)
+		}
+		go sd.Run(ctx)
+		slog.Info("StatsD metrics enabled", "addr", statsdAddr, "flavor", statsdFlavor)
+	}
+
+	// Recurring jobs
+	jobs, err := newScheduler(history, anchorer, passportClient, reconciler)
+	if err != nil {
+		slog.Error("Failed to set up scheduled jobs", "error", err)
+		os.Exit(1)
+	}
+
+	// Start the admin listener for metrics
+	if adminAddr != "" {
+		adminServer := admin.NewServer(adminAddr)
+		if adminSources != "" {
+			prefixes, err := parsePrefixes(adminSources)
+			if err != nil {
+				slog.Error("Invalid -admin-allow-sources", "error", err)
+				os.Exit(1)
+			}
+			adminServer.AllowSources(prefixes)
+		}
+		adminServer.Handle("/metrics", metrics.Default.Handler())
+		adminServer.Handle("/admin/sessions", admin.SessionsHandler(sessions))
+		adminServer.Handle("/admin/maintenance", admin.MaintenanceHandler(proxy))
+		adminServer.Handle("/admin/features", admin.FeaturesHandler(featureFlags))
+		adminServer.Handle("/admin/features/", admin.FeaturesHandler(featureFlags))
+		adminServer.Handle("/admin/config", admin.ConfigHandler(currentConfig(proxy, featureFlags)))
+		adminServer.Handle("/admin/version", admin.VersionHandler(proxy))
+		adminServer.Handle("/admin/devices", admin.DevicesHandler(bus, sessions, history, quarantined, tagger, ownerID))
+		adminServer.Handle("/admin/devices/", admin.DevicesHandler(bus, sessions, history, quarantined, tagger, ownerID))
+		if rvinfoURL != "" {
+			audit, err := rvinfo.OpenAudit(rvinfoAudit)
+			if err != nil {
+				slog.Error("Failed to open RVInfo audit", "error", err)
+				os.Exit(1)
+			}
+			h := admin.RVInfoHandler(rvinfo.NewClient(rvinfoURL, 0), audit)
+			adminServer.Handle("/admin/rvinfo", h)
+			adminServer.Handle("/admin/rvinfo/", h)
+			slog.Info("RVInfo management enabled", "url", rvinfoURL, "audit", rvinfoAudit)
+		}
+		if ownerKeyURL != "" {
+			audit, err := ownerkey.OpenAudit(ownerKeyAudit)
+			if err != nil {
+				slog.Error("Failed to open owner key audit", "error", err)
+				os.Exit(1)
+			}
+			rotator := ownerkey.NewRotator(ownerkey.NewClient(ownerKeyURL, 0), audit, ownerID)
+			if to0Trigger != nil {
+				rotator.EnableTO0(to0Trigger)
+			} else {
+				slog.Warn("Owner key rotation without -to0-trigger-url; rotated vouchers must be registered at the rendezvous server separately")
+			}
+			if passportClient != nil && passportClient.KeyRotationReportsEnabled() {
+				rotator.EnableLedger(passportClient)
+			}
+			h := admin.OwnerKeyHandler(rotator)
+			adminServer.Handle("/admin/owner-key/", h)
+			slog.Info("Owner key rotation enabled", "url", ownerKeyURL, "audit", ownerKeyAudit)
+		}
+		if history != nil {
+			if reportKeyPath == "" {
+				reportKeyPath, reportKeyID = vcIssuerKey, vcKeyID
+			}
+			var reportSigner *vc.Signer
+			if reportKeyPath != "" {
+				s, err := vc.LoadSigner(reportKeyPath, reportKeyID)
+				if err != nil {
+					slog.Error("Failed to load report signing key", "error", err)
+					os.Exit(1)
+				}
+				reportSigner = s
+			} else {
+				slog.Warn("No -report-signing-key; compliance reports will be unsigned")
+			}
+			adminServer.Handle("/admin/reports/compliance", admin.ComplianceReportHandler(history, reportSigner, ownerID))
+			adminServer.Handle("/admin/export", admin.ExportHandler(history))
+		}
+		if passportClient != nil {
+			adminServer.Handle("/admin/cache", admin.CacheHandler(passportClient))
+			adminServer.Handle("/admin/cache/", admin.CacheHandler(passportClient))
+			adminServer.Handle("/admin/passports", admin.PassportsHandler(passportClient))
+			adminServer.Handle("/admin/passports/", admin.PassportsHandler(passportClient))
+		}
+		if passportClient != nil && passportClient.OfflineEnabled() {
+			adminServer.Handle("/admin/ledger/sync", admin.LedgerSyncHandler(passportClient))
+		}
+		if reconciler != nil {
+			adminServer.Handle("/admin/reconcile", admin.ReconcileHandler(reconciler))
+		}
+		adminServer.Handle("/admin/jobs", admin.JobsHandler(jobs))
+		if files := stateFiles(); len(files) > 0 {
+			adminServer.Handle("/admin/backup", admin.BackupHandler(files))
+		}
+		adminServer.Handle("/admin/jobs/", admin.JobsHandler(jobs))
+		adminServer.Handle("/admin/bans", admin.BansHandler(bans))
+		adminServer.Handle("/admin/bans/", admin.BansHandler(bans))
+		if penalties != nil {
+			adminServer.Handle("/admin/penalties", admin.PenaltiesHandler(penalties))
+			adminServer.Handle("/admin/penalties/", admin.PenaltiesHandler(penalties))
+		}
+		if slos != nil {
+			adminServer.Handle("/admin/slo", admin.SLOHandler(slos))
+		}
+		adminServer.RequireToken(adminToken)
+		if adminTokens != "" {
+			tokens, err := admin.LoadTokens(adminTokens)
+			if err != nil {
+				slog.Error("Failed to load -admin-tokens", "error", err)
+				os.Exit(1)
+			}
+			adminServer.RequireTokens(tokens)
+		}
+		if adminToken == "" && adminTokens == "" {
+			slog.Warn("Admin API has no -admin-token; anyone who can reach the admin listener can use it")
+		}
+
+		// Tamper-evident trail of every change made through the admin API
+		var auditKey []byte
+		if adminAuditKey != "" {
+			auditKey = []byte(adminAuditKey)
+		}
+		trail, err := audit.OpenTrail(adminAuditFile, auditKey)
+		if err != nil {
+			slog.Error("Failed to open admin audit trail", "path", adminAuditFile, "error", err)
+			os.Exit(1)
+		}
+		if n, err := trail.Verify(); err != nil {
+			slog.Error("Admin audit trail does not verify; it was changed outside the proxy or with another -admin-audit-key", "path", adminAuditFile, "verified", n, "error", err)
+		}
+		adminServer.Audit(trail)
+		adminServer.Handle("/admin/audit", admin.AuditHandler(trail))
+		go func() {
+			if err := adminServer.Start(ctx); err != nil {
+				slog.Error("Admin server error", "error", err)
+			}
+		}()
+	}
+
+	// Pick up GeoIP database updates
+	if geoReloader != nil && geoIPReload > 0 {
+		go geoReloader.Run(ctx, geoIPReload)
+	}
+
+	// Watch rendezvous registrations for devices stranded before TO2
+	if rvWatch != nil {
+		go rvWatch.Run(ctx, time.Minute)
+	}
+
+	// Save the anomaly baseline as it is learned
+	if anomalies != nil {
+		go anomalies.Run(ctx, time.Minute)
+	}
+
+	// Prune, anchor, sync, reconcile and prefetch on schedule
+	jobs.Start(ctx)
+
 	// Start the proxy
-	slog.Info("Starting FDO proxy server", "listen_addr", listenAddr)
-	if err := proxy.Start(ctx, listenAddr); err != nil {
+	slog.Info("Starting FDO proxy server", "listen_addr", listenAddr, "version", version.Get().String())
+	if err := proxy.Start(ctx, listenAddr); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		slog.Error("Proxy server error", "error", err)
+		// Do not leave a backend container running
+		proxy.Stop(context.Background())
 		os.Exit(1)
 	}
+	<-stopped
+}
+
+// parsePrefixes parses a comma-separated list of networks.
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range strings.Split(list, ",") {
+		pfx, err := netip.ParsePrefix(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, pfx)
+	}
+	return prefixes, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(list string) []string {
+	var out []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// alertEngine builds the alert rules and notifiers from flags, or returns
+// nil if no rule is enabled.
+func alertEngine() *alert.Engine {
+	e := alert.NewEngine(30 * time.Second)
+	if alertFailureRate > 0 {
+		e.AddRule(alert.NewFailureRate(metrics.Default, alertFailureRate, alertFailureWindow, alertFailureMin))
+	}
+	if alertBreakerOpen > 0 {
+		e.AddRule(alert.NewBreakerOpen(metrics.Default, alertBreakerOpen))
+	}
+	if alertGUIDReuse > 0 {
+		e.AddRule(alert.NewGUIDReuse(metrics.Default, alertGUIDReuse))
+	}
+	if alertRVExpiring {
+		e.AddRule(alert.NewRegistrationsExpiring(metrics.Default))
+	}
+	if alertOutsideWindow > 0 {
+		e.AddRule(alert.NewOutsideWindow(metrics.Default, alertOutsideWindow))
+	}
+	if alertFailover {
+		e.AddRule(alert.NewBackendFailover(metrics.Default))
+	}
+	if alertBackendDown > 0 {
+		e.AddRule(alert.NewBackendDown(metrics.Default, alertBackendDown))
+	}
+	if alertAnomaly > 0 {
+		e.AddRule(alert.NewAnomalies(metrics.Default, alertAnomaly))
+	}
+	if e.Len() == 0 {
+		return nil
+	}
+
+	var notifiers []string
+	if alertWebhookURL != "" {
+		e.AddNotifier(alert.NewWebhook(alertWebhookURL))
+		notifiers = append(notifiers, "webhook")
+	}
+	if alertSlackURL != "" {
+		e.AddNotifier(alert.NewSlack(alertSlackURL))
+		notifiers = append(notifiers, "slack")
+	}
+	if alertEmailTo != "" {
+		var to []string
+		for _, addr := range strings.Split(alertEmailTo, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				to = append(to, addr)
+			}
+		}
+		e.AddNotifier(alert.NewEmail(alert.EmailOptions{
+			Addr:     alertSMTPAddr,
+			From:     alertEmailFrom,
+			To:       to,
+			Username: alertSMTPUser,
+			Password: os.Getenv("FDO_PROXY_SMTP_PASSWORD"),
+		}))
+		notifiers = append(notifiers, "email")
+	}
+	incidentRules := splitList(alertIncidentRules)
+	if alertPagerDutyKey != "" {
+		e.AddNotifier(alert.ForRules(alert.NewPagerDuty("", alertPagerDutyKey), incidentRules...))
+		notifiers = append(notifiers, "pagerduty")
+	}
+	if alertOpsgenieKey != "" {
+		e.AddNotifier(alert.ForRules(alert.NewOpsgenie(alertOpsgenieURL, alertOpsgenieKey), incidentRules...))
+		notifiers = append(notifiers, "opsgenie")
+	}
+	if len(notifiers) == 0 {
+		slog.Warn("Alert rules enabled without a notifier; alerts will only be logged")
+	}
+	slog.Info("Alerting enabled", "rules", e.Len(), "notifiers", strings.Join(notifiers, ","))
+	return e
+}
+
+// storeKeyWrapper returns the key wrapper for the local store from
+// -store-key-file or $FDO_PROXY_STORE_KEY, or nil if neither is set.
+func storeKeyWrapper() (store.KeyWrapper, error) {
+	var (
+		key []byte
+		err error
+	)
+	switch {
+	case storeKeyFile != "":
+		key, err = store.LoadKeyFile(storeKeyFile)
+	case os.Getenv("FDO_PROXY_STORE_KEY") != "":
+		key, err = store.ParseKey([]byte(os.Getenv("FDO_PROXY_STORE_KEY")))
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store.NewLocalKeyWrapper(key)
 }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/fdo-server-wrapper/internal/attest"
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/features"
+	"github.com/fdo-server-wrapper/internal/geo"
+	"github.com/fdo-server-wrapper/internal/kitting"
+	"github.com/fdo-server-wrapper/internal/middleware"
+	"github.com/fdo-server-wrapper/internal/owners"
+	"github.com/fdo-server-wrapper/internal/pipeline"
+	"github.com/fdo-server-wrapper/internal/policy"
+	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/quarantine"
+	"github.com/fdo-server-wrapper/internal/serials"
+	"github.com/fdo-server-wrapper/internal/session"
+	"github.com/fdo-server-wrapper/internal/store"
+	"github.com/fdo-server-wrapper/internal/tags"
+	"github.com/fdo-server-wrapper/internal/vc"
+)
+
+// pipelineDeps is what the built-in middleware share with the rest of the
+// proxy.
+type pipelineDeps struct {
+	ledger      proxy.LedgerClient
+	sessions    *session.Store
+	bus         *events.Bus
+	history     store.Store
+	quarantined *quarantine.List
+	owners      *owners.Map
+	tags        *tags.Tagger
+	policies    *policy.Set
+	geo         geo.DB
+	// Feature flags switching passport lookups and enforcement at runtime
+	passportLookup      *features.Flag
+	passportEnforcement *features.Flag
+}
+
+// registerBuiltins makes the built-in middleware available to pipelines.
+func registerBuiltins(d *pipelineDeps) {
+	pipeline.Register("di", d.newDI)
+	pipeline.Register("serviceinfo", d.newServiceInfo)
+	pipeline.Register("to2", d.newTO2)
+	pipeline.Register("kitting", d.newKitting)
+	pipeline.Register("payloads", d.newPayloads)
+	pipeline.Register("headers", newHeaders)
+	pipeline.Register("scrub", newScrub)
+}
+
+// defaultPipeline is the chain used without -pipeline, chosen from flags.
+func defaultPipeline(bus *events.Bus) []pipeline.Stage {
+	var stages []pipeline.Stage
+
+	// DI middleware if product passport is enabled, DI failures are
+	// reported, duplicate serials are checked, owners are assigned, devices
+	// are tagged or policies apply
+	if enableProductPassport || bus.Len() > 0 || diDuplicates != "off" || ownerMapPath != "" || tagRulesPath != "" || policiesPath != "" {
+		stages = append(stages, pipeline.Stage{Name: "di"})
+	}
+
+	// ServiceInfo observer ahead of TO2 so Done2 sees the full summary
+	if observeServiceInfo {
+		stages = append(stages, pipeline.Stage{Name: "serviceinfo"})
+	}
+
+	// TO2 middleware if owner ID or map, tag rules, policies, GeoIP, an
+	// attestation verifier, an event sink, the admin API, quarantine or GUID
+	// reuse detection needs it
+	if ownerID != "" || ownerMapPath != "" || tagRulesPath != "" || policiesPath != "" || geoIPPath != "" || attestVerifierURL != "" || bus.Len() > 0 || adminAddr != "" || quarantineAt > 0 || detectGUIDReuse {
+		stages = append(stages, pipeline.Stage{Name: "to2"})
+	}
+
+	// Payload verification of fdo.download and fdo.wget transfers
+	if verifyPayloads != "off" {
+		stages = append(stages, pipeline.Stage{Name: "payloads"})
+	}
+
+	// Kitting after TO2 so quarantined devices are refused first
+	if kittingURL != "" {
+		stages = append(stages, pipeline.Stage{Name: "kitting"})
+	}
+
+	// Scrubbing last so it sees responses as they leave the proxy
+	if scrubResponses {
+		stages = append(stages, pipeline.Stage{Name: "scrub"})
+	}
+	return stages
+}
+
+// diOptions are the "di" stage options. Defaults come from the matching
+// flags.
+type diOptions struct {
+	ProductPassport bool   `json:"product_passport"`
+	Duplicates      string `json:"duplicates"`
+	SerialsFile     string `json:"serials_file"`
+}
+
+func (d *pipelineDeps) newDI(options json.RawMessage) (any, error) {
+	o := diOptions{
+		ProductPassport: enableProductPassport,
+		Duplicates:      diDuplicates,
+		SerialsFile:     diSerialsFile,
+	}
+	if err := pipeline.DecodeOptions(options, &o); err != nil {
+		return nil, err
+	}
+	switch o.Duplicates {
+	case "off", "flag", "block":
+	default:
+		return nil, fmt.Errorf("invalid duplicates %q: want off, flag or block", o.Duplicates)
+	}
+
+	m := middleware.NewDIMiddleware(d.ledger, o.ProductPassport)
+	m.EnableEvents(d.bus)
+	m.EnableOwnerMap(d.owners)
+	m.EnableTags(d.tags)
+	m.EnablePolicies(d.policies)
+	m.EnableGeoIP(d.geo)
+	m.EnableFeatureFlags(d.passportLookup, d.passportEnforcement)
+	if o.Duplicates != "off" {
+		if o.SerialsFile == "" && storePath != "" {
+			o.SerialsFile = storePath + ".serials.jsonl"
+		}
+		registry, err := serials.Open(o.SerialsFile)
+		if err != nil {
+			return nil, err
+		}
+		m.EnableDuplicateDetection(registry, o.Duplicates == "block")
+		slog.Info("Duplicate DI detection enabled", "action", o.Duplicates, "path", o.SerialsFile)
+	}
+	slog.Info("DI middleware enabled", "product_passport", o.ProductPassport)
+	return m, nil
+}
+
+func (d *pipelineDeps) newServiceInfo(options json.RawMessage) (any, error) {
+	if err := pipeline.DecodeOptions(options, &struct{}{}); err != nil {
+		return nil, err
+	}
+	slog.Info("ServiceInfo observer enabled")
+	return middleware.NewServiceInfoObserver(d.sessions), nil
+}
+
+// to2Options are the "to2" stage options. Defaults come from the matching
+// flags.
+type to2Options struct {
+	DetectGUIDReuse        bool   `json:"detect_guid_reuse"`
+	AttestationVerifierURL string `json:"attestation_verifier_url"`
+	AttestationFailOpen    bool   `json:"attestation_fail_open"`
+}
+
+func (d *pipelineDeps) newTO2(options json.RawMessage) (any, error) {
+	o := to2Options{
+		DetectGUIDReuse:        detectGUIDReuse,
+		AttestationVerifierURL: attestVerifierURL,
+		AttestationFailOpen:    attestFailOpen,
+	}
+	if err := pipeline.DecodeOptions(options, &o); err != nil {
+		return nil, err
+	}
+
+	m := middleware.NewTO2Middleware(d.ledger, ownerID, d.sessions)
+	m.EnableEvents(d.bus)
+	m.EnableQuarantine(d.quarantined)
+	m.EnableOwnerMap(d.owners)
+	m.EnableTags(d.tags)
+	m.EnablePolicies(d.policies)
+	m.EnableGeoIP(d.geo)
+	if d.policies.Len() > 0 {
+		for _, p := range d.policies.Policies {
+			if p.CommissioningURL != "" && d.ledger == nil {
+				return nil, fmt.Errorf("policy %s: commissioning_url needs the passport service (-commissioning-url)", p.Name)
+			}
+			if p.Geofence != nil && len(p.Geofence.Countries) > 0 && d.geo == nil {
+				return nil, fmt.Errorf("policy %s: geofence countries need a GeoIP database (-geoip-db)", p.Name)
+			}
+		}
+	}
+	if o.DetectGUIDReuse {
+		m.EnableReuseDetection(d.history)
+		slog.Info("GUID reuse detection enabled", "history", d.history != nil)
+	}
+	if vcIssuerKey != "" {
+		issuer, err := vc.NewIssuer(vcIssuerID, vcKeyID, vcIssuerKey)
+		if err == nil && vcOutDir != "" {
+			err = issuer.StoreIn(vcOutDir)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("credential issuer: %w", err)
+		}
+		m.EnableCredentials(issuer)
+		slog.Info("Onboarding credentials enabled", "issuer", vcIssuerID)
+	}
+	if o.AttestationVerifierURL != "" {
+		m.EnableVerification(attest.NewHTTPVerifier(o.AttestationVerifierURL, attestTimeout), o.AttestationFailOpen)
+		slog.Info("Attestation verification enabled", "url", o.AttestationVerifierURL, "fail_open", o.AttestationFailOpen)
+	}
+	slog.Info("TO2 middleware enabled for commissioning passport", "owner_id", ownerID)
+	return m, nil
+}
+
+// kittingOptions are the "kitting" stage options. Defaults come from the
+// matching flags.
+type kittingOptions struct {
+	URL      string `json:"url"`
+	Required bool   `json:"required"`
+}
+
+func (d *pipelineDeps) newKitting(options json.RawMessage) (any, error) {
+	o := kittingOptions{URL: kittingURL, Required: kittingRequired}
+	if err := pipeline.DecodeOptions(options, &o); err != nil {
+		return nil, err
+	}
+	if o.URL == "" {
+		return nil, fmt.Errorf("kitting needs a url (-kitting-url)")
+	}
+	if d.ledger == nil {
+		return nil, fmt.Errorf("kitting needs the passport service (-product-base-url)")
+	}
+	slog.Info("Passport-driven kitting enabled", "url", o.URL, "required", o.Required)
+	return middleware.NewKitting(d.ledger, kitting.NewClient(o.URL, 0), o.Required), nil
+}
+
+// payloadsOptions are the "payloads" stage options. Defaults come from the
+// matching flags.
+type payloadsOptions struct {
+	Mode string `json:"mode"`
+}
+
+func (d *pipelineDeps) newPayloads(options json.RawMessage) (any, error) {
+	o := payloadsOptions{Mode: verifyPayloads}
+	if o.Mode == "off" {
+		// Placed by a pipeline file without the flag
+		o.Mode = "flag"
+	}
+	if err := pipeline.DecodeOptions(options, &o); err != nil {
+		return nil, err
+	}
+	switch o.Mode {
+	case "flag", "fail":
+	default:
+		return nil, fmt.Errorf("invalid mode %q: want flag or fail", o.Mode)
+	}
+	m := middleware.NewPayloadVerifier(d.sessions, d.ledger, o.Mode == "fail")
+	m.EnableEvents(d.bus)
+	slog.Info("Payload verification enabled", "mode", o.Mode, "passport", d.ledger != nil)
+	return m, nil
+}
+
+// headersOptions are the "headers" stage options.
+type headersOptions struct {
+	Remove []string          `json:"remove"`
+	Set    map[string]string `json:"set"`
+}
+
+func newHeaders(options json.RawMessage) (any, error) {
+	var o headersOptions
+	if err := pipeline.DecodeOptions(options, &o); err != nil {
+		return nil, err
+	}
+	m, err := middleware.NewHeaderRewriter(o.Remove, o.Set)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Response header rewriting enabled", "remove", len(o.Remove), "set", len(o.Set))
+	return m, nil
+}
+
+// scrubOptions are the "scrub" stage options. Defaults come from the
+// matching flags.
+type scrubOptions struct {
+	Remove      []string `json:"remove"`
+	Server      string   `json:"server"`
+	StackTraces bool     `json:"stack_traces"`
+}
+
+func newScrub(options json.RawMessage) (any, error) {
+	o := scrubOptions{Server: scrubServer, StackTraces: true}
+	if err := pipeline.DecodeOptions(options, &o); err != nil {
+		return nil, err
+	}
+	m, err := middleware.NewResponseScrubber(o.Remove, o.Server, o.StackTraces)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Response scrubbing enabled", "remove", len(o.Remove), "server", o.Server, "stack_traces", o.StackTraces)
+	return m, nil
+}
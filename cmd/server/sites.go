@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/fdo-server-wrapper/internal/pipeline"
+	"github.com/fdo-server-wrapper/internal/proxy"
+)
+
+// siteRoute is one entry of the -sni-routes and -virtual-hosts files,
+// keyed by name.
+type siteRoute struct {
+	// Role is the backend serving the name (default: by protocol).
+	Role string `json:"role"`
+	// URL is an FDO server the proxy does not run serving the name.
+	URL string `json:"url"`
+	// Pipeline is a -pipeline file for the name (default: the proxy's).
+	Pipeline string `json:"pipeline"`
+	// Cert and Key are served to devices asking for the name; SNI only.
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// loadSiteRoutes reads a -sni-routes or -virtual-hosts file.
+func loadSiteRoutes(path string) (map[string]siteRoute, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	var routes map[string]siteRoute
+	if err := pipeline.DecodeOptions(b, &routes); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return routes, nil
+}
+
+// newSite builds the proxy.Site of r, with the chain of its pipeline.
+func newSite(r siteRoute) (proxy.Site, error) {
+	site := proxy.Site{Role: r.Role, URL: r.URL}
+	if r.Pipeline == "" {
+		return site, nil
+	}
+	pc, err := pipeline.Load(r.Pipeline)
+	if err != nil {
+		return site, err
+	}
+	if site.Middleware, err = pipeline.Build(pc.Middleware, inspectLimit); err != nil {
+		return site, err
+	}
+	// An empty chain is still the name's own
+	if site.Middleware == nil {
+		site.Middleware = []proxy.Middleware{}
+	}
+	return site, nil
+}
+
+// configureSNIRoutes applies -sni-routes. Certificates of routes are added
+// to cfg, from which crypto/tls picks by server name.
+func configureSNIRoutes(p *proxy.FDOProxy, cfg *tls.Config) error {
+	if sniRoutesPath == "" {
+		return nil
+	}
+	if cfg == nil {
+		return fmt.Errorf("-sni-routes needs TLS on -listen")
+	}
+	routes, err := loadSiteRoutes(sniRoutesPath)
+	if err != nil {
+		return fmt.Errorf("SNI routes: %w", err)
+	}
+	for name, r := range routes {
+		site, err := newSite(r)
+		if err != nil {
+			return fmt.Errorf("SNI routes %s: %s: %w", sniRoutesPath, name, err)
+		}
+		if r.Cert != "" || r.Key != "" {
+			if cfg.GetCertificate != nil {
+				return fmt.Errorf("SNI routes %s: %s: certificates cannot be combined with -tls-spiffe or -acme-domains", sniRoutesPath, name)
+			}
+			cert, err := tls.LoadX509KeyPair(r.Cert, r.Key)
+			if err != nil {
+				return fmt.Errorf("SNI routes %s: %s: %w", sniRoutesPath, name, err)
+			}
+			cfg.Certificates = append(cfg.Certificates, cert)
+		}
+		if err := p.RouteServerName(name, site); err != nil {
+			return fmt.Errorf("SNI routes %s: %w", sniRoutesPath, err)
+		}
+		slog.Info("SNI route configured", "server_name", name, "role", r.Role, "url", r.URL, "pipeline", r.Pipeline, "cert", r.Cert)
+	}
+	return nil
+}
+
+// configureVirtualHosts applies -virtual-hosts.
+func configureVirtualHosts(p *proxy.FDOProxy) error {
+	if virtualHostsPath == "" {
+		return nil
+	}
+	routes, err := loadSiteRoutes(virtualHostsPath)
+	if err != nil {
+		return fmt.Errorf("virtual hosts: %w", err)
+	}
+	for host, r := range routes {
+		if r.Cert != "" || r.Key != "" {
+			return fmt.Errorf("virtual hosts %s: %s: certificates are selected by server name, use -sni-routes", virtualHostsPath, host)
+		}
+		site, err := newSite(r)
+		if err != nil {
+			return fmt.Errorf("virtual hosts %s: %s: %w", virtualHostsPath, host, err)
+		}
+		if err := p.RouteHost(host, site); err != nil {
+			return fmt.Errorf("virtual hosts %s: %w", virtualHostsPath, err)
+		}
+		slog.Info("Virtual host configured", "host", host, "role", r.Role, "url", r.URL, "pipeline", r.Pipeline)
+	}
+	return nil
+}
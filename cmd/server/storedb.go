@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/pg"
+	"github.com/fdo-server-wrapper/internal/schema"
+)
+
+// storeDBConn is the database of -store-db, shared by the store and the
+// ledger outbox.
+var storeDBConn *pg.DB
+
+// openStoreDB connects to -store-db on first use and brings its schema up
+// to date, or with -migrate-auto=false checks that it is.
+func openStoreDB() (*pg.DB, error) {
+	if storeDBConn != nil {
+		return storeDBConn, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	db, err := pg.Open(ctx, storeDB)
+	if err != nil {
+		return nil, err
+	}
+	ms, err := schema.Migrations()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if migrateAuto {
+		done, err := db.Migrate(ctx, ms, -1)
+		for _, m := range done {
+			slog.Info("Applied schema migration", "database", db.String(), "version", m.Version, "name", m.Name)
+		}
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("migrate schema: %w", err)
+		}
+	} else {
+		states, err := db.MigrationStatus(ctx, ms)
+		if err == nil {
+			err = schemaCurrent(states)
+		}
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	storeDBConn = db
+	return db, nil
+}
+
+// checkSchema connects to -store-db and checks its schema without changing
+// it. Pending migrations fail only with -migrate-auto=false, since the
+// proxy applies them at startup otherwise.
+func checkSchema() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	db, err := pg.Open(ctx, storeDB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ms, err := schema.Migrations()
+	if err != nil {
+		return err
+	}
+	states, err := db.MigrationStatus(ctx, ms)
+	if err != nil {
+		return err
+	}
+	if err := schemaCurrent(states); err != nil && (!migrateAuto || errors.Is(err, pg.ErrSchemaNewer)) {
+		return err
+	}
+	return nil
+}
+
+// schemaCurrent fails if a migration is pending or the database was
+// migrated by a newer build.
+func schemaCurrent(states []pg.MigrationState) error {
+	for _, st := range states {
+		if st.Unknown {
+			return fmt.Errorf("%w: migration %d is applied", pg.ErrSchemaNewer, st.Version)
+		}
+		if st.AppliedAt.IsZero() {
+			return fmt.Errorf("schema migration %d_%s is pending; run -migrate up or start with -migrate-auto", st.Version, st.Name)
+		}
+	}
+	return nil
+}
+
+// runMigrate runs -migrate and returns the exit status.
+func runMigrate(cmd string) int {
+	if storeDB == "" {
+		fmt.Fprintln(os.Stderr, "migrate: -store-db is not set")
+		return 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	db, err := pg.Open(ctx, storeDB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	defer db.Close()
+	ms, err := schema.Migrations()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+
+	states, err := db.MigrationStatus(ctx, ms)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	target := -1
+	switch cmd {
+	case "status":
+		for _, st := range states {
+			switch {
+			case st.Unknown:
+				fmt.Printf("%04d %-24s applied %s (unknown to this build)\n", st.Version, st.Name, st.AppliedAt.Format(time.RFC3339))
+			case st.AppliedAt.IsZero():
+				fmt.Printf("%04d %-24s pending\n", st.Version, st.Name)
+			default:
+				fmt.Printf("%04d %-24s applied %s\n", st.Version, st.Name, st.AppliedAt.Format(time.RFC3339))
+			}
+		}
+		if err := schemaCurrent(states); err != nil {
+			fmt.Fprintln(os.Stderr, "migrate:", err)
+		}
+		return 0
+	case "up":
+	case "down":
+		// Down from the last applied migration to the one before it
+		target = 0
+		for _, st := range states {
+			if !st.AppliedAt.IsZero() && !st.Unknown {
+				target = max(target, st.Version)
+			}
+		}
+		prev := 0
+		for _, m := range ms {
+			if m.Version < target {
+				prev = m.Version
+			}
+		}
+		if target == 0 {
+			fmt.Println("No migration to revert")
+			return 0
+		}
+		target = prev
+	default:
+		if target, err = strconv.Atoi(cmd); err != nil || target < 0 {
+			fmt.Fprintf(os.Stderr, "migrate: %q is not up, down, status or a version\n", cmd)
+			return 1
+		}
+	}
+
+	applied := make(map[int]bool)
+	for _, st := range states {
+		applied[st.Version] = !st.AppliedAt.IsZero()
+	}
+	done, err := db.Migrate(ctx, ms, target)
+	for _, m := range done {
+		if applied[m.Version] {
+			fmt.Printf("%04d %-24s reverted\n", m.Version, m.Name)
+		} else {
+			fmt.Printf("%04d %-24s applied\n", m.Version, m.Name)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		if errors.Is(err, pg.ErrSchemaNewer) {
+			fmt.Fprintln(os.Stderr, "migrate: use the build that applied it")
+		}
+		return 1
+	}
+	if len(done) == 0 {
+		fmt.Println("Schema is up to date")
+	}
+	return 0
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/admin"
+	"github.com/fdo-server-wrapper/internal/anchor"
+	"github.com/fdo-server-wrapper/internal/anomaly"
+	"github.com/fdo-server-wrapper/internal/audit"
+	"github.com/fdo-server-wrapper/internal/ban"
+	"github.com/fdo-server-wrapper/internal/callback"
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/features"
+	"github.com/fdo-server-wrapper/internal/geo"
+	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/ownerkey"
+	"github.com/fdo-server-wrapper/internal/owners"
+	"github.com/fdo-server-wrapper/internal/pg"
+	"github.com/fdo-server-wrapper/internal/pipeline"
+	"github.com/fdo-server-wrapper/internal/policy"
+	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/quarantine"
+	"github.com/fdo-server-wrapper/internal/receipt"
+	"github.com/fdo-server-wrapper/internal/redis"
+	"github.com/fdo-server-wrapper/internal/rvinfo"
+	"github.com/fdo-server-wrapper/internal/schedule"
+	"github.com/fdo-server-wrapper/internal/session"
+	"github.com/fdo-server-wrapper/internal/slo"
+	"github.com/fdo-server-wrapper/internal/tags"
+	"github.com/fdo-server-wrapper/internal/vc"
+	"github.com/fdo-server-wrapper/internal/version"
+)
+
+// certExpiryWarning is how close to expiry a certificate is reported.
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// Outcomes of a validation check.
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "FAIL"
+)
+
+// checkResult is one line of the -validate-config report.
+type checkResult struct {
+	outcome string
+	name    string
+	detail  string
+}
+
+// validator runs the checks of -validate-config and collects their
+// results.
+type validator struct {
+	results []checkResult
+}
+
+func (v *validator) add(outcome, name, detail string) {
+	v.results = append(v.results, checkResult{outcome, name, detail})
+}
+
+// fail records err as a failure under the flag it is about, or under name
+// if it is not a flagError.
+func (v *validator) fail(name string, err error) {
+	var fe *flagError
+	if errors.As(err, &fe) {
+		v.add(checkFail, fe.flag, fe.err.Error())
+		return
+	}
+	v.add(checkFail, name, err.Error())
+}
+
+// check records fn's outcome under name: failed if it returns an error,
+// else ok with the detail it returns.
+func (v *validator) check(name string, fn func() (string, error)) {
+	detail, err := fn()
+	if err != nil {
+		v.add(checkFail, name, err.Error())
+		return
+	}
+	v.add(checkOK, name, detail)
+}
+
+// report writes the results to w and returns the number of failures.
+func (v *validator) report(w io.Writer) int {
+	failed, warned := 0, 0
+	for _, r := range v.results {
+		switch r.outcome {
+		case checkFail:
+			failed++
+		case checkWarn:
+			warned++
+		}
+		fmt.Fprintf(w, "%-4s  %-24s  %s\n", r.outcome, r.name, r.detail)
+	}
+	fmt.Fprintf(w, "\n%d checks, %d failed, %d warned\n", len(v.results), failed, warned)
+	return failed
+}
+
+// validateConfig loads and checks the configuration given by flags
+// without starting anything, prints a report and returns the exit status:
+// 0 if every check passed, 1 otherwise. With -validate-reachability the
+// hosts of configured URLs must also accept connections.
+func validateConfig() int {
+	// Loaders log at Info; the report is what matters here
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	v := &validator{}
+	v.add(checkOK, "version", version.Get().String())
+	for _, err := range checkFlags() {
+		v.add(checkFail, err.flag, err.err.Error())
+	}
+	v.validateCommands()
+	v.validateLogging()
+	tlsConfig := v.validateTLS()
+	v.validateLedger()
+	v.validateFiles()
+	v.validateKeys()
+	v.validateProxy(tlsConfig)
+	v.validateURLs()
+
+	if v.report(os.Stdout) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// validateCommands checks the files of -backup, -restore and -migrate,
+// which run instead of the proxy.
+func (v *validator) validateCommands() {
+	if backupPath != "" {
+		v.check("backup", func() (string, error) {
+			if _, err := os.Stat(backupPath); err == nil {
+				return "", fmt.Errorf("%s exists", backupPath)
+			}
+			if fi, err := os.Stat(filepath.Dir(backupPath)); err != nil {
+				return "", err
+			} else if !fi.IsDir() {
+				return "", fmt.Errorf("%s is not a directory", filepath.Dir(backupPath))
+			}
+			return fmt.Sprintf("%s: %d state files", backupPath, len(stateFiles())), nil
+		})
+	}
+	if restorePath != "" {
+		v.check("restore", func() (string, error) {
+			f, err := os.Open(restorePath)
+			if err != nil {
+				return "", err
+			}
+			return restorePath, f.Close()
+		})
+	}
+	if scrubServer != "" && !scrubResponses && pipelinePath == "" {
+		v.add(checkWarn, "scrub-server", "ignored without -scrub-responses")
+	}
+}
+
+func (v *validator) validateLogging() {
+	if _, err := loadLogging(); err != nil {
+		v.fail("log-redact", err)
+	} else {
+		v.add(checkOK, "log-redact", logRedact)
+	}
+	if alertGUIDReuse > 0 && !detectGUIDReuse {
+		v.add(checkWarn, "alert-guid-reuse", "never fires without -detect-guid-reuse")
+	}
+	if alertAnomaly > 0 && !detectAnomalies {
+		v.add(checkWarn, "alert-anomaly", "never fires without -detect-anomalies")
+	}
+}
+
+// validateTLS checks the listener's TLS settings, returning the
+// configuration they make, nil without TLS or if it is invalid.
+func (v *validator) validateTLS() *tls.Config {
+	for _, f := range []struct{ name, list string }{{"trusted-proxies", trustProxies}, {"admin-allow-sources", adminSources}} {
+		if f.list != "" {
+			v.check(f.name, func() (string, error) {
+				p, err := parsePrefixes(f.list)
+				return fmt.Sprintf("%d networks", len(p)), err
+			})
+		}
+	}
+	cfg, err := loadTLS()
+	if err != nil {
+		v.fail("tls-policy", err)
+		return nil
+	}
+	if cfg == nil {
+		return nil
+	}
+	for _, cert := range cfg.Certificates {
+		v.checkCertificate("tls-cert", tlsCert, cert.Leaf)
+	}
+	if tlsClientCA != "" {
+		v.add(checkOK, "tls-client-ca", tlsClientCA)
+	}
+	v.add(checkOK, "tls-policy", "min version "+tlsMinVersion)
+	if tlsSPIFFE || acmeDomains != "" {
+		// As set at runtime, so SNI route certificates are refused alike
+		cfg.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return nil, nil }
+	}
+	return cfg
+}
+
+// checkCertificate reports a certificate that has expired, is not valid
+// yet or expires soon.
+func (v *validator) checkCertificate(name, path string, leaf *x509.Certificate) {
+	now := time.Now()
+	detail := fmt.Sprintf("%s: %s, expires %s", path, leaf.Subject, leaf.NotAfter.Format(time.DateOnly))
+	switch {
+	case now.After(leaf.NotAfter):
+		v.add(checkFail, name, detail+" (expired)")
+	case now.Before(leaf.NotBefore):
+		v.add(checkFail, name, detail+" (not valid before "+leaf.NotBefore.Format(time.DateOnly)+")")
+	case leaf.NotAfter.Sub(now) < certExpiryWarning:
+		v.add(checkWarn, name, detail+" (expires soon)")
+	default:
+		v.add(checkOK, name, detail)
+	}
+}
+
+func (v *validator) validateLedger() {
+	if _, err := loadRevocation(); err != nil {
+		v.fail("revocation-check", err)
+	}
+	if productPassportBaseURL == "" && commissioningCreateURL == "" && failureReportURL == "" && registrationURL == "" && keyRotationURL == "" && reconcileURL == "" && commissioningQueryURL == "" {
+		if prefetchManifest != "" {
+			v.add(checkWarn, "prefetch-manifest", "ignored without the passport service")
+		}
+		if prefetchAll {
+			v.add(checkWarn, "prefetch-all", "ignored without the passport service")
+		}
+		return
+	}
+	if s, err := loadLedger(); err != nil {
+		v.fail("ledger-http2", err)
+	} else {
+		v.add(checkOK, "ledger-http2", ledgerHTTP2)
+		if len(s.pins) > 0 {
+			v.add(checkOK, "ledger-pins", fmt.Sprintf("%d pins", len(s.pins)))
+		}
+		if s.resolving() {
+			v.add(checkOK, "ledger-dns-servers", fmt.Sprintf("%d servers, %d pinned hosts", len(s.dns.Servers), len(s.dns.Hosts)))
+		}
+	}
+	if ledgerMaxConns > 0 && ledgerIdleConns > ledgerMaxConns {
+		v.add(checkWarn, "ledger-idle-conns", "more than -ledger-max-conns can ever be open")
+	}
+	if ledgerDNSStaleTTL > 0 && ledgerDNSStaleTTL <= ledgerDNSCacheTTL {
+		v.add(checkWarn, "ledger-dns-stale-ttl", "no effect unless longer than -ledger-dns-cache-ttl")
+	}
+	if ledgerSessionCache > 0 && ledgerSPIFFE {
+		v.add(checkWarn, "ledger-tls-session-cache", "resumed connections carry the SVID of the session they resume, not the current one")
+	}
+	v.check("passport-client", func() (string, error) {
+		_, err := ledger.NewClient(productPassportBaseURL, commissioningCreateURL, caCertPath, clientCertPath, clientKeyPath)
+		return "mTLS material loaded", err
+	})
+	if caCertPath != "" {
+		v.check("ca-cert", func() (string, error) {
+			_, n, err := loadCertPool(caCertPath)
+			return fmt.Sprintf("%s: %d certificates", caCertPath, n), err
+		})
+	}
+	if clientCertPath != "" && clientKeyPath != "" {
+		if cert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath); err == nil {
+			v.checkCertificate("client-cert", clientCertPath, cert.Leaf)
+		}
+	}
+	if prefetchManifest != "" {
+		v.check("prefetch-manifest", func() (string, error) {
+			uuids, err := ledger.LoadManifest(prefetchManifest)
+			return fmt.Sprintf("%s: %d product UUIDs", prefetchManifest, len(uuids)), err
+		})
+	}
+}
+
+// validateFiles loads the configuration and state files the proxy reads at
+// startup.
+func (v *validator) validateFiles() {
+	if sourceRulesPath != "" {
+		v.check("source-rules", func() (string, error) {
+			r, err := proxy.LoadSourceRules(sourceRulesPath)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s: %d rules", sourceRulesPath, len(r.Rules)), nil
+		})
+	}
+	if ownerMapPath != "" {
+		v.check("owner-map", func() (string, error) {
+			m, err := owners.Load(ownerMapPath)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s: %d entries", ownerMapPath, m.Len()), nil
+		})
+	}
+	var rules *tags.Rules
+	if tagRulesPath != "" {
+		v.check("tag-rules", func() (string, error) {
+			r, err := tags.LoadRules(tagRulesPath)
+			if err != nil {
+				return "", err
+			}
+			rules = r
+			return fmt.Sprintf("%s: %d rules", tagRulesPath, r.Len()), nil
+		})
+	}
+	if policiesPath != "" {
+		v.check("policies", func() (string, error) {
+			s, err := policy.Load(policiesPath)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s: %d policies", policiesPath, s.Len()), nil
+		})
+	}
+	if sloSuccess != 0 || sloDuration != 0 {
+		v.check("slo", func() (string, error) {
+			if _, err := slo.New(slo.Options{Success: sloSuccess, Duration: sloDuration, Window: sloWindow}); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("success %v, p95 %s over %s", sloSuccess, sloDuration, sloWindow), nil
+		})
+	}
+	if rateLimitRedis != "" {
+		v.check("rate-limit-redis", func() (string, error) {
+			cfg, err := redis.ParseURL(rateLimitRedis)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s database %d, tls %t (not connected)", cfg.Addr, cfg.DB, cfg.TLS != nil), nil
+		})
+	}
+	if jobsPath != "" {
+		v.check("jobs", func() (string, error) {
+			c, err := schedule.LoadConfig(jobsPath)
+			if err != nil {
+				return "", err
+			}
+			for name := range c {
+				if !slices.Contains(jobNames, name) {
+					return "", fmt.Errorf("unknown job %q", name)
+				}
+			}
+			return fmt.Sprintf("%s: %d jobs", jobsPath, len(c)), nil
+		})
+	}
+	if commissioningTemplate != "" {
+		v.check("commissioning-template", func() (string, error) {
+			_, err := ledger.LoadCommissioningTemplate(commissioningTemplate)
+			return commissioningTemplate, err
+		})
+	}
+	if notifyConfig != "" {
+		if n, _, err := loadNotifier(); err != nil {
+			v.fail("notify-config", err)
+		} else {
+			v.add(checkOK, "notify-config", fmt.Sprintf("%s: %s", notifyConfig, strings.Join(n.Kinds(), ", ")))
+		}
+	}
+	if callbacksPath != "" {
+		v.check("callbacks", func() (string, error) {
+			c, err := callback.Load(callbacksPath)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s: %s", callbacksPath, strings.Join(c.Names(), ", ")), nil
+		})
+	}
+	if geoIPPath != "" {
+		v.check("geoip-db", func() (string, error) {
+			_, err := geo.Open(geoIPPath)
+			return geoIPPath, err
+		})
+	}
+
+	// State files kept next to the local store
+	v.checkStateFile("tags-file", tagsFile, func(path string) error {
+		_, err := tags.Open(path, rules)
+		return err
+	})
+	v.checkStateFile("quarantine-file", quarantineFile, func(path string) error {
+		_, err := quarantine.Open(path)
+		return err
+	})
+	v.checkStateFile("features-file", featuresFile, func(path string) error {
+		_, err := features.Open(path)
+		return err
+	})
+	if rateLimitRedis == "" {
+		v.checkStateFile("ban-file", banFile, func(path string) error {
+			_, err := ban.Open(path)
+			return err
+		})
+	}
+	if detectAnomalies {
+		v.checkStateFile("anomaly-file", anomalyFile, func(path string) error {
+			_, err := anomaly.Open(nil, anomaly.Options{}, path)
+			return err
+		})
+	}
+	if anchorURL != "" {
+		v.checkStateFile("anchor-pending-file", anchorPending, func(path string) error {
+			_, err := anchor.LoadPending(path)
+			return err
+		})
+	}
+	if adminAddr != "" {
+		if adminTokens != "" {
+			v.check("admin-tokens", func() (string, error) {
+				tokens, err := admin.LoadTokens(adminTokens)
+				return fmt.Sprintf("%d principals", len(tokens)), err
+			})
+		}
+		v.checkStateFile("admin-audit-file", adminAuditFile, func(path string) error {
+			var key []byte
+			if adminAuditKey != "" {
+				key = []byte(adminAuditKey)
+			}
+			t, err := audit.OpenTrail(path, key)
+			if err != nil {
+				return err
+			}
+			_, err = t.Verify()
+			return err
+		})
+	}
+	if rvinfoURL != "" {
+		v.checkStateFile("rvinfo-audit", rvinfoAudit, func(path string) error {
+			_, err := rvinfo.OpenAudit(path)
+			return err
+		})
+	}
+	if ledgerOffline {
+		v.checkStateFile("ledger-outbox", ledgerOutbox, func(path string) error {
+			// A bad key is reported by the store-key check
+			kw, _ := storeKeyWrapper()
+			return ledger.VerifyOutbox(path, kw)
+		})
+	}
+	if ownerKeyURL != "" {
+		v.checkStateFile("owner-key-audit", ownerKeyAudit, func(path string) error {
+			_, err := ownerkey.OpenAudit(path)
+			return err
+		})
+	}
+
+	if storePath != "" {
+		v.check("store-path", func() (string, error) {
+			dir := filepath.Dir(storePath)
+			if fi, err := os.Stat(dir); err != nil {
+				return "", err
+			} else if !fi.IsDir() {
+				return "", fmt.Errorf("%s is not a directory", dir)
+			}
+			return storePath, nil
+		})
+	}
+	if storeDB != "" {
+		v.check("store-db", func() (string, error) {
+			cfg, err := pg.ParseURL(storeDB)
+			if err != nil {
+				return "", err
+			}
+			if validateReach {
+				return fmt.Sprintf("%s@%s/%s, sslmode %s", cfg.User, cfg.Addr, cfg.Database, cfg.SSLMode), checkSchema()
+			}
+			return fmt.Sprintf("%s@%s/%s, sslmode %s (not connected)", cfg.User, cfg.Addr, cfg.Database, cfg.SSLMode), nil
+		})
+	}
+	v.check("store-key", func() (string, error) {
+		kw, err := storeKeyWrapper()
+		if kw == nil && err == nil {
+			return "not encrypted", nil
+		}
+		return "key loaded", err
+	})
+}
+
+// checkStateFile loads the file of a state flag, if it has one.
+func (v *validator) checkStateFile(name, path string, load func(string) error) {
+	if path == "" {
+		return
+	}
+	v.check(name, func() (string, error) {
+		return path, load(path)
+	})
+}
+
+// validateKeys loads the signing keys of credentials, reports and
+// receipts.
+func (v *validator) validateKeys() {
+	if vcIssuerKey != "" {
+		v.check("vc-issuer-key", func() (string, error) {
+			_, err := vc.NewIssuer(vcIssuerID, vcKeyID, vcIssuerKey)
+			return vcIssuerKey, err
+		})
+	}
+	if reportKeyPath != "" {
+		v.check("report-signing-key", func() (string, error) {
+			_, err := vc.LoadSigner(reportKeyPath, reportKeyID)
+			return reportKeyPath, err
+		})
+	}
+	if receiptKey != "" {
+		v.check("receipt-key", func() (string, error) {
+			signer, err := vc.LoadSigner(receiptKey, receiptKeyID)
+			if err != nil {
+				return receiptKey, err
+			}
+			// Without a directory, so nothing is created
+			_, err = receipt.New(signer, "")
+			return fmt.Sprintf("%s (%s)", receiptKey, signer.Alg()), err
+		})
+	}
+}
+
+// validateProxy builds the middleware chain, backends and sites on a proxy
+// that is never started.
+func (v *validator) validateProxy(tlsConfig *tls.Config) {
+	if backendMode == "process" && backendsPath == "" {
+		v.check("fdo-path", func() (string, error) {
+			fi, err := os.Stat(fdoPath)
+			if err == nil && !fi.IsDir() {
+				err = fmt.Errorf("%s is not a directory", fdoPath)
+			}
+			return fdoPath, err
+		})
+	}
+
+	deps := &pipelineDeps{sessions: session.NewStore(0), bus: events.NewBus(0)}
+	if productPassportBaseURL != "" || commissioningCreateURL != "" {
+		if c, err := ledger.NewClient(productPassportBaseURL, commissioningCreateURL, caCertPath, clientCertPath, clientKeyPath); err == nil {
+			deps.ledger = c
+		}
+	}
+	if policiesPath != "" {
+		deps.policies, _ = policy.Load(policiesPath)
+	}
+	if geoIPPath != "" {
+		if r, err := geo.Open(geoIPPath); err == nil {
+			deps.geo = r
+		}
+	}
+	registerBuiltins(deps)
+	v.check("pipeline", func() (string, error) {
+		stages := defaultPipeline(deps.bus)
+		source := "from flags"
+		if pipelinePath != "" {
+			cfg, err := pipeline.Load(pipelinePath)
+			if err != nil {
+				return "", err
+			}
+			stages, source = cfg.Middleware, pipelinePath
+		}
+		if _, err := pipeline.Build(stages, inspectLimit); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s: %d stages", source, len(stages)), nil
+	})
+
+	p := proxy.NewFDOProxy(fdoPath, nil, listenAddr, nil, nil)
+	if forwardPaths != "*" {
+		v.check("forward-paths", func() (string, error) {
+			return forwardPaths, p.RestrictPaths(splitList(forwardPaths))
+		})
+	}
+	if acceptRoles != "" {
+		v.check("accept-roles", func() (string, error) {
+			return acceptRoles, p.AcceptRoles(splitList(acceptRoles))
+		})
+	}
+	v.check("backends", func() (string, error) {
+		if err := configureBackends(p); err != nil {
+			return "", err
+		}
+		if backendsPath == "" {
+			return "-backend=" + backendMode, nil
+		}
+		return backendsPath, nil
+	})
+	if sniRoutesPath != "" {
+		v.check("sni-routes", func() (string, error) {
+			return sniRoutesPath, configureSNIRoutes(p, tlsConfig)
+		})
+	}
+	if virtualHostsPath != "" {
+		v.check("virtual-hosts", func() (string, error) {
+			return virtualHostsPath, configureVirtualHosts(p)
+		})
+	}
+	if listenersPath != "" {
+		v.check("listeners", func() (string, error) {
+			return listenersPath, configureListeners(p, nil)
+		})
+	}
+}
+
+// validateURLs parses every configured URL and, with
+// -validate-reachability, connects to its host.
+func (v *validator) validateURLs() {
+	urls := []struct{ name, value string }{
+		{"product-base-url", productPassportBaseURL},
+		{"commissioning-url", commissioningCreateURL},
+		{"commissioning-query-url", commissioningQueryURL},
+		{"failure-url", failureReportURL},
+		{"registration-url", registrationURL},
+		{"key-rotation-url", keyRotationURL},
+		{"to0-trigger-url", to0TriggerURL},
+		{"kitting-url", kittingURL},
+		{"rvinfo-url", rvinfoURL},
+		{"owner-key-url", ownerKeyURL},
+		{"attestation-verifier-url", attestVerifierURL},
+		{"epcis-capture-url", epcisCaptureURL},
+		{"anchor-url", anchorURL},
+		{"reconcile-url", reconcileURL},
+		{"otlp-logs-endpoint", otlpLogsURL},
+		{"alert-webhook-url", alertWebhookURL},
+		{"alert-slack-webhook", alertSlackURL},
+		{"notify-slack-webhook", notifySlackURL},
+		{"backend-standby", backendStandby},
+	}
+	if acmeDomains != "" {
+		urls = append(urls, struct{ name, value string }{"acme-directory", acmeDirectory})
+	}
+	if alertOpsgenieKey != "" {
+		urls = append(urls, struct{ name, value string }{"alert-opsgenie-url", alertOpsgenieURL})
+	}
+	for _, u := range urls {
+		if u.value == "" {
+			continue
+		}
+		v.check(u.name, func() (string, error) {
+			// {guid} placeholders are not valid in a host but may be in paths
+			parsed, err := url.Parse(strings.ReplaceAll(u.value, "{guid}", "guid"))
+			if err != nil {
+				return "", err
+			}
+			if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return "", fmt.Errorf("%q is not an http or https URL", u.value)
+			}
+			if !validateReach {
+				return u.value, nil
+			}
+			port := parsed.Port()
+			if port == "" {
+				port = "80"
+				if parsed.Scheme == "https" {
+					port = "443"
+				}
+			}
+			return u.value + " (reachable)", dial("tcp", net.JoinHostPort(parsed.Hostname(), port))
+		})
+	}
+	if !validateReach {
+		return
+	}
+	if alertEmailTo != "" || notifyConfig != "" && notifyEmailTo != "" {
+		v.check("alert-smtp-addr", func() (string, error) {
+			return alertSMTPAddr + " (reachable)", dial("tcp", alertSMTPAddr)
+		})
+	}
+	if spiffeEndpoint != "" && (tlsSPIFFE || ledgerSPIFFE) {
+		v.check("spiffe-endpoint", func() (string, error) {
+			u, err := url.Parse(spiffeEndpoint)
+			if err != nil {
+				return "", err
+			}
+			if u.Scheme == "unix" {
+				return spiffeEndpoint + " (reachable)", dial("unix", u.Path)
+			}
+			return spiffeEndpoint + " (reachable)", dial("tcp", u.Host)
+		})
+	}
+}
+
+// dial checks that addr accepts connections.
+func dial(network, addr string) error {
+	conn, err := net.DialTimeout(network, addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/version"
+)
+
+// printVersion writes the build of the proxy and the versions of the
+// backends configured by flags for -version, without starting anything.
+func printVersion() {
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	fmt.Println("fdo-proxy", version.Get())
+
+	p := proxy.NewFDOProxy(fdoPath, nil, listenAddr, nil, nil)
+	if err := configureBackends(p); err != nil {
+		fmt.Println("backends:", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, b := range p.BackendVersions(ctx) {
+		name := "backend"
+		if b.Role != "" {
+			name = b.Role + " backend"
+		}
+		switch {
+		case b.URL != "":
+			fmt.Printf("%s: %s (not run by the proxy)\n", name, b.URL)
+		case b.Error != "":
+			fmt.Printf("%s: unknown (%s)\n", name, b.Error)
+		default:
+			fmt.Printf("%s: %s\n", name, b.Version)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 module github.com/fdo-server-wrapper
 
-go 1.21
+// Go 1.24 for unencrypted HTTP/2 in net/http (http.Protocols), which the
+// SPIFFE Workload API client speaks over the agent's socket.
+go 1.24
 
 replace github.com/fido-device-onboard/go-fdo => ../go-fdo
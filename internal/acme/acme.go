@@ -0,0 +1,457 @@
+// Package acme obtains and renews the proxy listener's certificate from an
+// ACME CA such as Let's Encrypt, answering http-01 and tls-alpn-01
+// challenges itself.
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+var (
+	renewals = metrics.Default.NewCounterVec(
+		"fdo_proxy_acme_renewals_total",
+		"ACME certificate issuances and renewals by outcome (success, error).",
+		"outcome")
+	certExpiry = metrics.Default.NewGaugeVec(
+		"fdo_proxy_acme_cert_expiry_timestamp",
+		"Expiry of the ACME certificate served, in seconds since 1970.")
+)
+
+// LetsEncrypt is the Let's Encrypt production directory.
+const LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+// alpnProto is the ALPN protocol of tls-alpn-01 validation (RFC 8737).
+const alpnProto = "acme-tls/1"
+
+// oidACMEIdentifier marks tls-alpn-01 challenge certificates.
+var oidACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// checkInterval is how often the certificate is checked for renewal, and
+// how long a failed issuance waits before it is retried.
+const checkInterval = time.Hour
+
+// Options configure a Manager.
+type Options struct {
+	// DirectoryURL is the CA's ACME directory (default LetsEncrypt).
+	DirectoryURL string
+	// Email is the account contact the CA sends expiry notices to.
+	Email string
+	// Domains are the names the certificate covers.
+	Domains []string
+	// CacheDir keeps the account key and the certificate across restarts,
+	// so restarts do not count against the CA's rate limits.
+	CacheDir string
+}
+
+// Manager holds one certificate covering all configured domains, issues
+// it on first use and renews it well before it expires.
+type Manager struct {
+	domains []string
+	email   string
+	dir     string
+	client  *client
+
+	mu   sync.Mutex // serializes issuance
+	cert atomic.Pointer[tls.Certificate]
+	// failed is the last failed issuance, nil once one succeeds.
+	failed atomic.Pointer[failure]
+
+	chMu   sync.Mutex
+	tokens map[string]string           // http-01 token -> key authorization
+	alpn   map[string]*tls.Certificate // tls-alpn-01 domain -> certificate
+}
+
+// failure is a failed issuance.
+type failure struct {
+	at  time.Time
+	err error
+}
+
+// New creates a Manager, loading the account key and any certificate from
+// the cache directory and creating an account key if there is none.
+func New(opts Options) (*Manager, error) {
+	if len(opts.Domains) == 0 {
+		return nil, errors.New("acme: no domains")
+	}
+	if opts.CacheDir == "" {
+		return nil, errors.New("acme: no cache directory")
+	}
+	if opts.DirectoryURL == "" {
+		opts.DirectoryURL = LetsEncrypt
+	}
+	if err := os.MkdirAll(opts.CacheDir, 0o700); err != nil {
+		return nil, fmt.Errorf("acme: %w", err)
+	}
+	m := &Manager{
+		email:  opts.Email,
+		dir:    opts.CacheDir,
+		tokens: make(map[string]string),
+		alpn:   make(map[string]*tls.Certificate),
+	}
+	for _, d := range opts.Domains {
+		m.domains = append(m.domains, strings.ToLower(d))
+	}
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	m.client = &client{dirURL: opts.DirectoryURL, key: key, http: &http.Client{Timeout: 30 * time.Second}}
+
+	cert, err := tls.LoadX509KeyPair(m.path("cert.pem"), m.path("cert.key"))
+	switch {
+	case err == nil && m.covers(cert.Leaf):
+		m.setCert(&cert)
+	case err == nil:
+		slog.Info("Cached ACME certificate does not cover the configured domains, reissuing", "dns_names", cert.Leaf.DNSNames)
+	case !errors.Is(err, os.ErrNotExist):
+		slog.Warn("Cached ACME certificate unusable, reissuing", "error", err)
+	}
+	return m, nil
+}
+
+func (m *Manager) path(name string) string {
+	return filepath.Join(m.dir, name)
+}
+
+func (m *Manager) accountKey() (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(m.path("account.key"))
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("acme: account.key is not PEM")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("acme: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(m.path("account.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// covers reports whether leaf names every configured domain.
+func (m *Manager) covers(leaf *x509.Certificate) bool {
+	for _, d := range m.domains {
+		if !slices.Contains(leaf.DNSNames, d) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Manager) setCert(cert *tls.Certificate) {
+	m.cert.Store(cert)
+	certExpiry.Set(float64(cert.Leaf.NotAfter.Unix()))
+}
+
+// dueForRenewal reports whether cert is missing or in the last third of
+// its lifetime, at most 30 days before it expires.
+func dueForRenewal(cert *tls.Certificate, now time.Time) bool {
+	if cert == nil {
+		return true
+	}
+	leaf := cert.Leaf
+	window := min(leaf.NotAfter.Sub(leaf.NotBefore)/3, 30*24*time.Hour)
+	return now.After(leaf.NotAfter.Add(-window))
+}
+
+// Configure serves m's certificate from cfg and answers tls-alpn-01
+// challenges on it, also for listeners requiring client certificates.
+func (m *Manager) Configure(cfg *tls.Config) {
+	cfg.Certificates = nil
+	cfg.GetCertificate = m.GetCertificate
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	cfg.NextProtos = append(cfg.NextProtos, alpnProto)
+	next := cfg.GetConfigForClient
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if slices.Contains(hello.SupportedProtos, alpnProto) {
+			return &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				NextProtos:     []string{alpnProto},
+				GetCertificate: m.GetCertificate,
+			}, nil
+		}
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+}
+
+// GetCertificate serves the certificate, issuing it first if there is
+// none yet, or a tls-alpn-01 challenge certificate to the CA. After a
+// failed issuance it fails at once until Run retries, rather than asking
+// the CA again on every handshake.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if slices.Contains(hello.SupportedProtos, alpnProto) {
+		m.chMu.Lock()
+		cert := m.alpn[strings.ToLower(hello.ServerName)]
+		m.chMu.Unlock()
+		if cert == nil {
+			return nil, fmt.Errorf("acme: no tls-alpn-01 challenge for %q", hello.ServerName)
+		}
+		return cert, nil
+	}
+	if cert := m.cert.Load(); cert != nil {
+		return cert, nil
+	}
+	if err := m.failedRecently(); err != nil {
+		return nil, err
+	}
+	if err := m.obtain(hello.Context(), false); err != nil {
+		return nil, err
+	}
+	return m.cert.Load(), nil
+}
+
+// failedRecently returns the last issuance failure if Run has not retried
+// since.
+func (m *Manager) failedRecently() error {
+	f := m.failed.Load()
+	if f == nil || time.Since(f.at) >= checkInterval {
+		return nil
+	}
+	return fmt.Errorf("acme: no certificate, issuance failed at %s and is retried by %s: %w",
+		f.at.UTC().Format(time.RFC3339), f.at.Add(checkInterval).UTC().Format(time.RFC3339), f.err)
+}
+
+// HTTPHandler answers http-01 challenges and passes other requests to
+// fallback, or redirects them to HTTPS when fallback is nil.
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.URL.Path, "/.well-known/acme-challenge/"); ok {
+			m.chMu.Lock()
+			keyAuth, ok := m.tokens[token]
+			m.chMu.Unlock()
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(keyAuth))
+			return
+		}
+		if fallback != nil {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusFound)
+	})
+}
+
+// Run issues the certificate if needed and renews it until ctx is done.
+// Failures are retried every hour while the current certificate, if any,
+// stays in use.
+func (m *Manager) Run(ctx context.Context) {
+	for {
+		if dueForRenewal(m.cert.Load(), time.Now()) {
+			if err := m.obtain(ctx, true); err != nil && ctx.Err() == nil {
+				slog.Error("ACME certificate issuance failed", "domains", m.domains, "error", err)
+			}
+		}
+		if sleep(ctx, checkInterval) != nil {
+			return
+		}
+	}
+}
+
+// obtain issues a certificate unless another caller just did. Unless
+// retry is set, it also returns a recent failure instead of issuing, so
+// handshakes waiting on a failing issuance do not each try again.
+func (m *Manager) obtain(ctx context.Context, retry bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !dueForRenewal(m.cert.Load(), time.Now()) {
+		return nil
+	}
+	if !retry {
+		if err := m.failedRecently(); err != nil {
+			return err
+		}
+	}
+	ictx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	cert, err := m.issue(ictx)
+	if err != nil {
+		renewals.Inc("error")
+		// A handshake giving up is not the CA failing
+		if ctx.Err() == nil {
+			m.failed.Store(&failure{at: time.Now(), err: err})
+		}
+		return err
+	}
+	renewals.Inc("success")
+	m.failed.Store(nil)
+	m.setCert(cert)
+	slog.Info("ACME certificate issued", "domains", m.domains, "expires", cert.Leaf.NotAfter)
+	return nil
+}
+
+func (m *Manager) issue(ctx context.Context) (*tls.Certificate, error) {
+	c := m.client
+	if c.kid == "" {
+		if err := c.register(ctx, m.email); err != nil {
+			return nil, err
+		}
+	}
+	o, err := c.newOrder(ctx, m.domains)
+	if err != nil {
+		return nil, err
+	}
+	for _, authz := range o.Authorizations {
+		if err := c.authorize(ctx, authz, m.solve); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.waitOrder(ctx, o); err != nil {
+		return nil, err
+	}
+	if o.Status != "ready" {
+		return nil, fmt.Errorf("acme order %s: %v", o.Status, o.Error)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.domains[0]},
+		DNSNames: m.domains,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.finalize(ctx, o, csr); err != nil {
+		return nil, err
+	}
+	if o.Status != "valid" {
+		return nil, fmt.Errorf("acme order %s after finalize: %v", o.Status, o.Error)
+	}
+	chain, err := c.download(ctx, o.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	cert, err := tls.X509KeyPair(chain, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("acme certificate: %w", err)
+	}
+	if err := writeFile(m.path("cert.key"), keyPEM); err != nil {
+		return nil, err
+	}
+	if err := writeFile(m.path("cert.pem"), chain); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// solve makes the http-01 or tls-alpn-01 challenge ch answerable.
+func (m *Manager) solve(domain string, ch challenge) (func(), bool) {
+	keyAuth := m.client.keyAuthorization(ch.Token)
+	switch ch.Type {
+	case "http-01":
+		m.chMu.Lock()
+		m.tokens[ch.Token] = keyAuth
+		m.chMu.Unlock()
+		return func() {
+			m.chMu.Lock()
+			delete(m.tokens, ch.Token)
+			m.chMu.Unlock()
+		}, true
+	case "tls-alpn-01":
+		cert, err := alpnCertificate(domain, keyAuth)
+		if err != nil {
+			slog.Warn("Failed to create tls-alpn-01 certificate", "domain", domain, "error", err)
+			return nil, false
+		}
+		domain = strings.ToLower(domain)
+		m.chMu.Lock()
+		m.alpn[domain] = cert
+		m.chMu.Unlock()
+		return func() {
+			m.chMu.Lock()
+			delete(m.alpn, domain)
+			m.chMu.Unlock()
+		}, true
+	}
+	return nil, false
+}
+
+// alpnCertificate builds the self-signed certificate RFC 8737 validates,
+// carrying the SHA-256 of the key authorization.
+func alpnCertificate(domain, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	ext, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(now.UnixNano()),
+		Subject:         pkix.Name{CommonName: domain},
+		DNSNames:        []string{domain},
+		NotBefore:       now.Add(-time.Hour),
+		NotAfter:        now.Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: oidACMEIdentifier, Critical: true, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// writeFile replaces path atomically, readable only by the owner.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("acme: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("acme: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeCA is an ACME server issuing from a throwaway CA. It checks every
+// JWS the client sends: signature, nonce, URL and account.
+type fakeCA struct {
+	t      *testing.T
+	srv    *httptest.Server
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+	// validate fetches the key authorization for a token from the client,
+	// as the CA's validation servers would.
+	validate func(token string) string
+
+	mu        sync.Mutex
+	nonces    map[string]bool
+	nextNonce int
+	account   *ecdsa.PublicKey
+	thumb     string
+	badNonce  bool // reject the next request with badNonce
+	authzDone bool
+	polls     int
+	issued    []byte
+}
+
+const testToken = "evaGxfADs6pSRb2LAv9IZf17Dt3juxGJ-PCt92wr-oA"
+
+func newFakeCA(t *testing.T) *fakeCA {
+	t.Helper()
+	ca := &fakeCA{t: t, nonces: make(map[string]bool), badNonce: true}
+	ca.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.caKey.PublicKey, ca.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.caCert, _ = x509.ParseCertificate(der)
+	ca.srv = httptest.NewServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+func (ca *fakeCA) url(path string) string { return ca.srv.URL + path }
+
+func (ca *fakeCA) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(directory{
+			NewNonce:   ca.url("/new-nonce"),
+			NewAccount: ca.url("/new-account"),
+			NewOrder:   ca.url("/new-order"),
+		})
+		return
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.nextNonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", ca.nextNonce))
+	ca.nonces[fmt.Sprintf("nonce-%d", ca.nextNonce)] = true
+	if r.URL.Path == "/new-nonce" {
+		return
+	}
+
+	payload, err := ca.verify(r)
+	if err != nil {
+		ca.t.Errorf("%s: %v", r.URL.Path, err)
+		ca.problem(w, "malformed", err.Error())
+		return
+	}
+	if ca.badNonce && r.URL.Path == "/new-order" {
+		ca.badNonce = false
+		ca.problem(w, "badNonce", "stale nonce")
+		return
+	}
+	switch r.URL.Path {
+	case "/new-account":
+		var req struct {
+			Terms   bool     `json:"termsOfServiceAgreed"`
+			Contact []string `json:"contact"`
+		}
+		json.Unmarshal(payload, &req)
+		if !req.Terms || len(req.Contact) != 1 || req.Contact[0] != "mailto:ops@example.com" {
+			ca.t.Errorf("new account request = %s", payload)
+		}
+		w.Header().Set("Location", ca.url("/account/1"))
+		w.WriteHeader(http.StatusCreated)
+	case "/new-order":
+		if !strings.Contains(string(payload), `{"type":"dns","value":"fdo.example.com"}`) {
+			ca.t.Errorf("new order request = %s", payload)
+		}
+		w.Header().Set("Location", ca.url("/order/1"))
+		w.WriteHeader(http.StatusCreated)
+		ca.order(w, "pending")
+	case "/order/1":
+		// The order is ready once the authorization is, after a poll
+		ca.polls++
+		if ca.authzDone && ca.polls > 1 {
+			ca.order(w, "ready")
+		} else {
+			ca.order(w, "pending")
+		}
+	case "/authz/1":
+		status := "pending"
+		if ca.authzDone {
+			status = "valid"
+		}
+		fmt.Fprintf(w, `{"status":%q,"identifier":{"type":"dns","value":"fdo.example.com"},"challenges":[
+			{"type":"dns-01","url":%q,"token":"unused","status":"pending"},
+			{"type":"http-01","url":%q,"token":%q,"status":"pending"}]}`,
+			status, ca.url("/chall/dns"), ca.url("/chall/http"), testToken)
+	case "/chall/http":
+		if got, want := ca.validate(testToken), testToken+"."+ca.thumb; got != want {
+			ca.t.Errorf("key authorization = %q, want %q", got, want)
+		} else {
+			ca.authzDone = true
+		}
+		fmt.Fprint(w, `{"status":"processing"}`)
+	case "/order/1/finalize":
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || csr.CheckSignature() != nil || len(csr.DNSNames) != 1 || csr.DNSNames[0] != "fdo.example.com" {
+			ca.t.Errorf("CSR = %+v, %v", csr, err)
+			ca.problem(w, "badCSR", "bad CSR")
+			return
+		}
+		leaf, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}, ca.caCert, csr.PublicKey, ca.caKey)
+		if err != nil {
+			ca.t.Fatal(err)
+		}
+		ca.issued = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})...)
+		ca.order(w, "valid")
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.issued)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (ca *fakeCA) order(w http.ResponseWriter, status string) {
+	fmt.Fprintf(w, `{"status":%q,"authorizations":[%q],"finalize":%q,"certificate":%q}`,
+		status, ca.url("/authz/1"), ca.url("/order/1/finalize"), ca.url("/cert/1"))
+}
+
+func (ca *fakeCA) problem(w http.ResponseWriter, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, `{"type":"urn:ietf:params:acme:error:%s","detail":%q}`, typ, detail)
+}
+
+// verify checks the JWS of r and returns its payload.
+func (ca *fakeCA) verify(r *http.Request) ([]byte, error) {
+	if ct := r.Header.Get("Content-Type"); ct != "application/jose+json" {
+		return nil, fmt.Errorf("content type %q", ct)
+	}
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&jws); err != nil {
+		return nil, err
+	}
+	enc := base64.RawURLEncoding
+	hdrJSON, _ := enc.DecodeString(jws.Protected)
+	var hdr struct {
+		Alg   string            `json:"alg"`
+		Nonce string            `json:"nonce"`
+		URL   string            `json:"url"`
+		KID   string            `json:"kid"`
+		JWK   map[string]string `json:"jwk"`
+	}
+	if err := json.Unmarshal(hdrJSON, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.Alg != "ES256" {
+		return nil, fmt.Errorf("alg %q", hdr.Alg)
+	}
+	if !ca.nonces[hdr.Nonce] {
+		return nil, fmt.Errorf("nonce %q not issued or reused", hdr.Nonce)
+	}
+	delete(ca.nonces, hdr.Nonce)
+	if hdr.URL != ca.url(r.URL.Path) {
+		return nil, fmt.Errorf("url %q", hdr.URL)
+	}
+
+	key := ca.account
+	switch {
+	case r.URL.Path == "/new-account":
+		if hdr.JWK == nil || hdr.KID != "" {
+			return nil, fmt.Errorf("new account must carry jwk, not kid")
+		}
+		x, _ := enc.DecodeString(hdr.JWK["x"])
+		y, _ := enc.DecodeString(hdr.JWK["y"])
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		canon, _ := json.Marshal(map[string]string{"crv": hdr.JWK["crv"], "kty": hdr.JWK["kty"], "x": hdr.JWK["x"], "y": hdr.JWK["y"]})
+		sum := sha256.Sum256(canon)
+		ca.account, ca.thumb = key, enc.EncodeToString(sum[:])
+	case hdr.KID != ca.url("/account/1") || hdr.JWK != nil:
+		return nil, fmt.Errorf("kid %q, jwk %v", hdr.KID, hdr.JWK)
+	}
+
+	sig, _ := enc.DecodeString(jws.Signature)
+	sum := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(key, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, fmt.Errorf("bad signature")
+	}
+	return enc.DecodeString(jws.Payload)
+}
+
+// handshake connects to a TLS listener configured by m, verifying its
+// certificate for fdo.example.com against root, and returns the chain it
+// served.
+func handshake(m *Manager, root *x509.Certificate) ([]*x509.Certificate, error) {
+	cfg := &tls.Config{}
+	m.Configure(cfg)
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+	go tls.Server(sc, cfg).Handshake()
+
+	roots := x509.NewCertPool()
+	if root != nil {
+		roots.AddCert(root)
+	}
+	c := tls.Client(cc, &tls.Config{ServerName: "fdo.example.com", RootCAs: roots})
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	return c.ConnectionState().PeerCertificates, nil
+}
+
+func TestIssue(t *testing.T) {
+	ca := newFakeCA(t)
+	dir := t.TempDir()
+	m, err := New(Options{
+		DirectoryURL: ca.url("/directory"),
+		Email:        "ops@example.com",
+		Domains:      []string{"FDO.example.com"},
+		CacheDir:     dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenges := m.HTTPHandler(nil)
+	ca.validate = func(token string) string {
+		rec := httptest.NewRecorder()
+		challenges.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/acme-challenge/"+token, nil))
+		return rec.Body.String()
+	}
+
+	chain, err := handshake(m, ca.caCert)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if len(chain) != 2 || chain[0].DNSNames[0] != "fdo.example.com" {
+		t.Fatalf("served chain = %v", chain)
+	}
+	// The challenge is withdrawn once answered
+	if got := ca.validate(testToken); got == testToken+"."+ca.thumb {
+		t.Error("challenge still served after issuance")
+	}
+
+	// A restart loads the account key and certificate from the cache
+	m2, err := New(Options{DirectoryURL: ca.url("/directory"), Domains: []string{"fdo.example.com"}, CacheDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.client.thumbprint() != ca.thumb {
+		t.Error("account key not reloaded from the cache")
+	}
+	if c := m2.cert.Load(); c == nil || !c.Leaf.Equal(chain[0]) {
+		t.Error("certificate not reloaded from the cache")
+	}
+}
+
+func TestIssueFailureIsCached(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	m, err := New(Options{DirectoryURL: srv.URL, Domains: []string{"fdo.example.com"}, CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if _, err := handshake(m, nil); err == nil {
+			t.Fatal("handshake succeeded")
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("CA asked %d times, want 1 until Run retries", n)
+	}
+	if err := m.obtain(context.Background(), true); err == nil || calls.Load() != 2 {
+		t.Errorf("retry = %v after %d calls, want a second attempt", err, calls.Load())
+	}
+}
+
+func TestALPNCertificate(t *testing.T) {
+	keyAuth := testToken + ".thumbprint"
+	cert, err := alpnCertificate("fdo.example.com", keyAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, ext := range leaf.Extensions {
+		if !ext.Id.Equal(oidACMEIdentifier) {
+			continue
+		}
+		var digest []byte
+		if _, err := asn1.Unmarshal(ext.Value, &digest); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256([]byte(keyAuth))
+		found = ext.Critical && string(digest) == string(sum[:])
+	}
+	if !found || leaf.DNSNames[0] != "fdo.example.com" {
+		t.Errorf("no critical acmeIdentifier extension with the key authorization digest")
+	}
+}
+
+func TestDueForRenewal(t *testing.T) {
+	now := time.Now()
+	cert := func(notBefore, notAfter time.Time) *tls.Certificate {
+		return &tls.Certificate{Leaf: &x509.Certificate{NotBefore: notBefore, NotAfter: notAfter}}
+	}
+	tests := []struct {
+		name string
+		cert *tls.Certificate
+		want bool
+	}{
+		{"none", nil, true},
+		{"fresh 90 days", cert(now, now.Add(90*24*time.Hour)), false},
+		{"29 days left of 90", cert(now.Add(-61*24*time.Hour), now.Add(29*24*time.Hour)), true},
+		{"5 of 6 days left", cert(now.Add(-24*time.Hour), now.Add(5*24*time.Hour)), false},
+		{"1 of 6 days left", cert(now.Add(-5*24*time.Hour), now.Add(24*time.Hour)), true},
+	}
+	for _, tt := range tests {
+		if got := dueForRenewal(tt.cert, now); got != tt.want {
+			t.Errorf("%s: dueForRenewal = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPHandlerFallback(t *testing.T) {
+	m := &Manager{tokens: map[string]string{}}
+	rec := httptest.NewRecorder()
+	m.HTTPHandler(nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://fdo.example.com/health?x=1", nil))
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusFound || loc != "https://fdo.example.com/health?x=1" {
+		t.Errorf("redirect = %d %q", rec.Code, loc)
+	}
+	rec = httptest.NewRecorder()
+	m.HTTPHandler(nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/acme-challenge/unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown token = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,376 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// The RFC 8555 subset needed to issue one certificate: an account with
+// an ES256 key, orders, http-01 and tls-alpn-01 challenges and finalizing
+// with a CSR.
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type order struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	Error          *problem `json:"error"`
+	url            string
+}
+
+type authorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *problem `json:"error"`
+}
+
+// problem is an RFC 7807 error document.
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *problem) Error() string {
+	return fmt.Sprintf("%s: %s", p.Type, p.Detail)
+}
+
+// client talks to one ACME server with one account key.
+type client struct {
+	dirURL string
+	key    *ecdsa.PrivateKey
+	http   *http.Client
+
+	dir   *directory
+	kid   string
+	nonce string
+}
+
+func (c *client) discover(ctx context.Context) error {
+	if c.dir != nil {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.dirURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("acme directory: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("acme directory: status %d", resp.StatusCode)
+	}
+	var d directory
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return fmt.Errorf("acme directory: %w", err)
+	}
+	c.dir = &d
+	return nil
+}
+
+// register creates the account, or finds the one the key already has.
+func (c *client) register(ctx context.Context, email string) error {
+	if err := c.discover(ctx); err != nil {
+		return err
+	}
+	req := map[string]any{"termsOfServiceAgreed": true}
+	if email != "" {
+		req["contact"] = []string{"mailto:" + email}
+	}
+	resp, err := c.post(ctx, c.dir.NewAccount, req, nil)
+	if err != nil {
+		return fmt.Errorf("acme account: %w", err)
+	}
+	c.kid = resp.Header.Get("Location")
+	if c.kid == "" {
+		return errors.New("acme account: no account URL")
+	}
+	return nil
+}
+
+func (c *client) newOrder(ctx context.Context, domains []string) (*order, error) {
+	type identifier struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	var ids []identifier
+	for _, d := range domains {
+		ids = append(ids, identifier{Type: "dns", Value: d})
+	}
+	var o order
+	resp, err := c.post(ctx, c.dir.NewOrder, map[string]any{"identifiers": ids}, &o)
+	if err != nil {
+		return nil, fmt.Errorf("acme order: %w", err)
+	}
+	o.url = resp.Header.Get("Location")
+	return &o, nil
+}
+
+// waitOrder polls the order until it leaves the pending and processing
+// states.
+func (c *client) waitOrder(ctx context.Context, o *order) error {
+	for o.Status == "pending" || o.Status == "processing" {
+		if err := sleep(ctx, time.Second); err != nil {
+			return err
+		}
+		url := o.url
+		if _, err := c.post(ctx, url, nil, o); err != nil {
+			return fmt.Errorf("acme order: %w", err)
+		}
+		o.url = url
+	}
+	return nil
+}
+
+// authorize completes the authorization at url with solve, which makes a
+// challenge for the domain answerable and returns a function undoing
+// that, or reports it cannot answer that challenge type.
+func (c *client) authorize(ctx context.Context, url string, solve func(domain string, ch challenge) (func(), bool)) error {
+	var a authorization
+	if _, err := c.post(ctx, url, nil, &a); err != nil {
+		return fmt.Errorf("acme authorization: %w", err)
+	}
+	if a.Status == "valid" {
+		return nil
+	}
+	var chosen *challenge
+	var undo func()
+	for i := range a.Challenges {
+		if u, ok := solve(a.Identifier.Value, a.Challenges[i]); ok {
+			chosen, undo = &a.Challenges[i], u
+			break
+		}
+	}
+	if chosen == nil {
+		return fmt.Errorf("acme authorization for %s: no supported challenge", a.Identifier.Value)
+	}
+	defer undo()
+	if _, err := c.post(ctx, chosen.URL, map[string]any{}, nil); err != nil {
+		return fmt.Errorf("acme challenge %s: %w", chosen.Type, err)
+	}
+	for {
+		if err := sleep(ctx, time.Second); err != nil {
+			return err
+		}
+		if _, err := c.post(ctx, url, nil, &a); err != nil {
+			return fmt.Errorf("acme authorization: %w", err)
+		}
+		switch a.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+			continue
+		}
+		for _, ch := range a.Challenges {
+			if ch.Error != nil {
+				return fmt.Errorf("acme authorization for %s %s: %w", a.Identifier.Value, a.Status, ch.Error)
+			}
+		}
+		return fmt.Errorf("acme authorization for %s %s", a.Identifier.Value, a.Status)
+	}
+}
+
+func (c *client) finalize(ctx context.Context, o *order, csr []byte) error {
+	url := o.url
+	req := map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}
+	if _, err := c.post(ctx, o.Finalize, req, o); err != nil {
+		return fmt.Errorf("acme finalize: %w", err)
+	}
+	o.url = url
+	return c.waitOrder(ctx, o)
+}
+
+// download fetches the issued PEM chain.
+func (c *client) download(ctx context.Context, url string) ([]byte, error) {
+	resp, err := c.post(ctx, url, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("acme certificate: %w", err)
+	}
+	return resp.body, nil
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint of the account key, part of
+// every key authorization.
+func (c *client) thumbprint() string {
+	jwk := c.jwk()
+	canon := fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, jwk["crv"], jwk["x"], jwk["y"])
+	sum := sha256.Sum256([]byte(canon))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (c *client) keyAuthorization(token string) string {
+	return token + "." + c.thumbprint()
+}
+
+func (c *client) jwk() map[string]string {
+	// The key is P-256: an uncompressed point is 0x04 || x || y
+	pub, _ := c.key.PublicKey.ECDH()
+	point := pub.Bytes()[1:]
+	return map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(point[:32]),
+		"y":   base64.RawURLEncoding.EncodeToString(point[32:]),
+	}
+}
+
+type response struct {
+	*http.Response
+	body []byte
+}
+
+// post sends payload as a JWS signed with the account key, or a
+// POST-as-GET when payload is nil, decoding the answer into out. A
+// badNonce rejection is retried once with the fresh nonce.
+func (c *client) post(ctx context.Context, url string, payload, out any) (*response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.postOnce(ctx, url, payload)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 400 {
+			var p problem
+			if json.Unmarshal(resp.body, &p) == nil && p.Type != "" {
+				if p.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+					continue
+				}
+				return nil, &p
+			}
+			return nil, fmt.Errorf("status %d", resp.StatusCode)
+		}
+		if out != nil {
+			if err := json.Unmarshal(resp.body, out); err != nil {
+				return nil, err
+			}
+		}
+		return resp, nil
+	}
+}
+
+func (c *client) postOnce(ctx context.Context, url string, payload any) (*response, error) {
+	nonce, err := c.takeNonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+	protected := map[string]any{"alg": "ES256", "nonce": nonce, "url": url}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = c.jwk()
+	}
+	hdr, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString(hdr) + "." + enc.EncodeToString(body)
+	sig, err := c.sign([]byte(signingInput))
+	if err != nil {
+		return nil, err
+	}
+	jws, err := json.Marshal(map[string]string{
+		"protected": enc.EncodeToString(hdr),
+		"payload":   enc.EncodeToString(body),
+		"signature": enc.EncodeToString(sig),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jws))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if n := resp.Header.Get("Replay-Nonce"); n != "" {
+		c.nonce = n
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return &response{Response: resp, body: data}, nil
+}
+
+// sign produces the fixed-size r||s signature JWS uses for ES256.
+func (c *client) sign(data []byte) ([]byte, error) {
+	sum := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 64)
+	r.FillBytes(out[:32])
+	s.FillBytes(out[32:])
+	return out, nil
+}
+
+func (c *client) takeNonce(ctx context.Context) (string, error) {
+	if n := c.nonce; n != "" {
+		c.nonce = ""
+		return n, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("acme nonce: %w", err)
+	}
+	resp.Body.Close()
+	n := resp.Header.Get("Replay-Nonce")
+	if n == "" {
+		return "", errors.New("acme nonce: none returned")
+	}
+	return n, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,167 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/audit"
+	"github.com/fdo-server-wrapper/internal/correlation"
+)
+
+// auditKey is the context key of a request's auditRecord.
+type auditKey struct{}
+
+// auditRecord collects what a handler reports about the change it made.
+type auditRecord struct {
+	principal string
+	requestID string
+	before    any
+	after     any
+	changed   bool
+}
+
+// mutating reports whether a request with method can change state.
+func mutating(method string) bool {
+	return method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions
+}
+
+// statusRecorder captures the status code written by the handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Changed reports the state an admin request changed, before and after,
+// for the audit trail; nil stands for none, such as before a ban is
+// placed. Values are recorded as JSON. It does nothing unless the server
+// audits the request.
+func Changed(r *http.Request, before, after any) {
+	rec, _ := r.Context().Value(auditKey{}).(*auditRecord)
+	if rec == nil {
+		return
+	}
+	rec.before, rec.after, rec.changed = before, after, true
+}
+
+// beginAudit prepares r for recording, giving it a request ID the handler
+// and the response share if the client sent none.
+func beginAudit(w http.ResponseWriter, r *http.Request) *auditRecord {
+	id := strings.TrimSpace(r.Header.Get(correlation.RequestIDHeader))
+	if id == "" || len(id) > 128 {
+		id = correlation.NewRequestID()
+		r.Header.Set(correlation.RequestIDHeader, id)
+	}
+	w.Header().Set(correlation.RequestIDHeader, id)
+	return &auditRecord{requestID: id}
+}
+
+// record appends the answered request r to the trail.
+func (s *Server) record(r *http.Request, rec *auditRecord, sw *statusRecorder) {
+	a := audit.Action{
+		Time:       time.Now(),
+		Principal:  rec.principal,
+		RemoteAddr: r.RemoteAddr,
+		RequestID:  rec.requestID,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Status:     sw.status,
+	}
+	if rec.changed {
+		a.Before = auditValue(rec.before)
+		a.After = auditValue(rec.after)
+	}
+	if _, err := s.trail.Record(a); err != nil {
+		// The change is made; report the gap loudly
+		slog.Error("Admin action not recorded in the audit trail", "method", a.Method, "path", a.Path, "principal", a.Principal, "request_id", a.RequestID, "error", err)
+	}
+}
+
+// auditValue encodes v for an audit.Action, nil for none.
+func auditValue(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil || bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+	return b
+}
+
+// LoadTokens reads a file of admin tokens keyed by the principal each
+// authenticates, e.g. {"alice": "...", "ci": "..."}, for RequireTokens.
+// Names and tokens must be non-empty and tokens distinct.
+func LoadTokens(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read admin tokens: %w", err)
+	}
+	var tokens map[string]string
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return nil, fmt.Errorf("parse admin tokens: %w", err)
+	}
+	seen := make(map[string]string, len(tokens))
+	for name, token := range tokens {
+		switch {
+		case strings.TrimSpace(name) == "":
+			return nil, fmt.Errorf("admin tokens: empty principal name")
+		case token == "":
+			return nil, fmt.Errorf("admin tokens: empty token for %q", name)
+		case seen[token] != "":
+			return nil, fmt.Errorf("admin tokens: %q and %q share a token", seen[token], name)
+		}
+		seen[token] = name
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("admin tokens: %s names none", path)
+	}
+	return tokens, nil
+}
+
+// AuditHandler serves GET /admin/audit: the admin audit trail, oldest
+// first, and whether its hash chain verifies against the file.
+// ?limit=N keeps the last N actions.
+func AuditHandler(t *audit.Trail) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		actions := t.Entries()
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			actions = actions[max(0, len(actions)-n):]
+		}
+		resp := struct {
+			Intact   bool           `json:"intact"`
+			Verified int            `json:"verified"`
+			Error    string         `json:"error,omitempty"`
+			Actions  []audit.Action `json:"actions"`
+		}{Actions: actions}
+		n, err := t.Verify()
+		resp.Verified = n
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Intact = true
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
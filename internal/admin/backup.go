@@ -0,0 +1,32 @@
+package admin
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/backup"
+	"github.com/fdo-server-wrapper/internal/version"
+)
+
+// BackupHandler serves GET /admin/backup: a gzipped tarball of files, as
+// the proxy runs, for -restore on a replacement gateway.
+func BackupHandler(files []backup.File) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		filename := "fdo-proxy-backup-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		m, err := backup.Write(w, files, version.Get().String())
+		if err != nil {
+			// The response has started; the client sees a truncated archive
+			slog.Error("Backup failed", "remote_addr", r.RemoteAddr, "error", err)
+			return
+		}
+		slog.Info("Backup downloaded", "remote_addr", r.RemoteAddr, "files", len(m.Files))
+	})
+}
@@ -0,0 +1,100 @@
+package admin
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/ban"
+)
+
+// BansHandler serves the client addresses and devices refused sessions
+// under /admin/bans:
+//
+//	GET    /admin/bans                 every ban in force
+//	PUT    /admin/bans/{kind}/{value}  bans a client address or device
+//	DELETE /admin/bans/{kind}/{value}  lifts a ban
+//
+// kind is ip, serial or guid. The PUT body is optional JSON
+// {"ttl": "1h", "reason": "..."}; without a ttl the ban lasts until it is
+// lifted. It replaces any ban of the same address or device.
+func BansHandler(l *ban.List) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/bans"), "/")
+		if rest == "" {
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", "GET")
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			entries, err := l.All(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			writeJSON(w, http.StatusOK, entries)
+			return
+		}
+		kind, value, _ := strings.Cut(rest, "/")
+		value, err := ban.Normalize(kind, value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key := kind + ":" + value
+		var before *ban.Entry
+		if e, ok, _ := l.Get(r.Context(), key); ok {
+			before = &e
+		}
+		switch r.Method {
+		case http.MethodPut:
+			var body struct {
+				TTL    string `json:"ttl"`
+				Reason string `json:"reason"`
+			}
+			if r.ContentLength != 0 {
+				dec := json.NewDecoder(r.Body)
+				dec.DisallowUnknownFields()
+				if err := dec.Decode(&body); err != nil {
+					http.Error(w, "invalid JSON body", http.StatusBadRequest)
+					return
+				}
+			}
+			e := ban.Entry{Kind: kind, Value: value, Reason: body.Reason, Source: ban.SourceAdmin, Since: time.Now().UTC()}
+			if body.TTL != "" {
+				ttl, err := time.ParseDuration(body.TTL)
+				if err != nil || ttl <= 0 {
+					http.Error(w, "ttl must be a positive duration such as 30m", http.StatusBadRequest)
+					return
+				}
+				e.Until = e.Since.Add(ttl)
+			}
+			if _, err := l.Add(r.Context(), e); err != nil {
+				slog.Error("Failed to store ban", "key", key, "error", err)
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			Changed(r, before, e)
+			slog.Info("Ban placed by operator", "key", key, "until", e.Until, "reason", e.Reason, "remote_addr", r.RemoteAddr)
+			writeJSON(w, http.StatusOK, e)
+		case http.MethodDelete:
+			found, err := l.Lift(r.Context(), key)
+			switch {
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			case !found:
+				http.Error(w, "no ban of "+key, http.StatusNotFound)
+				return
+			}
+			Changed(r, before, nil)
+			slog.Info("Ban lifted", "key", key, "remote_addr", r.RemoteAddr)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "PUT, DELETE")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package admin
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/fdo-server-wrapper/internal/ledger"
+)
+
+// CacheHandler serves the product passport cache under /admin/cache, for
+// when passport data is corrected while devices are being onboarded:
+//
+//	GET    /admin/cache          the cached passports and held lookups
+//	DELETE /admin/cache          flushes the cache and held lookups
+//	GET    /admin/cache/{uuid}   the cached passport of a product UUID
+//	DELETE /admin/cache/{uuid}   invalidates one product UUID
+//
+// Held lookups are the not-found answers and failures keeping the client
+// from asking the passport service again for a while; invalidating a UUID
+// forgets those too, so the next DI for it fetches the corrected passport.
+func CacheHandler(c *ledger.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uuid := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/cache"), "/")
+		if uuid == "" {
+			switch r.Method {
+			case http.MethodGet:
+				writeJSON(w, http.StatusOK, c.CacheStatus())
+			case http.MethodDelete:
+				before := c.CacheStatus()
+				passports, held := c.FlushCache()
+				Changed(r, struct {
+					Passports int `json:"passports"`
+					Held      int `json:"held"`
+				}{len(before.Entries), len(before.Held)}, nil)
+				slog.Info("Passport cache flushed", "passports", passports, "held", held, "remote_addr", r.RemoteAddr)
+				writeJSON(w, http.StatusOK, map[string]int{"passports": passports, "held": held})
+			default:
+				w.Header().Set("Allow", "GET, DELETE")
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			}
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			p, ok := c.CachedPassport(uuid)
+			if !ok {
+				http.Error(w, "no cached passport for "+uuid, http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, p)
+		case http.MethodDelete:
+			before, _ := c.CachedPassport(uuid)
+			if !c.InvalidatePassport(uuid) {
+				http.Error(w, "nothing cached or held for "+uuid, http.StatusNotFound)
+				return
+			}
+			before.Passport = nil
+			Changed(r, before, nil)
+			slog.Info("Passport cache entry invalidated", "uuid", uuid, "remote_addr", r.RemoteAddr)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,18 @@
+package admin
+
+import (
+	"net/http"
+)
+
+// ConfigHandler serves GET /admin/config: the effective configuration of
+// the running proxy as reported by current, which must leave secrets out.
+func ConfigHandler(current func() any) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, current())
+	})
+}
@@ -0,0 +1,391 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/quarantine"
+	"github.com/fdo-server-wrapper/internal/session"
+	"github.com/fdo-server-wrapper/internal/store"
+	"github.com/fdo-server-wrapper/internal/tags"
+)
+
+// DevicesHandler serves per-device operations under /admin/devices:
+//
+//	GET /admin/devices[?min_failures=N&serial=S&tag=T&sort=K&limit=N]
+//	                                               lists per-device attempt counts
+//	GET /admin/devices/{guid}                      attempt counts, tags and quarantine state
+//	DELETE /admin/devices/{guid}                   erases locally held data for the device
+//	POST /admin/devices/{guid}/decommission        publishes a decommissioning event
+//	POST /admin/devices/{guid}/quarantine          quarantines the device
+//	DELETE /admin/devices/{guid}/quarantine        releases the device
+//	GET /admin/devices/{guid}/tags                 the device's tags
+//	PUT /admin/devices/{guid}/tags                 replaces the tags assigned by hand
+//	DELETE /admin/devices/{guid}/tags              removes the tags assigned by hand
+//
+// The decommission and quarantine bodies are optional JSON {"reason": "..."},
+// the tags body is {"tags": [...]}. history may be nil when no local store
+// is configured, quarantined nil when quarantine is disabled and tagger nil
+// when tagging is.
+func DevicesHandler(bus *events.Bus, sessions *session.Store, history store.Store, quarantined *quarantine.List, tagger *tags.Tagger, ownerID string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/devices"), "/")
+		guid, action, _ := strings.Cut(rest, "/")
+		if guid == "" {
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			listDevices(w, r, history, quarantined, tagger)
+			return
+		}
+
+		switch action {
+		case "":
+			switch r.Method {
+			case http.MethodGet:
+				showDevice(w, r, guid, history, quarantined, tagger)
+			case http.MethodDelete:
+				eraseDevice(w, r, guid, sessions, history)
+			default:
+				w.Header().Set("Allow", "GET, DELETE")
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			}
+		case "quarantine":
+			quarantineDevice(w, r, guid, quarantined)
+		case "tags":
+			tagDevice(w, r, guid, history, tagger)
+		case "decommission":
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			reason, ok := readReason(w, r)
+			if !ok {
+				return
+			}
+			ctx := correlation.FromRequest(r)
+			ev := &events.Event{
+				Type:      events.Decommissioned,
+				GUID:      guid,
+				OwnerID:   ownerID,
+				Time:      time.Now(),
+				RequestID: correlation.RequestID(ctx),
+				Reason:    reason,
+				Tags:      deviceTags(r, guid, history, tagger),
+			}
+			bus.Publish(ctx, ev)
+			writeJSON(w, http.StatusAccepted, map[string]any{"guid": guid, "event": ev.Type})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// eraseDevice scrubs session state and stored record detail (evidence,
+// source IPs, serials) for guid. Records stay behind as tombstones so the
+// history still shows that an onboarding happened.
+func eraseDevice(w http.ResponseWriter, r *http.Request, guid string, sessions *session.Store, history store.Store) {
+	now := time.Now()
+	droppedSessions := sessions.DeleteGUID(guid)
+	erased := 0
+	if history != nil {
+		n, err := history.Erase(r.Context(), guid, now)
+		if err != nil {
+			slog.Error("Failed to erase device records", "guid", guid, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		erased = n
+	}
+	slog.Info("Erased device data", "guid", guid, "records", erased, "sessions", droppedSessions)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"guid":      guid,
+		"records":   erased,
+		"sessions":  droppedSessions,
+		"erased_at": now.UTC(),
+	})
+}
+
+// readReason decodes the optional {"reason": "..."} body. On failure it
+// writes the error response and reports false.
+func readReason(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return "", false
+		}
+	}
+	return body.Reason, true
+}
+
+// deviceView is a device's attempt counts, tags and quarantine state.
+type deviceView struct {
+	GUID       string             `json:"guid"`
+	Stats      *store.DeviceStats `json:"stats,omitempty"`
+	Tags       []string           `json:"tags,omitempty"`
+	Quarantine *quarantine.Entry  `json:"quarantine,omitempty"`
+}
+
+// newDeviceView builds the view of guid. Its tags are those recorded with
+// its latest attempt and those assigned by hand since.
+func newDeviceView(guid string, stats *store.DeviceStats, quarantined *quarantine.List, tagger *tags.Tagger) deviceView {
+	v := deviceView{GUID: guid, Stats: stats, Tags: tagger.Assigned(guid)}
+	if stats != nil {
+		v.Tags = tags.Merge(stats.Tags, v.Tags)
+	}
+	if e, ok := quarantined.Get(guid); ok {
+		v.Quarantine = &e
+	}
+	return v
+}
+
+// deviceSorts are the sort keys of listDevices, all descending: the devices
+// an operator looks at first come first.
+var deviceSorts = map[string]func(*store.DeviceStats) int{
+	"attempts":             func(d *store.DeviceStats) int { return d.Attempts },
+	"failures":             func(d *store.DeviceStats) int { return d.Failures },
+	"consecutive_failures": func(d *store.DeviceStats) int { return d.ConsecutiveFailures },
+}
+
+// listDevices reports devices from the local store, optionally only those
+// with at least min_failures consecutive failures, a given serial or a given
+// tag. Quarantined and hand-tagged devices are listed even without records. sort orders by a
+// count, most first, and limit keeps the first N, e.g. the top ten failing
+// devices with sort=failures&limit=10.
+func listDevices(w http.ResponseWriter, r *http.Request, history store.Store, quarantined *quarantine.List, tagger *tags.Tagger) {
+	minFailures := 0
+	if v := r.URL.Query().Get("min_failures"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid min_failures", http.StatusBadRequest)
+			return
+		}
+		minFailures = n
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var key func(*store.DeviceStats) int
+	if v := r.URL.Query().Get("sort"); v != "" {
+		if key = deviceSorts[v]; key == nil {
+			http.Error(w, "invalid sort", http.StatusBadRequest)
+			return
+		}
+	}
+	serial := r.URL.Query().Get("serial")
+	tag := r.URL.Query().Get("tag")
+
+	devices := []deviceView{}
+	seen := make(map[string]bool)
+	add := func(v deviceView) {
+		seen[v.GUID] = true
+		if tag == "" || slices.Contains(v.Tags, tag) {
+			devices = append(devices, v)
+		}
+	}
+	if history != nil {
+		stats, err := store.Stats(r.Context(), history, store.Query{Serial: serial})
+		if err != nil {
+			slog.Error("Failed to compute device stats", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		for _, d := range stats {
+			if d.ConsecutiveFailures < minFailures {
+				continue
+			}
+			add(newDeviceView(d.GUID, d, quarantined, tagger))
+		}
+	}
+	if quarantined != nil && serial == "" && minFailures == 0 {
+		for _, e := range quarantined.All() {
+			if !seen[e.GUID] {
+				add(newDeviceView(e.GUID, nil, quarantined, tagger))
+			}
+		}
+	}
+	if tagger != nil && serial == "" && minFailures == 0 {
+		var guids []string
+		for guid := range tagger.All() {
+			if !seen[guid] {
+				guids = append(guids, guid)
+			}
+		}
+		sort.Strings(guids)
+		for _, guid := range guids {
+			add(newDeviceView(guid, nil, quarantined, tagger))
+		}
+	}
+	if key != nil {
+		count := func(v deviceView) int {
+			if v.Stats == nil {
+				return 0
+			}
+			return key(v.Stats)
+		}
+		sort.SliceStable(devices, func(i, j int) bool { return count(devices[i]) > count(devices[j]) })
+	}
+	if limit > 0 && len(devices) > limit {
+		devices = devices[:limit]
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"devices": devices})
+}
+
+func showDevice(w http.ResponseWriter, r *http.Request, guid string, history store.Store, quarantined *quarantine.List, tagger *tags.Tagger) {
+	var stats *store.DeviceStats
+	if history != nil {
+		s, err := store.DeviceStatsFor(r.Context(), history, guid)
+		switch {
+		case err == nil:
+			stats = s
+		case !errors.Is(err, store.ErrNotFound):
+			slog.Error("Failed to compute device stats", "guid", guid, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	v := newDeviceView(guid, stats, quarantined, tagger)
+	if v.Stats == nil && v.Quarantine == nil && len(v.Tags) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// quarantineDevice adds (POST) or releases (DELETE) guid.
+func quarantineDevice(w http.ResponseWriter, r *http.Request, guid string, quarantined *quarantine.List) {
+	if quarantined == nil {
+		http.Error(w, "quarantine not enabled", http.StatusNotFound)
+		return
+	}
+	var before *quarantine.Entry
+	if e, ok := quarantined.Get(guid); ok {
+		before = &e
+	}
+	switch r.Method {
+	case http.MethodPost:
+		reason, ok := readReason(w, r)
+		if !ok {
+			return
+		}
+		e := quarantine.Entry{GUID: guid, Reason: reason, Since: time.Now().UTC()}
+		added, err := quarantined.Add(e)
+		if err != nil {
+			slog.Error("Failed to persist quarantine", "guid", guid, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if added {
+			slog.Info("Device quarantined by operator", "guid", guid, "reason", reason)
+		}
+		e, _ = quarantined.Get(guid)
+		Changed(r, before, e)
+		writeJSON(w, http.StatusOK, e)
+	case http.MethodDelete:
+		removed, err := quarantined.Remove(guid)
+		if err != nil {
+			slog.Error("Failed to persist quarantine release", "guid", guid, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			http.NotFound(w, r)
+			return
+		}
+		Changed(r, before, nil)
+		slog.Info("Device released from quarantine", "guid", guid)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// deviceTags returns the current tags of guid, as newDeviceView shows them.
+func deviceTags(r *http.Request, guid string, history store.Store, tagger *tags.Tagger) []string {
+	var stats *store.DeviceStats
+	if history != nil {
+		stats, _ = store.DeviceStatsFor(r.Context(), history, guid)
+	}
+	return newDeviceView(guid, stats, nil, tagger).Tags
+}
+
+// tagDevice shows (GET), replaces (PUT) or removes (DELETE) the tags
+// assigned to guid by hand.
+func tagDevice(w http.ResponseWriter, r *http.Request, guid string, history store.Store, tagger *tags.Tagger) {
+	if tagger == nil {
+		http.Error(w, "tagging not enabled", http.StatusNotFound)
+		return
+	}
+	before := tagger.Assigned(guid)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body struct {
+			Tags []string `json:"tags"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		for _, t := range body.Tags {
+			if !tags.Valid(t) {
+				http.Error(w, fmt.Sprintf("invalid tag %q: want up to %d letters, digits, '.', '_', ':' or '-'", t, tags.MaxLen), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := tagger.Assign(guid, body.Tags); err != nil {
+			slog.Error("Failed to persist device tags", "guid", guid, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		Changed(r, before, tagger.Assigned(guid))
+		slog.Info("Device tags assigned by operator", "guid", guid, "tags", tagger.Assigned(guid))
+	case http.MethodDelete:
+		removed, err := tagger.Unassign(guid)
+		if err != nil {
+			slog.Error("Failed to persist device tags", "guid", guid, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			http.NotFound(w, r)
+			return
+		}
+		Changed(r, before, nil)
+		slog.Info("Device tags removed by operator", "guid", guid)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"guid":     guid,
+		"tags":     deviceTags(r, guid, history, tagger),
+		"assigned": tagger.Assigned(guid),
+	})
+}
@@ -0,0 +1,123 @@
+package admin
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/store"
+)
+
+// exportColumns are the CSV columns, in order.
+var exportColumns = []string{
+	"id", "guid", "protocol", "outcome", "owner_id", "started_at", "completed_at",
+	"remote_addr", "serial", "passport_status", "passport_error", "attestation_result",
+	"failure", "voucher_hash", "owner_key_hash", "kex_suite", "cipher_suite",
+	"device_serviceinfo_bytes", "owner_serviceinfo_bytes", "request_id", "erased_at",
+	"tags", "country",
+}
+
+// ExportHandler serves GET /admin/export?format=csv|json&from=&to=[&guid=&tag=],
+// streaming the recorded onboarding history. JSON is written as an array so
+// spreadsheets and BI tools can load it directly.
+func ExportHandler(st store.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		from, to, err := parseRange(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := store.Query{From: from, To: to, GUID: r.URL.Query().Get("guid"), Tag: r.URL.Query().Get("tag")}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+		filename := fmt.Sprintf("onboarding-%s-%s.%s", from.Format("20060102"), to.Format("20060102"), format)
+
+		switch format {
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+			exportCSV(w, r, st, q)
+		case "json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+			exportJSON(w, r, st, q)
+		default:
+			http.Error(w, "format must be csv or json", http.StatusBadRequest)
+		}
+	})
+}
+
+func exportCSV(w http.ResponseWriter, r *http.Request, st store.Store, q store.Query) {
+	cw := csv.NewWriter(w)
+	_ = cw.Write(exportColumns)
+	_ = st.Each(r.Context(), q, func(rec *store.Record) error {
+		if err := cw.Write(csvRow(rec)); err != nil {
+			return err
+		}
+		cw.Flush()
+		return cw.Error()
+	})
+	cw.Flush()
+}
+
+func csvRow(r *store.Record) []string {
+	row := []string{
+		r.ID, r.GUID, r.Protocol, r.Outcome, r.OwnerID,
+		formatTime(r.StartedAt), formatTime(r.CompletedAt),
+		r.RemoteAddr, r.Serial, r.PassportStatus, r.PassportError, r.AttestationResult,
+		r.Failure, "", "", "", "", "", "", r.RequestID, "", strings.Join(r.Tags, " "),
+		r.Country,
+	}
+	if e := r.Evidence; e != nil {
+		row[13], row[14], row[15], row[16] = e.VoucherHash, e.OwnerKeyHash, e.KexSuite, e.CipherSuite
+		row[17] = strconv.Itoa(e.ServiceInfo.DeviceBytes)
+		row[18] = strconv.Itoa(e.ServiceInfo.OwnerBytes)
+	}
+	if r.ErasedAt != nil {
+		row[20] = formatTime(*r.ErasedAt)
+	}
+	return row
+}
+
+func exportJSON(w http.ResponseWriter, r *http.Request, st store.Store, q store.Query) {
+	flusher, _ := w.(http.Flusher)
+	_, _ = w.Write([]byte("[\n"))
+	first := true
+	_ = st.Each(r.Context(), q, func(rec *store.Record) error {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if !first {
+			_, _ = w.Write([]byte(",\n"))
+		}
+		first = false
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	_, _ = w.Write([]byte("\n]\n"))
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/fdo-server-wrapper/internal/features"
+)
+
+// FeaturesHandler serves runtime feature flags under /admin/features:
+//
+//	GET    /admin/features          every flag and its state
+//	PUT    /admin/features/{name}   switches a flag on or off
+//	DELETE /admin/features/{name}   returns a flag to its default
+//
+// The PUT body is {"enabled": false, "reason": "..."}. Changes take effect
+// immediately and are kept across restarts until reset.
+func FeaturesHandler(s *features.Set) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/features"), "/")
+		if name == "" {
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", "GET")
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			writeJSON(w, http.StatusOK, s.All())
+			return
+		}
+
+		var before *features.State
+		for _, st := range s.All() {
+			if st.Name == name {
+				before = &st
+			}
+		}
+		var st features.State
+		var err error
+		switch r.Method {
+		case http.MethodPut:
+			var body struct {
+				Enabled *bool  `json:"enabled"`
+				Reason  string `json:"reason"`
+			}
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil || body.Enabled == nil {
+				http.Error(w, `invalid JSON body: want {"enabled": true|false, "reason": "..."}`, http.StatusBadRequest)
+				return
+			}
+			st, err = s.Set(name, *body.Enabled, body.Reason)
+		case http.MethodDelete:
+			st, err = s.Reset(name)
+		default:
+			w.Header().Set("Allow", "PUT, DELETE")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch {
+		case errors.Is(err, features.ErrUnknown):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			// The flag changed, but the change will not survive a restart
+			slog.Error("Failed to persist feature flags", "flag", name, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		Changed(r, before, st)
+		slog.Info("Feature flag changed", "flag", name, "enabled", st.Enabled, "overridden", st.Overridden, "remote_addr", r.RemoteAddr, "reason", st.Reason)
+		writeJSON(w, http.StatusOK, st)
+	})
+}
@@ -0,0 +1,67 @@
+package admin
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/fdo-server-wrapper/internal/schedule"
+)
+
+// JobsHandler serves the recurring jobs under /admin/jobs:
+//
+//	GET  /admin/jobs              every job with its schedule and last run
+//	GET  /admin/jobs/{name}       one job
+//	POST /admin/jobs/{name}/run   runs the job now and answers with its state
+//
+// A job can be run while disabled; POST answers 409 while it runs, here or,
+// for a singleton job, on another proxy.
+func JobsHandler(s *schedule.Scheduler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/jobs"), "/")
+		name, action, _ := strings.Cut(rest, "/")
+		if name == "" {
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			writeJSON(w, http.StatusOK, s.Status())
+			return
+		}
+
+		var st schedule.Status
+		var err error
+		switch action {
+		case "":
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			st, err = s.Get(name)
+		case "run":
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			slog.Info("Job run requested", "job", name, "remote_addr", r.RemoteAddr)
+			st, err = s.RunNow(r.Context(), name)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case errors.Is(err, schedule.ErrUnknown):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, schedule.ErrRunning), errors.Is(err, schedule.ErrLocked):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			writeJSON(w, http.StatusOK, st)
+		}
+	})
+}
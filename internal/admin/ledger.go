@@ -0,0 +1,35 @@
+package admin
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/fdo-server-wrapper/internal/ledger"
+)
+
+// LedgerSyncHandler serves the passport service's offline mode under
+// /admin/ledger/sync:
+//
+//	GET  /admin/ledger/sync   whether the service is online, and the writes
+//	                          and lookups queued for it
+//	POST /admin/ledger/sync   syncs now instead of at the next interval
+//
+// The POST answers with the round's result and the status after it.
+func LedgerSyncHandler(c *ledger.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, c.SyncStatus())
+		case http.MethodPost:
+			res := c.Sync(r.Context())
+			slog.Info("Ledger sync requested", "remote_addr", r.RemoteAddr, "synced", res.Synced, "rejected", res.Rejected, "looked_up", res.LookedUp, "online", res.Online)
+			writeJSON(w, http.StatusOK, struct {
+				Result ledger.SyncResult `json:"result"`
+				Status ledger.SyncStatus `json:"status"`
+			}{res, c.SyncStatus()})
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
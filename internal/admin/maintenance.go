@@ -0,0 +1,43 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/fdo-server-wrapper/internal/proxy"
+)
+
+// MaintenanceHandler serves maintenance mode under /admin/maintenance:
+//
+//	GET /admin/maintenance   the mode and the sessions still in flight
+//	PUT /admin/maintenance   turns it on or off
+//
+// The PUT body is {"enabled": true, "reason": "..."}. Either method answers
+// with the status; poll GET until "drained" before upgrading the backend.
+func MaintenanceHandler(p *proxy.FDOProxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var body struct {
+				Enabled *bool  `json:"enabled"`
+				Reason  string `json:"reason"`
+			}
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil || body.Enabled == nil {
+				http.Error(w, `invalid JSON body: want {"enabled": true|false, "reason": "..."}`, http.StatusBadRequest)
+				return
+			}
+			before := p.Maintenance()
+			p.SetMaintenance(*body.Enabled, body.Reason)
+			Changed(r, before, p.Maintenance())
+			slog.Info("Maintenance mode changed", "enabled", *body.Enabled, "remote_addr", r.RemoteAddr, "reason", body.Reason)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, p.Maintenance())
+	})
+}
@@ -0,0 +1,60 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/ownerkey"
+)
+
+// OwnerKeyHandler serves owner key rotation under /admin/owner-key:
+//
+//	POST /admin/owner-key/rotate      rotates the owner key
+//	GET  /admin/owner-key/rotations   every rotation made through the proxy
+//
+// The POST body is {"reason": "..."}. The rotation is returned as recorded;
+// rendezvous or ledger steps that failed are listed in it rather than
+// failing the request, since the key has already changed by then.
+func OwnerKeyHandler(r *ownerkey.Rotator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/admin/owner-key/rotations":
+			if req.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"rotations": r.History()})
+		case "/admin/owner-key/rotate":
+			if req.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			var body struct {
+				Reason string `json:"reason"`
+			}
+			if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil || body.Reason == "" {
+				http.Error(w, `invalid JSON body: want {"reason": "..."}`, http.StatusBadRequest)
+				return
+			}
+			rot, err := r.Rotate(correlation.FromRequest(req), body.Reason, req.RemoteAddr)
+			if errors.Is(err, ownerkey.ErrInProgress) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				slog.Error("Owner key rotation failed", "error", err)
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				return
+			}
+			writeJSON(w, http.StatusOK, rot)
+		default:
+			http.NotFound(w, req)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fdo-server-wrapper/internal/ledger"
+)
+
+// PassportsHandler serves read-only product passport queries under
+// /admin/passports, made to the passport service with the proxy's own mTLS
+// identity so line tools need no client certificate of their own:
+//
+//	GET /admin/passports/{uuid}                  the passport of a product UUID
+//	GET /admin/passports?board_sn={sn}           the passports of a board serial
+//	GET /admin/passports?limit={n}&cursor={c}    one page of every passport
+//
+// A list page holds up to limit passports (100 by default, at most 1000)
+// and, in "next", the cursor of the following page, empty on the last.
+// Answers come from the passport service, not the cache, and do not
+// change it. 404 means the service has no such passport, 503 that its
+// circuit breaker is open and 502 any other failure to ask it.
+func PassportsHandler(c *ledger.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		uuid := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/passports"), "/")
+		if uuid == "" {
+			sn := strings.TrimSpace(r.URL.Query().Get("board_sn"))
+			if sn == "" {
+				listPassports(w, r, c)
+				return
+			}
+			found, err := c.SearchProductItemPassports(r.Context(), sn)
+			if err != nil {
+				passportError(w, r, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, struct {
+				BoardSN   string                       `json:"board_sn"`
+				Passports []ledger.ProductItemPassport `json:"passports"`
+			}{sn, found})
+			return
+		}
+		if strings.Contains(uuid, "/") {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		p, err := c.FetchProductItemPassport(r.Context(), uuid)
+		if err != nil {
+			passportError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+	})
+}
+
+// listPassports answers one page of the passport list.
+func listPassports(w http.ResponseWriter, r *http.Request, c *ledger.Client) {
+	limit := ledger.DefaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > ledger.MaxListLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", ledger.MaxListLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	page, err := c.ListProductItemPassports(r.Context(), r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		passportError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// passportError answers a failed passport query.
+func passportError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ledger.ErrPassportNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ledger.ErrBreakerOpen):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		slog.Warn("Passport query failed", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
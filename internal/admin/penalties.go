@@ -0,0 +1,62 @@
+package admin
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/fdo-server-wrapper/internal/penalty"
+)
+
+// PenaltiesHandler serves the devices held back for repeated failures
+// under /admin/penalties:
+//
+//	GET    /admin/penalties        every device with failures or a ban
+//	DELETE /admin/penalties/{key}  forgets a device's failures and lifts its ban
+//
+// Keys are as listed, e.g. guid:<guid> or serial:<serial>. Lifting a
+// penalty also lifts the ban it earned, not one an operator placed.
+func PenaltiesHandler(b *penalty.Box) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/penalties"), "/")
+		if key == "" {
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", "GET")
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			entries, err := b.All(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			writeJSON(w, http.StatusOK, entries)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var before *penalty.Entry
+		if entries, err := b.All(r.Context()); err == nil {
+			for _, e := range entries {
+				if e.Key == key {
+					before = &e
+				}
+			}
+		}
+		found, err := b.Forgive(r.Context(), key)
+		switch {
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		case !found:
+			http.Error(w, "no penalty for "+key, http.StatusNotFound)
+			return
+		}
+		Changed(r, before, nil)
+		slog.Info("Device penalty lifted", "key", key, "remote_addr", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
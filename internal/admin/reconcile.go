@@ -0,0 +1,35 @@
+package admin
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/fdo-server-wrapper/internal/reconcile"
+)
+
+// ReconcileHandler serves reconciliation with the passport service under
+// /admin/reconcile:
+//
+//	GET  /admin/reconcile   the report of the last run
+//	POST /admin/reconcile   runs now and answers with its report
+//
+// GET answers 404 until the first run has completed.
+func ReconcileHandler(r *reconcile.Reconciler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			rep := r.Last()
+			if rep == nil {
+				http.Error(w, "no reconciliation has run yet", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, rep)
+		case http.MethodPost:
+			slog.Info("Reconciliation requested", "remote_addr", req.RemoteAddr)
+			writeJSON(w, http.StatusOK, r.Reconcile(req.Context()))
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
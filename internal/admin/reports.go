@@ -0,0 +1,103 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/report"
+	"github.com/fdo-server-wrapper/internal/store"
+	"github.com/fdo-server-wrapper/internal/vc"
+)
+
+// ReportSignatureHeader carries the detached JWS over a report body.
+const ReportSignatureHeader = "X-Report-Signature"
+
+// ComplianceReportHandler serves GET /admin/reports/compliance?from=&to=,
+// a JSON report of every onboarding attempt in the range with passport and
+// attestation status. When signer is set the exact response body is signed
+// and the detached JWS returned in X-Report-Signature.
+func ComplianceReportHandler(st store.Store, signer *vc.Signer, ownerID string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		from, to, err := parseRange(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rep, err := report.BuildCompliance(r.Context(), st, from, to, ownerID)
+		if err != nil {
+			slog.Error("Failed to build compliance report", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rep); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		if signer != nil {
+			sig, err := signer.SignDetached(buf.Bytes())
+			if err != nil {
+				slog.Error("Failed to sign compliance report", "error", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set(ReportSignatureHeader, sig)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="compliance-%s-%s.json"`,
+			from.Format("20060102"), to.Format("20060102")))
+		_, _ = w.Write(buf.Bytes())
+	})
+}
+
+// parseRange reads the from and to query parameters as RFC 3339 timestamps
+// or YYYY-MM-DD dates. A date in to includes that whole day. from defaults
+// to the epoch and to to now.
+func parseRange(r *http.Request) (time.Time, time.Time, error) {
+	q := r.URL.Query()
+	from, err := parseBound(q.Get("from"), false)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid from: %w", err)
+	}
+	to, err := parseBound(q.Get("to"), true)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid to: %w", err)
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+func parseBound(v string, end bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
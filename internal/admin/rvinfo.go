@@ -0,0 +1,91 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/rvinfo"
+)
+
+// RVInfoHandler serves the manufacturer backend's rendezvous info under
+// /admin/rvinfo:
+//
+//	GET /admin/rvinfo             the RVInfo new vouchers carry
+//	PUT /admin/rvinfo             replaces it
+//	GET /admin/rvinfo/history     every change made through the proxy
+//
+// The PUT body is {"rvinfo": ..., "reason": "..."}, with rvinfo in the
+// backend's JSON format. Each change is recorded in audit with the value it
+// replaced.
+func RVInfoHandler(c *rvinfo.Client, audit *rvinfo.Audit) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/admin/rvinfo":
+		case "/admin/rvinfo/history":
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"changes": audit.Entries()})
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		ctx := correlation.FromRequest(r)
+		switch r.Method {
+		case http.MethodGet:
+			rv, err := c.Get(ctx)
+			if err != nil {
+				slog.Error("Failed to read RVInfo from backend", "error", err)
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"rvinfo": rv})
+		case http.MethodPut:
+			var body struct {
+				RVInfo json.RawMessage `json:"rvinfo"`
+				Reason string          `json:"reason"`
+			}
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil || len(body.RVInfo) == 0 || string(body.RVInfo) == "null" {
+				http.Error(w, `invalid JSON body: want {"rvinfo": ..., "reason": "..."}`, http.StatusBadRequest)
+				return
+			}
+			prev, err := c.Get(ctx)
+			if err != nil {
+				slog.Error("Failed to read RVInfo from backend", "error", err)
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				return
+			}
+			if err := c.Put(ctx, body.RVInfo); err != nil {
+				slog.Error("Failed to update RVInfo in backend", "error", err)
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				return
+			}
+			change := rvinfo.Change{
+				Time:       time.Now().UTC(),
+				RequestID:  correlation.RequestID(ctx),
+				RemoteAddr: r.RemoteAddr,
+				Reason:     body.Reason,
+				Previous:   prev,
+				RVInfo:     body.RVInfo,
+			}
+			Changed(r, prev, body.RVInfo)
+			if err := audit.Record(change); err != nil {
+				// The backend already has the new value; report the gap loudly
+				slog.Error("RVInfo changed but the audit record failed", "request_id", change.RequestID, "error", err)
+			}
+			slog.Info("RVInfo updated", "request_id", change.RequestID, "remote_addr", r.RemoteAddr, "reason", body.Reason)
+			writeJSON(w, http.StatusOK, change)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+// Package admin serves operator-facing endpoints (metrics and administrative
+// APIs) on a listener separate from the device-facing proxy.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/audit"
+)
+
+// Server is the admin HTTP listener.
+type Server struct {
+	mux    *http.ServeMux
+	server *http.Server
+	tokens map[string]string // by principal
+	allow  []netip.Prefix
+	trail  *audit.Trail
+}
+
+// NewServer creates an admin server that will listen on addr.
+func NewServer(addr string) *Server {
+	s := &Server{
+		mux: http.NewServeMux(),
+		server: &http.Server{
+			Addr:              addr,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+	s.server.Handler = http.HandlerFunc(s.serveHTTP)
+	return s
+}
+
+// RequireToken makes every /admin/ endpoint demand "Authorization: Bearer
+// token". /metrics stays open for scrapers. An empty token disables the check.
+// Requests with the token act as the principal "admin".
+func (s *Server) RequireToken(token string) {
+	if token == "" {
+		return
+	}
+	s.RequireTokens(map[string]string{"admin": token})
+}
+
+// RequireTokens is RequireToken for several tokens, keyed by the principal
+// each authenticates, so the audit trail tells operators apart. It adds to
+// the tokens already required.
+func (s *Server) RequireTokens(tokens map[string]string) {
+	if s.tokens == nil {
+		s.tokens = make(map[string]string, len(tokens))
+	}
+	maps.Copy(s.tokens, tokens)
+}
+
+// Audit records every /admin/ request that changes state (any method but
+// GET, HEAD and OPTIONS) in t once answered, refused ones included, with
+// the before and after values its handler reports through Changed.
+func (s *Server) Audit(t *audit.Trail) {
+	s.trail = t
+}
+
+// AllowSources refuses connections from outside prefixes on every endpoint,
+// /metrics included. The peer address is used as is; the admin listener
+// does not trust X-Forwarded-For. No prefixes allow every source.
+func (s *Server) AllowSources(prefixes []netip.Prefix) {
+	s.allow = prefixes
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.trail != nil && strings.HasPrefix(r.URL.Path, "/admin/") && mutating(r.Method) {
+		rec := beginAudit(w, r)
+		r = r.WithContext(context.WithValue(r.Context(), auditKey{}, rec))
+		sw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		w = sw
+		defer s.record(r, rec, sw)
+	}
+	if len(s.allow) > 0 && !s.allowed(r) {
+		slog.Warn("Admin request refused by source", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if len(s.tokens) > 0 && strings.HasPrefix(r.URL.Path, "/admin/") {
+		principal, ok := s.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="fdo-proxy-admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if rec, _ := r.Context().Value(auditKey{}).(*auditRecord); rec != nil {
+			rec.principal = principal
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// authenticate returns the principal whose token r carries. Every token is
+// compared, so the time taken does not tell which one came close.
+func (s *Server) authenticate(r *http.Request) (string, bool) {
+	got := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	var principal string
+	for name, token := range s.tokens {
+		if subtle.ConstantTimeCompare(got, []byte(token)) == 1 {
+			principal = name
+		}
+	}
+	return principal, principal != ""
+}
+
+func (s *Server) allowed(r *http.Request) bool {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := ap.Addr().Unmap()
+	return slices.ContainsFunc(s.allow, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// Handle registers h for pattern on the admin listener.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+// Start serves until ctx is cancelled, then shuts the listener down.
+// It returns once the listener has stopped.
+func (s *Server) Start(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Failed to shutdown admin server", "error", err)
+		}
+	}()
+
+	slog.Info("Admin server starting", "listen_addr", s.server.Addr)
+	if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
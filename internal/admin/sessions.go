@@ -0,0 +1,40 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/fdo-server-wrapper/internal/session"
+)
+
+// SessionsHandler serves GET /admin/sessions, listing in-flight FDO sessions
+// with the evidence and ServiceInfo usage recorded so far. The optional guid
+// query parameter filters to one device. Session tokens are never exposed.
+func SessionsHandler(store *session.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		guid := r.URL.Query().Get("guid")
+		sessions := store.List()
+		out := make([]*session.Session, 0, len(sessions))
+		for _, s := range sessions {
+			if guid == "" || s.GUID == guid {
+				out = append(out, s)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"sessions": out})
+	})
+}
+
+// writeJSON writes v as an indented JSON response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
@@ -0,0 +1,22 @@
+package admin
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/slo"
+)
+
+// SLOHandler serves GET /admin/slo: each onboarding objective with its
+// SLI, error budget left and recent burn rates, and the estimated p95
+// duration, over the SLO window.
+func SLOHandler(t *slo.Tracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, t.Report(time.Now()))
+	})
+}
@@ -0,0 +1,28 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/version"
+)
+
+// VersionHandler serves GET /admin/version: the build of the proxy and the
+// versions of the FDO servers behind it, detected on each request.
+func VersionHandler(p *proxy.FDOProxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		writeJSON(w, http.StatusOK, struct {
+			version.Info
+			Backends []proxy.BackendVersion `json:"backends"`
+		}{version.Get(), p.BackendVersions(ctx)})
+	})
+}
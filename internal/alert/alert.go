@@ -0,0 +1,154 @@
+// Package alert evaluates simple threshold rules over the proxy's own
+// metrics and notifies operators through webhooks, Slack or email when a
+// rule starts or stops firing.
+package alert
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+// Alert statuses.
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+)
+
+// Alert is a rule state change.
+type Alert struct {
+	Rule    string    `json:"rule"`
+	Status  string    `json:"status"`
+	Summary string    `json:"summary"`
+	Time    time.Time `json:"time"`
+	// Since is when the rule started firing.
+	Since time.Time `json:"since"`
+}
+
+// Rule is a condition evaluated on each tick.
+type Rule interface {
+	// Name identifies the rule in alerts, logs and metrics.
+	Name() string
+	// Evaluate reports whether the rule fires at now, with a human-readable
+	// summary of the current value.
+	Evaluate(now time.Time) (firing bool, summary string)
+}
+
+// Notifier delivers alerts.
+type Notifier interface {
+	// Name identifies the notifier in logs and metrics.
+	Name() string
+	Notify(ctx context.Context, a *Alert) error
+}
+
+var (
+	alertsFiring = metrics.Default.NewGaugeVec(
+		"fdo_proxy_alerts_firing",
+		"Alert rules currently firing (1) or not (0).",
+		"rule")
+	alertNotifications = metrics.Default.NewCounterVec(
+		"fdo_proxy_alert_notifications_total",
+		"Alert notifications by notifier and outcome (success, error).",
+		"notifier", "outcome")
+)
+
+// Engine evaluates rules on an interval and notifies on state changes.
+type Engine struct {
+	interval  time.Duration
+	rules     []Rule
+	notifiers []Notifier
+
+	mu     sync.Mutex
+	firing map[string]time.Time
+}
+
+// NewEngine creates an engine that evaluates every interval. A non-positive
+// interval defaults to 30 seconds.
+func NewEngine(interval time.Duration) *Engine {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	return &Engine{interval: interval, firing: make(map[string]time.Time)}
+}
+
+// AddRule adds r to the engine. Rules must be added before Run.
+func (e *Engine) AddRule(r Rule) {
+	e.rules = append(e.rules, r)
+	alertsFiring.Set(0, r.Name())
+}
+
+// AddNotifier adds n to the engine. Notifiers must be added before Run.
+func (e *Engine) AddNotifier(n Notifier) { e.notifiers = append(e.notifiers, n) }
+
+// Len returns the number of rules.
+func (e *Engine) Len() int { return len(e.rules) }
+
+// Run evaluates rules until ctx is cancelled.
+func (e *Engine) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			e.evaluate(ctx, now)
+		}
+	}
+}
+
+func (e *Engine) evaluate(ctx context.Context, now time.Time) {
+	for _, r := range e.rules {
+		firing, summary := r.Evaluate(now)
+
+		e.mu.Lock()
+		since, was := e.firing[r.Name()]
+		switch {
+		case firing && !was:
+			since = now
+			e.firing[r.Name()] = now
+		case !firing && was:
+			delete(e.firing, r.Name())
+		}
+		e.mu.Unlock()
+
+		if firing == was {
+			continue
+		}
+		a := &Alert{Rule: r.Name(), Status: StatusResolved, Summary: summary, Time: now, Since: since}
+		if firing {
+			a.Status = StatusFiring
+			alertsFiring.Set(1, r.Name())
+			slog.Warn("Alert firing", "rule", r.Name(), "summary", summary)
+		} else {
+			alertsFiring.Set(0, r.Name())
+			slog.Info("Alert resolved", "rule", r.Name(), "summary", summary)
+		}
+		e.notify(ctx, a)
+	}
+}
+
+func (e *Engine) notify(ctx context.Context, a *Alert) {
+	var wg sync.WaitGroup
+	for _, n := range e.notifiers {
+		if f, ok := n.(*ruleFilter); ok && !f.accepts(a.Rule) {
+			continue
+		}
+		wg.Add(1)
+		go func(n Notifier) {
+			defer wg.Done()
+			nctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel()
+			if err := n.Notify(nctx, a); err != nil {
+				alertNotifications.Inc(n.Name(), "error")
+				slog.Warn("Alert notification failed", "notifier", n.Name(), "rule", a.Rule, "error", err)
+				return
+			}
+			alertNotifications.Inc(n.Name(), "success")
+		}(n)
+	}
+	wg.Wait()
+}
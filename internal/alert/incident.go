@@ -0,0 +1,184 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// incidentKey identifies the incident of a rule, the same on every proxy
+// so replicas firing together open one incident.
+func incidentKey(rule string) string {
+	return "fdo-proxy-" + rule
+}
+
+// source names this proxy in incidents.
+func source() string {
+	if h, err := os.Hostname(); err == nil {
+		return h
+	}
+	return "fdo-proxy"
+}
+
+// PagerDutyURL is the PagerDuty Events API v2 endpoint.
+const PagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDuty triggers an incident through the Events API v2 when a rule
+// fires and resolves it when the rule resolves.
+type PagerDuty struct {
+	url        string
+	routingKey string
+	http       *http.Client
+}
+
+// NewPagerDuty creates a PagerDuty notifier for the service integration
+// with routingKey. An empty apiURL means PagerDutyURL.
+func NewPagerDuty(apiURL, routingKey string) *PagerDuty {
+	if apiURL == "" {
+		apiURL = PagerDutyURL
+	}
+	return &PagerDuty{url: apiURL, routingKey: routingKey, http: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name implements Notifier.
+func (p *PagerDuty) Name() string { return "pagerduty" }
+
+// Notify implements Notifier.
+func (p *PagerDuty) Notify(ctx context.Context, a *Alert) error {
+	ev := map[string]any{
+		"routing_key":  p.routingKey,
+		"event_action": "resolve",
+		"dedup_key":    incidentKey(a.Rule),
+	}
+	if a.Status == StatusFiring {
+		ev["event_action"] = "trigger"
+		ev["payload"] = map[string]any{
+			"summary":   a.Rule + ": " + a.Summary,
+			"source":    source(),
+			"severity":  "critical",
+			"timestamp": a.Time.UTC().Format(time.RFC3339),
+			"component": "fdo-proxy",
+			"class":     a.Rule,
+			"custom_details": map[string]any{
+				"since": a.Since.UTC().Format(time.RFC3339),
+			},
+		}
+	}
+	return sendJSON(ctx, p.http, p.url, nil, ev)
+}
+
+// OpsgenieURL is the Opsgenie API; accounts in the EU region use
+// https://api.eu.opsgenie.com.
+const OpsgenieURL = "https://api.opsgenie.com"
+
+// Opsgenie creates an alert through the Alert API when a rule fires and
+// closes it when the rule resolves.
+type Opsgenie struct {
+	url  string
+	key  string
+	http *http.Client
+}
+
+// NewOpsgenie creates an Opsgenie notifier with the API integration key.
+// An empty apiURL means OpsgenieURL.
+func NewOpsgenie(apiURL, key string) *Opsgenie {
+	if apiURL == "" {
+		apiURL = OpsgenieURL
+	}
+	return &Opsgenie{url: strings.TrimSuffix(apiURL, "/"), key: key, http: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name implements Notifier.
+func (o *Opsgenie) Name() string { return "opsgenie" }
+
+// Notify implements Notifier.
+func (o *Opsgenie) Notify(ctx context.Context, a *Alert) error {
+	header := http.Header{"Authorization": {"GenieKey " + o.key}}
+	alias := incidentKey(a.Rule)
+	if a.Status == StatusResolved {
+		target := o.url + "/v2/alerts/" + url.PathEscape(alias) + "/close?identifierType=alias"
+		return sendJSON(ctx, o.http, target, header, map[string]string{
+			"source": source(),
+			"note":   a.Summary,
+		})
+	}
+	return sendJSON(ctx, o.http, o.url+"/v2/alerts", header, map[string]any{
+		"message":     truncate(a.Rule+": "+a.Summary, 130),
+		"alias":       alias,
+		"description": a.Summary,
+		"source":      source(),
+		"entity":      "fdo-proxy",
+		"priority":    "P1",
+		"details":     map[string]string{"rule": a.Rule, "since": a.Since.UTC().Format(time.RFC3339)},
+	})
+}
+
+// truncate cuts s to at most n bytes on a rune boundary.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func sendJSON(ctx context.Context, c *http.Client, target string, header http.Header, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode incident: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// ForRules passes on to n only the alerts of the named rules, e.g. so only
+// outages page someone.
+func ForRules(n Notifier, rules ...string) Notifier {
+	return &ruleFilter{n: n, rules: rules}
+}
+
+type ruleFilter struct {
+	n     Notifier
+	rules []string
+}
+
+// Name implements Notifier.
+func (f *ruleFilter) Name() string { return f.n.Name() }
+
+// Notify implements Notifier.
+func (f *ruleFilter) Notify(ctx context.Context, a *Alert) error {
+	return f.n.Notify(ctx, a)
+}
+
+// accepts reports whether the alerts of rule are passed on; the engine
+// does not hand over, or count, the others.
+func (f *ruleFilter) accepts(rule string) bool {
+	return slices.Contains(f.rules, rule)
+}
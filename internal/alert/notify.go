@@ -0,0 +1,131 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Webhook posts each alert as JSON.
+type Webhook struct {
+	url  string
+	http *http.Client
+}
+
+// NewWebhook creates a webhook notifier.
+func NewWebhook(url string) *Webhook {
+	return &Webhook{url: url, http: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name implements Notifier.
+func (w *Webhook) Name() string { return "webhook" }
+
+// Notify implements Notifier.
+func (w *Webhook) Notify(ctx context.Context, a *Alert) error {
+	return postJSON(ctx, w.http, w.url, a)
+}
+
+// Slack posts alerts to a Slack incoming webhook.
+type Slack struct {
+	url  string
+	http *http.Client
+}
+
+// NewSlack creates a Slack notifier.
+func NewSlack(webhookURL string) *Slack {
+	return &Slack{url: webhookURL, http: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name implements Notifier.
+func (s *Slack) Name() string { return "slack" }
+
+// Notify implements Notifier.
+func (s *Slack) Notify(ctx context.Context, a *Alert) error {
+	icon := ":rotating_light:"
+	if a.Status == StatusResolved {
+		icon = ":white_check_mark:"
+	}
+	return postJSON(ctx, s.http, s.url, map[string]string{
+		"text": fmt.Sprintf("%s *%s* %s: %s", icon, a.Rule, a.Status, a.Summary),
+	})
+}
+
+func postJSON(ctx context.Context, c *http.Client, url string, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode alert: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// EmailOptions configures the email notifier.
+type EmailOptions struct {
+	// Addr is the SMTP server as host:port.
+	Addr string
+	From string
+	To   []string
+	// Username and Password enable PLAIN authentication, which net/smtp
+	// only performs over TLS or to localhost.
+	Username string
+	Password string
+}
+
+// Email sends alerts over SMTP.
+type Email struct {
+	opts EmailOptions
+}
+
+// NewEmail creates an email notifier.
+func NewEmail(opts EmailOptions) *Email { return &Email{opts: opts} }
+
+// Name implements Notifier.
+func (e *Email) Name() string { return "email" }
+
+// Notify implements Notifier. net/smtp has no context support, so ctx only
+// bounds the wait; a stuck server connection finishes in the background.
+func (e *Email) Notify(ctx context.Context, a *Alert) error {
+	var auth smtp.Auth
+	if e.opts.Username != "" {
+		host, _, _ := net.SplitHostPort(e.opts.Addr)
+		auth = smtp.PlainAuth("", e.opts.Username, e.opts.Password, host)
+	}
+	subject := fmt.Sprintf("[fdo-proxy] %s %s", a.Rule, a.Status)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.opts.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.opts.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", a.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nRule: %s\r\nStatus: %s\r\nSince: %s\r\n",
+		a.Summary, a.Rule, a.Status, a.Since.Format(time.RFC3339))
+
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(e.opts.Addr, auth, e.opts.From, e.opts.To, msg.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,371 @@
+package alert
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+// RuleNames lists the names of the rules.
+var RuleNames = []string{
+	"onboarding_failure_rate", "ledger_breaker_open", "guid_reuse", "rendezvous_registrations_expiring",
+	"onboarding_outside_window", "backend_failover", "backend_down", "onboarding_anomaly",
+}
+
+// sample is a reading of the onboarding counters.
+type sample struct {
+	t               time.Time
+	failed, settled float64
+}
+
+// FailureRate fires when the share of failed onboardings over a sliding
+// window exceeds a threshold. It reads fdo_proxy_onboardings_total.
+type FailureRate struct {
+	reg         *metrics.Registry
+	threshold   float64
+	window      time.Duration
+	minAttempts int
+
+	samples []sample
+}
+
+// NewFailureRate creates the rule. threshold is a fraction (0.2 for 20%);
+// windows with fewer than minAttempts onboardings never fire.
+func NewFailureRate(reg *metrics.Registry, threshold float64, window time.Duration, minAttempts int) *FailureRate {
+	return &FailureRate{reg: reg, threshold: threshold, window: window, minAttempts: minAttempts}
+}
+
+// Name implements Rule.
+func (r *FailureRate) Name() string { return "onboarding_failure_rate" }
+
+// Evaluate implements Rule.
+func (r *FailureRate) Evaluate(now time.Time) (bool, string) {
+	cur := sample{t: now}
+	for _, s := range r.reg.Snapshot("fdo_proxy_onboardings_total") {
+		cur.settled += s.Value
+		if s.Labels["outcome"] == "failed" {
+			cur.failed += s.Value
+		}
+	}
+	r.samples = append(r.samples, cur)
+	// Keep the newest sample at or before the window start as the baseline
+	for len(r.samples) > 1 && !r.samples[1].t.After(now.Add(-r.window)) {
+		r.samples = r.samples[1:]
+	}
+	base := r.samples[0]
+	attempts := cur.settled - base.settled
+	failed := cur.failed - base.failed
+	if attempts <= 0 {
+		return false, fmt.Sprintf("no onboardings in the last %s", r.window)
+	}
+	rate := failed / attempts
+	summary := fmt.Sprintf("%.0f of %.0f onboardings failed (%.1f%%) in the last %s, threshold %.1f%%",
+		failed, attempts, rate*100, r.window, r.threshold*100)
+	return attempts >= float64(r.minAttempts) && rate > r.threshold, summary
+}
+
+// BreakerOpen fires when a ledger circuit breaker has not been closed for
+// longer than a duration. Half-open counts as open, since a breaker probing
+// a dead service flips straight back. It reads fdo_proxy_ledger_breaker_state.
+type BreakerOpen struct {
+	reg   *metrics.Registry
+	after time.Duration
+
+	openSince map[string]time.Time
+}
+
+// NewBreakerOpen creates the rule.
+func NewBreakerOpen(reg *metrics.Registry, after time.Duration) *BreakerOpen {
+	return &BreakerOpen{reg: reg, after: after, openSince: make(map[string]time.Time)}
+}
+
+// Name implements Rule.
+func (r *BreakerOpen) Name() string { return "ledger_breaker_open" }
+
+// Evaluate implements Rule.
+func (r *BreakerOpen) Evaluate(now time.Time) (bool, string) {
+	var open []string
+	for _, s := range r.reg.Snapshot("fdo_proxy_ledger_breaker_state") {
+		ep := s.Labels["endpoint"]
+		if s.Value == 0 {
+			delete(r.openSince, ep)
+			continue
+		}
+		since, ok := r.openSince[ep]
+		if !ok {
+			since = now
+			r.openSince[ep] = now
+		}
+		if d := now.Sub(since); d >= r.after {
+			open = append(open, fmt.Sprintf("%s (%s)", ep, d.Truncate(time.Second)))
+		}
+	}
+	if len(open) == 0 {
+		return false, fmt.Sprintf("no ledger circuit breaker open longer than %s", r.after)
+	}
+	sort.Strings(open)
+	return true, fmt.Sprintf("ledger circuit breaker open longer than %s: %s", r.after, strings.Join(open, ", "))
+}
+
+// GUIDReuse fires while a device GUID was seen reused within a window:
+// in flight from two sources at once, or onboarding again after completing
+// TO2. It reads fdo_proxy_guid_reuse_total.
+type GUIDReuse struct {
+	reg    *metrics.Registry
+	window time.Duration
+
+	samples []reuseSample
+}
+
+// reuseSample is a reading of a counter, such as GUID reuses by kind.
+type reuseSample struct {
+	t      time.Time
+	byKind map[string]float64
+}
+
+// NewGUIDReuse creates the rule.
+func NewGUIDReuse(reg *metrics.Registry, window time.Duration) *GUIDReuse {
+	return &GUIDReuse{reg: reg, window: window}
+}
+
+// Name implements Rule.
+func (r *GUIDReuse) Name() string { return "guid_reuse" }
+
+// Evaluate implements Rule.
+func (r *GUIDReuse) Evaluate(now time.Time) (bool, string) {
+	cur := reuseSample{t: now, byKind: make(map[string]float64)}
+	for _, s := range r.reg.Snapshot("fdo_proxy_guid_reuse_total") {
+		cur.byKind[s.Labels["kind"]] += s.Value
+	}
+	r.samples = append(r.samples, cur)
+	for len(r.samples) > 1 && !r.samples[1].t.After(now.Add(-r.window)) {
+		r.samples = r.samples[1:]
+	}
+	base := r.samples[0]
+
+	var total float64
+	var kinds []string
+	for kind, v := range cur.byKind {
+		if d := v - base.byKind[kind]; d > 0 {
+			total += d
+			kinds = append(kinds, fmt.Sprintf("%s: %.0f", kind, d))
+		}
+	}
+	if total == 0 {
+		return false, fmt.Sprintf("no GUID reuse in the last %s", r.window)
+	}
+	sort.Strings(kinds)
+	return true, fmt.Sprintf("%.0f suspected GUID reuses in the last %s (%s), possible voucher cloning",
+		total, r.window, strings.Join(kinds, ", "))
+}
+
+// Anomalies fires for a window after unusual onboarding activity was
+// detected. It reads fdo_proxy_anomalies_total.
+type Anomalies struct {
+	reg    *metrics.Registry
+	window time.Duration
+
+	samples []reuseSample
+}
+
+// NewAnomalies creates the rule.
+func NewAnomalies(reg *metrics.Registry, window time.Duration) *Anomalies {
+	return &Anomalies{reg: reg, window: window}
+}
+
+// Name implements Rule.
+func (r *Anomalies) Name() string { return "onboarding_anomaly" }
+
+// Evaluate implements Rule.
+func (r *Anomalies) Evaluate(now time.Time) (bool, string) {
+	cur := reuseSample{t: now, byKind: make(map[string]float64)}
+	for _, s := range r.reg.Snapshot("fdo_proxy_anomalies_total") {
+		cur.byKind[s.Labels["kind"]] += s.Value
+	}
+	r.samples = append(r.samples, cur)
+	for len(r.samples) > 1 && !r.samples[1].t.After(now.Add(-r.window)) {
+		r.samples = r.samples[1:]
+	}
+	base := r.samples[0]
+
+	var total float64
+	var kinds []string
+	for kind, v := range cur.byKind {
+		if d := v - base.byKind[kind]; d > 0 {
+			total += d
+			kinds = append(kinds, fmt.Sprintf("%s: %.0f", kind, d))
+		}
+	}
+	if total == 0 {
+		return false, fmt.Sprintf("no onboarding anomaly in the last %s", r.window)
+	}
+	sort.Strings(kinds)
+	return true, fmt.Sprintf("%.0f onboarding anomalies in the last %s (%s)", total, r.window, strings.Join(kinds, ", "))
+}
+
+// RegistrationsExpiring fires while TO0 registrations of devices that have
+// not completed TO2 are about to lapse. It reads
+// fdo_proxy_rendezvous_expiring.
+type RegistrationsExpiring struct {
+	reg *metrics.Registry
+}
+
+// NewRegistrationsExpiring creates the rule.
+func NewRegistrationsExpiring(reg *metrics.Registry) *RegistrationsExpiring {
+	return &RegistrationsExpiring{reg: reg}
+}
+
+// Name implements Rule.
+func (r *RegistrationsExpiring) Name() string { return "rendezvous_registrations_expiring" }
+
+// Evaluate implements Rule.
+func (r *RegistrationsExpiring) Evaluate(now time.Time) (bool, string) {
+	var n float64
+	for _, s := range r.reg.Snapshot("fdo_proxy_rendezvous_expiring") {
+		n += s.Value
+	}
+	if n == 0 {
+		return false, "no rendezvous registrations about to expire"
+	}
+	return true, fmt.Sprintf("%.0f rendezvous registrations about to expire before the device completed TO2", n)
+}
+
+// OutsideWindow fires for a window after devices were refused for trying to
+// onboard outside their policy's maintenance windows. It reads
+// fdo_proxy_policy_actions_total.
+type OutsideWindow struct {
+	reg    *metrics.Registry
+	window time.Duration
+
+	samples []reuseSample
+}
+
+// NewOutsideWindow creates the rule.
+func NewOutsideWindow(reg *metrics.Registry, window time.Duration) *OutsideWindow {
+	return &OutsideWindow{reg: reg, window: window}
+}
+
+// Name implements Rule.
+func (r *OutsideWindow) Name() string { return "onboarding_outside_window" }
+
+// Evaluate implements Rule.
+func (r *OutsideWindow) Evaluate(now time.Time) (bool, string) {
+	cur := reuseSample{t: now, byKind: make(map[string]float64)}
+	for _, s := range r.reg.Snapshot("fdo_proxy_policy_actions_total") {
+		if s.Labels["action"] == "outside_window" {
+			cur.byKind[s.Labels["policy"]] += s.Value
+		}
+	}
+	r.samples = append(r.samples, cur)
+	for len(r.samples) > 1 && !r.samples[1].t.After(now.Add(-r.window)) {
+		r.samples = r.samples[1:]
+	}
+	base := r.samples[0]
+
+	var total float64
+	var policies []string
+	for name, v := range cur.byKind {
+		if d := v - base.byKind[name]; d > 0 {
+			total += d
+			policies = append(policies, fmt.Sprintf("%s: %.0f", name, d))
+		}
+	}
+	if total == 0 {
+		return false, fmt.Sprintf("no onboarding outside policy windows in the last %s", r.window)
+	}
+	sort.Strings(policies)
+	return true, fmt.Sprintf("%.0f onboarding attempts refused outside policy windows in the last %s (%s)",
+		total, r.window, strings.Join(policies, ", "))
+}
+
+// BackendFailover fires while new sessions of a role go to its standby
+// backend because the primary fails its health checks. It reads
+// fdo_proxy_backend_failover_active.
+type BackendFailover struct {
+	reg *metrics.Registry
+}
+
+// NewBackendFailover creates the rule.
+func NewBackendFailover(reg *metrics.Registry) *BackendFailover {
+	return &BackendFailover{reg: reg}
+}
+
+// Name implements Rule.
+func (r *BackendFailover) Name() string { return "backend_failover" }
+
+// Evaluate implements Rule.
+func (r *BackendFailover) Evaluate(now time.Time) (bool, string) {
+	var roles []string
+	for _, s := range r.reg.Snapshot("fdo_proxy_backend_failover_active") {
+		if s.Value == 0 {
+			continue
+		}
+		role := s.Labels["role"]
+		if role == "" {
+			role = "backend"
+		}
+		roles = append(roles, role)
+	}
+	if len(roles) == 0 {
+		return false, "every backend with a standby is healthy"
+	}
+	sort.Strings(roles)
+	return true, fmt.Sprintf("backend failed its health checks, new sessions go to the standby: %s", strings.Join(roles, ", "))
+}
+
+// BackendDown fires when a backend has failed its health checks for
+// longer than a duration: a backend the proxy runs, or a pool none of
+// whose members is healthy. It reads fdo_proxy_backend_up and
+// fdo_proxy_pool_member_up.
+type BackendDown struct {
+	reg   *metrics.Registry
+	after time.Duration
+
+	downSince map[string]time.Time
+}
+
+// NewBackendDown creates the rule.
+func NewBackendDown(reg *metrics.Registry, after time.Duration) *BackendDown {
+	return &BackendDown{reg: reg, after: after, downSince: make(map[string]time.Time)}
+}
+
+// Name implements Rule.
+func (r *BackendDown) Name() string { return "backend_down" }
+
+// Evaluate implements Rule.
+func (r *BackendDown) Evaluate(now time.Time) (bool, string) {
+	up := make(map[string]bool)
+	for _, s := range r.reg.Snapshot("fdo_proxy_backend_up") {
+		up[s.Labels["role"]] = s.Value != 0
+	}
+	for _, s := range r.reg.Snapshot("fdo_proxy_pool_member_up") {
+		role := "pool " + s.Labels["role"]
+		up[role] = up[role] || s.Value != 0
+	}
+	var down []string
+	for role, ok := range up {
+		if ok {
+			delete(r.downSince, role)
+			continue
+		}
+		since, seen := r.downSince[role]
+		if !seen {
+			since = now
+			r.downSince[role] = now
+		}
+		if role == "" {
+			role = "backend"
+		}
+		if d := now.Sub(since); d >= r.after {
+			down = append(down, fmt.Sprintf("%s (%s)", role, d.Truncate(time.Second)))
+		}
+	}
+	if len(down) == 0 {
+		return false, fmt.Sprintf("no backend down longer than %s", r.after)
+	}
+	sort.Strings(down)
+	return true, fmt.Sprintf("backend failing its health checks longer than %s: %s", r.after, strings.Join(down, ", "))
+}
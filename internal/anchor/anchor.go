@@ -0,0 +1,329 @@
+// Package anchor batches hashes of commissioning passports into a Merkle
+// root and posts it to an external chain or notary endpoint on a schedule,
+// giving tamper evidence that does not depend on the passport service.
+package anchor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+// maxPending bounds the leaves held while the notary is unreachable.
+const maxPending = 100000
+
+var (
+	anchorBatches = metrics.Default.NewCounterVec(
+		"fdo_proxy_anchor_batches_total",
+		"Anchoring batches by outcome (success, error).",
+		"outcome")
+	anchorPending = metrics.Default.NewGaugeVec(
+		"fdo_proxy_anchor_pending_leaves",
+		"Commissioning passport hashes waiting to be anchored.")
+)
+
+// Options configures the anchoring job.
+type Options struct {
+	// URL receives a POST with the batch JSON.
+	URL string
+	// Dir, if set, receives one JSON record per anchored batch including
+	// each passport's inclusion proof.
+	Dir string
+	// Authorization, if set, is sent verbatim as the Authorization header.
+	Authorization string
+	// PendingPath, if set, is a JSON Lines file keeping the leaves not yet
+	// anchored, so a restart does not drop them.
+	PendingPath string
+}
+
+// Leaf is one anchored commissioning passport.
+type Leaf struct {
+	GUID string    `json:"guid"`
+	Time time.Time `json:"time"`
+	// PassportHash is the hex SHA-256 of the passport JSON sent to the ledger.
+	PassportHash string `json:"passport_hash"`
+}
+
+// Batch is the payload posted to the notary.
+type Batch struct {
+	Root   string    `json:"root"`
+	Algo   string    `json:"algorithm"`
+	Count  int       `json:"count"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Leaves []Leaf    `json:"leaves"`
+}
+
+// record is the on-disk form of an anchored batch.
+type record struct {
+	Batch
+	Proofs  map[string][]string `json:"proofs"`
+	Receipt json.RawMessage     `json:"receipt,omitempty"`
+}
+
+// Anchorer collects commissioning events and anchors them periodically.
+// It implements events.Sink.
+type Anchorer struct {
+	opts Options
+	http *http.Client
+
+	mu      sync.Mutex
+	pending []Leaf
+	// f appends to opts.PendingPath.
+	f *os.File
+}
+
+// New creates an Anchorer, picking up the leaves left pending in
+// opts.PendingPath by an earlier run.
+func New(opts Options) (*Anchorer, error) {
+	if opts.Dir != "" {
+		if err := os.MkdirAll(opts.Dir, 0o750); err != nil {
+			return nil, fmt.Errorf("create anchor dir: %w", err)
+		}
+	}
+	a := &Anchorer{opts: opts, http: &http.Client{Timeout: 30 * time.Second}}
+	if opts.PendingPath != "" {
+		leaves, err := LoadPending(opts.PendingPath)
+		if err != nil {
+			return nil, err
+		}
+		a.pending = leaves
+		// Rewritten so a torn final line is not appended to
+		if err := a.savePendingLocked(); err != nil {
+			return nil, err
+		}
+		if len(leaves) > 0 {
+			slog.Info("Commissioning passports left pending by an earlier run", "count", len(leaves), "path", opts.PendingPath)
+		}
+	}
+	anchorPending.Set(float64(len(a.pending)))
+	return a, nil
+}
+
+// LoadPending reads the leaves kept in the pending file at path, which
+// need not exist. Unreadable lines, such as a torn final write, are
+// skipped.
+func LoadPending(path string) ([]Leaf, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read pending anchor leaves: %w", err)
+	}
+	defer f.Close()
+	var leaves []Leaf
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var l Leaf
+		if err := json.Unmarshal(sc.Bytes(), &l); err != nil || l.PassportHash == "" {
+			slog.Warn("Skipping unreadable pending anchor leaf", "path", path, "line", line, "error", err)
+			continue
+		}
+		leaves = append(leaves, l)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read pending anchor leaves: %w", err)
+	}
+	return leaves, nil
+}
+
+// Name implements events.Sink.
+func (a *Anchorer) Name() string { return "anchor" }
+
+// Publish implements events.Sink by queueing the passport hash.
+func (a *Anchorer) Publish(ctx context.Context, ev *events.Event) error {
+	if ev.Type != events.Commissioned || ev.Passport == nil {
+		return nil
+	}
+	b, err := json.Marshal(ev.Passport)
+	if err != nil {
+		return fmt.Errorf("encode passport: %w", err)
+	}
+	sum := sha256.Sum256(b)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.pending) >= maxPending {
+		return fmt.Errorf("anchor queue full (%d passports)", maxPending)
+	}
+	leaf := Leaf{GUID: ev.GUID, Time: ev.Time.UTC(), PassportHash: hex.EncodeToString(sum[:])}
+	a.pending = append(a.pending, leaf)
+	anchorPending.Set(float64(len(a.pending)))
+	return a.appendPendingLocked(leaf)
+}
+
+// appendPendingLocked adds l to the pending file. The caller must hold
+// a.mu.
+func (a *Anchorer) appendPendingLocked(l Leaf) error {
+	if a.f == nil {
+		return nil
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("encode pending anchor leaf: %w", err)
+	}
+	if _, err := a.f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("save pending anchor leaf: %w", err)
+	}
+	return nil
+}
+
+// savePendingLocked atomically replaces the pending file with the leaves
+// pending now and reopens it for appending. The caller must hold a.mu.
+func (a *Anchorer) savePendingLocked() error {
+	path := a.opts.PendingPath
+	if path == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, l := range a.pending {
+		if err := enc.Encode(l); err != nil {
+			return fmt.Errorf("encode pending anchor leaf: %w", err)
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("save pending anchor leaves: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("save pending anchor leaves: %w", err)
+	}
+	if a.f != nil {
+		a.f.Close()
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		a.f = nil
+		return fmt.Errorf("reopen pending anchor leaves: %w", err)
+	}
+	a.f = f
+	return nil
+}
+
+// Flush anchors everything pending, as the scheduler's anchor job and
+// once more on shutdown. On failure the leaves are kept for the next round.
+// Leaves anchored just before a crash stay in the pending file and are
+// anchored again after the restart.
+func (a *Anchorer) Flush(ctx context.Context) error {
+	a.mu.Lock()
+	leaves := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+	if len(leaves) == 0 {
+		return nil
+	}
+
+	batch, hashes := newBatch(leaves)
+	receipt, err := a.post(ctx, batch)
+	if err != nil {
+		anchorBatches.Inc("error")
+		slog.Warn("Anchoring failed, will retry next round", "count", batch.Count, "root", batch.Root, "error", err)
+		a.mu.Lock()
+		a.pending = append(leaves, a.pending...)
+		anchorPending.Set(float64(len(a.pending)))
+		a.mu.Unlock()
+		return err
+	}
+	anchorBatches.Inc("success")
+	a.mu.Lock()
+	anchorPending.Set(float64(len(a.pending)))
+	if err := a.savePendingLocked(); err != nil {
+		slog.Warn("Failed to drop anchored leaves from the pending file", "path", a.opts.PendingPath, "error", err)
+	}
+	a.mu.Unlock()
+	slog.Info("Anchored commissioning passports", "count", batch.Count, "root", batch.Root)
+
+	if a.opts.Dir != "" {
+		if err := a.store(batch, hashes, receipt); err != nil {
+			slog.Warn("Failed to store anchor record", "root", batch.Root, "error", err)
+		}
+	}
+	return nil
+}
+
+func newBatch(leaves []Leaf) (*Batch, [][32]byte) {
+	hashes := make([][32]byte, len(leaves))
+	for i, l := range leaves {
+		raw, _ := hex.DecodeString(l.PassportHash)
+		hashes[i] = LeafHash(raw)
+	}
+	root := Root(hashes)
+	return &Batch{
+		Root:   hex.EncodeToString(root[:]),
+		Algo:   "rfc6962-sha256",
+		Count:  len(leaves),
+		From:   leaves[0].Time,
+		To:     leaves[len(leaves)-1].Time,
+		Leaves: leaves,
+	}, hashes
+}
+
+// post sends the batch and returns the notary's response body as a receipt.
+func (a *Anchorer) post(ctx context.Context, batch *Batch) ([]byte, error) {
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return nil, fmt.Errorf("encode batch: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.opts.URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.opts.Authorization != "" {
+		req.Header.Set("Authorization", a.opts.Authorization)
+	}
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("notary request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("notary status %d: %s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
+
+// store writes the batch with per-passport inclusion proofs.
+func (a *Anchorer) store(batch *Batch, hashes [][32]byte, receipt []byte) error {
+	rec := record{Batch: *batch, Proofs: make(map[string][]string, len(hashes))}
+	if json.Valid(receipt) {
+		rec.Receipt = receipt
+	}
+	for i, l := range batch.Leaves {
+		proof := Proof(hashes, i)
+		path := make([]string, len(proof))
+		for j, p := range proof {
+			path[j] = hex.EncodeToString(p[:])
+		}
+		rec.Proofs[l.PassportHash] = path
+	}
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.json", batch.To.Format("20060102T150405Z"), batch.Root[:16])
+	return os.WriteFile(filepath.Join(a.opts.Dir, name), b, 0o640)
+}
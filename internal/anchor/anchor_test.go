@@ -0,0 +1,110 @@
+package anchor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/ledger"
+)
+
+func commissioned(guid string) *events.Event {
+	return &events.Event{
+		Type:     events.Commissioned,
+		GUID:     guid,
+		Time:     time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC),
+		Passport: &ledger.CommissioningCreateRequest{ControllerUUID: guid},
+	}
+}
+
+func TestPendingSurvivesRestart(t *testing.T) {
+	var down atomic.Bool
+	var posted atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		posted.Add(1)
+		w.Write([]byte(`{"tx":"1"}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "anchor-pending.jsonl")
+	opts := Options{URL: srv.URL, PendingPath: path}
+	a, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, guid := range []string{"guid-1", "guid-2"} {
+		if err := a.Publish(ctx, commissioned(guid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The proxy died halfway through appending a third leaf
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"guid":"guid-3","ti`)
+	f.Close()
+
+	a, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.pending) != 2 || a.pending[0].GUID != "guid-1" || a.pending[1].GUID != "guid-2" {
+		t.Fatalf("pending after restart = %+v, want guid-1 and guid-2", a.pending)
+	}
+	if err := a.Publish(ctx, commissioned("guid-4")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed round keeps the leaves on disk
+	down.Store(true)
+	if err := a.Flush(ctx); err == nil {
+		t.Fatal("Flush against a failing endpoint = nil, want an error")
+	}
+	leaves, err := LoadPending(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaves) != 3 || leaves[2].GUID != "guid-4" {
+		t.Errorf("pending file after a failed round = %+v, want 3 leaves ending with guid-4", leaves)
+	}
+
+	down.Store(false)
+	if err := a.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if posted.Load() != 1 {
+		t.Errorf("%d batches posted, want 1", posted.Load())
+	}
+	if leaves, err := LoadPending(path); err != nil || len(leaves) != 0 {
+		t.Errorf("pending file after anchoring = %+v, %v, want empty", leaves, err)
+	}
+
+	// Leaves published after the round are still appended
+	if err := a.Publish(ctx, commissioned("guid-5")); err != nil {
+		t.Fatal(err)
+	}
+	if leaves, err := LoadPending(path); err != nil || len(leaves) != 1 || leaves[0].GUID != "guid-5" {
+		t.Errorf("pending file = %+v, %v, want guid-5", leaves, err)
+	}
+}
+
+func TestLoadPendingMissing(t *testing.T) {
+	leaves, err := LoadPending(filepath.Join(t.TempDir(), "absent.jsonl"))
+	if err != nil || leaves != nil {
+		t.Errorf("LoadPending of a missing file = %v, %v, want nil, nil", leaves, err)
+	}
+}
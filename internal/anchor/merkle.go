@@ -0,0 +1,56 @@
+package anchor
+
+import "crypto/sha256"
+
+// Leaves and interior nodes are domain-separated as in RFC 6962 so a leaf can
+// never be passed off as an interior node.
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// LeafHash returns the Merkle leaf hash of data.
+func LeafHash(data []byte) [32]byte {
+	return sha256.Sum256(append([]byte{leafPrefix}, data...))
+}
+
+func nodeHash(l, r [32]byte) [32]byte {
+	b := make([]byte, 0, 1+2*sha256.Size)
+	b = append(b, nodePrefix)
+	b = append(b, l[:]...)
+	b = append(b, r[:]...)
+	return sha256.Sum256(b)
+}
+
+// Root computes the RFC 6962 Merkle tree hash over leaf hashes. The tree is
+// split at the largest power of two smaller than the leaf count, so roots
+// can be checked with any RFC 6962 implementation. An empty tree hashes to
+// SHA-256 of the empty string.
+func Root(leaves [][32]byte) [32]byte {
+	switch len(leaves) {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return leaves[0]
+	}
+	k := 1
+	for k<<1 < len(leaves) {
+		k <<= 1
+	}
+	return nodeHash(Root(leaves[:k]), Root(leaves[k:]))
+}
+
+// Proof returns the audit path for leaf index i, ordered from the leaf up.
+func Proof(leaves [][32]byte, i int) [][32]byte {
+	if len(leaves) <= 1 || i < 0 || i >= len(leaves) {
+		return nil
+	}
+	k := 1
+	for k<<1 < len(leaves) {
+		k <<= 1
+	}
+	if i < k {
+		return append(Proof(leaves[:k], i), Root(leaves[k:]))
+	}
+	return append(Proof(leaves[k:], i-k), Root(leaves[:k]))
+}
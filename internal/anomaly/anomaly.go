@@ -0,0 +1,347 @@
+// Package anomaly watches onboarding for activity that departs from what
+// the proxy has seen before: bursts of attempts or failures, onboarding
+// at hours the line is normally idle, and devices onboarding from
+// networks never seen. Any of these can be a supply-chain signal, such as
+// cloned vouchers being replayed or devices diverted to another site, so
+// each is raised as an events.Anomaly for the other sinks to report.
+//
+// The baseline is learned from the onboardings themselves: an
+// exponentially weighted mean and variance of attempts and failures per
+// five minutes, the share of onboardings by hour of the day, and the
+// source networks (IPv4 /24, IPv6 /48) seen. Nothing is raised until it
+// has been learned for a while.
+package anomaly
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+// Kinds of anomaly.
+const (
+	// RateSpike is far more DI and TO2 attempts in five minutes than usual.
+	RateSpike = "rate_spike"
+	// FailureBurst is far more failed attempts in five minutes than usual.
+	FailureBurst = "failure_burst"
+	// UnusualHour is onboarding at an hour of the day that rarely sees any.
+	UnusualHour = "unusual_hour"
+	// NewNetwork is onboarding from a source network not seen before.
+	NewNetwork = "new_network"
+)
+
+// Kinds lists the kinds of anomaly.
+var Kinds = []string{RateSpike, FailureBurst, UnusualHour, NewNetwork}
+
+var raised = metrics.Default.NewCounterVec(
+	"fdo_proxy_anomalies_total",
+	"Unusual onboarding activity by kind (rate_spike, failure_burst, unusual_hour, new_network).",
+	"kind")
+
+const (
+	// bucketWidth is the period attempts and failures are counted over.
+	bucketWidth = 5 * time.Minute
+	// alpha weighs each finished bucket in the baseline, so roughly the
+	// last day of buckets counts.
+	alpha = 1.0 / 288
+	// minSpike and minBurst are the fewest attempts and failures in a
+	// bucket that can be a spike or burst, so a quiet line does not raise
+	// one for a handful of devices.
+	minSpike = 20
+	minBurst = 10
+	// quietHour is the share of a uniform hour's onboardings below which
+	// an hour of the day is unusual.
+	quietHour = 0.1
+	// hourCap is the total the hour counts are halved at, so recent
+	// months weigh more than old ones.
+	hourCap = 100000
+	// networkTTL is how long a network unseen is remembered.
+	networkTTL = 90 * 24 * time.Hour
+)
+
+// Options tune the detector.
+type Options struct {
+	// Threshold is how many standard deviations above the baseline a
+	// bucket's attempts or failures must be to raise an anomaly.
+	Threshold float64
+	// Learning is how long the baseline is learned, from the first
+	// onboarding seen, before anomalies are raised.
+	Learning time.Duration
+}
+
+// stat is an exponentially weighted mean and variance.
+type stat struct {
+	Mean float64 `json:"mean"`
+	Var  float64 `json:"var"`
+}
+
+// add folds x into the mean and variance.
+func (s *stat) add(x float64) {
+	d := x - s.Mean
+	s.Mean += alpha * d
+	s.Var = (1 - alpha) * (s.Var + alpha*d*d)
+}
+
+// above reports whether x is more than k standard deviations above the
+// mean. The deviation is at least that of a Poisson count, so a steady
+// baseline does not make every small rise unusual.
+func (s stat) above(x, k float64) bool {
+	sd := max(math.Sqrt(s.Var), math.Sqrt(s.Mean), 1)
+	return x > s.Mean+k*sd
+}
+
+// state is what the detector has learned; it is kept in the state file.
+type state struct {
+	// Since is the first onboarding seen.
+	Since    time.Time `json:"since"`
+	Attempts stat      `json:"attempts"`
+	Failures stat      `json:"failures"`
+	// Hours counts onboardings by hour of the day in local time.
+	Hours [24]float64 `json:"hours"`
+	// Networks holds when each source network was last seen.
+	Networks map[string]time.Time `json:"networks"`
+
+	// Bucket is the start of the current bucket, and Count and Failed
+	// its attempts and failures so far.
+	Bucket time.Time `json:"bucket"`
+	Count  int       `json:"count"`
+	Failed int       `json:"failed"`
+}
+
+// Detector raises anomalies from the onboardings published on a bus. It
+// implements events.Sink.
+type Detector struct {
+	bus  *events.Bus
+	o    Options
+	path string
+
+	mu    sync.Mutex
+	st    state
+	dirty bool
+	// spiked and burst mark the current bucket as raised, and quiet the
+	// last hour raised as unusual.
+	spiked, burst bool
+	quiet         time.Time
+}
+
+// Open returns a Detector publishing on bus, with the baseline loaded
+// from path, which need not exist yet. An empty path keeps it in memory,
+// so it is learned again after a restart.
+func Open(bus *events.Bus, o Options, path string) (*Detector, error) {
+	d := &Detector{bus: bus, o: o, path: path, st: state{Networks: make(map[string]time.Time)}}
+	if path == "" {
+		return d, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read anomaly baseline: %w", err)
+	}
+	if err := json.Unmarshal(b, &d.st); err != nil {
+		return nil, fmt.Errorf("parse anomaly baseline: %w", err)
+	}
+	if d.st.Networks == nil {
+		d.st.Networks = make(map[string]time.Time)
+	}
+	return d, nil
+}
+
+// Name implements events.Sink.
+func (d *Detector) Name() string { return "anomaly" }
+
+// anomaly is one to raise.
+type anomaly struct {
+	kind, reason string
+}
+
+// Publish implements events.Sink.
+func (d *Detector) Publish(ctx context.Context, ev *events.Event) error {
+	var failed bool
+	switch ev.Type {
+	case events.Initialized, events.Commissioned:
+	case events.Failed:
+		failed = true
+	default:
+		return nil
+	}
+	var network string
+	if ev.Session != nil {
+		if addr, err := netip.ParseAddr(ev.Session.RemoteAddr); err == nil {
+			network = prefix(addr.Unmap()).String()
+		}
+	}
+
+	d.mu.Lock()
+	found := d.observeLocked(ev.Time, failed, network)
+	d.mu.Unlock()
+
+	for _, a := range found {
+		raised.Inc(a.kind)
+		slog.Warn("Onboarding anomaly", "kind", a.kind, "reason", a.reason, "guid", ev.GUID, "serial", ev.Serial, "request_id", ev.RequestID)
+		out := &events.Event{
+			Type:        events.Anomaly,
+			AnomalyKind: a.kind,
+			Reason:      a.reason,
+			GUID:        ev.GUID,
+			OwnerID:     ev.OwnerID,
+			Time:        ev.Time,
+			RequestID:   ev.RequestID,
+			Session:     ev.Session,
+			Protocol:    ev.Protocol,
+			ProductID:   ev.ProductID,
+			Serial:      ev.Serial,
+			Tags:        ev.Tags,
+			Location:    ev.Location,
+		}
+		if out.Protocol == "" && ev.Session != nil {
+			out.Protocol = ev.Session.Protocol
+		}
+		d.bus.Publish(ctx, out)
+	}
+	return nil
+}
+
+// observeLocked counts an onboarding attempt at t from network, which is
+// empty if not known, and returns the anomalies it reveals. The caller
+// must hold d.mu.
+func (d *Detector) observeLocked(t time.Time, failed bool, network string) []anomaly {
+	st := &d.st
+	d.dirty = true
+	if st.Since.IsZero() {
+		st.Since = t
+	}
+	d.rollLocked(t)
+	learned := t.Sub(st.Since) >= d.o.Learning
+
+	var found []anomaly
+	st.Count++
+	if failed {
+		st.Failed++
+	}
+	if learned && !d.spiked && st.Count >= minSpike && st.Attempts.above(float64(st.Count), d.o.Threshold) {
+		d.spiked = true
+		found = append(found, anomaly{RateSpike, fmt.Sprintf("%d onboarding attempts in %s against a usual %.1f", st.Count, bucketWidth, st.Attempts.Mean)})
+	}
+	if learned && !d.burst && st.Failed >= minBurst && st.Failures.above(float64(st.Failed), d.o.Threshold) {
+		d.burst = true
+		found = append(found, anomaly{FailureBurst, fmt.Sprintf("%d failed onboarding attempts in %s against a usual %.1f", st.Failed, bucketWidth, st.Failures.Mean)})
+	}
+
+	h := t.Local().Hour()
+	total := 0.0
+	for _, n := range st.Hours {
+		total += n
+	}
+	if hour := t.Truncate(time.Hour); learned && total > 0 && st.Hours[h]/total < quietHour/24 && !hour.Equal(d.quiet) {
+		d.quiet = hour
+		found = append(found, anomaly{UnusualHour, fmt.Sprintf("onboarding at %02d:00, an hour that sees %.2f%% of onboardings", h, 100*st.Hours[h]/total)})
+	}
+	if st.Hours[h]++; total+1 >= hourCap {
+		for i := range st.Hours {
+			st.Hours[i] /= 2
+		}
+	}
+
+	if network != "" {
+		if seen, ok := st.Networks[network]; learned && (!ok || t.Sub(seen) > networkTTL) {
+			found = append(found, anomaly{NewNetwork, fmt.Sprintf("onboarding from %s, a network not seen in %d days", network, networkTTL/(24*time.Hour))})
+		}
+		st.Networks[network] = t
+	}
+	return found
+}
+
+// rollLocked moves the current bucket on to the one holding t, adding the
+// buckets finished, empty ones included, to the baseline.
+func (d *Detector) rollLocked(t time.Time) {
+	st := &d.st
+	b := t.Truncate(bucketWidth)
+	if st.Bucket.IsZero() {
+		st.Bucket = b
+		return
+	}
+	if !b.After(st.Bucket) {
+		// Late events count in the current bucket
+		return
+	}
+	st.Attempts.add(float64(st.Count))
+	st.Failures.add(float64(st.Failed))
+	// Past a week of silence the baseline has decayed about as far as it
+	// will
+	empty := min(int64(b.Sub(st.Bucket)/bucketWidth)-1, 7*288)
+	for range empty {
+		st.Attempts.add(0)
+		st.Failures.add(0)
+	}
+	st.Bucket, st.Count, st.Failed = b, 0, 0
+	d.spiked, d.burst = false, false
+}
+
+// prefix is the source network of addr: its /24 for IPv4, /48 for IPv6.
+func prefix(addr netip.Addr) netip.Prefix {
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	p, _ := addr.Prefix(bits)
+	return p
+}
+
+// Run saves the baseline every interval while it changes, until ctx is
+// done; the proxy calls Save at shutdown.
+func (d *Detector) Run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			if err := d.Save(); err != nil {
+				slog.Warn("Failed to save anomaly baseline", "path", d.path, "error", err)
+			}
+		}
+	}
+}
+
+// Save forgets networks unseen for networkTTL and atomically rewrites the
+// state file if the baseline changed.
+func (d *Detector) Save() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.dirty || d.path == "" {
+		return nil
+	}
+	now := time.Now()
+	for n, seen := range d.st.Networks {
+		if now.Sub(seen) > networkTTL {
+			delete(d.st.Networks, n)
+		}
+	}
+	b, err := json.MarshalIndent(d.st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := d.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("write anomaly baseline: %w", err)
+	}
+	if err := os.Rename(tmp, d.path); err != nil {
+		return fmt.Errorf("replace anomaly baseline: %w", err)
+	}
+	d.dirty = false
+	return nil
+}
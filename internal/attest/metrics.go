@@ -0,0 +1,14 @@
+package attest
+
+import "github.com/fdo-server-wrapper/internal/metrics"
+
+var (
+	verifications = metrics.Default.NewCounterVec(
+		"fdo_proxy_attestation_verifications_total",
+		"Attestation verifications by result (verified, rejected, unverified, error).",
+		"result")
+	verifyLatency = metrics.Default.NewHistogramVec(
+		"fdo_proxy_attestation_verify_duration_seconds",
+		"External attestation verifier latency.",
+		metrics.DefBuckets)
+)
@@ -0,0 +1,142 @@
+// Package attest lets an external service (e.g. a TPM attestation verifier)
+// vet the device attestation presented in TO2.ProveDevice before onboarding
+// is allowed to proceed.
+package attest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+)
+
+// ErrRejected is returned (wrapped) when a verifier explicitly rejects the
+// evidence, as opposed to failing to reach a decision.
+var ErrRejected = errors.New("attestation rejected")
+
+// Evidence is the attestation captured from TO2.ProveDevice.
+type Evidence struct {
+	GUID         string `json:"guid"`
+	Type         string `json:"type"`
+	Algorithm    string `json:"algorithm"`
+	Nonce        string `json:"nonce,omitempty"`
+	ClaimsDigest string `json:"claims_digest"`
+	// Token is the complete COSE_Sign1 Entity Attestation Token.
+	Token []byte `json:"token"`
+}
+
+// Verifier decides whether a device's attestation is acceptable.
+// Implementations return an error wrapping ErrRejected for an explicit
+// rejection and any other error when no decision could be made.
+type Verifier interface {
+	Verify(ctx context.Context, ev *Evidence) error
+}
+
+// VerifierFunc adapts a function to the Verifier interface.
+type VerifierFunc func(ctx context.Context, ev *Evidence) error
+
+// Verify calls f(ctx, ev).
+func (f VerifierFunc) Verify(ctx context.Context, ev *Evidence) error {
+	return f(ctx, ev)
+}
+
+// HTTPVerifier posts evidence as JSON to an external verification service.
+// The service answers 200 with {"verified": bool, "reason": string}; any
+// other status is treated as an error rather than a rejection.
+type HTTPVerifier struct {
+	url  string
+	http *http.Client
+}
+
+// NewHTTPVerifier creates a verifier for the service at url. A non-positive
+// timeout defaults to 5 seconds.
+func NewHTTPVerifier(url string, timeout time.Duration) *HTTPVerifier {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &HTTPVerifier{url: url, http: &http.Client{Timeout: timeout}}
+}
+
+type verifyResponse struct {
+	Verified bool   `json:"verified"`
+	Reason   string `json:"reason"`
+}
+
+// Verify sends ev to the verification service.
+func (v *HTTPVerifier) Verify(ctx context.Context, ev *Evidence) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("encode evidence: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	correlation.Inject(ctx, req.Header)
+
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("verifier request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("verifier status %d: %s", resp.StatusCode, string(b))
+	}
+	var out verifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return fmt.Errorf("decode verifier response: %w", err)
+	}
+	if !out.Verified {
+		if out.Reason == "" {
+			return ErrRejected
+		}
+		return fmt.Errorf("%w: %s", ErrRejected, out.Reason)
+	}
+	return nil
+}
+
+// Verification results recorded in sessions, passports and metrics.
+const (
+	ResultVerified = "verified"
+	ResultRejected = "rejected"
+	// ResultUnverified means the verifier could not decide and the
+	// fail-open policy let the device proceed.
+	ResultUnverified = "unverified"
+	// ResultError means the verifier could not decide and the fail-closed
+	// policy stopped the device.
+	ResultError = "error"
+)
+
+// Check runs v against ev and applies the failure policy. It returns the
+// result to record and a non-nil error when onboarding must be stopped:
+// always for an explicit rejection, and for verifier errors unless failOpen.
+func Check(ctx context.Context, v Verifier, ev *Evidence, failOpen bool) (string, error) {
+	start := time.Now()
+	err := v.Verify(ctx, ev)
+	verifyLatency.Observe(time.Since(start).Seconds())
+
+	result := ResultVerified
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrRejected):
+		result = ResultRejected
+	case failOpen:
+		slog.Warn("Attestation verifier failed, allowing device (fail-open)", "guid", ev.GUID, "error", err)
+		result, err = ResultUnverified, nil
+	default:
+		result = ResultError
+	}
+	verifications.Inc(result)
+	return result, err
+}
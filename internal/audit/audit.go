@@ -0,0 +1,87 @@
+// Package audit keeps append-only histories of operator changes made
+// through the admin API, optionally persisted as JSON Lines, among them
+// the tamper-evident trail of every admin action.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// Log is a history of T records, optionally persisted to a JSON Lines file
+// that is appended to on every record.
+type Log[T any] struct {
+	path string
+	name string
+
+	mu      sync.RWMutex
+	entries []T
+}
+
+// Open loads the history from path, which need not exist yet. An empty path
+// keeps the history in memory only. name describes the log in errors.
+func Open[T any](path, name string) (*Log[T], error) {
+	l := &Log[T]{path: path, name: name}
+	if path == "" {
+		return l, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", name, err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 4<<20)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var e T
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+		l.entries = append(l.entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	return l, nil
+}
+
+// Record appends e to the history.
+func (l *Log[T]) Record(e T) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, e)
+	if l.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", l.name, err)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %w", l.name, err)
+	}
+	return f.Close()
+}
+
+// Entries returns the history, oldest first.
+func (l *Log[T]) Entries() []T {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]T(nil), l.entries...)
+}
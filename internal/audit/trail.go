@@ -0,0 +1,202 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+var (
+	trailRecords = metrics.Default.NewCounterVec(
+		"fdo_proxy_admin_audit_records_total",
+		"Admin API actions recorded in the audit trail, by outcome (success, error).",
+		"outcome")
+	trailIntact = metrics.Default.NewGaugeVec(
+		"fdo_proxy_admin_audit_intact",
+		"1 while the admin audit trail's hash chain verifies, 0 once a record was found altered, removed or reordered.")
+)
+
+// Action is one change made through the admin API, or a refused attempt
+// at one.
+type Action struct {
+	Seq  int64     `json:"seq"`
+	Time time.Time `json:"time"`
+	// Principal names the admin token the request authenticated with,
+	// empty if it did not.
+	Principal  string `json:"principal"`
+	RemoteAddr string `json:"remote_addr"`
+	RequestID  string `json:"request_id,omitempty"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Status     int    `json:"status"`
+	// Before and After are the state the action changed, as the handler
+	// reported it; absent for actions without one, such as running a job.
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+	// Prev is the Hash of the action before, empty for the first, and
+	// Hash covers Prev and every other field.
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+// Trail is a tamper-evident history of admin actions, persisted as JSON
+// Lines like a Log. Each action is chained to the one before by a
+// SHA-256 hash over it and the previous hash, so editing, removing or
+// reordering records breaks the chain from that point on. With a key the
+// hash is an HMAC-SHA256, so the chain cannot be rebuilt without it.
+type Trail struct {
+	log  *Log[Action]
+	path string
+	key  []byte
+
+	mu   sync.Mutex
+	seq  int64
+	last string
+}
+
+// OpenTrail loads the trail from path, which need not exist yet; an empty
+// path keeps it in memory only. A trail whose chain is broken still opens
+// as long as its records parse, so the proxy can run and append to it;
+// Verify reports the break.
+func OpenTrail(path string, key []byte) (*Trail, error) {
+	l, err := Open[Action](path, "admin audit trail")
+	if err != nil {
+		return nil, err
+	}
+	t := &Trail{log: l, path: path, key: key}
+	if entries := l.Entries(); len(entries) > 0 {
+		last := entries[len(entries)-1]
+		t.seq, t.last = last.Seq, last.Hash
+	}
+	return t, nil
+}
+
+// Record chains a to the trail and appends it, returning it as recorded.
+func (t *Trail) Record(a Action) (Action, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a.Seq = t.seq + 1
+	a.Time = a.Time.UTC()
+	a.Prev = t.last
+	sum, err := t.sum(a)
+	if err != nil {
+		trailRecords.Inc("error")
+		return a, err
+	}
+	a.Hash = sum
+	if err := t.log.Record(a); err != nil {
+		trailRecords.Inc("error")
+		return a, err
+	}
+	t.seq, t.last = a.Seq, a.Hash
+	trailRecords.Inc("success")
+	return a, nil
+}
+
+// sum is the hash of a with its Hash left out.
+func (t *Trail) sum(a Action) (string, error) {
+	a.Hash = ""
+	b, err := json.Marshal(a)
+	if err != nil {
+		return "", fmt.Errorf("encode admin audit record: %w", err)
+	}
+	var h hash.Hash
+	if t.key != nil {
+		h = hmac.New(sha256.New, t.key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Entries returns the trail, oldest first.
+func (t *Trail) Entries() []Action {
+	return t.log.Entries()
+}
+
+// ErrTampered is returned by Verify when the chain is broken.
+var ErrTampered = errors.New("admin audit trail does not verify")
+
+// Verify reads the trail back from its file and checks the chain, so it
+// finds changes made behind the proxy's back. It returns the number of
+// records checked. A trail kept in memory is checked as held.
+func (t *Trail) Verify() (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n, err := t.verifyLocked()
+	if errors.Is(err, ErrTampered) {
+		trailIntact.Set(0)
+	} else if err == nil {
+		trailIntact.Set(1)
+	}
+	return n, err
+}
+
+func (t *Trail) verifyLocked() (int, error) {
+	entries := t.log.Entries()
+	if t.path != "" {
+		var err error
+		if entries, err = readActions(t.path); err != nil {
+			return 0, err
+		}
+	}
+	prev := ""
+	for i, a := range entries {
+		if a.Prev != prev {
+			return i, fmt.Errorf("%w: record %d does not follow the one before", ErrTampered, a.Seq)
+		}
+		sum, err := t.sum(a)
+		if err != nil {
+			return i, err
+		}
+		if !hmac.Equal([]byte(sum), []byte(a.Hash)) {
+			return i, fmt.Errorf("%w: record %d was altered", ErrTampered, a.Seq)
+		}
+		prev = a.Hash
+	}
+	if prev != t.last {
+		return len(entries), fmt.Errorf("%w: records after %d are missing", ErrTampered, len(entries))
+	}
+	return len(entries), nil
+}
+
+// readActions reads every record of the trail file at path.
+func readActions(path string) ([]Action, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open admin audit trail: %w", err)
+	}
+	defer f.Close()
+	var out []Action
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 4<<20)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var a Action
+		if err := json.Unmarshal(sc.Bytes(), &a); err != nil {
+			return nil, fmt.Errorf("%w: unreadable record after %d", ErrTampered, len(out))
+		}
+		out = append(out, a)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read admin audit trail: %w", err)
+	}
+	return out, nil
+}
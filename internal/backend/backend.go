@@ -0,0 +1,77 @@
+// Package backend runs the go-fdo server the proxy forwards to, either as a
+// child process built from a go-fdo source tree or as a container.
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Process runs the go-fdo server with `go run ./cmd/server` in a go-fdo
+// source tree, which needs the tree and a Go toolchain on the host.
+type Process struct {
+	dir  string
+	db   string
+	args []string
+	cmd  *exec.Cmd
+}
+
+// NewProcess creates a backend run from the go-fdo repository at dir with
+// its database at db, relative to dir; "" is ./fdo-backend.db. args are
+// passed to the server after the ones the proxy sets.
+func NewProcess(dir, db string, args []string) *Process {
+	if db == "" {
+		db = "./fdo-backend.db"
+	}
+	return &Process{dir: dir, db: db, args: args}
+}
+
+// Start starts the server listening on localhost:port.
+func (p *Process) Start(ctx context.Context, port int) error {
+	args := append([]string{
+		"run", "./cmd/server",
+		"-db", p.db,
+		"-http", fmt.Sprintf("localhost:%d", port),
+		"-debug",
+	}, p.args...)
+
+	p.cmd = exec.CommandContext(ctx, "go", args...)
+	p.cmd.Dir = p.dir
+	p.cmd.Stdout = os.Stdout
+	p.cmd.Stderr = os.Stderr
+	if err := p.cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start FDO server: %w", err)
+	}
+
+	slog.Info("Backend FDO server started", "pid", p.cmd.Process.Pid, "port", port)
+	return nil
+}
+
+// Stop kills the server process.
+func (p *Process) Stop(ctx context.Context) error {
+	if p.cmd == nil || p.cmd.Process == nil {
+		return nil
+	}
+	// The process is already gone if the context passed to Start ended
+	if err := p.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("kill backend process: %w", err)
+	}
+	return nil
+}
+
+// Version describes the go-fdo tree the server is run from, by the git tag
+// and commit of its HEAD, e.g. v0.3.1-4-g1a2b3c4-dirty.
+func (p *Process) Version(ctx context.Context) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "describe", "--tags", "--always", "--dirty")
+	cmd.Dir = p.dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("describe %s: %w", p.dir, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,363 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultEngineHost is the Docker socket used when neither the -backend
+// flags nor $DOCKER_HOST name an engine. Podman serves the same API on
+// unix:///run/podman/podman.sock.
+const DefaultEngineHost = "unix:///var/run/docker.sock"
+
+// ContainerConfig describes the go-fdo server container.
+type ContainerConfig struct {
+	// Host is the engine API endpoint, unix:///path or tcp://host:port.
+	Host string
+	// Image is a go-fdo server image whose entrypoint is the server binary.
+	Image string
+	// Name is the container name; a stale container with this name, left
+	// by a proxy that did not shut down cleanly, is replaced.
+	Name string
+	// Database is the server database path in the container; empty is
+	// /data/fdo-backend.db.
+	Database string
+	// Volumes are bind mounts, "host-path:container-path[:ro]". A volume on
+	// the database directory keeps it across restarts.
+	Volumes []string
+	// Network is the network the container joins, e.g. one shared with
+	// the rendezvous server; empty uses the engine default.
+	Network string
+	// Args are passed to the server after the ones the proxy sets.
+	Args []string
+}
+
+// Container runs the go-fdo server as a container through the Docker
+// Engine API, which Podman also serves, so the host needs neither the go-fdo
+// source nor a Go toolchain. The server port is published on 127.0.0.1
+// only; devices still reach it through the proxy.
+type Container struct {
+	cfg  ContainerConfig
+	http *http.Client
+	base string
+	id   string
+}
+
+// NewContainer creates a container backend. An empty cfg.Host uses
+// $DOCKER_HOST, then DefaultEngineHost.
+func NewContainer(cfg ContainerConfig) (*Container, error) {
+	if cfg.Image == "" {
+		return nil, errors.New("container backend: image is required")
+	}
+	if cfg.Name == "" {
+		cfg.Name = "fdo-proxy-backend"
+	}
+	if cfg.Database == "" {
+		cfg.Database = "/data/fdo-backend.db"
+	}
+	if cfg.Host == "" {
+		cfg.Host = os.Getenv("DOCKER_HOST")
+	}
+	if cfg.Host == "" {
+		cfg.Host = DefaultEngineHost
+	}
+	for _, v := range cfg.Volumes {
+		if !strings.Contains(v, ":") {
+			return nil, fmt.Errorf("container backend: volume %q: want host-path:container-path", v)
+		}
+	}
+
+	u, err := url.Parse(cfg.Host)
+	if err != nil {
+		return nil, fmt.Errorf("container backend: engine host: %w", err)
+	}
+	c := &Container{cfg: cfg}
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		c.base = "http://engine"
+		c.http = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}}
+	case "tcp", "http":
+		c.base = "http://" + u.Host
+		c.http = &http.Client{}
+	default:
+		return nil, fmt.Errorf("container backend: engine host %q: want unix:// or tcp://", cfg.Host)
+	}
+	return c, nil
+}
+
+// Start creates and starts the container, pulling the image if the engine
+// does not have it, with the server published on localhost:port.
+func (c *Container) Start(ctx context.Context, port int) error {
+	// Replace a container left behind by an earlier run
+	if err := c.remove(ctx, c.cfg.Name); err != nil {
+		return err
+	}
+
+	id, err := c.create(ctx, port)
+	if errors.Is(err, errNoImage) {
+		slog.Info("Pulling backend image", "image", c.cfg.Image)
+		if err = c.pull(ctx); err == nil {
+			id, err = c.create(ctx, port)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	c.id = id
+
+	if err := c.call(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil); err != nil {
+		return fmt.Errorf("start container: %w", err)
+	}
+	go c.followLogs(context.WithoutCancel(ctx))
+
+	slog.Info("Backend FDO container started", "id", shortID(id), "image", c.cfg.Image, "port", port, "network", c.cfg.Network)
+	return nil
+}
+
+// Stop stops and removes the container.
+func (c *Container) Stop(ctx context.Context) error {
+	if c.id == "" {
+		return nil
+	}
+	if err := c.call(ctx, http.MethodPost, "/containers/"+c.id+"/stop?t=10", nil, nil); err != nil {
+		slog.Warn("Failed to stop backend container", "id", shortID(c.id), "error", err)
+	}
+	return c.remove(ctx, c.id)
+}
+
+// errNoImage is returned by create when the engine lacks the image.
+var errNoImage = errors.New("no such image")
+
+type createRequest struct {
+	Image        string              `json:"Image"`
+	Cmd          []string            `json:"Cmd"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+	HostConfig   hostConfig          `json:"HostConfig"`
+}
+
+type hostConfig struct {
+	Binds        []string                 `json:"Binds,omitempty"`
+	NetworkMode  string                   `json:"NetworkMode,omitempty"`
+	PortBindings map[string][]portBinding `json:"PortBindings"`
+}
+
+type portBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string `json:"HostPort"`
+}
+
+func (c *Container) create(ctx context.Context, port int) (string, error) {
+	p := strconv.Itoa(port)
+	req := createRequest{
+		Image: c.cfg.Image,
+		Cmd: append([]string{
+			"-db", c.cfg.Database,
+			"-http", "0.0.0.0:" + p,
+			"-debug",
+		}, c.cfg.Args...),
+		ExposedPorts: map[string]struct{}{p + "/tcp": {}},
+		HostConfig: hostConfig{
+			Binds:        c.cfg.Volumes,
+			NetworkMode:  c.cfg.Network,
+			PortBindings: map[string][]portBinding{p + "/tcp": {{HostIP: "127.0.0.1", HostPort: p}}},
+		},
+	}
+	var out struct {
+		ID string `json:"Id"`
+	}
+	err := c.call(ctx, http.MethodPost, "/containers/create?name="+url.QueryEscape(c.cfg.Name), req, &out)
+	var apiErr *engineError
+	if errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound && strings.Contains(strings.ToLower(apiErr.message), "image") {
+		return "", errNoImage
+	}
+	if err != nil {
+		return "", fmt.Errorf("create container: %w", err)
+	}
+	return out.ID, nil
+}
+
+// Version describes the server image by its
+// org.opencontainers.image.version label, if set, and its ID, e.g.
+// v0.3.1 (sha256:1a2b3c4d5e6f).
+func (c *Container) Version(ctx context.Context) (string, error) {
+	var out struct {
+		ID     string `json:"Id"`
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+	}
+	if err := c.call(ctx, http.MethodGet, "/images/"+url.PathEscape(c.cfg.Image)+"/json", nil, &out); err != nil {
+		return "", fmt.Errorf("inspect image %s: %w", c.cfg.Image, err)
+	}
+	id := shortID(strings.TrimPrefix(out.ID, "sha256:"))
+	if v := out.Config.Labels["org.opencontainers.image.version"]; v != "" {
+		return fmt.Sprintf("%s (sha256:%s)", v, id), nil
+	}
+	return fmt.Sprintf("%s (sha256:%s)", c.cfg.Image, id), nil
+}
+
+// pull fetches the image. The engine streams progress as JSON messages and
+// reports a failed pull in them rather than in the status code.
+func (c *Container) pull(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base+"/images/create?fromImage="+url.QueryEscape(c.cfg.Image), nil)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("pull image: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pull image: %w", readEngineError(resp))
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("pull image: %w", err)
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("pull image: %s", msg.Error)
+		}
+	}
+}
+
+// remove force-removes the container named or identified by ref, if any.
+func (c *Container) remove(ctx context.Context, ref string) error {
+	err := c.call(ctx, http.MethodDelete, "/containers/"+url.PathEscape(ref)+"?force=true", nil, nil)
+	var apiErr *engineError
+	if errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("remove container: %w", err)
+	}
+	return nil
+}
+
+// followLogs copies the container output to the proxy's stdout and stderr,
+// as the process backend does, until the container exits.
+func (c *Container) followLogs(ctx context.Context) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+"/containers/"+c.id+"/logs?follow=1&stdout=1&stderr=1", nil)
+	if err != nil {
+		return
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		slog.Warn("Failed to follow backend container logs", "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slog.Warn("Failed to follow backend container logs", "error", readEngineError(resp))
+		return
+	}
+
+	// Without a TTY each chunk has an 8-byte header: stream, 3 zero
+	// bytes, big-endian length
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(resp.Body, hdr[:]); err != nil {
+			return
+		}
+		w := io.Writer(os.Stdout)
+		if hdr[0] == 2 {
+			w = os.Stderr
+		}
+		if _, err := io.CopyN(w, resp.Body, int64(binary.BigEndian.Uint32(hdr[4:]))); err != nil {
+			return
+		}
+	}
+}
+
+// engineError is a non-2xx engine API answer.
+type engineError struct {
+	status  int
+	message string
+}
+
+func (e *engineError) Error() string {
+	return fmt.Sprintf("engine status %d: %s", e.status, e.message)
+}
+
+// call sends a JSON request to the engine API and decodes a JSON answer
+// into out, if non-nil.
+func (c *Container) call(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+		body = bytes.NewReader(b)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("engine request: %w", err)
+	}
+	defer resp.Body.Close()
+	// 304 answers stopping a container that is not running
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return readEngineError(resp)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("decode engine response: %w", err)
+		}
+	}
+	return nil
+}
+
+func readEngineError(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	var msg struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(b, &msg) != nil || msg.Message == "" {
+		msg.Message = strings.TrimSpace(string(b))
+	}
+	return &engineError{status: resp.StatusCode, message: msg.Message}
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,159 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+)
+
+// InProcess serves FDO with an http.Handler in the proxy's own process, such
+// as a go-fdo server built as a library into a single binary. The proxy
+// hands it messages through RoundTrip, so there is neither a listening port
+// nor a process to manage.
+type InProcess struct {
+	handler http.Handler
+}
+
+// NewInProcess creates a backend served by h.
+func NewInProcess(h http.Handler) *InProcess {
+	return &InProcess{handler: h}
+}
+
+// Start does nothing; the handler is ready when constructed.
+func (b *InProcess) Start(ctx context.Context, port int) error { return nil }
+
+// Stop does nothing; the handler lives as long as the proxy.
+func (b *InProcess) Stop(ctx context.Context) error { return nil }
+
+// goFDOModule is the module path of go-fdo.
+const goFDOModule = "github.com/fido-device-onboard/go-fdo"
+
+// Version reports the go-fdo module version built into the binary.
+func (b *InProcess) Version(ctx context.Context) (string, error) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", errors.New("no build information in the binary")
+	}
+	for _, m := range info.Deps {
+		if m.Path == goFDOModule {
+			if m.Replace != nil {
+				m = m.Replace
+			}
+			if m.Version == "" {
+				// Replaced by a local tree
+				return m.Path, nil
+			}
+			return m.Version, nil
+		}
+	}
+	return "", fmt.Errorf("%s not built into the binary", goFDOModule)
+}
+
+// RoundTrip serves req with the handler. The response is returned once the
+// handler writes its header, or returns, and its body streams as the handler
+// writes it.
+func (b *InProcess) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Present the client request as a server would to a handler
+	in := req.Clone(req.Context())
+	if in.Body == nil {
+		in.Body = http.NoBody
+	}
+	in.RequestURI = req.URL.RequestURI()
+	in.RemoteAddr = "127.0.0.1:0"
+
+	pr, pw := io.Pipe()
+	w := &pipeWriter{
+		header: make(http.Header),
+		body:   pw,
+		resp: &http.Response{
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Body:       pr,
+			Request:    req,
+		},
+		ready: make(chan struct{}),
+	}
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				w.abort(v)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			pw.Close()
+		}()
+		b.handler.ServeHTTP(w, in)
+	}()
+
+	select {
+	case <-w.ready:
+		return w.resp, nil
+	case <-req.Context().Done():
+		pr.CloseWithError(req.Context().Err())
+		return nil, req.Context().Err()
+	}
+}
+
+// pipeWriter is the http.ResponseWriter handed to an InProcess handler.
+type pipeWriter struct {
+	header http.Header
+	body   *io.PipeWriter
+	resp   *http.Response
+	once   sync.Once
+	ready  chan struct{}
+}
+
+func (w *pipeWriter) Header() http.Header { return w.header }
+
+func (w *pipeWriter) WriteHeader(status int) {
+	w.once.Do(func() {
+		w.resp.StatusCode = status
+		w.resp.Status = strconv.Itoa(status) + " " + http.StatusText(status)
+		w.resp.Header = w.header.Clone()
+		w.resp.ContentLength = -1
+		if n, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64); err == nil {
+			w.resp.ContentLength = n
+		}
+		close(w.ready)
+	})
+}
+
+func (w *pipeWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// abort ends a response whose handler panicked with v, as net/http does for
+// its own handlers: the proxy gets a 500 if nothing was sent yet, and
+// otherwise a body failing with an error rather than a truncated one
+// passing for complete.
+func (w *pipeWriter) abort(v any) {
+	err := fmt.Errorf("in-process FDO handler panicked: %v", v)
+	if v != http.ErrAbortHandler {
+		slog.Error("In-process FDO handler panicked", "panic", v, "stack", string(debug.Stack()))
+	}
+	sent := true
+	w.once.Do(func() {
+		sent = false
+		w.resp.StatusCode = http.StatusInternalServerError
+		w.resp.Status = "500 " + http.StatusText(http.StatusInternalServerError)
+		w.resp.Header = http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+		w.resp.ContentLength = -1
+		close(w.ready)
+	})
+	if sent {
+		w.body.CloseWithError(err)
+		return
+	}
+	w.body.Close()
+}
+
+// Flush is a no-op: every Write already reaches the reader.
+func (w *pipeWriter) Flush() {}
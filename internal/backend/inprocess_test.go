@@ -0,0 +1,59 @@
+package backend
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInProcessRoundTrip(t *testing.T) {
+	b := NewInProcess(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Message-Type", "11")
+		w.Header().Set("Content-Length", "7")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, string(body)+r.URL.Path[len(r.URL.Path)-3:])
+	}))
+	req := httptest.NewRequest(http.MethodPost, "http://backend/fdo/101/msg/10", strings.NewReader("abcd"))
+	req.RequestURI = ""
+	resp, err := b.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusCreated || resp.Header.Get("Message-Type") != "11" ||
+		resp.ContentLength != 7 || string(body) != "abcd/10" {
+		t.Errorf("response = %d %v %d %q, %v", resp.StatusCode, resp.Header, resp.ContentLength, body, err)
+	}
+}
+
+func TestInProcessPanic(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+		bodyErr bool
+	}{
+		{"before header", func(w http.ResponseWriter, r *http.Request) { panic("boom") }, http.StatusInternalServerError, false},
+		{"after header", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "partial")
+			panic("boom")
+		}, http.StatusOK, true},
+		{"abort", func(w http.ResponseWriter, r *http.Request) { panic(http.ErrAbortHandler) }, http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://backend/fdo/101/msg/10", nil)
+			resp, err := NewInProcess(tt.handler).RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip: %v", err)
+			}
+			_, err = io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status || (err != nil) != tt.bodyErr {
+				t.Errorf("status %d, body error %v; want %d, error %v", resp.StatusCode, err, tt.status, tt.bodyErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// Package backup snapshots the proxy's local state (onboarding history,
+// the passport service outbox, device state files, audit trails and anchor
+// records) into a gzipped tarball, and restores it, so replacing a gateway
+// does not lose onboarding history.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// manifestName is the archive entry describing the others. It is written
+// last, once their digests are known.
+const manifestName = "manifest.json"
+
+// File is a state file or directory to back up.
+type File struct {
+	// Name identifies the file in the archive, independent of where it
+	// lives, so a backup can be restored to other paths.
+	Name string
+	Path string
+	// Lines marks an append-only JSON Lines file. It is copied up to its
+	// last complete line, so an append in progress is not caught half way.
+	Lines bool
+	// Dir backs up the regular files directly in Path as Name/<file>.
+	Dir bool
+}
+
+// Entry describes one archived file.
+type Entry struct {
+	Name string `json:"name"`
+	// Path is where the file was backed up from, or restored to.
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest describes a backup.
+type Manifest struct {
+	// Version is the build of the proxy that took the backup.
+	Version   string    `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Files     []Entry   `json:"files"`
+}
+
+// Write archives files to w as a gzipped tarball with a manifest. Files
+// and directories that do not exist yet are left out. The state files
+// other than JSON Lines files are replaced atomically when they change, so
+// each is read as one consistent version.
+func Write(w io.Writer, files []File, version string) (*Manifest, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	m := &Manifest{Version: version, CreatedAt: time.Now().UTC(), Files: []Entry{}}
+	add := func(name, p string, lines bool) error {
+		b, err := os.ReadFile(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if lines {
+			b = b[:bytes.LastIndexByte(b, '\n')+1]
+		}
+		hdr := &tar.Header{Name: name, Mode: 0o600, Size: int64(len(b)), ModTime: m.CreatedAt, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(b); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		m.Files = append(m.Files, Entry{Name: name, Path: p, Size: int64(len(b)), SHA256: hex.EncodeToString(sum[:])})
+		return nil
+	}
+
+	for _, f := range files {
+		if !f.Dir {
+			if err := add(f.Name, f.Path, f.Lines); err != nil {
+				return nil, fmt.Errorf("back up %s: %w", f.Name, err)
+			}
+			continue
+		}
+		ents, err := os.ReadDir(f.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("back up %s: %w", f.Name, err)
+		}
+		for _, e := range ents {
+			// Temporary files are atomic writes still in progress
+			if !e.Type().IsRegular() || strings.HasSuffix(e.Name(), ".tmp") {
+				continue
+			}
+			if err := add(f.Name+"/"+e.Name(), filepath.Join(f.Path, e.Name()), f.Lines); err != nil {
+				return nil, fmt.Errorf("back up %s: %w", f.Name, err)
+			}
+		}
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: manifestName, Mode: 0o600, Size: int64(len(b)), ModTime: m.CreatedAt, Typeflag: tar.TypeReg}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Result is the outcome of a restore.
+type Result struct {
+	Manifest *Manifest `json:"manifest"`
+	// Restored lists the files written, at their new paths.
+	Restored []Entry `json:"restored"`
+	// Skipped lists the archived files without a destination under the
+	// current configuration.
+	Skipped []string `json:"skipped"`
+}
+
+// staged is a restored file waiting to be moved into place.
+type staged struct {
+	Entry
+	tmp string
+}
+
+// Restore extracts a backup written by Write into the paths of files,
+// matched by name. Every file is checked against the manifest before any
+// is moved into place. Existing files are only replaced with force; the
+// proxy must not be running.
+func Restore(r io.Reader, files []File, force bool) (*Result, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("read backup: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	var (
+		m       *Manifest
+		pending []staged
+		skipped []string
+	)
+	cleanup := func() {
+		for _, s := range pending {
+			os.Remove(s.tmp)
+		}
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("read backup: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if hdr.Name == manifestName {
+			m = new(Manifest)
+			if err := json.NewDecoder(tr).Decode(m); err != nil {
+				cleanup()
+				return nil, fmt.Errorf("parse manifest: %w", err)
+			}
+			continue
+		}
+		dest, ok := destination(files, hdr.Name)
+		if !ok {
+			skipped = append(skipped, hdr.Name)
+			continue
+		}
+		s, err := stage(tr, hdr.Name, dest, force)
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("restore %s: %w", hdr.Name, err)
+		}
+		pending = append(pending, s)
+	}
+	if m == nil {
+		cleanup()
+		return nil, fmt.Errorf("read backup: no %s", manifestName)
+	}
+
+	want := make(map[string]Entry, len(m.Files))
+	for _, e := range m.Files {
+		want[e.Name] = e
+	}
+	seen := make(map[string]bool, len(m.Files))
+	for _, s := range pending {
+		if e, ok := want[s.Name]; !ok || e.SHA256 != s.SHA256 || e.Size != s.Size {
+			cleanup()
+			return nil, fmt.Errorf("restore %s: does not match the manifest", s.Name)
+		}
+		seen[s.Name] = true
+	}
+	for _, name := range skipped {
+		seen[name] = true
+	}
+	for _, e := range m.Files {
+		if !seen[e.Name] {
+			cleanup()
+			return nil, fmt.Errorf("read backup: %s missing", e.Name)
+		}
+	}
+
+	res := &Result{Manifest: m, Restored: []Entry{}, Skipped: skipped}
+	for i, s := range pending {
+		if err := os.Rename(s.tmp, s.Path); err != nil {
+			for _, rest := range pending[i:] {
+				os.Remove(rest.tmp)
+			}
+			return res, fmt.Errorf("restore %s: %w", s.Name, err)
+		}
+		res.Restored = append(res.Restored, s.Entry)
+	}
+	sort.Strings(res.Skipped)
+	return res, nil
+}
+
+// destination returns where the archive entry name is restored to.
+func destination(files []File, name string) (string, bool) {
+	for _, f := range files {
+		if f.Path == "" {
+			continue
+		}
+		if !f.Dir {
+			if f.Name == name {
+				return f.Path, true
+			}
+			continue
+		}
+		base, ok := strings.CutPrefix(name, f.Name+"/")
+		// Only files directly in the directory, never outside it
+		if ok && base == path.Base(base) && base != "." && base != ".." && base != "/" {
+			return filepath.Join(f.Path, base), true
+		}
+	}
+	return "", false
+}
+
+// stage copies an archive entry next to dest and digests it.
+func stage(r io.Reader, name, dest string, force bool) (staged, error) {
+	if _, err := os.Stat(dest); err == nil && !force {
+		return staged{}, fmt.Errorf("%s exists", dest)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
+		return staged{}, err
+	}
+	tmp := dest + ".restore.tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return staged{}, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return staged{}, err
+	}
+	return staged{Entry: Entry{Name: name, Path: dest, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, tmp: tmp}, nil
+}
@@ -0,0 +1,394 @@
+// Package ban keeps the client addresses, serial numbers and GUIDs the
+// proxy refuses to start sessions for, each until its ban expires or is
+// lifted. Operators ban through the admin API; the penalty rules ban
+// devices that keep failing on their own.
+package ban
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+	"github.com/fdo-server-wrapper/internal/redis"
+)
+
+var storeErrors = metrics.Default.NewCounterVec(
+	"fdo_proxy_ban_errors_total",
+	"Ban lookups and changes that could not reach Redis; lookups that fail let the client through.")
+
+// Kinds of ban.
+const (
+	KindIP     = "ip"
+	KindSerial = "serial"
+	KindGUID   = "guid"
+)
+
+// Sources of a ban.
+const (
+	// SourceAdmin is a ban made by an operator.
+	SourceAdmin = "admin"
+	// SourcePenalty is a ban earned by repeated failed onboardings.
+	SourcePenalty = "penalty"
+)
+
+// Entry is one ban.
+type Entry struct {
+	Kind   string    `json:"kind"`
+	Value  string    `json:"value"`
+	Reason string    `json:"reason,omitempty"`
+	Source string    `json:"source"`
+	Since  time.Time `json:"since"`
+	// Until is when the ban expires, zero for a ban that lasts until it is
+	// lifted.
+	Until time.Time `json:"until,omitzero"`
+}
+
+// Key names the banned client or device as the proxy's rate limits do,
+// e.g. ip:203.0.113.7 or guid:<guid>.
+func (e Entry) Key() string {
+	return e.Kind + ":" + e.Value
+}
+
+// Active reports whether e is in force at now.
+func (e Entry) Active(now time.Time) bool {
+	return e.Until.IsZero() || now.Before(e.Until)
+}
+
+// ParseKey splits a key into its kind and value, normalizing IP addresses.
+func ParseKey(key string) (kind, value string, err error) {
+	kind, value, _ = strings.Cut(key, ":")
+	value, err = Normalize(kind, value)
+	return kind, value, err
+}
+
+// Normalize checks value is of kind and returns it in the form keys use.
+func Normalize(kind, value string) (string, error) {
+	if value == "" {
+		return "", fmt.Errorf("empty %s", kind)
+	}
+	switch kind {
+	case KindIP:
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid IP address %q", value)
+		}
+		return addr.Unmap().String(), nil
+	case KindSerial, KindGUID:
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown kind %q: want ip, serial or guid", kind)
+}
+
+// store keeps the entries.
+type store interface {
+	// put stores e, unless e is automatic and an operator's ban of the same
+	// key is in force; it reports whether it did.
+	put(ctx context.Context, e Entry) (bool, error)
+	// get returns the ban of key in force, if any.
+	get(ctx context.Context, key string) (Entry, bool, error)
+	// remove lifts the ban of key, reporting whether there was one.
+	remove(ctx context.Context, key string) (bool, error)
+	// all returns the bans in force.
+	all(ctx context.Context) ([]Entry, error)
+}
+
+// List is the set of bans.
+type List struct {
+	st store
+}
+
+// Open loads the bans from path, which need not exist yet, and keeps them
+// there. An empty path keeps them in memory only.
+func Open(path string) (*List, error) {
+	m := &memory{path: path, entries: make(map[string]Entry)}
+	if path == "" {
+		return &List{st: m}, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &List{st: m}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read ban list: %w", err)
+	}
+	var entries []Entry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("parse ban list: %w", err)
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if e.Active(now) {
+			m.entries[e.Key()] = e
+		}
+	}
+	return &List{st: m}, nil
+}
+
+// OpenRedis returns a list kept in c, shared by every proxy using the
+// server.
+func OpenRedis(c *redis.Client) *List {
+	return &List{st: &redisStore{c: c}}
+}
+
+// Add bans e.Key() until e.Until, replacing a ban of the same key, except
+// that an automatic ban does not replace an operator's. It reports whether
+// e was stored.
+func (l *List) Add(ctx context.Context, e Entry) (bool, error) {
+	v, err := Normalize(e.Kind, e.Value)
+	if err != nil {
+		return false, err
+	}
+	e.Value = v
+	if e.Source == "" {
+		e.Source = SourceAdmin
+	}
+	if e.Since.IsZero() {
+		e.Since = time.Now().UTC()
+	}
+	ok, err := l.st.put(ctx, e)
+	if err != nil {
+		storeErrors.Inc()
+	}
+	return ok, err
+}
+
+// Check returns the first ban in force of keys, if any. Should the bans
+// be out of reach the client is let through.
+func (l *List) Check(ctx context.Context, keys ...string) (Entry, bool) {
+	for _, key := range keys {
+		e, ok, err := l.st.get(ctx, key)
+		if err != nil {
+			storeErrors.Inc()
+			slog.Warn("Could not look up ban", "key", key, "error", err)
+			continue
+		}
+		if ok {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Get returns the ban of key in force, if any.
+func (l *List) Get(ctx context.Context, key string) (Entry, bool, error) {
+	return l.st.get(ctx, key)
+}
+
+// Lift removes the ban of key. It reports false if there was none.
+func (l *List) Lift(ctx context.Context, key string) (bool, error) {
+	ok, err := l.st.remove(ctx, key)
+	if err != nil {
+		storeErrors.Inc()
+	}
+	return ok, err
+}
+
+// All returns the bans in force sorted by key.
+func (l *List) All(ctx context.Context) ([]Entry, error) {
+	out, err := l.st.all(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key() < out[j].Key() })
+	return out, nil
+}
+
+// memory keeps the entries in a map, optionally saved to a JSON file.
+type memory struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+func (m *memory) put(_ context.Context, e Entry) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cur, ok := m.entries[e.Key()]; ok && cur.Source == SourceAdmin && e.Source != SourceAdmin && cur.Active(time.Now()) {
+		return false, nil
+	}
+	m.entries[e.Key()] = e
+	return true, m.saveLocked()
+}
+
+func (m *memory) get(_ context.Context, key string) (Entry, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok || !e.Active(time.Now()) {
+		return Entry{}, false, nil
+	}
+	return e, true, nil
+}
+
+func (m *memory) remove(_ context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return false, nil
+	}
+	delete(m.entries, key)
+	return e.Active(time.Now()), m.saveLocked()
+}
+
+func (m *memory) all(context.Context) ([]Entry, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Entry, 0, len(m.entries))
+	for _, e := range m.entries {
+		if e.Active(now) {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// saveLocked drops expired bans and atomically rewrites the file. The
+// caller must hold m.mu.
+func (m *memory) saveLocked() error {
+	now := time.Now()
+	entries := make([]Entry, 0, len(m.entries))
+	for key, e := range m.entries {
+		if !e.Active(now) {
+			delete(m.entries, key)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if m.path == "" {
+		return nil
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key() < entries[j].Key() })
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("write ban list: %w", err)
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fmt.Errorf("replace ban list: %w", err)
+	}
+	return nil
+}
+
+// keyPrefix namespaces the ban keys in a Redis database the proxy may
+// share.
+const keyPrefix = "fdo-proxy:ban:"
+
+// putScript stores a ban in hash KEYS[1] from ARGV kind, value, reason,
+// source, since and until (Unix milliseconds, 0 for none), expiring it
+// after ARGV[7] milliseconds if positive, unless it is automatic and an
+// operator's ban is stored. It returns 1 if it stored the ban.
+var putScript = redis.NewScript(`
+if ARGV[4] ~= 'admin' and redis.call('HGET', KEYS[1], 'source') == 'admin' then
+  return 0
+end
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[1], 'kind', ARGV[1], 'value', ARGV[2], 'reason', ARGV[3], 'source', ARGV[4], 'since', ARGV[5], 'until', ARGV[6])
+if tonumber(ARGV[7]) > 0 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[7])
+end
+return 1
+`)
+
+// redisStore keeps each ban in a hash of its own, expiring with the ban.
+type redisStore struct {
+	c *redis.Client
+}
+
+func (r *redisStore) put(ctx context.Context, e Entry) (bool, error) {
+	var until, ttl int64
+	if !e.Until.IsZero() {
+		until = e.Until.UnixMilli()
+		if ttl = time.Until(e.Until).Milliseconds(); ttl <= 0 {
+			return false, nil
+		}
+	}
+	v, err := putScript.Run(ctx, r.c, []string{keyPrefix + e.Key()},
+		e.Kind, e.Value, e.Reason, e.Source, e.Since.UnixMilli(), until, ttl)
+	if err != nil {
+		return false, err
+	}
+	n, _ := v.(int64)
+	return n == 1, nil
+}
+
+func (r *redisStore) get(ctx context.Context, key string) (Entry, bool, error) {
+	v, err := r.c.Do(ctx, "HMGET", keyPrefix+key, "kind", "value", "reason", "source", "since", "until")
+	if err != nil {
+		return Entry{}, false, err
+	}
+	arr, ok := v.([]any)
+	if !ok || len(arr) != 6 {
+		return Entry{}, false, errors.New("unexpected reply to ban lookup")
+	}
+	if arr[0] == nil {
+		return Entry{}, false, nil
+	}
+	field := func(i int) string {
+		s, _ := arr[i].(string)
+		return s
+	}
+	millis := func(i int) time.Time {
+		n, _ := strconv.ParseInt(field(i), 10, 64)
+		if n <= 0 {
+			return time.Time{}
+		}
+		return time.UnixMilli(n).UTC()
+	}
+	e := Entry{Kind: field(0), Value: field(1), Reason: field(2), Source: field(3), Since: millis(4), Until: millis(5)}
+	return e, e.Active(time.Now()), nil
+}
+
+func (r *redisStore) remove(ctx context.Context, key string) (bool, error) {
+	v, err := r.c.Do(ctx, "DEL", keyPrefix+key)
+	if err != nil {
+		return false, err
+	}
+	n, _ := v.(int64)
+	return n > 0, nil
+}
+
+func (r *redisStore) all(ctx context.Context) ([]Entry, error) {
+	var out []Entry
+	cursor := "0"
+	for {
+		v, err := r.c.Do(ctx, "SCAN", cursor, "MATCH", keyPrefix+"*", "COUNT", 500)
+		if err != nil {
+			return nil, err
+		}
+		arr, ok := v.([]any)
+		if !ok || len(arr) != 2 {
+			return nil, errors.New("unexpected reply to SCAN")
+		}
+		cursor, _ = arr[0].(string)
+		keys, _ := arr[1].([]any)
+		for _, k := range keys {
+			name, _ := k.(string)
+			e, ok, err := r.get(ctx, strings.TrimPrefix(name, keyPrefix))
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				out = append(out, e)
+			}
+		}
+		if cursor == "0" {
+			return out, nil
+		}
+	}
+}
@@ -0,0 +1,377 @@
+// Package callback calls the backends of owners (tenants) when one of
+// their devices completes onboarding, for customers whose system of
+// record is not the passport service. Each callback names the owners it
+// serves, and its URL, headers and body are templates over the onboarding.
+package callback
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+const (
+	// attempts is how often a callback is tried before it is given up.
+	attempts = 3
+	// retryDelay is the wait before the second attempt, doubled for each
+	// one after.
+	retryDelay = time.Second
+)
+
+var calls = metrics.Default.NewCounterVec(
+	"fdo_proxy_callbacks_total",
+	"Onboarding completion callbacks by callback and outcome (success, retry, error).",
+	"callback", "outcome")
+
+// Callback is one entry of a callbacks file.
+type Callback struct {
+	// Name identifies the callback in logs and metrics.
+	Name string `json:"name"`
+	// Owners are the owners whose devices it is called for; empty means
+	// every owner.
+	Owners []string `json:"owners,omitempty"`
+	// URL is the URL to call, a template.
+	URL string `json:"url"`
+	// Method is POST, PUT or PATCH (default POST).
+	Method string `json:"method,omitempty"`
+	// Headers are request headers, each value a template.
+	Headers map[string]string `json:"headers,omitempty"`
+	// ContentType defaults to application/json.
+	ContentType string `json:"content_type,omitempty"`
+	// Body is the request body, a template; empty sends DefaultBody.
+	Body string `json:"body,omitempty"`
+	// Timeout bounds each attempt, e.g. "5s" (default 10s).
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// Data is what the templates render.
+type Data struct {
+	GUID      string
+	OwnerID   string
+	Serial    string
+	ProductID string
+	Time      time.Time
+	RequestID string
+	Tags      []string
+	// VoucherHash is the hex SHA-384 of the ownership voucher header, when
+	// known.
+	VoucherHash string
+	// PassportSent is whether the passport service recorded the
+	// commissioning passport.
+	PassportSent bool
+	// Country is where the device onboarded from, when a GeoIP database
+	// knows it.
+	Country string
+}
+
+// DefaultBody is the body of a callback without one.
+const DefaultBody = `{"event": "onboarded", "guid": {{json .GUID}}, "owner_id": {{json .OwnerID}}, "serial": {{json .Serial}}, "product_id": {{json .ProductID}}, "time": {{json .Time}}, "request_id": {{json .RequestID}}, "tags": {{json .Tags}}, "voucher_hash": {{json .VoucherHash}}}`
+
+var funcs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"query": url.QueryEscape,
+	"path":  url.PathEscape,
+	"join":  strings.Join,
+	"env":   os.Getenv,
+}
+
+// sample is rendered by New to find template errors at startup.
+var sample = Data{
+	GUID:      "00000000-0000-0000-0000-000000000000",
+	OwnerID:   "owner",
+	Serial:    "serial",
+	ProductID: "product",
+	Time:      time.Unix(0, 0).UTC(),
+	RequestID: "request",
+	Tags:      []string{"tag"},
+}
+
+// target is a parsed Callback.
+type target struct {
+	name        string
+	owners      []string
+	method      string
+	url         *template.Template
+	headers     map[string]*template.Template
+	contentType string
+	body        *template.Template
+	http        *http.Client
+}
+
+// Callbacks calls the callbacks of each onboarded device's owner. It
+// implements events.Sink.
+type Callbacks struct {
+	targets []*target
+}
+
+// Load reads a callbacks file, a JSON array of Callback such as
+//
+//	[{"name": "tenant-a-erp", "owners": ["tenant-a"],
+//	  "url": "https://erp.tenant-a.example.com/devices/{{.GUID}}/onboarded",
+//	  "headers": {"Authorization": "Bearer {{env \"TENANT_A_TOKEN\"}}"},
+//	  "body": "{\"device\": {{json .GUID}}, \"serial\": {{json .Serial}}}"}]
+//
+// and checks that every template renders.
+func Load(path string) (*Callbacks, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read callbacks: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var list []Callback
+	if err := dec.Decode(&list); err != nil {
+		return nil, fmt.Errorf("parse callbacks: %w", err)
+	}
+	return New(list)
+}
+
+// New checks list and returns its Callbacks.
+func New(list []Callback) (*Callbacks, error) {
+	c := &Callbacks{}
+	seen := make(map[string]bool)
+	for i, cb := range list {
+		if cb.Name == "" {
+			return nil, fmt.Errorf("callback %d: name is required", i)
+		}
+		if seen[cb.Name] {
+			return nil, fmt.Errorf("callback %s: name used twice", cb.Name)
+		}
+		seen[cb.Name] = true
+		t, err := parse(cb)
+		if err != nil {
+			return nil, fmt.Errorf("callback %s: %w", cb.Name, err)
+		}
+		c.targets = append(c.targets, t)
+	}
+	return c, nil
+}
+
+// parse turns cb into a target, rendering its templates once.
+func parse(cb Callback) (*target, error) {
+	t := &target{
+		name:        cb.Name,
+		owners:      cb.Owners,
+		method:      cb.Method,
+		contentType: cb.ContentType,
+		headers:     make(map[string]*template.Template, len(cb.Headers)),
+	}
+	switch t.method {
+	case "":
+		t.method = http.MethodPost
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return nil, fmt.Errorf("invalid method %q: want POST, PUT or PATCH", cb.Method)
+	}
+	if t.contentType == "" {
+		t.contentType = "application/json"
+	}
+	timeout := 10 * time.Second
+	if cb.Timeout != "" {
+		d, err := time.ParseDuration(cb.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", cb.Timeout)
+		}
+		timeout = d
+	}
+	t.http = &http.Client{Timeout: timeout}
+
+	var err error
+	if cb.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	if t.url, err = newTemplate("url", cb.URL); err != nil {
+		return nil, err
+	}
+	body := cb.Body
+	if body == "" {
+		body = DefaultBody
+	}
+	if t.body, err = newTemplate("body", body); err != nil {
+		return nil, err
+	}
+	for name, v := range cb.Headers {
+		if t.headers[name], err = newTemplate("header "+name, v); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := t.request(context.Background(), &sample); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func newTemplate(name, src string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return t, nil
+}
+
+func render(t *template.Template, d *Data) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, d); err != nil {
+		return "", fmt.Errorf("%s: %w", t.Name(), err)
+	}
+	return b.String(), nil
+}
+
+// request renders the request for d.
+func (t *target) request(ctx context.Context, d *Data) (*http.Request, error) {
+	rawURL, err := render(t.url, d)
+	if err != nil {
+		return nil, err
+	}
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url %q is not an http or https URL", rawURL)
+	}
+	body, err := render(t.body, d)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, t.method, rawURL, strings.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", t.contentType)
+	for name, tmpl := range t.headers {
+		v, err := render(tmpl, d)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(name, v)
+	}
+	correlation.Inject(ctx, req.Header)
+	return req, nil
+}
+
+// Names returns the names of the callbacks, in file order.
+func (c *Callbacks) Names() []string {
+	names := make([]string, len(c.targets))
+	for i, t := range c.targets {
+		names[i] = t.name
+	}
+	return names
+}
+
+// Name implements events.Sink.
+func (c *Callbacks) Name() string { return "callbacks" }
+
+// Publish implements events.Sink, calling every callback of the owner of
+// a commissioned device at once. It returns the first error.
+func (c *Callbacks) Publish(ctx context.Context, ev *events.Event) error {
+	if ev.Type != events.Commissioned {
+		return nil
+	}
+	d := &Data{
+		GUID:         ev.GUID,
+		OwnerID:      ev.OwnerID,
+		Time:         ev.Time.UTC(),
+		RequestID:    ev.RequestID,
+		Tags:         ev.Tags,
+		ProductID:    ev.ProductID,
+		PassportSent: ev.PassportSent && ev.PassportErr == nil,
+	}
+	if ev.Session != nil {
+		d.Serial = ev.Session.Serial
+		d.VoucherHash = ev.Session.VoucherHash
+		if d.ProductID == "" {
+			d.ProductID = ev.Session.ProductID
+		}
+	}
+	if ev.Location != nil {
+		d.Country = ev.Location.Country
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+	for _, t := range c.targets {
+		if len(t.owners) > 0 && !slices.Contains(t.owners, ev.OwnerID) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := t.call(ctx, d)
+			if err == nil {
+				return
+			}
+			slog.Warn("Onboarding callback failed", "callback", t.name, "guid", ev.GUID, "owner_id", ev.OwnerID, "request_id", ev.RequestID, "error", err)
+			mu.Lock()
+			if first == nil {
+				first = fmt.Errorf("callback %s: %w", t.name, err)
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return first
+}
+
+// call makes the request for d, retrying network errors, 429 and 5xx.
+func (t *target) call(ctx context.Context, d *Data) error {
+	delay := retryDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		if retry, err = t.try(ctx, d); err == nil {
+			calls.Inc(t.name, "success")
+			return nil
+		}
+		if !retry || attempt == attempts {
+			break
+		}
+		calls.Inc(t.name, "retry")
+		select {
+		case <-ctx.Done():
+			calls.Inc(t.name, "error")
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	calls.Inc(t.name, "error")
+	return err
+}
+
+// try makes one attempt, reporting whether a failure is worth retrying.
+func (t *target) try(ctx context.Context, d *Data) (bool, error) {
+	req, err := t.request(ctx, d)
+	if err != nil {
+		return false, err
+	}
+	resp, err := t.http.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		return false, nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(b))
+}
@@ -0,0 +1,448 @@
+// Package cbor is a small RFC 8949 decoder covering what the proxy needs to
+// inspect FDO messages: generic decoding into Go values plus access to the
+// raw encoding of array elements, which FDO hashes and signs over. A matching
+// encoder builds the few messages the proxy sends itself.
+//
+// Decoded values use these Go types:
+//
+//	unsigned integer   uint64
+//	negative integer   int64 (values below -2^63 are rejected)
+//	byte string        []byte
+//	text string        string
+//	array              []any
+//	map                map[any]any (byte string keys become string)
+//	tag                Tag
+//	false/true         bool
+//	null, undefined    nil
+//	float              float64
+package cbor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// maxDepth bounds nesting so hostile input can't exhaust the stack.
+const maxDepth = 64
+
+var (
+	// ErrTruncated is returned when input ends in the middle of an item.
+	ErrTruncated = errors.New("cbor: truncated input")
+	// ErrUnsupported is returned for encodings the decoder does not handle.
+	ErrUnsupported = errors.New("cbor: unsupported encoding")
+)
+
+// Tag is a tagged data item.
+type Tag struct {
+	Number  uint64
+	Content any
+}
+
+const (
+	majorUint   = 0
+	majorNegInt = 1
+	majorBytes  = 2
+	majorText   = 3
+	majorArray  = 4
+	majorMap    = 5
+	majorTag    = 6
+	majorSimple = 7
+
+	indefinite = 31
+	breakByte  = 0xff
+)
+
+// Decode decodes exactly one item from b. Trailing bytes are an error.
+func Decode(b []byte) (any, error) {
+	v, rest, err := decode(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("cbor: %d trailing bytes", len(rest))
+	}
+	return v, nil
+}
+
+// Next splits the first complete item off b, returning its raw encoding and
+// the remaining bytes.
+func Next(b []byte) (item, rest []byte, err error) {
+	_, rest, err = decode(b, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b[:len(b)-len(rest)], rest, nil
+}
+
+// Head decodes the head of the first item in b: its major type and its
+// argument (value, length or tag number; -1 for indefinite length), and
+// returns the bytes after the head. It lets callers walk into an item they
+// only have a prefix of.
+func Head(b []byte) (major byte, arg int64, rest []byte, err error) {
+	major, arg, n, err := head(b)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return major, arg, b[n:], nil
+}
+
+// ArrayRaw decodes a definite- or indefinite-length array header (optionally
+// wrapped in tags) and returns the raw encoding of each element.
+func ArrayRaw(b []byte) ([][]byte, error) {
+	b, err := skipTags(b)
+	if err != nil {
+		return nil, err
+	}
+	major, arg, n, err := head(b)
+	if err != nil {
+		return nil, err
+	}
+	if major != majorArray {
+		return nil, fmt.Errorf("cbor: expected array, got major type %d", major)
+	}
+	b = b[n:]
+
+	var items [][]byte
+	if arg == -1 {
+		for {
+			if len(b) == 0 {
+				return nil, ErrTruncated
+			}
+			if b[0] == breakByte {
+				b = b[1:]
+				break
+			}
+			item, rest, err := Next(b)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			b = rest
+		}
+	} else {
+		if uint64(arg) > uint64(len(b)) {
+			return nil, ErrTruncated
+		}
+		items = make([][]byte, 0, arg)
+		for i := int64(0); i < arg; i++ {
+			item, rest, err := Next(b)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			b = rest
+		}
+	}
+	if len(b) != 0 {
+		return nil, fmt.Errorf("cbor: %d trailing bytes", len(b))
+	}
+	return items, nil
+}
+
+// Bytes decodes b as a byte string, returning its contents. It is used to
+// unwrap FDO's "bstr .cbor" fields.
+func Bytes(b []byte) ([]byte, error) {
+	v, err := Decode(b)
+	if err != nil {
+		return nil, err
+	}
+	bs, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("cbor: expected byte string, got %T", v)
+	}
+	return bs, nil
+}
+
+// skipTags strips any leading tag heads from b.
+func skipTags(b []byte) ([]byte, error) {
+	for {
+		major, _, n, err := head(b)
+		if err != nil {
+			return nil, err
+		}
+		if major != majorTag {
+			return b, nil
+		}
+		b = b[n:]
+	}
+}
+
+// head parses an item head, returning the major type, argument (-1 for
+// indefinite length) and the number of bytes consumed.
+func head(b []byte) (major byte, arg int64, n int, err error) {
+	if len(b) == 0 {
+		return 0, 0, 0, ErrTruncated
+	}
+	major = b[0] >> 5
+	info := b[0] & 0x1f
+
+	var u uint64
+	switch {
+	case info < 24:
+		return major, int64(info), 1, nil
+	case info == 24:
+		if len(b) < 2 {
+			return 0, 0, 0, ErrTruncated
+		}
+		u, n = uint64(b[1]), 2
+	case info == 25:
+		if len(b) < 3 {
+			return 0, 0, 0, ErrTruncated
+		}
+		u, n = uint64(binary.BigEndian.Uint16(b[1:])), 3
+	case info == 26:
+		if len(b) < 5 {
+			return 0, 0, 0, ErrTruncated
+		}
+		u, n = uint64(binary.BigEndian.Uint32(b[1:])), 5
+	case info == 27:
+		if len(b) < 9 {
+			return 0, 0, 0, ErrTruncated
+		}
+		u, n = binary.BigEndian.Uint64(b[1:]), 9
+	case info == indefinite:
+		if major == majorUint || major == majorNegInt || major == majorTag {
+			return 0, 0, 0, ErrUnsupported
+		}
+		return major, -1, 1, nil
+	default:
+		return 0, 0, 0, ErrUnsupported
+	}
+
+	// Floats carry raw bits in the argument; everything else must fit int64
+	if major != majorSimple && u > math.MaxInt64 {
+		if major == majorUint {
+			// decode converts back to uint64, preserving the full range
+			return major, int64(u), n, nil
+		}
+		return 0, 0, 0, ErrUnsupported
+	}
+	return major, int64(u), n, nil
+}
+
+func decode(b []byte, depth int) (any, []byte, error) {
+	if depth > maxDepth {
+		return nil, nil, errors.New("cbor: nesting too deep")
+	}
+	major, arg, n, err := head(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := b[0] & 0x1f
+	b = b[n:]
+
+	switch major {
+	case majorUint:
+		return uint64(arg), b, nil
+	case majorNegInt:
+		return -1 - arg, b, nil
+	case majorBytes, majorText:
+		var data []byte
+		if arg == -1 {
+			data, b, err = decodeChunks(b, major)
+			if err != nil {
+				return nil, nil, err
+			}
+		} else {
+			if uint64(arg) > uint64(len(b)) {
+				return nil, nil, ErrTruncated
+			}
+			data, b = append([]byte(nil), b[:arg]...), b[arg:]
+		}
+		if major == majorText {
+			return string(data), b, nil
+		}
+		return data, b, nil
+	case majorArray:
+		var arr []any
+		for i := int64(0); arg == -1 || i < arg; i++ {
+			if arg == -1 {
+				if len(b) == 0 {
+					return nil, nil, ErrTruncated
+				}
+				if b[0] == breakByte {
+					return arr, b[1:], nil
+				}
+			}
+			var v any
+			v, b, err = decode(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, v)
+		}
+		if arr == nil {
+			arr = []any{}
+		}
+		return arr, b, nil
+	case majorMap:
+		m := make(map[any]any)
+		for i := int64(0); arg == -1 || i < arg; i++ {
+			if arg == -1 {
+				if len(b) == 0 {
+					return nil, nil, ErrTruncated
+				}
+				if b[0] == breakByte {
+					return m, b[1:], nil
+				}
+			}
+			var k, v any
+			k, b, err = decode(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			v, b, err = decode(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch kk := k.(type) {
+			case []byte:
+				k = string(kk)
+			case []any, map[any]any, Tag:
+				return nil, nil, fmt.Errorf("%w: non-scalar map key", ErrUnsupported)
+			}
+			m[k] = v
+		}
+		return m, b, nil
+	case majorTag:
+		var content any
+		content, b, err = decode(b, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return Tag{Number: uint64(arg), Content: content}, b, nil
+	default: // majorSimple
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		case 25:
+			return halfToFloat(uint16(arg)), b, nil
+		case 26:
+			return float64(math.Float32frombits(uint32(arg))), b, nil
+		case 27:
+			return math.Float64frombits(uint64(arg)), b, nil
+		default:
+			if info < 24 || info == 24 {
+				// Unassigned simple values decode as their number
+				return uint64(arg), b, nil
+			}
+			return nil, nil, ErrUnsupported
+		}
+	}
+}
+
+// decodeChunks reassembles an indefinite-length byte or text string.
+func decodeChunks(b []byte, major byte) ([]byte, []byte, error) {
+	var out []byte
+	for {
+		if len(b) == 0 {
+			return nil, nil, ErrTruncated
+		}
+		if b[0] == breakByte {
+			return out, b[1:], nil
+		}
+		m, arg, n, err := head(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		if m != major || arg == -1 {
+			return nil, nil, errors.New("cbor: malformed indefinite-length string")
+		}
+		b = b[n:]
+		if uint64(arg) > uint64(len(b)) {
+			return nil, nil, ErrTruncated
+		}
+		out = append(out, b[:arg]...)
+		b = b[arg:]
+	}
+}
+
+func halfToFloat(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exp := int(h>>10) & 0x1f
+	frac := float64(h & 0x3ff)
+	switch exp {
+	case 0:
+		return sign * math.Ldexp(frac, -24)
+	case 31:
+		if frac == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.NaN()
+	}
+	return sign * math.Ldexp(frac+1024, exp-25)
+}
+
+// Int converts a decoded integer (uint64 or int64) to int64.
+func Int(v any) (int64, bool) {
+	switch t := v.(type) {
+	case uint64:
+		if t > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(t), true
+	case int64:
+		return t, true
+	}
+	return 0, false
+}
+
+// MapRaw decodes a map (optionally wrapped in tags) and returns each value's
+// raw encoding keyed by its decoded key.
+func MapRaw(b []byte) (map[any][]byte, error) {
+	b, err := skipTags(b)
+	if err != nil {
+		return nil, err
+	}
+	major, arg, n, err := head(b)
+	if err != nil {
+		return nil, err
+	}
+	if major != majorMap {
+		return nil, fmt.Errorf("cbor: expected map, got major type %d", major)
+	}
+	b = b[n:]
+
+	m := make(map[any][]byte)
+	for i := int64(0); arg == -1 || i < arg; i++ {
+		if arg == -1 {
+			if len(b) == 0 {
+				return nil, ErrTruncated
+			}
+			if b[0] == breakByte {
+				b = b[1:]
+				break
+			}
+		}
+		k, rest, err := decode(b, 1)
+		if err != nil {
+			return nil, err
+		}
+		if kb, ok := k.([]byte); ok {
+			k = string(kb)
+		}
+		var val []byte
+		val, b, err = Next(rest)
+		if err != nil {
+			return nil, err
+		}
+		switch k.(type) {
+		case []any, map[any]any, Tag:
+			return nil, fmt.Errorf("%w: non-scalar map key", ErrUnsupported)
+		}
+		m[k] = val
+	}
+	if len(b) != 0 {
+		return nil, fmt.Errorf("cbor: %d trailing bytes", len(b))
+	}
+	return m, nil
+}
@@ -0,0 +1,177 @@
+package cbor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// Examples from RFC 8949 appendix A in their shortest form, which Marshal
+// produces too.
+var vectors = []struct {
+	hex string
+	v   any
+}{
+	{"00", uint64(0)},
+	{"17", uint64(23)},
+	{"1818", uint64(24)},
+	{"1903e8", uint64(1000)},
+	{"1a000f4240", uint64(1000000)},
+	{"1b000000e8d4a51000", uint64(1000000000000)},
+	{"1bffffffffffffffff", uint64(18446744073709551615)},
+	{"20", int64(-1)},
+	{"3863", int64(-100)},
+	{"3b7fffffffffffffff", int64(math.MinInt64)},
+	{"f4", false},
+	{"f5", true},
+	{"f6", nil},
+	{"40", []byte(nil)}, // empty byte strings decode as nil
+	{"4401020304", []byte{1, 2, 3, 4}},
+	{"60", ""},
+	{"6161", "a"},
+	{"6449455446", "IETF"},
+	{"62225c", "\"\\"},
+	{"63e6b0b4", "水"},
+	{"80", []any{}},
+	{"83010203", []any{uint64(1), uint64(2), uint64(3)}},
+	{"8301820203820405", []any{uint64(1), []any{uint64(2), uint64(3)}, []any{uint64(4), uint64(5)}}},
+	{"a0", map[any]any{}},
+	{"a201020304", map[any]any{uint64(1): uint64(2), uint64(3): uint64(4)}},
+	{"a26161016162820203", map[any]any{"a": uint64(1), "b": []any{uint64(2), uint64(3)}}},
+	{"c074323031332d30332d32315432303a30343a30305a", Tag{Number: 0, Content: "2013-03-21T20:04:00Z"}},
+	{"d82076687474703a2f2f7777772e6578616d706c652e636f6d", Tag{Number: 32, Content: "http://www.example.com"}},
+}
+
+func TestDecodeVectors(t *testing.T) {
+	for _, tt := range vectors {
+		b, _ := hex.DecodeString(tt.hex)
+		v, err := Decode(b)
+		if err != nil || !reflect.DeepEqual(v, tt.v) {
+			t.Errorf("Decode(%s) = %#v, %v, want %#v", tt.hex, v, err, tt.v)
+		}
+	}
+}
+
+func TestDecodeOnly(t *testing.T) {
+	tests := []struct {
+		hex string
+		v   any
+	}{
+		// Non-shortest forms and indefinite lengths decode to the same values
+		{"1800", uint64(0)},
+		{"5f42010243030405ff", []byte{1, 2, 3, 4, 5}},
+		{"7f657374726561646d696e67ff", "streaming"},
+		{"9f018202039f0405ffff", []any{uint64(1), []any{uint64(2), uint64(3)}, []any{uint64(4), uint64(5)}}},
+		{"bf61610161629f0203ffff", map[any]any{"a": uint64(1), "b": []any{uint64(2), uint64(3)}}},
+		// Byte string keys become strings
+		{"a1426b7601", map[any]any{"kv": uint64(1)}},
+		{"f7", nil},
+		{"f90000", 0.0},
+		{"f93c00", 1.0},
+		{"f97bff", 65504.0},
+		{"fa47c35000", 100000.0},
+		{"fb3ff199999999999a", 1.1},
+		{"f9fc00", math.Inf(-1)},
+	}
+	for _, tt := range tests {
+		b, _ := hex.DecodeString(tt.hex)
+		v, err := Decode(b)
+		if err != nil || !reflect.DeepEqual(v, tt.v) {
+			t.Errorf("Decode(%s) = %#v, %v, want %#v", tt.hex, v, err, tt.v)
+		}
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	tests := []struct {
+		hex string
+		err error
+	}{
+		{"", ErrTruncated},
+		{"18", ErrTruncated},
+		{"1a0000", ErrTruncated},
+		{"4401", ErrTruncated},
+		{"8301", ErrTruncated},
+		{"9f01", ErrTruncated},
+		{"5f4101", ErrTruncated},
+		{"1f", ErrUnsupported},
+		{"1c", ErrUnsupported},
+		{"3bffffffffffffffff", ErrUnsupported},
+		{"a1800102", ErrUnsupported},
+		{"0000", nil},
+	}
+	for _, tt := range tests {
+		b, _ := hex.DecodeString(tt.hex)
+		_, err := Decode(b)
+		if err == nil || tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("Decode(%s) error = %v, want %v", tt.hex, err, tt.err)
+		}
+	}
+
+	deep := bytes.Repeat([]byte{0x81}, maxDepth+2)
+	if _, err := Decode(append(deep, 0)); err == nil {
+		t.Error("Decode of deeply nested arrays succeeded")
+	}
+}
+
+func TestRaw(t *testing.T) {
+	// 18([h'a10126', {}, h'', h'0102']), a COSE_Sign1
+	b, _ := hex.DecodeString("d28443a10126a040420102")
+	items, err := ArrayRaw(b)
+	if err != nil {
+		t.Fatalf("ArrayRaw: %v", err)
+	}
+	want := []string{"43a10126", "a0", "40", "420102"}
+	if len(items) != len(want) {
+		t.Fatalf("ArrayRaw = %x, want %v", items, want)
+	}
+	for i, item := range items {
+		if hex.EncodeToString(item) != want[i] {
+			t.Errorf("item %d = %x, want %s", i, item, want[i])
+		}
+	}
+	protected, err := Bytes(items[0])
+	if err != nil || hex.EncodeToString(protected) != "a10126" {
+		t.Errorf("Bytes = %x, %v, want a10126", protected, err)
+	}
+	m, err := MapRaw(protected)
+	if err != nil || hex.EncodeToString(m[uint64(1)]) != "26" {
+		t.Errorf("MapRaw = %x, %v, want {1: 26}", m, err)
+	}
+	if _, err := ArrayRaw(append(b, 0)); err == nil {
+		t.Error("ArrayRaw with trailing bytes succeeded")
+	}
+	if _, err := ArrayRaw(protected); err == nil {
+		t.Error("ArrayRaw of a map succeeded")
+	}
+
+	item, rest, err := Next(b[1:])
+	if err != nil || len(item) != len(b)-1 || len(rest) != 0 {
+		t.Errorf("Next = %x, %x, %v", item, rest, err)
+	}
+	major, arg, rest, err := Head(b[1:])
+	if err != nil || major != majorArray || arg != 4 || len(rest) != len(b)-2 {
+		t.Errorf("Head = %d, %d, %v", major, arg, err)
+	}
+}
+
+func TestInt(t *testing.T) {
+	tests := []struct {
+		v    any
+		want int64
+		ok   bool
+	}{
+		{uint64(7), 7, true},
+		{int64(-7), -7, true},
+		{uint64(math.MaxUint64), 0, false},
+		{"7", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := Int(tt.v); got != tt.want || ok != tt.ok {
+			t.Errorf("Int(%#v) = %d, %v, want %d, %v", tt.v, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package cbor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+// Marshal encodes v in the shortest form. It handles the Go types Decode
+// produces except floats, plus int. Map keys are sorted by their encoding,
+// as RFC 8949 section 4.2.1 asks, so the output is deterministic.
+func Marshal(v any) ([]byte, error) {
+	return appendItem(nil, v)
+}
+
+func appendItem(b []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, majorSimple<<5|22), nil
+	case bool:
+		if v {
+			return append(b, majorSimple<<5|21), nil
+		}
+		return append(b, majorSimple<<5|20), nil
+	case uint64:
+		return appendHead(b, majorUint, v), nil
+	case int64:
+		if v < 0 {
+			return appendHead(b, majorNegInt, uint64(-1-v)), nil
+		}
+		return appendHead(b, majorUint, uint64(v)), nil
+	case int:
+		return appendItem(b, int64(v))
+	case []byte:
+		return append(appendHead(b, majorBytes, uint64(len(v))), v...), nil
+	case string:
+		return append(appendHead(b, majorText, uint64(len(v))), v...), nil
+	case []any:
+		b = appendHead(b, majorArray, uint64(len(v)))
+		for _, e := range v {
+			var err error
+			if b, err = appendItem(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[any]any:
+		type pair struct{ k, v []byte }
+		pairs := make([]pair, 0, len(v))
+		for k, e := range v {
+			kb, err := appendItem(nil, k)
+			if err != nil {
+				return nil, err
+			}
+			vb, err := appendItem(nil, e)
+			if err != nil {
+				return nil, err
+			}
+			pairs = append(pairs, pair{kb, vb})
+		}
+		slices.SortFunc(pairs, func(x, y pair) int { return bytes.Compare(x.k, y.k) })
+		b = appendHead(b, majorMap, uint64(len(pairs)))
+		for _, p := range pairs {
+			b = append(append(b, p.k...), p.v...)
+		}
+		return b, nil
+	case Tag:
+		return appendItem(appendHead(b, majorTag, v.Number), v.Content)
+	}
+	return nil, fmt.Errorf("cbor: cannot encode %T", v)
+}
+
+// appendHead appends an item head with major type major and argument arg.
+func appendHead(b []byte, major byte, arg uint64) []byte {
+	m := major << 5
+	switch {
+	case arg < 24:
+		return append(b, m|byte(arg))
+	case arg <= 0xff:
+		return append(b, m|24, byte(arg))
+	case arg <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, m|25), uint16(arg))
+	case arg <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(b, m|26), uint32(arg))
+	}
+	return binary.BigEndian.AppendUint64(append(b, m|27), arg)
+}
@@ -0,0 +1,49 @@
+package cbor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestMarshalVectors(t *testing.T) {
+	for _, tt := range vectors {
+		got, err := Marshal(tt.v)
+		if err != nil || hex.EncodeToString(got) != tt.hex {
+			t.Errorf("Marshal(%#v) = %x, %v, want %s", tt.v, got, err, tt.hex)
+		}
+	}
+}
+
+func TestMarshalSortsKeys(t *testing.T) {
+	m := map[any]any{"b": uint64(1), uint64(10): true, "a": nil, int64(-1): "x"}
+	for range 10 {
+		b, err := Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 10 (0a) < -1 (20) < "a" (6161) < "b" (6162)
+		if want := "a40af52061786161f6616201"; hex.EncodeToString(b) != want {
+			t.Fatalf("Marshal = %x, want %s", b, want)
+		}
+	}
+	if _, err := Marshal(1.5); err == nil {
+		t.Error("Marshal(1.5) succeeded")
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	v := []any{uint64(1), "fdo", []byte{0xde, 0xad}, map[any]any{int64(-3): []any{true, nil}}, Tag{Number: 18, Content: []any{}}}
+	b, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := Marshal(again)
+	if err != nil || !bytes.Equal(b, b2) {
+		t.Errorf("re-encoding %x gave %x, %v", b, b2, err)
+	}
+}
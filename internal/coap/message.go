@@ -0,0 +1,334 @@
+// Package coap is a small RFC 7252 server: message encoding, confirmable
+// exchanges with deduplication and separate responses, and RFC 7959
+// block-wise transfers, which it assembles so handlers only see whole
+// requests and responses. There is no client, observe or DTLS support.
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Type is the CoAP message type.
+type Type uint8
+
+// Message types.
+const (
+	Confirmable     Type = 0
+	NonConfirmable  Type = 1
+	Acknowledgement Type = 2
+	Reset           Type = 3
+)
+
+// Code is a request method or response code, class << 5 | detail.
+type Code uint8
+
+// Request methods and the response codes the package uses.
+const (
+	Empty  Code = 0
+	GET    Code = 1
+	POST   Code = 2
+	PUT    Code = 3
+	DELETE Code = 4
+
+	Created                  Code = 2<<5 | 1
+	Deleted                  Code = 2<<5 | 2
+	Valid                    Code = 2<<5 | 3
+	Changed                  Code = 2<<5 | 4
+	Content                  Code = 2<<5 | 5
+	Continue                 Code = 2<<5 | 31
+	BadRequest               Code = 4<<5 | 0
+	Unauthorized             Code = 4<<5 | 1
+	BadOption                Code = 4<<5 | 2
+	Forbidden                Code = 4<<5 | 3
+	NotFound                 Code = 4<<5 | 4
+	MethodNotAllowed         Code = 4<<5 | 5
+	RequestEntityIncomplete  Code = 4<<5 | 8
+	Conflict                 Code = 4<<5 | 9
+	RequestEntityTooLarge    Code = 4<<5 | 13
+	UnsupportedContentFormat Code = 4<<5 | 15
+	InternalServerError      Code = 5<<5 | 0
+	BadGateway               Code = 5<<5 | 2
+	ServiceUnavailable       Code = 5<<5 | 3
+	GatewayTimeout           Code = 5<<5 | 4
+)
+
+// IsRequest reports whether c is a method rather than a response.
+func (c Code) IsRequest() bool {
+	return c != Empty && c>>5 == 0
+}
+
+// String formats c in dotted form, e.g. "2.05".
+func (c Code) String() string {
+	return fmt.Sprintf("%d.%02d", c>>5, c&0x1f)
+}
+
+// Option numbers.
+const (
+	OptURIHost       = 3
+	OptURIPath       = 11
+	OptContentFormat = 12
+	OptMaxAge        = 14
+	OptURIQuery      = 15
+	OptAccept        = 17
+	OptBlock2        = 23
+	OptBlock1        = 27
+	OptSize2         = 28
+	OptSize1         = 60
+)
+
+// FormatCBOR is the Content-Format of application/cbor.
+const FormatCBOR = 60
+
+// Option is one option of a message. Options with the same number repeat.
+type Option struct {
+	Number uint16
+	Value  []byte
+}
+
+// Message is a CoAP message.
+type Message struct {
+	Type      Type
+	Code      Code
+	MessageID uint16
+	Token     []byte
+	// Options are kept sorted by number, as Marshal needs them.
+	Options []Option
+	Payload []byte
+}
+
+// payloadMarker separates options from the payload.
+const payloadMarker = 0xff
+
+var errTruncated = errors.New("coap: truncated message")
+
+// Unmarshal decodes a CoAP message from a datagram.
+func Unmarshal(b []byte) (*Message, error) {
+	if len(b) < 4 {
+		return nil, errTruncated
+	}
+	if b[0]>>6 != 1 {
+		return nil, fmt.Errorf("coap: unsupported version %d", b[0]>>6)
+	}
+	m := &Message{
+		Type:      Type(b[0] >> 4 & 0x3),
+		Code:      Code(b[1]),
+		MessageID: binary.BigEndian.Uint16(b[2:4]),
+	}
+	tkl := int(b[0] & 0xf)
+	if tkl > 8 {
+		return nil, fmt.Errorf("coap: token length %d", tkl)
+	}
+	b = b[4:]
+	if len(b) < tkl {
+		return nil, errTruncated
+	}
+	m.Token, b = append([]byte(nil), b[:tkl]...), b[tkl:]
+
+	var number uint16
+	for len(b) > 0 {
+		if b[0] == payloadMarker {
+			if len(b) == 1 {
+				return nil, errors.New("coap: payload marker without payload")
+			}
+			m.Payload = append([]byte(nil), b[1:]...)
+			break
+		}
+		delta, length := int(b[0]>>4), int(b[0]&0xf)
+		b = b[1:]
+		var err error
+		if delta, b, err = extended(delta, b); err != nil {
+			return nil, err
+		}
+		if length, b, err = extended(length, b); err != nil {
+			return nil, err
+		}
+		if len(b) < length {
+			return nil, errTruncated
+		}
+		if int(number)+delta > 0xffff {
+			return nil, errors.New("coap: option number out of range")
+		}
+		number += uint16(delta)
+		m.Options = append(m.Options, Option{Number: number, Value: append([]byte(nil), b[:length]...)})
+		b = b[length:]
+	}
+	return m, nil
+}
+
+// extended reads the extended form of an option delta or length.
+func extended(v int, b []byte) (int, []byte, error) {
+	switch v {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, errTruncated
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, errTruncated
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	case 15:
+		return 0, nil, errors.New("coap: reserved option nibble")
+	}
+	return v, b, nil
+}
+
+// Marshal encodes m as a datagram.
+func (m *Message) Marshal() ([]byte, error) {
+	if len(m.Token) > 8 {
+		return nil, fmt.Errorf("coap: token length %d", len(m.Token))
+	}
+	b := []byte{1<<6 | byte(m.Type)<<4 | byte(len(m.Token)), byte(m.Code), byte(m.MessageID >> 8), byte(m.MessageID)}
+	b = append(b, m.Token...)
+	var number uint16
+	for _, o := range m.Options {
+		if o.Number < number {
+			return nil, errors.New("coap: options out of order")
+		}
+		delta, length := int(o.Number-number), len(o.Value)
+		if length > 0xffff+269 {
+			return nil, fmt.Errorf("coap: option %d too long", o.Number)
+		}
+		dn, dext := nibble(delta)
+		ln, lext := nibble(length)
+		b = append(b, dn<<4|ln)
+		b = append(b, dext...)
+		b = append(b, lext...)
+		b = append(b, o.Value...)
+		number = o.Number
+	}
+	if len(m.Payload) > 0 {
+		b = append(b, payloadMarker)
+		b = append(b, m.Payload...)
+	}
+	return b, nil
+}
+
+// nibble returns the 4-bit form of an option delta or length and its
+// extended bytes.
+func nibble(v int) (byte, []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	}
+	return 14, []byte{byte((v - 269) >> 8), byte(v - 269)}
+}
+
+// Option returns the first value of option n.
+func (m *Message) Option(n uint16) ([]byte, bool) {
+	for _, o := range m.Options {
+		if o.Number == n {
+			return o.Value, true
+		}
+	}
+	return nil, false
+}
+
+// AddOption adds a value of option n, after any it already has.
+func (m *Message) AddOption(n uint16, v []byte) {
+	i := 0
+	for i < len(m.Options) && m.Options[i].Number <= n {
+		i++
+	}
+	m.Options = append(m.Options, Option{})
+	copy(m.Options[i+1:], m.Options[i:])
+	m.Options[i] = Option{Number: n, Value: v}
+}
+
+// SetOption replaces every value of option n with v.
+func (m *Message) SetOption(n uint16, v []byte) {
+	m.RemoveOption(n)
+	m.AddOption(n, v)
+}
+
+// RemoveOption deletes option n.
+func (m *Message) RemoveOption(n uint16) {
+	out := m.Options[:0]
+	for _, o := range m.Options {
+		if o.Number != n {
+			out = append(out, o)
+		}
+	}
+	m.Options = out
+}
+
+// Uint returns option n as an unsigned integer.
+func (m *Message) Uint(n uint16) (uint32, bool) {
+	v, ok := m.Option(n)
+	if !ok || len(v) > 4 {
+		return 0, false
+	}
+	var u uint32
+	for _, c := range v {
+		u = u<<8 | uint32(c)
+	}
+	return u, true
+}
+
+// SetUint sets option n to u in its shortest encoding.
+func (m *Message) SetUint(n uint16, u uint32) {
+	var v []byte
+	for u > 0 {
+		v = append([]byte{byte(u)}, v...)
+		u >>= 8
+	}
+	m.SetOption(n, v)
+}
+
+// Path returns the Uri-Path of m as an absolute path, e.g.
+// "/fdo/101/msg/10".
+func (m *Message) Path() string {
+	var segs []string
+	for _, o := range m.Options {
+		if o.Number == OptURIPath {
+			segs = append(segs, string(o.Value))
+		}
+	}
+	return "/" + strings.Join(segs, "/")
+}
+
+// Block is the value of a Block1 or Block2 option.
+type Block struct {
+	Num  uint32
+	More bool
+	// Size is 16 to 1024 bytes.
+	Size int
+}
+
+// Block returns option n, OptBlock1 or OptBlock2, of m.
+func (m *Message) Block(n uint16) (Block, bool) {
+	v, ok := m.Uint(n)
+	if !ok {
+		return Block{}, false
+	}
+	szx := v & 0x7
+	if szx == 7 {
+		// BERT is only defined over TCP
+		return Block{}, false
+	}
+	return Block{Num: v >> 4, More: v&0x8 != 0, Size: 1 << (szx + 4)}, true
+}
+
+// SetBlock sets option n, OptBlock1 or OptBlock2, of m to b.
+func (m *Message) SetBlock(n uint16, b Block) {
+	v := b.Num<<4 | szx(b.Size)
+	if b.More {
+		v |= 0x8
+	}
+	m.SetUint(n, v)
+}
+
+// szx encodes a block size, rounding down to a power of two.
+func szx(size int) uint32 {
+	var x uint32
+	for x < 6 && 1<<(x+5) <= size {
+		x++
+	}
+	return x
+}
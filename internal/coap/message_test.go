@@ -0,0 +1,142 @@
+package coap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarshalUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+		m    Message
+	}{
+		{
+			// RFC 7252 figure 16: GET /temperature
+			"get", "40017d34bb74656d7065726174757265",
+			Message{Type: Confirmable, Code: GET, MessageID: 0x7d34,
+				Options: []Option{{OptURIPath, []byte("temperature")}}},
+		},
+		{
+			"piggybacked", "60457d34ff32322e3320432e",
+			Message{Type: Acknowledgement, Code: Content, MessageID: 0x7d34,
+				Payload: []byte("22.3 C.")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := hex.DecodeString(tt.hex)
+			m, err := Unmarshal(b)
+			if err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(*m, tt.m) {
+				t.Errorf("Unmarshal = %+v, want %+v", *m, tt.m)
+			}
+			got, err := tt.m.Marshal()
+			if err != nil || !bytes.Equal(got, b) {
+				t.Errorf("Marshal = %x, %v, want %s", got, err, tt.hex)
+			}
+		})
+	}
+}
+
+func TestRoundTripExtendedOptions(t *testing.T) {
+	m := &Message{Type: NonConfirmable, Code: POST, MessageID: 1, Token: []byte{1, 2, 3, 4, 5, 6, 7, 8}, Payload: []byte{0xff, 0}}
+	m.AddOption(OptURIPath, []byte("fdo"))
+	m.AddOption(OptURIPath, []byte("101"))
+	m.AddOption(OptURIPath, []byte("msg"))
+	m.SetUint(OptContentFormat, FormatCBOR)
+	// Deltas and lengths that need one and two extended bytes
+	m.AddOption(OptSize1, bytes.Repeat([]byte{'a'}, 13))
+	m.AddOption(2048, bytes.Repeat([]byte{'b'}, 300))
+	m.AddOption(OptURIHost, []byte("example"))
+
+	b, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("round trip = %+v, want %+v", got, m)
+	}
+	if p := got.Path(); p != "/fdo/101/msg" {
+		t.Errorf("Path = %q", p)
+	}
+	if f, ok := got.Uint(OptContentFormat); !ok || f != FormatCBOR {
+		t.Errorf("Content-Format = %d, %v", f, ok)
+	}
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	for _, h := range []string{
+		"",
+		"400100",               // short header
+		"80010000",             // version 2
+		"49010000",             // token length 9
+		"42010000aa",           // token cut short
+		"40010000ff",           // payload marker without payload
+		"40010000f0",           // reserved delta nibble
+		"40010000d1",           // extended delta missing
+		"40010000e100",         // two-byte delta cut short
+		"4001000013ab",         // option value cut short
+		"40010000e0fef3e0fef3", // option number past 65535
+	} {
+		b, _ := hex.DecodeString(h)
+		if _, err := Unmarshal(b); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded", h)
+		}
+	}
+	if _, err := (&Message{Token: make([]byte, 9)}).Marshal(); err == nil {
+		t.Error("Marshal with a 9-byte token succeeded")
+	}
+	m := &Message{Options: []Option{{OptURIPath, nil}, {OptURIHost, nil}}}
+	if _, err := m.Marshal(); err == nil {
+		t.Error("Marshal with options out of order succeeded")
+	}
+}
+
+func TestBlock(t *testing.T) {
+	tests := []struct {
+		b   Block
+		hex string
+	}{
+		{Block{Num: 0, More: true, Size: 16}, "08"},
+		{Block{Num: 1, More: false, Size: 1024}, "16"},
+		{Block{Num: 300, More: true, Size: 64}, "12ca"},
+	}
+	for _, tt := range tests {
+		var m Message
+		m.SetBlock(OptBlock2, tt.b)
+		v, _ := m.Option(OptBlock2)
+		if hex.EncodeToString(v) != tt.hex {
+			t.Errorf("SetBlock(%+v) = %x, want %s", tt.b, v, tt.hex)
+		}
+		if b, ok := m.Block(OptBlock2); !ok || b != tt.b {
+			t.Errorf("Block = %+v, %v, want %+v", b, ok, tt.b)
+		}
+	}
+	// SZX 7 is BERT, only defined over TCP
+	m := Message{Options: []Option{{OptBlock1, []byte{0x07}}}}
+	if _, ok := m.Block(OptBlock1); ok {
+		t.Error("BERT block accepted")
+	}
+}
+
+func TestCode(t *testing.T) {
+	if s := Content.String(); s != "2.05" {
+		t.Errorf("Content = %s", s)
+	}
+	if s := strings.Join([]string{GatewayTimeout.String(), RequestEntityTooLarge.String()}, " "); s != "5.04 4.13" {
+		t.Errorf("codes = %s", s)
+	}
+	if !POST.IsRequest() || Empty.IsRequest() || Content.IsRequest() {
+		t.Error("IsRequest wrong")
+	}
+}
@@ -0,0 +1,418 @@
+package coap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RFC 7252 transmission parameters.
+const (
+	ackTimeout       = 2 * time.Second
+	maxRetransmit    = 4
+	exchangeLifetime = 247 * time.Second
+)
+
+// separateAfter is how long a handler may take before a confirmable
+// request is acknowledged on its own and answered by a separate response,
+// kept below ackTimeout so clients do not retransmit.
+const separateAfter = time.Second
+
+// ErrServerClosed is returned by Serve after Shutdown.
+var ErrServerClosed = errors.New("coap: server closed")
+
+// Handler serves a whole request, its Block1 transfer already assembled.
+// It returns the response code, options and payload; the server sets the
+// type, message ID and token, and sends large payloads block-wise.
+type Handler func(ctx context.Context, peer net.Addr, req *Message) *Message
+
+// Server serves CoAP over UDP.
+type Server struct {
+	Addr    string
+	Handler Handler
+	// BlockSize is the largest payload sent in one response; larger ones
+	// are sent block-wise (default and at most 1024).
+	BlockSize int
+	// MaxBody limits request payloads, whole or assembled from blocks
+	// (default 1 MiB).
+	MaxBody int
+
+	mu        sync.Mutex
+	conn      net.PacketConn
+	ctx       context.Context
+	cancel    context.CancelFunc
+	exchanges map[string]*exchange
+	uploads   map[string]*transfer
+	downloads map[string]*transfer
+	pending   map[string]chan struct{}
+	swept     time.Time
+	nextID    atomic.Uint32
+	wg        sync.WaitGroup
+}
+
+// exchange is a request received, remembered to answer retransmissions
+// with the same reply.
+type exchange struct {
+	at    time.Time
+	reply []byte
+}
+
+// transfer is a block-wise request being assembled or a response being
+// fetched block by block.
+type transfer struct {
+	at   time.Time
+	body []byte
+	resp *Message
+}
+
+// ListenAndServe listens on the UDP address s.Addr and serves it.
+func (s *Server) ListenAndServe() error {
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Serve serves requests arriving on conn until Shutdown.
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mu.Lock()
+	s.conn = conn
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.exchanges = make(map[string]*exchange)
+	s.uploads = make(map[string]*transfer)
+	s.downloads = make(map[string]*transfer)
+	s.pending = make(map[string]chan struct{})
+	s.mu.Unlock()
+	s.nextID.Store(rand.Uint32())
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return ErrServerClosed
+			}
+			return err
+		}
+		s.receive(peer, append([]byte(nil), buf[:n]...))
+	}
+}
+
+// Shutdown stops receiving and waits for requests in progress, or ctx.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	conn, cancel := s.conn, s.cancel
+	s.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	cancel()
+	conn.Close()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// receive handles one datagram from peer.
+func (s *Server) receive(peer net.Addr, b []byte) {
+	m, err := Unmarshal(b)
+	if err != nil {
+		// A confirmable message that cannot be parsed is rejected
+		if len(b) >= 4 && b[0]>>6 == 1 && Type(b[0]>>4&0x3) == Confirmable {
+			s.send(peer, &Message{Type: Reset, MessageID: binary.BigEndian.Uint16(b[2:4])})
+		}
+		return
+	}
+	switch {
+	case m.Type == Acknowledgement || m.Type == Reset:
+		s.acknowledged(peer, m.MessageID)
+		return
+	case !m.Code.IsRequest():
+		// Pings, and responses a server never asked for
+		if m.Type == Confirmable {
+			s.send(peer, &Message{Type: Reset, MessageID: m.MessageID})
+		}
+		return
+	}
+
+	key := exchangeKey(peer, m.MessageID)
+	now := time.Now()
+	s.mu.Lock()
+	s.sweepLocked(now)
+	if ex, ok := s.exchanges[key]; ok {
+		// A retransmission: repeat the reply, or wait for it
+		reply := ex.reply
+		s.mu.Unlock()
+		if reply != nil {
+			s.conn.WriteTo(reply, peer)
+		}
+		return
+	}
+	ex := &exchange{at: now}
+	s.exchanges[key] = ex
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.exchange(peer, m, ex)
+	}()
+}
+
+// exchange answers req, piggybacked on the acknowledgement if the handler
+// is quick enough.
+func (s *Server) exchange(peer net.Addr, req *Message, ex *exchange) {
+	done := make(chan *Message, 1)
+	go func() { done <- s.respond(peer, req) }()
+
+	var resp *Message
+	if req.Type == Confirmable {
+		select {
+		case resp = <-done:
+			resp.Type, resp.MessageID = Acknowledgement, req.MessageID
+		case <-time.After(separateAfter):
+			s.reply(peer, ex, &Message{Type: Acknowledgement, MessageID: req.MessageID})
+			resp = <-done
+			resp.Type, resp.MessageID, resp.Token = Confirmable, s.newID(), req.Token
+			s.confirm(peer, resp)
+			return
+		}
+	} else {
+		resp = <-done
+		resp.Type, resp.MessageID = NonConfirmable, s.newID()
+	}
+	resp.Token = req.Token
+	s.reply(peer, ex, resp)
+}
+
+// respond runs the handler for req, assembling Block1 transfers and
+// splitting large responses into Block2 transfers.
+func (s *Server) respond(peer net.Addr, req *Message) *Message {
+	key := peer.String() + " " + req.Code.String() + " " + req.Path()
+	if b2, ok := req.Block(OptBlock2); ok && b2.Num > 0 {
+		return s.nextBlock(key, b2)
+	}
+	b1, block1 := req.Block(OptBlock1)
+	if block1 {
+		body, resp := s.upload(key, req, b1)
+		if resp != nil {
+			return resp
+		}
+		req.Payload = body
+	} else if len(req.Payload) > s.maxBody() {
+		return tooLarge(s.maxBody())
+	}
+
+	resp := s.Handler(s.ctx, peer, req)
+	if resp == nil {
+		resp = &Message{Code: InternalServerError}
+	}
+	if block1 {
+		resp.SetBlock(OptBlock1, Block{Num: b1.Num, Size: b1.Size})
+	}
+	size := s.blockSize()
+	if b2, ok := req.Block(OptBlock2); ok && b2.Size < size {
+		size = b2.Size
+	}
+	if len(resp.Payload) <= size {
+		return resp
+	}
+	s.mu.Lock()
+	s.downloads[key] = &transfer{at: time.Now(), resp: resp}
+	s.mu.Unlock()
+	return block(resp, 0, size)
+}
+
+// upload adds a Block1 block of req to the transfer under key. It returns
+// the whole body once the last block arrived, or else the response to
+// send.
+func (s *Server) upload(key string, req *Message, b Block) ([]byte, *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.uploads[key]
+	if b.Num == 0 {
+		t = &transfer{}
+	}
+	if t == nil || int(b.Num)*b.Size != len(t.body) {
+		delete(s.uploads, key)
+		return nil, &Message{Code: RequestEntityIncomplete}
+	}
+	if b.More && len(req.Payload) != b.Size {
+		delete(s.uploads, key)
+		return nil, &Message{Code: BadRequest, Payload: []byte("block shorter than its size")}
+	}
+	if len(t.body)+len(req.Payload) > s.maxBody() {
+		delete(s.uploads, key)
+		return nil, tooLarge(s.maxBody())
+	}
+	t.body = append(t.body, req.Payload...)
+	t.at = time.Now()
+	if !b.More {
+		delete(s.uploads, key)
+		return t.body, nil
+	}
+	s.uploads[key] = t
+	resp := &Message{Code: Continue}
+	resp.SetBlock(OptBlock1, Block{Num: b.Num, More: true, Size: b.Size})
+	return nil, resp
+}
+
+// nextBlock returns a later block of the response stored under key.
+func (s *Server) nextBlock(key string, b Block) *Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.downloads[key]
+	if !ok {
+		return &Message{Code: RequestEntityIncomplete}
+	}
+	if int(b.Num)*b.Size >= len(t.resp.Payload) {
+		return &Message{Code: BadOption}
+	}
+	resp := block(t.resp, b.Num, b.Size)
+	resp.RemoveOption(OptBlock1)
+	if more, _ := resp.Block(OptBlock2); !more.More {
+		delete(s.downloads, key)
+	}
+	return resp
+}
+
+// block returns block num of resp's payload.
+func block(resp *Message, num uint32, size int) *Message {
+	out := &Message{Code: resp.Code, Options: append([]Option(nil), resp.Options...)}
+	start := int(num) * size
+	end := min(start+size, len(resp.Payload))
+	out.Payload = resp.Payload[start:end]
+	out.SetBlock(OptBlock2, Block{Num: num, More: end < len(resp.Payload), Size: size})
+	if num == 0 {
+		out.SetUint(OptSize2, uint32(len(resp.Payload)))
+	}
+	return out
+}
+
+func tooLarge(max int) *Message {
+	m := &Message{Code: RequestEntityTooLarge}
+	m.SetUint(OptSize1, uint32(max))
+	return m
+}
+
+// reply sends m as the reply to ex, repeated for retransmissions of its
+// request.
+func (s *Server) reply(peer net.Addr, ex *exchange, m *Message) {
+	b, err := m.Marshal()
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	ex.reply = b
+	s.mu.Unlock()
+	s.conn.WriteTo(b, peer)
+}
+
+// confirm sends the confirmable message m until peer acknowledges it or
+// retransmissions run out.
+func (s *Server) confirm(peer net.Addr, m *Message) {
+	b, err := m.Marshal()
+	if err != nil {
+		return
+	}
+	key := exchangeKey(peer, m.MessageID)
+	acked := make(chan struct{})
+	s.mu.Lock()
+	s.pending[key] = acked
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, key)
+		s.mu.Unlock()
+	}()
+
+	timeout := ackTimeout + time.Duration(rand.Int64N(int64(ackTimeout/2)))
+	for range maxRetransmit + 1 {
+		s.conn.WriteTo(b, peer)
+		select {
+		case <-acked:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-time.After(timeout):
+			timeout *= 2
+		}
+	}
+}
+
+// acknowledged stops retransmitting message id to peer.
+func (s *Server) acknowledged(peer net.Addr, id uint16) {
+	key := exchangeKey(peer, id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if acked, ok := s.pending[key]; ok {
+		close(acked)
+		delete(s.pending, key)
+	}
+}
+
+// send writes m to peer, for messages never repeated.
+func (s *Server) send(peer net.Addr, m *Message) {
+	if b, err := m.Marshal(); err == nil {
+		s.conn.WriteTo(b, peer)
+	}
+}
+
+// sweepLocked forgets exchanges and transfers older than the exchange
+// lifetime, at most once a second. The caller must hold s.mu.
+func (s *Server) sweepLocked(now time.Time) {
+	if now.Sub(s.swept) < time.Second {
+		return
+	}
+	s.swept = now
+	for k, ex := range s.exchanges {
+		if now.Sub(ex.at) > exchangeLifetime {
+			delete(s.exchanges, k)
+		}
+	}
+	for _, m := range []map[string]*transfer{s.uploads, s.downloads} {
+		for k, t := range m {
+			if now.Sub(t.at) > exchangeLifetime {
+				delete(m, k)
+			}
+		}
+	}
+}
+
+func (s *Server) newID() uint16 {
+	return uint16(s.nextID.Add(1))
+}
+
+// blockSize is s.BlockSize as a valid block size.
+func (s *Server) blockSize() int {
+	if s.BlockSize <= 0 {
+		return 1024
+	}
+	return 1 << (szx(s.BlockSize) + 4)
+}
+
+func (s *Server) maxBody() int {
+	if s.MaxBody <= 0 {
+		return 1 << 20
+	}
+	return s.MaxBody
+}
+
+func exchangeKey(peer net.Addr, id uint16) string {
+	return peer.String() + "#" + strconv.Itoa(int(id))
+}
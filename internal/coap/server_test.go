@@ -0,0 +1,162 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startServer serves h on a local UDP port and returns a client socket
+// connected to it.
+func startServer(t *testing.T, h Handler) *net.UDPConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Handler: h, BlockSize: 64, MaxBody: 256}
+	go s.Serve(pc)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	c, err := net.DialUDP("udp", nil, pc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// roundTrip sends m and returns the next message received.
+func roundTrip(t *testing.T, c *net.UDPConn, m *Message) *Message {
+	t.Helper()
+	b, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	return receive(t, c)
+}
+
+func receive(t *testing.T, c *net.UDPConn) *Message {
+	t.Helper()
+	buf := make([]byte, 2048)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Unmarshal(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func request(code Code, id uint16, path string, payload []byte) *Message {
+	m := &Message{Type: Confirmable, Code: code, MessageID: id, Token: []byte{0xca, 0xfe}, Payload: payload}
+	m.AddOption(OptURIPath, []byte(path))
+	return m
+}
+
+func TestPiggybackedAndDeduplicated(t *testing.T) {
+	var calls atomic.Int32
+	c := startServer(t, func(ctx context.Context, peer net.Addr, req *Message) *Message {
+		calls.Add(1)
+		return &Message{Code: Content, Payload: []byte(req.Path())}
+	})
+	req := request(GET, 0x1234, "hello", nil)
+	for range 2 {
+		// The second send is a retransmission, answered from the first reply
+		resp := roundTrip(t, c, req)
+		if resp.Type != Acknowledgement || resp.MessageID != 0x1234 || resp.Code != Content ||
+			!bytes.Equal(resp.Token, req.Token) || string(resp.Payload) != "/hello" {
+			t.Errorf("response = %+v", resp)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("handler ran %d times, want 1", n)
+	}
+}
+
+func TestResetsMalformedConfirmable(t *testing.T) {
+	c := startServer(t, func(context.Context, net.Addr, *Message) *Message { return nil })
+	// A confirmable message with a reserved option nibble
+	c.Write([]byte{0x40, 0x01, 0x00, 0x07, 0xf0})
+	if m := receive(t, c); m.Type != Reset || m.MessageID != 7 {
+		t.Errorf("reply = %+v, want a reset of message 7", m)
+	}
+	// A ping is answered with a reset too
+	if m := roundTrip(t, c, &Message{Type: Confirmable, MessageID: 8}); m.Type != Reset || m.MessageID != 8 {
+		t.Errorf("ping reply = %+v, want a reset", m)
+	}
+	if m := roundTrip(t, c, request(GET, 9, "x", nil)); m.Code != InternalServerError {
+		t.Errorf("nil handler response = %v, want 5.00", m.Code)
+	}
+}
+
+func TestBlockwise(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 10) // 160 bytes
+	c := startServer(t, func(ctx context.Context, peer net.Addr, req *Message) *Message {
+		if req.Code == POST {
+			return &Message{Code: Changed, Payload: []byte{byte(len(req.Payload))}}
+		}
+		return &Message{Code: Content, Payload: body}
+	})
+
+	// Block2: 64, 64 and 32 bytes
+	var got []byte
+	for num := uint32(0); ; num++ {
+		req := request(GET, uint16(100+num), "big", nil)
+		if num > 0 {
+			req.SetBlock(OptBlock2, Block{Num: num, Size: 64})
+		}
+		resp := roundTrip(t, c, req)
+		b, ok := resp.Block(OptBlock2)
+		if !ok || b.Num != num || b.Size != 64 {
+			t.Fatalf("block %d: Block2 = %+v, %v", num, b, ok)
+		}
+		if size, ok := resp.Uint(OptSize2); num == 0 && (!ok || size != 160) {
+			t.Errorf("Size2 = %d, %v, want 160", size, ok)
+		}
+		got = append(got, resp.Payload...)
+		if !b.More {
+			break
+		}
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("assembled %d bytes, want %d", len(got), len(body))
+	}
+
+	// Block1: 32 + 32 + 10 bytes, assembled for the handler
+	upload := bytes.Repeat([]byte{'u'}, 74)
+	for num := uint32(0); num < 3; num++ {
+		end := min(int(num+1)*32, len(upload))
+		req := request(POST, uint16(200+num), "up", upload[num*32:end])
+		req.SetBlock(OptBlock1, Block{Num: num, More: end < len(upload), Size: 32})
+		resp := roundTrip(t, c, req)
+		if end < len(upload) {
+			if resp.Code != Continue {
+				t.Fatalf("block %d: code %v, want 2.31", num, resp.Code)
+			}
+			continue
+		}
+		if resp.Code != Changed || len(resp.Payload) != 1 || resp.Payload[0] != 74 {
+			t.Errorf("last block: %v %v, want 2.04 with length 74", resp.Code, resp.Payload)
+		}
+	}
+
+	// A block out of sequence, and a body over MaxBody
+	req := request(POST, 300, "up", bytes.Repeat([]byte{'u'}, 32))
+	req.SetBlock(OptBlock1, Block{Num: 2, More: true, Size: 32})
+	if resp := roundTrip(t, c, req); resp.Code != RequestEntityIncomplete {
+		t.Errorf("out of sequence: %v, want 4.08", resp.Code)
+	}
+	resp := roundTrip(t, c, request(POST, 301, "up", make([]byte, 257)))
+	if max, _ := resp.Uint(OptSize1); resp.Code != RequestEntityTooLarge || max != 256 {
+		t.Errorf("too large: %v with Size1 %d, want 4.13 with 256", resp.Code, max)
+	}
+}
@@ -0,0 +1,157 @@
+// Package correlation carries the proxy's request ID and W3C trace context
+// from the device-facing listener through middleware to outbound ledger calls,
+// so ledger-side logs can be joined with wrapper logs.
+package correlation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Header names used for propagation.
+const (
+	RequestIDHeader   = "X-Request-ID"
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	traceKey
+)
+
+// TraceContext is a parsed W3C traceparent (version 00).
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+	State   string
+}
+
+// NewRequestID returns a random 128-bit request ID in hex.
+func NewRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// NewTrace starts a new sampled trace with a random trace and span ID.
+func NewTrace() TraceContext {
+	var tc TraceContext
+	_, _ = rand.Read(tc.TraceID[:])
+	_, _ = rand.Read(tc.SpanID[:])
+	tc.Flags = 0x01
+	return tc
+}
+
+// ParseTraceparent parses a traceparent header value. It rejects unknown
+// formats and the all-zero IDs the spec declares invalid.
+func ParseTraceparent(v string) (TraceContext, bool) {
+	var tc TraceContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return tc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return tc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tc, false
+	}
+	if _, err := hex.Decode(tc.TraceID[:], []byte(parts[1])); err != nil {
+		return tc, false
+	}
+	if _, err := hex.Decode(tc.SpanID[:], []byte(parts[2])); err != nil {
+		return tc, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return tc, false
+	}
+	tc.Flags = flags[0]
+	if tc.TraceID == ([16]byte{}) || tc.SpanID == ([8]byte{}) {
+		return tc, false
+	}
+	return tc, true
+}
+
+// String renders the trace context as a version 00 traceparent value.
+func (tc TraceContext) String() string {
+	return fmt.Sprintf("00-%x-%x-%02x", tc.TraceID, tc.SpanID, tc.Flags)
+}
+
+// TraceIDString returns the trace ID in hex, for logging.
+func (tc TraceContext) TraceIDString() string {
+	return hex.EncodeToString(tc.TraceID[:])
+}
+
+// Child returns a trace context in the same trace with a fresh span ID.
+func (tc TraceContext) Child() TraceContext {
+	child := tc
+	_, _ = rand.Read(child.SpanID[:])
+	return child
+}
+
+// WithRequestID returns a context carrying id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID carried by ctx, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithTrace returns a context carrying tc.
+func WithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceKey, tc)
+}
+
+// Trace returns the trace context carried by ctx.
+func Trace(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceKey).(TraceContext)
+	return tc, ok
+}
+
+// FromRequest extracts (or creates) the request ID and trace context for an
+// incoming request and returns a context carrying both.
+func FromRequest(r *http.Request) context.Context {
+	ctx := r.Context()
+
+	id := strings.TrimSpace(r.Header.Get(RequestIDHeader))
+	if id == "" || len(id) > 128 {
+		id = NewRequestID()
+	}
+	ctx = WithRequestID(ctx, id)
+
+	tc, ok := ParseTraceparent(r.Header.Get(TraceparentHeader))
+	if ok {
+		tc.State = r.Header.Get(TracestateHeader)
+		// The proxy is a hop in the trace: give it its own span
+		tc = tc.Child()
+	} else {
+		tc = NewTrace()
+	}
+	return WithTrace(ctx, tc)
+}
+
+// Inject sets the request ID and a child traceparent from ctx on an outbound
+// request's headers. Headers are left untouched if ctx carries neither.
+func Inject(ctx context.Context, h http.Header) {
+	if id := RequestID(ctx); id != "" {
+		h.Set(RequestIDHeader, id)
+	}
+	if tc, ok := Trace(ctx); ok {
+		h.Set(TraceparentHeader, tc.Child().String())
+		if tc.State != "" {
+			h.Set(TracestateHeader, tc.State)
+		}
+	}
+}
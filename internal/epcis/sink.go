@@ -0,0 +1,157 @@
+// Package epcis publishes device lifecycle events to a GS1 EPCIS 2.0 capture
+// interface as JSON-LD ObjectEvents.
+package epcis
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/events"
+)
+
+const (
+	epcisContext = "https://ref.gs1.org/standards/epcis/2.0.0/epcis-context.jsonld"
+	// fdoNamespace qualifies the extension fields the proxy adds to events.
+	fdoNamespace = "https://fidoalliance.org/fdo/epcis#"
+)
+
+// Options configures the EPCIS sink.
+type Options struct {
+	// CaptureURL is the EPCIS 2.0 capture endpoint (usually ending in /capture).
+	CaptureURL string
+	// EPCTemplate maps a device GUID to its EPC; "{guid}" is replaced.
+	// Defaults to "urn:uuid:{guid}".
+	EPCTemplate string
+	// ReadPoint and BizLocation are optional location identifiers
+	// (e.g. SGLN URNs) attached to every event.
+	ReadPoint   string
+	BizLocation string
+	// Authorization, if set, is sent verbatim as the Authorization header.
+	Authorization string
+	Timeout       time.Duration
+}
+
+// Sink posts lifecycle events to an EPCIS repository.
+type Sink struct {
+	opts Options
+	http *http.Client
+}
+
+// NewSink creates an EPCIS sink. A non-positive timeout defaults to 10 seconds.
+func NewSink(opts Options) *Sink {
+	if opts.EPCTemplate == "" {
+		opts.EPCTemplate = "urn:uuid:{guid}"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	return &Sink{opts: opts, http: &http.Client{Timeout: opts.Timeout}}
+}
+
+// Name implements events.Sink.
+func (s *Sink) Name() string { return "epcis" }
+
+// Publish implements events.Sink. Event types without an EPCIS mapping are
+// ignored.
+func (s *Sink) Publish(ctx context.Context, ev *events.Event) error {
+	obj, ok := s.objectEvent(ev)
+	if !ok {
+		return nil
+	}
+	doc := map[string]any{
+		"@context":      []any{epcisContext, map[string]string{"fdo": fdoNamespace}},
+		"type":          "EPCISDocument",
+		"schemaVersion": "2.0",
+		"creationDate":  time.Now().UTC().Format(time.RFC3339Nano),
+		"epcisBody":     map[string]any{"eventList": []any{obj}},
+	}
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("encode EPCIS document: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.CaptureURL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/ld+json")
+	req.Header.Set("GS1-EPCIS-Version", "2.0.0")
+	if s.opts.Authorization != "" {
+		req.Header.Set("Authorization", s.opts.Authorization)
+	}
+	correlation.Inject(ctx, req.Header)
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("EPCIS capture: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("EPCIS capture status %d: %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+// objectEvent maps ev onto an EPCIS ObjectEvent using CBV business steps.
+func (s *Sink) objectEvent(ev *events.Event) (map[string]any, bool) {
+	var action, bizStep, disposition string
+	switch ev.Type {
+	case events.Commissioned:
+		action, bizStep, disposition = "ADD", "commissioning", "active"
+	case events.Decommissioned:
+		action, bizStep, disposition = "DELETE", "decommissioning", "inactive"
+	default:
+		return nil, false
+	}
+
+	t := ev.Time.UTC()
+	obj := map[string]any{
+		"type":                "ObjectEvent",
+		"eventID":             "urn:uuid:" + newUUID(),
+		"eventTime":           t.Format(time.RFC3339Nano),
+		"eventTimeZoneOffset": "+00:00",
+		"epcList":             []string{strings.ReplaceAll(s.opts.EPCTemplate, "{guid}", ev.GUID)},
+		"action":              action,
+		"bizStep":             bizStep,
+		"disposition":         disposition,
+		"fdo:guid":            ev.GUID,
+	}
+	if s.opts.ReadPoint != "" {
+		obj["readPoint"] = map[string]string{"id": s.opts.ReadPoint}
+	}
+	if s.opts.BizLocation != "" {
+		obj["bizLocation"] = map[string]string{"id": s.opts.BizLocation}
+	}
+	if ev.OwnerID != "" {
+		obj["fdo:owner"] = ev.OwnerID
+	}
+	if ev.Passport != nil && ev.Passport.Evidence != nil && ev.Passport.Evidence.VoucherHash != "" {
+		obj["fdo:voucherHash"] = ev.Passport.Evidence.VoucherHash
+	}
+	if ev.Reason != "" {
+		obj["fdo:reason"] = ev.Reason
+	}
+	if ev.Location != nil {
+		obj["fdo:location"] = ev.Location
+	}
+	return obj, true
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
@@ -0,0 +1,196 @@
+// Package events fans device lifecycle events (initialization, rendezvous
+// registration and its expiry, commissioning, decommissioning) out to
+// external sinks such as EPCIS repositories.
+// Delivery is asynchronous and best effort so sinks never hold up the FDO
+// exchange.
+package events
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/geo"
+	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/metrics"
+	"github.com/fdo-server-wrapper/internal/session"
+)
+
+// Type is the kind of lifecycle event.
+type Type string
+
+// Lifecycle event types.
+const (
+	Commissioned   Type = "commissioned"
+	Decommissioned Type = "decommissioned"
+	// Failed reports an onboarding attempt that did not complete.
+	Failed Type = "failed"
+	// Initialized reports a device that completed DI; its voucher is with
+	// the manufacturer backend.
+	Initialized Type = "initialized"
+	// Registered reports a device the owner registered at the rendezvous
+	// server (TO0), making it resolvable by TO1.
+	Registered Type = "registered"
+	// Expiring reports a registered device that has not completed TO2 and
+	// whose rendezvous registration is about to lapse.
+	Expiring Type = "registration_expiring"
+	// Anomaly reports unusual onboarding activity (see package anomaly),
+	// with the device whose onboarding revealed it.
+	Anomaly Type = "anomaly"
+)
+
+// Event describes a device lifecycle change.
+type Event struct {
+	Type      Type
+	GUID      string
+	OwnerID   string
+	Time      time.Time
+	RequestID string
+	// Passport is the commissioning passport built for the device. It was
+	// sent to the passport service only if PassportSent is set.
+	Passport     *ledger.CommissioningCreateRequest
+	PassportSent bool
+	// PassportErr is the commissioning passport creation failure, if any.
+	PassportErr error
+	// Session is a copy of the protocol session state, when one was tracked.
+	Session *session.Session
+	// Reason is an operator-supplied note for decommissioning, or the cause
+	// of a failed attempt.
+	Reason string
+
+	// Protocol is the FDO protocol of a failed attempt ("di", "to2").
+	Protocol string
+	// FailureKind classifies a failed attempt (see ledger.Failure*).
+	FailureKind string
+	// Stage is the FDO message type a failed attempt stopped at, if known.
+	Stage int
+	// ErrorCode is the FDO ErrorMessage code of a failed attempt, if any.
+	ErrorCode uint64
+	// ProductID identifies the device when no GUID is known yet.
+	ProductID string
+	// Serial is the device's serial number from DI.AppStart, when known;
+	// a DI attempt that failed has no GUID to go by.
+	Serial string
+	// Tags are the device's tags, when known (see package tags).
+	Tags []string
+	// Location is where the device's source address is located, when a
+	// GeoIP database is configured and knows it.
+	Location *geo.Location
+	// WaitSeconds is how long the rendezvous server keeps a registration,
+	// when known; for Expiring, how long it has left.
+	WaitSeconds int
+	// AnomalyKind classifies an Anomaly (see anomaly.Kinds); Reason
+	// describes it.
+	AnomalyKind string
+}
+
+// Sink receives lifecycle events.
+type Sink interface {
+	// Name identifies the sink in logs and metrics.
+	Name() string
+	Publish(ctx context.Context, ev *Event) error
+}
+
+var deliveries = metrics.Default.NewCounterVec(
+	"fdo_proxy_event_deliveries_total",
+	"Lifecycle event deliveries by sink and outcome (success, error, skipped).",
+	"sink", "outcome")
+
+// Bus delivers each published event to every subscribed sink.
+type Bus struct {
+	mu      sync.RWMutex
+	sinks   []Sink
+	timeout time.Duration
+	gate    func(sink string) bool
+	wg      sync.WaitGroup
+}
+
+// NewBus creates a bus whose deliveries are bounded by timeout. A
+// non-positive timeout defaults to 30 seconds.
+func NewBus(timeout time.Duration) *Bus {
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return &Bus{timeout: timeout}
+}
+
+// Subscribe adds s to the bus.
+func (b *Bus) Subscribe(s Sink) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sinks = append(b.sinks, s)
+}
+
+// Gate has events delivered only to the sinks for whose name allow
+// returns true, checked on every publish. Others count as skipped.
+func (b *Bus) Gate(allow func(sink string) bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.gate = allow
+}
+
+// Names returns the names of the subscribed sinks. A nil bus has none.
+func (b *Bus) Names() []string {
+	if b == nil {
+		return nil
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	names := make([]string, len(b.sinks))
+	for i, s := range b.sinks {
+		names[i] = s.Name()
+	}
+	return names
+}
+
+// Len returns the number of subscribed sinks. A nil bus has none.
+func (b *Bus) Len() int {
+	if b == nil {
+		return 0
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.sinks)
+}
+
+// Publish hands ev to every sink in the background. Values carried by ctx
+// (e.g. the request ID) are kept, but its cancellation is not, so a finished
+// HTTP exchange doesn't abort delivery. Publishing on a nil bus is a no-op.
+func (b *Bus) Publish(ctx context.Context, ev *Event) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	sinks := append([]Sink(nil), b.sinks...)
+	gate := b.gate
+	b.mu.RUnlock()
+
+	base := context.WithoutCancel(ctx)
+	for _, s := range sinks {
+		if gate != nil && !gate(s.Name()) {
+			deliveries.Inc(s.Name(), "skipped")
+			continue
+		}
+		b.wg.Add(1)
+		go func(s Sink) {
+			defer b.wg.Done()
+			ctx, cancel := context.WithTimeout(base, b.timeout)
+			defer cancel()
+			if err := s.Publish(ctx, ev); err != nil {
+				deliveries.Inc(s.Name(), "error")
+				slog.Warn("Event delivery failed", "sink", s.Name(), "type", ev.Type, "guid", ev.GUID, "error", err)
+				return
+			}
+			deliveries.Inc(s.Name(), "success")
+		}(s)
+	}
+}
+
+// Wait blocks until in-flight deliveries finish.
+func (b *Bus) Wait() {
+	if b == nil {
+		return
+	}
+	b.wg.Wait()
+}
@@ -0,0 +1,122 @@
+package fdo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/fdo-server-wrapper/internal/cbor"
+)
+
+// COSE and EAT labels used in TO2.ProveDevice.
+const (
+	coseHeaderAlg = 1
+	eatNonce      = 10
+	eatUEID       = 256
+	eatFDO        = -257
+	euphNonce     = -259
+)
+
+// ProveDevice is the attestation evidence carried by TO2.ProveDevice (msg 64).
+type ProveDevice struct {
+	// Alg is the COSE signature algorithm from the protected header, or 0
+	// if absent.
+	Alg int64
+	// Nonce is the EAT-NONCE claim (NonceTO2ProveDv).
+	Nonce []byte
+	// SetupNonce is the EUPHNonce unprotected header (NonceTO2SetupDv).
+	SetupNonce []byte
+	// UEID is the EAT-UEID claim: a type byte followed by the device GUID.
+	UEID []byte
+	// ClaimsDigest is the hex SHA-256 of the encoded claims (the payload).
+	ClaimsDigest string
+	// HasFDOClaim reports whether the EAT-FDO claim (xBKeyExchange) is present.
+	HasFDOClaim bool
+}
+
+// GUID returns the device GUID encoded in the UEID claim, if any.
+func (p *ProveDevice) GUID() (GUID, bool) {
+	var g GUID
+	if len(p.UEID) != 1+len(g) {
+		return g, false
+	}
+	copy(g[:], p.UEID[1:])
+	return g, true
+}
+
+// DecodeProveDevice parses a TO2.ProveDevice request body, an Entity
+// Attestation Token signed as COSE_Sign1 whose payload is the claims map:
+//
+//	{EAT-UEID: bytes, EAT-NONCE: NonceTO2ProveDv, EAT-FDO: [xBKeyExchange], ...}
+//
+// and whose unprotected header carries EUPHNonce.
+func DecodeProveDevice(body []byte) (*ProveDevice, error) {
+	s, err := decodeSign1(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var p ProveDevice
+	sum := sha256.Sum256(s.payload)
+	p.ClaimsDigest = hex.EncodeToString(sum[:])
+
+	if raw, ok := label(s.protected, coseHeaderAlg); ok {
+		if v, err := cbor.Decode(raw); err == nil {
+			p.Alg, _ = cbor.Int(v)
+		}
+	}
+	if raw, ok := label(s.unprotected, euphNonce); ok {
+		p.SetupNonce, _ = cbor.Bytes(raw)
+	}
+
+	claims, err := cbor.MapRaw(s.payload)
+	if err != nil {
+		return nil, fmt.Errorf("fdo: ProveDevice claims: %w", err)
+	}
+	if raw, ok := label(claims, eatNonce); ok {
+		p.Nonce, _ = cbor.Bytes(raw)
+	}
+	if raw, ok := label(claims, eatUEID); ok {
+		p.UEID, _ = cbor.Bytes(raw)
+	}
+	_, p.HasFDOClaim = label(claims, eatFDO)
+	return &p, nil
+}
+
+// SigAlgName returns the name of a device attestation signature type, as
+// used in eASigInfo and the COSE alg header.
+func SigAlgName(alg int64) string {
+	switch alg {
+	case -7:
+		return "ES256"
+	case -35:
+		return "ES384"
+	case -257:
+		return "RS256"
+	case -258:
+		return "RS384"
+	case -37:
+		return "PS256"
+	case -38:
+		return "PS384"
+	case 90:
+		return "EPID10"
+	case 91:
+		return "EPID11"
+	}
+	return fmt.Sprintf("unknown(%d)", alg)
+}
+
+// AttestationType classifies a device attestation signature type as
+// "ecdsa", "rsa" or "epid".
+func AttestationType(alg int64) string {
+	switch alg {
+	case -7, -35:
+		return "ecdsa"
+	case -257, -258, -37, -38:
+		return "rsa"
+	case 90, 91:
+		return "epid"
+	}
+	return "unknown"
+}
@@ -0,0 +1,67 @@
+package fdo
+
+import (
+	"fmt"
+
+	"github.com/fdo-server-wrapper/internal/cbor"
+)
+
+// coseSign1 is the decoded outer structure of a COSE_Sign1 message.
+// Signatures are not verified; the backend does that.
+type coseSign1 struct {
+	protected   map[any][]byte
+	unprotected map[any][]byte
+	payload     []byte
+	signature   []byte
+}
+
+// decodeSign1 parses a (possibly tag 18 wrapped) COSE_Sign1 structure.
+func decodeSign1(b []byte) (*coseSign1, error) {
+	items, err := cbor.ArrayRaw(b)
+	if err != nil {
+		return nil, fmt.Errorf("fdo: COSE_Sign1: %w", err)
+	}
+	if len(items) != 4 {
+		return nil, fmt.Errorf("fdo: COSE_Sign1 has %d elements", len(items))
+	}
+
+	var s coseSign1
+	protected, err := cbor.Bytes(items[0])
+	if err != nil {
+		return nil, fmt.Errorf("fdo: COSE_Sign1 protected header: %w", err)
+	}
+	if len(protected) > 0 {
+		if s.protected, err = cbor.MapRaw(protected); err != nil {
+			return nil, fmt.Errorf("fdo: COSE_Sign1 protected header: %w", err)
+		}
+	}
+	if s.unprotected, err = cbor.MapRaw(items[1]); err != nil {
+		return nil, fmt.Errorf("fdo: COSE_Sign1 unprotected header: %w", err)
+	}
+	if s.payload, err = cbor.Bytes(items[2]); err != nil {
+		return nil, fmt.Errorf("fdo: COSE_Sign1 payload: %w", err)
+	}
+	if s.signature, err = cbor.Bytes(items[3]); err != nil {
+		return nil, fmt.Errorf("fdo: COSE_Sign1 signature: %w", err)
+	}
+	return &s, nil
+}
+
+// label looks up an integer header label, which decodes as uint64 when
+// non-negative and int64 otherwise.
+func label(m map[any][]byte, l int64) ([]byte, bool) {
+	if l >= 0 {
+		v, ok := m[uint64(l)]
+		return v, ok
+	}
+	v, ok := m[l]
+	return v, ok
+}
+
+// bstrOrRaw unwraps a "bstr .cbor" field, accepting the bare encoding too.
+func bstrOrRaw(raw []byte) []byte {
+	if b, err := cbor.Bytes(raw); err == nil {
+		return b
+	}
+	return raw
+}
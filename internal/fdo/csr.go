@@ -0,0 +1,116 @@
+package fdo
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fdo-server-wrapper/internal/cbor"
+)
+
+// CSRModule is the FDO ServiceInfo module for certificate enrollment (EST
+// carried over ServiceInfo).
+const CSRModule = "fdo.csr"
+
+// IsCSRCertResponse reports whether kv is an fdo.csr owner message that
+// carries an issued device certificate.
+func IsCSRCertResponse(kv ServiceInfoKV) bool {
+	if kv.Module() != CSRModule {
+		return false
+	}
+	switch kv.Message() {
+	case "simpleenroll-res", "simplereenroll-res", "serverkeygen-res":
+		return true
+	}
+	return false
+}
+
+// DecodeCSRCertificates extracts the certificates from an fdo.csr enrollment
+// response value. The value is a byte or text string holding either a DER
+// certificate, a PEM bundle, or an EST-style (base64) PKCS#7 certs-only
+// structure.
+func DecodeCSRCertificates(value []byte) ([]*x509.Certificate, error) {
+	v, err := cbor.Decode(value)
+	if err != nil {
+		return nil, fmt.Errorf("fdo: fdo.csr value: %w", err)
+	}
+
+	var data []byte
+	switch t := v.(type) {
+	case []byte:
+		data = t
+	case string:
+		data = []byte(t)
+	default:
+		return nil, fmt.Errorf("fdo: fdo.csr value has type %T", v)
+	}
+
+	// PEM bundle
+	if strings.Contains(string(data), "-----BEGIN") {
+		var certs []*x509.Certificate
+		for rest := data; ; {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if c, err := x509.ParseCertificate(block.Bytes); err == nil {
+				certs = append(certs, c)
+			} else if cs, err := parsePKCS7Certs(block.Bytes); err == nil {
+				certs = append(certs, cs...)
+			}
+		}
+		if len(certs) == 0 {
+			return nil, errors.New("fdo: fdo.csr PEM holds no certificates")
+		}
+		return certs, nil
+	}
+
+	// EST transfers PKCS#7 base64-encoded
+	if decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), "")); err == nil {
+		data = decoded
+	}
+	if c, err := x509.ParseCertificate(data); err == nil {
+		return []*x509.Certificate{c}, nil
+	}
+	return parsePKCS7Certs(data)
+}
+
+var oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+// parsePKCS7Certs pulls the certificates out of a degenerate (certs-only)
+// PKCS#7 SignedData structure as returned by EST simpleenroll.
+func parsePKCS7Certs(der []byte) ([]*x509.Certificate, error) {
+	var ci struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"explicit,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, fmt.Errorf("fdo: PKCS#7: %w", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, errors.New("fdo: PKCS#7: not SignedData")
+	}
+
+	var sd struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      asn1.RawValue
+		Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("fdo: PKCS#7 SignedData: %w", err)
+	}
+	if len(sd.Certificates.Bytes) == 0 {
+		return nil, errors.New("fdo: PKCS#7 holds no certificates")
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("fdo: PKCS#7 certificates: %w", err)
+	}
+	return certs, nil
+}
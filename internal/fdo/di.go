@@ -0,0 +1,116 @@
+package fdo
+
+import (
+	"fmt"
+
+	"github.com/fdo-server-wrapper/internal/cbor"
+)
+
+// AppStart is the subset of DI.AppStart (msg 10) the proxy records.
+type AppStart struct {
+	SerialNumber string
+	DeviceInfo   string
+	// ProductID is the product item UUID in canonical form, empty if
+	// DeviceMfgInfo names none.
+	ProductID string
+}
+
+// productIDKey is the DeviceMfgInfo map key naming the product item.
+const productIDKey = "productId"
+
+// DecodeAppStart parses a DI.AppStart request body, [DeviceMfgInfo].
+// DeviceMfgInfo is manufacturer specific; the common encoding (used by the
+// reference implementation) is a bstr-wrapped array
+//
+//	[KeyType, KeyEncoding, (KeyHashAlg,) SerialNumber, DeviceInfo, CertInfo]
+//
+// so the first two text strings are taken as serial number and device info.
+// Lines linking devices to product item passports add a map element
+//
+//	{"productId": UUID}
+//
+// with the UUID as a 16-byte bstr or a text string; one that is not a UUID
+// is ignored.
+func DecodeAppStart(body []byte) (*AppStart, error) {
+	items, err := cbor.ArrayRaw(body)
+	if err != nil || len(items) < 1 {
+		return nil, fmt.Errorf("fdo: AppStart: unexpected structure")
+	}
+	v, err := cbor.Decode(bstrOrRaw(items[0]))
+	if err != nil {
+		return nil, fmt.Errorf("fdo: AppStart DeviceMfgInfo: %w", err)
+	}
+	info, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("fdo: AppStart DeviceMfgInfo: unexpected structure")
+	}
+
+	var a AppStart
+	var texts []string
+	for _, f := range info {
+		switch f := f.(type) {
+		case string:
+			texts = append(texts, f)
+		case map[any]any:
+			if a.ProductID == "" {
+				a.ProductID = productID(f[productIDKey])
+			}
+		}
+	}
+	if len(texts) == 0 || texts[0] == "" {
+		return nil, fmt.Errorf("fdo: AppStart DeviceMfgInfo: no serial number")
+	}
+	a.SerialNumber = texts[0]
+	if len(texts) > 1 {
+		a.DeviceInfo = texts[1]
+	}
+	return &a, nil
+}
+
+// SetCredentials is the subset of DI.SetCredentials (msg 11) the proxy
+// records.
+type SetCredentials struct {
+	// GUID is taken from the voucher header.
+	GUID GUID
+}
+
+// DecodeSetCredentials parses a DI.SetCredentials response body, [OVHeader].
+func DecodeSetCredentials(body []byte) (*SetCredentials, error) {
+	items, err := cbor.ArrayRaw(body)
+	if err != nil || len(items) < 1 {
+		return nil, fmt.Errorf("fdo: SetCredentials: unexpected structure")
+	}
+	hdr, err := cbor.Decode(bstrOrRaw(items[0]))
+	if err != nil {
+		return nil, fmt.Errorf("fdo: SetCredentials OVHeader: %w", err)
+	}
+	// OVHeader = [OVHProtVer, OVGuid, OVRVInfo, OVDeviceInfo, OVPubKey, OVDevCertChainHash]
+	arr, ok := hdr.([]any)
+	if !ok || len(arr) < 2 {
+		return nil, fmt.Errorf("fdo: SetCredentials OVHeader: unexpected structure")
+	}
+	var sc SetCredentials
+	if sc.GUID, err = guidFrom(arr[1]); err != nil {
+		return nil, fmt.Errorf("fdo: SetCredentials: %w", err)
+	}
+	return &sc, nil
+}
+
+// productID returns the product item UUID v encodes, or "".
+func productID(v any) string {
+	switch v := v.(type) {
+	case []byte:
+		g, err := guidFrom(v)
+		if err != nil {
+			return ""
+		}
+		return g.String()
+	case string:
+		g, err := ParseGUID(v)
+		if err != nil {
+			return ""
+		}
+		return g.String()
+	}
+	return ""
+}
@@ -0,0 +1,56 @@
+package fdo
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// AppStart bodies as devices send them: [bstr DeviceMfgInfo], with
+// DeviceMfgInfo = [10 (SECP256R1), 1 (X509), "SN-0001", "onie-x86",
+// h'3081' (CSR, truncated)] plus, where noted, a {"productId": ...} map.
+const (
+	appStartNoProduct   = "8157850a0167534e2d30303031686f6e69652d783836423081"
+	appStartProductBstr = "815833860a0167534e2d30303031686f6e69652d783836423081a16970726f647563744964503f2504e04f8941d39a0c0305e82c3301"
+	appStartProductText = "815848860a0167534e2d30303031686f6e69652d783836423081a16970726f647563744964782433463235303445302d344638392d343144332d394130432d303330354538324333333031"
+	appStartProductBad  = "81582d860a0167534e2d30303031686f6e69652d783836423081a16970726f6475637449646a6e6f742d612d75756964"
+)
+
+func TestDecodeAppStart(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		productID string
+	}{
+		{"no product", appStartNoProduct, ""},
+		{"product bstr", appStartProductBstr, "3f2504e0-4f89-41d3-9a0c-0305e82c3301"},
+		{"product text", appStartProductText, "3f2504e0-4f89-41d3-9a0c-0305e82c3301"},
+		{"product not a UUID", appStartProductBad, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := hex.DecodeString(tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, err := DecodeAppStart(body)
+			if err != nil {
+				t.Fatalf("DecodeAppStart: %v", err)
+			}
+			if a.SerialNumber != "SN-0001" || a.DeviceInfo != "onie-x86" {
+				t.Errorf("serial, device info = %q, %q, want SN-0001, onie-x86", a.SerialNumber, a.DeviceInfo)
+			}
+			if a.ProductID != tt.productID {
+				t.Errorf("ProductID = %q, want %q", a.ProductID, tt.productID)
+			}
+		})
+	}
+}
+
+func TestDecodeAppStartMalformed(t *testing.T) {
+	for _, body := range []string{"", "80", "8140", "81418a"} {
+		b, _ := hex.DecodeString(body)
+		if _, err := DecodeAppStart(b); err == nil {
+			t.Errorf("DecodeAppStart(%s) succeeded", body)
+		}
+	}
+}
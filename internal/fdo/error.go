@@ -0,0 +1,92 @@
+package fdo
+
+import (
+	"fmt"
+
+	"github.com/fdo-server-wrapper/internal/cbor"
+)
+
+// FDO error codes (EMErrorCode).
+const (
+	CodeInvalidJWTToken         = 1
+	CodeInvalidOwnershipVoucher = 2
+	CodeInvalidOwnerSignBody    = 3
+	CodeInvalidIPAddress        = 4
+	CodeInvalidGUID             = 5
+	CodeResourceNotFound        = 6
+	CodeMessageBodyError        = 100
+	CodeInvalidMessageError     = 101
+	CodeCredReuseError          = 102
+	CodeInternalServerError     = 500
+)
+
+// ErrorMessage is an FDO ErrorMessage (msg 255).
+type ErrorMessage struct {
+	Code      uint64
+	PrevMsgID uint64
+	Message   string
+	// CorrelationID lets the sender find the error in its logs.
+	CorrelationID uint64
+}
+
+// DecodeErrorMessage parses an ErrorMessage body:
+//
+//	[EMErrorCode, EMPrevMsgID, EMErrorStr, EMErrorTs, EMErrorCID]
+func DecodeErrorMessage(body []byte) (*ErrorMessage, error) {
+	v, err := cbor.Decode(body)
+	if err != nil {
+		return nil, fmt.Errorf("fdo: ErrorMessage: %w", err)
+	}
+	arr, ok := v.([]any)
+	if !ok || len(arr) < 3 {
+		return nil, fmt.Errorf("fdo: ErrorMessage: unexpected structure")
+	}
+	var e ErrorMessage
+	e.Code, _ = arr[0].(uint64)
+	e.PrevMsgID, _ = arr[1].(uint64)
+	e.Message, _ = arr[2].(string)
+	if len(arr) > 4 {
+		e.CorrelationID, _ = arr[4].(uint64)
+	}
+	return &e, nil
+}
+
+// EncodeErrorMessage encodes e as an ErrorMessage body, without a
+// timestamp.
+func EncodeErrorMessage(e *ErrorMessage) []byte {
+	// Every field has an encodable type, so Marshal cannot fail
+	b, _ := cbor.Marshal([]any{e.Code, e.PrevMsgID, e.Message, nil, e.CorrelationID})
+	return b
+}
+
+// String formats the error for logs and records.
+func (e *ErrorMessage) String() string {
+	return fmt.Sprintf("error %d (%s) after msg %d: %s", e.Code, ErrorCodeName(e.Code), e.PrevMsgID, e.Message)
+}
+
+// ErrorCodeName returns the name of an FDO error code.
+func ErrorCodeName(code uint64) string {
+	switch code {
+	case CodeInvalidJWTToken:
+		return "INVALID_JWT_TOKEN"
+	case CodeInvalidOwnershipVoucher:
+		return "INVALID_OWNERSHIP_VOUCHER"
+	case CodeInvalidOwnerSignBody:
+		return "INVALID_OWNER_SIGN_BODY"
+	case CodeInvalidIPAddress:
+		return "INVALID_IP_ADDRESS"
+	case CodeInvalidGUID:
+		return "INVALID_GUID"
+	case CodeResourceNotFound:
+		return "RESOURCE_NOT_FOUND"
+	case CodeMessageBodyError:
+		return "MESSAGE_BODY_ERROR"
+	case CodeInvalidMessageError:
+		return "INVALID_MESSAGE_ERROR"
+	case CodeCredReuseError:
+		return "CRED_REUSE_ERROR"
+	case CodeInternalServerError:
+		return "INTERNAL_SERVER_ERROR"
+	}
+	return "UNKNOWN"
+}
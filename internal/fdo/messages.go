@@ -0,0 +1,226 @@
+// Package fdo decodes the parts of FIDO Device Onboard 1.1 messages the proxy
+// inspects. It is deliberately partial: only fields used by middleware are
+// extracted, and message bodies are never modified.
+package fdo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/fdo-server-wrapper/internal/cbor"
+)
+
+// FDO message type numbers.
+const (
+	MsgDIAppStart       = 10
+	MsgDISetCredentials = 11
+	MsgDISetHMAC        = 12
+	MsgDIDone           = 13
+
+	MsgTO0Hello       = 20
+	MsgTO0AcceptOwner = 23
+
+	MsgTO1HelloRV    = 30
+	MsgTO1RVRedirect = 33
+
+	MsgTO2HelloDevice            = 60
+	MsgTO2ProveOVHdr             = 61
+	MsgTO2GetOVNextEntry         = 62
+	MsgTO2OVNextEntry            = 63
+	MsgTO2ProveDevice            = 64
+	MsgTO2SetupDevice            = 65
+	MsgTO2DeviceServiceInfoReady = 66
+	MsgTO2OwnerServiceInfoReady  = 67
+	MsgTO2DeviceServiceInfo      = 68
+	MsgTO2OwnerServiceInfo       = 69
+	MsgTO2Done                   = 70
+	MsgTO2Done2                  = 71
+
+	MsgError = 255
+)
+
+// ErrEncrypted is returned when a message body is a COSE encryption or MAC
+// structure. TO2 messages after ProveDevice are protected with session keys
+// the proxy does not hold, so their contents can't be inspected.
+var ErrEncrypted = errors.New("fdo: message is encrypted")
+
+// GUID is a 16-byte FDO device GUID.
+type GUID [16]byte
+
+// String formats the GUID in canonical UUID form.
+func (g GUID) String() string {
+	h := hex.EncodeToString(g[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// ParseGUID parses a GUID in canonical UUID form, or as 32 hex digits.
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	h := s
+	if len(s) == 36 && s[8] == '-' && s[13] == '-' && s[18] == '-' && s[23] == '-' {
+		h = s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:36]
+	}
+	if len(h) != 2*len(g) {
+		return g, fmt.Errorf("fdo: invalid GUID %q", s)
+	}
+	if _, err := hex.Decode(g[:], []byte(h)); err != nil {
+		return g, fmt.Errorf("fdo: invalid GUID %q", s)
+	}
+	return g, nil
+}
+
+func guidFrom(v any) (GUID, error) {
+	var g GUID
+	b, ok := v.([]byte)
+	if !ok || len(b) != len(g) {
+		return g, fmt.Errorf("fdo: invalid GUID")
+	}
+	copy(g[:], b)
+	return g, nil
+}
+
+// msgPrefix is the path of FDO messages, followed by the message type.
+const msgPrefix = "/fdo/101/msg/"
+
+// MessageType parses the message number from an /fdo/101/msg/{type} path.
+// Only the canonical form returned by CanonicalPath matches.
+func MessageType(p string) (int, bool) {
+	c, ok := CanonicalPath(p)
+	if !ok || c != p || !strings.HasPrefix(c, msgPrefix) {
+		return 0, false
+	}
+	n, _ := strconv.Atoi(c[len(msgPrefix):])
+	return n, true
+}
+
+// CanonicalPath resolves the spellings of a request path that HTTP servers
+// route alike: repeated slashes and dot segments, and for FDO messages a
+// trailing slash and leading zeros in the message type. It returns false
+// for a path under /fdo/ that is still not a message path, or one holding a
+// message path further down, which a backend might route in ways the proxy
+// cannot follow.
+func CanonicalPath(p string) (string, bool) {
+	c := path.Clean("/" + p)
+	if strings.Contains(c[1:], msgPrefix) {
+		return c, false
+	}
+	if c != "/fdo" && !strings.HasPrefix(c, "/fdo/") {
+		// Keep the trailing slash, as servers route it apart
+		if strings.HasSuffix(p, "/") && c != "/" {
+			c += "/"
+		}
+		return c, true
+	}
+	rest, ok := strings.CutPrefix(c, msgPrefix)
+	if !ok || rest == "" || strings.Trim(rest, "0123456789") != "" {
+		return c, false
+	}
+	n, err := strconv.Atoi(rest)
+	if err != nil || n > 255 {
+		return c, false
+	}
+	return msgPrefix + strconv.Itoa(n), true
+}
+
+// Protocol names the FDO protocol a message type belongs to ("di", "to0",
+// "to1", "to2"), or "" for ErrorMessage and unknown types.
+func Protocol(msgType int) string {
+	switch {
+	case msgType >= MsgDIAppStart && msgType <= MsgDIDone:
+		return "di"
+	case msgType >= MsgTO0Hello && msgType <= MsgTO0AcceptOwner:
+		return "to0"
+	case msgType >= MsgTO1HelloRV && msgType <= MsgTO1RVRedirect:
+		return "to1"
+	case msgType >= MsgTO2HelloDevice && msgType <= MsgTO2Done2:
+		return "to2"
+	}
+	return ""
+}
+
+// SessionToken returns the session token from an Authorization header,
+// without any "Bearer " prefix.
+func SessionToken(h http.Header) string {
+	v := strings.TrimSpace(h.Get("Authorization"))
+	if len(v) > 7 && strings.EqualFold(v[:7], "bearer ") {
+		v = strings.TrimSpace(v[7:])
+	}
+	return v
+}
+
+// Hash returns the hex SHA-256 digest of b.
+func Hash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// IsEncrypted reports whether body looks like a COSE_Encrypt0 or COSE_Mac0
+// structure rather than a plaintext message.
+func IsEncrypted(body []byte) bool {
+	v, err := cbor.Decode(body)
+	if err != nil {
+		return false
+	}
+	if t, ok := v.(cbor.Tag); ok {
+		switch t.Number {
+		case 16, 17: // COSE_Encrypt0, COSE_Mac0
+			return true
+		}
+		v = t.Content
+	}
+	// Untagged COSE structures start with the protected header bstr; no
+	// plaintext TO2 message that reaches the encrypted phase does
+	arr, ok := v.([]any)
+	if !ok || len(arr) < 3 {
+		return false
+	}
+	_, isBstr := arr[0].([]byte)
+	_, isMap := arr[1].(map[any]any)
+	return isBstr && isMap
+}
+
+// IsEncryptedPrefix is IsEncrypted for the leading bytes of a body too large
+// to inspect whole. COSE structures open with their protected and
+// unprotected headers, which are small enough for any practical prefix.
+func IsEncryptedPrefix(prefix []byte) bool {
+	major, arg, rest, err := cbor.Head(prefix)
+	if err != nil {
+		return false
+	}
+	if major == 6 { // tag
+		if arg == 16 || arg == 17 { // COSE_Encrypt0, COSE_Mac0
+			return true
+		}
+		if major, arg, rest, err = cbor.Head(rest); err != nil {
+			return false
+		}
+	}
+	if major != 4 || (arg >= 0 && arg < 3) { // array of at least 3
+		return false
+	}
+	protected, rest, err := cbor.Next(rest)
+	if err != nil {
+		return false
+	}
+	unprotected, _, err := cbor.Next(rest)
+	if err != nil {
+		return false
+	}
+	p, err := cbor.Decode(protected)
+	if err != nil {
+		return false
+	}
+	u, err := cbor.Decode(unprotected)
+	if err != nil {
+		return false
+	}
+	_, isBstr := p.([]byte)
+	_, isMap := u.(map[any]any)
+	return isBstr && isMap
+}
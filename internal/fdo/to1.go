@@ -0,0 +1,29 @@
+package fdo
+
+import (
+	"fmt"
+
+	"github.com/fdo-server-wrapper/internal/cbor"
+)
+
+// HelloRV is the subset of TO1.HelloRV (msg 30) the proxy records.
+type HelloRV struct {
+	GUID GUID
+}
+
+// DecodeHelloRV parses a TO1.HelloRV request body, [Guid, eASigInfo].
+func DecodeHelloRV(body []byte) (*HelloRV, error) {
+	v, err := cbor.Decode(body)
+	if err != nil {
+		return nil, fmt.Errorf("fdo: HelloRV: %w", err)
+	}
+	arr, ok := v.([]any)
+	if !ok || len(arr) < 2 {
+		return nil, fmt.Errorf("fdo: HelloRV: unexpected structure")
+	}
+	var h HelloRV
+	if h.GUID, err = guidFrom(arr[0]); err != nil {
+		return nil, fmt.Errorf("fdo: HelloRV: %w", err)
+	}
+	return &h, nil
+}
@@ -0,0 +1,189 @@
+package fdo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fdo-server-wrapper/internal/cbor"
+)
+
+// cuphOwnerPubKey is the TO2.ProveOVHdr unprotected header label carrying
+// the owner public key.
+const cuphOwnerPubKey = 257
+
+// HelloDevice is the subset of TO2.HelloDevice (msg 60) the proxy records.
+type HelloDevice struct {
+	MaxDeviceMessageSize uint64
+	GUID                 GUID
+	// Nonce is NonceTO2ProveOV, which the device picks for the session.
+	Nonce       []byte
+	KexSuite    string
+	CipherSuite int64
+	SigType     int64
+}
+
+// DecodeHelloDevice parses a TO2.HelloDevice request body:
+//
+//	[maxDeviceMessageSize, Guid, NonceTO2ProveOV, kexSuiteName, cipherSuiteName, eASigInfo]
+func DecodeHelloDevice(body []byte) (*HelloDevice, error) {
+	v, err := cbor.Decode(body)
+	if err != nil {
+		return nil, fmt.Errorf("fdo: HelloDevice: %w", err)
+	}
+	arr, ok := v.([]any)
+	if !ok || len(arr) < 6 {
+		return nil, fmt.Errorf("fdo: HelloDevice: unexpected structure")
+	}
+
+	var h HelloDevice
+	h.MaxDeviceMessageSize, _ = arr[0].(uint64)
+	if h.GUID, err = guidFrom(arr[1]); err != nil {
+		return nil, fmt.Errorf("fdo: HelloDevice: %w", err)
+	}
+	h.Nonce, _ = arr[2].([]byte)
+	h.KexSuite, _ = arr[3].(string)
+	h.CipherSuite, _ = cbor.Int(arr[4])
+	if sig, ok := arr[5].([]any); ok && len(sig) > 0 {
+		h.SigType, _ = cbor.Int(sig[0])
+	}
+	return &h, nil
+}
+
+// ProveOVHdr is the subset of TO2.ProveOVHdr (msg 61) the proxy records.
+type ProveOVHdr struct {
+	// OVHeader is the CBOR encoding of the ownership voucher header.
+	OVHeader []byte
+	// GUID is taken from the voucher header.
+	GUID GUID
+	// NumOVEntries is the number of entries in the voucher.
+	NumOVEntries uint64
+	// OwnerPubKey is the CBOR encoding of the owner public key (CUPHOwnerPubKey).
+	OwnerPubKey []byte
+}
+
+// DecodeProveOVHdr parses a TO2.ProveOVHdr response body, a COSE_Sign1 whose
+// payload is:
+//
+//	[OVHeader, NumOVEntries, HMac, NonceTO2ProveOV, eBSigInfo, xAKeyExchange, helloDeviceHash, maxOwnerMessageSize]
+//
+// and whose unprotected header carries the owner public key.
+func DecodeProveOVHdr(body []byte) (*ProveOVHdr, error) {
+	s, err := decodeSign1(body)
+	if err != nil {
+		return nil, err
+	}
+	items, err := cbor.ArrayRaw(s.payload)
+	if err != nil || len(items) < 2 {
+		return nil, fmt.Errorf("fdo: ProveOVHdr payload: unexpected structure")
+	}
+
+	var p ProveOVHdr
+	p.OVHeader = bstrOrRaw(items[0])
+	if n, err := cbor.Decode(items[1]); err == nil {
+		p.NumOVEntries, _ = n.(uint64)
+	}
+	if hdr, err := cbor.Decode(p.OVHeader); err == nil {
+		// OVHeader = [OVHProtVer, OVGuid, OVRVInfo, OVDeviceInfo, OVPubKey, OVDevCertChainHash]
+		if arr, ok := hdr.([]any); ok && len(arr) > 1 {
+			p.GUID, _ = guidFrom(arr[1])
+		}
+	}
+	if key, ok := label(s.unprotected, cuphOwnerPubKey); ok {
+		p.OwnerPubKey = key
+	}
+	return &p, nil
+}
+
+// ServiceInfoKV is a single ServiceInfo key/value pair.
+type ServiceInfoKV struct {
+	// Key is the full "module:message" key.
+	Key string
+	// Value is the CBOR encoding of the value.
+	Value []byte
+}
+
+// Module returns the module name portion of the key.
+func (kv ServiceInfoKV) Module() string {
+	if i := strings.IndexByte(kv.Key, ':'); i >= 0 {
+		return kv.Key[:i]
+	}
+	return kv.Key
+}
+
+// Message returns the message name portion of the key.
+func (kv ServiceInfoKV) Message() string {
+	if i := strings.IndexByte(kv.Key, ':'); i >= 0 {
+		return kv.Key[i+1:]
+	}
+	return ""
+}
+
+// DecodeServiceInfo parses the ServiceInfo list from a TO2.DeviceServiceInfo
+// (msg 68) or TO2.OwnerServiceInfo (msg 69) body:
+//
+//	68: [IsMoreServiceInfo, ServiceInfo]
+//	69: [IsMoreServiceInfo, IsDone, ServiceInfo]
+//
+// It returns ErrEncrypted when the body is protected with session keys.
+func DecodeServiceInfo(msgType int, body []byte) ([]ServiceInfoKV, error) {
+	if IsEncrypted(body) {
+		return nil, ErrEncrypted
+	}
+	items, err := cbor.ArrayRaw(body)
+	if err != nil {
+		return nil, fmt.Errorf("fdo: ServiceInfo: %w", err)
+	}
+
+	idx := 1
+	if msgType == MsgTO2OwnerServiceInfo {
+		idx = 2
+	}
+	if len(items) <= idx {
+		return nil, fmt.Errorf("fdo: ServiceInfo: unexpected structure")
+	}
+
+	entries, err := cbor.ArrayRaw(items[idx])
+	if err != nil {
+		return nil, fmt.Errorf("fdo: ServiceInfo: %w", err)
+	}
+	kvs := make([]ServiceInfoKV, 0, len(entries))
+	for _, e := range entries {
+		pair, err := cbor.ArrayRaw(e)
+		if err != nil || len(pair) != 2 {
+			return nil, fmt.Errorf("fdo: ServiceInfo: malformed key/value")
+		}
+		k, err := cbor.Decode(pair[0])
+		if err != nil {
+			return nil, fmt.Errorf("fdo: ServiceInfo key: %w", err)
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("fdo: ServiceInfo: non-string key")
+		}
+		kvs = append(kvs, ServiceInfoKV{Key: key, Value: bstrOrRaw(pair[1])})
+	}
+	return kvs, nil
+}
+
+// CipherSuiteName returns the registered name of an FDO cipher suite.
+func CipherSuiteName(id int64) string {
+	switch id {
+	case 1:
+		return "A128GCM"
+	case 3:
+		return "A256GCM"
+	case 32:
+		return "AES-CCM-64-128-128"
+	case 33:
+		return "AES-CCM-64-128-256"
+	case -17760703:
+		return "COSEAES128CBC"
+	case -17760704:
+		return "COSEAES128CTR"
+	case -17760705:
+		return "COSEAES256CBC"
+	case -17760706:
+		return "COSEAES256CTR"
+	}
+	return fmt.Sprintf("unknown(%d)", id)
+}
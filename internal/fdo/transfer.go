@@ -0,0 +1,56 @@
+package fdo
+
+import (
+	"encoding/hex"
+
+	"github.com/fdo-server-wrapper/internal/cbor"
+)
+
+// FDO ServiceInfo modules that deliver files to the device: fdo.download
+// carries the file in ServiceInfo, fdo.wget has the device fetch it from a
+// URL.
+const (
+	DownloadModule = "fdo.download"
+	WgetModule     = "fdo.wget"
+)
+
+// IsTransfer reports whether kv belongs to fdo.download or fdo.wget.
+func IsTransfer(kv ServiceInfoKV) bool {
+	m := kv.Module()
+	return m == DownloadModule || m == WgetModule
+}
+
+// Int returns kv's value as an integer, e.g. fdo.download:length or the
+// device's done count.
+func (kv ServiceInfoKV) Int() (int64, bool) {
+	v, err := cbor.Decode(kv.Value)
+	if err != nil {
+		return 0, false
+	}
+	return cbor.Int(v)
+}
+
+// Text returns kv's value as a text string, e.g. a file name or URL.
+func (kv ServiceInfoKV) Text() (string, bool) {
+	v, err := cbor.Decode(kv.Value)
+	if err != nil {
+		return "", false
+	}
+	s, ok := v.(string)
+	return s, ok
+}
+
+// Bytes returns kv's value as a byte string, e.g. fdo.download:data. Values
+// sent without the "bstr .cbor" wrapping have already lost their byte
+// string header and are returned as is.
+func (kv ServiceInfoKV) Bytes() []byte {
+	if b, err := cbor.Bytes(kv.Value); err == nil {
+		return b
+	}
+	return kv.Value
+}
+
+// HexDigest returns kv's byte string value hex encoded, for sha-384 digests.
+func (kv ServiceInfoKV) HexDigest() string {
+	return hex.EncodeToString(kv.Bytes())
+}
@@ -0,0 +1,211 @@
+// Package features holds runtime feature flags: behavior the operator can
+// switch on or off through the admin API during a production run, without
+// redeploying. Changes are persisted so they survive restarts.
+package features
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+var enabledGauge = metrics.Default.NewGaugeVec(
+	"fdo_proxy_feature_enabled",
+	"Whether a runtime feature flag is on (1) or off (0).",
+	"flag")
+
+// ErrUnknown is returned for a flag that was never defined.
+var ErrUnknown = errors.New("unknown feature flag")
+
+// Flag is one feature flag.
+type Flag struct {
+	name        string
+	description string
+	def         bool
+	on          atomic.Bool
+	hooks       []func(bool)
+}
+
+// Enabled reports whether the flag is on.
+func (f *Flag) Enabled() bool {
+	return f.on.Load()
+}
+
+// OnChange calls fn with the flag's value now and after every change.
+// Hooks must be added before the admin API can change the flag.
+func (f *Flag) OnChange(fn func(bool)) {
+	f.hooks = append(f.hooks, fn)
+	fn(f.Enabled())
+}
+
+// override is a value set through the admin API, as persisted.
+type override struct {
+	Enabled   bool      `json:"enabled"`
+	Reason    string    `json:"reason,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// State describes a flag for the admin API.
+type State struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	// Default is the value from the command line, in effect unless
+	// overridden.
+	Default    bool      `json:"default"`
+	Overridden bool      `json:"overridden"`
+	Reason     string    `json:"reason,omitempty"`
+	ChangedAt  time.Time `json:"changed_at,omitzero"`
+}
+
+// Set is the proxy's feature flags, with their overrides optionally
+// persisted to a JSON file.
+type Set struct {
+	path string
+
+	mu        sync.Mutex
+	flags     map[string]*Flag
+	overrides map[string]override
+}
+
+// Open loads overrides from path, which need not exist yet. An empty path
+// keeps them in memory only.
+func Open(path string) (*Set, error) {
+	s := &Set{path: path, flags: make(map[string]*Flag), overrides: make(map[string]override)}
+	if path == "" {
+		return s, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read feature flags: %w", err)
+	}
+	if err := json.Unmarshal(b, &s.overrides); err != nil {
+		return nil, fmt.Errorf("parse feature flags: %w", err)
+	}
+	return s, nil
+}
+
+// Define adds the flag name, on by default if def is set. An override
+// persisted for name takes effect right away. Defining a name twice
+// returns the first flag.
+func (s *Set) Define(name, description string, def bool) *Flag {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.flags[name]; ok {
+		return f
+	}
+	f := &Flag{name: name, description: description, def: def}
+	f.on.Store(def)
+	if o, ok := s.overrides[name]; ok {
+		f.on.Store(o.Enabled)
+	}
+	enabledGauge.Set(gauge(f.Enabled()), name)
+	s.flags[name] = f
+	return f
+}
+
+// Set turns the flag name on or off until Reset.
+func (s *Set) Set(name string, on bool, reason string) (State, error) {
+	s.mu.Lock()
+	f, ok := s.flags[name]
+	if !ok {
+		s.mu.Unlock()
+		return State{}, fmt.Errorf("%w %q", ErrUnknown, name)
+	}
+	s.overrides[name] = override{Enabled: on, Reason: reason, ChangedAt: time.Now().UTC()}
+	err := s.saveLocked()
+	st := s.stateLocked(f)
+	s.mu.Unlock()
+	s.apply(f, on)
+	return st, err
+}
+
+// Reset drops the override of name, returning the flag to its default.
+func (s *Set) Reset(name string) (State, error) {
+	s.mu.Lock()
+	f, ok := s.flags[name]
+	if !ok {
+		s.mu.Unlock()
+		return State{}, fmt.Errorf("%w %q", ErrUnknown, name)
+	}
+	delete(s.overrides, name)
+	err := s.saveLocked()
+	st := s.stateLocked(f)
+	s.mu.Unlock()
+	s.apply(f, f.def)
+	return st, err
+}
+
+// All returns every defined flag, sorted by name.
+func (s *Set) All() []State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]State, 0, len(s.flags))
+	for _, f := range s.flags {
+		out = append(out, s.stateLocked(f))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// apply switches f and runs its hooks if its value changed.
+func (s *Set) apply(f *Flag, on bool) {
+	if f.on.Swap(on) == on {
+		return
+	}
+	enabledGauge.Set(gauge(on), f.name)
+	for _, fn := range f.hooks {
+		fn(on)
+	}
+}
+
+// stateLocked describes f as it will be once applied. The caller must
+// hold s.mu.
+func (s *Set) stateLocked(f *Flag) State {
+	st := State{Name: f.name, Description: f.description, Enabled: f.def, Default: f.def}
+	if o, ok := s.overrides[f.name]; ok {
+		st.Enabled = o.Enabled
+		st.Overridden = true
+		st.Reason = o.Reason
+		st.ChangedAt = o.ChangedAt
+	}
+	return st
+}
+
+// saveLocked atomically rewrites the file. Overrides of flags this run
+// does not define are kept. The caller must hold s.mu.
+func (s *Set) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(s.overrides, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("write feature flags: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("replace feature flags: %w", err)
+	}
+	return nil
+}
+
+func gauge(on bool) float64 {
+	if on {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,144 @@
+// Package geo locates device source addresses, so onboarding can be fenced
+// to the countries and networks a tenant expects its devices in.
+package geo
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Location is where an address is registered. A CSV table only knows the
+// country.
+type Location struct {
+	// Country is the ISO 3166-1 alpha-2 country code, e.g. "DE".
+	Country string `json:"country,omitempty"`
+	// Region is the ISO 3166-2 code of the first subdivision, e.g. "BE".
+	Region    string  `json:"region,omitempty"`
+	City      string  `json:"city,omitempty"`
+	Latitude  float64 `json:"latitude,omitempty"`
+	Longitude float64 `json:"longitude,omitempty"`
+}
+
+// String formats l as "City, Region, Country", leaving out what is unknown.
+func (l Location) String() string {
+	var parts []string
+	for _, p := range []string{l.City, l.Region, l.Country} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// DB looks addresses up. A nil DB knows no address.
+type DB interface {
+	Lookup(addr netip.Addr) (Location, bool)
+}
+
+// Lookup looks addr up in db, which may be nil.
+func Lookup(db DB, addr netip.Addr) (Location, bool) {
+	if db == nil || !addr.IsValid() {
+		return Location{}, false
+	}
+	return db.Lookup(addr.Unmap())
+}
+
+// block is one network of a Table.
+type block struct {
+	prefix netip.Prefix
+	last   netip.Addr
+	loc    Location
+}
+
+// Table is a DB of networks and their countries, read from a CSV file.
+type Table struct {
+	blocks []block
+}
+
+// LoadCSV reads a table with one network per line:
+//
+//	network,country
+//	81.2.69.0/24,GB
+//	2001:db8::/32,DE
+//
+// The header line is optional. Networks must not overlap.
+func LoadCSV(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open geoip table: %w", err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	var t Table
+	for line := 1; ; line++ {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse geoip table: %w", err)
+		}
+		if len(rec) < 2 {
+			return nil, fmt.Errorf("geoip table line %d: want network,country", line)
+		}
+		prefix, err := netip.ParsePrefix(rec[0])
+		if err != nil {
+			if line == 1 {
+				continue // Header
+			}
+			return nil, fmt.Errorf("geoip table line %d: %w", line, err)
+		}
+		prefix = prefix.Masked()
+		t.blocks = append(t.blocks, block{
+			prefix: prefix,
+			last:   lastAddr(prefix),
+			loc:    Location{Country: strings.ToUpper(rec[1])},
+		})
+	}
+	sort.Slice(t.blocks, func(i, j int) bool { return t.blocks[i].prefix.Addr().Less(t.blocks[j].prefix.Addr()) })
+	for i := 1; i < len(t.blocks); i++ {
+		if prev := t.blocks[i-1]; !prev.last.Less(t.blocks[i].prefix.Addr()) {
+			return nil, fmt.Errorf("geoip table: %s overlaps %s", t.blocks[i].prefix, prev.prefix)
+		}
+	}
+	return &t, nil
+}
+
+// Len returns the number of networks in t.
+func (t *Table) Len() int {
+	return len(t.blocks)
+}
+
+// Lookup implements DB.
+func (t *Table) Lookup(addr netip.Addr) (Location, bool) {
+	// The last block starting at or before addr is the only one that can hold it
+	i := sort.Search(len(t.blocks), func(i int) bool { return addr.Less(t.blocks[i].prefix.Addr()) }) - 1
+	if i < 0 || !t.blocks[i].prefix.Contains(addr) {
+		return Location{}, false
+	}
+	return t.blocks[i].loc, true
+}
+
+// lastAddr returns the highest address in p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := range b {
+		hostBits := len(b)*8 - p.Bits() - (len(b)-1-i)*8
+		switch {
+		case hostBits >= 8:
+			b[i] = 0xff
+		case hostBits > 0:
+			b[i] |= byte(1<<hostBits - 1)
+		}
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
@@ -0,0 +1,333 @@
+package geo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// metadataMarker starts the metadata section at the end of a MaxMind DB.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// MMDB is a DB read from a MaxMind DB file, such as GeoLite2-Country or
+// GeoLite2-City. Only the country, first subdivision, city and coordinates
+// of a network are used.
+type MMDB struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+	// Type is the database_type from the metadata, e.g. "GeoLite2-City".
+	Type string
+	// BuildEpoch is when the database was built, in seconds since 1970.
+	BuildEpoch uint64
+}
+
+// OpenMMDB reads a MaxMind DB file.
+func OpenMMDB(path string) (*MMDB, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read mmdb: %w", err)
+	}
+	return ParseMMDB(b)
+}
+
+// ParseMMDB parses a MaxMind DB held in b, which is kept.
+func ParseMMDB(b []byte) (*MMDB, error) {
+	i := bytes.LastIndex(b, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("mmdb: no metadata")
+	}
+	meta := b[i+len(metadataMarker):]
+	v, _, err := decode(meta, 0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: metadata: %w", err)
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("mmdb: metadata is not a map")
+	}
+	db := &MMDB{buf: b}
+	db.nodeCount = uint(metaUint(m, "node_count"))
+	db.recordSize = uint(metaUint(m, "record_size"))
+	db.ipVersion = uint(metaUint(m, "ip_version"))
+	db.BuildEpoch = metaUint(m, "build_epoch")
+	db.Type, _ = m["database_type"].(string)
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", db.recordSize)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("mmdb: search tree exceeds file")
+	}
+	db.data = b[treeSize+16 : i]
+
+	// IPv4 addresses live under ::/96 in an IPv6 tree
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for n := 0; n < 96 && node < db.nodeCount; n++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+func metaUint(m map[string]any, key string) uint64 {
+	switch v := m[key].(type) {
+	case uint64:
+		return v
+	case int64:
+		return uint64(v)
+	}
+	return 0
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *MMDB) record(node, bit uint) uint {
+	b := db.buf
+	switch db.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(b[off+3]&0xf0)<<20 | uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+		}
+		return uint(b[off+3]&0x0f)<<24 | uint(b[off+4])<<16 | uint(b[off+5])<<8 | uint(b[off+6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(b[off:]))
+	}
+}
+
+// Lookup implements DB.
+func (db *MMDB) Lookup(addr netip.Addr) (Location, bool) {
+	ip := addr.AsSlice()
+	node := uint(0)
+	if addr.Is4() && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if !addr.Is4() && db.ipVersion == 4 {
+		return Location{}, false
+	}
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-i%8)) & 1
+		node = db.record(node, bit)
+	}
+	if node <= db.nodeCount {
+		// Reached the empty record, or ran out of address bits
+		return Location{}, false
+	}
+	off := node - db.nodeCount - 16
+	if off >= uint(len(db.data)) {
+		return Location{}, false
+	}
+	v, _, err := decode(db.data, off)
+	if err != nil {
+		return Location{}, false
+	}
+	m, _ := v.(map[string]any)
+	loc := Location{
+		Country: str(m, "country", "iso_code"),
+		Region:  str(first(m, "subdivisions"), "iso_code"),
+		City:    str(m, "city", "names", "en"),
+	}
+	if c, ok := m["location"].(map[string]any); ok {
+		loc.Latitude, _ = c["latitude"].(float64)
+		loc.Longitude, _ = c["longitude"].(float64)
+	}
+	if loc.Country == "" {
+		// Anycast and satellite networks only carry a registered country
+		loc.Country = str(m, "registered_country", "iso_code")
+	}
+	return loc, loc != Location{}
+}
+
+// str walks the maps of v along path to a string.
+func str(v any, path ...string) string {
+	for _, k := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return ""
+		}
+		v = m[k]
+	}
+	s, _ := v.(string)
+	return s
+}
+
+// first returns the first element of the array m[key].
+func first(m map[string]any, key string) any {
+	a, _ := m[key].([]any)
+	if len(a) == 0 {
+		return nil
+	}
+	return a[0]
+}
+
+// MaxMind DB data section types.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+var errTruncated = errors.New("truncated data")
+
+// decode decodes the value at off in data, returning it and the offset
+// after it. Maps become map[string]any, arrays []any, unsigned integers
+// uint64, int32 int64 and floats float64; uint128 is kept as bytes.
+func decode(data []byte, off uint) (any, uint, error) {
+	return decodeDepth(data, off, 0)
+}
+
+func decodeDepth(data []byte, off uint, depth int) (any, uint, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	if off >= uint(len(data)) {
+		return nil, 0, errTruncated
+	}
+	ctrl := data[off]
+	off++
+	typ := int(ctrl >> 5)
+	if typ == typePointer {
+		ptr, next, err := pointer(data, off, ctrl)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := decodeDepth(data, ptr, depth+1)
+		return v, next, err
+	}
+	if typ == typeExtended {
+		if off >= uint(len(data)) {
+			return nil, 0, errTruncated
+		}
+		typ = 7 + int(data[off])
+		off++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(data)) {
+			return nil, 0, errTruncated
+		}
+		var ext uint
+		for _, c := range data[off : off+n] {
+			ext = ext<<8 | uint(c)
+		}
+		off += n
+		size = [...]uint{29, 285, 65821}[n-1] + ext
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := decodeDepth(data, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			v, next, err := decodeDepth(data, next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			off = next
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]any, 0, min(size, 64))
+		for i := uint(0); i < size; i++ {
+			v, next, err := decodeDepth(data, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case typeBool:
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(data)) {
+		return nil, 0, errTruncated
+	}
+	b := data[off : off+size]
+	off += size
+	switch typ {
+	case typeString:
+		return string(b), off, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("bad double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("bad float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case typeUint16, typeUint32, typeUint64:
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, off, nil
+	case typeInt32:
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+		return int64(int32(u)), off, nil
+	case typeBytes, typeUint128:
+		return append([]byte(nil), b...), off, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", typ)
+}
+
+// pointer decodes the pointer whose control byte is ctrl and whose
+// remaining bytes start at off, returning its target and the offset after
+// it.
+func pointer(data []byte, off uint, ctrl byte) (uint, uint, error) {
+	n := uint(ctrl>>3&0x3) + 1
+	if off+n > uint(len(data)) {
+		return 0, 0, errTruncated
+	}
+	var p uint
+	if n < 4 {
+		p = uint(ctrl & 0x7)
+	}
+	for _, c := range data[off : off+n] {
+		p = p<<8 | uint(c)
+	}
+	p += [...]uint{0, 2048, 526336, 0}[n-1]
+	return p, off + n, nil
+}
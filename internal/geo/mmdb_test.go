@@ -0,0 +1,273 @@
+package geo
+
+import (
+	"encoding/binary"
+	"math"
+	"net/netip"
+	"testing"
+)
+
+// The MaxMind DB writer below covers just what the tests need: a search
+// tree over a few networks and their data, in any record size.
+
+// ctrl appends the control byte(s) of a data field of type typ and size.
+func ctrl(b []byte, typ int, size int) []byte {
+	first := byte(typ << 5)
+	if typ > 7 {
+		first = 0
+	}
+	var ext []byte
+	switch {
+	case size < 29:
+		first |= byte(size)
+	case size < 285:
+		first |= 29
+		ext = []byte{byte(size - 29)}
+	default:
+		first |= 30
+		ext = binary.BigEndian.AppendUint16(nil, uint16(size-285))
+	}
+	b = append(b, first)
+	if typ > 7 {
+		b = append(b, byte(typ-7))
+	}
+	return append(b, ext...)
+}
+
+func mmString(b []byte, s string) []byte { return append(ctrl(b, typeString, len(s)), s...) }
+
+func mmDouble(b []byte, f float64) []byte {
+	return binary.BigEndian.AppendUint64(ctrl(b, typeDouble, 8), math.Float64bits(f))
+}
+
+func mmUint(b []byte, typ int, u uint64) []byte {
+	var v []byte
+	for ; u > 0; u >>= 8 {
+		v = append([]byte{byte(u)}, v...)
+	}
+	return append(ctrl(b, typ, len(v)), v...)
+}
+
+// mmPointer appends an 11-bit pointer to off in the data section.
+func mmPointer(b []byte, off int) []byte {
+	return append(b, byte(typePointer<<5|0<<3|off>>8), byte(off))
+}
+
+// field is one key and its encoded value, in order.
+type field struct {
+	key   string
+	value func([]byte) []byte
+}
+
+func mmMap(b []byte, fields ...field) []byte {
+	b = ctrl(b, typeMap, len(fields))
+	for _, f := range fields {
+		b = f.value(mmString(b, f.key))
+	}
+	return b
+}
+
+func mmText(s string) func([]byte) []byte { return func(b []byte) []byte { return mmString(b, s) } }
+
+// tree is a search tree being built.
+type tree struct {
+	nodes [][2]record
+}
+
+// record points to a node (never the root, so 0 is empty) or to data at
+// offset data-1.
+type record struct {
+	node int
+	data int
+}
+
+func (t *tree) insert(addr []byte, bits int, dataOff int) {
+	if len(t.nodes) == 0 {
+		t.nodes = append(t.nodes, [2]record{})
+	}
+	n := 0
+	for i := 0; i < bits; i++ {
+		bit := addr[i/8] >> (7 - i%8) & 1
+		if i == bits-1 {
+			t.nodes[n][bit] = record{data: dataOff + 1}
+			return
+		}
+		if t.nodes[n][bit].node == 0 {
+			t.nodes = append(t.nodes, [2]record{})
+			t.nodes[n][bit] = record{node: len(t.nodes) - 1}
+		}
+		n = t.nodes[n][bit].node
+	}
+}
+
+func (t *tree) encode(recordSize int) []byte {
+	count := len(t.nodes)
+	value := func(r record) uint32 {
+		switch {
+		case r.data > 0:
+			return uint32(count + 16 + r.data - 1)
+		case r.node > 0:
+			return uint32(r.node)
+		}
+		return uint32(count)
+	}
+	var b []byte
+	for _, n := range t.nodes {
+		l, r := value(n[0]), value(n[1])
+		switch recordSize {
+		case 24:
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(l>>24<<4)|byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			b = binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(b, l), r)
+		}
+	}
+	return b
+}
+
+// buildMMDB returns an IPv6 database holding:
+//
+//	81.2.69.0/24        GB, London, 51.5142, -0.0931
+//	2001:db8::/32       DE, BE, Berlin (the country is a pointer)
+//	198.51.100.0/24     registered country US only
+func buildMMDB(t *testing.T, recordSize int) []byte {
+	t.Helper()
+	var data []byte
+	london := len(data)
+	data = mmMap(data,
+		field{"city", func(b []byte) []byte {
+			return mmMap(b, field{"names", func(b []byte) []byte { return mmMap(b, field{"en", mmText("London")}) }})
+		}},
+		field{"country", func(b []byte) []byte { return mmMap(b, field{"iso_code", mmText("GB")}) }},
+		field{"location", func(b []byte) []byte {
+			return mmMap(b,
+				field{"latitude", func(b []byte) []byte { return mmDouble(b, 51.5142) }},
+				field{"longitude", func(b []byte) []byte { return mmDouble(b, -0.0931) }},
+				field{"accuracy_radius", func(b []byte) []byte { return mmUint(b, typeUint16, 1000) }})
+		}},
+	)
+	de := len(data)
+	data = mmMap(data, field{"iso_code", mmText("DE")})
+	berlin := len(data)
+	data = mmMap(data,
+		field{"city", func(b []byte) []byte {
+			return mmMap(b, field{"names", func(b []byte) []byte { return mmMap(b, field{"en", mmText("Berlin")}) }})
+		}},
+		field{"country", func(b []byte) []byte { return mmPointer(b, de) }},
+		field{"subdivisions", func(b []byte) []byte { return mmMap(ctrl(b, typeArray, 1), field{"iso_code", mmText("BE")}) }},
+	)
+	anycast := len(data)
+	data = mmMap(data, field{"registered_country", func(b []byte) []byte { return mmMap(b, field{"iso_code", mmText("US")}) }})
+
+	var tr tree
+	addr16 := func(s string) []byte {
+		a := netip.MustParseAddr(s).As16()
+		return a[:]
+	}
+	tr.insert(addr16("::81.2.69.0"), 96+24, london)
+	tr.insert(addr16("::198.51.100.0"), 96+24, anycast)
+	tr.insert(addr16("2001:db8::"), 32, berlin)
+
+	b := tr.encode(recordSize)
+	b = append(b, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, metadataMarker...)
+	b = mmMap(b,
+		field{"node_count", func(b []byte) []byte { return mmUint(b, typeUint32, uint64(len(tr.nodes))) }},
+		field{"record_size", func(b []byte) []byte { return mmUint(b, typeUint16, uint64(recordSize)) }},
+		field{"ip_version", func(b []byte) []byte { return mmUint(b, typeUint16, 6) }},
+		field{"database_type", mmText("Test-City")},
+		field{"build_epoch", func(b []byte) []byte { return mmUint(b, typeUint64, 1767225600) }},
+	)
+	return b
+}
+
+func TestMMDBLookup(t *testing.T) {
+	for _, size := range []int{24, 28, 32} {
+		db, err := ParseMMDB(buildMMDB(t, size))
+		if err != nil {
+			t.Fatalf("record size %d: %v", size, err)
+		}
+		if db.Type != "Test-City" || db.BuildEpoch != 1767225600 {
+			t.Errorf("record size %d: metadata = %q, %d", size, db.Type, db.BuildEpoch)
+		}
+		tests := []struct {
+			addr string
+			want Location
+			ok   bool
+		}{
+			{"81.2.69.160", Location{Country: "GB", City: "London", Latitude: 51.5142, Longitude: -0.0931}, true},
+			{"::ffff:81.2.69.1", Location{}, false}, // geo.Lookup unmaps, MMDB.Lookup does not
+			{"2001:db8:1::1", Location{Country: "DE", Region: "BE", City: "Berlin"}, true},
+			{"198.51.100.7", Location{Country: "US"}, true},
+			{"81.2.70.1", Location{}, false},
+			{"2001:db9::1", Location{}, false},
+		}
+		for _, tt := range tests {
+			got, ok := db.Lookup(netip.MustParseAddr(tt.addr))
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("record size %d: Lookup(%s) = %+v, %v, want %+v, %v", size, tt.addr, got, ok, tt.want, tt.ok)
+			}
+		}
+		if got, ok := Lookup(db, netip.MustParseAddr("::ffff:81.2.69.1")); !ok || got.Country != "GB" {
+			t.Errorf("record size %d: geo.Lookup of a mapped address = %+v, %v", size, got, ok)
+		}
+	}
+}
+
+func TestParseMMDBMalformed(t *testing.T) {
+	meta := func(nodes, recordSize uint64) []byte {
+		return mmMap(append([]byte(nil), metadataMarker...),
+			field{"node_count", func(b []byte) []byte { return mmUint(b, typeUint32, nodes) }},
+			field{"record_size", func(b []byte) []byte { return mmUint(b, typeUint16, recordSize) }})
+	}
+	good := buildMMDB(t, 24)
+	tests := map[string][]byte{
+		"empty":             nil,
+		"truncated":         good[:len(good)-3],
+		"metadata not map":  mmString(append([]byte(nil), metadataMarker...), "x"),
+		"bad record size":   append(make([]byte, 22), meta(1, 20)...),
+		"tree exceeds file": append(make([]byte, 22), meta(1000, 24)...),
+	}
+	for name, b := range tests {
+		if _, err := ParseMMDB(b); err == nil {
+			t.Errorf("%s: ParseMMDB succeeded", name)
+		}
+	}
+	if _, err := ParseMMDB(append(make([]byte, 22), meta(1, 24)...)); err != nil {
+		t.Errorf("one empty node: %v", err)
+	}
+}
+
+func TestMMDBDecode(t *testing.T) {
+	var b []byte
+	b = mmUint(b, typeUint64, math.MaxUint64)
+	b = append(ctrl(b, typeInt32, 4), 0xff, 0xff, 0xff, 0xfe)
+	b = ctrl(b, typeBool, 1)
+	b = append(ctrl(b, typeFloat, 4), 0x3f, 0xc0, 0, 0)
+	long := string(make([]byte, 300))
+	b = mmString(b, long)
+	want := []any{uint64(math.MaxUint64), int64(-2), true, 1.5, long}
+	off := uint(0)
+	for i, w := range want {
+		v, next, err := decode(b, off)
+		if err != nil || v != w {
+			t.Fatalf("value %d = %v, %v, want %v", i, v, err, w)
+		}
+		off = next
+	}
+	if off != uint(len(b)) {
+		t.Errorf("decoded %d of %d bytes", off, len(b))
+	}
+
+	// A pointer to itself must not recurse forever
+	if _, _, err := decode([]byte{0x20, 0x00}, 0); err == nil {
+		t.Error("self-referencing pointer decoded")
+	}
+	for _, bad := range [][]byte{{}, {0x44, 'a'}, {0x68, 0}, {0x5d}, {0xe1, 0x41}} {
+		if _, _, err := decode(bad, 0); err == nil {
+			t.Errorf("decode(%x) succeeded", bad)
+		}
+	}
+}
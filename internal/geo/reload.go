@@ -0,0 +1,106 @@
+package geo
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+var (
+	reloads = metrics.Default.NewCounterVec(
+		"fdo_proxy_geoip_reloads_total",
+		"GeoIP database reloads after the file changed, by outcome (success, error).",
+		"outcome")
+	buildEpoch = metrics.Default.NewGaugeVec(
+		"fdo_proxy_geoip_build_epoch",
+		"Build time of the loaded MaxMind database, in seconds since 1970 (0 for CSV tables).")
+)
+
+// Reloader is a DB read from a file that is read again when the file
+// changes, so databases updated by geoipupdate take effect without a
+// restart. Files ending in .mmdb are MaxMind databases, others CSV tables
+// (see LoadCSV).
+type Reloader struct {
+	path string
+	db   atomic.Pointer[loaded]
+}
+
+type loaded struct {
+	db      DB
+	modTime time.Time
+	size    int64
+}
+
+// Open loads the database at path.
+func Open(path string) (*Reloader, error) {
+	r := &Reloader{path: path}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Lookup implements DB.
+func (r *Reloader) Lookup(addr netip.Addr) (Location, bool) {
+	return r.db.Load().db.Lookup(addr)
+}
+
+// load reads the file if it changed since it was last loaded, reporting
+// whether it did.
+func (r *Reloader) load() (bool, error) {
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return false, fmt.Errorf("geoip: %w", err)
+	}
+	if cur := r.db.Load(); cur != nil && cur.modTime.Equal(fi.ModTime()) && cur.size == fi.Size() {
+		return false, nil
+	}
+	var db DB
+	var epoch uint64
+	if strings.HasSuffix(r.path, ".mmdb") {
+		m, err := OpenMMDB(r.path)
+		if err != nil {
+			return false, err
+		}
+		db, epoch = m, m.BuildEpoch
+	} else {
+		t, err := LoadCSV(r.path)
+		if err != nil {
+			return false, err
+		}
+		db = t
+	}
+	r.db.Store(&loaded{db: db, modTime: fi.ModTime(), size: fi.Size()})
+	buildEpoch.Set(float64(epoch))
+	return true, nil
+}
+
+// Run checks the file for changes every interval until ctx is done. A file
+// that fails to load leaves the previous database in use.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		changed, err := r.load()
+		switch {
+		case err != nil:
+			reloads.Inc("error")
+			slog.Warn("GeoIP database reload failed, keeping the previous one", "path", r.path, "error", err)
+		case changed:
+			reloads.Inc("success")
+			slog.Info("GeoIP database reloaded", "path", r.path)
+		}
+	}
+}
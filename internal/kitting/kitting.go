@@ -0,0 +1,88 @@
+// Package kitting turns the configuration records of a product item
+// passport into owner ServiceInfo and hands them to the owner backend, so
+// the passport service is the source of truth for per-device provisioning
+// data delivered during TO2.
+package kitting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/ledger"
+)
+
+// ServiceInfo is one owner ServiceInfo message for the backend to send.
+// Value is the message's value as JSON; the backend encodes it as CBOR.
+type ServiceInfo struct {
+	Module  string          `json:"module"`
+	Message string          `json:"message"`
+	Value   json.RawMessage `json:"value"`
+}
+
+// FromPassport returns the ServiceInfo for the configuration records in p,
+// in record order, and the UUIDs of the configuration records that could not
+// be used because they lack a module, message or value.
+func FromPassport(p *ledger.ProductItemPassport) (items []ServiceInfo, invalid []string) {
+	for _, r := range p.Records {
+		c := r.Config
+		if c == nil {
+			continue
+		}
+		if c.Module == "" || c.Message == "" || len(c.Value) == 0 || !json.Valid(c.Value) {
+			invalid = append(invalid, r.UUID)
+			continue
+		}
+		items = append(items, ServiceInfo{Module: c.Module, Message: c.Message, Value: c.Value})
+	}
+	return items, invalid
+}
+
+// Client talks to the owner backend's ServiceInfo module API, which takes a
+// PUT of {"guid": ..., "service_info": [...]} replacing what the device
+// receives in its next TO2.
+type Client struct {
+	url  string
+	http *http.Client
+}
+
+// NewClient creates a client for url, in which "{guid}" is replaced with
+// the device GUID. A non-positive timeout defaults to 10 seconds.
+func NewClient(url string, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &Client{url: url, http: &http.Client{Timeout: timeout}}
+}
+
+// Deliver hands items to the backend for guid.
+func (c *Client) Deliver(ctx context.Context, guid string, items []ServiceInfo) error {
+	payload, err := json.Marshal(map[string]any{"guid": guid, "service_info": items})
+	if err != nil {
+		return fmt.Errorf("encode request: %w", err)
+	}
+	url := strings.ReplaceAll(c.url, "{guid}", guid)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	correlation.Inject(ctx, req.Header)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("backend request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("backend status %d: %s", resp.StatusCode, bytes.TrimSpace(b))
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package ledger
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrPassportNotFound is returned when the passport service has no
+	// passport for the requested UUID.
+	ErrPassportNotFound = errors.New("product item passport not found")
+
+	// ErrLookupBackoff is returned when recent lookups for a UUID failed and
+	// the client is holding off before asking the service again.
+	ErrLookupBackoff = errors.New("passport lookup backing off")
+)
+
+// lookupGuard remembers failed passport lookups per UUID. "Not found" results
+// are cached for a fixed TTL; other failures back off exponentially so a
+// device stuck retrying DI doesn't turn into a lookup storm.
+type lookupGuard struct {
+	mu          sync.Mutex
+	negativeTTL time.Duration
+	backoffBase time.Duration
+	backoffMax  time.Duration
+	entries     map[string]guardEntry
+}
+
+type guardEntry struct {
+	notFound bool
+	failures int
+	until    time.Time
+}
+
+func newLookupGuard(negativeTTL, backoffBase, backoffMax time.Duration) *lookupGuard {
+	if backoffMax < backoffBase {
+		backoffMax = backoffBase
+	}
+	return &lookupGuard{
+		negativeTTL: negativeTTL,
+		backoffBase: backoffBase,
+		backoffMax:  backoffMax,
+		entries:     make(map[string]guardEntry),
+	}
+}
+
+// check returns a non-nil error if a lookup for uuid should be skipped.
+func (g *lookupGuard) check(uuid string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	e, ok := g.entries[uuid]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.until) {
+		// Forget expired negatives; failure counts stay so backoff keeps escalating
+		if e.notFound {
+			delete(g.entries, uuid)
+		}
+		return nil
+	}
+	if e.notFound {
+		return ErrPassportNotFound
+	}
+	return ErrLookupBackoff
+}
+
+// fail records a failed lookup. Not-found results are held for the negative
+// TTL; other errors double the previous delay up to the configured maximum.
+func (g *lookupGuard) fail(uuid string, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	if errors.Is(err, ErrPassportNotFound) {
+		if g.negativeTTL > 0 {
+			g.entries[uuid] = guardEntry{notFound: true, until: now.Add(g.negativeTTL)}
+		}
+		return
+	}
+	if g.backoffBase <= 0 {
+		return
+	}
+
+	e := g.entries[uuid]
+	e.notFound = false
+	e.failures++
+	delay := g.backoffBase
+	for i := 1; i < e.failures && delay < g.backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > g.backoffMax {
+		delay = g.backoffMax
+	}
+	e.until = now.Add(delay)
+	g.entries[uuid] = e
+}
+
+// succeed clears any failure state for uuid.
+func (g *lookupGuard) succeed(uuid string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.entries, uuid)
+}
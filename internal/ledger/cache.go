@@ -0,0 +1,193 @@
+package ledger
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// passportCache holds product item passports keyed by UUID so repeated DI
+// lookups for the same product don't round-trip to the passport service.
+type passportCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	passport *ProductItemPassport
+	expires  time.Time
+}
+
+func newPassportCache(ttl time.Duration) *passportCache {
+	return &passportCache{
+		ttl:     ttl,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// get returns the cached passport for uuid if present and not expired.
+func (c *passportCache) get(uuid string) (*ProductItemPassport, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[uuid]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, uuid)
+		return nil, false
+	}
+	return e.passport, true
+}
+
+// put stores a passport for the configured TTL.
+func (c *passportCache) put(uuid string, p *ProductItemPassport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[uuid] = cacheEntry{passport: p, expires: time.Now().Add(c.ttl)}
+}
+
+// len reports the number of entries, including ones that have expired but
+// not yet been evicted by a lookup.
+func (c *passportCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// delete removes uuid, reporting whether it was cached.
+func (c *passportCache) delete(uuid string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[uuid]
+	delete(c.entries, uuid)
+	return ok
+}
+
+// flush removes every entry and returns how many there were.
+func (c *passportCache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	c.entries = make(map[string]cacheEntry)
+	return n
+}
+
+// CachedPassport describes a product item passport in the cache.
+type CachedPassport struct {
+	UUID      string    `json:"uuid"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Records counts the passport's records.
+	Records int `json:"records"`
+	// Passport is the cached passport itself, in CachedPassport only.
+	Passport *ProductItemPassport `json:"passport,omitempty"`
+}
+
+// HeldLookup is a UUID whose failed lookup keeps the client from asking
+// the passport service again until Until.
+type HeldLookup struct {
+	UUID string `json:"uuid"`
+	// NotFound is set for a passport the service did not have; other
+	// failures are backing off.
+	NotFound bool      `json:"not_found"`
+	Failures int       `json:"failures,omitempty"`
+	Until    time.Time `json:"until"`
+}
+
+// CacheStatus describes the product passport cache and the lookups held off
+// by EnableLookupBackoff.
+type CacheStatus struct {
+	// Enabled reports whether passports are cached at all.
+	Enabled bool             `json:"enabled"`
+	TTL     string           `json:"ttl,omitempty"`
+	Entries []CachedPassport `json:"entries"`
+	Held    []HeldLookup     `json:"held"`
+}
+
+// CacheStatus returns the unexpired cached passports and held lookups,
+// sorted by UUID.
+func (c *Client) CacheStatus() CacheStatus {
+	now := time.Now()
+	st := CacheStatus{Enabled: c.cache != nil, Entries: []CachedPassport{}, Held: []HeldLookup{}}
+	if c.cache != nil {
+		st.TTL = c.cache.ttl.String()
+		c.cache.mu.Lock()
+		for uuid, e := range c.cache.entries {
+			if now.After(e.expires) {
+				continue
+			}
+			st.Entries = append(st.Entries, CachedPassport{UUID: uuid, ExpiresAt: e.expires.UTC(), Records: len(e.passport.Records)})
+		}
+		c.cache.mu.Unlock()
+		slices.SortFunc(st.Entries, func(a, b CachedPassport) int { return strings.Compare(a.UUID, b.UUID) })
+	}
+	if c.guard != nil {
+		c.guard.mu.Lock()
+		for uuid, e := range c.guard.entries {
+			if now.After(e.until) {
+				continue
+			}
+			st.Held = append(st.Held, HeldLookup{UUID: uuid, NotFound: e.notFound, Failures: e.failures, Until: e.until.UTC()})
+		}
+		c.guard.mu.Unlock()
+		slices.SortFunc(st.Held, func(a, b HeldLookup) int { return strings.Compare(a.UUID, b.UUID) })
+	}
+	return st
+}
+
+// CachedPassport returns the cached passport of uuid, if it has an
+// unexpired one.
+func (c *Client) CachedPassport(uuid string) (CachedPassport, bool) {
+	if c.cache == nil {
+		return CachedPassport{}, false
+	}
+	c.cache.mu.Lock()
+	defer c.cache.mu.Unlock()
+	e, ok := c.cache.entries[uuid]
+	if !ok || time.Now().After(e.expires) {
+		return CachedPassport{}, false
+	}
+	return CachedPassport{UUID: uuid, ExpiresAt: e.expires.UTC(), Records: len(e.passport.Records), Passport: e.passport}, true
+}
+
+// InvalidatePassport forgets what the client knows of uuid, its cached
+// passport and any failed lookup holding it off, so the next lookup asks
+// the passport service. It reports whether there was anything to forget.
+func (c *Client) InvalidatePassport(uuid string) bool {
+	var found bool
+	if c.cache != nil && c.cache.delete(uuid) {
+		found = true
+	}
+	if c.guard != nil {
+		c.guard.mu.Lock()
+		if _, ok := c.guard.entries[uuid]; ok {
+			delete(c.guard.entries, uuid)
+			found = true
+		}
+		c.guard.mu.Unlock()
+	}
+	if found {
+		ledgerCacheInvalidations.Inc("uuid")
+	}
+	return found
+}
+
+// FlushCache empties the passport cache and forgets every failed lookup,
+// returning how many passports and lookups it dropped.
+func (c *Client) FlushCache() (passports, held int) {
+	if c.cache != nil {
+		passports = c.cache.flush()
+	}
+	if c.guard != nil {
+		c.guard.mu.Lock()
+		held = len(c.guard.entries)
+		c.guard.entries = make(map[string]guardEntry)
+		c.guard.mu.Unlock()
+	}
+	ledgerCacheInvalidations.Inc("flush")
+	return passports, held
+}
@@ -1,11 +1,11 @@
 package ledger
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -19,31 +19,88 @@ import (
 type Client struct {
 	productBaseURL    string
 	commissioningURL  string
+	failureURL        string
+	registrationURL   string
+	keyRotationURL    string
+	listURL           string
+	queryURL          string
 	productHTTP       *http.Client
+	productTLS        *tls.Config
+	connChecks        []func(tls.ConnectionState) error
 	commissioningHTTP *http.Client
+	cache             *passportCache
+	guard             *lookupGuard
+	productRetries    int
+	breakers          map[string]*breaker
+	onBreaker         func(endpoint string, s BreakerState)
+	outbox            *Outbox
+	// httpOptions, resolver and wrapTransport make the transports of both
+	// clients, rebuilt by buildTransports whenever one changes.
+	httpOptions   HTTPOptions
+	resolver      *resolver
+	wrapTransport func(http.RoundTripper) http.RoundTripper
+	// commissioningTemplate shapes commissioning requests, if set.
+	commissioningTemplate *CommissioningTemplate
 }
 
 // NewClient configures clients for:
 // - Product item passport (mTLS GET)
 // - Commissioning passport (HTTP POST)
 func NewClient(productBaseURL, commissioningURL, caCertPath, clientCertPath, clientKeyPath string) (*Client, error) {
-	productHTTP, err := newMTLSHTTPClient(caCertPath, clientCertPath, clientKeyPath)
+	productTLS, err := newMTLSConfig(caCertPath, clientCertPath, clientKeyPath)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Client{
+	c := &Client{
 		productBaseURL:    productBaseURL,
 		commissioningURL:  commissioningURL,
-		productHTTP:       productHTTP,
-		commissioningHTTP: &http.Client{Timeout: 30 * time.Second},
-	}, nil
+		productHTTP:       &http.Client{},
+		productTLS:        productTLS,
+		commissioningHTTP: &http.Client{},
+	}
+	c.buildTransports()
+	return c, nil
 }
 
-func newMTLSHTTPClient(caPath, certPath, keyPath string) (*http.Client, error) {
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-	if err != nil {
-		return nil, fmt.Errorf("load client cert/key: %w", err)
+// EnableCache turns on in-memory caching of product item passports for ttl.
+// A non-positive ttl leaves caching disabled.
+func (c *Client) EnableCache(ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.cache = newPassportCache(ttl)
+}
+
+// EnableLookupBackoff caches "not found" results for negativeTTL and backs off
+// repeated failed lookups for the same UUID, starting at base and doubling up
+// to max. Zero durations disable the corresponding behavior.
+func (c *Client) EnableLookupBackoff(negativeTTL, base, max time.Duration) {
+	if negativeTTL <= 0 && base <= 0 {
+		return
+	}
+	c.guard = newLookupGuard(negativeTTL, base, max)
+}
+
+// UseClientCertificate presents the certificate get returns to the
+// passport service instead of the client cert/key pair, which may then be
+// left empty in NewClient. get is called per handshake, so a rotating
+// identity such as a SPIFFE SVID is picked up by new connections.
+func (c *Client) UseClientCertificate(get func(*tls.CertificateRequestInfo) (*tls.Certificate, error)) {
+	c.productTLS.Certificates = nil
+	c.productTLS.GetClientCertificate = get
+}
+
+// newMTLSConfig builds the passport service TLS config. Without certPath
+// and keyPath it presents no certificate until UseClientCertificate.
+func newMTLSConfig(caPath, certPath, keyPath string) (*tls.Config, error) {
+	var certs []tls.Certificate
+	if certPath != "" || keyPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("load client cert/key: %w", err)
+		}
+		certs = append(certs, cert)
 	}
 
 	caCert, err := os.ReadFile(caPath)
@@ -55,13 +112,12 @@ func newMTLSHTTPClient(caPath, certPath, keyPath string) (*http.Client, error) {
 		return nil, fmt.Errorf("append CA cert")
 	}
 
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			RootCAs:      caPool,
-			Certificates: []tls.Certificate{cert},
-		},
-	}
-	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+	// PinServer, CheckRevocation and UseClientCertificate adjust this
+	// config later
+	return &tls.Config{
+		RootCAs:      caPool,
+		Certificates: certs,
+	}, nil
 }
 
 // Shapes below mirror the service responses closely.
@@ -78,12 +134,41 @@ type ProductItemRecord struct {
 	UUID       string `json:"uuid"`
 	Signature  string `json:"signature"`
 	Descriptor string `json:"descriptor"`
+	// Config is per-device provisioning data, present on configuration
+	// records.
+	Config *ProductItemConfig `json:"config,omitempty"`
+	// Artifact is a file the device is expected to receive during TO2,
+	// present on artifact records.
+	Artifact *ProductItemArtifact `json:"artifact,omitempty"`
+	// Event is what happened to the item, present on records the proxy
+	// appends (see AppendRecord).
+	Event *ProductItemEvent `json:"event,omitempty"`
+}
+
+// ProductItemArtifact names a file delivered through fdo.download or
+// fdo.wget and its expected hex SHA-384 digest.
+type ProductItemArtifact struct {
+	Name   string `json:"name"`
+	SHA384 string `json:"sha384"`
+}
+
+// ProductItemConfig is one owner ServiceInfo message the device should
+// receive during TO2: value is sent as message of the FSIM module.
+type ProductItemConfig struct {
+	Module  string          `json:"module"`
+	Message string          `json:"message"`
+	Value   json.RawMessage `json:"value"`
 }
 
 type ProductItemMetadata struct {
 	Version      string `json:"version"`
 	CreationTime string `json:"creation_time"`
 	BoardSN      string `json:"board_sn"`
+	// OwnerID is the owner (tenant) the item is destined for, if the
+	// passport service assigns one.
+	OwnerID string `json:"owner_id,omitempty"`
+	// Tags group the item, e.g. by batch or SKU.
+	Tags []string `json:"tags,omitempty"`
 }
 
 type ProductItemAgent struct {
@@ -106,15 +191,76 @@ type ProductItemAgent struct {
 //	    - Returns nil passport and error if service unavailable or invalid response
 //
 //	  Error Conditions:
-//	    - Network errors: connection failures, timeouts
+//	    - Network errors: connection failures, timeouts (retried if enabled)
+//	    - Breaker: ErrBreakerOpen while the endpoint's circuit breaker is open
 //	    - TLS errors: invalid certificates, mTLS handshake failures
-//	    - HTTP errors: non-200 status codes
+//	    - HTTP errors: non-200 status codes (404 wraps ErrPassportNotFound)
 //	    - JSON errors: malformed response body
+//	    - Backoff: ErrLookupBackoff while a failed UUID is held off
+//	    - Offline: ErrOffline while offline mode holds the service unreachable
 //
 //		GET {productBaseURL}/product_item/?uuid={uuid}
 //
-// Uses mTLS with the configured CA, client cert, and key.
+// Uses mTLS with the configured CA, client cert, and key. When caching is
+// enabled, a cached passport is returned without contacting the service.
+// When lookup backoff is enabled, recently failed UUIDs return
+// ErrPassportNotFound or ErrLookupBackoff without contacting the service.
+// In offline mode, lookups that cannot reach the service are repeated on
+// sync.
 func (c *Client) GetProductItemPassport(ctx context.Context, uuid string) (*ProductItemPassport, error) {
+	if c.cache != nil {
+		if p, ok := c.cache.get(uuid); ok {
+			ledgerCacheLookups.Inc("hit")
+			return p, nil
+		}
+	}
+	if c.guard != nil {
+		if err := c.guard.check(uuid); err != nil {
+			if errors.Is(err, ErrPassportNotFound) {
+				ledgerCacheLookups.Inc("negative")
+			} else {
+				ledgerCacheLookups.Inc("backoff")
+			}
+			return nil, fmt.Errorf("passport %s: %w", uuid, err)
+		}
+	}
+	if c.outbox != nil && c.outbox.Offline() {
+		c.outbox.deferLookup(uuid, nil)
+		return nil, fmt.Errorf("passport %s: %w", uuid, ErrOffline)
+	}
+	if c.cache != nil {
+		ledgerCacheLookups.Inc("miss")
+	}
+
+	p, err := c.fetchProductItemPassport(ctx, uuid)
+	c.recordLookup(uuid, p, err)
+	if err != nil {
+		if c.outbox != nil && unreachable(err) {
+			c.outbox.deferLookup(uuid, err)
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// recordLookup updates the cache and failure state after a passport GET.
+func (c *Client) recordLookup(uuid string, p *ProductItemPassport, err error) {
+	if err != nil {
+		if c.guard != nil {
+			c.guard.fail(uuid, err)
+		}
+		return
+	}
+	if c.guard != nil {
+		c.guard.succeed(uuid)
+	}
+	if c.cache != nil {
+		c.cache.put(uuid, p)
+	}
+}
+
+// fetchProductItemPassport performs the passport GET, bypassing the cache.
+func (c *Client) fetchProductItemPassport(ctx context.Context, uuid string) (*ProductItemPassport, error) {
 	if c.productBaseURL == "" {
 		return nil, fmt.Errorf("product base URL not configured")
 	}
@@ -128,20 +274,20 @@ func (c *Client) GetProductItemPassport(ctx context.Context, uuid string) (*Prod
 	q.Set("uuid", uuid)
 	u.RawQuery = q.Encode()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	resp, err := c.do(endpointProductGet, c.productHTTP, c.productRetries, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("build request: %w", err)
-	}
-
-	resp, err := c.productHTTP.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("passport %s: %w", uuid, ErrPassportNotFound)
+	}
 	if resp.StatusCode != http.StatusOK {
 		b, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("passport GET status %d: %s", resp.StatusCode, string(b))
+		return nil, &statusError{request: "passport GET", status: resp.StatusCode, body: string(b)}
 	}
 
 	var out ProductItemPassport
@@ -153,10 +299,78 @@ func (c *Client) GetProductItemPassport(ctx context.Context, uuid string) (*Prod
 
 // CommissioningCreateRequest is the payload the service expects.
 type CommissioningCreateRequest struct {
-	ControllerUUID   string `json:"controller_uuid"`
-	Cert             string `json:"cert"`
-	DeployedLocation string `json:"deployed_location"`
-	Timestamp        string `json:"timestamp"`
+	ControllerUUID string `json:"controller_uuid"`
+	// ProductID links the device to its product item passport, when DI ran
+	// through this proxy.
+	ProductID string `json:"product_id,omitempty"`
+	// OwnerID is the owner the device was onboarded to.
+	OwnerID          string              `json:"owner_id,omitempty"`
+	Cert             string              `json:"cert"`
+	DeployedLocation string              `json:"deployed_location"`
+	Timestamp        string              `json:"timestamp"`
+	Evidence         *OnboardingEvidence `json:"evidence,omitempty"`
+	// Credential is a VC-JWT attesting the onboarding, when an issuer is configured.
+	Credential string `json:"credential,omitempty"`
+
+	// Serial and Tags are not sent, but are available to a
+	// CommissioningTemplate.
+	Serial string   `json:"-"`
+	Tags   []string `json:"-"`
+}
+
+// OnboardingEvidence records what the proxy observed during TO2 so the
+// commissioning passport can be audited. Hashes are hex SHA-256.
+type OnboardingEvidence struct {
+	VoucherHash  string             `json:"voucher_hash,omitempty"`
+	OwnerKeyHash string             `json:"owner_key_hash,omitempty"`
+	KexSuite     string             `json:"kex_suite,omitempty"`
+	CipherSuite  string             `json:"cipher_suite,omitempty"`
+	ServiceInfo  ServiceInfoSummary `json:"service_info"`
+	Attestation  *AttestationInfo   `json:"attestation,omitempty"`
+	Transfers    []TransferInfo     `json:"transfers,omitempty"`
+}
+
+// TransferInfo describes a file delivered through fdo.download or fdo.wget
+// and how it compared with the product item passport. Digests are hex
+// SHA-384.
+type TransferInfo struct {
+	Module          string `json:"module"`
+	Name            string `json:"name,omitempty"`
+	URL             string `json:"url,omitempty"`
+	Length          int64  `json:"length,omitempty"`
+	AnnouncedSHA384 string `json:"announced_sha384,omitempty"`
+	ExpectedSHA384  string `json:"expected_sha384,omitempty"`
+	ObservedSHA384  string `json:"observed_sha384,omitempty"`
+	DeviceResult    int64  `json:"device_result"`
+	Error           string `json:"error,omitempty"`
+	Verification    string `json:"verification"`
+}
+
+// AttestationInfo describes the device attestation presented in TO2.ProveDevice.
+type AttestationInfo struct {
+	Type         string `json:"type"`
+	Algorithm    string `json:"algorithm"`
+	Nonce        string `json:"nonce,omitempty"`
+	ClaimsDigest string `json:"claims_digest,omitempty"`
+	Verification string `json:"verification,omitempty"`
+}
+
+// ServiceInfoSummary describes the ServiceInfo delivered during TO2. Module
+// names are only known when the messages were not encrypted.
+type ServiceInfoSummary struct {
+	DeviceMessages int                 `json:"device_messages"`
+	OwnerMessages  int                 `json:"owner_messages"`
+	DeviceBytes    int                 `json:"device_bytes"`
+	OwnerBytes     int                 `json:"owner_bytes"`
+	Encrypted      bool                `json:"encrypted"`
+	Modules        []ServiceInfoModule `json:"modules,omitempty"`
+}
+
+// ServiceInfoModule summarizes one FSIM module exercised during TO2.
+type ServiceInfoModule struct {
+	Name     string `json:"name"`
+	Messages int    `json:"messages"`
+	Bytes    int    `json:"bytes"`
 }
 
 // CreateCommissioningPassport creates a commissioning passport in the external service.
@@ -175,36 +389,39 @@ type CommissioningCreateRequest struct {
 //	    - Returns error on failure (HTTP 4xx/5xx status or network errors)
 //
 //	  Error Conditions:
-//	    - Network errors: connection failures, timeouts
+//	    - Network errors: connection failures, timeouts (never retried)
+//	    - Breaker: ErrBreakerOpen while the endpoint's circuit breaker is open
 //	    - HTTP errors: non-2xx status codes
 //	    - JSON errors: malformed request body
+//	    - Template errors: with UseCommissioningTemplate, a template that
+//	      fails or renders invalid JSON for body
 //	    - Validation errors: missing required fields
+//	    - Offline: with EnableOffline, network errors, 5xx responses and
+//	      ErrBreakerOpen queue the passport for sync and return nil
 //
 //		POST {commissioningURL}
 func (c *Client) CreateCommissioningPassport(ctx context.Context, body *CommissioningCreateRequest) error {
-	if c.commissioningURL == "" {
-		return fmt.Errorf("commissioning URL not configured")
-	}
+	return c.CreateCommissioningPassportAt(ctx, c.commissioningURL, body)
+}
 
-	b, err := json.Marshal(body)
-	if err != nil {
-		return fmt.Errorf("marshal request: %w", err)
+// CreateCommissioningPassportAt is CreateCommissioningPassport sending the
+// passport to target instead of the configured commissioning URL, so device
+// groups can keep their records in separate ledgers. The commissioning
+// endpoint's circuit breaker covers every target.
+func (c *Client) CreateCommissioningPassportAt(ctx context.Context, target string, body *CommissioningCreateRequest) error {
+	if target == "" {
+		return fmt.Errorf("commissioning URL not configured")
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.commissioningURL, bytes.NewReader(b))
-	if err != nil {
-		return fmt.Errorf("build request: %w", err)
+	var b []byte
+	var err error
+	if c.commissioningTemplate != nil {
+		b, err = c.commissioningTemplate.Render(body)
+	} else if b, err = json.Marshal(body); err != nil {
+		err = fmt.Errorf("marshal request: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.commissioningHTTP.Do(req)
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		bb, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("commissioning POST status %d: %s", resp.StatusCode, string(bb))
+		return err
 	}
-	return nil
+	return c.post(ctx, endpointCommissioningPost, target, b)
 }
@@ -0,0 +1,92 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Failure kinds reported to the passport service.
+const (
+	// FailureDIRejected is a DI exchange the manufacturer backend refused.
+	FailureDIRejected = "di_rejected"
+	// FailureTO2Aborted is a TO2 exchange that ended in an ErrorMessage.
+	FailureTO2Aborted = "to2_aborted"
+	// FailureAttestationRejected is a TO2 exchange the proxy stopped because
+	// the attestation verifier rejected the device.
+	FailureAttestationRejected = "attestation_rejected"
+	// FailurePassportMismatch is a device whose product ID has no product
+	// item passport.
+	FailurePassportMismatch = "passport_mismatch"
+	// FailureDuplicateSerial is a DI.AppStart the proxy refused because the
+	// serial number already completed DI.
+	FailureDuplicateSerial = "duplicate_serial"
+	// FailurePayloadMismatch is a TO2 exchange the proxy stopped because a
+	// file delivered through fdo.download or fdo.wget did not match the
+	// digest its product item passport lists.
+	FailurePayloadMismatch = "payload_mismatch"
+	// FailureGeofence is a TO2 exchange the proxy refused because the
+	// device's source address is outside its policy's geofence.
+	FailureGeofence = "geofence"
+)
+
+// FailureRecord describes a device that did not onboard cleanly.
+type FailureRecord struct {
+	// ControllerUUID is the device GUID, when known. DI failures before
+	// credentials are set only carry a ProductID.
+	ControllerUUID string `json:"controller_uuid,omitempty"`
+	ProductID      string `json:"product_id,omitempty"`
+	Kind           string `json:"kind"`
+	Protocol       string `json:"protocol"`
+	// Stage is the FDO message type the exchange failed at, if known.
+	Stage int `json:"stage,omitempty"`
+	// ErrorCode is the FDO ErrorMessage code, if the backend sent one.
+	ErrorCode uint64              `json:"error_code,omitempty"`
+	Reason    string              `json:"reason"`
+	Timestamp string              `json:"timestamp"`
+	Evidence  *OnboardingEvidence `json:"evidence,omitempty"`
+}
+
+// EnableFailureReports configures the endpoint that receives failure
+// records. An empty URL leaves reporting disabled.
+func (c *Client) EnableFailureReports(url string) {
+	c.failureURL = url
+}
+
+// FailureReportsEnabled reports whether EnableFailureReports was given a URL.
+func (c *Client) FailureReportsEnabled() bool {
+	return c.failureURL != ""
+}
+
+// ReportFailure records an onboarding failure in the external service.
+//
+// Contract:
+//
+//	  Preconditions:
+//	    - ctx is not nil
+//	    - rec is not nil with Kind and Protocol set
+//	    - failureURL is configured
+//
+//	  Postconditions:
+//	    - Returns nil on successful creation (HTTP 2xx status)
+//	    - Returns error on failure (HTTP 4xx/5xx status or network errors)
+//
+//	  Error Conditions:
+//	    - Network errors: connection failures, timeouts (never retried)
+//	    - Breaker: ErrBreakerOpen while the endpoint's circuit breaker is open
+//	    - HTTP errors: non-2xx status codes
+//	    - Offline: queued for sync as for CreateCommissioningPassport
+//
+//		POST {failureURL}
+func (c *Client) ReportFailure(ctx context.Context, rec *FailureRecord) error {
+	if c.failureURL == "" {
+		return fmt.Errorf("failure URL not configured")
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+
+	return c.post(ctx, endpointFailurePost, c.failureURL, b)
+}
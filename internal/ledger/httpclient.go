@@ -0,0 +1,133 @@
+package ledger
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTP2Mode is whether the ledger HTTP clients use HTTP/2.
+type HTTP2Mode string
+
+const (
+	// HTTP2Auto keeps Go's choice: HTTP/2 where the service offers it,
+	// except on the mTLS passport client, whose custom TLS config limits it
+	// to HTTP/1.1.
+	HTTP2Auto HTTP2Mode = "auto"
+	// HTTP2On negotiates HTTP/2 on both clients, so concurrent requests
+	// share one connection and one handshake per host.
+	HTTP2On HTTP2Mode = "on"
+	// HTTP2Off keeps both clients on HTTP/1.1.
+	HTTP2Off HTTP2Mode = "off"
+)
+
+// ParseHTTP2Mode parses auto, on or off.
+func ParseHTTP2Mode(s string) (HTTP2Mode, error) {
+	switch m := HTTP2Mode(s); m {
+	case HTTP2Auto, HTTP2On, HTTP2Off:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown HTTP/2 mode %q (want auto, on or off)", s)
+}
+
+// HTTPOptions tunes the connections of both ledger HTTP clients. Zero
+// values keep the defaults.
+type HTTPOptions struct {
+	// Timeout bounds a whole request, reading the response included
+	// (30s unless set).
+	Timeout time.Duration
+	// DialTimeout bounds opening a TCP connection.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake.
+	TLSHandshakeTimeout time.Duration
+	// IdleConnTimeout is how long an idle connection is kept for reuse.
+	IdleConnTimeout time.Duration
+	// MaxIdleConnsPerHost is how many idle connections are kept per host;
+	// Go keeps 2, so bursts of lookups above that reconnect.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost caps the connections per host, dialing, active and
+	// idle; requests above it wait for one.
+	MaxConnsPerHost int
+	// SessionCache is how many TLS sessions are kept for resumption, which
+	// lets a new connection skip the certificate exchange of a full
+	// handshake.
+	SessionCache int
+	// HTTP2 selects HTTP/2; empty is HTTP2Auto.
+	HTTP2 HTTP2Mode
+}
+
+// TuneHTTP applies o to the product passport and commissioning clients.
+// Pins, revocation checks and client certificates are kept. Call it before
+// the client is used; UseResolver and EnableWireLog may come before or
+// after it.
+func (c *Client) TuneHTTP(o HTTPOptions) {
+	c.httpOptions = o
+	c.buildTransports()
+}
+
+// buildTransports gives both clients new transports made from the HTTP
+// options, resolver and wire log set so far, so none of them undoes
+// another whatever the order they were set in.
+func (c *Client) buildTransports() {
+	// The passport client's config is shared with PinServer and
+	// CheckRevocation, so it is used, and changed, in place
+	c.productHTTP.Transport, c.productHTTP.Timeout = c.newTransport(&http.Transport{TLSClientConfig: c.productTLS})
+	c.commissioningHTTP.Transport, c.commissioningHTTP.Timeout = c.newTransport(http.DefaultTransport.(*http.Transport).Clone())
+}
+
+// newTransport applies the client's options to t and returns it, wrapped
+// for the wire log if enabled, with the request timeout.
+func (c *Client) newTransport(t *http.Transport) (http.RoundTripper, time.Duration) {
+	o := c.httpOptions
+	if o.DialTimeout > 0 || c.resolver != nil {
+		timeout := o.DialTimeout
+		if timeout <= 0 {
+			timeout = 30 * time.Second
+		}
+		t.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+		if c.resolver != nil {
+			t.DialContext = c.resolver.dialer(t.DialContext)
+		}
+	}
+	if o.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = o.TLSHandshakeTimeout
+	}
+	if o.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = o.IdleConnTimeout
+	}
+	if o.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+		if t.MaxIdleConns != 0 && t.MaxIdleConns < o.MaxIdleConnsPerHost {
+			t.MaxIdleConns = o.MaxIdleConnsPerHost
+		}
+	}
+	if o.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = o.MaxConnsPerHost
+	}
+	if o.SessionCache > 0 {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(o.SessionCache)
+	} else if t.TLSClientConfig != nil {
+		t.TLSClientConfig.ClientSessionCache = nil
+	}
+	switch o.HTTP2 {
+	case HTTP2On:
+		t.ForceAttemptHTTP2 = true
+	case HTTP2Off:
+		t.ForceAttemptHTTP2 = false
+		// A non-nil empty map is how net/http is told not to upgrade
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	timeout := 30 * time.Second
+	if o.Timeout > 0 {
+		timeout = o.Timeout
+	}
+	if c.wrapTransport != nil {
+		return c.wrapTransport(t), timeout
+	}
+	return t, timeout
+}
@@ -0,0 +1,65 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// KeyRotationRecord describes an owner key rotation and the vouchers moved
+// to the new key.
+type KeyRotationRecord struct {
+	OwnerID       string `json:"owner_id,omitempty"`
+	KeyID         string `json:"key_id,omitempty"`
+	PreviousKeyID string `json:"previous_key_id,omitempty"`
+	// ControllerUUIDs are the devices whose vouchers were re-signed or
+	// extended to the new key.
+	ControllerUUIDs []string `json:"controller_uuids"`
+	Reason          string   `json:"reason,omitempty"`
+	Timestamp       string   `json:"timestamp"`
+}
+
+// EnableKeyRotationReports configures the endpoint that receives owner key
+// rotation records. An empty URL leaves reporting disabled.
+func (c *Client) EnableKeyRotationReports(url string) {
+	c.keyRotationURL = url
+}
+
+// KeyRotationReportsEnabled reports whether EnableKeyRotationReports was
+// given a URL.
+func (c *Client) KeyRotationReportsEnabled() bool {
+	return c.keyRotationURL != ""
+}
+
+// RecordKeyRotation records an owner key rotation in the external service.
+//
+// Contract:
+//
+//	  Preconditions:
+//	    - ctx is not nil
+//	    - rec is not nil
+//	    - keyRotationURL is configured
+//
+//	  Postconditions:
+//	    - Returns nil on successful creation (HTTP 2xx status)
+//	    - Returns error on failure (HTTP 4xx/5xx status or network errors)
+//
+//	  Error Conditions:
+//	    - Network errors: connection failures, timeouts (never retried)
+//	    - Breaker: ErrBreakerOpen while the endpoint's circuit breaker is open
+//	    - HTTP errors: non-2xx status codes
+//	    - Offline: queued for sync as for CreateCommissioningPassport
+//
+//		POST {keyRotationURL}
+func (c *Client) RecordKeyRotation(ctx context.Context, rec *KeyRotationRecord) error {
+	if c.keyRotationURL == "" {
+		return fmt.Errorf("key rotation URL not configured")
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+
+	return c.post(ctx, endpointKeyRotationPost, c.keyRotationURL, b)
+}
@@ -0,0 +1,113 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// maxListPages bounds the pages followed by ListCommissioningPassports and
+// PrefetchAll.
+const maxListPages = 10000
+
+// CommissioningEntry is a commissioning passport as the list endpoint
+// describes it.
+type CommissioningEntry struct {
+	ControllerUUID string `json:"controller_uuid"`
+	OwnerID        string `json:"owner_id,omitempty"`
+	Timestamp      string `json:"timestamp,omitempty"`
+}
+
+// EnableCommissioningList configures the endpoint listing commissioning
+// passports. An empty URL leaves listing disabled.
+func (c *Client) EnableCommissioningList(url string) {
+	c.listURL = url
+}
+
+// CommissioningListEnabled reports whether EnableCommissioningList was
+// given a URL.
+func (c *Client) CommissioningListEnabled() bool {
+	return c.listURL != ""
+}
+
+// ListCommissioningPassports lists the commissioning passports the external
+// service created between from and to.
+//
+// Contract:
+//
+//	  Preconditions:
+//	    - ctx is not nil
+//	    - listURL is configured
+//
+//	  Postconditions:
+//	    - Returns every passport of every page, in the service's order
+//	    - Returns nil and error if any page fails
+//
+//	  Error Conditions:
+//	    - Network errors: connection failures, timeouts (never retried)
+//	    - Breaker: ErrBreakerOpen while the endpoint's circuit breaker is open
+//	    - HTTP errors: non-200 status codes
+//	    - JSON errors: malformed response body
+//
+//		GET {listURL}?from={RFC 3339}&to={RFC 3339}[&cursor={next}]
+//
+// The response is {"passports": [...], "next": "..."}; a non-empty next is
+// passed back as cursor for the following page.
+func (c *Client) ListCommissioningPassports(ctx context.Context, from, to time.Time) ([]CommissioningEntry, error) {
+	if c.listURL == "" {
+		return nil, fmt.Errorf("commissioning list URL not configured")
+	}
+	u, err := url.Parse(c.listURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse list URL: %w", err)
+	}
+
+	var out []CommissioningEntry
+	cursor := ""
+	for range maxListPages {
+		q := u.Query()
+		q.Set("from", from.UTC().Format(time.RFC3339))
+		q.Set("to", to.UTC().Format(time.RFC3339))
+		if cursor != "" {
+			q.Set("cursor", cursor)
+		}
+		u.RawQuery = q.Encode()
+
+		var page struct {
+			Passports []CommissioningEntry `json:"passports"`
+			Next      string               `json:"next"`
+		}
+		if err := c.listPage(ctx, u.String(), &page); err != nil {
+			return nil, err
+		}
+		out = append(out, page.Passports...)
+		if page.Next == "" {
+			return out, nil
+		}
+		cursor = page.Next
+	}
+	return nil, fmt.Errorf("commissioning list longer than %d pages", maxListPages)
+}
+
+// listPage fetches one page of the commissioning list into page.
+func (c *Client) listPage(ctx context.Context, target string, page any) error {
+	resp, err := c.do(endpointCommissioningList, c.commissioningHTTP, 0, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return &statusError{request: "commissioning list GET", status: resp.StatusCode, body: string(b)}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(page); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package ledger
+
+import "github.com/fdo-server-wrapper/internal/metrics"
+
+// Endpoint labels used in ledger metrics.
+const (
+	endpointProductGet        = "product_get"
+	endpointProductSearch     = "product_search"
+	endpointProductPatch      = "product_patch"
+	endpointProductList       = "product_list"
+	endpointCommissioningPost = "commissioning_post"
+	endpointFailurePost       = "failure_post"
+	endpointRegistrationPost  = "registration_post"
+	endpointKeyRotationPost   = "key_rotation_post"
+	endpointCommissioningList = "commissioning_list"
+	endpointCommissioningGet  = "commissioning_get"
+)
+
+var (
+	ledgerRequests = metrics.Default.NewCounterVec(
+		"fdo_proxy_ledger_requests_total",
+		"Ledger requests by endpoint and outcome.",
+		"endpoint", "outcome")
+	ledgerLatency = metrics.Default.NewHistogramVec(
+		"fdo_proxy_ledger_request_duration_seconds",
+		"Ledger request latency by endpoint, including retries.",
+		metrics.DefBuckets,
+		"endpoint")
+	ledgerRetries = metrics.Default.NewCounterVec(
+		"fdo_proxy_ledger_retries_total",
+		"Ledger request retries by endpoint.",
+		"endpoint")
+	ledgerBreakerState = metrics.Default.NewGaugeVec(
+		"fdo_proxy_ledger_breaker_state",
+		"Ledger circuit breaker state by endpoint (0=closed, 1=half-open, 2=open).",
+		"endpoint")
+	ledgerCacheLookups = metrics.Default.NewCounterVec(
+		"fdo_proxy_ledger_cache_lookups_total",
+		"Product passport cache lookups by result (hit, miss, negative, backoff).",
+		"result")
+	ledgerCacheInvalidations = metrics.Default.NewCounterVec(
+		"fdo_proxy_ledger_cache_invalidations_total",
+		"Product passport cache invalidations through the admin API, by scope (uuid, flush).",
+		"scope")
+	ledgerDNSLookups = metrics.Default.NewCounterVec(
+		"fdo_proxy_ledger_dns_lookups_total",
+		"Ledger host lookups with UseResolver by result (pinned, hit, resolved, stale, failed).",
+		"result")
+	ledgerPinFailures = metrics.Default.NewCounterVec(
+		"fdo_proxy_ledger_pin_failures_total",
+		"Passport service TLS handshakes refused because no certificate matched a pin, by server name.",
+		"server")
+	ledgerOffline = metrics.Default.NewGaugeVec(
+		"fdo_proxy_ledger_offline",
+		"Whether offline mode holds the passport service unreachable and queues its work (1) or not (0).")
+	ledgerOutboxPending = metrics.Default.NewGaugeVec(
+		"fdo_proxy_ledger_outbox_pending",
+		"Passport service work queued for sync, by kind (write, lookup).",
+		"kind")
+	ledgerOutboxWork = metrics.Default.NewCounterVec(
+		"fdo_proxy_ledger_outbox_total",
+		"Passport service work through the offline outbox, by endpoint and result (queued, synced, rejected).",
+		"endpoint", "result")
+)
@@ -0,0 +1,906 @@
+package ledger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/linecrypt"
+)
+
+// ErrOffline is returned by passport lookups while offline mode holds the
+// passport service unreachable. The lookup is repeated on the next sync.
+var ErrOffline = errors.New("passport service offline")
+
+// maxQueued bounds the writes and lookups held while the service is
+// unreachable.
+const maxQueued = 100000
+
+// maxRejected bounds the writes kept after the service refused them on sync.
+const maxRejected = 100
+
+// compactSlack is how many lines an outbox file may hold beyond twice its
+// state before it is rewritten.
+const compactSlack = 1024
+
+// QueuedWrite is a passport service POST held while the service cannot be
+// reached.
+type QueuedWrite struct {
+	ID uint64 `json:"id"`
+	// Endpoint is the metrics label of the POST, e.g. "commissioning_post".
+	Endpoint string          `json:"endpoint"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body,omitempty"`
+	QueuedAt time.Time       `json:"queued_at"`
+	// Error is why the write was queued, or why the service refused it.
+	Error string `json:"error,omitempty"`
+}
+
+// DeferredLookup is a product passport lookup that could not reach the
+// service, repeated on sync so its result is cached and logged.
+type DeferredLookup struct {
+	UUID       string    `json:"uuid"`
+	DeferredAt time.Time `json:"deferred_at"`
+}
+
+// outboxFile is the state of an Outbox.
+type outboxFile struct {
+	NextID   uint64           `json:"next_id"`
+	Writes   []QueuedWrite    `json:"writes"`
+	Lookups  []DeferredLookup `json:"lookups"`
+	Rejected []QueuedWrite    `json:"rejected"`
+}
+
+// Changes to an outbox, as journaled in its file.
+const (
+	opWrite   = "write"   // Write queued
+	opLookup  = "lookup"  // Lookup deferred
+	opSent    = "sent"    // write ID sent
+	opRefused = "refused" // write ID refused, with Error
+	opLooked  = "looked"  // lookup of UUID repeated
+	opNext    = "next"    // write IDs continue after ID
+)
+
+// outboxOp is one change to an outbox: a line of its file, replayed in
+// order on open.
+type outboxOp struct {
+	Op     string          `json:"op"`
+	Write  *QueuedWrite    `json:"write,omitempty"`
+	Lookup *DeferredLookup `json:"lookup,omitempty"`
+	ID     uint64          `json:"id,omitempty"`
+	UUID   string          `json:"uuid,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// apply makes the change op describes, returning the write it queued, sent
+// or refused. A queued write without an ID is given the next one, in op
+// too. errUnchanged means op changes nothing.
+func (st *outboxFile) apply(op *outboxOp) (QueuedWrite, error) {
+	switch op.Op {
+	case opWrite:
+		if op.Write == nil {
+			break
+		}
+		if len(st.Writes) >= maxQueued {
+			return QueuedWrite{}, fmt.Errorf("ledger outbox full (%d writes)", maxQueued)
+		}
+		if op.Write.ID == 0 {
+			st.NextID++
+			op.Write.ID = st.NextID
+		} else if op.Write.ID > st.NextID {
+			st.NextID = op.Write.ID
+		}
+		st.Writes = append(st.Writes, *op.Write)
+		return *op.Write, nil
+	case opLookup:
+		if op.Lookup == nil {
+			break
+		}
+		for _, l := range st.Lookups {
+			if l.UUID == op.Lookup.UUID {
+				return QueuedWrite{}, errUnchanged
+			}
+		}
+		if len(st.Lookups) >= maxQueued {
+			return QueuedWrite{}, errUnchanged
+		}
+		st.Lookups = append(st.Lookups, *op.Lookup)
+		return QueuedWrite{}, nil
+	case opSent, opRefused:
+		for i, w := range st.Writes {
+			if w.ID != op.ID {
+				continue
+			}
+			st.Writes = append(st.Writes[:i:i], st.Writes[i+1:]...)
+			if op.Op == opRefused {
+				w.Error = op.Error
+				st.Rejected = append(st.Rejected, w)
+				if n := len(st.Rejected) - maxRejected; n > 0 {
+					st.Rejected = st.Rejected[n:]
+				}
+			}
+			return w, nil
+		}
+		return QueuedWrite{}, errUnchanged
+	case opLooked:
+		for i, l := range st.Lookups {
+			if l.UUID == op.UUID {
+				st.Lookups = append(st.Lookups[:i:i], st.Lookups[i+1:]...)
+				return QueuedWrite{}, nil
+			}
+		}
+		return QueuedWrite{}, errUnchanged
+	case opNext:
+		if op.ID > st.NextID {
+			st.NextID = op.ID
+		}
+		return QueuedWrite{}, nil
+	}
+	return QueuedWrite{}, fmt.Errorf("malformed outbox change %q", op.Op)
+}
+
+// Outbox keeps the passport service's work while the service cannot be
+// reached, optionally persisted to a file so it survives restarts, or to a
+// database shared by several proxies. See Client.EnableOffline.
+//
+// The file is a journal of changes in JSON Lines, appended to as work is
+// queued and sent and rewritten only once it holds far more lines than
+// work. With a KeyWrapper, the first line holds the wrapped data key and
+// every other line is sealed, like an encrypted store's.
+type Outbox struct {
+	path string
+	c    *linecrypt.Cipher // nil for a plaintext file
+	f    *os.File
+	// lines counts the changes in the file.
+	lines int
+	// shared holds the work instead of path and state when it is in a
+	// database.
+	shared sharedOutbox
+	// refreshed is when the shared counts were last read.
+	refreshed time.Time
+	// syncing serializes Sync rounds.
+	syncing sync.Mutex
+
+	mu          sync.Mutex
+	state       outboxFile
+	offline     bool
+	since       time.Time
+	lastAttempt time.Time
+	lastSync    time.Time
+	lastErr     string
+	synced      int
+	// sharedWrites and sharedLookups count the shared work as last read.
+	sharedWrites  int
+	sharedLookups int
+}
+
+// OpenOutbox loads the outbox from path, which need not exist yet. An empty
+// path keeps the outbox in memory only. If kw is non-nil the file is
+// encrypted at rest; an existing plaintext file, or one in the single JSON
+// object of earlier versions, is rewritten encrypted. A nil kw fails on an
+// encrypted file. An outbox with work left from an earlier run starts
+// offline, so new writes queue behind it until a sync.
+func OpenOutbox(path string, kw linecrypt.KeyWrapper) (*Outbox, error) {
+	o := &Outbox{path: path, since: time.Now()}
+	if path != "" {
+		rewrite, err := o.load(kw)
+		if err != nil {
+			return nil, err
+		}
+		if kw != nil && o.c == nil {
+			if o.c, err = linecrypt.New(kw); err != nil {
+				return nil, fmt.Errorf("encrypt ledger outbox: %w", err)
+			}
+			rewrite = true
+		}
+		if rewrite {
+			if err := o.compactLocked(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	o.offline = len(o.state.Writes)+len(o.state.Lookups) > 0
+	o.gauges()
+	return o, nil
+}
+
+// VerifyOutbox reads the outbox file at path as OpenOutbox would, without
+// changing it.
+func VerifyOutbox(path string, kw linecrypt.KeyWrapper) error {
+	o := &Outbox{path: path}
+	_, err := o.load(kw)
+	return err
+}
+
+// load replays the file, reporting whether it must be rewritten: it is in
+// the format of earlier versions, or ends in a torn write the next appended
+// line would run into. Unreadable lines, such as that torn write, are
+// skipped.
+func (o *Outbox) load(kw linecrypt.KeyWrapper) (bool, error) {
+	f, err := os.Open(o.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("read ledger outbox: %w", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	torn := false
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return false, fmt.Errorf("read ledger outbox: %w", err)
+		}
+		eof := err == io.EOF
+		// Every line is written with its newline, so one without was torn
+		if eof && len(b) > 0 {
+			torn = true
+		}
+		if b = bytes.TrimSpace(b); len(b) > 0 {
+			if o.lines == 0 && o.c == nil {
+				c, ok, err := linecrypt.ParseHeader(b, kw)
+				if err != nil {
+					return false, fmt.Errorf("open ledger outbox %s: %w", o.path, err)
+				}
+				if ok {
+					o.c = c
+					continue
+				}
+			}
+			if o.c != nil {
+				if b, err = o.c.Open(b); err != nil {
+					slog.Warn("Skipping undecryptable ledger outbox line", "path", o.path, "line", line, "error", err)
+					continue
+				}
+			}
+			var op outboxOp
+			if err := json.Unmarshal(b, &op); err != nil {
+				slog.Warn("Skipping unreadable ledger outbox line", "path", o.path, "line", line, "error", err)
+				continue
+			}
+			if op.Op == "" && o.lines == 0 && o.c == nil {
+				if err := json.Unmarshal(b, &o.state); err != nil {
+					return false, fmt.Errorf("parse ledger outbox: %w", err)
+				}
+				return true, nil
+			}
+			if _, err := o.state.apply(&op); err != nil && !errors.Is(err, errUnchanged) {
+				slog.Warn("Skipping ledger outbox line", "path", o.path, "line", line, "error", err)
+			}
+			o.lines++
+		}
+		if eof {
+			return torn, nil
+		}
+	}
+}
+
+// EnableOffline keeps onboarding going while the passport service is
+// unreachable. Commissioning, failure, registration and key rotation POSTs
+// that cannot reach it are queued in o and reported as sent, and product
+// passport lookups fail fast with ErrOffline and are deferred. From the
+// first such failure until a sync drains o, new work is queued without
+// contacting the service. RunSync or Sync sends it once the service is back.
+func (c *Client) EnableOffline(o *Outbox) {
+	c.outbox = o
+}
+
+// OfflineEnabled reports whether EnableOffline was given an outbox.
+func (c *Client) OfflineEnabled() bool {
+	return c.outbox != nil
+}
+
+// unreachable reports whether err means the service could not be reached,
+// rather than that it refused the request. A 429 asks for the request to be
+// made again later, so it counts as unreachable too.
+func unreachable(err error) bool {
+	var ue *url.Error
+	var se *statusError
+	return errors.Is(err, ErrBreakerOpen) || errors.As(err, &ue) ||
+		errors.As(err, &se) && (se.status >= 500 || se.status == http.StatusTooManyRequests)
+}
+
+// Offline reports whether new work is queued rather than sent.
+func (o *Outbox) Offline() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.refreshLocked(time.Second)
+	return o.offline
+}
+
+// sharedTimeout bounds a database round trip made for an outbox change
+// that has no context of its own.
+const sharedTimeout = 10 * time.Second
+
+// errUnchanged stops a change that turned out to be a no-op without saving.
+var errUnchanged = errors.New("unchanged")
+
+// changeLocked applies op to the state of an unshared outbox and appends
+// it to the file, returning the write it queued, sent or refused.
+// errUnchanged means there was nothing to change. The caller must hold
+// o.mu.
+func (o *Outbox) changeLocked(op *outboxOp) (QueuedWrite, error) {
+	defer o.gauges()
+	w, err := o.state.apply(op)
+	if err != nil {
+		return w, err
+	}
+	return w, o.appendLocked(op)
+}
+
+// pendingLocked returns how many writes and lookups are queued, as last
+// read for a shared outbox. The caller must hold o.mu, or own o.
+func (o *Outbox) pendingLocked() (writes, lookups int) {
+	if o.shared != nil {
+		return o.sharedWrites, o.sharedLookups
+	}
+	return len(o.state.Writes), len(o.state.Lookups)
+}
+
+// refreshLocked reads the shared counts again if they were read longer
+// than maxAge ago. Work another proxy queued holds this one offline too,
+// so writes are queued behind it. The caller must hold o.mu.
+func (o *Outbox) refreshLocked(maxAge time.Duration) {
+	if o.shared == nil || time.Since(o.refreshed) < maxAge {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sharedTimeout)
+	defer cancel()
+	writes, lookups, err := o.shared.counts(ctx)
+	if err != nil {
+		slog.Warn("Failed to read shared ledger outbox", "error", err)
+		return
+	}
+	o.refreshed = time.Now()
+	o.sharedWrites, o.sharedLookups = writes, lookups
+	if writes+lookups > 0 && !o.offline {
+		o.offline, o.since = true, time.Now()
+		slog.Warn("Passport service work queued by another proxy, queueing until it is synced")
+	}
+	o.gauges()
+}
+
+// queueWrite holds a POST of body to target on endpoint. cause is the
+// failure that showed the service unreachable, nil if it already was.
+func (o *Outbox) queueWrite(endpoint, target string, body []byte, cause error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	w := QueuedWrite{Endpoint: endpoint, URL: target, Body: body, QueuedAt: time.Now().UTC()}
+	if cause != nil {
+		w.Error = cause.Error()
+	}
+	var err error
+	if o.shared != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), sharedTimeout)
+		defer cancel()
+		if w, err = o.shared.addWrite(ctx, w); err == nil {
+			o.sharedWrites++
+		}
+	} else {
+		w, err = o.changeLocked(&outboxOp{Op: opWrite, Write: &w})
+	}
+	if err != nil {
+		return fmt.Errorf("queue %s: %w", endpoint, err)
+	}
+	o.goOfflineLocked(cause)
+	o.gauges()
+	ledgerOutboxWork.Inc(endpoint, "queued")
+	pending, _ := o.pendingLocked()
+	slog.Warn("Passport service unreachable, write queued for sync", "endpoint", endpoint, "id", w.ID, "pending", pending)
+	return nil
+}
+
+// deferLookup notes a lookup of uuid to repeat on sync.
+func (o *Outbox) deferLookup(uuid string, cause error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.goOfflineLocked(cause)
+	l := DeferredLookup{UUID: uuid, DeferredAt: time.Now().UTC()}
+	var err error
+	if o.shared != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), sharedTimeout)
+		defer cancel()
+		var added bool
+		added, err = o.shared.addLookup(ctx, l)
+		if err == nil && !added {
+			err = errUnchanged
+		}
+	} else {
+		_, err = o.changeLocked(&outboxOp{Op: opLookup, Lookup: &l})
+	}
+	switch {
+	case errors.Is(err, errUnchanged):
+	case err != nil:
+		slog.Warn("Failed to save ledger outbox", "error", err)
+	default:
+		if o.shared != nil {
+			o.sharedLookups++
+			o.gauges()
+		}
+		ledgerOutboxWork.Inc(endpointProductGet, "queued")
+	}
+}
+
+// goOfflineLocked starts queueing. The caller must hold o.mu.
+func (o *Outbox) goOfflineLocked(cause error) {
+	if cause != nil {
+		o.lastErr = cause.Error()
+	}
+	if o.offline {
+		return
+	}
+	o.offline, o.since = true, time.Now()
+	slog.Warn("Passport service offline, queueing its work until it is reachable again", "error", cause)
+}
+
+// takeWrite passes the oldest queued write to fn and, unless fn fails,
+// removes it: sent, or moved to the rejected list if fn returns it
+// refused. It reports false once no write is left to take. A shared write
+// is locked against the other proxies until fn returns, and each takes the
+// oldest write no other holds.
+func (o *Outbox) takeWrite(ctx context.Context, fn func(QueuedWrite) (refused, err error)) (bool, error) {
+	if o.shared != nil {
+		var (
+			w       QueuedWrite
+			refused error
+		)
+		took, err := o.shared.takeWrite(ctx, func(qw QueuedWrite) (error, error) {
+			var err error
+			w = qw
+			refused, err = fn(qw)
+			return refused, err
+		})
+		if took && err == nil {
+			o.mu.Lock()
+			o.sharedWrites--
+			o.wroteLocked(w, refused)
+			o.mu.Unlock()
+		}
+		return took, err
+	}
+
+	o.mu.Lock()
+	if len(o.state.Writes) == 0 {
+		o.mu.Unlock()
+		return false, nil
+	}
+	w := o.state.Writes[0]
+	o.mu.Unlock()
+	refused, err := fn(w)
+	if err != nil {
+		return true, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	op := &outboxOp{Op: opSent, ID: w.ID}
+	if refused != nil {
+		op.Op, op.Error = opRefused, refused.Error()
+	}
+	w, err = o.changeLocked(op)
+	switch {
+	case errors.Is(err, errUnchanged):
+	case err != nil:
+		slog.Warn("Failed to save ledger outbox", "error", err)
+	default:
+		o.wroteLocked(w, refused)
+	}
+	return true, nil
+}
+
+// wroteLocked counts the write w as sent, or as rejected with refused set.
+// The caller must hold o.mu.
+func (o *Outbox) wroteLocked(w QueuedWrite, refused error) {
+	if refused != nil {
+		ledgerOutboxWork.Inc(w.Endpoint, "rejected")
+		return
+	}
+	o.synced++
+	ledgerOutboxWork.Inc(w.Endpoint, "synced")
+}
+
+// takeLookup passes the oldest deferred lookup to fn and, unless fn fails,
+// removes it, as takeWrite does writes.
+func (o *Outbox) takeLookup(ctx context.Context, fn func(DeferredLookup) error) (bool, error) {
+	if o.shared != nil {
+		took, err := o.shared.takeLookup(ctx, fn)
+		if took && err == nil {
+			o.mu.Lock()
+			o.sharedLookups--
+			o.lookedLocked()
+			o.mu.Unlock()
+		}
+		return took, err
+	}
+
+	o.mu.Lock()
+	if len(o.state.Lookups) == 0 {
+		o.mu.Unlock()
+		return false, nil
+	}
+	l := o.state.Lookups[0]
+	o.mu.Unlock()
+	if err := fn(l); err != nil {
+		return true, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, err := o.changeLocked(&outboxOp{Op: opLooked, UUID: l.UUID})
+	switch {
+	case errors.Is(err, errUnchanged):
+	case err != nil:
+		slog.Warn("Failed to save ledger outbox", "error", err)
+	default:
+		o.lookedLocked()
+	}
+	return true, nil
+}
+
+// lookedLocked counts a deferred lookup as repeated. The caller must hold
+// o.mu.
+func (o *Outbox) lookedLocked() {
+	o.synced++
+	ledgerOutboxWork.Inc(endpointProductGet, "synced")
+}
+
+// attempted records the outcome of a sync round: err is why it stopped
+// early, nil once everything was sent. The outbox goes back online only if
+// nothing was queued meanwhile.
+func (o *Outbox) attempted(err error) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lastAttempt = time.Now()
+	if err != nil {
+		o.lastErr = err.Error()
+		return false
+	}
+	o.refreshLocked(0)
+	if writes, lookups := o.pendingLocked(); writes+lookups > 0 {
+		return false
+	}
+	o.lastSync = o.lastAttempt
+	if o.offline {
+		o.offline, o.since = false, o.lastAttempt
+		o.lastErr = ""
+		slog.Info("Passport service reachable again, queued work synced", "synced", o.synced)
+	}
+	o.gauges()
+	return true
+}
+
+// appendLocked adds op, already applied, to the file, or rewrites the file
+// once the state is empty or far smaller than it. The caller must hold
+// o.mu.
+func (o *Outbox) appendLocked(op *outboxOp) error {
+	if o.path == "" {
+		return nil
+	}
+	live := len(o.state.Writes) + len(o.state.Lookups) + len(o.state.Rejected)
+	if live == 0 || o.lines >= 2*live+compactSlack {
+		return o.compactLocked()
+	}
+	line, err := o.encode(op)
+	if err != nil {
+		return err
+	}
+	if o.f == nil {
+		if o.f, err = os.OpenFile(o.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+			return fmt.Errorf("open ledger outbox: %w", err)
+		}
+	}
+	if _, err := o.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("append to ledger outbox: %w", err)
+	}
+	o.lines++
+	return nil
+}
+
+// compactLocked atomically replaces the file with the changes that rebuild
+// the state and reopens it for appending. The caller must hold o.mu.
+func (o *Outbox) compactLocked() error {
+	ops := []*outboxOp{{Op: opNext, ID: o.state.NextID}}
+	for i := range o.state.Rejected {
+		w := &o.state.Rejected[i]
+		ops = append(ops, &outboxOp{Op: opWrite, Write: w}, &outboxOp{Op: opRefused, ID: w.ID, Error: w.Error})
+	}
+	for i := range o.state.Writes {
+		ops = append(ops, &outboxOp{Op: opWrite, Write: &o.state.Writes[i]})
+	}
+	for i := range o.state.Lookups {
+		ops = append(ops, &outboxOp{Op: opLookup, Lookup: &o.state.Lookups[i]})
+	}
+
+	tmp := o.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("rewrite ledger outbox: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	if o.c != nil {
+		w.Write(o.c.Header())
+		w.WriteByte('\n')
+	}
+	for _, op := range ops {
+		line, err := o.encode(op)
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("rewrite ledger outbox: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("rewrite ledger outbox: %w", err)
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, o.path); err != nil {
+		return fmt.Errorf("replace ledger outbox: %w", err)
+	}
+	if o.f != nil {
+		o.f.Close()
+	}
+	o.f, err = os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("reopen ledger outbox: %w", err)
+	}
+	o.lines = len(ops)
+	return nil
+}
+
+// encode renders op as one line of the file, sealed if it is encrypted.
+// JSON is compact, so queued bodies are sent byte for byte as they were
+// given.
+func (o *Outbox) encode(op *outboxOp) ([]byte, error) {
+	line, err := json.Marshal(op)
+	if err != nil {
+		return nil, fmt.Errorf("encode ledger outbox change: %w", err)
+	}
+	if o.c == nil {
+		return line, nil
+	}
+	sealed, err := o.c.Seal(line)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt ledger outbox change: %w", err)
+	}
+	return sealed, nil
+}
+
+// gauges updates the outbox metrics. The caller must hold o.mu, or own o.
+func (o *Outbox) gauges() {
+	offline := 0.0
+	if o.offline {
+		offline = 1
+	}
+	ledgerOffline.Set(offline)
+	writes, lookups := o.pendingLocked()
+	ledgerOutboxPending.Set(float64(writes), "write")
+	ledgerOutboxPending.Set(float64(lookups), "lookup")
+}
+
+// SyncStatus describes offline mode for the admin API. Writes are listed
+// without their bodies.
+type SyncStatus struct {
+	Online bool `json:"online"`
+	// Since is when the service went offline or came back.
+	Since       time.Time        `json:"since"`
+	Writes      []QueuedWrite    `json:"writes"`
+	Lookups     []DeferredLookup `json:"lookups"`
+	Rejected    []QueuedWrite    `json:"rejected"`
+	LastAttempt time.Time        `json:"last_attempt,omitzero"`
+	LastSync    time.Time        `json:"last_sync,omitzero"`
+	LastError   string           `json:"last_error,omitempty"`
+	// Synced counts the writes and lookups sent since startup.
+	Synced int `json:"synced"`
+}
+
+// SyncStatus returns the state of offline mode; the zero SyncStatus,
+// online, without EnableOffline.
+func (c *Client) SyncStatus() SyncStatus {
+	o := c.outbox
+	if o == nil {
+		return SyncStatus{Online: true}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.refreshLocked(time.Second)
+	st := o.state
+	if o.shared != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), sharedTimeout)
+		defer cancel()
+		var err error
+		if st, err = o.shared.list(ctx); err != nil {
+			slog.Warn("Failed to read shared ledger outbox", "error", err)
+		}
+	}
+	strip := func(ws []QueuedWrite) []QueuedWrite {
+		out := make([]QueuedWrite, len(ws))
+		for i, w := range ws {
+			w.Body = nil
+			out[i] = w
+		}
+		return out
+	}
+	return SyncStatus{
+		Online:      !o.offline,
+		Since:       o.since.UTC(),
+		Writes:      strip(st.Writes),
+		Lookups:     append([]DeferredLookup{}, st.Lookups...),
+		Rejected:    strip(st.Rejected),
+		LastAttempt: o.lastAttempt.UTC(),
+		LastSync:    o.lastSync.UTC(),
+		LastError:   o.lastErr,
+		Synced:      o.synced,
+	}
+}
+
+// SyncResult counts what a Sync round sent.
+type SyncResult struct {
+	Synced   int `json:"synced"`
+	Rejected int `json:"rejected"`
+	LookedUp int `json:"looked_up"`
+	// Online is whether the round left nothing queued.
+	Online bool   `json:"online"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Sync sends the queued writes in order, then repeats the deferred
+// lookups, stopping at the first the service still cannot be reached for.
+// Writes the service refuses are moved to the rejected list rather than
+// retried. Lookups cache their passports as usual. Once nothing is left,
+// the client is back online. Proxies syncing a shared outbox at the same
+// time drain it together, each sending writes the others have not taken.
+func (c *Client) Sync(ctx context.Context) SyncResult {
+	var res SyncResult
+	o := c.outbox
+	if o == nil {
+		res.Online = true
+		return res
+	}
+	o.syncing.Lock()
+	defer o.syncing.Unlock()
+	c.syncRounds(ctx, &res)
+	return res
+}
+
+// syncRounds drains the outbox until it is empty, a round fails or what is
+// left is being sent by other proxies.
+func (c *Client) syncRounds(ctx context.Context, res *SyncResult) {
+	o := c.outbox
+	for {
+		done := res.Synced + res.Rejected + res.LookedUp
+		err := c.syncOnce(ctx, res)
+		if res.Online = o.attempted(err); res.Online || err != nil {
+			if err != nil {
+				res.Error = err.Error()
+			}
+			return
+		}
+		if res.Synced+res.Rejected+res.LookedUp == done {
+			return
+		}
+	}
+}
+
+// syncOnce drains the outbox once, returning the error it stopped at.
+func (c *Client) syncOnce(ctx context.Context, res *SyncResult) error {
+	o := c.outbox
+	send := func(w QueuedWrite) (error, error) {
+		exists, err := c.alreadySent(ctx, w)
+		if err != nil && (unreachable(err) || ctx.Err() != nil) {
+			return nil, err
+		}
+		if exists {
+			slog.Info("Queued commissioning passport already in the passport service, not sent again", "id", w.ID, "queued_at", w.QueuedAt)
+			res.Synced++
+			return nil, nil
+		}
+		err = c.send(ctx, w.Endpoint, w.URL, w.Body)
+		if err != nil && (unreachable(err) || ctx.Err() != nil) {
+			return nil, err
+		}
+		if err != nil {
+			slog.Warn("Passport service refused a queued write", "endpoint", w.Endpoint, "id", w.ID, "queued_at", w.QueuedAt, "error", err)
+			res.Rejected++
+		} else {
+			res.Synced++
+		}
+		return err, nil
+	}
+	for {
+		took, err := o.takeWrite(ctx, send)
+		if err != nil {
+			return err
+		}
+		if !took {
+			break
+		}
+	}
+	lookup := func(l DeferredLookup) error {
+		p, err := c.fetchProductItemPassport(ctx, l.UUID)
+		c.recordLookup(l.UUID, p, err)
+		if err != nil && (unreachable(err) || ctx.Err() != nil) {
+			return err
+		}
+		switch {
+		case errors.Is(err, ErrPassportNotFound):
+			slog.Warn("Deferred passport lookup found no product item passport", "uuid", l.UUID, "deferred_at", l.DeferredAt)
+		case err != nil:
+			slog.Warn("Deferred passport lookup failed", "uuid", l.UUID, "deferred_at", l.DeferredAt, "error", err)
+		default:
+			slog.Info("Deferred passport lookup synced", "uuid", l.UUID, "deferred_at", l.DeferredAt, "records", len(p.Records))
+		}
+		res.LookedUp++
+		return nil
+	}
+	for {
+		took, err := o.takeLookup(ctx, lookup)
+		if err != nil {
+			return err
+		}
+		if !took {
+			break
+		}
+	}
+	return nil
+}
+
+// alreadySent reports whether the queued write w is a commissioning
+// passport the service holds already, e.g. because the POST that queued it
+// reached the service before failing. It needs EnableCommissioningQuery and
+// a body naming controller_uuid and timestamp; other writes are not
+// checked. A failed check is not fatal unless the service is unreachable.
+func (c *Client) alreadySent(ctx context.Context, w QueuedWrite) (bool, error) {
+	if w.Endpoint != endpointCommissioningPost || c.queryURL == "" {
+		return false, nil
+	}
+	var body struct {
+		ControllerUUID string `json:"controller_uuid"`
+		Timestamp      string `json:"timestamp"`
+	}
+	if json.Unmarshal(w.Body, &body) != nil || body.ControllerUUID == "" || body.Timestamp == "" {
+		return false, nil
+	}
+	exists, err := c.CommissioningPassportExists(ctx, body.ControllerUUID, body.Timestamp)
+	if err != nil {
+		slog.Warn("Could not check for a queued commissioning passport", "id", w.ID, "controller_uuid", body.ControllerUUID, "error", err)
+		return false, err
+	}
+	return exists, nil
+}
+
+// SyncPending runs one sync round if the service is held offline, as the
+// scheduler's ledger-sync job. It fails if the round left work queued
+// because the service still cannot be reached.
+func (c *Client) SyncPending(ctx context.Context) error {
+	if c.outbox == nil || !c.outbox.Offline() {
+		return nil
+	}
+	res := c.Sync(ctx)
+	if res.Synced+res.Rejected+res.LookedUp > 0 {
+		slog.Info("Ledger outbox synced", "synced", res.Synced, "rejected", res.Rejected, "looked_up", res.LookedUp, "online", res.Online)
+	}
+	if res.Error != "" {
+		return errors.New(res.Error)
+	}
+	return nil
+}
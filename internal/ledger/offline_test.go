@@ -0,0 +1,326 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/linecrypt"
+)
+
+func openOutbox(t *testing.T, path string, kw linecrypt.KeyWrapper) *Outbox {
+	t.Helper()
+	o, err := OpenOutbox(path, kw)
+	if err != nil {
+		t.Fatalf("OpenOutbox: %v", err)
+	}
+	t.Cleanup(func() { closeOutbox(o) })
+	return o
+}
+
+// closeOutbox releases the file of o, as a stopped proxy would.
+func closeOutbox(o *Outbox) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.f != nil {
+		o.f.Close()
+		o.f = nil
+	}
+}
+
+func queue(t *testing.T, o *Outbox, target string) {
+	t.Helper()
+	if err := o.queueWrite(endpointCommissioningPost, target, []byte(`{"n":1}`), nil); err != nil {
+		t.Fatalf("queueWrite(%s): %v", target, err)
+	}
+}
+
+// ids lists the IDs of ws.
+func ids(ws []QueuedWrite) []uint64 {
+	out := []uint64{}
+	for _, w := range ws {
+		out = append(out, w.ID)
+	}
+	return out
+}
+
+// fileLines counts the lines of the file at path.
+func fileLines(t *testing.T, path string) int {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(b, []byte("\n"))
+}
+
+func TestOutboxTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o := openOutbox(t, path, nil)
+	queue(t, o, "http://ledger/1")
+	queue(t, o, "http://ledger/2")
+	o.deferLookup("uuid-1", errors.New("down"))
+	closeOutbox(o)
+
+	// The proxy died halfway through appending a third write
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"write","write":{"id":3,"endpoint":"commiss`)
+	f.Close()
+
+	o = openOutbox(t, path, nil)
+	if got := ids(o.state.Writes); !reflect.DeepEqual(got, []uint64{1, 2}) {
+		t.Errorf("writes after replay = %v, want [1 2]", got)
+	}
+	if len(o.state.Lookups) != 1 || o.state.Lookups[0].UUID != "uuid-1" {
+		t.Errorf("lookups after replay = %+v, want uuid-1", o.state.Lookups)
+	}
+	if !o.Offline() {
+		t.Error("outbox with work left is online, want offline")
+	}
+
+	// The next write must not run into the torn line
+	queue(t, o, "http://ledger/3")
+	closeOutbox(o)
+	o = openOutbox(t, path, nil)
+	if got := ids(o.state.Writes); !reflect.DeepEqual(got, []uint64{1, 2, 3}) {
+		t.Errorf("writes after appending = %v, want [1 2 3]", got)
+	}
+	if o.state.Writes[2].URL != "http://ledger/3" {
+		t.Errorf("write 3 URL = %q, want http://ledger/3", o.state.Writes[2].URL)
+	}
+}
+
+func TestOutboxLegacy(t *testing.T) {
+	queuedAt := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	legacy := outboxFile{
+		NextID: 7,
+		Writes: []QueuedWrite{
+			{ID: 5, Endpoint: endpointCommissioningPost, URL: "http://ledger/5", Body: json.RawMessage(`{"n":5}`), QueuedAt: queuedAt},
+			{ID: 7, Endpoint: endpointFailurePost, URL: "http://ledger/7", Body: json.RawMessage(`{"n":7}`), QueuedAt: queuedAt},
+		},
+		Lookups:  []DeferredLookup{{UUID: "uuid-1", DeferredAt: queuedAt}},
+		Rejected: []QueuedWrite{{ID: 2, Endpoint: endpointCommissioningPost, URL: "http://ledger/2", QueuedAt: queuedAt, Error: "status 400"}},
+	}
+	// Earlier versions saved the state as one compact JSON object
+	b, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kw, err := linecrypt.NewLocalKeyWrapper(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		kw   linecrypt.KeyWrapper
+	}{
+		{"plaintext", nil},
+		{"encrypted", kw},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "outbox.json")
+			if err := os.WriteFile(path, b, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			o := openOutbox(t, path, tc.kw)
+			if !reflect.DeepEqual(o.state, legacy) {
+				t.Errorf("state = %+v, want %+v", o.state, legacy)
+			}
+			closeOutbox(o)
+
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.HasPrefix(raw, []byte(`{"next_id"`)) {
+				t.Fatal("legacy file was not rewritten as a journal")
+			}
+			if tc.kw != nil && bytes.Contains(raw, []byte("http://ledger")) {
+				t.Error("rewritten file leaks plaintext")
+			}
+			if tc.kw != nil {
+				if _, err := OpenOutbox(path, nil); err == nil {
+					t.Error("OpenOutbox without a key opened the encrypted file")
+				}
+			}
+
+			o = openOutbox(t, path, tc.kw)
+			if !reflect.DeepEqual(o.state, legacy) {
+				t.Errorf("state after reopening = %+v, want %+v", o.state, legacy)
+			}
+			queue(t, o, "http://ledger/8")
+			if id := o.state.Writes[len(o.state.Writes)-1].ID; id != 8 {
+				t.Errorf("next write ID = %d, want 8", id)
+			}
+		})
+	}
+}
+
+func TestOutboxCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o := openOutbox(t, path, nil)
+	ctx := context.Background()
+
+	queue(t, o, "http://ledger/refused")
+	o.takeWrite(ctx, func(QueuedWrite) (error, error) { return errors.New("status 400"), nil })
+	queue(t, o, "http://ledger/kept")
+	o.deferLookup("uuid-1", nil)
+
+	// Sent writes leave lines behind until the file is rewritten
+	const sent = compactSlack
+	for i := 0; i < sent; i++ {
+		queue(t, o, "http://ledger/sent")
+		o.mu.Lock()
+		last := o.state.Writes[len(o.state.Writes)-1]
+		_, err := o.changeLocked(&outboxOp{Op: opSent, ID: last.ID})
+		o.mu.Unlock()
+		if err != nil {
+			t.Fatalf("send write %d: %v", last.ID, err)
+		}
+	}
+	if n := fileLines(t, path); n >= 2*sent {
+		t.Errorf("file holds %d lines after %d writes sent, want it compacted", n, sent)
+	}
+
+	want := o.state
+	closeOutbox(o)
+	o = openOutbox(t, path, nil)
+	if !reflect.DeepEqual(o.state, want) {
+		t.Errorf("state after compaction = %+v, want %+v", o.state, want)
+	}
+	if got := ids(o.state.Rejected); !reflect.DeepEqual(got, []uint64{1}) || o.state.Rejected[0].Error != "status 400" {
+		t.Errorf("rejected = %+v, want write 1 with its error", o.state.Rejected)
+	}
+	if got := ids(o.state.Writes); !reflect.DeepEqual(got, []uint64{2}) {
+		t.Errorf("writes = %v, want [2]", got)
+	}
+	if o.state.NextID != sent+2 {
+		t.Errorf("NextID = %d, want %d", o.state.NextID, sent+2)
+	}
+}
+
+func TestOutboxEmptyKeepsNextID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o := openOutbox(t, path, nil)
+	queue(t, o, "http://ledger/1")
+	queue(t, o, "http://ledger/2")
+	for {
+		took, err := o.takeWrite(context.Background(), func(QueuedWrite) (error, error) { return nil, nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !took {
+			break
+		}
+	}
+	if n := fileLines(t, path); n != 1 {
+		t.Errorf("empty outbox file holds %d lines, want 1", n)
+	}
+	closeOutbox(o)
+
+	o = openOutbox(t, path, nil)
+	if o.Offline() {
+		t.Error("empty outbox opened offline")
+	}
+	queue(t, o, "http://ledger/3")
+	if id := o.state.Writes[0].ID; id != 3 {
+		t.Errorf("write ID after reopening = %d, want 3", id)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"network", &url.Error{Op: "Post", URL: "http://ledger", Err: errors.New("connection refused")}, true},
+		{"breaker", fmt.Errorf("%s: %w", endpointCommissioningPost, ErrBreakerOpen), true},
+		{"500", &statusError{status: http.StatusInternalServerError}, true},
+		{"503", &statusError{status: http.StatusServiceUnavailable}, true},
+		{"429", &statusError{status: http.StatusTooManyRequests}, true},
+		{"400", &statusError{status: http.StatusBadRequest}, false},
+		{"404", &statusError{status: http.StatusNotFound}, false},
+		{"409", &statusError{status: http.StatusConflict}, false},
+		{"other", errors.New("bad body"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := unreachable(tc.err); got != tc.want {
+				t.Errorf("unreachable(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSyncRefusedAndUnreachable(t *testing.T) {
+	var busy atomic.Bool
+	busy.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/refuse":
+			http.Error(w, "no such controller", http.StatusBadRequest)
+		case r.URL.Path == "/busy" && busy.Load():
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer srv.Close()
+
+	c := &Client{productHTTP: &http.Client{}, commissioningHTTP: &http.Client{}}
+	c.buildTransports()
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o := openOutbox(t, path, nil)
+	c.EnableOffline(o)
+	for _, p := range []string{"/ok", "/refuse", "/busy", "/after"} {
+		queue(t, o, srv.URL+p)
+	}
+
+	ctx := context.Background()
+	res := c.Sync(ctx)
+	if res.Synced != 1 || res.Rejected != 1 || res.Online {
+		t.Errorf("first sync = %+v, want 1 synced, 1 rejected, offline", res)
+	}
+	if !strings.Contains(res.Error, "429") {
+		t.Errorf("first sync error = %q, want the 429", res.Error)
+	}
+	st := c.SyncStatus()
+	if got := ids(st.Writes); !reflect.DeepEqual(got, []uint64{3, 4}) {
+		t.Errorf("writes left = %v, want [3 4]", got)
+	}
+	if got := ids(st.Rejected); !reflect.DeepEqual(got, []uint64{2}) || !strings.Contains(st.Rejected[0].Error, "400") {
+		t.Errorf("rejected = %+v, want write 2 with its 400", st.Rejected)
+	}
+
+	busy.Store(false)
+	res = c.Sync(ctx)
+	if res.Synced != 2 || res.Rejected != 0 || !res.Online || res.Error != "" {
+		t.Errorf("second sync = %+v, want 2 synced, online", res)
+	}
+	if c.outbox.Offline() {
+		t.Error("outbox offline after a complete sync")
+	}
+
+	closeOutbox(o)
+	o = openOutbox(t, path, nil)
+	if len(o.state.Writes) != 0 || len(o.state.Rejected) != 1 || o.state.NextID != 4 {
+		t.Errorf("state after reopening = %+v, want only write 2 rejected and NextID 4", o.state)
+	}
+}
@@ -0,0 +1,323 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/linecrypt"
+	"github.com/fdo-server-wrapper/internal/pg"
+)
+
+// sharedOutbox stores an outbox's work where several proxies reach it.
+type sharedOutbox interface {
+	// counts returns how many writes and lookups are queued.
+	counts(ctx context.Context) (writes, lookups int, err error)
+	// list returns the queued and rejected writes, without their bodies,
+	// and the deferred lookups.
+	list(ctx context.Context) (outboxFile, error)
+	// addWrite queues w, returning it with its ID.
+	addWrite(ctx context.Context, w QueuedWrite) (QueuedWrite, error)
+	// addLookup defers l, reporting false if its UUID already is.
+	addLookup(ctx context.Context, l DeferredLookup) (bool, error)
+	// takeWrite locks the oldest queued write no other proxy holds and
+	// passes it to fn. Unless fn fails the write is removed, or kept as
+	// rejected if fn returns it refused. It reports false if there was no
+	// write to take.
+	takeWrite(ctx context.Context, fn func(QueuedWrite) (refused, err error)) (bool, error)
+	// takeLookup does the same for the oldest deferred lookup.
+	takeLookup(ctx context.Context, fn func(DeferredLookup) error) (bool, error)
+}
+
+// pgOutbox keeps the work in PostgreSQL tables, one row per queued write
+// and per deferred lookup. Proxies syncing at the same time each lock the
+// oldest row the others have not (FOR UPDATE SKIP LOCKED), so they send
+// different writes rather than waiting on each other.
+type pgOutbox struct {
+	db *pg.DB
+	c  *linecrypt.Cipher // nil for plaintext writes
+}
+
+// outboxHeader names the wrapped data key of an encrypted outbox in
+// fdo_proxy_store_meta.
+const outboxHeader = "ledger_outbox_header"
+
+// OpenSharedOutbox opens an outbox kept in db, whose schema the caller has
+// migrated, so the proxies using the database share one queue of passport
+// service work. kw works as for OpenOutbox: queued writes are sealed with
+// it, plaintext ones encrypted in place, and a nil kw fails on an
+// encrypted outbox. Like OpenOutbox, it starts offline if work is queued.
+func OpenSharedOutbox(ctx context.Context, db *pg.DB, kw linecrypt.KeyWrapper) (*Outbox, error) {
+	p := &pgOutbox{db: db}
+	if err := p.open(ctx, kw); err != nil {
+		return nil, fmt.Errorf("open ledger outbox %s: %w", db, err)
+	}
+	writes, lookups, err := p.counts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read ledger outbox: %w", err)
+	}
+	o := &Outbox{shared: p, since: time.Now()}
+	o.refreshed = o.since
+	o.sharedWrites, o.sharedLookups = writes, lookups
+	o.offline = writes+lookups > 0
+	o.gauges()
+	return o, nil
+}
+
+// open reads the outbox's wrapped data key, first sealing the queued
+// writes with a new one if kw is given and there is none.
+func (p *pgOutbox) open(ctx context.Context, kw linecrypt.KeyWrapper) error {
+	header, err := p.header(ctx, p.db)
+	if err != nil {
+		return err
+	}
+	if header != nil {
+		p.c, _, err = linecrypt.ParseHeader(header, kw)
+		return err
+	}
+	if kw == nil {
+		return nil
+	}
+	n := 0
+	err = p.db.Tx(ctx, func(tx *pg.Tx) error {
+		// A proxy starting at the same time waits here, then finds the
+		// outbox encrypted by the first
+		if _, err := tx.Exec(ctx, `LOCK TABLE fdo_proxy_store_meta`); err != nil {
+			return err
+		}
+		header, err := p.header(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if header != nil {
+			p.c, _, err = linecrypt.ParseHeader(header, kw)
+			return err
+		}
+		c, err := linecrypt.New(kw)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Query(ctx, `SELECT id, record FROM fdo_proxy_ledger_writes FOR UPDATE`)
+		if err != nil {
+			return err
+		}
+		for _, row := range res.Rows {
+			sealed, err := c.Seal([]byte(*row[1]))
+			if err != nil {
+				return fmt.Errorf("encrypt queued write: %w", err)
+			}
+			if _, err := tx.Exec(ctx, `UPDATE fdo_proxy_ledger_writes SET record = $1 WHERE id = $2`, string(sealed), *row[0]); err != nil {
+				return err
+			}
+			n++
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO fdo_proxy_store_meta (name, value) VALUES ($1, $2)`, outboxHeader, string(c.Header())); err != nil {
+			return err
+		}
+		p.c = c
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("encrypt ledger outbox: %w", err)
+	}
+	if n > 0 {
+		slog.Info("Encrypted plaintext ledger outbox", "database", p.db.String(), "writes", n)
+	}
+	return nil
+}
+
+// querier is a DB or a transaction.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (*pg.Result, error)
+}
+
+// header returns the encrypted outbox header, nil for a plaintext outbox.
+func (p *pgOutbox) header(ctx context.Context, q querier) ([]byte, error) {
+	res, err := q.Query(ctx, `SELECT value FROM fdo_proxy_store_meta WHERE name = $1`, outboxHeader)
+	if err != nil || len(res.Rows) == 0 {
+		return nil, err
+	}
+	return []byte(*res.Rows[0][0]), nil
+}
+
+// encode renders w as it is stored, sealed if the outbox is encrypted.
+func (p *pgOutbox) encode(w QueuedWrite) (string, error) {
+	b, err := json.Marshal(w)
+	if err != nil {
+		return "", fmt.Errorf("encode queued write: %w", err)
+	}
+	if p.c != nil {
+		if b, err = p.c.Seal(b); err != nil {
+			return "", fmt.Errorf("encrypt queued write: %w", err)
+		}
+	}
+	return string(b), nil
+}
+
+// decode parses the stored write of row id.
+func (p *pgOutbox) decode(id, stored string) (QueuedWrite, error) {
+	var w QueuedWrite
+	b := []byte(stored)
+	if p.c != nil {
+		var err error
+		if b, err = p.c.Open(b); err != nil {
+			return w, fmt.Errorf("decrypt queued write %s: %w", id, err)
+		}
+	}
+	if err := json.Unmarshal(b, &w); err != nil {
+		return w, fmt.Errorf("parse queued write %s: %w", id, err)
+	}
+	var err error
+	if w.ID, err = strconv.ParseUint(id, 10, 64); err != nil {
+		return w, fmt.Errorf("queued write ID %q: %w", id, err)
+	}
+	return w, nil
+}
+
+func (p *pgOutbox) counts(ctx context.Context) (int, int, error) {
+	res, err := p.db.Query(ctx, `SELECT
+		(SELECT count(*) FROM fdo_proxy_ledger_writes WHERE rejected_at IS NULL),
+		(SELECT count(*) FROM fdo_proxy_ledger_lookups)`)
+	if err != nil {
+		return 0, 0, err
+	}
+	writes, _ := strconv.Atoi(*res.Rows[0][0])
+	lookups, _ := strconv.Atoi(*res.Rows[0][1])
+	return writes, lookups, nil
+}
+
+func (p *pgOutbox) list(ctx context.Context) (outboxFile, error) {
+	var st outboxFile
+	res, err := p.db.Query(ctx, `SELECT id, record, rejected_at IS NOT NULL FROM fdo_proxy_ledger_writes ORDER BY id`)
+	if err != nil {
+		return st, err
+	}
+	for _, row := range res.Rows {
+		w, err := p.decode(*row[0], *row[1])
+		if err != nil {
+			slog.Warn("Skipping unreadable queued write", "database", p.db.String(), "error", err)
+			continue
+		}
+		w.Body = nil
+		if *row[2] == "t" {
+			st.Rejected = append(st.Rejected, w)
+		} else {
+			st.Writes = append(st.Writes, w)
+		}
+	}
+	res, err = p.db.Query(ctx, `SELECT uuid, `+utcText("deferred_at")+` FROM fdo_proxy_ledger_lookups ORDER BY deferred_at, uuid`)
+	if err != nil {
+		return st, err
+	}
+	for _, row := range res.Rows {
+		st.Lookups = append(st.Lookups, lookupRow(row))
+	}
+	return st, nil
+}
+
+func (p *pgOutbox) addWrite(ctx context.Context, w QueuedWrite) (QueuedWrite, error) {
+	w.ID = 0
+	stored, err := p.encode(w)
+	if err != nil {
+		return w, err
+	}
+	res, err := p.db.Query(ctx, `INSERT INTO fdo_proxy_ledger_writes (record)
+		SELECT $1::text WHERE (SELECT count(*) FROM fdo_proxy_ledger_writes WHERE rejected_at IS NULL) < $2
+		RETURNING id`, stored, maxQueued)
+	if err != nil {
+		return w, err
+	}
+	if len(res.Rows) == 0 {
+		return w, fmt.Errorf("ledger outbox full (%d writes)", maxQueued)
+	}
+	w.ID, err = strconv.ParseUint(*res.Rows[0][0], 10, 64)
+	return w, err
+}
+
+func (p *pgOutbox) addLookup(ctx context.Context, l DeferredLookup) (bool, error) {
+	n, err := p.db.Exec(ctx, `INSERT INTO fdo_proxy_ledger_lookups (uuid, deferred_at)
+		SELECT $1::text, $2::timestamptz WHERE (SELECT count(*) FROM fdo_proxy_ledger_lookups) < $3
+		ON CONFLICT (uuid) DO NOTHING`, l.UUID, l.DeferredAt, maxQueued)
+	return n > 0, err
+}
+
+func (p *pgOutbox) takeWrite(ctx context.Context, fn func(QueuedWrite) (refused, err error)) (bool, error) {
+	took := false
+	err := p.db.Tx(ctx, func(tx *pg.Tx) error {
+		res, err := tx.Query(ctx, `SELECT id, record FROM fdo_proxy_ledger_writes
+			WHERE rejected_at IS NULL ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED`)
+		if err != nil || len(res.Rows) == 0 {
+			return err
+		}
+		took = true
+		id := *res.Rows[0][0]
+		w, err := p.decode(id, *res.Rows[0][1])
+		if err != nil {
+			// Left in place, it would be taken first on every round
+			slog.Warn("Rejecting unreadable queued write", "database", p.db.String(), "error", err)
+			return p.reject(ctx, tx, id)
+		}
+		refused, err := fn(w)
+		if err != nil {
+			return err
+		}
+		if refused == nil {
+			_, err = tx.Exec(ctx, `DELETE FROM fdo_proxy_ledger_writes WHERE id = $1`, id)
+			return err
+		}
+		w.ID, w.Error = 0, refused.Error()
+		stored, err := p.encode(w)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE fdo_proxy_ledger_writes SET record = $1 WHERE id = $2`, stored, id); err != nil {
+			return err
+		}
+		return p.reject(ctx, tx, id)
+	})
+	return took, err
+}
+
+// reject marks write id rejected and drops all but the last maxRejected
+// rejected writes.
+func (p *pgOutbox) reject(ctx context.Context, tx *pg.Tx, id string) error {
+	if _, err := tx.Exec(ctx, `UPDATE fdo_proxy_ledger_writes SET rejected_at = now() WHERE id = $1`, id); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, `DELETE FROM fdo_proxy_ledger_writes WHERE rejected_at IS NOT NULL AND id NOT IN (
+		SELECT id FROM fdo_proxy_ledger_writes WHERE rejected_at IS NOT NULL ORDER BY rejected_at DESC, id DESC LIMIT $1)`, maxRejected)
+	return err
+}
+
+func (p *pgOutbox) takeLookup(ctx context.Context, fn func(DeferredLookup) error) (bool, error) {
+	took := false
+	err := p.db.Tx(ctx, func(tx *pg.Tx) error {
+		res, err := tx.Query(ctx, `SELECT uuid, `+utcText("deferred_at")+` FROM fdo_proxy_ledger_lookups
+			ORDER BY deferred_at, uuid LIMIT 1 FOR UPDATE SKIP LOCKED`)
+		if err != nil || len(res.Rows) == 0 {
+			return err
+		}
+		took = true
+		l := lookupRow(res.Rows[0])
+		if err := fn(l); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM fdo_proxy_ledger_lookups WHERE uuid = $1`, l.UUID)
+		return err
+	})
+	return took, err
+}
+
+// utcText selects the timestamptz column as RFC 3339 in UTC.
+func utcText(column string) string {
+	return `to_char(` + column + ` AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"')`
+}
+
+// lookupRow parses a row of uuid and utcText(deferred_at).
+func lookupRow(row []*string) DeferredLookup {
+	at, _ := time.Parse(time.RFC3339Nano, *row[1])
+	return DeferredLookup{UUID: *row[0], DeferredAt: at}
+}
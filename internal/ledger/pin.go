@@ -0,0 +1,114 @@
+package ledger
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/fdo-server-wrapper/internal/revocation"
+)
+
+// Pin is a SHA-256 digest one certificate of the passport service's
+// verified chain must match, on top of CA validation.
+type Pin struct {
+	// SPKI pins the certificate's public key, so it survives reissuance
+	// with the same key; otherwise the whole DER certificate is pinned.
+	SPKI   bool
+	Digest [sha256.Size]byte
+}
+
+// ParsePin parses "spki-sha256:<digest>" or "cert-sha256:<digest>", with
+// the digest in base64 or hex (colons allowed, as openssl prints it).
+func ParsePin(s string) (Pin, error) {
+	kind, digest, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return Pin{}, fmt.Errorf("pin %q: want spki-sha256:<digest> or cert-sha256:<digest>", s)
+	}
+	var p Pin
+	switch kind {
+	case "spki-sha256":
+		p.SPKI = true
+	case "cert-sha256":
+	default:
+		return Pin{}, fmt.Errorf("pin %q: unknown kind %q", s, kind)
+	}
+	raw, err := hex.DecodeString(strings.ReplaceAll(digest, ":", ""))
+	if err != nil {
+		raw, err = base64.StdEncoding.DecodeString(digest)
+	}
+	if err != nil || len(raw) != sha256.Size {
+		return Pin{}, fmt.Errorf("pin %q: digest is not a SHA-256 hash in hex or base64", s)
+	}
+	copy(p.Digest[:], raw)
+	return p, nil
+}
+
+func (p Pin) matches(cert *x509.Certificate) bool {
+	data := cert.Raw
+	if p.SPKI {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	sum := sha256.Sum256(data)
+	return bytes.Equal(sum[:], p.Digest[:])
+}
+
+// errPinMismatch fails the TLS handshake with a pinned service.
+var errPinMismatch = errors.New("passport service certificate matches no pin")
+
+// PinServer additionally requires the passport service's verified chain
+// to contain a certificate matching one of pins, so a certificate issued by
+// another CA the trust store accepts is refused. Pin the service's leaf or
+// its own issuing CA; pinning a shared root defeats the purpose. List the
+// next key's pin ahead of a rotation. Call before the client is used.
+func (c *Client) PinServer(pins []Pin) {
+	if len(pins) == 0 {
+		return
+	}
+	c.addConnectionCheck(func(cs tls.ConnectionState) error {
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				for _, p := range pins {
+					if p.matches(cert) {
+						return nil
+					}
+				}
+			}
+		}
+		ledgerPinFailures.Inc(cs.ServerName)
+		if len(cs.PeerCertificates) > 0 {
+			sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			slog.Warn("Passport service certificate matches no pin", "server", cs.ServerName,
+				"spki_sha256", base64.StdEncoding.EncodeToString(sum[:]))
+		}
+		return errPinMismatch
+	})
+}
+
+// CheckRevocation refuses passport service certificates chk finds revoked,
+// or whose status it cannot determine in hard-fail mode.
+// Call before the client is used.
+func (c *Client) CheckRevocation(chk *revocation.Checker) {
+	c.addConnectionCheck(chk.VerifyConnection("passport_service"))
+}
+
+// addConnectionCheck runs check after CA validation of every passport
+// service handshake, after the checks added before it.
+func (c *Client) addConnectionCheck(check func(tls.ConnectionState) error) {
+	c.connChecks = append(c.connChecks, check)
+	checks := c.connChecks
+	c.productTLS.VerifyConnection = func(cs tls.ConnectionState) error {
+		for _, check := range checks {
+			if err := check(cs); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,205 @@
+package ledger
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+// LoadManifest reads the product UUIDs expected in a production batch.
+//
+// Supported formats, selected by file extension:
+//   - .csv: one UUID per row in the first column, or in a column named "uuid"
+//     when a header row is present
+//   - .json: an array of UUID strings, an array of objects with a "uuid"
+//     field, or an object of the form {"uuids": [...]}
+//
+// UUIDs are put in the canonical lowercase form DI looks passports up by;
+// entries that are not UUIDs are dropped with a warning, as are blank
+// entries and duplicates. Order is preserved.
+func LoadManifest(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open manifest: %w", err)
+	}
+	defer f.Close()
+
+	var uuids []string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		uuids, err = parseCSVManifest(f)
+	case ".json":
+		uuids, err = parseJSONManifest(f)
+	default:
+		return nil, fmt.Errorf("unsupported manifest format %q (want .csv or .json)", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dedupe(uuids), nil
+}
+
+func parseCSVManifest(r io.Reader) ([]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("parse CSV manifest: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	// Honor a header row if one names a uuid column
+	col := 0
+	for i, name := range rows[0] {
+		if strings.EqualFold(strings.TrimSpace(name), "uuid") {
+			col = i
+			rows = rows[1:]
+			break
+		}
+	}
+
+	var out []string
+	for _, row := range rows {
+		if col < len(row) {
+			out = append(out, row[col])
+		}
+	}
+	return out, nil
+}
+
+func parseJSONManifest(r io.Reader) ([]string, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read JSON manifest: %w", err)
+	}
+
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return list, nil
+	}
+
+	var objects []struct {
+		UUID string `json:"uuid"`
+	}
+	if err := json.Unmarshal(raw, &objects); err == nil {
+		for _, o := range objects {
+			list = append(list, o.UUID)
+		}
+		return list, nil
+	}
+
+	var wrapped struct {
+		UUIDs []string `json:"uuids"`
+	}
+	if err := json.Unmarshal(raw, &wrapped); err != nil {
+		return nil, fmt.Errorf("parse JSON manifest: %w", err)
+	}
+	return wrapped.UUIDs, nil
+}
+
+func dedupe(in []string) []string {
+	seen := make(map[string]bool, len(in))
+	out := make([]string, 0, len(in))
+	for _, s := range in {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		g, err := fdo.ParseGUID(s)
+		if err != nil {
+			slog.Warn("Manifest entry is not a product UUID, skipped", "entry", s)
+			continue
+		}
+		if s = g.String(); seen[s] {
+			continue
+		}
+		seen[s] = true
+		out = append(out, s)
+	}
+	return out
+}
+
+// PrefetchResult summarizes a prefetch run.
+type PrefetchResult struct {
+	Requested int
+	Loaded    int
+	Failed    int
+	Duration  time.Duration
+}
+
+// Prefetch loads the passports for uuids into the cache ahead of DI so the
+// first device of each product doesn't pay for the ledger round trip.
+//
+// Contract:
+//
+//	Preconditions:
+//	  - caching is enabled (see EnableCache)
+//	  - concurrency > 0; values <= 0 are treated as 1
+//
+//	Postconditions:
+//	  - Every UUID that could be fetched is in the cache
+//	  - Individual lookup failures are logged and counted, not returned
+//	  - Returns an error only if caching is disabled
+func (c *Client) Prefetch(ctx context.Context, uuids []string, concurrency int) (PrefetchResult, error) {
+	if c.cache == nil {
+		return PrefetchResult{}, fmt.Errorf("passport cache not enabled")
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	start := time.Now()
+	res := PrefetchResult{Requested: len(uuids)}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		work = make(chan string)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uuid := range work {
+				p, err := c.fetchProductItemPassport(ctx, uuid)
+				c.recordLookup(uuid, p, err)
+				mu.Lock()
+				if err != nil {
+					res.Failed++
+					slog.Warn("Passport prefetch failed", "uuid", uuid, "error", err)
+				} else {
+					res.Loaded++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, uuid := range uuids {
+		select {
+		case <-ctx.Done():
+			break feed
+		case work <- uuid:
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	res.Duration = time.Since(start)
+	return res, nil
+}
@@ -0,0 +1,149 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+const (
+	// DefaultListLimit is the page size of ListProductItemPassports when
+	// none is given.
+	DefaultListLimit = 100
+	// MaxListLimit bounds the page size of ListProductItemPassports.
+	MaxListLimit = 1000
+)
+
+// ProductItemPage is one page of the product item passport list.
+type ProductItemPage struct {
+	Passports []ProductItemPassport `json:"passports"`
+	// Next is the cursor of the following page, empty on the last.
+	Next string `json:"next,omitempty"`
+}
+
+// ListProductItemPassports returns one page of the product item passports
+// the external service holds, starting at cursor (empty for the first
+// page), with up to limit passports.
+//
+// Contract:
+//
+//	  Preconditions:
+//	    - ctx is not nil
+//	    - productBaseURL is configured
+//	    - limit is between 1 and MaxListLimit; 0 means DefaultListLimit
+//
+//	  Postconditions:
+//	    - Returns the page and the cursor of the next, empty on the last
+//	    - Returns nil and error if service unavailable or invalid response
+//
+//	  Error Conditions:
+//	    - Network errors: connection failures, timeouts (retried if enabled)
+//	    - Breaker: ErrBreakerOpen while the endpoint's circuit breaker is open
+//	    - HTTP errors: non-200 status codes, e.g. for a stale cursor
+//	    - JSON errors: malformed response body
+//
+//		GET {productBaseURL}/product_item/?limit={limit}[&cursor={cursor}]
+//
+// The response is {"passports": [...], "next": "..."}. Like
+// FetchProductItemPassport, it neither reads nor fills the cache.
+func (c *Client) ListProductItemPassports(ctx context.Context, cursor string, limit int) (*ProductItemPage, error) {
+	if c.productBaseURL == "" {
+		return nil, fmt.Errorf("product base URL not configured")
+	}
+	if limit == 0 {
+		limit = DefaultListLimit
+	}
+	if limit < 0 || limit > MaxListLimit {
+		return nil, fmt.Errorf("list limit %d out of range 1-%d", limit, MaxListLimit)
+	}
+	u, err := url.Parse(c.productBaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse base URL: %w", err)
+	}
+	u.Path = "/product_item/"
+	q := u.Query()
+	q.Set("limit", strconv.Itoa(limit))
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	u.RawQuery = q.Encode()
+
+	resp, err := c.do(endpointProductList, c.productHTTP, c.productRetries, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, &statusError{request: "passport list GET", status: resp.StatusCode, body: string(b)}
+	}
+	var page ProductItemPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	if page.Passports == nil {
+		page.Passports = []ProductItemPassport{}
+	}
+	if page.Next == cursor && cursor != "" {
+		return nil, fmt.Errorf("passport list: cursor %q repeats", cursor)
+	}
+	return &page, nil
+}
+
+// PrefetchAll loads every passport the service lists into the cache, a
+// page of pageSize at a time, instead of looking each up as Prefetch does.
+//
+// Contract:
+//
+//	Preconditions:
+//	  - caching is enabled (see EnableCache)
+//
+//	Postconditions:
+//	  - Every listed passport with a UUID is in the cache, under the
+//	    canonical form DI looks it up by
+//	  - Returns what was loaded and an error if a page failed, keeping
+//	    the passports of the pages before it
+func (c *Client) PrefetchAll(ctx context.Context, pageSize int) (PrefetchResult, error) {
+	if c.cache == nil {
+		return PrefetchResult{}, fmt.Errorf("passport cache not enabled")
+	}
+	start := time.Now()
+	var res PrefetchResult
+	cursor := ""
+	for range maxListPages {
+		page, err := c.ListProductItemPassports(ctx, cursor, pageSize)
+		if err != nil {
+			res.Duration = time.Since(start)
+			return res, err
+		}
+		for i := range page.Passports {
+			p := &page.Passports[i]
+			res.Requested++
+			g, err := fdo.ParseGUID(p.UUID)
+			if err != nil {
+				res.Failed++
+				slog.Warn("Listed product passport has no valid UUID, not cached", "uuid", p.UUID)
+				continue
+			}
+			c.recordLookup(g.String(), p, nil)
+			res.Loaded++
+		}
+		if page.Next == "" {
+			res.Duration = time.Since(start)
+			return res, nil
+		}
+		cursor = page.Next
+	}
+	res.Duration = time.Since(start)
+	return res, fmt.Errorf("passport list longer than %d pages", maxListPages)
+}
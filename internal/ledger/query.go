@@ -0,0 +1,109 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// EnableCommissioningQuery configures the endpoint answering which
+// commissioning passports exist for a controller UUID. An empty URL leaves
+// querying disabled.
+func (c *Client) EnableCommissioningQuery(url string) {
+	c.queryURL = url
+}
+
+// CommissioningQueryEnabled reports whether EnableCommissioningQuery was
+// given a URL.
+func (c *Client) CommissioningQueryEnabled() bool {
+	return c.queryURL != ""
+}
+
+// GetCommissioningPassports returns the commissioning passports the
+// external service holds for controllerUUID, oldest first if the service
+// orders them.
+//
+// Contract:
+//
+//	  Preconditions:
+//	    - ctx is not nil
+//	    - controllerUUID is a non-empty string
+//	    - queryURL is configured
+//
+//	  Postconditions:
+//	    - Returns every passport of the controller, empty if it has none
+//	    - Returns nil and error if service unavailable or invalid response
+//
+//	  Error Conditions:
+//	    - Network errors: connection failures, timeouts (never retried)
+//	    - Breaker: ErrBreakerOpen while the endpoint's circuit breaker is open
+//	    - HTTP errors: non-200 status codes other than 404
+//	    - JSON errors: malformed response body
+//
+//		GET {queryURL}?controller_uuid={controllerUUID}
+//
+// The response is {"passports": [...]} as for ListCommissioningPassports;
+// 404 means none.
+func (c *Client) GetCommissioningPassports(ctx context.Context, controllerUUID string) ([]CommissioningEntry, error) {
+	if c.queryURL == "" {
+		return nil, fmt.Errorf("commissioning query URL not configured")
+	}
+	if controllerUUID == "" {
+		return nil, fmt.Errorf("controller UUID required")
+	}
+	u, err := url.Parse(c.queryURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse query URL: %w", err)
+	}
+	q := u.Query()
+	q.Set("controller_uuid", controllerUUID)
+	u.RawQuery = q.Encode()
+
+	resp, err := c.do(endpointCommissioningGet, c.commissioningHTTP, 0, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return []CommissioningEntry{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, &statusError{request: "commissioning GET", status: resp.StatusCode, body: string(b)}
+	}
+	var out struct {
+		Passports []CommissioningEntry `json:"passports"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	if out.Passports == nil {
+		out.Passports = []CommissioningEntry{}
+	}
+	return out.Passports, nil
+}
+
+// CommissioningPassportExists reports whether the external service holds
+// a commissioning passport for controllerUUID and, if timestamp is not
+// empty, with that timestamp: the passport of one onboarding rather than
+// of any.
+func (c *Client) CommissioningPassportExists(ctx context.Context, controllerUUID, timestamp string) (bool, error) {
+	entries, err := c.GetCommissioningPassports(ctx, controllerUUID)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.ControllerUUID != "" && e.ControllerUUID != controllerUUID {
+			continue
+		}
+		if timestamp == "" || e.Timestamp == timestamp {
+			return true, nil
+		}
+	}
+	return false, nil
+}
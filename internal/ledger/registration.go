@@ -0,0 +1,64 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// RegistrationRecord describes a device the owner registered at the
+// rendezvous server (TO0).
+type RegistrationRecord struct {
+	ControllerUUID string `json:"controller_uuid"`
+	OwnerID        string `json:"owner_id,omitempty"`
+	// WaitSeconds is how long the rendezvous server keeps the
+	// registration, if the owner backend reported it.
+	WaitSeconds int    `json:"wait_seconds,omitempty"`
+	Timestamp   string `json:"timestamp"`
+}
+
+// EnableRegistrationReports configures the endpoint that receives
+// rendezvous registration records. An empty URL leaves reporting disabled.
+func (c *Client) EnableRegistrationReports(url string) {
+	c.registrationURL = url
+}
+
+// RegistrationReportsEnabled reports whether EnableRegistrationReports was
+// given a URL.
+func (c *Client) RegistrationReportsEnabled() bool {
+	return c.registrationURL != ""
+}
+
+// RecordRegistration records a rendezvous registration in the external
+// service.
+//
+// Contract:
+//
+//	  Preconditions:
+//	    - ctx is not nil
+//	    - rec is not nil with ControllerUUID set
+//	    - registrationURL is configured
+//
+//	  Postconditions:
+//	    - Returns nil on successful creation (HTTP 2xx status)
+//	    - Returns error on failure (HTTP 4xx/5xx status or network errors)
+//
+//	  Error Conditions:
+//	    - Network errors: connection failures, timeouts (never retried)
+//	    - Breaker: ErrBreakerOpen while the endpoint's circuit breaker is open
+//	    - HTTP errors: non-2xx status codes
+//	    - Offline: queued for sync as for CreateCommissioningPassport
+//
+//		POST {registrationURL}
+func (c *Client) RecordRegistration(ctx context.Context, rec *RegistrationRecord) error {
+	if c.registrationURL == "" {
+		return fmt.Errorf("registration URL not configured")
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+
+	return c.post(ctx, endpointRegistrationPost, c.registrationURL, b)
+}
@@ -0,0 +1,191 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsServerTimeout bounds the queries made to one of several DNS servers
+// before the next is asked.
+const dnsServerTimeout = 3 * time.Second
+
+// ResolverOptions controls how the ledger clients resolve the passport
+// service hosts.
+type ResolverOptions struct {
+	// Servers are DNS servers (host:port) asked in turn instead of the
+	// system resolver.
+	Servers []string
+	// Hosts pins host names to addresses, which are used without asking
+	// DNS at all.
+	Hosts map[string][]string
+	// CacheTTL is how long resolved addresses are reused without asking
+	// again.
+	CacheTTL time.Duration
+	// StaleTTL is how long after resolving them addresses are still used
+	// when resolving again fails.
+	StaleTTL time.Duration
+}
+
+// ParseDNSServer parses a DNS server address, host or host:port, with the
+// port 53 by default.
+func ParseDNSServer(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if _, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return net.JoinHostPort(strings.Trim(s, "[]"), "53"), nil
+	}
+	if !strings.Contains(s, ":") {
+		s = net.JoinHostPort(s, "53")
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || host == "" || port == "" {
+		return "", fmt.Errorf("DNS server %q: want host or host:port", s)
+	}
+	return s, nil
+}
+
+// ParseHostPin parses "host=address", pinning host to an IP address.
+func ParseHostPin(s string) (host, addr string, err error) {
+	host, addr, ok := strings.Cut(strings.TrimSpace(s), "=")
+	host = strings.ToLower(strings.TrimSpace(host))
+	if !ok || host == "" {
+		return "", "", fmt.Errorf("host pin %q: want host=address", s)
+	}
+	ip, err := netip.ParseAddr(strings.TrimSpace(addr))
+	if err != nil {
+		return "", "", fmt.Errorf("host pin %q: %q is not an IP address", s, addr)
+	}
+	return host, ip.String(), nil
+}
+
+// UseResolver resolves the hosts of both ledger clients as o says. Without
+// it, each connection asks the system resolver and fails when it does.
+// Call it before the client is used.
+func (c *Client) UseResolver(o ResolverOptions) {
+	r := &resolver{
+		hosts:    make(map[string][]string, len(o.Hosts)),
+		cacheTTL: o.CacheTTL,
+		staleTTL: o.StaleTTL,
+		entries:  make(map[string]resolved),
+	}
+	for host, addrs := range o.Hosts {
+		r.hosts[strings.ToLower(host)] = addrs
+	}
+	for _, server := range o.Servers {
+		server := server
+		r.servers = append(r.servers, &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		})
+	}
+	if len(r.servers) == 0 {
+		r.servers = []*net.Resolver{net.DefaultResolver}
+	}
+	c.resolver = r
+	c.buildTransports()
+}
+
+// resolved is a host's addresses as last resolved.
+type resolved struct {
+	addrs []string
+	at    time.Time
+}
+
+// resolver resolves ledger hosts through pins, a cache and DNS servers.
+type resolver struct {
+	servers  []*net.Resolver
+	hosts    map[string][]string
+	cacheTTL time.Duration
+	staleTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]resolved
+}
+
+// dialer returns a dial function resolving the host of addr itself and
+// dialing its addresses in turn through next.
+func (r *resolver) dialer(next func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := netip.ParseAddr(host); err == nil {
+			return next(ctx, network, addr)
+		}
+		addrs, err := r.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var errs []error
+		for _, a := range addrs {
+			conn, err := next(ctx, network, net.JoinHostPort(a, port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// lookup returns the addresses of host: pinned, cached or resolved, or,
+// when resolving fails, those last resolved within the stale TTL.
+func (r *resolver) lookup(ctx context.Context, host string) ([]string, error) {
+	host = strings.ToLower(host)
+	if addrs, ok := r.hosts[host]; ok {
+		ledgerDNSLookups.Inc("pinned")
+		return addrs, nil
+	}
+	r.mu.Lock()
+	e, ok := r.entries[host]
+	r.mu.Unlock()
+	if ok && time.Since(e.at) < r.cacheTTL {
+		ledgerDNSLookups.Inc("hit")
+		return e.addrs, nil
+	}
+
+	var err error
+	for _, res := range r.servers {
+		qctx, cancel := ctx, context.CancelFunc(func() {})
+		if len(r.servers) > 1 {
+			qctx, cancel = context.WithTimeout(ctx, dnsServerTimeout)
+		}
+		var addrs []string
+		addrs, err = res.LookupHost(qctx, host)
+		cancel()
+		if err == nil && len(addrs) > 0 {
+			r.mu.Lock()
+			r.entries[host] = resolved{addrs: addrs, at: time.Now()}
+			r.mu.Unlock()
+			ledgerDNSLookups.Inc("resolved")
+			return addrs, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if ok && time.Since(e.at) < r.staleTTL {
+		ledgerDNSLookups.Inc("stale")
+		slog.Warn("Resolving ledger host failed, using the addresses last resolved",
+			"host", host, "resolved_at", e.at, "error", err)
+		return e.addrs, nil
+	}
+	ledgerDNSLookups.Inc("failed")
+	if err == nil {
+		err = fmt.Errorf("no addresses")
+	}
+	return nil, fmt.Errorf("resolve %s: %w", host, err)
+}
@@ -0,0 +1,96 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// maxSearchResults bounds the passports SearchProductItemPassports returns.
+const maxSearchResults = 1000
+
+// FetchProductItemPassport is GetProductItemPassport asking the passport
+// service every time: it skips the cache, lookup backoff and offline mode,
+// and changes none of them, so what it returns is what the service holds
+// now.
+func (c *Client) FetchProductItemPassport(ctx context.Context, uuid string) (*ProductItemPassport, error) {
+	return c.fetchProductItemPassport(ctx, uuid)
+}
+
+// SearchProductItemPassports finds the product item passports whose
+// metadata carries board serial number boardSN.
+//
+// Contract:
+//
+//	  Preconditions:
+//	    - ctx is not nil
+//	    - boardSN is a non-empty string
+//	    - productBaseURL is configured
+//
+//	  Postconditions:
+//	    - Returns the matching passports, empty if the service has none
+//	    - Returns nil and error if service unavailable or invalid response
+//
+//	  Error Conditions:
+//	    - Network errors: connection failures, timeouts (retried if enabled)
+//	    - Breaker: ErrBreakerOpen while the endpoint's circuit breaker is open
+//	    - HTTP errors: non-200 status codes other than 404
+//	    - JSON errors: a body that is neither a passport nor an array of them
+//
+//		GET {productBaseURL}/product_item/?board_sn={boardSN}
+//
+// Like FetchProductItemPassport, it neither reads nor fills the cache.
+func (c *Client) SearchProductItemPassports(ctx context.Context, boardSN string) ([]ProductItemPassport, error) {
+	if c.productBaseURL == "" {
+		return nil, fmt.Errorf("product base URL not configured")
+	}
+	if boardSN == "" {
+		return nil, fmt.Errorf("board serial number required")
+	}
+	u, err := url.Parse(c.productBaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse base URL: %w", err)
+	}
+	u.Path = "/product_item/"
+	q := u.Query()
+	q.Set("board_sn", boardSN)
+	u.RawQuery = q.Encode()
+
+	resp, err := c.do(endpointProductSearch, c.productHTTP, c.productRetries, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return []ProductItemPassport{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, &statusError{request: "passport search", status: resp.StatusCode, body: string(b)}
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	out := []ProductItemPassport{}
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		if err := json.Unmarshal(raw, &out); err != nil {
+			return nil, fmt.Errorf("decode response: %w", err)
+		}
+	} else {
+		var p ProductItemPassport
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, fmt.Errorf("decode response: %w", err)
+		}
+		out = append(out, p)
+	}
+	return out[:min(len(out), maxSearchResults)], nil
+}
@@ -0,0 +1,96 @@
+package ledger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// CommissioningTemplate renders commissioning passport requests in the
+// shape of a ledger API other than the passport service's, so such a
+// ledger can be integrated without changing this package.
+type CommissioningTemplate struct {
+	t *template.Template
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join": strings.Join,
+	"default": func(def, v string) string {
+		if v == "" {
+			return def
+		}
+		return v
+	},
+}
+
+// sampleRequest is rendered by ParseCommissioningTemplate to find errors at
+// startup.
+var sampleRequest = CommissioningCreateRequest{
+	ControllerUUID:   "00000000-0000-0000-0000-000000000000",
+	ProductID:        "product",
+	OwnerID:          "owner",
+	Cert:             "cert",
+	DeployedLocation: "US",
+	Timestamp:        "0",
+	Evidence:         &OnboardingEvidence{},
+	Credential:       "credential",
+	Serial:           "serial",
+	Tags:             []string{"tag"},
+}
+
+// LoadCommissioningTemplate reads a commissioning template file.
+func LoadCommissioningTemplate(path string) (*CommissioningTemplate, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read commissioning template: %w", err)
+	}
+	return ParseCommissioningTemplate(string(b))
+}
+
+// ParseCommissioningTemplate parses src, a Go text/template over a
+// CommissioningCreateRequest producing the JSON body to send, such as
+//
+//	{"deviceId": {{json .ControllerUUID}}, "tenant": {{json .OwnerID}},
+//	 "voucher": {{json .Evidence.VoucherHash}}}
+//
+// with json (a JSON value), join and default (a fallback for an empty
+// string). It fails unless the template renders valid JSON for a sample
+// request, whose optional parts such as Evidence.Attestation are nil, so
+// templates must check those with "with" or "if".
+func ParseCommissioningTemplate(src string) (*CommissioningTemplate, error) {
+	t, err := template.New("commissioning").Funcs(templateFuncs).Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("parse commissioning template: %w", err)
+	}
+	ct := &CommissioningTemplate{t: t}
+	if _, err := ct.Render(&sampleRequest); err != nil {
+		return nil, err
+	}
+	return ct, nil
+}
+
+// Render returns the body for req.
+func (ct *CommissioningTemplate) Render(req *CommissioningCreateRequest) ([]byte, error) {
+	var b bytes.Buffer
+	if err := ct.t.Execute(&b, req); err != nil {
+		return nil, fmt.Errorf("render commissioning template: %w", err)
+	}
+	if !json.Valid(b.Bytes()) {
+		return nil, fmt.Errorf("render commissioning template: result is not valid JSON")
+	}
+	return b.Bytes(), nil
+}
+
+// UseCommissioningTemplate sends commissioning passports rendered through
+// t instead of as CommissioningCreateRequest JSON. A nil t restores the
+// default.
+func (c *Client) UseCommissioningTemplate(t *CommissioningTemplate) {
+	c.commissioningTemplate = t
+}
@@ -0,0 +1,177 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+)
+
+// retryDelay is the pause before the first retry; it doubles per attempt.
+const retryDelay = 100 * time.Millisecond
+
+// EnableRetries retries product passport lookups up to n extra times on
+// transport errors and 5xx responses. Commissioning POSTs are never retried
+// because the service does not deduplicate them.
+func (c *Client) EnableRetries(n int) {
+	if n < 0 {
+		n = 0
+	}
+	c.productRetries = n
+}
+
+// EnableBreaker installs a per-endpoint circuit breaker that opens after
+// threshold consecutive failures and lets a trial request through after
+// cooldown. A non-positive threshold leaves the breakers disabled.
+func (c *Client) EnableBreaker(threshold int, cooldown time.Duration) {
+	if threshold <= 0 {
+		return
+	}
+	c.breakers = make(map[string]*breaker)
+	for _, endpoint := range []string{endpointProductGet, endpointProductSearch, endpointProductPatch, endpointProductList, endpointCommissioningPost, endpointFailurePost, endpointRegistrationPost, endpointKeyRotationPost, endpointCommissioningList, endpointCommissioningGet} {
+		endpoint := endpoint
+		c.breakers[endpoint] = newBreaker(threshold, cooldown, func(s BreakerState) {
+			ledgerBreakerState.Set(float64(s), endpoint)
+			if c.onBreaker != nil {
+				c.onBreaker(endpoint, s)
+			}
+		})
+		ledgerBreakerState.Set(float64(BreakerClosed), endpoint)
+	}
+}
+
+// OnBreakerChange calls fn whenever an endpoint's circuit breaker changes
+// state. fn runs with the breaker locked and must not block or call back
+// into the client. Call it before the client is used.
+func (c *Client) OnBreakerChange(fn func(endpoint string, s BreakerState)) {
+	c.onBreaker = fn
+}
+
+// BreakerState reports the breaker state for an endpoint ("product_get",
+// "product_search", "product_patch", "product_list", "commissioning_post",
+// "failure_post", "registration_post", "key_rotation_post",
+// "commissioning_list" or "commissioning_get"). Endpoints without a breaker
+// report closed.
+func (c *Client) BreakerState(endpoint string) BreakerState {
+	return c.breakers[endpoint].State()
+}
+
+// do sends the request built by newReq through the endpoint's breaker,
+// retrying up to retries times on transport errors and 5xx responses.
+// newReq is called once per attempt so request bodies can be replayed.
+// The returned response's body is owned by the caller.
+func (c *Client) do(endpoint string, hc *http.Client, retries int, newReq func() (*http.Request, error)) (*http.Response, error) {
+	start := time.Now()
+	defer func() {
+		ledgerLatency.Observe(time.Since(start).Seconds(), endpoint)
+	}()
+
+	b := c.breakers[endpoint]
+	for attempt := 0; ; attempt++ {
+		if !b.allow() {
+			ledgerRequests.Inc(endpoint, "breaker_open")
+			return nil, fmt.Errorf("%s: %w", endpoint, ErrBreakerOpen)
+		}
+
+		req, err := newReq()
+		if err != nil {
+			return nil, fmt.Errorf("build request: %w", err)
+		}
+		correlation.Inject(req.Context(), req.Header)
+
+		resp, err := hc.Do(req)
+		failed := err != nil || resp.StatusCode >= 500
+		b.record(failed)
+
+		if failed && attempt < retries && req.Context().Err() == nil {
+			if resp != nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			ledgerRetries.Inc(endpoint)
+			select {
+			case <-req.Context().Done():
+			case <-time.After(retryDelay << attempt):
+			}
+			continue
+		}
+
+		if err != nil {
+			ledgerRequests.Inc(endpoint, "error")
+			return nil, fmt.Errorf("request failed: %w", err)
+		}
+		ledgerRequests.Inc(endpoint, outcome(resp.StatusCode))
+		return resp, nil
+	}
+}
+
+func outcome(status int) string {
+	switch {
+	case status == http.StatusNotFound:
+		return "not_found"
+	case status >= 500:
+		return "server_error"
+	case status >= 400:
+		return "client_error"
+	default:
+		return "success"
+	}
+}
+
+// statusError is a response from the passport service other than success.
+type statusError struct {
+	request string
+	status  int
+	body    string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s status %d: %s", e.request, e.status, e.body)
+}
+
+// postRequests name the JSON POST endpoints in errors.
+var postRequests = map[string]string{
+	endpointCommissioningPost: "commissioning POST",
+	endpointFailurePost:       "failure POST",
+	endpointRegistrationPost:  "registration POST",
+	endpointKeyRotationPost:   "key rotation POST",
+}
+
+// post sends the JSON body to target on endpoint, never retried. In offline
+// mode, the body is queued for sync instead while the service is held
+// unreachable, or when this POST finds it so.
+func (c *Client) post(ctx context.Context, endpoint, target string, body []byte) error {
+	if c.outbox != nil && c.outbox.Offline() {
+		return c.outbox.queueWrite(endpoint, target, body, nil)
+	}
+	err := c.send(ctx, endpoint, target, body)
+	if err != nil && c.outbox != nil && unreachable(err) {
+		return c.outbox.queueWrite(endpoint, target, body, err)
+	}
+	return err
+}
+
+// send POSTs the JSON body to target on endpoint.
+func (c *Client) send(ctx context.Context, endpoint, target string, body []byte) error {
+	resp, err := c.do(endpoint, c.commissioningHTTP, 0, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return &statusError{request: postRequests[endpoint], status: resp.StatusCode, body: string(b)}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// DescriptorDICompleted describes the record appended to a product item
+// passport when a device of the item completes DI.
+const DescriptorDICompleted = "FDO DI COMPLETED"
+
+// ProductItemEvent is what happened to an item, present on the records the
+// proxy appends.
+type ProductItemEvent struct {
+	// Type is di_completed for DescriptorDICompleted records.
+	Type    string `json:"type"`
+	GUID    string `json:"guid,omitempty"`
+	Serial  string `json:"serial,omitempty"`
+	OwnerID string `json:"owner_id,omitempty"`
+	// Timestamp is Unix nanoseconds, as in commissioning passports.
+	Timestamp string `json:"timestamp"`
+}
+
+// ProductItemUpdate changes a product item passport.
+type ProductItemUpdate struct {
+	// Metadata holds the metadata fields to replace; null removes one and
+	// fields left out are kept.
+	Metadata map[string]any `json:"metadata,omitempty"`
+	// AppendRecords are added after the passport's records, which are
+	// otherwise never changed.
+	AppendRecords []ProductItemRecord `json:"append_records,omitempty"`
+}
+
+// UpdateProductItemPassport changes a product item passport in the external
+// service.
+//
+// Contract:
+//
+//	  Preconditions:
+//	    - ctx is not nil
+//	    - uuid is a non-empty string
+//	    - upd changes metadata or appends records
+//	    - productBaseURL is configured
+//
+//	  Postconditions:
+//	    - Returns the updated passport if the service answers with it, or
+//	      nil on 204 No Content
+//	    - Drops uuid from the cache once the service answers, whatever the
+//	      answer, so the next lookup sees the update
+//	    - Returns nil and error if the service did not apply the update
+//
+//	  Error Conditions:
+//	    - Network errors: connection failures, timeouts (never retried)
+//	    - Breaker: ErrBreakerOpen while the endpoint's circuit breaker is open
+//	    - TLS errors: invalid certificates, mTLS handshake failures
+//	    - HTTP errors: non-2xx status codes (404 wraps ErrPassportNotFound)
+//	    - Offline: ErrOffline while offline mode holds the service
+//	      unreachable; updates are not queued
+//
+//		PATCH {productBaseURL}/product_item/?uuid={uuid}
+//
+// Uses the mTLS client of GetProductItemPassport.
+func (c *Client) UpdateProductItemPassport(ctx context.Context, uuid string, upd *ProductItemUpdate) (*ProductItemPassport, error) {
+	if c.productBaseURL == "" {
+		return nil, fmt.Errorf("product base URL not configured")
+	}
+	if uuid == "" {
+		return nil, fmt.Errorf("passport UUID required")
+	}
+	if upd == nil || (len(upd.Metadata) == 0 && len(upd.AppendRecords) == 0) {
+		return nil, fmt.Errorf("passport %s: empty update", uuid)
+	}
+	if c.outbox != nil && c.outbox.Offline() {
+		return nil, fmt.Errorf("passport %s: %w", uuid, ErrOffline)
+	}
+	body, err := json.Marshal(upd)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+	u, err := url.Parse(c.productBaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse base URL: %w", err)
+	}
+	u.Path = "/product_item/"
+	q := u.Query()
+	q.Set("uuid", uuid)
+	u.RawQuery = q.Encode()
+
+	resp, err := c.do(endpointProductPatch, c.productHTTP, 0, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPatch, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Whatever the service answered, it may have applied the update, so
+	// the cached copy is no longer to be trusted
+	if c.cache != nil {
+		c.cache.delete(uuid)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("passport %s: %w", uuid, ErrPassportNotFound)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, &statusError{request: "passport PATCH", status: resp.StatusCode, body: string(b)}
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	var out ProductItemPassport
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return &out, nil
+}
+
+// AppendRecord appends rec to the product item passport of uuid, as
+// UpdateProductItemPassport, giving it a random UUID if it has none.
+func (c *Client) AppendRecord(ctx context.Context, uuid string, rec ProductItemRecord) (*ProductItemPassport, error) {
+	if rec.UUID == "" {
+		rec.UUID = newRecordUUID()
+	}
+	return c.UpdateProductItemPassport(ctx, uuid, &ProductItemUpdate{AppendRecords: []ProductItemRecord{rec}})
+}
+
+// newRecordUUID returns a random (version 4) UUID.
+func newRecordUUID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
@@ -0,0 +1,148 @@
+package ledger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxWireLogBody caps how much of a non-JSON body is logged.
+const maxWireLogBody = 4096
+
+// WireLogOptions controls ledger wire logging.
+type WireLogOptions struct {
+	// RedactFields lists JSON keys (case-insensitive, at any depth) whose
+	// string values are truncated before logging, e.g. "signature", "cert".
+	RedactFields []string
+	// KeepChars is how many leading characters of a redacted value are kept.
+	KeepChars int
+}
+
+// EnableWireLog logs every ledger request and response body at debug level,
+// with the configured fields truncated so signatures and certificates don't
+// end up in logs.
+func (c *Client) EnableWireLog(opts WireLogOptions) {
+	redact := make(map[string]bool, len(opts.RedactFields))
+	for _, f := range opts.RedactFields {
+		if f = strings.TrimSpace(f); f != "" {
+			redact[strings.ToLower(f)] = true
+		}
+	}
+	c.wrapTransport = func(next http.RoundTripper) http.RoundTripper {
+		return &wireLogger{next: next, redact: redact, keep: opts.KeepChars}
+	}
+	c.buildTransports()
+}
+
+// wireLogger is an http.RoundTripper that logs redacted request/response bodies.
+type wireLogger struct {
+	next   http.RoundTripper
+	redact map[string]bool
+	keep   int
+}
+
+func (l *wireLogger) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read request body: %w", err)
+		}
+		reqBody = b
+		req.Body = io.NopCloser(bytes.NewReader(b))
+	}
+
+	slog.Debug("Ledger request",
+		"method", req.Method,
+		"url", req.URL.String(),
+		"headers", l.headers(req.Header),
+		"body", l.body(reqBody))
+
+	start := time.Now()
+	resp, err := l.next.RoundTrip(req)
+	if err != nil {
+		slog.Debug("Ledger request failed", "url", req.URL.String(), "error", err)
+		return nil, err
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	if err != nil {
+		return nil, fmt.Errorf("read response body: %w", err)
+	}
+
+	slog.Debug("Ledger response",
+		"url", req.URL.String(),
+		"status", resp.StatusCode,
+		"duration", time.Since(start),
+		"body", l.body(respBody))
+	return resp, nil
+}
+
+// headers returns request headers with credentials masked.
+func (l *wireLogger) headers(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		switch strings.ToLower(k) {
+		case "authorization", "cookie", "x-api-key":
+			out[k] = "[redacted]"
+		default:
+			out[k] = strings.Join(v, ", ")
+		}
+	}
+	return out
+}
+
+// body renders a body for logging, redacting JSON fields where possible.
+func (l *wireLogger) body(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		if len(b) > maxWireLogBody {
+			return string(b[:maxWireLogBody]) + fmt.Sprintf("...(%d bytes)", len(b))
+		}
+		return string(b)
+	}
+	out, err := json.Marshal(l.redactValue(v))
+	if err != nil {
+		return "[unloggable body]"
+	}
+	return string(out)
+}
+
+func (l *wireLogger) redactValue(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, val := range t {
+			if s, ok := val.(string); ok && l.redact[strings.ToLower(k)] {
+				t[k] = truncate(s, l.keep)
+				continue
+			}
+			t[k] = l.redactValue(val)
+		}
+	case []any:
+		for i := range t {
+			t[i] = l.redactValue(t[i])
+		}
+	}
+	return v
+}
+
+func truncate(s string, keep int) string {
+	if keep < 0 {
+		keep = 0
+	}
+	if len(s) <= keep {
+		return s
+	}
+	return fmt.Sprintf("%s...[redacted %d chars]", s[:keep], len(s)-keep)
+}
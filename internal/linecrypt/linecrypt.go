@@ -0,0 +1,190 @@
+// Package linecrypt seals the lines of the proxy's JSON Lines files one by
+// one with a data encryption key (DEK), itself wrapped by a key encryption
+// key and kept in a header line, so appending never rewrites the file.
+package linecrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyWrapper protects a data encryption key (DEK) with a key encryption key
+// held elsewhere: a local key file, or a KMS behind the same interface.
+type KeyWrapper interface {
+	// ID identifies the key encryption key, so a file can report which
+	// key it needs.
+	ID() string
+	Wrap(dek []byte) ([]byte, error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// localKey wraps DEKs with AES-256-GCM under a locally held key.
+type localKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewLocalKeyWrapper creates a KeyWrapper from a 32-byte key.
+func NewLocalKeyWrapper(kek []byte) (KeyWrapper, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(kek)
+	return &localKey{id: "local:" + hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+func (k *localKey) ID() string { return k.id }
+
+func (k *localKey) Wrap(dek []byte) ([]byte, error) {
+	return seal(k.aead, dek, []byte(k.id))
+}
+
+func (k *localKey) Unwrap(wrapped []byte) ([]byte, error) {
+	return open(k.aead, wrapped, []byte(k.id))
+}
+
+// LoadKeyFile reads a 32-byte key stored as hex, base64 or raw bytes.
+func LoadKeyFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read store key: %w", err)
+	}
+	return ParseKey(b)
+}
+
+// ParseKey decodes a 32-byte key given as hex, base64 or raw bytes.
+func ParseKey(b []byte) ([]byte, error) {
+	if len(b) == 32 {
+		return b, nil
+	}
+	text := strings.TrimSpace(string(b))
+	if k, err := hex.DecodeString(text); err == nil && len(k) == 32 {
+		return k, nil
+	}
+	if k, err := base64.StdEncoding.DecodeString(text); err == nil && len(k) == 32 {
+		return k, nil
+	}
+	return nil, errors.New("store key must be 32 bytes (raw, hex or base64)")
+}
+
+// fileHeader is the first line of an encrypted file.
+type fileHeader struct {
+	Version int    `json:"fdo_store"`
+	Cipher  string `json:"cipher"`
+	KeyID   string `json:"key_id"`
+	DEK     []byte `json:"dek"`
+}
+
+const cipherName = "aes-256-gcm"
+
+// Cipher encrypts individual lines with the DEK.
+type Cipher struct {
+	aead   cipher.AEAD
+	header []byte
+}
+
+// New creates a Cipher with a fresh DEK wrapped by kw.
+func New(kw KeyWrapper) (*Cipher, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, fmt.Errorf("generate data key: %w", err)
+	}
+	wrapped, err := kw.Wrap(dek)
+	if err != nil {
+		return nil, fmt.Errorf("wrap data key: %w", err)
+	}
+	header, err := json.Marshal(fileHeader{Version: 1, Cipher: cipherName, KeyID: kw.ID(), DEK: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead, header: header}, nil
+}
+
+// ParseHeader reports whether line is an encryption header and, if so,
+// unwraps its DEK with kw.
+func ParseHeader(line []byte, kw KeyWrapper) (*Cipher, bool, error) {
+	var h fileHeader
+	if json.Unmarshal(line, &h) != nil || h.Version == 0 {
+		return nil, false, nil
+	}
+	if h.Cipher != cipherName {
+		return nil, true, fmt.Errorf("cipher %q not supported", h.Cipher)
+	}
+	if kw == nil {
+		return nil, true, fmt.Errorf("encrypted with key %s; no key configured", h.KeyID)
+	}
+	dek, err := kw.Unwrap(h.DEK)
+	if err != nil {
+		return nil, true, fmt.Errorf("unwrap data key (key %s, configured %s): %w", h.KeyID, kw.ID(), err)
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, true, err
+	}
+	return &Cipher{aead: aead, header: append([]byte(nil), line...)}, true, nil
+}
+
+// Header returns the header line holding the wrapped DEK, written first.
+func (c *Cipher) Header() []byte { return c.header }
+
+// Seal encrypts one line, returning it base64 encoded.
+func (c *Cipher) Seal(plain []byte) ([]byte, error) {
+	ct, err := seal(c.aead, plain, nil)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(ct)))
+	base64.StdEncoding.Encode(out, ct)
+	return out, nil
+}
+
+// Open decrypts a line sealed by Seal.
+func (c *Cipher) Open(line []byte) ([]byte, error) {
+	ct := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(ct, line)
+	if err != nil {
+		return nil, err
+	}
+	return open(c.aead, ct[:n], nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("store key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns nonce || ciphertext.
+func seal(aead cipher.AEAD, plain, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, ad), nil
+}
+
+func open(aead cipher.AEAD, b, ad []byte) ([]byte, error) {
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], ad)
+}
@@ -0,0 +1,135 @@
+package linecrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T, b byte) KeyWrapper {
+	t.Helper()
+	kw, err := NewLocalKeyWrapper(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kw
+}
+
+func TestSealOpen(t *testing.T) {
+	kw := testKey(t, 1)
+	c, err := New(kw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []byte(`{"guid":"0102","event":"to2"}`)
+	sealed, err := c.Seal(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("guid")) || bytes.ContainsAny(sealed, "\n") {
+		t.Errorf("sealed line %q leaks plaintext or breaks the line", sealed)
+	}
+	again, _ := c.Seal(line)
+	if bytes.Equal(sealed, again) {
+		t.Error("sealing twice gave the same line; nonce reused")
+	}
+
+	// A reader of the file has only the header line and the key
+	r, ok, err := ParseHeader(c.Header(), kw)
+	if err != nil || !ok {
+		t.Fatalf("ParseHeader = %v, %v", ok, err)
+	}
+	got, err := r.Open(sealed)
+	if err != nil || !bytes.Equal(got, line) {
+		t.Errorf("Open = %q, %v, want %q", got, err, line)
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	c, err := New(testKey(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := c.Seal([]byte(`{"n":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(string(sealed))
+	for i := range raw {
+		b := bytes.Clone(raw)
+		b[i] ^= 0x01
+		if _, err := c.Open([]byte(base64.StdEncoding.EncodeToString(b))); err == nil {
+			t.Errorf("Open succeeded with byte %d flipped", i)
+		}
+	}
+	for _, line := range []string{
+		"",
+		"not base64!",
+		base64.StdEncoding.EncodeToString(raw[:len(raw)-1]),
+		base64.StdEncoding.EncodeToString(raw[:8]),
+	} {
+		if _, err := c.Open([]byte(line)); err == nil {
+			t.Errorf("Open(%q) succeeded", line)
+		}
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	kw := testKey(t, 1)
+	c, err := New(kw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Plain JSON Lines are not headers
+	for _, line := range []string{`{"guid":"0102"}`, `not json`, ``} {
+		if _, ok, err := ParseHeader([]byte(line), kw); ok || err != nil {
+			t.Errorf("ParseHeader(%q) = %v, %v, want not a header", line, ok, err)
+		}
+	}
+
+	if _, ok, err := ParseHeader(c.Header(), testKey(t, 2)); !ok || err == nil {
+		t.Errorf("ParseHeader with the wrong key = %v, %v, want an error", ok, err)
+	}
+	if _, ok, err := ParseHeader(c.Header(), nil); !ok || err == nil || !strings.Contains(err.Error(), kw.ID()) {
+		t.Errorf("ParseHeader without a key = %v, %v, want an error naming %s", ok, err, kw.ID())
+	}
+	other := bytes.Replace(c.Header(), []byte(cipherName), []byte("des"), 1)
+	if _, ok, err := ParseHeader(other, kw); !ok || err == nil {
+		t.Errorf("ParseHeader with another cipher = %v, %v, want an error", ok, err)
+	}
+}
+
+func TestWrapBindsKeyID(t *testing.T) {
+	kw := testKey(t, 1).(*localKey)
+	wrapped, err := kw.Wrap(bytes.Repeat([]byte{9}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The key ID is authenticated, so a wrapped DEK cannot be relabelled
+	relabelled := &localKey{id: "local:00000000", aead: kw.aead}
+	if _, err := relabelled.Unwrap(wrapped); err == nil {
+		t.Error("Unwrap under another key ID succeeded")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, 32)
+	for _, in := range [][]byte{
+		key,
+		[]byte(hex.EncodeToString(key) + "\n"),
+		[]byte(base64.StdEncoding.EncodeToString(key)),
+	} {
+		got, err := ParseKey(in)
+		if err != nil || !bytes.Equal(got, key) {
+			t.Errorf("ParseKey(%q) = %x, %v", in, got, err)
+		}
+	}
+	for _, in := range []string{"", "abcd", hex.EncodeToString(key[:20])} {
+		if _, err := ParseKey([]byte(in)); err == nil {
+			t.Errorf("ParseKey(%q) succeeded", in)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+// maxQueued bounds the records held while the collector is unreachable.
+const maxQueued = 10000
+
+var otlpRecords = metrics.Default.NewCounterVec(
+	"fdo_proxy_otlp_log_records_total",
+	"Log records shipped over OTLP by outcome (exported, failed, dropped).",
+	"outcome")
+
+// OTLPOptions configures OTLP log export.
+type OTLPOptions struct {
+	// Endpoint is the OTLP/HTTP logs URL, e.g. http://collector:4318/v1/logs.
+	// A URL without a path gets /v1/logs appended.
+	Endpoint string
+	// Headers are sent with every export request (e.g. API keys).
+	Headers map[string]string
+	// ServiceName is reported as the service.name resource attribute.
+	ServiceName string
+	// Interval between exports. Defaults to 5 seconds.
+	Interval time.Duration
+	// BatchSize triggers an early export. Defaults to 512.
+	BatchSize int
+}
+
+// ParseHeaders parses OTEL_EXPORTER_OTLP_HEADERS-style "k=v,k=v" pairs.
+func ParseHeaders(s string) (map[string]string, error) {
+	h := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("otlp header %q: want key=value", part)
+		}
+		h[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return h, nil
+}
+
+// OTLPExporter batches log records and posts them to an OpenTelemetry
+// collector using OTLP/HTTP with JSON encoding.
+type OTLPExporter struct {
+	opts     OTLPOptions
+	http     *http.Client
+	resource otlpResource
+
+	mu     sync.Mutex
+	queue  []otlpRecord
+	kick   chan struct{}
+	done   chan struct{}
+	closed sync.Once
+	wg     sync.WaitGroup
+}
+
+// NewOTLPExporter creates an exporter and starts its background flush loop.
+// Call Close to export what is left.
+func NewOTLPExporter(opts OTLPOptions) *OTLPExporter {
+	if opts.Interval <= 0 {
+		opts.Interval = 5 * time.Second
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 512
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = "fdo-proxy"
+	}
+	if i := strings.Index(opts.Endpoint, "://"); i >= 0 && !strings.Contains(opts.Endpoint[i+3:], "/") {
+		opts.Endpoint += "/v1/logs"
+	}
+	host, _ := os.Hostname()
+	e := &OTLPExporter{
+		opts: opts,
+		http: &http.Client{Timeout: 10 * time.Second},
+		resource: otlpResource{Attributes: []otlpKV{
+			{Key: "service.name", Value: otlpValue{StringValue: &opts.ServiceName}},
+			{Key: "host.name", Value: otlpValue{StringValue: &host}},
+		}},
+		kick: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	e.wg.Add(1)
+	go e.loop()
+	return e
+}
+
+// Handler returns an slog.Handler feeding the exporter at or above level.
+func (e *OTLPExporter) Handler(level slog.Leveler) slog.Handler {
+	return &otlpHandler{e: e, level: level}
+}
+
+// Close stops the flush loop and exports pending records, bounded by ctx.
+func (e *OTLPExporter) Close(ctx context.Context) error {
+	var err error
+	e.closed.Do(func() {
+		close(e.done)
+		e.wg.Wait()
+		err = e.flush(ctx)
+	})
+	return err
+}
+
+func (e *OTLPExporter) loop() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(e.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		case <-e.kick:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := e.flush(ctx); err != nil {
+			// Logging this through slog would feed the failure back into
+			// the exporter
+			fmt.Fprintf(os.Stderr, "otlp log export failed: %v\n", err)
+		}
+		cancel()
+	}
+}
+
+func (e *OTLPExporter) enqueue(r otlpRecord) {
+	e.mu.Lock()
+	if len(e.queue) >= maxQueued {
+		e.mu.Unlock()
+		otlpRecords.Inc("dropped")
+		return
+	}
+	e.queue = append(e.queue, r)
+	full := len(e.queue) >= e.opts.BatchSize
+	e.mu.Unlock()
+	if full {
+		select {
+		case e.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush exports the queue. On failure the records are put back for the next
+// round, as far as the queue bound allows.
+func (e *OTLPExporter) flush(ctx context.Context) error {
+	e.mu.Lock()
+	batch := e.queue
+	e.queue = nil
+	e.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	if err := e.post(ctx, batch); err != nil {
+		otlpRecords.Add(float64(len(batch)), "failed")
+		e.mu.Lock()
+		if room := maxQueued - len(e.queue); room < len(batch) {
+			otlpRecords.Add(float64(len(batch)-max(room, 0)), "dropped")
+			batch = batch[len(batch)-max(room, 0):]
+		}
+		e.queue = append(batch, e.queue...)
+		e.mu.Unlock()
+		return err
+	}
+	otlpRecords.Add(float64(len(batch)), "exported")
+	return nil
+}
+
+func (e *OTLPExporter) post(ctx context.Context, batch []otlpRecord) error {
+	payload, err := json.Marshal(otlpRequest{ResourceLogs: []otlpResourceLogs{{
+		Resource: e.resource,
+		ScopeLogs: []otlpScopeLogs{{
+			Scope:      otlpScope{Name: "github.com/fdo-server-wrapper"},
+			LogRecords: batch,
+		}},
+	}}})
+	if err != nil {
+		return fmt.Errorf("encode logs: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.opts.Endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.opts.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("collector request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("collector status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// otlpHandler converts slog records into OTLP log records.
+type otlpHandler struct {
+	e      *OTLPExporter
+	level  slog.Leveler
+	attrs  []otlpKV
+	prefix string
+}
+
+func (h *otlpHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *otlpHandler) Handle(ctx context.Context, rec slog.Record) error {
+	msg := rec.Message
+	r := otlpRecord{
+		TimeUnixNano:   strconv.FormatInt(rec.Time.UnixNano(), 10),
+		SeverityNumber: severity(rec.Level),
+		SeverityText:   rec.Level.String(),
+		Body:           otlpValue{StringValue: &msg},
+		Attributes:     append([]otlpKV(nil), h.attrs...),
+	}
+	rec.Attrs(func(a slog.Attr) bool {
+		r.Attributes = appendAttr(r.Attributes, h.prefix, a)
+		return true
+	})
+	if id := correlation.RequestID(ctx); id != "" {
+		r.Attributes = append(r.Attributes, otlpKV{Key: "request_id", Value: otlpValue{StringValue: &id}})
+	}
+	if tc, ok := correlation.Trace(ctx); ok {
+		r.TraceID = hex.EncodeToString(tc.TraceID[:])
+		r.SpanID = hex.EncodeToString(tc.SpanID[:])
+		r.Flags = uint32(tc.Flags)
+	}
+	h.e.enqueue(r)
+	return nil
+}
+
+func (h *otlpHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append([]otlpKV(nil), h.attrs...)
+	for _, a := range attrs {
+		c.attrs = appendAttr(c.attrs, h.prefix, a)
+	}
+	return &c
+}
+
+func (h *otlpHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.prefix = h.prefix + name + "."
+	return &c
+}
+
+// appendAttr flattens a into dotted keys.
+func appendAttr(kvs []otlpKV, prefix string, a slog.Attr) []otlpKV {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		p := prefix
+		if a.Key != "" {
+			p += a.Key + "."
+		}
+		for _, g := range v.Group() {
+			kvs = appendAttr(kvs, p, g)
+		}
+		return kvs
+	}
+	if a.Key == "" {
+		return kvs
+	}
+	return append(kvs, otlpKV{Key: prefix + a.Key, Value: toValue(v)})
+}
+
+func toValue(v slog.Value) otlpValue {
+	switch v.Kind() {
+	case slog.KindBool:
+		b := v.Bool()
+		return otlpValue{BoolValue: &b}
+	case slog.KindInt64:
+		s := strconv.FormatInt(v.Int64(), 10)
+		return otlpValue{IntValue: &s}
+	case slog.KindUint64:
+		if u := v.Uint64(); u <= math.MaxInt64 {
+			s := strconv.FormatUint(u, 10)
+			return otlpValue{IntValue: &s}
+		}
+	case slog.KindFloat64:
+		f := v.Float64()
+		return otlpValue{DoubleValue: &f}
+	case slog.KindDuration:
+		s := v.Duration().String()
+		return otlpValue{StringValue: &s}
+	case slog.KindTime:
+		s := v.Time().UTC().Format(time.RFC3339Nano)
+		return otlpValue{StringValue: &s}
+	}
+	s := v.String()
+	return otlpValue{StringValue: &s}
+}
+
+// severity maps slog levels onto OTLP severity numbers.
+func severity(l slog.Level) int {
+	switch {
+	case l >= slog.LevelError:
+		return 17
+	case l >= slog.LevelWarn:
+		return 13
+	case l >= slog.LevelInfo:
+		return 9
+	default:
+		return 5
+	}
+}
+
+// OTLP/HTTP JSON wire types (opentelemetry-proto logs/v1).
+type (
+	otlpRequest struct {
+		ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+	}
+	otlpResourceLogs struct {
+		Resource  otlpResource    `json:"resource"`
+		ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+	}
+	otlpResource struct {
+		Attributes []otlpKV `json:"attributes"`
+	}
+	otlpScopeLogs struct {
+		Scope      otlpScope    `json:"scope"`
+		LogRecords []otlpRecord `json:"logRecords"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpRecord struct {
+		TimeUnixNano   string    `json:"timeUnixNano"`
+		SeverityNumber int       `json:"severityNumber"`
+		SeverityText   string    `json:"severityText"`
+		Body           otlpValue `json:"body"`
+		Attributes     []otlpKV  `json:"attributes,omitempty"`
+		TraceID        string    `json:"traceId,omitempty"`
+		SpanID         string    `json:"spanId,omitempty"`
+		Flags          uint32    `json:"flags,omitempty"`
+	}
+	otlpKV struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
@@ -0,0 +1,203 @@
+// Package logging holds slog helpers shared by the proxy, such as redaction
+// of device identifiers for deployments whose logs leave the secure enclave.
+package logging
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Mode selects how identifiers are redacted.
+type Mode string
+
+// Redaction modes.
+const (
+	// ModeOff logs identifiers as they are.
+	ModeOff Mode = "off"
+	// ModeHash replaces identifiers with a keyed hash, so one device's log
+	// lines can still be correlated without revealing the identifier.
+	ModeHash Mode = "hash"
+	// ModeTruncate keeps a short prefix of GUIDs, the tail of serial
+	// numbers and the network part of IP addresses.
+	ModeTruncate Mode = "truncate"
+)
+
+// ParseMode parses a -log-redact value. The empty string means ModeOff.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(strings.ToLower(strings.TrimSpace(s))); m {
+	case "", ModeOff:
+		return ModeOff, nil
+	case ModeHash, ModeTruncate:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown log redaction mode %q (want off, hash or truncate)", s)
+}
+
+// kind is the class of identifier an attribute carries.
+type kind int
+
+const (
+	kindGUID kind = iota + 1
+	kindSerial
+	kindIP
+)
+
+// attrKinds maps log attribute keys to the identifier they carry.
+var attrKinds = map[string]kind{
+	"guid":        kindGUID,
+	"ueid_guid":   kindGUID,
+	"serial":      kindSerial,
+	"subject":     kindSerial, // certificate DNs embed the serial number
+	"remote_addr": kindIP,
+	"client_ip":   kindIP,
+}
+
+// guidPattern finds canonical GUIDs embedded in messages and errors.
+var guidPattern = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+
+// Redactor rewrites device identifiers according to a Mode.
+type Redactor struct {
+	mode Mode
+	salt []byte
+}
+
+// NewRedactor creates a Redactor. salt keys the hash in ModeHash; without
+// one, hashes of low-entropy values such as serials can be brute forced.
+func NewRedactor(mode Mode, salt string) *Redactor {
+	return &Redactor{mode: mode, salt: []byte(salt)}
+}
+
+// GUID redacts a device GUID.
+func (r *Redactor) GUID(v string) string { return r.redact(kindGUID, v) }
+
+// Serial redacts a serial number.
+func (r *Redactor) Serial(v string) string { return r.redact(kindSerial, v) }
+
+// IP redacts an IP address, with or without a port.
+func (r *Redactor) IP(v string) string { return r.redact(kindIP, v) }
+
+func (r *Redactor) redact(k kind, v string) string {
+	if r == nil || r.mode == ModeOff || v == "" {
+		return v
+	}
+	switch k {
+	case kindGUID:
+		v = strings.ToLower(v)
+	case kindIP:
+		v = stripPort(v)
+	}
+	if r.mode == ModeHash {
+		mac := hmac.New(sha256.New, r.salt)
+		mac.Write([]byte(v))
+		return "h:" + hex.EncodeToString(mac.Sum(nil)[:6])
+	}
+	switch k {
+	case kindGUID:
+		if len(v) > 8 {
+			return v[:8] + "…"
+		}
+	case kindSerial:
+		if len(v) > 4 {
+			return "…" + v[len(v)-4:]
+		}
+		return "…"
+	case kindIP:
+		return truncateIP(v)
+	}
+	return v
+}
+
+func stripPort(v string) string {
+	if h, _, err := net.SplitHostPort(v); err == nil {
+		return h
+	}
+	return v
+}
+
+// truncateIP keeps the /24 of an IPv4 address or the /48 of an IPv6 one.
+func truncateIP(v string) string {
+	ip := net.ParseIP(v)
+	switch {
+	case ip == nil:
+		return "…"
+	case ip.To4() != nil:
+		return ip.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	default:
+		return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+	}
+}
+
+// text redacts GUIDs embedded in free text.
+func (r *Redactor) text(s string) string {
+	return guidPattern.ReplaceAllStringFunc(s, r.GUID)
+}
+
+// attr redacts a by key, and any GUIDs in string or error values.
+func (r *Redactor) attr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		attrs := v.Group()
+		out := make([]slog.Attr, len(attrs))
+		for i, g := range attrs {
+			out[i] = r.attr(g)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(out...)}
+	}
+	if k, ok := attrKinds[a.Key]; ok {
+		return slog.String(a.Key, r.redact(k, v.String()))
+	}
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, r.text(v.String()))
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return slog.String(a.Key, r.text(err.Error()))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// Handler wraps h so records pass through r before being written.
+func Handler(h slog.Handler, r *Redactor) slog.Handler {
+	if r == nil || r.mode == ModeOff {
+		return h
+	}
+	return &redactHandler{h: h, r: r}
+}
+
+type redactHandler struct {
+	h slog.Handler
+	r *Redactor
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.h.Enabled(ctx, l)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, rec slog.Record) error {
+	out := slog.NewRecord(rec.Time, rec.Level, h.r.text(rec.Message), rec.PC)
+	rec.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.r.attr(a))
+		return true
+	})
+	return h.h.Handle(ctx, out)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		out[i] = h.r.attr(a)
+	}
+	return &redactHandler{h: h.h.WithAttrs(out), r: h.r}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{h: h.h.WithGroup(name), r: h.r}
+}
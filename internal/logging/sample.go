@@ -0,0 +1,143 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+// SampleKey is the attribute that marks a record as a routine per-message
+// log eligible for sampling. Its value is the FDO message type.
+const SampleKey = "msg_type"
+
+var sampledOut = metrics.Default.NewCounterVec(
+	"fdo_proxy_log_records_sampled_out_total",
+	"Per-message log records dropped by sampling, by FDO message type.",
+	"msg_type")
+
+// SampleRates maps FDO message types to "log 1 in N". The key -1 applies to
+// message types without an entry of their own.
+type SampleRates map[int]uint64
+
+// ParseSampleRates parses a -log-sample value such as "68=100,69=100" or
+// "*=10". Message types are numeric; "*" sets the default.
+func ParseSampleRates(s string) (SampleRates, error) {
+	rates := SampleRates{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("log sample %q: want type=N", part)
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 32)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("log sample %q: rate must be a positive integer", part)
+		}
+		t := -1
+		if k = strings.TrimSpace(k); k != "*" {
+			if t, err = strconv.Atoi(k); err != nil || t < 0 || t > 255 {
+				return nil, fmt.Errorf("log sample %q: unknown message type", part)
+			}
+		}
+		rates[t] = n
+	}
+	return rates, nil
+}
+
+func (r SampleRates) rate(msgType int) uint64 {
+	if n, ok := r[msgType]; ok {
+		return n
+	}
+	return r[-1]
+}
+
+// SampleHandler wraps h so routine per-message records (those carrying
+// SampleKey, below warning level) are kept 1 in N per message type.
+// Warnings, errors and records without a message type, such as lifecycle
+// transitions, always pass.
+func SampleHandler(h slog.Handler, rates SampleRates) slog.Handler {
+	if len(rates) == 0 {
+		return h
+	}
+	return &sampleHandler{h: h, rates: rates, counts: &sync.Map{}, msgType: -1}
+}
+
+type sampleHandler struct {
+	h      slog.Handler
+	rates  SampleRates
+	counts *sync.Map // int → *atomic.Uint64
+	// msgType comes from WithAttrs, or is -1.
+	msgType int
+}
+
+func (h *sampleHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.h.Enabled(ctx, l)
+}
+
+func (h *sampleHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if rec.Level >= slog.LevelWarn {
+		return h.h.Handle(ctx, rec)
+	}
+	msgType := h.msgType
+	rec.Attrs(func(a slog.Attr) bool {
+		if t, ok := attrMsgType(a); ok {
+			msgType = t
+			return false
+		}
+		return true
+	})
+	if msgType < 0 || h.keep(msgType) {
+		return h.h.Handle(ctx, rec)
+	}
+	sampledOut.Inc(strconv.Itoa(msgType))
+	return nil
+}
+
+// keep reports whether this occurrence of msgType is the 1 in N logged.
+func (h *sampleHandler) keep(msgType int) bool {
+	n := h.rates.rate(msgType)
+	if n <= 1 {
+		return true
+	}
+	c, _ := h.counts.LoadOrStore(msgType, new(atomic.Uint64))
+	return (c.(*atomic.Uint64).Add(1)-1)%n == 0
+}
+
+func (h *sampleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	for _, a := range attrs {
+		if t, ok := attrMsgType(a); ok {
+			c.msgType = t
+		}
+	}
+	c.h = h.h.WithAttrs(attrs)
+	return &c
+}
+
+func (h *sampleHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.h = h.h.WithGroup(name)
+	return &c
+}
+
+func attrMsgType(a slog.Attr) (int, bool) {
+	if a.Key != SampleKey {
+		return 0, false
+	}
+	switch v := a.Value.Resolve(); v.Kind() {
+	case slog.KindInt64:
+		return int(v.Int64()), true
+	case slog.KindUint64:
+		return int(v.Uint64()), true
+	}
+	return 0, false
+}
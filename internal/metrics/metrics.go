@@ -0,0 +1,336 @@
+// Package metrics is a minimal, dependency-free metrics registry that renders
+// the Prometheus text exposition format. It covers the counters, gauges and
+// histograms the proxy needs without pulling in a client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are latency buckets in seconds suited to HTTP round trips.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the process-wide registry served on the admin listener.
+var Default = NewRegistry()
+
+// Registry holds metric families in registration order.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	byName   map[string]*family
+	sinks    atomic.Pointer[[]Sink]
+}
+
+// Sink receives every update as it is made, for push-based backends such as
+// StatsD. Implementations are called on the instrumented code path and must
+// not block.
+type Sink interface {
+	Count(name string, labels, values []string, delta float64)
+	Gauge(name string, labels, values []string, v float64)
+	Observe(name string, labels, values []string, v float64)
+}
+
+// AddSink forwards all subsequent updates to s.
+func (r *Registry) AddSink(s Sink) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sinks []Sink
+	if p := r.sinks.Load(); p != nil {
+		sinks = append(sinks, *p...)
+	}
+	sinks = append(sinks, s)
+	r.sinks.Store(&sinks)
+}
+
+func (r *Registry) eachSink(fn func(Sink)) {
+	if p := r.sinks.Load(); p != nil {
+		for _, s := range *p {
+			fn(s)
+		}
+	}
+}
+
+// EachGaugeFunc calls fn with the current value of every gauge registered
+// with NewGaugeFunc, so push-based sinks can poll them.
+func (r *Registry) EachGaugeFunc(fn func(name string, v float64)) {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+	for _, f := range families {
+		if f.fn != nil {
+			fn(f.name, f.fn())
+		}
+	}
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{byName: make(map[string]*family)}
+}
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+type family struct {
+	reg     *Registry
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+	fn      func() float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (r *Registry) register(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.byName[f.name]; ok {
+		if existing.kind != f.kind || len(existing.labels) != len(f.labels) {
+			panic(fmt.Sprintf("metrics: %s re-registered with a different shape", f.name))
+		}
+		return existing
+	}
+	f.reg = r
+	f.series = make(map[string]*series)
+	r.families = append(r.families, f)
+	r.byName[f.name] = f
+	return f
+}
+
+// get returns the series for the given label values, creating it if needed.
+// The caller must hold f.mu.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if f.kind == kindHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// CounterVec is a monotonically increasing value partitioned by labels.
+type CounterVec struct{ f *family }
+
+// NewCounterVec registers a counter family.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(&family{name: name, help: help, kind: kindCounter, labels: labels})}
+}
+
+// Inc adds one to the series identified by values.
+func (c *CounterVec) Inc(values ...string) { c.Add(1, values...) }
+
+// Add adds v (which must be non-negative) to the series identified by values.
+func (c *CounterVec) Add(v float64, values ...string) {
+	if v < 0 {
+		return
+	}
+	c.f.mu.Lock()
+	c.f.get(values).value += v
+	c.f.mu.Unlock()
+	c.f.reg.eachSink(func(s Sink) { s.Count(c.f.name, c.f.labels, values, v) })
+}
+
+// GaugeVec is a value that can go up and down, partitioned by labels.
+type GaugeVec struct{ f *family }
+
+// NewGaugeVec registers a gauge family.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(&family{name: name, help: help, kind: kindGauge, labels: labels})}
+}
+
+// Set replaces the value of the series identified by values.
+func (g *GaugeVec) Set(v float64, values ...string) {
+	g.f.mu.Lock()
+	g.f.get(values).value = v
+	g.f.mu.Unlock()
+	g.f.reg.eachSink(func(s Sink) { s.Gauge(g.f.name, g.f.labels, values, v) })
+}
+
+// Add adds v (possibly negative) to the series identified by values.
+func (g *GaugeVec) Add(v float64, values ...string) {
+	g.f.mu.Lock()
+	s := g.f.get(values)
+	s.value += v
+	cur := s.value
+	g.f.mu.Unlock()
+	g.f.reg.eachSink(func(s Sink) { s.Gauge(g.f.name, g.f.labels, values, cur) })
+}
+
+// NewGaugeFunc registers an unlabelled gauge whose value is read from fn at
+// scrape time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, kind: kindGauge, fn: fn})
+}
+
+// HistogramVec counts observations into cumulative buckets, partitioned by labels.
+type HistogramVec struct{ f *family }
+
+// NewHistogramVec registers a histogram family. Buckets must be sorted ascending.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{r.register(&family{name: name, help: help, kind: kindHistogram, labels: labels, buckets: buckets})}
+}
+
+// Observe records v in the series identified by values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.f.mu.Lock()
+	s := h.f.get(values)
+	for i, ub := range h.f.buckets {
+		if v <= ub {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+	h.f.mu.Unlock()
+	h.f.reg.eachSink(func(s Sink) { s.Observe(h.f.name, h.f.labels, values, v) })
+}
+
+// Sample is the current value of one counter or gauge series.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Snapshot returns the series of the counter or gauge called name, for
+// in-process consumers such as alert rules. Unknown names and histograms
+// return nil.
+func (r *Registry) Snapshot(name string) []Sample {
+	r.mu.Lock()
+	f := r.byName[name]
+	r.mu.Unlock()
+	if f == nil || f.kind == kindHistogram {
+		return nil
+	}
+	if f.fn != nil {
+		return []Sample{{Value: f.fn()}}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]Sample, 0, len(f.series))
+	for _, s := range f.series {
+		labels := make(map[string]string, len(f.labels))
+		for i, l := range f.labels {
+			labels[l] = s.values[i]
+		}
+		out = append(out, Sample{Labels: labels, Value: s.value})
+	}
+	return out
+}
+
+// WriteText renders every family in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+
+	for _, f := range families {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *family) write(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.kind)
+
+	if f.fn != nil {
+		fmt.Fprintf(&b, "%s %s\n", f.name, formatFloat(f.fn()))
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		if f.kind != kindHistogram {
+			fmt.Fprintf(&b, "%s%s %s\n", f.name, labelString(f.labels, s.values, "", ""), formatFloat(s.value))
+			continue
+		}
+		for i, ub := range f.buckets {
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, labelString(f.labels, s.values, "le", formatFloat(ub)), s.counts[i])
+		}
+		fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, labelString(f.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, labelString(f.labels, s.values, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(&b, "%s_count%s %d\n", f.name, labelString(f.labels, s.values, "", ""), s.count)
+	}
+	f.mu.Unlock()
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelString(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		pairs = append(pairs, n+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler serves the registry in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.WriteText(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxPacket keeps StatsD datagrams under a typical Ethernet MTU.
+const maxPacket = 1432
+
+// StatsD flavors.
+const (
+	FlavorStatsD    = "statsd"
+	FlavorDogStatsD = "dogstatsd"
+)
+
+// StatsDOptions configures the StatsD emitter.
+type StatsDOptions struct {
+	// Addr is the agent's UDP address, e.g. 127.0.0.1:8125.
+	Addr string
+	// Prefix is prepended to every metric name, e.g. "fdo.".
+	Prefix string
+	// Flavor is FlavorStatsD (labels folded into the name) or
+	// FlavorDogStatsD (labels sent as tags). Defaults to FlavorStatsD.
+	Flavor string
+	// Tags are added to every metric in the DogStatsD flavor ("key:value").
+	Tags []string
+	// Interval between flushes. Defaults to one second.
+	Interval time.Duration
+}
+
+// StatsD pushes registry updates to a StatsD or DogStatsD agent over UDP.
+// Counters become counts, gauges gauges, and histograms timers (in
+// milliseconds for *_seconds metrics).
+type StatsD struct {
+	reg  *Registry
+	opts StatsDOptions
+	conn net.Conn
+
+	lines   chan string
+	dropped atomic.Uint64
+}
+
+// NewStatsD creates an emitter and subscribes it to r. Call Run to start
+// sending.
+func NewStatsD(r *Registry, opts StatsDOptions) (*StatsD, error) {
+	switch opts.Flavor {
+	case "":
+		opts.Flavor = FlavorStatsD
+	case FlavorStatsD, FlavorDogStatsD:
+	default:
+		return nil, fmt.Errorf("unknown statsd flavor %q (want statsd or dogstatsd)", opts.Flavor)
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	conn, err := net.Dial("udp", opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial statsd: %w", err)
+	}
+	s := &StatsD{reg: r, opts: opts, conn: conn, lines: make(chan string, 8192)}
+	r.AddSink(s)
+	return s, nil
+}
+
+// Count implements Sink.
+func (s *StatsD) Count(name string, labels, values []string, delta float64) {
+	s.emit(name, labels, values, formatFloat(delta)+"|c")
+}
+
+// Gauge implements Sink.
+func (s *StatsD) Gauge(name string, labels, values []string, v float64) {
+	if v < 0 && s.opts.Flavor == FlavorStatsD {
+		// A leading sign means "adjust by" to plain StatsD
+		s.emit(name, labels, values, "0|g")
+	}
+	s.emit(name, labels, values, formatFloat(v)+"|g")
+}
+
+// Observe implements Sink.
+func (s *StatsD) Observe(name string, labels, values []string, v float64) {
+	if base, ok := strings.CutSuffix(name, "_seconds"); ok {
+		s.emit(base, labels, values, formatFloat(math.Round(v*1e6)/1e3)+"|ms")
+		return
+	}
+	typ := "|ms"
+	if s.opts.Flavor == FlavorDogStatsD {
+		typ = "|h"
+	}
+	s.emit(name, labels, values, formatFloat(v)+typ)
+}
+
+func (s *StatsD) emit(name string, labels, values []string, value string) {
+	var b strings.Builder
+	b.WriteString(s.opts.Prefix)
+	b.WriteString(name)
+	if s.opts.Flavor == FlavorStatsD {
+		for _, v := range values {
+			b.WriteByte('.')
+			b.WriteString(sanitize(v))
+		}
+	}
+	b.WriteByte(':')
+	b.WriteString(value)
+	if s.opts.Flavor == FlavorDogStatsD && (len(labels) > 0 || len(s.opts.Tags) > 0) {
+		b.WriteString("|#")
+		for i, l := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(l)
+			b.WriteByte(':')
+			b.WriteString(sanitize(values[i]))
+		}
+		for i, t := range s.opts.Tags {
+			if i > 0 || len(labels) > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(t)
+		}
+	}
+	select {
+	case s.lines <- b.String():
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// sanitize makes a label value safe for a StatsD name segment or tag.
+func sanitize(v string) string {
+	if v == "" {
+		return "none"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, v)
+}
+
+// Run sends buffered updates every interval until ctx is cancelled, with a
+// final flush on the way out. Gauges registered with NewGaugeFunc are polled
+// on each flush.
+func (s *StatsD) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+	defer s.conn.Close()
+	var pkt []byte
+	send := func() {
+		if len(pkt) > 0 {
+			// UDP is fire and forget; an absent agent must not affect the proxy
+			_, _ = s.conn.Write(pkt)
+			pkt = pkt[:0]
+		}
+	}
+	add := func(line string) {
+		if len(pkt) > 0 && len(pkt)+1+len(line) > maxPacket {
+			send()
+		}
+		if len(pkt) > 0 {
+			pkt = append(pkt, '\n')
+		}
+		pkt = append(pkt, line...)
+	}
+	drain := func() {
+		s.reg.EachGaugeFunc(func(name string, v float64) { s.Gauge(name, nil, nil, v) })
+		if n := s.dropped.Swap(0); n > 0 {
+			s.Count("fdo_proxy_statsd_dropped_total", nil, nil, float64(n))
+		}
+		for {
+			select {
+			case line := <-s.lines:
+				add(line)
+			default:
+				send()
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			drain()
+			return
+		case <-ticker.C:
+			drain()
+		case line := <-s.lines:
+			add(line)
+			if len(pkt) >= maxPacket/2 {
+				send()
+			}
+		}
+	}
+}
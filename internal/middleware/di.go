@@ -2,20 +2,54 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
-	"strings"
+	"net/netip"
+	"time"
 
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/features"
+	"github.com/fdo-server-wrapper/internal/geo"
+	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/owners"
+	"github.com/fdo-server-wrapper/internal/policy"
 	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/serials"
+	"github.com/fdo-server-wrapper/internal/tags"
+)
+
+// Device values the DI middleware leaves in the session context for the
+// device's later sessions (see proxy.SessionContext.DeviceGet). All are
+// strings except DeviceTags.
+const (
+	DeviceSerial    = "serial"
+	DeviceProductID = "product_id"
+	// DeviceOwnerID is the owner named by the product item passport.
+	DeviceOwnerID = "owner_id"
+	// DeviceTags are the tags listed by the product item passport, a
+	// []string.
+	DeviceTags = "tags"
 )
 
 // DIMiddleware intercepts DI protocol messages to integrate with passport services.
 // It extracts product information during device initialization and logs passport data.
+// It is a set of typed handlers, installed with proxy.NewDispatcher.
 type DIMiddleware struct {
 	ledgerClient          proxy.LedgerClient
 	enableProductPassport bool
+	events                *events.Bus
+	serials               *serials.Registry
+	blockDuplicates       bool
+	owners                *owners.Map
+	tags                  *tags.Tagger
+	policies              *policy.Set
+	geo                   geo.DB
+	passportLookup        *features.Flag
+	passportEnforcement   *features.Flag
 }
 
 // NewDIMiddleware creates middleware for DI protocol integration.
@@ -27,138 +61,388 @@ func NewDIMiddleware(ledgerClient proxy.LedgerClient, enableProductPassport bool
 	}
 }
 
-// ProcessRequest handles incoming DI protocol requests.
-//
-// Contract:
-//
-//	Preconditions:
-//	  - req is not nil and contains valid HTTP request
-//	  - ctx is not nil
-//
-//	Postconditions:
-//	  - Returns nil if request is not DI-related or processing succeeds
-//	  - Returns error if request processing fails (does not interrupt FDO flow)
-//
-//	Integration Points:
-//	  - DI.AppStart (msg type 10): extracts product UUID and fetches passport
-func (m *DIMiddleware) ProcessRequest(ctx context.Context, req *http.Request) error {
-	// Only process DI protocol requests
-	if !m.isDIRequest(req) {
-		return nil
-	}
+// EnableEvents publishes a failure event to bus for every DI exchange the
+// backend rejects and every device whose product passport is missing, and
+// an initialized event for every device completing DI.
+func (m *DIMiddleware) EnableEvents(bus *events.Bus) {
+	m.events = bus
+}
 
-	// Parse message type from URL path: /fdo/101/msg/{msgType}
-	pathParts := strings.Split(req.URL.Path, "/")
-	if len(pathParts) < 5 {
-		return nil
-	}
+// EnableDuplicateDetection records every serial number completing DI in r
+// and flags a DI.AppStart for a serial already there. With block set such
+// requests are refused instead.
+func (m *DIMiddleware) EnableDuplicateDetection(r *serials.Registry, block bool) {
+	m.serials = r
+	m.blockDuplicates = block
+}
 
-	msgType := pathParts[4]
-	if msgType == "10" { // DI.AppStart message
-		return m.handleDIAppStart(ctx, req)
-	}
+// EnableOwnerMap assigns devices completing DI to owners from m, ahead of
+// the owner named by the product item passport.
+func (m *DIMiddleware) EnableOwnerMap(owners *owners.Map) {
+	m.owners = owners
+}
 
-	return nil
+// EnableTags tags devices through t, on top of the tags their product item
+// passport lists.
+func (m *DIMiddleware) EnableTags(t *tags.Tagger) {
+	m.tags = t
 }
 
-// ProcessResponse handles outgoing DI protocol responses.
-//
-// Contract:
-//
-//	Preconditions:
-//	  - resp is not nil and contains valid HTTP response
-//	  - ctx is not nil
-//
-//	Postconditions:
-//	  - Returns nil if response is not DI-related or processing succeeds
-//	  - Returns error if response processing fails (does not interrupt FDO flow)
-//
-//	Integration Points:
-//	  - DI.SetCredentials (msg type 11): logs successful credential setup
-func (m *DIMiddleware) ProcessResponse(ctx context.Context, resp *http.Response) error {
-	// Only process DI protocol responses
-	if !m.isDIResponse(resp) {
-		return nil
-	}
+// EnablePolicies applies the policy of s matching each device's tags or
+// owner to its DI: its rate limit, windows and passport mode.
+func (m *DIMiddleware) EnablePolicies(s *policy.Set) {
+	m.policies = s
+}
+
+// EnableGeoIP locates every device starting DI in db, for lifecycle
+// events.
+func (m *DIMiddleware) EnableGeoIP(db geo.DB) {
+	m.geo = db
+}
 
-	// Extract message type from response headers
-	msgType := resp.Header.Get("Message-Type")
-	if msgType == "11" { // DI.SetCredentials response
-		return m.handleDISetCredentials(ctx, resp)
+// EnableFeatureFlags lets lookup switch product passport lookups off and
+// enforce switch off the refusal of devices whose policy requires a
+// passport, at runtime. Such devices are then onboarded as if their policy
+// did not say.
+func (m *DIMiddleware) EnableFeatureFlags(lookup, enforce *features.Flag) {
+	m.passportLookup = lookup
+	m.passportEnforcement = enforce
+}
+
+// errLookupsOff is why a device is refused while the passport_lookup
+// feature flag is off. The device retries.
+var errLookupsOff = errors.New("passport lookups switched off")
+
+// passportMode returns the passport mode of p in effect.
+func (m *DIMiddleware) passportMode(p *policy.Policy) string {
+	mode := p.PassportMode()
+	if mode == policy.PassportRequire && m.passportEnforcement != nil && !m.passportEnforcement.Enabled() {
+		return ""
 	}
+	return mode
+}
 
-	return nil
+// diLocation is the session context key for where the device running DI
+// is located.
+const diLocation = "di.location"
+
+// location returns where the device running the DI session sc is located,
+// or nil.
+func location(sc *proxy.SessionContext) *geo.Location {
+	v, _ := sc.Get(diLocation)
+	loc, _ := v.(*geo.Location)
+	return loc
 }
 
-// isDIRequest identifies DI protocol requests by URL pattern.
-// DI requests follow the pattern /fdo/101/msg/10 or /fdo/101/msg/12.
-func (m *DIMiddleware) isDIRequest(req *http.Request) bool {
-	return strings.Contains(req.URL.Path, "/fdo/101/msg/") &&
-		(strings.HasSuffix(req.URL.Path, "/10") || strings.HasSuffix(req.URL.Path, "/12"))
+// deviceSerial is the serial number DI.AppStart gave for the device sc
+// belongs to, "" if it could not be decoded.
+func deviceSerial(sc *proxy.SessionContext) string {
+	v, _ := sc.DeviceGet(DeviceSerial)
+	serial, _ := v.(string)
+	return serial
 }
 
-// isDIResponse identifies DI protocol responses by message type header.
-// DI responses have Message-Type header set to "11" (SetCredentials) or "13" (Done).
-func (m *DIMiddleware) isDIResponse(resp *http.Response) bool {
-	msgType := resp.Header.Get("Message-Type")
-	return msgType == "11" || msgType == "13" // DI.SetCredentials or DI.Done
+// deviceTags resolves the tags of the device sc belongs to from what DI has
+// seen of it so far.
+func (m *DIMiddleware) deviceTags(sc *proxy.SessionContext) []string {
+	v, _ := sc.DeviceGet(DeviceSerial)
+	serial, _ := v.(string)
+	v, _ = sc.DeviceGet(DeviceProductID)
+	productID, _ := v.(string)
+	v, _ = sc.DeviceGet(DeviceTags)
+	passport, _ := v.([]string)
+	return m.tags.For(sc.GUID(), serial, productID, passport)
 }
 
-// handleDIAppStart processes DI.AppStart requests to fetch product passports.
-// When enabled, it extracts the product UUID from the request body and calls
-// the passport service to retrieve product item information.
-func (m *DIMiddleware) handleDIAppStart(ctx context.Context, req *http.Request) error {
-	if !m.enableProductPassport || m.ledgerClient == nil {
-		return nil
+// devicePolicy returns the policy of the device sc belongs to, from what DI
+// has seen of it so far.
+func (m *DIMiddleware) devicePolicy(sc *proxy.SessionContext) *policy.Policy {
+	v, _ := sc.DeviceGet(DeviceSerial)
+	serial, _ := v.(string)
+	v, _ = sc.DeviceGet(DeviceProductID)
+	productID, _ := v.(string)
+	return m.policies.For(m.deviceTags(sc), resolveOwner(m.owners, sc, sc.GUID(), serial, productID, ""))
+}
+
+// OnDIAppStart implements proxy.DIAppStartHandler. The serial number is
+// checked for duplicates and stashed as a device value in sc; when enabled,
+// the product UUID named by DeviceMfgInfo is used to retrieve product item
+// information from the passport service, whose owner and tags, if any, are
+// stashed too. The device's policy, chosen by the tags
+// and owner known before the passport is fetched, may rate limit it, hold
+// it until a window opens and require or skip the passport. It returns
+// *proxy.RejectError if duplicate blocking refuses the serial or the policy
+// refuses the device.
+func (m *DIMiddleware) OnDIAppStart(ctx context.Context, sc *proxy.SessionContext, app *fdo.AppStart, msg *proxy.Message) error {
+	addr, _ := netip.ParseAddr(remoteIP(msg.Request))
+	if loc, ok := geo.Lookup(m.geo, addr); ok {
+		sc.Set(diLocation, &loc)
+	}
+	if app == nil {
+		// DeviceMfgInfo is manufacturer specific; not every line uses the common layout
+		slog.Debug("Could not decode DI.AppStart", "msg_type", fdo.MsgDIAppStart, "error", msg.DecodeErr)
+	} else {
+		if err := m.checkSerial(ctx, sc, app.SerialNumber); err != nil {
+			return err
+		}
+		sc.DeviceSet(DeviceSerial, app.SerialNumber)
 	}
 
-	// Read request body to extract product information
-	body, err := io.ReadAll(req.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read request body: %w", err)
+	p := m.devicePolicy(sc)
+	mode := m.passportMode(p)
+	if err := admitPolicy(ctx, p, "di", time.Now(), mode == policy.PassportRequire); err != nil {
+		return err
+	}
+	lookup := m.enableProductPassport
+	switch mode {
+	case policy.PassportRequire:
+		lookup = true
+	case policy.PassportSkip:
+		if lookup {
+			policyActions.Inc(p.Name, "passport_skipped")
+		}
+		lookup = false
+	}
+	if m.passportLookup != nil && !m.passportLookup.Enabled() {
+		if mode == policy.PassportRequire {
+			return m.passportRequired(ctx, sc, p, "", errLookupsOff)
+		}
+		lookup = false
+	}
+	if !lookup || m.ledgerClient == nil {
+		if mode == policy.PassportRequire {
+			return m.passportRequired(ctx, sc, p, "", errors.New("passport service not configured"))
+		}
+		return nil
 	}
-	req.Body = io.NopCloser(strings.NewReader(string(body))) // Restore body for backend
 
-	// Extract product UUID from CBOR body
-	// Note: This is a simplified implementation - production code would need proper CBOR parsing
-	productID := m.extractProductID(body)
+	var productID string
+	if app != nil {
+		productID = app.ProductID
+	}
 	if productID == "" {
+		if mode == policy.PassportRequire {
+			return m.passportRequired(ctx, sc, p, "", errors.New("DeviceMfgInfo names no product ID"))
+		}
 		return nil
 	}
+	sc.DeviceSet(DeviceProductID, productID)
 
 	// Fetch product item passport from external service
 	passport, err := m.ledgerClient.GetProductItemPassport(ctx, productID)
 	if err != nil {
-		slog.Warn("Failed to get product passport", "product_id", productID, "error", err)
+		if mode == policy.PassportRequire {
+			return m.passportRequired(ctx, sc, p, productID, err)
+		}
+		if errors.Is(err, ledger.ErrLookupBackoff) {
+			// Already warned about this UUID; don't flood the log while backing off
+			slog.Debug("Product passport lookup backing off", "product_id", productID)
+			return nil
+		}
+		if errors.Is(err, ledger.ErrOffline) {
+			// The lookup is repeated when the passport service is back
+			slog.Debug("Product passport lookup deferred while the passport service is offline", "product_id", productID)
+			return nil
+		}
+		if errors.Is(err, ledger.ErrPassportNotFound) {
+			m.events.Publish(ctx, &events.Event{
+				Type:        events.Failed,
+				Time:        time.Now(),
+				RequestID:   correlation.RequestID(ctx),
+				Protocol:    "di",
+				FailureKind: ledger.FailurePassportMismatch,
+				Stage:       fdo.MsgDIAppStart,
+				ProductID:   productID,
+				Serial:      deviceSerial(sc),
+				Tags:        m.deviceTags(sc),
+				Location:    location(sc),
+				Reason:      "no product item passport for product ID",
+			})
+		}
+		slog.Warn("Failed to get product passport",
+			"product_id", productID,
+			"request_id", correlation.RequestID(ctx),
+			"error", err)
 		return nil // Don't fail the request - passport lookup is optional
 	}
 
 	slog.Info("Retrieved product item passport",
 		"uuid", passport.UUID,
-		"records", len(passport.Records))
+		"records", len(passport.Records),
+		"owner_id", passport.Metadata.OwnerID,
+		"tags", passport.Metadata.Tags)
+	if passport.Metadata.OwnerID != "" {
+		sc.DeviceSet(DeviceOwnerID, passport.Metadata.OwnerID)
+	}
+	if len(passport.Metadata.Tags) > 0 {
+		sc.DeviceSet(DeviceTags, passport.Metadata.Tags)
+	}
 
 	return nil
 }
 
-// handleDISetCredentials logs successful DI credential setup.
-// This provides visibility into the DI protocol completion.
-func (m *DIMiddleware) handleDISetCredentials(ctx context.Context, resp *http.Response) error {
-	slog.Info("DI.SetCredentials completed successfully")
+// passportRequired refuses a device whose policy requires a product passport
+// that could not be retrieved, publishing the refusal as a passport
+// mismatch. A missing passport is refused for good; a lookup that failed
+// otherwise is refused as retryable.
+func (m *DIMiddleware) passportRequired(ctx context.Context, sc *proxy.SessionContext, p *policy.Policy, productID string, err error) error {
+	reject := &proxy.RejectError{
+		Status: http.StatusServiceUnavailable,
+		Err:    fmt.Errorf("policy %s requires a product passport: %w", p.Name, err),
+	}
+	if (productID == "" && !errors.Is(err, errLookupsOff)) || errors.Is(err, ledger.ErrPassportNotFound) {
+		reject.Status = http.StatusForbidden
+		reject.Code = fdo.CodeResourceNotFound
+	}
+	tags := m.deviceTags(sc)
+	policyActions.Inc(p.Name, "passport_refused")
+	countOnboarding("di", "failed", tags)
+	slog.Warn("DI refused by policy",
+		"policy", p.Name,
+		"product_id", productID,
+		"request_id", correlation.RequestID(ctx),
+		"error", err)
+	m.events.Publish(ctx, &events.Event{
+		Type:        events.Failed,
+		Time:        time.Now(),
+		RequestID:   correlation.RequestID(ctx),
+		Protocol:    "di",
+		FailureKind: ledger.FailurePassportMismatch,
+		Stage:       fdo.MsgDIAppStart,
+		ProductID:   productID,
+		Serial:      deviceSerial(sc),
+		Tags:        tags,
+		Location:    location(sc),
+		Reason:      reject.Err.Error(),
+	})
+	return reject
+}
+
+// checkSerial flags, or with blocking enabled refuses, a serial number that
+// already completed DI.
+func (m *DIMiddleware) checkSerial(ctx context.Context, sc *proxy.SessionContext, serial string) error {
+	prev, ok := m.serials.Get(serial)
+	if !ok {
+		return nil
+	}
+	requestID := correlation.RequestID(ctx)
+	action := "flagged"
+	if m.blockDuplicates {
+		action = "blocked"
+	}
+	duplicateSerials.Inc(action)
+	slog.Warn("DI.AppStart for already initialized serial",
+		"serial", serial,
+		"guid", prev.GUID,
+		"count", prev.Count,
+		"last_initialized", prev.Last,
+		"action", action,
+		"request_id", requestID)
+	if !m.blockDuplicates {
+		return nil
+	}
+
+	// The serial stays out of the error text, which is logged unredacted
+	reason := fmt.Sprintf("serial already initialized %d time(s), last at %s", prev.Count, prev.Last.Format(time.RFC3339))
+	tags := m.tags.For("", serial, "", nil)
+	countOnboarding("di", "failed", tags)
+	m.events.Publish(ctx, &events.Event{
+		Type:        events.Failed,
+		Time:        time.Now(),
+		RequestID:   requestID,
+		Protocol:    "di",
+		FailureKind: ledger.FailureDuplicateSerial,
+		Stage:       fdo.MsgDIAppStart,
+		Serial:      serial,
+		Tags:        tags,
+		Location:    location(sc),
+		Reason:      reason + " as " + prev.GUID,
+	})
+	return &proxy.RejectError{Status: http.StatusConflict, Code: fdo.CodeCredReuseError, Err: errors.New(reason)}
+}
+
+// OnDIDone implements proxy.DIDoneHandler. It counts the completed DI
+// exchange, publishes it with the device's owner, if one is assigned, and
+// tags, and records the serial as initialized.
+func (m *DIMiddleware) OnDIDone(ctx context.Context, sc *proxy.SessionContext, msg *proxy.Message) error {
+	tags := m.deviceTags(sc)
+	countOnboarding("di", "succeeded", tags)
+	if m.events.Len() > 0 && sc.GUID() != "" {
+		v, _ := sc.DeviceGet(DeviceProductID)
+		productID, _ := v.(string)
+		serial := deviceSerial(sc)
+		m.events.Publish(ctx, &events.Event{
+			Type:      events.Initialized,
+			GUID:      sc.GUID(),
+			OwnerID:   resolveOwner(m.owners, sc, sc.GUID(), serial, productID, ""),
+			Time:      time.Now(),
+			RequestID: correlation.RequestID(ctx),
+			Protocol:  "di",
+			ProductID: productID,
+			Serial:    serial,
+			Tags:      tags,
+			Location:  location(sc),
+		})
+	}
+	if m.serials == nil {
+		return nil
+	}
+	serial := deviceSerial(sc)
+	if serial == "" {
+		return nil
+	}
+	e, err := m.serials.Record(serial, sc.GUID(), time.Now())
+	if err != nil {
+		slog.Error("Failed to record initialized serial", "serial", serial, "error", err)
+		return nil
+	}
+	slog.Info("Serial initialized", "serial", serial, "guid", sc.GUID(), "count", e.Count)
 	return nil
 }
 
-// extractProductID parses the product UUID from DI.AppStart request body.
-// This is a placeholder implementation - production code would need:
-// 1. Proper CBOR parsing of the request body
-// 2. Extraction of device manufacturing info
-// 3. Location of the productId field within the CBOR structure
-func (m *DIMiddleware) extractProductID(body []byte) string {
-	// Simple string search as placeholder
-	// TODO: Implement proper CBOR parsing
-	if strings.Contains(string(body), "productId") {
-		// Extract actual product ID from CBOR data
-		return "example-product-id"
+// OnErrorMessage implements proxy.ErrorMessageHandler. A DI exchange the
+// backend answered with an ErrorMessage is published as a failure. No GUID
+// has been assigned at this point.
+func (m *DIMiddleware) OnErrorMessage(ctx context.Context, sc *proxy.SessionContext, em *fdo.ErrorMessage, msg *proxy.Message) error {
+	if msg.InReplyTo != fdo.MsgDIAppStart && msg.InReplyTo != fdo.MsgDISetHMAC {
+		return nil
+	}
+	tags := m.deviceTags(sc)
+	countOnboarding("di", "failed", tags)
+	if m.events.Len() == 0 {
+		return nil
 	}
+	ev := &events.Event{
+		Type:        events.Failed,
+		Time:        time.Now(),
+		RequestID:   correlation.RequestID(ctx),
+		Protocol:    "di",
+		FailureKind: ledger.FailureDIRejected,
+		Serial:      deviceSerial(sc),
+		Tags:        tags,
+		Location:    location(sc),
+		Reason:      "error message",
+	}
+	if em != nil {
+		ev.Reason = em.String()
+		ev.Stage = int(em.PrevMsgID)
+		ev.ErrorCode = em.Code
+	}
+	slog.Warn("DI rejected by backend", "request_id", ev.RequestID, "reason", ev.Reason)
+	m.events.Publish(ctx, ev)
+	return nil
+}
 
-	return ""
+// OnDISetCredentials implements proxy.DISetCredentialsHandler. It logs
+// successful DI credential setup, which provides visibility into the DI
+// protocol completion, and ties sc to the voucher GUID so its device values
+// are kept for TO2.
+func (m *DIMiddleware) OnDISetCredentials(ctx context.Context, sc *proxy.SessionContext, creds *fdo.SetCredentials, msg *proxy.Message) error {
+	slog.Info("DI.SetCredentials completed successfully")
+	if creds == nil {
+		slog.Warn("Could not decode DI.SetCredentials", "request_id", correlation.RequestID(ctx), "error", msg.DecodeErr)
+		return nil
+	}
+	sc.SetGUID(creds.GUID.String())
+	return nil
 }
@@ -0,0 +1,243 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/policy"
+	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/serials"
+	"github.com/fdo-server-wrapper/internal/tags"
+)
+
+// appStartBody is a DI.AppStart for serial SN-0001 naming product
+// testProductID.
+const appStartBody = "815848860a0167534e2d30303031686f6e69652d783836423081a16970726f647563744964782433463235303445302d344638392d343144332d394130432d303330354538324333333031"
+
+const testProductID = "3f2504e0-4f89-41d3-9a0c-0305e82c3301"
+
+// fakeLedger is a passport service answering every lookup with passport
+// or err, and recording the commissioning passports it is sent.
+type fakeLedger struct {
+	passport *ledger.ProductItemPassport
+	err      error
+
+	mu      sync.Mutex
+	lookups []string
+	created []*ledger.CommissioningCreateRequest
+}
+
+func (l *fakeLedger) GetProductItemPassport(_ context.Context, uuid string) (*ledger.ProductItemPassport, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lookups = append(l.lookups, uuid)
+	return l.passport, l.err
+}
+
+func (l *fakeLedger) CreateCommissioningPassport(_ context.Context, req *ledger.CommissioningCreateRequest) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.created = append(l.created, req)
+	return l.err
+}
+
+// recordingSink keeps the events published to it.
+type recordingSink struct {
+	mu     sync.Mutex
+	events []*events.Event
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+
+func (s *recordingSink) Publish(_ context.Context, ev *events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, ev)
+	return nil
+}
+
+// newBus returns a bus delivering to a recordingSink.
+func newBus() (*events.Bus, *recordingSink) {
+	bus := events.NewBus(time.Second)
+	sink := &recordingSink{}
+	bus.Subscribe(sink)
+	return bus, sink
+}
+
+// loadPolicies writes a policy file of body and loads it.
+func loadPolicies(t *testing.T, body string) *policy.Set {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policies.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := policy.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// dispatch hands req to handler through a dispatcher, as the proxy does.
+func dispatch(t *testing.T, sc *proxy.SessionContext, req *http.Request, handler any) error {
+	t.Helper()
+	d, err := proxy.NewDispatcher(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.ProcessRequest(context.Background(), sc, req)
+}
+
+// fdoRequest is a device's FDO message of msgType with body in hex.
+func fdoRequest(t *testing.T, msgType int, body string) *http.Request {
+	t.Helper()
+	b, err := hex.DecodeString(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewRequest(http.MethodPost, "/fdo/101/msg/"+strconv.Itoa(msgType), bytes.NewReader(b))
+}
+
+// wantReject checks that err is a *proxy.RejectError with status, and with
+// code unless it is 0.
+func wantReject(t *testing.T, err error, status int, code uint64) {
+	t.Helper()
+	var rej *proxy.RejectError
+	if !errors.As(err, &rej) {
+		t.Fatalf("error = %v, want *proxy.RejectError", err)
+	}
+	if rej.Status != status || (code != 0 && rej.Code != code) {
+		t.Errorf("rejected with %d, code %d, want %d, code %d", rej.Status, rej.Code, status, code)
+	}
+}
+
+func TestDIPolicyPassport(t *testing.T) {
+	found := &ledger.ProductItemPassport{UUID: testProductID, Metadata: ledger.ProductItemMetadata{OwnerID: "tenant-a"}}
+	tests := []struct {
+		name     string
+		passport string // policy passport mode, "" for none
+		lookup   bool   // -product-passport
+		ledger   *fakeLedger
+		// status is the rejection, 0 if the device is let through.
+		status  int
+		code    uint64
+		lookups int
+	}{
+		{name: "no policy", lookup: true, ledger: &fakeLedger{passport: found}, lookups: 1},
+		{name: "lookups off", ledger: &fakeLedger{passport: found}},
+		{name: "require found", passport: "require", ledger: &fakeLedger{passport: found}, lookups: 1},
+		{name: "require not found", passport: "require", ledger: &fakeLedger{err: ledger.ErrPassportNotFound}, status: http.StatusForbidden, code: fdo.CodeResourceNotFound, lookups: 1},
+		{name: "require unreachable", passport: "require", ledger: &fakeLedger{err: errors.New("connection refused")}, status: http.StatusServiceUnavailable, lookups: 1},
+		{name: "require offline", passport: "require", ledger: &fakeLedger{err: ledger.ErrOffline}, status: http.StatusServiceUnavailable, lookups: 1},
+		{name: "require without service", passport: "require", status: http.StatusForbidden, code: fdo.CodeResourceNotFound},
+		{name: "skip", passport: "skip", lookup: true, ledger: &fakeLedger{passport: found}},
+		{name: "optional not found", lookup: true, ledger: &fakeLedger{err: ledger.ErrPassportNotFound}, lookups: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var client proxy.LedgerClient
+			if tt.ledger != nil {
+				client = tt.ledger
+			}
+			m := NewDIMiddleware(client, tt.lookup)
+			tagger, err := tags.Open("", &tags.Rules{SerialPrefixes: map[string][]string{"SN-": {"line-a"}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.EnableTags(tagger)
+			if tt.passport != "" {
+				m.EnablePolicies(loadPolicies(t, `{"policies": [{"name": "line-a", "tags": ["line-a"], "passport": "`+tt.passport+`"}]}`))
+			}
+			bus, sink := newBus()
+			m.EnableEvents(bus)
+
+			sc := proxy.NewSessionContext("di")
+			err = dispatch(t, sc, fdoRequest(t, fdo.MsgDIAppStart, appStartBody), m)
+			bus.Wait()
+			if tt.status == 0 {
+				if err != nil {
+					t.Fatalf("OnDIAppStart = %v, want nil", err)
+				}
+			} else {
+				wantReject(t, err, tt.status, tt.code)
+				if len(sink.events) != 1 || sink.events[0].FailureKind != ledger.FailurePassportMismatch {
+					t.Errorf("events = %+v, want one passport_mismatch failure", sink.events)
+				}
+			}
+			if tt.ledger != nil && len(tt.ledger.lookups) != tt.lookups {
+				t.Errorf("%d passport lookups, want %d", len(tt.ledger.lookups), tt.lookups)
+			}
+			if v, _ := sc.DeviceGet(DeviceSerial); v != "SN-0001" {
+				t.Errorf("device serial = %v, want SN-0001", v)
+			}
+			if tt.status == 0 && tt.lookups > 0 && tt.ledger.err == nil {
+				if v, _ := sc.DeviceGet(DeviceOwnerID); v != "tenant-a" {
+					t.Errorf("device owner = %v, want tenant-a from the passport", v)
+				}
+			}
+		})
+	}
+}
+
+func TestDIDuplicateSerial(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		block bool
+	}{
+		{"flag", false},
+		{"block", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reg, err := serials.Open("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := NewDIMiddleware(nil, false)
+			m.EnableDuplicateDetection(reg, tt.block)
+			bus, sink := newBus()
+			m.EnableEvents(bus)
+
+			// A serial not seen before passes either way
+			if err := dispatch(t, proxy.NewSessionContext("di"), fdoRequest(t, fdo.MsgDIAppStart, appStartBody), m); err != nil {
+				t.Fatalf("first DI.AppStart = %v, want nil", err)
+			}
+			if _, err := reg.Record("SN-0001", "11111111-2222-3333-4444-555555555555", time.Now()); err != nil {
+				t.Fatal(err)
+			}
+
+			err = dispatch(t, proxy.NewSessionContext("di"), fdoRequest(t, fdo.MsgDIAppStart, appStartBody), m)
+			bus.Wait()
+			if !tt.block {
+				if err != nil || len(sink.events) != 0 {
+					t.Errorf("flagged duplicate = %v with events %+v, want nil and none", err, sink.events)
+				}
+				return
+			}
+			wantReject(t, err, http.StatusConflict, fdo.CodeCredReuseError)
+			if strings.Contains(err.Error(), "SN-0001") {
+				t.Errorf("rejection %q names the serial", err)
+			}
+			if len(sink.events) != 1 {
+				t.Fatalf("%d events, want 1", len(sink.events))
+			}
+			ev := sink.events[0]
+			if ev.Type != events.Failed || ev.FailureKind != ledger.FailureDuplicateSerial || ev.Serial != "SN-0001" {
+				t.Errorf("event = %+v, want a duplicate_serial failure for SN-0001", ev)
+			}
+		})
+	}
+}
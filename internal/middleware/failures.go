@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/ledger"
+)
+
+// FailureClient posts failure records to the passport service.
+type FailureClient interface {
+	ReportFailure(ctx context.Context, rec *ledger.FailureRecord) error
+}
+
+// LedgerFailureSink reports failed onboarding events to the passport
+// service, so it reflects problem devices as well as successes. It
+// implements events.Sink.
+type LedgerFailureSink struct {
+	client FailureClient
+}
+
+// NewLedgerFailureSink creates a sink posting to c.
+func NewLedgerFailureSink(c FailureClient) *LedgerFailureSink {
+	return &LedgerFailureSink{client: c}
+}
+
+// Name implements events.Sink.
+func (f *LedgerFailureSink) Name() string { return "ledger_failures" }
+
+// Publish implements events.Sink.
+func (f *LedgerFailureSink) Publish(ctx context.Context, ev *events.Event) error {
+	if ev.Type != events.Failed {
+		return nil
+	}
+	rec := &ledger.FailureRecord{
+		ControllerUUID: ev.GUID,
+		ProductID:      ev.ProductID,
+		Kind:           ev.FailureKind,
+		Protocol:       ev.Protocol,
+		Stage:          ev.Stage,
+		ErrorCode:      ev.ErrorCode,
+		Reason:         ev.Reason,
+		Timestamp:      fmt.Sprintf("%d", ev.Time.UnixNano()),
+	}
+	if ev.Session != nil {
+		rec.Evidence = evidenceFromSession(ev.Session)
+	}
+	return f.client.ReportFailure(ctx, rec)
+}
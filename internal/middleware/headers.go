@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/fdo-server-wrapper/internal/proxy"
+)
+
+// HeaderRewriter edits backend response headers before they reach the
+// device, e.g. to drop headers that reveal the backend's software or add
+// owner-specific ones.
+type HeaderRewriter struct {
+	remove []string
+	set    map[string]string
+}
+
+// protectedHeaders carry the FDO exchange itself and cannot be rewritten.
+var protectedHeaders = []string{"Authorization", "Message-Type", "Content-Type", "Content-Length", "Transfer-Encoding"}
+
+// NewHeaderRewriter creates middleware that deletes the remove headers from
+// every response, then sets the set headers.
+func NewHeaderRewriter(remove []string, set map[string]string) (*HeaderRewriter, error) {
+	names := append([]string(nil), remove...)
+	for name := range set {
+		names = append(names, name)
+	}
+	if err := checkProtected(names); err != nil {
+		return nil, err
+	}
+	return &HeaderRewriter{remove: remove, set: set}, nil
+}
+
+// checkProtected fails if any of names is a protected header.
+func checkProtected(names []string) error {
+	for _, name := range names {
+		for _, p := range protectedHeaders {
+			if http.CanonicalHeaderKey(name) == p {
+				return fmt.Errorf("header %s is part of the FDO exchange and cannot be rewritten", p)
+			}
+		}
+	}
+	return nil
+}
+
+// ProcessRequest leaves requests untouched.
+func (h *HeaderRewriter) ProcessRequest(ctx context.Context, sc *proxy.SessionContext, req *http.Request) error {
+	return nil
+}
+
+// ProcessResponse applies the header edits to resp.
+func (h *HeaderRewriter) ProcessResponse(ctx context.Context, sc *proxy.SessionContext, resp *http.Response) error {
+	for _, name := range h.remove {
+		resp.Header.Del(name)
+	}
+	for name, v := range h.set {
+		resp.Header.Set(name, v)
+	}
+	return nil
+}
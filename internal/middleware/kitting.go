@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/kitting"
+	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/metrics"
+	"github.com/fdo-server-wrapper/internal/proxy"
+)
+
+var kittingDeliveries = metrics.Default.NewCounterVec(
+	"fdo_proxy_kitting_deliveries_total",
+	"Passport configuration handed to the owner backend on TO2.HelloDevice by outcome (delivered, failed).",
+	"outcome")
+
+// Kitting delivers the configuration records of a device's product item
+// passport to the owner backend as owner ServiceInfo before the device's
+// TO2 reaches it. The product ID comes from the device's DI, so only
+// devices whose DI ran through this proxy are kitted. It is a typed
+// handler, installed with proxy.NewDispatcher.
+type Kitting struct {
+	ledgerClient proxy.LedgerClient
+	client       *kitting.Client
+	required     bool
+}
+
+// NewKitting creates the middleware. With required set, a device whose
+// configuration cannot be delivered is refused, so that it retries TO2
+// rather than onboarding without it.
+func NewKitting(ledgerClient proxy.LedgerClient, client *kitting.Client, required bool) *Kitting {
+	return &Kitting{ledgerClient: ledgerClient, client: client, required: required}
+}
+
+// OnTO2HelloDevice implements proxy.TO2HelloDeviceHandler. It returns
+// *proxy.RejectError only when delivery is required and failed.
+func (k *Kitting) OnTO2HelloDevice(ctx context.Context, sc *proxy.SessionContext, hello *fdo.HelloDevice, msg *proxy.Message) error {
+	if hello == nil {
+		return nil
+	}
+	v, _ := sc.DeviceGet(DeviceProductID)
+	productID, _ := v.(string)
+	if productID == "" {
+		return nil
+	}
+	guid := hello.GUID.String()
+
+	passport, err := k.ledgerClient.GetProductItemPassport(ctx, productID)
+	if errors.Is(err, ledger.ErrPassportNotFound) {
+		return nil
+	}
+	if err != nil {
+		return k.failed(ctx, guid, fmt.Errorf("product passport: %w", err))
+	}
+	items, invalid := kitting.FromPassport(passport)
+	if len(invalid) > 0 {
+		slog.Warn("Skipping unusable passport configuration records", "guid", guid, "product_id", productID, "records", invalid)
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	if err := k.client.Deliver(ctx, guid, items); err != nil {
+		return k.failed(ctx, guid, err)
+	}
+	kittingDeliveries.Inc("delivered")
+	slog.Info("Delivered passport configuration to owner backend", "guid", guid, "product_id", productID, "service_info", len(items))
+	return nil
+}
+
+// failed records a delivery failure and applies the failure policy.
+func (k *Kitting) failed(ctx context.Context, guid string, err error) error {
+	kittingDeliveries.Inc("failed")
+	slog.Warn("Failed to deliver passport configuration", "guid", guid, "request_id", correlation.RequestID(ctx), "required", k.required, "error", err)
+	if !k.required {
+		return nil
+	}
+	return &proxy.RejectError{
+		Status: http.StatusServiceUnavailable,
+		Err:    fmt.Errorf("kitting for %s: %w", guid, err),
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import "github.com/fdo-server-wrapper/internal/metrics"
+
+var onboardings = metrics.Default.NewCounterVec(
+	"fdo_proxy_onboardings_total",
+	"Onboarding exchanges seen through the proxy by protocol (di, to2) and outcome (succeeded, failed).",
+	"protocol", "outcome")
+
+var duplicateSerials = metrics.Default.NewCounterVec(
+	"fdo_proxy_di_duplicate_serials_total",
+	"DI.AppStart messages for serial numbers that already completed DI, by action (flagged, blocked).",
+	"action")
+
+var guidReuse = metrics.Default.NewCounterVec(
+	"fdo_proxy_guid_reuse_total",
+	"TO2.HelloDevice messages for GUIDs already in flight from another source (concurrent) or already onboarded (after_onboarding).",
+	"kind")
+
+var taggedOnboardings = metrics.Default.NewCounterVec(
+	"fdo_proxy_tagged_onboardings_total",
+	"Onboarding exchanges of tagged devices by tag, protocol (di, to2) and outcome (succeeded, failed).",
+	"tag", "protocol", "outcome")
+
+// countOnboarding counts an onboarding exchange, and once more under each of
+// the device's tags.
+func countOnboarding(protocol, outcome string, tags []string) {
+	onboardings.Inc(protocol, outcome)
+	for _, t := range tags {
+		taggedOnboardings.Inc(t, protocol, outcome)
+	}
+}
+
+var policyActions = metrics.Default.NewCounterVec(
+	"fdo_proxy_policy_actions_total",
+	"Departures from the proxy defaults made by tag-scoped policies, by policy and action (rate_limited, outside_window, geofence_flagged, geofence_rejected, passport_refused, passport_skipped, attestation_skipped, commissioning_skipped, commissioning_redirected).",
+	"policy", "action")
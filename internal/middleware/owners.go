@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"github.com/fdo-server-wrapper/internal/owners"
+	"github.com/fdo-server-wrapper/internal/proxy"
+)
+
+// OwnerHeader carries the owner assigned to a device on the TO2.HelloDevice
+// request forwarded to the backend, so a multi-tenant owner backend can
+// pick the tenant's vouchers and keys.
+const OwnerHeader = "X-FDO-Owner-ID"
+
+// resolveOwner picks the owner for a device: an owner map entry, then the
+// owner named by its product item passport during DI, then fallback.
+func resolveOwner(m *owners.Map, sc *proxy.SessionContext, guid, serial, productID, fallback string) string {
+	if owner, ok := m.Lookup(guid, serial, productID); ok {
+		return owner
+	}
+	if v, ok := sc.DeviceGet(DeviceOwnerID); ok {
+		if owner, _ := v.(string); owner != "" {
+			return owner
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/ledger"
+)
+
+// PassportRecordClient appends records to product item passports.
+type PassportRecordClient interface {
+	AppendRecord(ctx context.Context, uuid string, rec ledger.ProductItemRecord) (*ledger.ProductItemPassport, error)
+}
+
+// LedgerPassportRecordSink appends a ledger.DescriptorDICompleted record
+// to the product item passport of every device completing DI with a
+// product UUID; other devices are skipped. It implements events.Sink.
+type LedgerPassportRecordSink struct {
+	client PassportRecordClient
+}
+
+// NewLedgerPassportRecordSink creates a sink appending through c.
+func NewLedgerPassportRecordSink(c PassportRecordClient) *LedgerPassportRecordSink {
+	return &LedgerPassportRecordSink{client: c}
+}
+
+// Name implements events.Sink.
+func (p *LedgerPassportRecordSink) Name() string { return "passport_records" }
+
+// Publish implements events.Sink.
+func (p *LedgerPassportRecordSink) Publish(ctx context.Context, ev *events.Event) error {
+	if ev.Type != events.Initialized {
+		return nil
+	}
+	// Without a product UUID from DeviceMfgInfo there is no passport of
+	// the device's own to append to
+	if _, err := fdo.ParseGUID(ev.ProductID); err != nil {
+		return nil
+	}
+	_, err := p.client.AppendRecord(ctx, ev.ProductID, ledger.ProductItemRecord{
+		Descriptor: ledger.DescriptorDICompleted,
+		Event: &ledger.ProductItemEvent{
+			Type:      "di_completed",
+			GUID:      ev.GUID,
+			Serial:    ev.Serial,
+			OwnerID:   ev.OwnerID,
+			Timestamp: fmt.Sprintf("%d", ev.Time.UnixNano()),
+		},
+	})
+	return err
+}
@@ -0,0 +1,297 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/metrics"
+	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/session"
+)
+
+var payloadTransfers = metrics.Default.NewCounterVec(
+	"fdo_proxy_payload_transfers_total",
+	"Files delivered through fdo.download and fdo.wget by module and verification (verified, mismatch, unlisted, unverified, failed).",
+	"module", "verification")
+
+// PayloadVerifier follows fdo.download and fdo.wget transfers in readable
+// TO2 ServiceInfo and, once the device reports a transfer done, checks the
+// file's digest against the artifacts its product item passport lists. For
+// fdo.download the data relayed is hashed too, so a payload that differs
+// from the digest the owner announced is caught. Results are recorded in
+// the session for the commissioning passport. It is a typed handler,
+// installed with proxy.NewDispatcher.
+type PayloadVerifier struct {
+	sessions     *session.Store
+	ledgerClient proxy.LedgerClient
+	fail         bool
+	events       *events.Bus
+}
+
+// NewPayloadVerifier creates the middleware. Expected digests come from
+// ledgerClient, which may be nil to only compare relayed data with the
+// owner's digest. With fail set, a mismatch refuses the device's message
+// reporting the transfer done, so the device does not complete TO2;
+// otherwise mismatches are flagged only.
+func NewPayloadVerifier(sessions *session.Store, ledgerClient proxy.LedgerClient, fail bool) *PayloadVerifier {
+	return &PayloadVerifier{sessions: sessions, ledgerClient: ledgerClient, fail: fail}
+}
+
+// EnableEvents publishes a failure event to bus for every device refused
+// over a mismatch.
+func (v *PayloadVerifier) EnableEvents(bus *events.Bus) {
+	v.events = bus
+}
+
+// payloadState is what the verifier keeps in the session context between
+// ServiceInfo messages.
+type payloadState struct {
+	// expected maps artifact names to digests, once looked up
+	expected map[string]string
+	looked   bool
+	// data hashes the current fdo.download file; seen counts its bytes
+	// and missed is set once a message could not be read
+	data   hash.Hash
+	seen   int64
+	missed bool
+}
+
+const payloadStateKey = "payloads.state"
+
+func payloadStateFrom(sc *proxy.SessionContext) *payloadState {
+	if v, ok := sc.Get(payloadStateKey); ok {
+		return v.(*payloadState)
+	}
+	st := &payloadState{}
+	sc.Set(payloadStateKey, st)
+	return st
+}
+
+// OnTO2ServiceInfo implements proxy.TO2ServiceInfoHandler. It returns
+// *proxy.RejectError when a mismatch is found in fail mode.
+func (v *PayloadVerifier) OnTO2ServiceInfo(ctx context.Context, sc *proxy.SessionContext, kvs []fdo.ServiceInfoKV, msg *proxy.Message) error {
+	token := fdo.SessionToken(msg.Request.Header)
+	if token == "" {
+		return nil
+	}
+	st := payloadStateFrom(sc)
+	if msg.DecodeErr != nil {
+		// Encrypted or streamed past the inspection limit: data may be missed
+		st.missed = true
+		return nil
+	}
+
+	// Look up the expected digests before taking the session store lock
+	if msg.Type == fdo.MsgTO2DeviceServiceInfo && finishesTransfer(kvs) {
+		v.lookupExpected(ctx, sc, st)
+	}
+
+	var mismatched []session.Transfer
+	v.sessions.Upsert(token, "to2", func(s *session.Session) {
+		for _, kv := range kvs {
+			if !fdo.IsTransfer(kv) {
+				continue
+			}
+			if msg.Type == fdo.MsgTO2OwnerServiceInfo {
+				st.owner(currentTransfer(s, kv.Module()), kv)
+				continue
+			}
+			if !finishes(kv) {
+				continue
+			}
+			t := currentTransfer(s, kv.Module())
+			finishTransfer(t, kv)
+			st.verify(t)
+			payloadTransfers.Inc(t.Module, t.Verification)
+			slog.Info("Payload transfer finished",
+				"guid", s.GUID,
+				"module", t.Module,
+				"name", t.Name,
+				"device_result", t.DeviceResult,
+				"verification", t.Verification)
+			if t.Verification == session.TransferMismatch {
+				mismatched = append(mismatched, *t)
+			}
+		}
+	})
+	if len(mismatched) == 0 {
+		return nil
+	}
+
+	s, _ := v.sessions.Get(token)
+	var names []string
+	for _, t := range mismatched {
+		names = append(names, fmt.Sprintf("%s %q (announced %s, expected %s, observed %s)",
+			t.Module, t.Name, t.AnnouncedSHA384, t.ExpectedSHA384, t.ObservedSHA384))
+	}
+	reason := "payload digest mismatch: " + strings.Join(names, "; ")
+	guid := sc.GUID()
+	if s != nil {
+		guid = s.GUID
+	}
+	slog.Warn("Delivered payload does not match", "guid", guid, "request_id", correlation.RequestID(ctx), "fail", v.fail, "reason", reason)
+	if !v.fail {
+		return nil
+	}
+	if s != nil {
+		v.refused(ctx, s, reason)
+	}
+	return &proxy.RejectError{
+		Status: http.StatusForbidden,
+		Err:    fmt.Errorf("device %s: %s", guid, reason),
+	}
+}
+
+// finishesTransfer reports whether kvs has a device message finishing an
+// fdo.download or fdo.wget transfer.
+func finishesTransfer(kvs []fdo.ServiceInfoKV) bool {
+	for _, kv := range kvs {
+		if fdo.IsTransfer(kv) && finishes(kv) {
+			return true
+		}
+	}
+	return false
+}
+
+// finishes reports whether the device message kv ends a transfer.
+func finishes(kv fdo.ServiceInfoKV) bool {
+	return kv.Message() == "done" || kv.Message() == "error"
+}
+
+// currentTransfer returns the transfer of module the device has not
+// finished yet, starting one if there is none.
+func currentTransfer(s *session.Session, module string) *session.Transfer {
+	for i := len(s.Transfers) - 1; i >= 0; i-- {
+		if s.Transfers[i].Module == module && !s.Transfers[i].Done {
+			return &s.Transfers[i]
+		}
+	}
+	s.Transfers = append(s.Transfers, session.Transfer{Module: module, Verification: session.TransferPending})
+	return &s.Transfers[len(s.Transfers)-1]
+}
+
+// owner records an owner message about t.
+func (st *payloadState) owner(t *session.Transfer, kv fdo.ServiceInfoKV) {
+	switch kv.Message() {
+	case "name":
+		t.Name, _ = kv.Text()
+	case "url":
+		t.URL, _ = kv.Text()
+	case "length":
+		t.Length, _ = kv.Int()
+	case "sha-384":
+		t.AnnouncedSHA384 = kv.HexDigest()
+	case "data":
+		if t.Module != fdo.DownloadModule {
+			return
+		}
+		if st.data == nil {
+			st.data = sha512.New384()
+		}
+		b := kv.Bytes()
+		st.data.Write(b)
+		st.seen += int64(len(b))
+	}
+}
+
+// finishTransfer records the device message kv finishing t.
+func finishTransfer(t *session.Transfer, kv fdo.ServiceInfoKV) {
+	if kv.Message() == "error" {
+		t.Error, _ = kv.Text()
+		t.DeviceResult = -1
+	} else {
+		t.DeviceResult, _ = kv.Int()
+	}
+	t.Done = true
+}
+
+// verify sets t's verification once the device finished it, and resets the
+// download hash for the next file.
+func (st *payloadState) verify(t *session.Transfer) {
+	if t.Module == fdo.DownloadModule {
+		if st.data != nil && !st.missed && (t.Length == 0 || st.seen == t.Length) {
+			t.ObservedSHA384 = hex.EncodeToString(st.data.Sum(nil))
+		}
+		st.data, st.seen, st.missed = nil, 0, false
+	}
+	t.ExpectedSHA384 = st.expected[t.Name]
+
+	digest := t.ObservedSHA384
+	if digest == "" {
+		digest = t.AnnouncedSHA384
+	}
+	switch {
+	case t.DeviceResult < 0 || t.Error != "":
+		t.Verification = session.TransferFailed
+	case t.ObservedSHA384 != "" && t.AnnouncedSHA384 != "" && !strings.EqualFold(t.ObservedSHA384, t.AnnouncedSHA384):
+		t.Verification = session.TransferMismatch
+	case t.ExpectedSHA384 == "":
+		t.Verification = session.TransferUnlisted
+	case digest == "":
+		t.Verification = session.TransferUnverified
+	case strings.EqualFold(digest, t.ExpectedSHA384):
+		t.Verification = session.TransferVerified
+	default:
+		t.Verification = session.TransferMismatch
+	}
+}
+
+// lookupExpected loads the artifact digests listed by the device's product
+// item passport into st, once per session.
+func (v *PayloadVerifier) lookupExpected(ctx context.Context, sc *proxy.SessionContext, st *payloadState) {
+	if st.looked || v.ledgerClient == nil {
+		return
+	}
+	st.looked = true
+	val, _ := sc.DeviceGet(DeviceProductID)
+	productID, _ := val.(string)
+	if productID == "" {
+		return
+	}
+	passport, err := v.ledgerClient.GetProductItemPassport(ctx, productID)
+	if err != nil {
+		if !errors.Is(err, ledger.ErrPassportNotFound) {
+			slog.Warn("Could not look up expected payload digests", "product_id", productID, "error", err)
+		}
+		return
+	}
+	st.expected = make(map[string]string)
+	for _, r := range passport.Records {
+		if a := r.Artifact; a != nil && a.Name != "" && a.SHA384 != "" {
+			st.expected[a.Name] = strings.ToLower(a.SHA384)
+		}
+	}
+}
+
+// refused publishes a TO2 session stopped over a payload mismatch and drops
+// it.
+func (v *PayloadVerifier) refused(ctx context.Context, s *session.Session, reason string) {
+	countOnboarding("to2", "failed", s.Tags)
+	v.sessions.Delete(s.Token)
+	v.events.Publish(ctx, &events.Event{
+		Type:        events.Failed,
+		GUID:        s.GUID,
+		OwnerID:     s.OwnerID,
+		Time:        time.Now(),
+		RequestID:   correlation.RequestID(ctx),
+		Session:     s,
+		Protocol:    "to2",
+		FailureKind: ledger.FailurePayloadMismatch,
+		Stage:       fdo.MsgTO2DeviceServiceInfo,
+		ProductID:   s.ProductID,
+		Tags:        s.Tags,
+		Reason:      reason,
+	})
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/policy"
+	"github.com/fdo-server-wrapper/internal/proxy"
+)
+
+// admitPolicy applies the rate limit and onboarding windows of policy p to
+// a device starting protocol at now. Devices it refuses are told to retry
+// and are not counted as failed onboardings. With enforces set, the device
+// is about to go through a step p's enforcement windows cover, and is
+// refused outside them too.
+func admitPolicy(ctx context.Context, p *policy.Policy, protocol string, now time.Time, enforces bool) error {
+	if p == nil {
+		return nil
+	}
+	scope := policy.WindowOnboarding
+	if !p.Closed(now, scope) && enforces {
+		scope = policy.WindowEnforcement
+	}
+	if p.Closed(now, scope) {
+		policyActions.Inc(p.Name, "outside_window")
+		slog.Warn("Onboarding outside policy window",
+			"policy", p.Name,
+			"protocol", protocol,
+			"scope", scope,
+			"request_id", correlation.RequestID(ctx))
+		return &proxy.RejectError{
+			Status: http.StatusServiceUnavailable,
+			Code:   fdo.CodeInternalServerError,
+			Err:    fmt.Errorf("policy %s: %s outside %s window", p.Name, protocol, scope),
+		}
+	}
+	if !p.Allow(ctx) {
+		policyActions.Inc(p.Name, "rate_limited")
+		return &proxy.RejectError{
+			Status: http.StatusTooManyRequests,
+			Code:   fdo.CodeInternalServerError,
+			Err:    fmt.Errorf("policy %s: %s rate limit exceeded", p.Name, protocol),
+		}
+	}
+	return nil
+}
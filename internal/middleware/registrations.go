@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/ledger"
+)
+
+// RegistrationClient posts rendezvous registration records to the passport
+// service.
+type RegistrationClient interface {
+	RecordRegistration(ctx context.Context, rec *ledger.RegistrationRecord) error
+}
+
+// LedgerRegistrationSink records devices registered at the rendezvous
+// server in the passport service. It implements events.Sink.
+type LedgerRegistrationSink struct {
+	client RegistrationClient
+}
+
+// NewLedgerRegistrationSink creates a sink posting to c.
+func NewLedgerRegistrationSink(c RegistrationClient) *LedgerRegistrationSink {
+	return &LedgerRegistrationSink{client: c}
+}
+
+// Name implements events.Sink.
+func (r *LedgerRegistrationSink) Name() string { return "ledger_registrations" }
+
+// Publish implements events.Sink.
+func (r *LedgerRegistrationSink) Publish(ctx context.Context, ev *events.Event) error {
+	if ev.Type != events.Registered {
+		return nil
+	}
+	return r.client.RecordRegistration(ctx, &ledger.RegistrationRecord{
+		ControllerUUID: ev.GUID,
+		OwnerID:        ev.OwnerID,
+		WaitSeconds:    ev.WaitSeconds,
+		Timestamp:      fmt.Sprintf("%d", ev.Time.UnixNano()),
+	})
+}
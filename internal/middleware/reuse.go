@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/session"
+	"github.com/fdo-server-wrapper/internal/store"
+)
+
+// GUID reuse kinds counted in fdo_proxy_guid_reuse_total.
+const (
+	// ReuseConcurrent is a HelloDevice for a GUID that already has a TO2
+	// session in flight from another source address.
+	ReuseConcurrent = "concurrent"
+	// ReuseAfterOnboarding is a HelloDevice for a GUID that already
+	// completed TO2.
+	ReuseAfterOnboarding = "after_onboarding"
+)
+
+// EnableReuseDetection flags a TO2.HelloDevice whose GUID is already in
+// flight from another source, or, when history is set, already completed
+// TO2. Either can mean a cloned voucher; re-onboarding after a reset looks
+// the same, so devices are not refused.
+func (m *TO2Middleware) EnableReuseDetection(history store.Store) {
+	m.detectReuse = true
+	m.history = history
+}
+
+// checkReuse looks for other uses of the GUID in s. Sessions are visible
+// once the backend has answered their HelloDevice.
+func (m *TO2Middleware) checkReuse(ctx context.Context, s *session.Session) {
+	requestID := correlation.RequestID(ctx)
+
+	for _, o := range m.sessions.List() {
+		if o.Protocol != "to2" || o.GUID != s.GUID || o.RemoteAddr == s.RemoteAddr {
+			continue
+		}
+		guidReuse.Inc(ReuseConcurrent)
+		slog.Warn("Possible voucher cloning: GUID in flight from another source",
+			"guid", s.GUID,
+			"remote_addr", s.RemoteAddr,
+			"other_remote_addr", o.RemoteAddr,
+			"other_started_at", o.StartedAt,
+			"request_id", requestID)
+		break
+	}
+
+	if m.history == nil {
+		return
+	}
+	var last *store.Record
+	err := m.history.Each(ctx, store.Query{GUID: s.GUID}, func(r *store.Record) error {
+		if r.Outcome == store.OutcomeSucceeded && r.Protocol == "to2" {
+			last = r
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Warn("Could not check onboarding history", "guid", s.GUID, "error", err)
+		return
+	}
+	if last == nil {
+		return
+	}
+	guidReuse.Inc(ReuseAfterOnboarding)
+	slog.Warn("Possible voucher cloning: GUID already onboarded",
+		"guid", s.GUID,
+		"remote_addr", s.RemoteAddr,
+		"onboarded_at", last.CompletedAt.Format(time.RFC3339),
+		"onboarded_from", last.RemoteAddr,
+		"request_id", requestID)
+}
@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/metrics"
+	"github.com/fdo-server-wrapper/internal/proxy"
+)
+
+var scrubbedResponses = metrics.Default.NewCounterVec(
+	"fdo_proxy_scrubbed_responses_total",
+	"Backend responses stripped of identifying headers (headers) or of a stack trace in their error body (stack_trace).",
+	"what")
+
+// identifyingHeaders name the software, framework or runtime serving a
+// response.
+var identifyingHeaders = []string{
+	"Server",
+	"X-Powered-By",
+	"X-AspNet-Version",
+	"X-AspNetMvc-Version",
+	"X-Runtime",
+	"X-Version",
+	"X-Generator",
+	"X-Backend-Server",
+}
+
+// stackTrace matches the traces Go, Java, .NET and Python servers put in
+// error responses when they fail.
+var stackTrace = regexp.MustCompile(`goroutine \d+ \[|panic: |\.go:\d+|\n\s+at [\w$.<>]+\(|Traceback \(most recent call last\)|File "[^"]+", line \d+`)
+
+// maxScrubBody is the largest error body searched for a stack trace; larger
+// bodies pass through untouched.
+const maxScrubBody = 64 << 10
+
+// ResponseScrubber removes what backend responses reveal about the backend
+// implementation before they leave the proxy: identifying headers such as
+// Server and X-Powered-By, and stack traces in error bodies.
+type ResponseScrubber struct {
+	remove []string
+	server string
+	traces bool
+}
+
+// NewResponseScrubber creates middleware that deletes identifyingHeaders
+// and the extra headers from every response and, if server is set, sends it
+// as the Server header instead. With traces, an error response whose body
+// holds a stack trace has it replaced: an FDO ErrorMessage keeps its code
+// and correlation ID but gets a generic error string, any other body
+// becomes the status text.
+func NewResponseScrubber(extra []string, server string, traces bool) (*ResponseScrubber, error) {
+	if err := checkProtected(extra); err != nil {
+		return nil, err
+	}
+	remove := append(append([]string(nil), identifyingHeaders...), extra...)
+	return &ResponseScrubber{remove: remove, server: server, traces: traces}, nil
+}
+
+// ProcessRequest leaves requests untouched.
+func (s *ResponseScrubber) ProcessRequest(ctx context.Context, sc *proxy.SessionContext, req *http.Request) error {
+	return nil
+}
+
+// ProcessResponse scrubs resp.
+func (s *ResponseScrubber) ProcessResponse(ctx context.Context, sc *proxy.SessionContext, resp *http.Response) error {
+	scrubbed := false
+	for _, name := range s.remove {
+		if _, ok := resp.Header[http.CanonicalHeaderKey(name)]; ok {
+			resp.Header.Del(name)
+			scrubbed = true
+		}
+	}
+	if scrubbed {
+		scrubbedResponses.Inc("headers")
+	}
+	if s.server != "" {
+		resp.Header.Set("Server", s.server)
+	}
+
+	isError := resp.Header.Get("Message-Type") == strconv.Itoa(fdo.MsgError)
+	if !s.traces || (!isError && resp.StatusCode < 400) {
+		return nil
+	}
+	// Compressed bodies cannot be searched, and large ones are not errors
+	// a server writes by hand
+	if resp.Body == nil || resp.Header.Get("Content-Encoding") != "" || resp.ContentLength > maxScrubBody {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxScrubBody+1))
+	if err != nil {
+		return fmt.Errorf("read error body: %w", err)
+	}
+	if len(body) > maxScrubBody {
+		resp.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	requestID := correlation.RequestID(ctx)
+	generic := fmt.Sprintf("%s (request %s)", http.StatusText(resp.StatusCode), requestID)
+	if isError {
+		msg, err := fdo.DecodeErrorMessage(body)
+		if err != nil || !stackTrace.MatchString(msg.Message) {
+			return nil
+		}
+		slog.Warn("Stack trace scrubbed from backend ErrorMessage", "request_id", requestID, "status", resp.StatusCode, "error", msg.String())
+		msg.Message = generic
+		proxy.ReplaceResponseBody(resp, fdo.EncodeErrorMessage(msg))
+	} else {
+		if !stackTrace.Match(body) {
+			return nil
+		}
+		slog.Warn("Stack trace scrubbed from backend error response", "request_id", requestID, "status", resp.StatusCode, "body", string(body))
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		proxy.ReplaceResponseBody(resp, []byte(generic+"\n"))
+	}
+	scrubbedResponses.Inc("stack_trace")
+	return nil
+}
+
+// prefixedBody is a body whose start was read ahead.
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
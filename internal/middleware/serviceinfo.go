@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/session"
+)
+
+// ServiceInfoObserver records which FSIM modules are exercised during TO2
+// (fdo.download, fdo.wget, custom modules) and how much data each carries.
+// Results are stored per session for the admin API and passport enrichment.
+type ServiceInfoObserver struct {
+	sessions *session.Store
+}
+
+// NewServiceInfoObserver creates middleware that observes TO2 ServiceInfo.
+func NewServiceInfoObserver(sessions *session.Store) *ServiceInfoObserver {
+	return &ServiceInfoObserver{sessions: sessions}
+}
+
+// OnTO2ServiceInfo implements proxy.TO2ServiceInfoHandler, recording
+// TO2.DeviceServiceInfo (msg type 68) and TO2.OwnerServiceInfo (msg type 69)
+// for the session.
+func (o *ServiceInfoObserver) OnTO2ServiceInfo(ctx context.Context, sc *proxy.SessionContext, kvs []fdo.ServiceInfoKV, msg *proxy.Message) error {
+	token := fdo.SessionToken(msg.Request.Header)
+	if token == "" {
+		return nil
+	}
+	err := msg.DecodeErr
+	if err != nil && !errors.Is(err, fdo.ErrEncrypted) && !msg.Truncated {
+		slog.Debug("Could not decode ServiceInfo", "msg_type", msg.Type, "error", err)
+	}
+
+	// A message streamed past the inspection limit counts in full
+	size := int(msg.Size)
+	if size < 0 {
+		size = len(msg.Body)
+	}
+	o.sessions.Upsert(token, "to2", func(s *session.Session) {
+		if msg.Type == fdo.MsgTO2DeviceServiceInfo {
+			s.ServiceInfo.DeviceMessages++
+			s.ServiceInfo.DeviceBytes += size
+		} else {
+			s.ServiceInfo.OwnerMessages++
+			s.ServiceInfo.OwnerBytes += size
+		}
+		if errors.Is(err, fdo.ErrEncrypted) {
+			s.ServiceInfo.Encrypted = true
+			return
+		}
+		for _, kv := range kvs {
+			s.RecordModule(kv.Module(), len(kv.Value))
+		}
+	})
+	return nil
+}
@@ -2,161 +2,674 @@ package middleware
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
-	"strings"
+	"net/netip"
 	"time"
 
+	"github.com/fdo-server-wrapper/internal/attest"
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/geo"
 	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/owners"
+	"github.com/fdo-server-wrapper/internal/policy"
 	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/quarantine"
+	"github.com/fdo-server-wrapper/internal/session"
+	"github.com/fdo-server-wrapper/internal/store"
+	"github.com/fdo-server-wrapper/internal/tags"
+	"github.com/fdo-server-wrapper/internal/vc"
 )
 
 // TO2Middleware intercepts TO2 protocol messages to create commissioning passports.
-// It tracks device onboarding completion and records commissioning events.
+// It tracks device onboarding completion and records commissioning events,
+// enriched with the evidence observed over the session. It is a set of typed
+// handlers, installed with proxy.NewDispatcher.
 type TO2Middleware struct {
 	ledgerClient proxy.LedgerClient
 	ownerID      string
+	sessions     *session.Store
+	verifier     attest.Verifier
+	failOpen     bool
+	issuer       *vc.Issuer
+	events       *events.Bus
+	quarantine   *quarantine.List
+	detectReuse  bool
+	history      store.Store
+	owners       *owners.Map
+	tags         *tags.Tagger
+	policies     *policy.Set
+	geo          geo.DB
 }
 
 // NewTO2Middleware creates middleware for TO2 protocol integration.
 // When configured, it will create commissioning passports upon successful device onboarding.
-func NewTO2Middleware(ledgerClient proxy.LedgerClient, ownerID string) *TO2Middleware {
+// Session state is kept in sessions so it can be inspected elsewhere.
+func NewTO2Middleware(ledgerClient proxy.LedgerClient, ownerID string, sessions *session.Store) *TO2Middleware {
 	return &TO2Middleware{
 		ledgerClient: ledgerClient,
 		ownerID:      ownerID,
+		sessions:     sessions,
 	}
 }
 
-// ProcessRequest handles incoming TO2 protocol requests.
-//
-// Contract:
-//
-//	Preconditions:
-//	  - req is not nil and contains valid HTTP request
-//	  - ctx is not nil
-//
-//	Postconditions:
-//	  - Returns nil if request is not TO2-related or processing succeeds
-//	  - Returns error if request processing fails (does not interrupt FDO flow)
-//
-//	Integration Points:
-//	  - TO2.HelloDevice (msg type 60): logs device hello for tracking
-func (m *TO2Middleware) ProcessRequest(ctx context.Context, req *http.Request) error {
-	// Only process TO2 protocol requests
-	if !m.isTO2Request(req) {
+// EnableVerification has v vet the attestation in every TO2.ProveDevice
+// before it is forwarded. Explicit rejections always stop the device; when
+// failOpen is set, verifier errors let the device proceed.
+func (m *TO2Middleware) EnableVerification(v attest.Verifier, failOpen bool) {
+	m.verifier = v
+	m.failOpen = failOpen
+}
+
+// EnableCredentials has issuer sign a Verifiable Credential for every device
+// completing TO2. The credential is sent with the commissioning passport.
+func (m *TO2Middleware) EnableCredentials(issuer *vc.Issuer) {
+	m.issuer = issuer
+}
+
+// EnableEvents publishes a commissioning event to bus for every device
+// completing TO2.
+func (m *TO2Middleware) EnableEvents(bus *events.Bus) {
+	m.events = bus
+}
+
+// EnableOwnerMap assigns devices to owners from m, ahead of the owner
+// named by the product item passport and the global owner ID.
+func (m *TO2Middleware) EnableOwnerMap(owners *owners.Map) {
+	m.owners = owners
+}
+
+// EnableTags tags devices through t, on top of the tags their product item
+// passport lists.
+func (m *TO2Middleware) EnableTags(t *tags.Tagger) {
+	m.tags = t
+}
+
+// EnablePolicies applies the policy of s matching each device's tags or
+// owner to its TO2: its rate limit, windows, attestation verification and
+// commissioning passport.
+func (m *TO2Middleware) EnablePolicies(s *policy.Set) {
+	m.policies = s
+}
+
+// EnableGeoIP locates every device starting TO2 in db, for the sessions
+// view, policy geofences, lifecycle events and the commissioning passport's
+// deployed location.
+func (m *TO2Middleware) EnableGeoIP(db geo.DB) {
+	m.geo = db
+}
+
+// EnableQuarantine refuses TO2.HelloDevice from every device on l.
+func (m *TO2Middleware) EnableQuarantine(l *quarantine.List) {
+	m.quarantine = l
+}
+
+// OnTO2HelloDevice implements proxy.TO2HelloDeviceHandler, starting to
+// track the session (GUID, cipher suites) and assigning the device's owner,
+// which is passed to the backend in OwnerHeader, and tags. The session is parked
+// until the backend's response reveals the session token. Quarantined
+// devices, and devices over their policy's rate limit, outside its windows
+// or, if it rejects them, outside its geofence, are refused with
+// *proxy.RejectError; GUIDs already in use or onboarded are flagged when
+// reuse detection is enabled, as are devices outside a flagging geofence.
+func (m *TO2Middleware) OnTO2HelloDevice(ctx context.Context, sc *proxy.SessionContext, hello *fdo.HelloDevice, msg *proxy.Message) error {
+	// Never forward an owner the device chose itself
+	msg.Request.Header.Del(OwnerHeader)
+	if hello == nil {
+		slog.Warn("Could not decode TO2.HelloDevice", "error", msg.DecodeErr)
 		return nil
 	}
 
-	// Parse message type from URL path: /fdo/101/msg/{msgType}
-	pathParts := strings.Split(req.URL.Path, "/")
-	if len(pathParts) < 5 {
-		return nil
+	slog.Info("TO2.HelloDevice request received", "guid", hello.GUID.String())
+	if e, ok := m.quarantine.Get(hello.GUID.String()); ok {
+		return &proxy.RejectError{
+			Status: http.StatusForbidden,
+			Code:   fdo.CodeInvalidGUID,
+			Err:    fmt.Errorf("device %s quarantined since %s: %s", e.GUID, e.Since.Format(time.RFC3339), e.Reason),
+		}
 	}
 
-	msgType := pathParts[4]
-	if msgType == "60" { // TO2.HelloDevice message
-		return m.handleTO2HelloDevice(ctx, req)
+	s := &session.Session{
+		Protocol:    "to2",
+		GUID:        hello.GUID.String(),
+		StartedAt:   time.Now(),
+		HelloNonce:  hex.EncodeToString(hello.Nonce),
+		RemoteAddr:  remoteIP(msg.Request),
+		KexSuite:    hello.KexSuite,
+		CipherSuite: fdo.CipherSuiteName(hello.CipherSuite),
+	}
+	if hello.SigType != 0 {
+		// eASigInfo announces the attestation type; ProveDevice confirms it
+		s.Attestation = &session.Attestation{
+			Type:      fdo.AttestationType(hello.SigType),
+			Algorithm: fdo.SigAlgName(hello.SigType),
+		}
+	}
+	// Pick up what DI left for the device, if it ran through this proxy
+	sc.SetGUID(s.GUID)
+	if v, ok := sc.DeviceGet(DeviceSerial); ok {
+		s.Serial, _ = v.(string)
+	}
+	if v, ok := sc.DeviceGet(DeviceProductID); ok {
+		s.ProductID, _ = v.(string)
+	}
+	s.OwnerID = resolveOwner(m.owners, sc, s.GUID, s.Serial, s.ProductID, m.ownerID)
+	if s.OwnerID != "" {
+		msg.Request.Header.Set(OwnerHeader, s.OwnerID)
+	}
+	v, _ := sc.DeviceGet(DeviceTags)
+	passportTags, _ := v.([]string)
+	s.Tags = m.tags.For(s.GUID, s.Serial, s.ProductID, passportTags)
+	addr, _ := netip.ParseAddr(s.RemoteAddr)
+	if loc, ok := geo.Lookup(m.geo, addr); ok {
+		s.Location = &loc
+	}
+	if p := m.policies.For(s.Tags, s.OwnerID); p != nil {
+		if err := admitPolicy(ctx, p, "to2", time.Now(), m.verifier != nil && !p.SkipsAttestation()); err != nil {
+			return err
+		}
+		s.Policy = p.Name
+		if p.Outside(addr, country(s.Location)) {
+			if err := m.outsideGeofence(ctx, p, s); err != nil {
+				return err
+			}
+		}
+	}
+	if m.detectReuse {
+		m.checkReuse(ctx, s)
 	}
 
+	sc.Set(to2Hello, s)
 	return nil
 }
 
-// ProcessResponse handles outgoing TO2 protocol responses.
-//
-// Contract:
-//
-//	Preconditions:
-//	  - resp is not nil and contains valid HTTP response
-//	  - ctx is not nil
-//
-//	Postconditions:
-//	  - Returns nil if response is not TO2-related or processing succeeds
-//	  - Returns error if response processing fails (does not interrupt FDO flow)
-//
-//	Integration Points:
-//	  - TO2.Done2 (msg type 71): creates commissioning passport upon completion
-func (m *TO2Middleware) ProcessResponse(ctx context.Context, resp *http.Response) error {
-	// Only process TO2 protocol responses
-	if !m.isTO2Response(resp) {
+// outsideGeofence flags s, which started TO2 from outside the geofence of
+// its policy p, or with a rejecting geofence fails it and returns
+// *proxy.RejectError.
+func (m *TO2Middleware) outsideGeofence(ctx context.Context, p *policy.Policy, s *session.Session) error {
+	s.OutsideGeofence = true
+	action := "geofence_flagged"
+	if p.RejectsOutside() {
+		action = "geofence_rejected"
+	}
+	policyActions.Inc(p.Name, action)
+	slog.Warn("TO2 from outside policy geofence",
+		"guid", s.GUID,
+		"policy", p.Name,
+		"remote_addr", s.RemoteAddr,
+		"country", country(s.Location),
+		"action", action,
+		"request_id", correlation.RequestID(ctx))
+	if !p.RejectsOutside() {
+		return nil
+	}
+	reason := fmt.Sprintf("source outside geofence of policy %s", p.Name)
+	if c := country(s.Location); c != "" {
+		reason += " (located in " + c + ")"
+	}
+	m.sessionFailed(ctx, s, &events.Event{
+		FailureKind: ledger.FailureGeofence,
+		Stage:       fdo.MsgTO2HelloDevice,
+		Reason:      reason,
+	})
+	return &proxy.RejectError{
+		Status: http.StatusForbidden,
+		Code:   fdo.CodeInvalidIPAddress,
+		Err:    fmt.Errorf("%s: %s", s.GUID, reason),
+	}
+}
+
+// OnTO2ProveOVHdr implements proxy.TO2ProveOVHdrHandler. It binds the
+// parked HelloDevice to the session token the backend issued and records
+// voucher and owner key hashes.
+func (m *TO2Middleware) OnTO2ProveOVHdr(ctx context.Context, sc *proxy.SessionContext, hdr *fdo.ProveOVHdr, msg *proxy.Message) error {
+	s := parkedHello(sc)
+	token := sc.Token()
+	if s == nil || token == "" {
 		return nil
 	}
+	s.Token = token
 
-	// Extract message type from response headers
-	msgType := resp.Header.Get("Message-Type")
-	if msgType == "71" { // TO2.Done2 response
-		return m.handleTO2Done2(ctx, resp)
+	if hdr == nil {
+		slog.Warn("Could not decode TO2.ProveOVHdr", "guid", s.GUID, "error", msg.DecodeErr)
+	} else {
+		s.VoucherHash = fdo.Hash(hdr.OVHeader)
+		if len(hdr.OwnerPubKey) > 0 {
+			s.OwnerKeyHash = fdo.Hash(hdr.OwnerPubKey)
+		}
 	}
 
+	m.sessions.Put(s)
 	return nil
 }
 
-// isTO2Request identifies TO2 protocol requests by URL pattern.
-// TO2 requests follow the pattern /fdo/101/msg/60 or /fdo/101/msg/70.
-func (m *TO2Middleware) isTO2Request(req *http.Request) bool {
-	return strings.Contains(req.URL.Path, "/fdo/101/msg/") &&
-		(strings.HasSuffix(req.URL.Path, "/60") || strings.HasSuffix(req.URL.Path, "/70"))
+// OnTO2ProveDevice implements proxy.TO2ProveDeviceHandler. It records the
+// attestation evidence the device presents and, when a verifier is
+// configured and the device's policy does not skip it, asks it to vet that
+// evidence before the request reaches the backend, returning
+// *proxy.RejectError if verification stops the device.
+// The EAT signature itself is verified by the backend, not here.
+func (m *TO2Middleware) OnTO2ProveDevice(ctx context.Context, sc *proxy.SessionContext, pd *fdo.ProveDevice, msg *proxy.Message) error {
+	token := fdo.SessionToken(msg.Request.Header)
+	if token == "" && m.verifier == nil {
+		return nil
+	}
+	if pd == nil {
+		slog.Warn("Could not decode TO2.ProveDevice", "request_id", correlation.RequestID(ctx), "error", msg.DecodeErr)
+		return m.verificationUnavailable(fmt.Errorf("decode TO2.ProveDevice: %w", msg.DecodeErr))
+	}
+
+	var ev *attest.Evidence
+	m.sessions.Update(token, func(s *session.Session) {
+		a := s.Attestation
+		if a == nil {
+			a = &session.Attestation{}
+		}
+		if pd.Alg != 0 {
+			a.Type = fdo.AttestationType(pd.Alg)
+			a.Algorithm = fdo.SigAlgName(pd.Alg)
+		}
+		a.Nonce = hex.EncodeToString(pd.Nonce)
+		a.ClaimsDigest = pd.ClaimsDigest
+		s.Attestation = a
+
+		if g, ok := pd.GUID(); ok && g.String() != s.GUID {
+			slog.Warn("TO2.ProveDevice UEID does not match HelloDevice GUID", "guid", s.GUID, "ueid_guid", g.String())
+		}
+		slog.Info("TO2.ProveDevice attestation recorded",
+			"guid", s.GUID,
+			"type", a.Type,
+			"algorithm", a.Algorithm,
+			"claims_digest", a.ClaimsDigest)
+
+		ev = &attest.Evidence{
+			GUID:         s.GUID,
+			Type:         a.Type,
+			Algorithm:    a.Algorithm,
+			Nonce:        a.Nonce,
+			ClaimsDigest: a.ClaimsDigest,
+			Token:        msg.Body,
+		}
+	})
+
+	if m.verifier == nil {
+		return nil
+	}
+	if s, ok := m.sessions.Get(token); ok {
+		if p := m.policies.Named(s.Policy); p.SkipsAttestation() {
+			policyActions.Inc(p.Name, "attestation_skipped")
+			slog.Info("TO2.ProveDevice attestation check skipped by policy", "guid", s.GUID, "policy", p.Name)
+			return nil
+		}
+	}
+	if ev == nil {
+		return m.verificationUnavailable(errors.New("no TO2 session for ProveDevice"))
+	}
+
+	result, err := attest.Check(ctx, m.verifier, ev, m.failOpen)
+	m.sessions.Update(token, func(s *session.Session) {
+		s.Attestation.Verification = result
+	})
+	if err != nil {
+		if s, ok := m.sessions.Get(token); ok {
+			m.sessionFailed(ctx, s, &events.Event{
+				FailureKind: ledger.FailureAttestationRejected,
+				Stage:       fdo.MsgTO2ProveDevice,
+				Reason:      "attestation " + result + ": " + err.Error(),
+			})
+		}
+		return &proxy.RejectError{
+			Status: http.StatusForbidden,
+			Err:    fmt.Errorf("attestation for %s: %w", ev.GUID, err),
+		}
+	}
+	slog.Info("TO2.ProveDevice attestation checked", "guid", ev.GUID, "result", result)
+	return nil
 }
 
-// isTO2Response identifies TO2 protocol responses by message type header.
-// TO2 responses have Message-Type header set to "71" (Done2).
-func (m *TO2Middleware) isTO2Response(resp *http.Response) bool {
-	msgType := resp.Header.Get("Message-Type")
-	return msgType == "71" // TO2.Done2
+// verificationUnavailable applies the failure policy when evidence could not
+// even be presented to the verifier.
+func (m *TO2Middleware) verificationUnavailable(err error) error {
+	if m.verifier == nil || m.failOpen {
+		return nil
+	}
+	return &proxy.RejectError{Status: http.StatusForbidden, Err: fmt.Errorf("attestation: %w", err)}
 }
 
-// handleTO2HelloDevice logs TO2.HelloDevice requests for tracking.
-// This provides visibility into device onboarding initiation.
-func (m *TO2Middleware) handleTO2HelloDevice(ctx context.Context, req *http.Request) error {
-	slog.Info("TO2.HelloDevice request received")
+// OnTO2ServiceInfo implements proxy.TO2ServiceInfoHandler. It inspects
+// readable owner ServiceInfo for an fdo.csr enrollment response. Module
+// counts and sizes are recorded separately by ServiceInfoObserver.
+func (m *TO2Middleware) OnTO2ServiceInfo(ctx context.Context, sc *proxy.SessionContext, kvs []fdo.ServiceInfoKV, msg *proxy.Message) error {
+	if msg.Type != fdo.MsgTO2OwnerServiceInfo || msg.DecodeErr != nil {
+		return nil // Encrypted or unreadable - nothing to capture
+	}
+	token := fdo.SessionToken(msg.Request.Header)
+	if token == "" {
+		return nil
+	}
+	for _, kv := range kvs {
+		if fdo.IsCSRCertResponse(kv) {
+			m.sessions.Update(token, func(s *session.Session) {
+				captureDeviceCert(s, kv)
+			})
+		}
+	}
 	return nil
 }
 
-// handleTO2Done2 processes TO2.Done2 responses to create commissioning passports.
-// When a device completes onboarding successfully, this creates a record
-// of the commissioning event in the external passport service.
-func (m *TO2Middleware) handleTO2Done2(ctx context.Context, resp *http.Response) error {
-	if m.ledgerClient == nil {
+// captureDeviceCert stores the leaf certificate from an fdo.csr enrollment
+// response in the session, to feed the commissioning passport.
+func captureDeviceCert(s *session.Session, kv fdo.ServiceInfoKV) {
+	certs, err := fdo.DecodeCSRCertificates(kv.Value)
+	if err != nil {
+		slog.Warn("Could not decode fdo.csr certificate", "guid", s.GUID, "message", kv.Message(), "error", err)
+		return
+	}
+	leaf := certs[0]
+	s.DeviceCert = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}))
+	if leaf.Subject.SerialNumber != "" {
+		s.Serial = leaf.Subject.SerialNumber
+	}
+
+	slog.Info("Captured device certificate",
+		"guid", s.GUID,
+		"subject", leaf.Subject.String(),
+		"issuer", leaf.Issuer.String(),
+		"serial", leaf.SerialNumber.String(),
+		"not_after", leaf.NotAfter,
+		"sha256", certFingerprint(leaf))
+}
+
+func certFingerprint(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// OnTO2Done2 implements proxy.TO2Done2Handler, creating commissioning passports.
+// When a device completes onboarding successfully, this issues the onboarding
+// credential, if enabled, creates a record of the commissioning event in the
+// external passport service, at the URL the device's policy names or not at
+// all if it skips commissioning, and publishes a commissioning event.
+func (m *TO2Middleware) OnTO2Done2(ctx context.Context, sc *proxy.SessionContext, msg *proxy.Message) error {
+	// The session carries the GUID from HelloDevice and the evidence gathered since
+	s := m.lookupSession(msg.Request)
+	var tags []string
+	if s != nil {
+		tags = s.Tags
+	}
+	countOnboarding("to2", "succeeded", tags)
+	if m.ledgerClient == nil && m.issuer == nil && m.events.Len() == 0 {
 		return nil
 	}
 
-	// Extract device GUID from response or session context
-	// Note: This is a simplified implementation - production code would need proper CBOR parsing
-	deviceGUID := m.extractDeviceGUID(resp)
-	if deviceGUID == "" {
+	if s == nil || s.GUID == "" {
 		slog.Warn("Could not extract device GUID from TO2.Done2 response")
 		return nil
 	}
+	defer m.sessions.Delete(s.Token)
+
+	now := time.Now()
 
 	// Build commissioning passport request
 	reqBody := &ledger.CommissioningCreateRequest{
-		ControllerUUID:   deviceGUID,
-		Cert:             "", // TODO: Extract actual certificate if available
-		DeployedLocation: "", // TODO: Extract location from device info or config
-		Timestamp:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		ControllerUUID:   s.GUID,
+		ProductID:        s.ProductID,
+		OwnerID:          m.owner(s),
+		Cert:             s.DeviceCert, // Issued via fdo.csr, when observed
+		DeployedLocation: deployedLocation(s),
+		Timestamp:        fmt.Sprintf("%d", now.UnixNano()),
+		Evidence:         evidenceFromSession(s),
+		Serial:           s.Serial,
+		Tags:             s.Tags,
+	}
+
+	// Issue the onboarding credential first so it travels with the passport
+	if m.issuer != nil {
+		token, err := m.issuer.Issue(&vc.Onboarding{
+			GUID:        s.GUID,
+			OwnerID:     m.owner(s),
+			OnboardedAt: now,
+			VoucherHash: s.VoucherHash,
+		})
+		if err != nil {
+			slog.Warn("Failed to issue onboarding credential", "guid", s.GUID, "error", err)
+		}
+		reqBody.Credential = token
+	}
+
+	// The device is onboarded whether or not the passport service accepts the record
+	ev := &events.Event{
+		Type:      events.Commissioned,
+		GUID:      s.GUID,
+		OwnerID:   m.owner(s),
+		Time:      now,
+		RequestID: correlation.RequestID(ctx),
+		Passport:  reqBody,
+		Session:   s,
+		Tags:      s.Tags,
+		Location:  s.Location,
+	}
+	defer func() { m.events.Publish(ctx, ev) }()
+
+	if m.ledgerClient == nil {
+		return nil
+	}
+	p := m.policies.Named(s.Policy)
+	if p != nil && p.SkipCommissioning {
+		policyActions.Inc(p.Name, "commissioning_skipped")
+		slog.Info("Commissioning passport skipped by policy", "controller_uuid", s.GUID, "policy", p.Name)
+		return nil
 	}
 
 	// Create commissioning passport in external service
-	if err := m.ledgerClient.CreateCommissioningPassport(ctx, reqBody); err != nil {
+	ev.PassportSent = true
+	if err := m.createCommissioningPassport(ctx, p, reqBody); err != nil {
+		ev.PassportErr = err
 		slog.Warn("Failed to create commissioning passport",
-			"controller_uuid", deviceGUID,
+			"controller_uuid", s.GUID,
+			"request_id", correlation.RequestID(ctx),
 			"error", err)
 		return nil // Don't fail the response - passport creation is optional
 	}
 
 	slog.Info("Created commissioning passport",
-		"controller_uuid", reqBody.ControllerUUID)
+		"controller_uuid", reqBody.ControllerUUID,
+		"voucher_hash", reqBody.Evidence.VoucherHash)
 
 	return nil
 }
 
-// extractDeviceGUID parses the device GUID from TO2.Done2 response.
-// This is a placeholder implementation - production code would need:
-// 1. Proper CBOR parsing of the response body
-// 2. Extraction of device GUID from the response structure
-// 3. Or extraction from session context if available
-func (m *TO2Middleware) extractDeviceGUID(resp *http.Response) string {
-	// Placeholder implementation
-	// TODO: Implement proper CBOR parsing to extract device GUID
-	return "example-device-guid"
+// commissioningRouter is a LedgerClient that can send commissioning
+// passports elsewhere than its configured URL.
+type commissioningRouter interface {
+	CreateCommissioningPassportAt(ctx context.Context, target string, req *ledger.CommissioningCreateRequest) error
+}
+
+// createCommissioningPassport sends req to the commissioning URL of policy
+// p, if it names one, or else to the ledger client's own.
+func (m *TO2Middleware) createCommissioningPassport(ctx context.Context, p *policy.Policy, req *ledger.CommissioningCreateRequest) error {
+	if p == nil || p.CommissioningURL == "" {
+		return m.ledgerClient.CreateCommissioningPassport(ctx, req)
+	}
+	r, ok := m.ledgerClient.(commissioningRouter)
+	if !ok {
+		return fmt.Errorf("policy %s: ledger client cannot send to %s", p.Name, p.CommissioningURL)
+	}
+	policyActions.Inc(p.Name, "commissioning_redirected")
+	return r.CreateCommissioningPassportAt(ctx, p.CommissioningURL, req)
+}
+
+// OnErrorMessage implements proxy.ErrorMessageHandler. It publishes a TO2
+// session the backend aborted with an ErrorMessage as a failed onboarding
+// and stops tracking it.
+func (m *TO2Middleware) OnErrorMessage(ctx context.Context, sc *proxy.SessionContext, em *fdo.ErrorMessage, msg *proxy.Message) error {
+	if msg.InReplyTo < fdo.MsgTO2HelloDevice || msg.InReplyTo > fdo.MsgTO2Done {
+		return nil
+	}
+	s := m.lookupSession(msg.Request)
+	if s == nil {
+		// An error answering HelloDevice arrives before a token is bound
+		s = parkedHello(sc)
+	}
+	if s == nil {
+		return nil
+	}
+	ev := &events.Event{FailureKind: ledger.FailureTO2Aborted, Reason: "error message"}
+	if em != nil {
+		ev.Reason = em.String()
+		ev.Stage = int(em.PrevMsgID)
+		ev.ErrorCode = em.Code
+	}
+	m.sessionFailed(ctx, s, ev)
+	return nil
+}
+
+// sessionFailed publishes a failed onboarding attempt and drops the session.
+// ev carries the failure details; the rest is filled in from s.
+func (m *TO2Middleware) sessionFailed(ctx context.Context, s *session.Session, ev *events.Event) {
+	slog.Warn("TO2 onboarding failed", "guid", s.GUID, "request_id", correlation.RequestID(ctx), "reason", ev.Reason)
+	countOnboarding("to2", "failed", s.Tags)
+	m.sessions.Delete(s.Token)
+	ev.Type = events.Failed
+	ev.GUID = s.GUID
+	ev.OwnerID = m.owner(s)
+	ev.Time = time.Now()
+	ev.RequestID = correlation.RequestID(ctx)
+	ev.Session = s
+	ev.Protocol = "to2"
+	ev.ProductID = s.ProductID
+	ev.Tags = s.Tags
+	ev.Location = s.Location
+	m.events.Publish(ctx, ev)
+}
+
+// owner returns the owner s is onboarded to, falling back to the global
+// owner ID for sessions tracked without one.
+func (m *TO2Middleware) owner(s *session.Session) string {
+	if s.OwnerID != "" {
+		return s.OwnerID
+	}
+	return m.ownerID
+}
+
+// to2Hello is the session context key for the session parsed from
+// TO2.HelloDevice. HelloDevice carries no session token; the backend issues
+// one in its response, so the session is parked here until ProveOVHdr.
+const to2Hello = "to2.hello"
+
+// parkedHello returns the session parked by HelloDevice, if any.
+func parkedHello(sc *proxy.SessionContext) *session.Session {
+	v, _ := sc.Get(to2Hello)
+	s, _ := v.(*session.Session)
+	return s
+}
+
+// deployedLocation is the commissioning passport's DeployedLocation for s:
+// where its source address is located, if known.
+func deployedLocation(s *session.Session) string {
+	if s.Location == nil {
+		return ""
+	}
+	return s.Location.String()
+}
+
+// country returns the country of loc, empty if unknown.
+func country(loc *geo.Location) string {
+	if loc == nil {
+		return ""
+	}
+	return loc.Country
+}
+
+// remoteIP returns the host part of the request's remote address.
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// lookupSession finds the session for req.
+func (m *TO2Middleware) lookupSession(req *http.Request) *session.Session {
+	s, ok := m.sessions.Get(fdo.SessionToken(req.Header))
+	if !ok {
+		return nil
+	}
+	return s
+}
+
+// evidenceFromSession maps recorded session state onto the ledger payload.
+func evidenceFromSession(s *session.Session) *ledger.OnboardingEvidence {
+	return &ledger.OnboardingEvidence{
+		VoucherHash:  s.VoucherHash,
+		OwnerKeyHash: s.OwnerKeyHash,
+		KexSuite:     s.KexSuite,
+		CipherSuite:  s.CipherSuite,
+		ServiceInfo: ledger.ServiceInfoSummary{
+			DeviceMessages: s.ServiceInfo.DeviceMessages,
+			OwnerMessages:  s.ServiceInfo.OwnerMessages,
+			DeviceBytes:    s.ServiceInfo.DeviceBytes,
+			OwnerBytes:     s.ServiceInfo.OwnerBytes,
+			Encrypted:      s.ServiceInfo.Encrypted,
+			Modules:        serviceInfoModules(s.ServiceInfo.Modules),
+		},
+		Attestation: attestationInfo(s.Attestation),
+		Transfers:   transferInfo(s.Transfers),
+	}
+}
+
+func transferInfo(in []session.Transfer) []ledger.TransferInfo {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make([]ledger.TransferInfo, len(in))
+	for i, t := range in {
+		out[i] = ledger.TransferInfo{
+			Module:          t.Module,
+			Name:            t.Name,
+			URL:             t.URL,
+			Length:          t.Length,
+			AnnouncedSHA384: t.AnnouncedSHA384,
+			ExpectedSHA384:  t.ExpectedSHA384,
+			ObservedSHA384:  t.ObservedSHA384,
+			DeviceResult:    t.DeviceResult,
+			Error:           t.Error,
+			Verification:    t.Verification,
+		}
+	}
+	return out
+}
+
+func attestationInfo(a *session.Attestation) *ledger.AttestationInfo {
+	if a == nil {
+		return nil
+	}
+	return &ledger.AttestationInfo{
+		Type:         a.Type,
+		Algorithm:    a.Algorithm,
+		Nonce:        a.Nonce,
+		ClaimsDigest: a.ClaimsDigest,
+		Verification: a.Verification,
+	}
+}
+
+func serviceInfoModules(in []session.ModuleUsage) []ledger.ServiceInfoModule {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make([]ledger.ServiceInfoModule, len(in))
+	for i, m := range in {
+		out[i] = ledger.ServiceInfoModule{Name: m.Name, Messages: m.Messages, Bytes: m.Bytes}
+	}
+	return out
 }
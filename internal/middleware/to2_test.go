@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/cbor"
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/quarantine"
+	"github.com/fdo-server-wrapper/internal/session"
+)
+
+// helloDevice is a TO2.HelloDevice from the device with guid.
+func helloDevice(t *testing.T, guid fdo.GUID) *http.Request {
+	t.Helper()
+	nonce := bytes.Repeat([]byte{0xaa}, 16)
+	body, err := cbor.Marshal([]any{uint64(1300), guid[:], nonce, "ECDH256", 1, []any{-7, []byte{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/fdo/101/msg/"+strconv.Itoa(fdo.MsgTO2HelloDevice), bytes.NewReader(body))
+	// A device must not choose its owner
+	req.Header.Set(OwnerHeader, "device-chosen")
+	return req
+}
+
+func TestTO2Quarantine(t *testing.T) {
+	blocked := fdo.GUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	other := fdo.GUID{16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1}
+	list, err := quarantine.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := list.Add(quarantine.Entry{GUID: blocked.String(), Reason: "tampered", Since: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	m := NewTO2Middleware(nil, "tenant-a", session.NewStore(time.Hour))
+	m.EnableQuarantine(list)
+
+	sc := proxy.NewSessionContext("to2")
+	err = dispatch(t, sc, helloDevice(t, blocked), m)
+	wantReject(t, err, http.StatusForbidden, fdo.CodeInvalidGUID)
+	if parkedHello(sc) != nil {
+		t.Error("quarantined device's session was parked")
+	}
+
+	sc = proxy.NewSessionContext("to2")
+	req := helloDevice(t, other)
+	if err := dispatch(t, sc, req, m); err != nil {
+		t.Fatalf("HelloDevice of a device not quarantined = %v, want nil", err)
+	}
+	s := parkedHello(sc)
+	if s == nil || s.GUID != other.String() || s.KexSuite != "ECDH256" {
+		t.Fatalf("parked session = %+v, want %s over ECDH256", s, other)
+	}
+	if got := req.Header.Get(OwnerHeader); got != "tenant-a" {
+		t.Errorf("%s = %q, want tenant-a", OwnerHeader, got)
+	}
+
+	// Releasing the device lets it through
+	if _, err := list.Remove(blocked.String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := dispatch(t, proxy.NewSessionContext("to2"), helloDevice(t, blocked), m); err != nil {
+		t.Errorf("HelloDevice after release = %v, want nil", err)
+	}
+}
+
+// done2 is the backend's TO2.Done2 answering the device's TO2.Done in the
+// session of token.
+func done2(token string) *http.Response {
+	req := httptest.NewRequest(http.MethodPost, "/fdo/101/msg/"+strconv.Itoa(fdo.MsgTO2Done), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Message-Type": {strconv.Itoa(fdo.MsgTO2Done2)}},
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+func TestTO2Done2Commissioning(t *testing.T) {
+	const guid = "01020304-0506-0708-090a-0b0c0d0e0f10"
+	for _, tt := range []struct {
+		name     string
+		policy   string // policy of the session
+		token    string // token Done2 carries
+		sent     bool
+		finished bool // whether the session is dropped
+	}{
+		{name: "sent", token: "tok", sent: true, finished: true},
+		{name: "skipped by policy", policy: "lab", token: "tok", finished: true},
+		{name: "unknown session", token: "other"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := session.NewStore(time.Hour)
+			sessions.Put(&session.Session{
+				Token:        "tok",
+				Protocol:     "to2",
+				GUID:         guid,
+				ProductID:    testProductID,
+				Serial:       "SN-0001",
+				VoucherHash:  "voucher-hash",
+				OwnerKeyHash: "owner-key-hash",
+				KexSuite:     "ECDH256",
+				CipherSuite:  "A128GCM",
+				Tags:         []string{"line-a"},
+				Policy:       tt.policy,
+				Attestation:  &session.Attestation{Type: "tpm", Verification: "passed"},
+			})
+			client := &fakeLedger{}
+			m := NewTO2Middleware(client, "tenant-a", sessions)
+			m.EnablePolicies(loadPolicies(t, `{"policies": [{"name": "lab", "tags": ["lab"], "skip_commissioning": true}]}`))
+			bus, sink := newBus()
+			m.EnableEvents(bus)
+
+			d, err := proxy.NewDispatcher(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := d.ProcessResponse(context.Background(), proxy.NewSessionContext("to2"), done2(tt.token)); err != nil {
+				t.Fatalf("OnTO2Done2 = %v, want nil", err)
+			}
+			bus.Wait()
+
+			if _, ok := sessions.Get("tok"); ok == tt.finished {
+				t.Errorf("session kept = %v, want %v", ok, !tt.finished)
+			}
+			if !tt.sent {
+				if len(client.created) != 0 {
+					t.Errorf("%d commissioning passports sent, want none", len(client.created))
+				}
+				if tt.finished && (len(sink.events) != 1 || sink.events[0].PassportSent) {
+					t.Errorf("events = %+v, want one commissioning event without a passport", sink.events)
+				}
+				return
+			}
+			if len(client.created) != 1 {
+				t.Fatalf("%d commissioning passports sent, want 1", len(client.created))
+			}
+			p := client.created[0]
+			if p.ControllerUUID != guid || p.ProductID != testProductID || p.OwnerID != "tenant-a" || p.Serial != "SN-0001" {
+				t.Errorf("passport = %+v, want the device's GUID, product, owner and serial", p)
+			}
+			if p.Timestamp == "" || len(p.Tags) != 1 || p.Tags[0] != "line-a" {
+				t.Errorf("timestamp, tags = %q, %v, want a timestamp and [line-a]", p.Timestamp, p.Tags)
+			}
+			ev := p.Evidence
+			if ev.VoucherHash != "voucher-hash" || ev.OwnerKeyHash != "owner-key-hash" || ev.KexSuite != "ECDH256" || ev.CipherSuite != "A128GCM" {
+				t.Errorf("evidence = %+v, want the session's hashes and suites", ev)
+			}
+			if ev.Attestation == nil || ev.Attestation.Type != "tpm" || ev.Attestation.Verification != "passed" {
+				t.Errorf("attestation = %+v, want tpm, passed", ev.Attestation)
+			}
+			if len(sink.events) != 1 || sink.events[0].Type != events.Commissioned || !sink.events[0].PassportSent || sink.events[0].Passport != p {
+				t.Errorf("events = %+v, want one commissioning event carrying the passport", sink.events)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Message is a rendered notification.
+type Message struct {
+	Kind    string
+	Time    time.Time
+	Subject string
+	Text    string
+}
+
+// Channel delivers notifications.
+type Channel interface {
+	// Name identifies the channel in notifications files, logs and
+	// metrics.
+	Name() string
+	Send(ctx context.Context, m *Message) error
+}
+
+// Slack posts notifications to a Slack incoming webhook.
+type Slack struct {
+	url  string
+	http *http.Client
+}
+
+// NewSlack creates a Slack channel.
+func NewSlack(webhookURL string) *Slack {
+	return &Slack{url: webhookURL, http: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name implements Channel.
+func (s *Slack) Name() string { return "slack" }
+
+// Send implements Channel. The subject is posted in bold above the text.
+func (s *Slack) Send(ctx context.Context, m *Message) error {
+	payload, err := json.Marshal(map[string]string{"text": "*" + m.Subject + "*\n" + m.Text})
+	if err != nil {
+		return fmt.Errorf("encode notification: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// EmailOptions configures the email channel.
+type EmailOptions struct {
+	// Addr is the SMTP server as host:port.
+	Addr string
+	From string
+	To   []string
+	// Username and Password enable PLAIN authentication, which net/smtp
+	// only performs over TLS or to localhost.
+	Username string
+	Password string
+}
+
+// Email sends notifications over SMTP.
+type Email struct {
+	opts EmailOptions
+}
+
+// NewEmail creates an email channel.
+func NewEmail(opts EmailOptions) *Email { return &Email{opts: opts} }
+
+// Name implements Channel.
+func (e *Email) Name() string { return "email" }
+
+// Send implements Channel. net/smtp has no context support, so ctx only
+// bounds the wait; a stuck server connection finishes in the background.
+func (e *Email) Send(ctx context.Context, m *Message) error {
+	var auth smtp.Auth
+	if e.opts.Username != "" {
+		host, _, _ := net.SplitHostPort(e.opts.Addr)
+		auth = smtp.PlainAuth("", e.opts.Username, e.opts.Password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.opts.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.opts.To, ", "))
+	// Templates may put anything in the subject; keep it one encoded line
+	subject := strings.Join(strings.Fields("[fdo-proxy] "+m.Subject), " ")
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", m.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Text, "\r\n", "\n"), "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(e.opts.Addr, auth, e.opts.From, e.opts.To, msg.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
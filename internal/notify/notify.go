@@ -0,0 +1,341 @@
+// Package notify tells people about onboarding as it happens: devices
+// that completed onboarding, devices the proxy refused, outages of the
+// passport service and unusual onboarding activity, each sent to the Slack and email channels chosen
+// for it with a message rendered from a template.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+// Kinds of notification.
+const (
+	// Onboarded is a device that completed TO2.
+	Onboarded = "onboarded"
+	// Denied is a DI or TO2 attempt the proxy refused: a duplicate serial,
+	// a missing passport, a rejected attestation, a payload mismatch or a
+	// geofence.
+	Denied = "denied"
+	// LedgerOutage is a passport service endpoint whose circuit breaker
+	// opened, and again when it closes.
+	LedgerOutage = "ledger_outage"
+	// Anomaly is unusual onboarding activity (see package anomaly).
+	Anomaly = "anomaly"
+)
+
+// Kinds lists the kinds of notification.
+var Kinds = []string{Onboarded, Denied, LedgerOutage, Anomaly}
+
+var notifications = metrics.Default.NewCounterVec(
+	"fdo_proxy_notifications_total",
+	"Notifications by kind, channel and outcome (success, error).",
+	"kind", "channel", "outcome")
+
+// KindConfig chooses where and how a kind of notification is sent; it is
+// one entry of a notifications file.
+type KindConfig struct {
+	// Channels names the channels to send to ("slack", "email"); empty
+	// means every channel configured.
+	Channels []string `json:"channels,omitempty"`
+	// Subject and Text replace the default templates, in text/template
+	// syntax over a Data.
+	Subject string `json:"subject,omitempty"`
+	Text    string `json:"text,omitempty"`
+}
+
+// Config is a notifications file, keyed by kind. Kinds left out are not
+// sent.
+type Config map[string]KindConfig
+
+// LoadConfig reads a notifications file of the form
+//
+//	{
+//	  "onboarded": {"channels": ["slack"]},
+//	  "denied": {"text": "{{.Protocol}} refused for {{.Device}}: {{.Reason}}"},
+//	  "ledger_outage": {"channels": ["slack", "email"]}
+//	}
+//
+// and checks its kinds and templates. Channels are checked by New.
+func LoadConfig(path string) (Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read notifications: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("parse notifications: %w", err)
+	}
+	for kind, kc := range c {
+		if !slices.Contains(Kinds, kind) {
+			return nil, fmt.Errorf("unknown notification %q: want one of %s", kind, strings.Join(Kinds, ", "))
+		}
+		ts, err := kc.templates(kind)
+		if err != nil {
+			return nil, err
+		}
+		// Render once, so fields Data lacks fail here rather than at the
+		// first notification
+		for _, t := range ts {
+			if err := t.Execute(io.Discard, Data{Kind: kind, Time: time.Now()}); err != nil {
+				return nil, fmt.Errorf("notification %s: %w", kind, err)
+			}
+		}
+	}
+	return c, nil
+}
+
+// Data is what a template renders.
+type Data struct {
+	Kind string
+	Time time.Time
+	// Device is the GUID, or the serial number if there is no GUID yet.
+	Device    string
+	GUID      string
+	Serial    string
+	OwnerID   string
+	Protocol  string
+	RequestID string
+	Tags      []string
+	// Reason is why a device was denied, FailureKind its class (see
+	// ledger.Failure*).
+	Reason      string
+	FailureKind string
+	// Endpoint is the passport service endpoint of a ledger outage, and
+	// Status "down" or "up".
+	Endpoint string
+	Status   string
+	// Anomaly is the kind of an anomaly (see anomaly.Kinds), described by
+	// Reason.
+	Anomaly string
+}
+
+// defaults are the templates of each kind, subject then text.
+var defaults = map[string][2]string{
+	Onboarded: {
+		`Device {{.Device}} onboarded`,
+		`Device {{.Device}}{{with .Serial}} (serial {{.}}){{end}} completed onboarding{{with .OwnerID}} to owner {{.}}{{end}} at {{.Time.Format "2006-01-02 15:04:05 MST"}}.{{with .Tags}}
+Tags: {{join . ", "}}{{end}}`,
+	},
+	Denied: {
+		`Device {{.Device}} denied: {{.FailureKind}}`,
+		`The proxy refused {{.Protocol}} for device {{.Device}} at {{.Time.Format "2006-01-02 15:04:05 MST"}}: {{.Reason}}
+Request ID: {{.RequestID}}`,
+	},
+	LedgerOutage: {
+		`Passport service {{.Status}}: {{.Endpoint}}`,
+		`{{if eq .Status "down"}}The passport service stopped answering {{.Endpoint}} requests at {{.Time.Format "2006-01-02 15:04:05 MST"}}; the proxy is holding off until it recovers.{{else}}The passport service is answering {{.Endpoint}} requests again as of {{.Time.Format "2006-01-02 15:04:05 MST"}}.{{end}}`,
+	},
+	Anomaly: {
+		`Onboarding anomaly: {{.Anomaly}}`,
+		`Unusual onboarding activity at {{.Time.Format "2006-01-02 15:04:05 MST"}}: {{.Reason}}.{{with .Device}}
+Device: {{.}}{{end}}{{with .RequestID}}
+Request ID: {{.}}{{end}}`,
+	},
+}
+
+var funcs = template.FuncMap{"join": strings.Join}
+
+// templates parses the subject and text templates of kind.
+func (kc KindConfig) templates(kind string) ([2]*template.Template, error) {
+	var out [2]*template.Template
+	for i, src := range []string{kc.Subject, kc.Text} {
+		if src == "" {
+			src = defaults[kind][i]
+		}
+		t, err := template.New(kind).Funcs(funcs).Option("missingkey=error").Parse(src)
+		if err != nil {
+			return out, fmt.Errorf("notification %s: %w", kind, err)
+		}
+		out[i] = t
+	}
+	return out, nil
+}
+
+// route is where and how a kind is sent.
+type route struct {
+	channels  []Channel
+	templates [2]*template.Template
+}
+
+// Notifier sends notifications. It implements events.Sink for the device
+// notifications; ledger outages come through LedgerBreaker.
+type Notifier struct {
+	routes map[string]route
+
+	mu   sync.Mutex
+	down map[string]bool
+}
+
+// New returns a Notifier sending the kinds in c to channels.
+func New(c Config, channels []Channel) (*Notifier, error) {
+	byName := make(map[string]Channel, len(channels))
+	for _, ch := range channels {
+		byName[ch.Name()] = ch
+	}
+	n := &Notifier{routes: make(map[string]route), down: make(map[string]bool)}
+	for kind, kc := range c {
+		ts, err := kc.templates(kind)
+		if err != nil {
+			return nil, err
+		}
+		r := route{templates: ts}
+		if len(kc.Channels) == 0 {
+			r.channels = channels
+		}
+		for _, name := range kc.Channels {
+			ch, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("notification %s: channel %q is not configured", kind, name)
+			}
+			r.channels = append(r.channels, ch)
+		}
+		if len(r.channels) == 0 {
+			return nil, fmt.Errorf("notification %s: no channel configured", kind)
+		}
+		n.routes[kind] = r
+	}
+	return n, nil
+}
+
+// Kinds returns the kinds n sends, sorted.
+func (n *Notifier) Kinds() []string {
+	out := make([]string, 0, len(n.routes))
+	for kind := range n.routes {
+		out = append(out, kind)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Name implements events.Sink.
+func (n *Notifier) Name() string { return "notifications" }
+
+// Publish implements events.Sink.
+func (n *Notifier) Publish(ctx context.Context, ev *events.Event) error {
+	var kind string
+	switch {
+	case ev.Type == events.Commissioned:
+		kind = Onboarded
+	case ev.Type == events.Failed && denial(ev.FailureKind):
+		kind = Denied
+	case ev.Type == events.Anomaly:
+		kind = Anomaly
+	default:
+		return nil
+	}
+	if _, ok := n.routes[kind]; !ok {
+		return nil
+	}
+	d := Data{
+		Kind:        kind,
+		Time:        ev.Time,
+		GUID:        ev.GUID,
+		Serial:      ev.Serial,
+		OwnerID:     ev.OwnerID,
+		Protocol:    ev.Protocol,
+		RequestID:   ev.RequestID,
+		Tags:        ev.Tags,
+		Reason:      ev.Reason,
+		FailureKind: ev.FailureKind,
+		Anomaly:     ev.AnomalyKind,
+	}
+	if d.Serial == "" && ev.Session != nil {
+		d.Serial = ev.Session.Serial
+	}
+	if d.Device = d.GUID; d.Device == "" {
+		d.Device = d.Serial
+	}
+	return n.send(ctx, d)
+}
+
+// denial reports whether a failure of kind was the proxy refusing the
+// device, rather than the backend or the device giving up.
+func denial(kind string) bool {
+	return kind != "" && kind != ledger.FailureDIRejected && kind != ledger.FailureTO2Aborted
+}
+
+// LedgerBreaker notifies that endpoint went down when its circuit breaker
+// opens and that it is up again when the breaker closes; trial requests
+// in between are not reported. It is meant for ledger.Client's
+// OnBreakerChange and sends in the background.
+func (n *Notifier) LedgerBreaker(endpoint string, s ledger.BreakerState) {
+	if _, ok := n.routes[LedgerOutage]; !ok {
+		return
+	}
+	n.mu.Lock()
+	was := n.down[endpoint]
+	switch {
+	case s == ledger.BreakerOpen && !was:
+		n.down[endpoint] = true
+	case s == ledger.BreakerClosed && was:
+		delete(n.down, endpoint)
+	default:
+		n.mu.Unlock()
+		return
+	}
+	n.mu.Unlock()
+	d := Data{Kind: LedgerOutage, Time: time.Now(), Endpoint: endpoint, Status: "up"}
+	if !was {
+		d.Status = "down"
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := n.send(ctx, d); err != nil {
+			slog.Warn("Notification failed", "kind", d.Kind, "error", err)
+		}
+	}()
+}
+
+// send renders d and sends it to the channels of its kind, returning the
+// first error.
+func (n *Notifier) send(ctx context.Context, d Data) error {
+	r := n.routes[d.Kind]
+	var parts [2]bytes.Buffer
+	for i, t := range r.templates {
+		if err := t.Execute(&parts[i], d); err != nil {
+			return fmt.Errorf("render %s notification: %w", d.Kind, err)
+		}
+	}
+	m := &Message{Kind: d.Kind, Time: d.Time, Subject: strings.TrimSpace(parts[0].String()), Text: parts[1].String()}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(r.channels))
+	for i, ch := range r.channels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ch.Send(ctx, m); err != nil {
+				notifications.Inc(d.Kind, ch.Name(), "error")
+				errs[i] = fmt.Errorf("%s: %w", ch.Name(), err)
+				return
+			}
+			notifications.Inc(d.Kind, ch.Name(), "success")
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
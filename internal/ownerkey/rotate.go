@@ -0,0 +1,224 @@
+// Package ownerkey drives owner key rotation: the owner backend switches to
+// a new key and re-signs or extends the outstanding vouchers, then the
+// proxy updates their rendezvous registrations and records the rotation in
+// an audit trail and the passport service.
+package ownerkey
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/audit"
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+var rotations = metrics.Default.NewCounterVec(
+	"fdo_proxy_owner_key_rotations_total",
+	"Owner key rotations by outcome (rotated, partial, failed).",
+	"outcome")
+
+// ErrInProgress is returned while another rotation is running.
+var ErrInProgress = errors.New("owner key rotation already in progress")
+
+// Result is the owner backend's answer to a rotation.
+type Result struct {
+	KeyID         string `json:"key_id"`
+	PreviousKeyID string `json:"previous_key_id"`
+	// Vouchers are the GUIDs of the outstanding vouchers the backend
+	// re-signed or extended to the new key.
+	Vouchers []string `json:"vouchers"`
+}
+
+// Client talks to the owner backend's key rotation endpoint, which takes a
+// POST of {"reason": ...}, switches to a new owner key and answers with a
+// Result.
+type Client struct {
+	url  string
+	http *http.Client
+}
+
+// NewClient creates a client for the endpoint at url. A non-positive
+// timeout defaults to 5 minutes, since the backend re-signs every
+// outstanding voucher before it answers.
+func NewClient(url string, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	return &Client{url: url, http: &http.Client{Timeout: timeout}}
+}
+
+// Rotate asks the backend to rotate the owner key.
+func (c *Client) Rotate(ctx context.Context, reason string) (*Result, error) {
+	payload, err := json.Marshal(map[string]string{"reason": reason})
+	if err != nil {
+		return nil, fmt.Errorf("encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	correlation.Inject(ctx, req.Header)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("backend request: %w", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, fmt.Errorf("read backend response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("backend status %d: %s", resp.StatusCode, bytes.TrimSpace(b))
+	}
+	var res Result
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, fmt.Errorf("parse backend response: %w", err)
+	}
+	return &res, nil
+}
+
+// Rotation is one audited owner key rotation.
+type Rotation struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"request_id,omitempty"`
+	RemoteAddr    string    `json:"remote_addr,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	KeyID         string    `json:"key_id,omitempty"`
+	PreviousKeyID string    `json:"previous_key_id,omitempty"`
+	Vouchers      []string  `json:"vouchers"`
+	// Registered are the vouchers registered again at the rendezvous
+	// server; RegistrationErrors holds the ones that failed.
+	Registered         []string          `json:"registered,omitempty"`
+	RegistrationErrors map[string]string `json:"registration_errors,omitempty"`
+	// LedgerError is why the passport service did not record the rotation.
+	LedgerError string `json:"ledger_error,omitempty"`
+}
+
+// Complete reports whether every follow-up step of the rotation succeeded.
+func (r *Rotation) Complete() bool {
+	return len(r.RegistrationErrors) == 0 && r.LedgerError == ""
+}
+
+// Audit is the owner key rotation history.
+type Audit = audit.Log[Rotation]
+
+// OpenAudit loads the history from path, which need not exist yet. An
+// empty path keeps the history in memory only.
+func OpenAudit(path string) (*Audit, error) {
+	return audit.Open[Rotation](path, "owner key audit")
+}
+
+// Registrar registers a device at the rendezvous server (TO0).
+type Registrar interface {
+	Register(ctx context.Context, guid, ownerID, productID, requestID string) (int, error)
+}
+
+// Recorder records rotations in the passport service.
+type Recorder interface {
+	RecordKeyRotation(ctx context.Context, rec *ledger.KeyRotationRecord) error
+}
+
+// Rotator runs rotations one at a time.
+type Rotator struct {
+	client  *Client
+	audit   *Audit
+	ownerID string
+	to0     Registrar
+	ledger  Recorder
+
+	mu sync.Mutex
+}
+
+// NewRotator creates a rotator using c and recording to a.
+func NewRotator(c *Client, a *Audit, ownerID string) *Rotator {
+	return &Rotator{client: c, audit: a, ownerID: ownerID}
+}
+
+// EnableTO0 registers the rotated vouchers again through reg, so the
+// rendezvous server holds registrations signed with the new key.
+func (r *Rotator) EnableTO0(reg Registrar) { r.to0 = reg }
+
+// EnableLedger records each rotation through rec.
+func (r *Rotator) EnableLedger(rec Recorder) { r.ledger = rec }
+
+// History returns the rotations made through the proxy, oldest first.
+func (r *Rotator) History() []Rotation { return r.audit.Entries() }
+
+// Rotate has the backend rotate the owner key, then updates the rendezvous
+// registrations and records the rotation. Only a backend failure is
+// returned as an error; failed follow-up steps are reported in the
+// Rotation, which is recorded either way.
+func (r *Rotator) Rotate(ctx context.Context, reason, remoteAddr string) (*Rotation, error) {
+	if !r.mu.TryLock() {
+		return nil, ErrInProgress
+	}
+	defer r.mu.Unlock()
+
+	res, err := r.client.Rotate(ctx, reason)
+	if err != nil {
+		rotations.Inc("failed")
+		return nil, err
+	}
+	rot := &Rotation{
+		Time:          time.Now().UTC(),
+		RequestID:     correlation.RequestID(ctx),
+		RemoteAddr:    remoteAddr,
+		Reason:        reason,
+		KeyID:         res.KeyID,
+		PreviousKeyID: res.PreviousKeyID,
+		Vouchers:      append([]string{}, res.Vouchers...),
+	}
+
+	if r.to0 != nil {
+		for _, guid := range rot.Vouchers {
+			if _, err := r.to0.Register(ctx, guid, r.ownerID, "", rot.RequestID); err != nil {
+				if rot.RegistrationErrors == nil {
+					rot.RegistrationErrors = make(map[string]string)
+				}
+				rot.RegistrationErrors[guid] = err.Error()
+				continue
+			}
+			rot.Registered = append(rot.Registered, guid)
+		}
+	}
+	if r.ledger != nil {
+		err := r.ledger.RecordKeyRotation(ctx, &ledger.KeyRotationRecord{
+			OwnerID:         r.ownerID,
+			KeyID:           rot.KeyID,
+			PreviousKeyID:   rot.PreviousKeyID,
+			ControllerUUIDs: rot.Vouchers,
+			Reason:          reason,
+			Timestamp:       fmt.Sprintf("%d", rot.Time.UnixNano()),
+		})
+		if err != nil {
+			rot.LedgerError = err.Error()
+		}
+	}
+
+	if err := r.audit.Record(*rot); err != nil {
+		// The key has already changed; report the gap loudly
+		slog.Error("Owner key rotated but the audit record failed", "request_id", rot.RequestID, "error", err)
+	}
+	if rot.Complete() {
+		rotations.Inc("rotated")
+	} else {
+		rotations.Inc("partial")
+	}
+	slog.Info("Owner key rotated", "request_id", rot.RequestID, "key_id", rot.KeyID,
+		"previous_key_id", rot.PreviousKeyID, "vouchers", len(rot.Vouchers),
+		"registration_errors", len(rot.RegistrationErrors), "ledger_error", rot.LedgerError)
+	return rot, nil
+}
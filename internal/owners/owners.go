@@ -0,0 +1,65 @@
+// Package owners assigns devices to owners (tenants) from a mapping file,
+// for proxies onboarding devices on behalf of more than one owner.
+package owners
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Map assigns owner IDs by device GUID, serial number or product ID. A
+// nil *Map assigns nothing.
+type Map struct {
+	GUIDs    map[string]string `json:"guids"`
+	Serials  map[string]string `json:"serials"`
+	Products map[string]string `json:"products"`
+}
+
+// Load reads a mapping file of the form
+//
+//	{"guids": {...}, "serials": {...}, "products": {...}}
+//
+// where each object maps a key to an owner ID. Every section is optional.
+func Load(path string) (*Map, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read owner map: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var m Map
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("parse owner map: %w", err)
+	}
+	return &m, nil
+}
+
+// Len returns the number of entries in m.
+func (m *Map) Len() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.GUIDs) + len(m.Serials) + len(m.Products)
+}
+
+// Lookup returns the owner for a device, matching its GUID first, then its
+// serial number, then its product ID. Empty keys never match.
+func (m *Map) Lookup(guid, serial, productID string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	for _, c := range []struct {
+		key string
+		ids map[string]string
+	}{{guid, m.GUIDs}, {serial, m.Serials}, {productID, m.Products}} {
+		if c.key == "" {
+			continue
+		}
+		if owner, ok := c.ids[c.key]; ok && owner != "" {
+			return owner, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,427 @@
+// Package penalty holds back devices that keep failing to onboard. After a
+// number of failed DI or TO2 attempts in a row a device is banned from
+// starting sessions for a while, twice as long after each further failure
+// up to a ceiling, so a bricked or hostile device stops loading the
+// backend while a device that recovers can still get through. Failures
+// are forgiven when the device succeeds or has not failed for a while.
+// The bans themselves are kept in the ban list, where the proxy checks
+// them along with the operators'.
+package penalty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/ban"
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/metrics"
+	"github.com/fdo-server-wrapper/internal/redis"
+)
+
+var (
+	bans = metrics.Default.NewCounterVec(
+		"fdo_proxy_penalty_bans_total",
+		"Devices banned from starting sessions after repeated failed onboardings, by protocol of the last failure.",
+		"protocol")
+	storeErrors = metrics.Default.NewCounterVec(
+		"fdo_proxy_penalty_errors_total",
+		"Penalty lookups and updates that could not reach Redis; lookups that fail let the device through.")
+)
+
+// Options are the penalty rules.
+type Options struct {
+	// After is how many failures in a row earn the first ban.
+	After int
+	// Base is the first ban; each further failure doubles it, up to Max.
+	Base time.Duration
+	Max  time.Duration
+	// Reset forgets a device's failures once it has gone this long without
+	// one and is not banned.
+	Reset time.Duration
+}
+
+// ban is the ban earned by the failures-th failure in a row, 0 for none.
+func (o Options) ban(failures int) time.Duration {
+	if failures < o.After {
+		return 0
+	}
+	d := o.Base
+	for range failures - o.After {
+		if d >= o.Max {
+			break
+		}
+		d *= 2
+	}
+	return min(d, o.Max)
+}
+
+// Entry is a device's failures and ban. Key names the device as the
+// proxy's rate limits and the ban list do: "guid:<guid>", or
+// "serial:<serial>" for DI attempts that failed before a GUID was assigned.
+type Entry struct {
+	Key      string `json:"key"`
+	Failures int    `json:"failures"`
+	// Until is when the ban ends, zero if the device is not banned yet.
+	Until       time.Time `json:"banned_until,omitzero"`
+	LastFailure time.Time `json:"last_failure"`
+}
+
+// Banned reports whether e bans its device at now.
+func (e Entry) Banned(now time.Time) bool {
+	return now.Before(e.Until)
+}
+
+// expired reports whether e can be forgotten at now.
+func (e Entry) expired(now time.Time, reset time.Duration) bool {
+	return !e.Banned(now) && now.Sub(e.LastFailure) >= reset
+}
+
+// store keeps the entries.
+type store interface {
+	// fail counts a failure of key and returns its entry.
+	fail(ctx context.Context, key string, o Options) (Entry, error)
+	// get returns the entry of key, if it has one.
+	get(ctx context.Context, key string) (Entry, bool, error)
+	// remove forgets key, reporting whether it had an entry.
+	remove(ctx context.Context, key string) (bool, error)
+	// all returns every entry.
+	all(ctx context.Context) ([]Entry, error)
+}
+
+// Box tracks failures and bans devices in a ban list. It implements
+// events.Sink, counting the failures and forgiving the successes published
+// on the bus.
+type Box struct {
+	opts Options
+	st   store
+	bans *ban.List
+}
+
+// New returns a Box counting failures in memory, so each proxy bans on
+// what it has seen itself, and banning in l.
+func New(o Options, l *ban.List) *Box {
+	return &Box{opts: o, st: &memory{entries: make(map[string]*Entry), reset: o.Reset}, bans: l}
+}
+
+// NewRedis returns a Box counting failures in c, shared by every proxy
+// using the server, and banning in l.
+func NewRedis(c *redis.Client, o Options, l *ban.List) *Box {
+	return &Box{opts: o, st: &redisStore{c: c}, bans: l}
+}
+
+// Fail counts a failed attempt of the device of key, banning it if it has
+// now failed often enough. A ban an operator placed on the device is left
+// as it is.
+func (b *Box) Fail(ctx context.Context, key, protocol string) {
+	e, err := b.st.fail(ctx, key, b.opts)
+	if err != nil {
+		storeErrors.Inc()
+		slog.Warn("Could not count device failure", "key", key, "error", err)
+		return
+	}
+	if e.Until.IsZero() {
+		return
+	}
+	kind, value, err := ban.ParseKey(key)
+	if err != nil {
+		return
+	}
+	added, err := b.bans.Add(ctx, ban.Entry{
+		Kind:   kind,
+		Value:  value,
+		Reason: fmt.Sprintf("%d failed %s attempts in a row", e.Failures, protocol),
+		Source: ban.SourcePenalty,
+		Since:  e.LastFailure.UTC(),
+		Until:  e.Until.UTC(),
+	})
+	if err != nil {
+		slog.Warn("Could not ban device", "key", key, "error", err)
+		return
+	}
+	if added {
+		bans.Inc(protocol)
+		slog.Warn("Device banned after repeated failures",
+			"key", key,
+			"protocol", protocol,
+			"failures", e.Failures,
+			"until", e.Until.Format(time.RFC3339),
+			"ban", time.Until(e.Until).Round(time.Second))
+	}
+}
+
+// Forgive forgets the failures of the device of key and lifts the ban they
+// earned, leaving any an operator placed. It reports false if the device
+// had neither.
+func (b *Box) Forgive(ctx context.Context, key string) (bool, error) {
+	found, err := b.st.remove(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	e, banned, err := b.bans.Get(ctx, key)
+	if err != nil {
+		return found, err
+	}
+	if banned && e.Source == ban.SourcePenalty {
+		lifted, err := b.bans.Lift(ctx, key)
+		return found || lifted, err
+	}
+	return found, nil
+}
+
+// All returns the devices with failures or a ban, sorted by key.
+func (b *Box) All(ctx context.Context) ([]Entry, error) {
+	out, err := b.st.all(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out, nil
+}
+
+// Name implements events.Sink.
+func (b *Box) Name() string { return "penalties" }
+
+// Publish implements events.Sink. Failed DI and TO2 attempts count against
+// the device, by GUID or else by serial number; completed DI and TO2
+// forgive it.
+func (b *Box) Publish(ctx context.Context, ev *events.Event) error {
+	switch ev.Type {
+	case events.Failed:
+		if ev.Protocol != "di" && ev.Protocol != "to2" {
+			return nil
+		}
+		if key := deviceKey(ev); key != "" {
+			b.Fail(ctx, key, ev.Protocol)
+		}
+	case events.Initialized, events.Commissioned:
+		for _, key := range []string{deviceKey(ev), serialKey(ev.Serial)} {
+			if key == "" {
+				continue
+			}
+			if _, err := b.Forgive(ctx, key); err != nil {
+				storeErrors.Inc()
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deviceKey names the device of ev.
+func deviceKey(ev *events.Event) string {
+	if ev.GUID != "" {
+		return "guid:" + ev.GUID
+	}
+	return serialKey(ev.Serial)
+}
+
+func serialKey(serial string) string {
+	if serial == "" {
+		return ""
+	}
+	return "serial:" + serial
+}
+
+// sweepInterval limits how often expired entries are looked for.
+const sweepInterval = time.Minute
+
+// memory keeps the entries in a map.
+type memory struct {
+	mu      sync.Mutex
+	entries map[string]*Entry
+	reset   time.Duration
+	swept   time.Time
+}
+
+func (m *memory) fail(_ context.Context, key string, o Options) (Entry, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweepLocked(now)
+	e := m.entries[key]
+	if e == nil || e.expired(now, m.reset) {
+		e = &Entry{Key: key}
+		m.entries[key] = e
+	}
+	e.Failures++
+	e.LastFailure = now
+	if d := o.ban(e.Failures); d > 0 {
+		e.Until = now.Add(d)
+	}
+	return *e, nil
+}
+
+func (m *memory) get(_ context.Context, key string) (Entry, bool, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.entries[key]
+	if e == nil || e.expired(now, m.reset) {
+		return Entry{}, false, nil
+	}
+	return *e, true, nil
+}
+
+func (m *memory) remove(_ context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.entries[key]
+	delete(m.entries, key)
+	return ok, nil
+}
+
+func (m *memory) all(context.Context) ([]Entry, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Entry, 0, len(m.entries))
+	for _, e := range m.entries {
+		if !e.expired(now, m.reset) {
+			out = append(out, *e)
+		}
+	}
+	return out, nil
+}
+
+// sweepLocked drops the entries that have expired. The caller must hold
+// m.mu.
+func (m *memory) sweepLocked(now time.Time) {
+	if now.Sub(m.swept) < sweepInterval {
+		return
+	}
+	m.swept = now
+	for key, e := range m.entries {
+		if e.expired(now, m.reset) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+// keyPrefix namespaces the penalty keys in a Redis database the proxy may
+// share.
+const keyPrefix = "fdo-proxy:penalty:"
+
+// failScript counts a failure in hash KEYS[1] and sets the ban it earns,
+// given After, Base, Max and Reset in ARGV (durations in milliseconds),
+// returning the failures and the ban's end and the failure's time in Unix
+// milliseconds. The key expires once it may be forgotten. Time is the
+// server's, so proxies with skewed clocks agree.
+var failScript = redis.NewScript(`
+local after, base, max, reset = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local n = redis.call('HINCRBY', KEYS[1], 'failures', 1)
+local ban = 0
+if n >= after then
+  ban = base
+  for _ = 1, n - after do
+    if ban >= max then break end
+    ban = ban * 2
+  end
+  ban = math.min(ban, max)
+  redis.call('HSET', KEYS[1], 'until', now + ban)
+end
+redis.call('HSET', KEYS[1], 'last', now)
+redis.call('PEXPIRE', KEYS[1], math.max(reset, ban))
+local u = redis.call('HGET', KEYS[1], 'until')
+return {n, tonumber(u) or 0, now}
+`)
+
+// redisStore keeps each entry in a hash of its own.
+type redisStore struct {
+	c *redis.Client
+}
+
+func (r *redisStore) fail(ctx context.Context, key string, o Options) (Entry, error) {
+	v, err := failScript.Run(ctx, r.c, []string{keyPrefix + key},
+		int64(o.After), o.Base.Milliseconds(), o.Max.Milliseconds(), o.Reset.Milliseconds())
+	if err != nil {
+		return Entry{}, err
+	}
+	arr, ok := v.([]any)
+	if !ok || len(arr) != 3 {
+		return Entry{}, errors.New("unexpected reply to penalty update")
+	}
+	n, _ := arr[0].(int64)
+	until, _ := arr[1].(int64)
+	last, _ := arr[2].(int64)
+	e := Entry{Key: key, Failures: int(n), LastFailure: time.UnixMilli(last)}
+	if until > 0 {
+		e.Until = time.UnixMilli(until)
+	}
+	return e, nil
+}
+
+func (r *redisStore) get(ctx context.Context, key string) (Entry, bool, error) {
+	v, err := r.c.Do(ctx, "HMGET", keyPrefix+key, "failures", "until", "last")
+	if err != nil {
+		return Entry{}, false, err
+	}
+	return parseEntry(key, v)
+}
+
+// parseEntry reads the reply to HMGET failures until last.
+func parseEntry(key string, v any) (Entry, bool, error) {
+	arr, ok := v.([]any)
+	if !ok || len(arr) != 3 {
+		return Entry{}, false, errors.New("unexpected reply to penalty lookup")
+	}
+	field := func(i int) int64 {
+		s, _ := arr[i].(string)
+		n, _ := strconv.ParseInt(s, 10, 64)
+		return n
+	}
+	if arr[0] == nil {
+		return Entry{}, false, nil
+	}
+	e := Entry{Key: key, Failures: int(field(0)), LastFailure: time.UnixMilli(field(2))}
+	if until := field(1); until > 0 {
+		e.Until = time.UnixMilli(until)
+	}
+	return e, true, nil
+}
+
+func (r *redisStore) remove(ctx context.Context, key string) (bool, error) {
+	v, err := r.c.Do(ctx, "DEL", keyPrefix+key)
+	if err != nil {
+		return false, err
+	}
+	n, _ := v.(int64)
+	return n > 0, nil
+}
+
+func (r *redisStore) all(ctx context.Context) ([]Entry, error) {
+	var out []Entry
+	cursor := "0"
+	for {
+		v, err := r.c.Do(ctx, "SCAN", cursor, "MATCH", keyPrefix+"*", "COUNT", 500)
+		if err != nil {
+			return nil, err
+		}
+		arr, ok := v.([]any)
+		if !ok || len(arr) != 2 {
+			return nil, errors.New("unexpected reply to SCAN")
+		}
+		cursor, _ = arr[0].(string)
+		keys, _ := arr[1].([]any)
+		for _, k := range keys {
+			name, _ := k.(string)
+			e, ok, err := r.get(ctx, name[len(keyPrefix):])
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				out = append(out, e)
+			}
+		}
+		if cursor == "0" {
+			return out, nil
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package pg
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Protocol version 3.0 and the SSLRequest code.
+const (
+	protocolVersion = 196608
+	sslRequestCode  = 80877103
+)
+
+// maxMessage bounds a backend message, guarding against a corrupt stream.
+const maxMessage = 1 << 30
+
+// conn is one connection speaking the frontend/backend protocol. It is
+// used by one goroutine at a time.
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  []byte
+	// start is where the message being written begins in w.
+	start int
+	cfg   *Config
+	// bad marks a connection whose protocol state is unknown after an I/O
+	// error or cancellation; it is closed rather than reused.
+	bad bool
+	// used is when the connection was last returned to the pool.
+	used time.Time
+}
+
+// dial connects and authenticates.
+func dial(ctx context.Context, cfg *Config) (*conn, error) {
+	d := net.Dialer{Timeout: cfg.ConnectTimeout}
+	nc, err := d.DialContext(ctx, "tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{nc: nc, cfg: cfg}
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	} else {
+		nc.SetDeadline(time.Now().Add(cfg.ConnectTimeout))
+	}
+	if err := c.startTLS(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	c.r = bufio.NewReader(c.nc)
+	if err := c.startup(); err != nil {
+		c.nc.Close()
+		return nil, err
+	}
+	c.nc.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// startTLS negotiates TLS as cfg.SSLMode asks.
+func (c *conn) startTLS() error {
+	if c.cfg.TLS == nil {
+		return nil
+	}
+	var req [8]byte
+	binary.BigEndian.PutUint32(req[0:], 8)
+	binary.BigEndian.PutUint32(req[4:], sslRequestCode)
+	if _, err := c.nc.Write(req[:]); err != nil {
+		return err
+	}
+	var resp [1]byte
+	if _, err := io.ReadFull(c.nc, resp[:]); err != nil {
+		return err
+	}
+	switch resp[0] {
+	case 'S':
+		tc := tls.Client(c.nc, c.cfg.TLS)
+		if err := tc.Handshake(); err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		c.nc = tc
+		return nil
+	case 'N':
+		if c.cfg.SSLMode == "prefer" {
+			return nil
+		}
+		return errors.New("server does not support TLS")
+	default:
+		return fmt.Errorf("unexpected SSLRequest response %q", resp[0])
+	}
+}
+
+// startup sends the startup message, authenticates and waits until the
+// server is ready for queries.
+func (c *conn) startup() error {
+	c.w = c.w[:0]
+	c.w = binary.BigEndian.AppendUint32(c.w, 0)
+	c.w = binary.BigEndian.AppendUint32(c.w, protocolVersion)
+	for _, kv := range [][2]string{{"user", c.cfg.User}, {"database", c.cfg.Database}, {"application_name", c.cfg.ApplicationName}, {"client_encoding", "UTF8"}} {
+		c.w = append(c.w, kv[0]...)
+		c.w = append(c.w, 0)
+		c.w = append(c.w, kv[1]...)
+		c.w = append(c.w, 0)
+	}
+	c.w = append(c.w, 0)
+	binary.BigEndian.PutUint32(c.w, uint32(len(c.w)))
+	_, err := c.nc.Write(c.w)
+	c.w = c.w[:0]
+	if err != nil {
+		return err
+	}
+
+	var sc *scram
+	for {
+		t, msg, err := c.recv()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case 'R':
+			if len(msg) < 4 {
+				return errors.New("short authentication message")
+			}
+			code, data := binary.BigEndian.Uint32(msg), msg[4:]
+			switch code {
+			case 0: // AuthenticationOk
+			case 3: // cleartext
+				c.begin('p')
+				c.str(c.cfg.Password)
+				if err := c.flush(); err != nil {
+					return err
+				}
+			case 5: // md5
+				if len(data) < 4 {
+					return errors.New("short md5 salt")
+				}
+				inner := md5.Sum([]byte(c.cfg.Password + c.cfg.User))
+				outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), data[:4]...))
+				c.begin('p')
+				c.str("md5" + hex.EncodeToString(outer[:]))
+				if err := c.flush(); err != nil {
+					return err
+				}
+			case 10: // SASL
+				if !containsMechanism(data, scramMechanism) {
+					return errors.New("server offers no supported SASL mechanism")
+				}
+				if sc, err = newSCRAM(c.cfg.Password); err != nil {
+					return err
+				}
+				first := sc.first()
+				c.begin('p')
+				c.str(scramMechanism)
+				c.w = binary.BigEndian.AppendUint32(c.w, uint32(len(first)))
+				c.w = append(c.w, first...)
+				if err := c.flush(); err != nil {
+					return err
+				}
+			case 11: // SASLContinue
+				if sc == nil {
+					return errors.New("unexpected SASL continuation")
+				}
+				final, err := sc.final(string(data))
+				if err != nil {
+					return err
+				}
+				c.begin('p')
+				c.w = append(c.w, final...)
+				if err := c.flush(); err != nil {
+					return err
+				}
+			case 12: // SASLFinal
+				if sc == nil {
+					return errors.New("unexpected SASL final message")
+				}
+				if err := sc.verify(string(data)); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("authentication method %d not supported", code)
+			}
+		case 'E':
+			return parseError(msg)
+		case 'Z':
+			return nil
+		}
+		// ParameterStatus, BackendKeyData and notices need no answer
+	}
+}
+
+func containsMechanism(list []byte, name string) bool {
+	for _, m := range strings.Split(string(list), "\x00") {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// query runs sql with args through the extended protocol, all values in
+// text format.
+func (c *conn) query(ctx context.Context, sql string, args []any) (*Result, error) {
+	params := make([][]byte, len(args))
+	for i, a := range args {
+		v, err := encode(a)
+		if err != nil {
+			return nil, fmt.Errorf("argument $%d: %w", i+1, err)
+		}
+		params[i] = v
+	}
+
+	defer c.watch(ctx)()
+
+	c.w = c.w[:0]
+	c.begin('P')
+	c.str("")
+	c.str(sql)
+	c.w = binary.BigEndian.AppendUint16(c.w, 0)
+	c.end()
+	c.begin('B')
+	c.str("")
+	c.str("")
+	c.w = binary.BigEndian.AppendUint16(c.w, 0)
+	c.w = binary.BigEndian.AppendUint16(c.w, uint16(len(params)))
+	for _, p := range params {
+		if p == nil {
+			c.w = binary.BigEndian.AppendUint32(c.w, ^uint32(0))
+			continue
+		}
+		c.w = binary.BigEndian.AppendUint32(c.w, uint32(len(p)))
+		c.w = append(c.w, p...)
+	}
+	c.w = binary.BigEndian.AppendUint16(c.w, 0)
+	c.end()
+	c.begin('D')
+	c.w = append(c.w, 'P')
+	c.str("")
+	c.end()
+	c.begin('E')
+	c.str("")
+	c.w = binary.BigEndian.AppendUint32(c.w, 0)
+	c.end()
+	c.begin('S')
+	if err := c.flush(); err != nil {
+		c.bad = true
+		return nil, ctxErr(ctx, err)
+	}
+	return c.results(ctx)
+}
+
+// script runs sql, which may hold several statements, through the simple
+// query protocol. It takes no arguments; the statements run in one
+// implicit transaction unless sql manages its own.
+func (c *conn) script(ctx context.Context, sql string) (*Result, error) {
+	defer c.watch(ctx)()
+	c.w = c.w[:0]
+	c.begin('Q')
+	c.str(sql)
+	if err := c.flush(); err != nil {
+		c.bad = true
+		return nil, ctxErr(ctx, err)
+	}
+	return c.results(ctx)
+}
+
+// watch makes a cancelled ctx interrupt blocked reads and writes until the
+// returned function is called.
+func (c *conn) watch(ctx context.Context) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.nc.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { c.nc.SetDeadline(time.Unix(1, 0)) })
+	return func() {
+		if !stop() {
+			c.bad = true
+		}
+		if !c.bad {
+			c.nc.SetDeadline(time.Time{})
+		}
+	}
+}
+
+// results reads the responses to a query up to ReadyForQuery. Rows of
+// several statements are collected together; the first error wins.
+func (c *conn) results(ctx context.Context) (*Result, error) {
+	res := &Result{}
+	var qerr error
+	for {
+		t, msg, err := c.recv()
+		if err != nil {
+			c.bad = true
+			return nil, ctxErr(ctx, err)
+		}
+		switch t {
+		case 'T':
+			res.Columns, err = parseRowDescription(msg)
+		case 'D':
+			var row []*string
+			row, err = parseDataRow(msg)
+			res.Rows = append(res.Rows, row)
+		case 'C':
+			res.Affected = commandRows(msg)
+		case 'E':
+			if qerr == nil {
+				qerr = parseError(msg)
+			}
+		case 'Z':
+			if qerr != nil {
+				return nil, qerr
+			}
+			return res, nil
+		}
+		// ParseComplete, BindComplete, NoData, EmptyQueryResponse,
+		// notices and parameter changes need no handling
+		if err != nil {
+			c.bad = true
+			return nil, err
+		}
+	}
+}
+
+// ctxErr prefers the context's error to the I/O error it caused.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (c *conn) close() error {
+	// Terminate is a courtesy; the server copes with a dropped connection
+	c.nc.SetDeadline(time.Now().Add(time.Second))
+	c.w = c.w[:0]
+	c.begin('X')
+	c.flush()
+	return c.nc.Close()
+}
+
+// begin starts a message of type t in the write buffer.
+func (c *conn) begin(t byte) {
+	c.start = len(c.w)
+	c.w = append(c.w, t, 0, 0, 0, 0)
+}
+
+// end fills in the length of the message begun last.
+func (c *conn) end() {
+	binary.BigEndian.PutUint32(c.w[c.start+1:], uint32(len(c.w)-c.start-1))
+}
+
+// flush ends the last message and sends the buffer.
+func (c *conn) flush() error {
+	c.end()
+	_, err := c.nc.Write(c.w)
+	c.w = c.w[:0]
+	return err
+}
+
+func (c *conn) str(s string) {
+	c.w = append(c.w, s...)
+	c.w = append(c.w, 0)
+}
+
+// recv reads one backend message.
+func (c *conn) recv() (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint32(hdr[1:]))
+	if n < 4 || n > maxMessage {
+		return 0, nil, fmt.Errorf("invalid message length %d", n)
+	}
+	msg := make([]byte, n-4)
+	if _, err := io.ReadFull(c.r, msg); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], msg, nil
+}
+
+func parseRowDescription(msg []byte) ([]string, error) {
+	if len(msg) < 2 {
+		return nil, errors.New("short row description")
+	}
+	n := int(binary.BigEndian.Uint16(msg))
+	msg = msg[2:]
+	cols := make([]string, n)
+	for i := range cols {
+		end := indexNUL(msg)
+		if end < 0 || len(msg) < end+1+18 {
+			return nil, errors.New("short row description")
+		}
+		cols[i] = string(msg[:end])
+		msg = msg[end+1+18:]
+	}
+	return cols, nil
+}
+
+func parseDataRow(msg []byte) ([]*string, error) {
+	if len(msg) < 2 {
+		return nil, errors.New("short data row")
+	}
+	n := int(binary.BigEndian.Uint16(msg))
+	msg = msg[2:]
+	row := make([]*string, n)
+	for i := range row {
+		if len(msg) < 4 {
+			return nil, errors.New("short data row")
+		}
+		l := int32(binary.BigEndian.Uint32(msg))
+		msg = msg[4:]
+		if l < 0 {
+			continue
+		}
+		if len(msg) < int(l) {
+			return nil, errors.New("short data row")
+		}
+		v := string(msg[:l])
+		row[i] = &v
+		msg = msg[l:]
+	}
+	return row, nil
+}
+
+// commandRows returns the row count at the end of a command tag such as
+// "UPDATE 3" or "INSERT 0 1", 0 if there is none.
+func commandRows(msg []byte) int64 {
+	tag := strings.TrimRight(string(msg), "\x00")
+	if i := strings.LastIndexByte(tag, ' '); i >= 0 {
+		if n, err := strconv.ParseInt(tag[i+1:], 10, 64); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+func indexNUL(b []byte) int {
+	for i, v := range b {
+		if v == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseError decodes an ErrorResponse.
+func parseError(msg []byte) *Error {
+	e := &Error{}
+	for len(msg) > 0 && msg[0] != 0 {
+		field := msg[0]
+		end := indexNUL(msg[1:])
+		if end < 0 {
+			break
+		}
+		v := string(msg[1 : 1+end])
+		msg = msg[2+end:]
+		switch field {
+		case 'S':
+			e.Severity = v
+		case 'C':
+			e.Code = v
+		case 'M':
+			e.Message = v
+		case 'D':
+			e.Detail = v
+		}
+	}
+	return e
+}
+
+// encode renders a query argument in text format; nil is NULL.
+func encode(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []byte(v), nil
+	case []byte:
+		if v == nil {
+			return nil, nil
+		}
+		return []byte(`\x` + hex.EncodeToString(v)), nil
+	case int:
+		return strconv.AppendInt(nil, int64(v), 10), nil
+	case int64:
+		return strconv.AppendInt(nil, v, 10), nil
+	case uint64:
+		return strconv.AppendUint(nil, v, 10), nil
+	case bool:
+		return strconv.AppendBool(nil, v), nil
+	case time.Time:
+		return []byte(v.UTC().Format(time.RFC3339Nano)), nil
+	default:
+		return nil, fmt.Errorf("unsupported type %T", v)
+	}
+}
@@ -0,0 +1,373 @@
+package pg
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backend is the server side of one connection in tests, speaking the
+// protocol from the other end.
+type backend struct {
+	t  *testing.T
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+// serve accepts connections on a local port and hands each to handle,
+// returning a URL for user with password.
+func serve(t *testing.T, password string, handle func(b *backend)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer nc.Close()
+				nc.SetDeadline(time.Now().Add(10 * time.Second))
+				handle(&backend{t: t, nc: nc, r: bufio.NewReader(nc)})
+			}()
+		}
+	}()
+	return fmt.Sprintf("postgres://app:%s@%s/fdo?sslmode=disable&pool_max_conns=1", password, ln.Addr())
+}
+
+// startup reads the startup message and returns its parameters.
+func (b *backend) startup() map[string]string {
+	var n uint32
+	if err := binary.Read(b.r, binary.BigEndian, &n); err != nil {
+		b.t.Errorf("read startup: %v", err)
+		return nil
+	}
+	msg := make([]byte, n-4)
+	if _, err := io.ReadFull(b.r, msg); err != nil {
+		b.t.Errorf("read startup: %v", err)
+		return nil
+	}
+	if v := binary.BigEndian.Uint32(msg); v != protocolVersion {
+		b.t.Errorf("protocol version = %d, want %d", v, protocolVersion)
+	}
+	params := make(map[string]string)
+	fields := strings.Split(string(msg[4:]), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		params[fields[i]] = fields[i+1]
+	}
+	return params
+}
+
+// recv reads one frontend message.
+func (b *backend) recv() (byte, []byte) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(b.r, hdr[:]); err != nil {
+		return 0, nil
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(hdr[1:])-4)
+	if _, err := io.ReadFull(b.r, msg); err != nil {
+		return 0, nil
+	}
+	return hdr[0], msg
+}
+
+// send writes one backend message.
+func (b *backend) send(t byte, body ...[]byte) {
+	msg := []byte{t, 0, 0, 0, 0}
+	for _, p := range body {
+		msg = append(msg, p...)
+	}
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(msg)-1))
+	b.nc.Write(msg)
+}
+
+func u32(n int) []byte { return binary.BigEndian.AppendUint32(nil, uint32(n)) }
+
+func cstr(s string) []byte { return append([]byte(s), 0) }
+
+// authSCRAM runs the server side of SCRAM-SHA-256, checking the client's
+// proof against password, and reports whether it matched.
+func (b *backend) authSCRAM(password string) bool {
+	b.send('R', u32(10), cstr(scramMechanism), []byte{0})
+	t, msg := b.recv()
+	mech, rest, _ := strings.Cut(string(msg), "\x00")
+	if t != 'p' || mech != scramMechanism || len(rest) < 4 {
+		b.t.Errorf("SASLInitialResponse = %c %q", t, msg)
+		return false
+	}
+	clientFirst := rest[4:]
+	bare, ok := strings.CutPrefix(clientFirst, "n,,")
+	if !ok {
+		b.t.Errorf("client-first-message %q has no gs2 header", clientFirst)
+		return false
+	}
+	nonce := scramAttrs(bare)["r"] + "server-nonce"
+	salt := []byte("0123456789abcdef")
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=4096", nonce, base64.StdEncoding.EncodeToString(salt))
+	b.send('R', u32(11), []byte(serverFirst))
+
+	t, msg = b.recv()
+	if t != 'p' {
+		b.t.Errorf("SASLResponse type = %c", t)
+		return false
+	}
+	clientFinal := string(msg)
+	withoutProof, proof64, _ := strings.Cut(clientFinal, ",p=")
+	if withoutProof != "c=biws,r="+nonce {
+		b.t.Errorf("client-final-message = %q", clientFinal)
+		return false
+	}
+	salted, _ := pbkdf2.Key(sha256.New, password, salt, 4096, sha256.Size)
+	authMessage := bare + "," + serverFirst + "," + withoutProof
+	storedKey := sha256.Sum256(hmacSHA256(salted, "Client Key"))
+	proof, _ := base64.StdEncoding.DecodeString(proof64)
+	sig := hmacSHA256(storedKey[:], authMessage)
+	if len(proof) != len(sig) {
+		return false
+	}
+	for i := range proof {
+		proof[i] ^= sig[i]
+	}
+	if got := sha256.Sum256(proof); !hmac.Equal(got[:], storedKey[:]) {
+		return false
+	}
+	serverSig := hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage)
+	b.send('R', u32(12), []byte("v="+base64.StdEncoding.EncodeToString(serverSig)))
+	b.send('R', u32(0))
+	b.send('S', cstr("server_version"), cstr("16.2"))
+	b.send('K', u32(1234), u32(5678))
+	b.send('Z', []byte{'I'})
+	return true
+}
+
+// query is one extended-protocol query as the backend received it.
+type query struct {
+	sql    string
+	params []*string
+}
+
+// queries reads Parse, Bind, Describe, Execute and Sync until the client
+// terminates, answering each query with answer.
+func (b *backend) queries(answer func(q query)) {
+	var q query
+	for {
+		t, msg := b.recv()
+		switch t {
+		case 'P':
+			// Unnamed statement, then the SQL
+			q.sql = strings.TrimSuffix(string(msg[1:indexNUL(msg[1:])+1]), "\x00")
+		case 'B':
+			q.params = parseBind(msg)
+		case 'S':
+			b.send('1')
+			b.send('2')
+			answer(q)
+			b.send('Z', []byte{'I'})
+			q = query{}
+		case 'D', 'E':
+		case 'X', 0:
+			return
+		default:
+			b.t.Errorf("unexpected frontend message %c", t)
+			return
+		}
+	}
+}
+
+// parseBind returns the parameters of a Bind message for the unnamed
+// portal and statement.
+func parseBind(msg []byte) []*string {
+	msg = msg[2:] // portal and statement names
+	formats := int(binary.BigEndian.Uint16(msg))
+	msg = msg[2+2*formats:]
+	n := int(binary.BigEndian.Uint16(msg))
+	msg = msg[2:]
+	params := make([]*string, n)
+	for i := range params {
+		l := int32(binary.BigEndian.Uint32(msg))
+		msg = msg[4:]
+		if l < 0 {
+			continue
+		}
+		v := string(msg[:l])
+		params[i] = &v
+		msg = msg[l:]
+	}
+	return params
+}
+
+// rowDescription describes text columns named cols.
+func rowDescription(cols ...string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(cols)))
+	for _, c := range cols {
+		b = append(b, cstr(c)...)
+		b = append(b, make([]byte, 18)...)
+	}
+	return b
+}
+
+// dataRow encodes values; nil is NULL.
+func dataRow(values ...*string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(values)))
+	for _, v := range values {
+		if v == nil {
+			b = binary.BigEndian.AppendUint32(b, ^uint32(0))
+			continue
+		}
+		b = binary.BigEndian.AppendUint32(b, uint32(len(*v)))
+		b = append(b, *v...)
+	}
+	return b
+}
+
+func ptr(s string) *string { return &s }
+
+func TestQueryOverSCRAM(t *testing.T) {
+	got := make(chan query, 4)
+	dsn := serve(t, "s3cret", func(b *backend) {
+		params := b.startup()
+		if params["user"] != "app" || params["database"] != "fdo" || params["client_encoding"] != "UTF8" {
+			t.Errorf("startup parameters = %v", params)
+		}
+		if !b.authSCRAM("s3cret") {
+			t.Error("client proof does not match the password")
+			return
+		}
+		b.queries(func(q query) {
+			got <- q
+			switch q.sql {
+			case "SELECT 1":
+				b.send('C', cstr("SELECT 1"))
+			case "SELECT a, b FROM t WHERE x = $1 AND y = $2 AND z = $3":
+				b.send('T', rowDescription("a", "b"))
+				b.send('D', dataRow(ptr("one"), nil))
+				b.send('D', dataRow(ptr(""), ptr("two")))
+				b.send('C', cstr("SELECT 2"))
+			case "UPDATE t SET x = 1":
+				b.send('C', cstr("UPDATE 3"))
+			default:
+				b.send('E', cstr("SERROR"), cstr("C42P01"), cstr("Mrelation \"nope\" does not exist"), []byte{0})
+			}
+		})
+	})
+
+	ctx := context.Background()
+	db, err := Open(ctx, dsn)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	<-got // Open's own SELECT 1
+
+	res, err := db.Query(ctx, "SELECT a, b FROM t WHERE x = $1 AND y = $2 AND z = $3", "x'y", nil, 42)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	q := <-got
+	if len(q.params) != 3 || *q.params[0] != "x'y" || q.params[1] != nil || *q.params[2] != "42" {
+		t.Errorf("bound parameters = %v", q.params)
+	}
+	if strings.Join(res.Columns, ",") != "a,b" || len(res.Rows) != 2 {
+		t.Fatalf("result = %v, %d rows", res.Columns, len(res.Rows))
+	}
+	if r := res.Rows[0]; *r[0] != "one" || r[1] != nil {
+		t.Errorf("row 0 = %v", r)
+	}
+	if r := res.Rows[1]; *r[0] != "" || *r[1] != "two" {
+		t.Errorf("row 1 = %v", r)
+	}
+
+	n, err := db.Exec(ctx, "UPDATE t SET x = 1")
+	if err != nil || n != 3 {
+		t.Errorf("Exec = %d, %v, want 3", n, err)
+	}
+	<-got
+
+	_, err = db.Query(ctx, "SELECT * FROM nope")
+	var pgErr *Error
+	if !errors.As(err, &pgErr) || pgErr.Code != "42P01" || pgErr.Severity != "ERROR" {
+		t.Errorf("Query error = %v, want SQLSTATE 42P01", err)
+	}
+	<-got
+	// The connection is still usable after a server error
+	if _, err := db.Exec(ctx, "UPDATE t SET x = 1"); err != nil {
+		t.Errorf("Exec after error: %v", err)
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	dsn := serve(t, "wrong", func(b *backend) {
+		b.startup()
+		if b.authSCRAM("s3cret") {
+			t.Error("proof for the wrong password matched")
+			return
+		}
+		b.send('E', cstr("SFATAL"), cstr("C28P01"), cstr("Mpassword authentication failed"), []byte{0})
+	})
+	_, err := Open(context.Background(), dsn)
+	var pgErr *Error
+	if !errors.As(err, &pgErr) || pgErr.Code != "28P01" {
+		t.Errorf("Open error = %v, want SQLSTATE 28P01", err)
+	}
+}
+
+func TestForgedServerSignature(t *testing.T) {
+	dsn := serve(t, "s3cret", func(b *backend) {
+		b.startup()
+		b.send('R', u32(10), cstr(scramMechanism), []byte{0})
+		_, msg := b.recv()
+		_, rest, _ := strings.Cut(string(msg), "\x00")
+		nonce := scramAttrs(rest[4+3:])["r"] + "x"
+		b.send('R', u32(11), []byte("r="+nonce+",s=MDEyMzQ1Njc4OWFiY2RlZg==,i=4096"))
+		b.recv()
+		// A server that does not know the password cannot sign
+		b.send('R', u32(12), []byte("v=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="))
+		b.send('R', u32(0))
+		b.send('Z', []byte{'I'})
+	})
+	if _, err := Open(context.Background(), dsn); err == nil || !strings.Contains(err.Error(), "server signature") {
+		t.Errorf("Open error = %v, want a server signature mismatch", err)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		v    any
+		want string
+	}{
+		{"text", "text"},
+		{[]byte{0xde, 0xad}, `\xdead`},
+		{-7, "-7"},
+		{int64(1) << 40, "1099511627776"},
+		{uint64(18446744073709551615), "18446744073709551615"},
+		{true, "true"},
+		{time.Date(2026, 1, 2, 3, 4, 5, 600, time.FixedZone("", 3600)), "2026-01-02T02:04:05.0000006Z"},
+	}
+	for _, tt := range tests {
+		b, err := encode(tt.v)
+		if err != nil || string(b) != tt.want {
+			t.Errorf("encode(%v) = %q, %v, want %q", tt.v, b, err, tt.want)
+		}
+	}
+	if b, err := encode(nil); b != nil || err != nil {
+		t.Errorf("encode(nil) = %q, %v, want NULL", b, err)
+	}
+	if _, err := encode(1.5); err == nil {
+		t.Error("encode(1.5) succeeded")
+	}
+}
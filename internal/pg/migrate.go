@@ -0,0 +1,241 @@
+package pg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationLock is the advisory lock key held while migrating, so proxies
+// starting together apply each migration once ("fdo-migr").
+const migrationLock = 0x66646f2d6d696772
+
+// migrationsTable records the migrations applied to a database.
+const migrationsTable = "fdo_proxy_schema_migrations"
+
+// Migration is one versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	// Up applies the change and Down reverts it; Down may be empty for a
+	// change that cannot be reverted.
+	Up   string
+	Down string
+}
+
+// LoadMigrations reads the migrations in dir of fsys, named as for
+// golang-migrate: <version>_<name>.up.sql and <version>_<name>.down.sql,
+// e.g. 0002_ledger_outbox.up.sql. Every version needs an up file; versions
+// must be unique and are applied in order.
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	ents, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("read migrations: %w", err)
+	}
+	byVersion := make(map[int]*Migration)
+	for _, e := range ents {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		base, dirn, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		if !ok || dirn != "up" && dirn != "down" {
+			return nil, fmt.Errorf("migration %s: name must end in .up.sql or .down.sql", name)
+		}
+		v, label, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(v)
+		if !ok || err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s: name must start with a positive version and _", name)
+		}
+		b, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("read migration %s: %w", name, err)
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		} else if m.Name != label {
+			return nil, fmt.Errorf("migration %d named both %s and %s", version, m.Name, label)
+		}
+		if dirn == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+	out := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// MigrationState is a migration and whether it is applied.
+type MigrationState struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	AppliedAt time.Time `json:"applied_at,omitzero"`
+	// Unknown marks a version applied to the database that is not among
+	// the migrations given, i.e. from a newer build.
+	Unknown bool `json:"unknown,omitempty"`
+}
+
+// ErrSchemaNewer is returned when the database has migrations this build
+// does not know, so it was migrated by a newer build.
+var ErrSchemaNewer = errors.New("database schema is newer than this build")
+
+// MigrationStatus lists ms with when each was applied to db, followed by
+// any applied versions ms does not include.
+func (db *DB) MigrationStatus(ctx context.Context, ms []Migration) ([]MigrationState, error) {
+	var out []MigrationState
+	err := db.Tx(ctx, func(tx *Tx) error {
+		applied, err := appliedMigrations(ctx, tx)
+		if err != nil {
+			return err
+		}
+		out = migrationStates(ms, applied)
+		return nil
+	})
+	return out, err
+}
+
+// Migrate brings db to version target of ms, applying up migrations in
+// order or reverting down to it, each in its own transaction, under a lock
+// so concurrent callers wait rather than apply a migration twice. A
+// negative target means the latest. It returns the migrations run; on an
+// error those before it stay done.
+func (db *DB) Migrate(ctx context.Context, ms []Migration, target int) ([]MigrationState, error) {
+	if target < 0 && len(ms) > 0 {
+		target = ms[len(ms)-1].Version
+	} else if target < 0 {
+		target = 0
+	}
+	if target != 0 && !slices.ContainsFunc(ms, func(m Migration) bool { return m.Version == target }) {
+		return nil, fmt.Errorf("no migration %d", target)
+	}
+
+	var done []MigrationState
+	for {
+		ran := false
+		err := db.Tx(ctx, func(tx *Tx) error {
+			if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(migrationLock)); err != nil {
+				return err
+			}
+			applied, err := appliedMigrations(ctx, tx)
+			if err != nil {
+				return err
+			}
+			for _, st := range migrationStates(ms, applied) {
+				if st.Unknown {
+					return fmt.Errorf("%w: migration %d is applied", ErrSchemaNewer, st.Version)
+				}
+			}
+			m, up, ok := nextMigration(ms, applied, target)
+			if !ok {
+				return nil
+			}
+			if up {
+				if err := tx.Script(ctx, m.Up); err != nil {
+					return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+				}
+				if _, err := tx.Exec(ctx, `INSERT INTO `+migrationsTable+` (version, name) VALUES ($1, $2)`, m.Version, m.Name); err != nil {
+					return err
+				}
+			} else {
+				if m.Down == "" {
+					return fmt.Errorf("migration %d_%s cannot be reverted", m.Version, m.Name)
+				}
+				if err := tx.Script(ctx, m.Down); err != nil {
+					return fmt.Errorf("revert migration %d_%s: %w", m.Version, m.Name, err)
+				}
+				if _, err := tx.Exec(ctx, `DELETE FROM `+migrationsTable+` WHERE version = $1`, m.Version); err != nil {
+					return err
+				}
+			}
+			done = append(done, MigrationState{Version: m.Version, Name: m.Name, AppliedAt: time.Now().UTC()})
+			ran = true
+			return nil
+		})
+		if err != nil || !ran {
+			return done, err
+		}
+	}
+}
+
+// nextMigration returns the migration to apply (up) or revert next to reach
+// target, if any.
+func nextMigration(ms []Migration, applied map[int]MigrationState, target int) (Migration, bool, bool) {
+	for _, m := range ms {
+		if _, ok := applied[m.Version]; !ok && m.Version <= target {
+			return m, true, true
+		}
+	}
+	for i := len(ms) - 1; i >= 0; i-- {
+		if _, ok := applied[ms[i].Version]; ok && ms[i].Version > target {
+			return ms[i], false, true
+		}
+	}
+	return Migration{}, false, false
+}
+
+// appliedMigrations returns the versions applied, creating the table that
+// records them if needed.
+func appliedMigrations(ctx context.Context, tx *Tx) (map[int]MigrationState, error) {
+	_, err := tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+migrationsTable+` (
+		version bigint PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("create %s: %w", migrationsTable, err)
+	}
+	res, err := tx.Query(ctx, `SELECT version, name, to_char(applied_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') FROM `+migrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]MigrationState, len(res.Rows))
+	for _, row := range res.Rows {
+		v, err := strconv.Atoi(*row[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid version %q", migrationsTable, *row[0])
+		}
+		at, _ := time.Parse(time.RFC3339, *row[2])
+		applied[v] = MigrationState{Version: v, Name: *row[1], AppliedAt: at}
+	}
+	return applied, nil
+}
+
+// migrationStates merges ms with the applied versions.
+func migrationStates(ms []Migration, applied map[int]MigrationState) []MigrationState {
+	out := make([]MigrationState, 0, len(ms))
+	known := make(map[int]bool, len(ms))
+	for _, m := range ms {
+		known[m.Version] = true
+		out = append(out, MigrationState{Version: m.Version, Name: m.Name, AppliedAt: applied[m.Version].AppliedAt})
+	}
+	var unknown []int
+	for v := range applied {
+		if !known[v] {
+			unknown = append(unknown, v)
+		}
+	}
+	sort.Ints(unknown)
+	for _, v := range unknown {
+		st := applied[v]
+		st.Unknown = true
+		out = append(out, st)
+	}
+	return out
+}
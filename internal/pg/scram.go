@@ -0,0 +1,108 @@
+package pg
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// scramMechanism is the only SASL mechanism supported.
+const scramMechanism = "SCRAM-SHA-256"
+
+// scram is the client side of a SCRAM-SHA-256 exchange (RFC 5802, RFC
+// 7677). PostgreSQL takes the user from the startup message, so the
+// username attribute is left empty.
+type scram struct {
+	password    string
+	clientNonce string
+
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+func newSCRAM(password string) (*scram, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &scram{password: password, clientNonce: base64.RawStdEncoding.EncodeToString(nonce)}, nil
+}
+
+// first returns the client-first-message.
+func (s *scram) first() string {
+	s.clientFirstBare = "n=,r=" + s.clientNonce
+	return "n,," + s.clientFirstBare
+}
+
+// final answers the server-first-message with the client-final-message.
+func (s *scram) final(serverFirst string) (string, error) {
+	attrs := scramAttrs(serverFirst)
+	nonce, salt64, iter := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(nonce, s.clientNonce) || len(nonce) == len(s.clientNonce) {
+		return "", errors.New("scram: server nonce does not extend ours")
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return "", fmt.Errorf("scram: salt: %w", err)
+	}
+	n, err := strconv.Atoi(iter)
+	if err != nil || n < 1 {
+		return "", fmt.Errorf("scram: invalid iteration count %q", iter)
+	}
+	s.saltedPassword, err = pbkdf2.Key(sha256.New, s.password, salt, n, sha256.Size)
+	if err != nil {
+		return "", fmt.Errorf("scram: %w", err)
+	}
+
+	withoutProof := "c=biws,r=" + nonce
+	s.authMessage = s.clientFirstBare + "," + serverFirst + "," + withoutProof
+	clientKey := hmacSHA256(s.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof := hmacSHA256(storedKey[:], s.authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verify checks the server-final-message, proving the server knew the
+// password too.
+func (s *scram) verify(serverFinal string) error {
+	attrs := scramAttrs(serverFinal)
+	if e := attrs["e"]; e != "" {
+		return fmt.Errorf("scram: server: %s", e)
+	}
+	got, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil {
+		return fmt.Errorf("scram: server signature: %w", err)
+	}
+	serverKey := hmacSHA256(s.saltedPassword, "Server Key")
+	if !hmac.Equal(got, hmacSHA256(serverKey, s.authMessage)) {
+		return errors.New("scram: server signature does not match")
+	}
+	return nil
+}
+
+// scramAttrs splits a SCRAM message into its attributes.
+func scramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range strings.Split(msg, ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
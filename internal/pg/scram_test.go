@@ -0,0 +1,67 @@
+package pg
+
+import "testing"
+
+// The SCRAM-SHA-256 exchange of RFC 7677, section 3: user "user", password
+// "pencil".
+const (
+	rfc7677ClientNonce = "rOprNGfwEbeRWgbNEkqO"
+	rfc7677ServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfc7677ClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfc7677ServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+// rfc7677 returns the client of the RFC's exchange after its first
+// message. PostgreSQL leaves the username out, the RFC does not, so the
+// bare message is set as the RFC has it.
+func rfc7677(t *testing.T) *scram {
+	t.Helper()
+	s := &scram{password: "pencil", clientNonce: rfc7677ClientNonce}
+	if got, want := s.first(), "n,,n=,r="+rfc7677ClientNonce; got != want {
+		t.Fatalf("first() = %q, want %q", got, want)
+	}
+	s.clientFirstBare = "n=user,r=" + rfc7677ClientNonce
+	return s
+}
+
+func TestSCRAMRFC7677(t *testing.T) {
+	s := rfc7677(t)
+	final, err := s.final(rfc7677ServerFirst)
+	if err != nil {
+		t.Fatalf("final: %v", err)
+	}
+	if final != rfc7677ClientFinal {
+		t.Errorf("final = %q, want %q", final, rfc7677ClientFinal)
+	}
+	if err := s.verify(rfc7677ServerFinal); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+}
+
+func TestSCRAMWrongServerSignature(t *testing.T) {
+	s := rfc7677(t)
+	if _, err := s.final(rfc7677ServerFirst); err != nil {
+		t.Fatalf("final: %v", err)
+	}
+	if err := s.verify("v=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="); err == nil {
+		t.Error("verify accepted a wrong server signature")
+	}
+	if err := s.verify("e=invalid-proof"); err == nil {
+		t.Error("verify accepted a server error")
+	}
+}
+
+func TestSCRAMBadServerFirst(t *testing.T) {
+	for _, msg := range []string{
+		// The nonce must extend the client's
+		"r=someoneElse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"r=" + rfc7677ClientNonce + ",s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"r=" + rfc7677ClientNonce + "x,s=not base64!,i=4096",
+		"r=" + rfc7677ClientNonce + "x,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0",
+		"r=" + rfc7677ClientNonce + "x,s=W22ZaJ0SNY7soEsUEjb6gQ==",
+	} {
+		if _, err := rfc7677(t).final(msg); err == nil {
+			t.Errorf("final(%q) succeeded", msg)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Package pipeline composes the proxy's middleware chain from a declarative
+// list of named stages, each built by a registered factory from its own
+// options.
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/fdo-server-wrapper/internal/proxy"
+)
+
+// Stage is one middleware in the chain.
+type Stage struct {
+	// Name selects the factory building the middleware.
+	Name string `json:"name"`
+	// Options are handed to the factory as is.
+	Options json.RawMessage `json:"options,omitempty"`
+	// Disabled leaves the stage out without deleting its options.
+	Disabled bool `json:"disabled,omitempty"`
+	// Match, if set, restricts the middleware to some FDO exchanges.
+	Match *proxy.Match `json:"match,omitempty"`
+}
+
+// Config is the pipeline file, e.g.
+//
+//	{"middleware": [
+//	  {"name": "di", "options": {"duplicates": "block"}},
+//	  {"name": "serviceinfo"},
+//	  {"name": "to2", "options": {"detect_guid_reuse": true},
+//	   "match": {"sources": ["10.20.0.0/16"]}}
+//	]}
+type Config struct {
+	Middleware []Stage `json:"middleware"`
+}
+
+// Factory builds the middleware for a stage from its options. It returns
+// either a proxy.Middleware or a value implementing one or more of the
+// typed handler interfaces in package proxy.
+type Factory func(options json.RawMessage) (any, error)
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a middleware available to pipelines under name. Custom
+// middleware typically registers itself from an init function. It panics
+// if name is already registered.
+func Register(name string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := factories[name]; dup {
+		panic("pipeline: Register called twice for " + name)
+	}
+	factories[name] = f
+}
+
+// Names returns the registered middleware names, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Load reads a pipeline file.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read pipeline: %w", err)
+	}
+	var c Config
+	if err := DecodeOptions(b, &c); err != nil {
+		return nil, fmt.Errorf("parse pipeline %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// DecodeOptions decodes options into v, which factories prefill with their
+// defaults. Unknown fields are an error so typos do not pass silently.
+func DecodeOptions(options json.RawMessage, v any) error {
+	if len(bytes.TrimSpace(options)) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(options))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// Build constructs the middleware for stages, in order. Consecutive typed
+// handlers without a match share one proxy.Dispatcher, so a message is
+// decoded once for all of them. Each dispatcher inspects at most
+// inspectLimit bytes of a body (see proxy.Dispatcher.LimitInspection).
+func Build(stages []Stage, inspectLimit int) ([]proxy.Middleware, error) {
+	var (
+		chain    []proxy.Middleware
+		handlers []any
+	)
+	flush := func() error {
+		if len(handlers) == 0 {
+			return nil
+		}
+		d, err := proxy.NewDispatcher(handlers...)
+		if err != nil {
+			return err
+		}
+		d.LimitInspection(inspectLimit)
+		chain = append(chain, d)
+		handlers = nil
+		return nil
+	}
+
+	for i, st := range stages {
+		if st.Disabled {
+			continue
+		}
+		if st.Match != nil {
+			if err := st.Match.Validate(); err != nil {
+				return nil, fmt.Errorf("pipeline: middleware %d (%s): match: %w", i, st.Name, err)
+			}
+		}
+		mu.RLock()
+		f, ok := factories[st.Name]
+		mu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("pipeline: middleware %d: unknown name %q", i, st.Name)
+		}
+		m, err := f(st.Options)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline: middleware %d (%s): %w", i, st.Name, err)
+		}
+		raw, ok := m.(proxy.Middleware)
+		if !ok {
+			d, err := proxy.NewDispatcher(m)
+			if err != nil {
+				return nil, fmt.Errorf("pipeline: middleware %d (%s): %w", i, st.Name, err)
+			}
+			if st.Match == nil {
+				handlers = append(handlers, m)
+				continue
+			}
+			d.LimitInspection(inspectLimit)
+			raw = d
+		}
+		if err := flush(); err != nil {
+			return nil, fmt.Errorf("pipeline: %w", err)
+		}
+		if st.Match != nil {
+			raw = proxy.When(raw, st.Match)
+		}
+		chain = append(chain, raw)
+	}
+	if err := flush(); err != nil {
+		return nil, fmt.Errorf("pipeline: %w", err)
+	}
+	return chain, nil
+}
@@ -0,0 +1,396 @@
+// Package policy scopes proxy behaviour to device tags and owners: passport
+// and attestation enforcement, onboarding rate limits, maintenance windows,
+// geofences and where commissioning passports are sent can differ per group
+// or tenant, e.g. prototype units skipping passport enforcement.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/ratelimit"
+	"github.com/fdo-server-wrapper/internal/tags"
+)
+
+// Passport enforcement modes. The empty mode follows
+// -enable-product-passport.
+const (
+	// PassportRequire looks the product passport up during DI and refuses
+	// devices it cannot be found for.
+	PassportRequire = "require"
+	// PassportSkip never looks the product passport up.
+	PassportSkip = "skip"
+)
+
+// AttestationSkip leaves the attestation verifier out for matching devices.
+const AttestationSkip = "skip"
+
+// Geofence actions. The empty action is GeofenceFlag.
+const (
+	// GeofenceFlag logs and counts TO2 from outside the fence.
+	GeofenceFlag = "flag"
+	// GeofenceReject refuses TO2 from outside the fence.
+	GeofenceReject = "reject"
+)
+
+// Window scopes. The empty scope is WindowOnboarding.
+const (
+	// WindowOnboarding refuses DI and TO2 outside the windows.
+	WindowOnboarding = "onboarding"
+	// WindowEnforcement refuses only the steps that enforce something
+	// outside the windows: product passport lookups and attestation
+	// verification.
+	WindowEnforcement = "enforcement"
+)
+
+// Policy is the behaviour applied to devices carrying any of its tags or
+// belonging to any of its owners. A nil *Policy applies the proxy's
+// defaults.
+type Policy struct {
+	Name string `json:"name"`
+	// Tags select the devices: a device matches when it has any of them.
+	Tags []string `json:"tags,omitempty"`
+	// Owners select the devices of these owners (tenants) too.
+	Owners []string `json:"owners,omitempty"`
+
+	// Passport is PassportRequire, PassportSkip or empty.
+	Passport string `json:"passport,omitempty"`
+	// Attestation is AttestationSkip or empty.
+	Attestation string `json:"attestation,omitempty"`
+	// RateLimit bounds how fast matching devices start DI and TO2.
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+	// CommissioningURL receives the commissioning passports of matching
+	// devices instead of -commissioning-url.
+	CommissioningURL string `json:"commissioning_url,omitempty"`
+	// SkipCommissioning creates no commissioning passport for matching
+	// devices.
+	SkipCommissioning bool `json:"skip_commissioning,omitempty"`
+	// Windows are when matching devices may onboard; none means always.
+	Windows []*Window `json:"windows,omitempty"`
+	// WindowScope is WindowOnboarding, WindowEnforcement or empty.
+	WindowScope string `json:"window_scope,omitempty"`
+	// Geofence is where matching devices may run TO2 from.
+	Geofence *Geofence `json:"geofence,omitempty"`
+
+	rate    ratelimit.Rate
+	limiter ratelimit.Limiter
+}
+
+// Geofence lists the countries and networks devices are expected to
+// onboard from. A device is inside when its source address is in one of
+// Networks or located in one of Countries.
+type Geofence struct {
+	// Countries are ISO 3166-1 alpha-2 codes, located through a GeoIP
+	// database.
+	Countries []string       `json:"countries,omitempty"`
+	Networks  []netip.Prefix `json:"networks,omitempty"`
+	// Action is GeofenceFlag, GeofenceReject or empty.
+	Action string `json:"action,omitempty"`
+}
+
+// Window is a daily time range, e.g. weekdays from 08:00 to 18:00. An end
+// before the start runs past midnight into the next day.
+type Window struct {
+	// Days are the days the window opens on, "mon" to "sun"; none means
+	// every day.
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	// TZ is the IANA time zone of Start and End, UTC if empty.
+	TZ string `json:"tz,omitempty"`
+
+	days       [7]bool
+	start, end time.Duration
+	loc        *time.Location
+}
+
+// RateLimit is a token bucket shared by every device of a policy.
+type RateLimit struct {
+	PerMinute float64 `json:"per_minute"`
+	// Burst is how many devices may start at once; 0 is a minute's worth.
+	Burst int `json:"burst,omitempty"`
+}
+
+// Set is the ordered list of policies of a policy file. A nil *Set has
+// none.
+type Set struct {
+	Policies []*Policy `json:"policies"`
+}
+
+// Load reads a policy file of the form
+//
+//	{"policies": [
+//	  {"name": "prototypes", "tags": ["prototype"], "passport": "skip", "skip_commissioning": true},
+//	  {"name": "sku-a", "tags": ["sku-a"], "rate_limit": {"per_minute": 30}},
+//	  {"name": "tenant-b", "owners": ["tenant-b"], "windows": [{"days": ["mon", "tue", "wed", "thu", "fri"], "start": "08:00", "end": "18:00", "tz": "Europe/Berlin"}]}
+//	]}
+//
+// Policies are tried in order and the first matching a device applies.
+func Load(path string) (*Set, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read policies: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var s Set
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("parse policies: %w", err)
+	}
+	names := make(map[string]bool)
+	local := ratelimit.NewLocal()
+	for i, p := range s.Policies {
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("policy %d: %w", i, err)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("policy %d: duplicate name %q", i, p.Name)
+		}
+		names[p.Name] = true
+		if r := p.RateLimit; r != nil {
+			p.rate = ratelimit.PerMinute(r.PerMinute, r.Burst)
+		}
+		p.limiter = local
+	}
+	return &s, nil
+}
+
+func (p *Policy) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if len(p.Tags) == 0 && len(p.Owners) == 0 {
+		return fmt.Errorf("%s: no tags or owners", p.Name)
+	}
+	for _, t := range p.Tags {
+		if !tags.Valid(t) {
+			return fmt.Errorf("%s: invalid tag %q", p.Name, t)
+		}
+	}
+	switch p.Passport {
+	case "", PassportRequire, PassportSkip:
+	default:
+		return fmt.Errorf("%s: invalid passport %q: want require or skip", p.Name, p.Passport)
+	}
+	switch p.Attestation {
+	case "", AttestationSkip:
+	default:
+		return fmt.Errorf("%s: invalid attestation %q: want skip", p.Name, p.Attestation)
+	}
+	if r := p.RateLimit; r != nil && (r.PerMinute <= 0 || r.Burst < 0) {
+		return fmt.Errorf("%s: rate_limit needs a positive per_minute and burst", p.Name)
+	}
+	if p.SkipCommissioning && p.CommissioningURL != "" {
+		return fmt.Errorf("%s: commissioning_url and skip_commissioning exclude each other", p.Name)
+	}
+	if g := p.Geofence; g != nil {
+		if len(g.Countries) == 0 && len(g.Networks) == 0 {
+			return fmt.Errorf("%s: geofence needs countries or networks", p.Name)
+		}
+		switch g.Action {
+		case "", GeofenceFlag, GeofenceReject:
+		default:
+			return fmt.Errorf("%s: invalid geofence action %q: want flag or reject", p.Name, g.Action)
+		}
+		for i, c := range g.Countries {
+			if len(c) != 2 {
+				return fmt.Errorf("%s: invalid geofence country %q: want a two-letter code", p.Name, c)
+			}
+			g.Countries[i] = strings.ToUpper(c)
+		}
+	}
+	switch p.WindowScope {
+	case "", WindowOnboarding, WindowEnforcement:
+	default:
+		return fmt.Errorf("%s: invalid window_scope %q: want onboarding or enforcement", p.Name, p.WindowScope)
+	}
+	for i, w := range p.Windows {
+		if err := w.parse(); err != nil {
+			return fmt.Errorf("%s: window %d: %w", p.Name, i, err)
+		}
+	}
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (w *Window) parse() error {
+	if w == nil {
+		return fmt.Errorf("empty window")
+	}
+	for _, d := range w.Days {
+		wd, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return fmt.Errorf("invalid day %q: want mon to sun", d)
+		}
+		w.days[wd] = true
+	}
+	if len(w.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	var err error
+	if w.start, err = clock(w.Start); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+	if w.end, err = clock(w.End); err != nil {
+		return fmt.Errorf("end: %w", err)
+	}
+	if w.start == w.end {
+		return fmt.Errorf("start and end are both %s", w.Start)
+	}
+	if w.loc, err = time.LoadLocation(w.TZ); err != nil {
+		return fmt.Errorf("tz: %w", err)
+	}
+	return nil
+}
+
+// clock parses an HH:MM time of day as the offset from midnight. 24:00 is
+// the end of the day.
+func clock(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: want HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// open reports whether w is open at now.
+func (w *Window) open(now time.Time) bool {
+	now = now.In(w.loc)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, w.loc)
+	at := now.Sub(midnight)
+	if w.start < w.end {
+		return w.days[now.Weekday()] && at >= w.start && at < w.end
+	}
+	// Past midnight, the window belongs to the day it opened on
+	yesterday := (now.Weekday() + 6) % 7
+	return (w.days[now.Weekday()] && at >= w.start) || (w.days[yesterday] && at < w.end)
+}
+
+// UseLimiter keeps the rate limit buckets of s's policies in l, e.g. one
+// shared by several proxies, rather than in s.
+func (s *Set) UseLimiter(l ratelimit.Limiter) {
+	if s == nil {
+		return
+	}
+	for _, p := range s.Policies {
+		p.limiter = l
+	}
+}
+
+// Len returns the number of policies in s.
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.Policies)
+}
+
+// For returns the first policy matching a device with deviceTags belonging
+// to ownerID, or nil.
+func (s *Set) For(deviceTags []string, ownerID string) *Policy {
+	if s == nil {
+		return nil
+	}
+	for _, p := range s.Policies {
+		if ownerID != "" && slices.Contains(p.Owners, ownerID) {
+			return p
+		}
+		for _, t := range p.Tags {
+			if slices.Contains(deviceTags, t) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// Named returns the policy called name, or nil.
+func (s *Set) Named(name string) *Policy {
+	if s == nil || name == "" {
+		return nil
+	}
+	for _, p := range s.Policies {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// PassportMode returns p's passport mode, empty for a nil policy.
+func (p *Policy) PassportMode() string {
+	if p == nil {
+		return ""
+	}
+	return p.Passport
+}
+
+// SkipsAttestation reports whether p leaves the attestation verifier out.
+func (p *Policy) SkipsAttestation() bool {
+	return p != nil && p.Attestation == AttestationSkip
+}
+
+// Closed reports whether p keeps what scope covers, WindowOnboarding or
+// WindowEnforcement, from happening at now because none of its windows is
+// open. Policies without windows are never closed.
+func (p *Policy) Closed(now time.Time, scope string) bool {
+	if p == nil || len(p.Windows) == 0 {
+		return false
+	}
+	own := p.WindowScope
+	if own == "" {
+		own = WindowOnboarding
+	}
+	if own != scope {
+		return false
+	}
+	for _, w := range p.Windows {
+		if w.open(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// Outside reports whether a device at addr, located in country (empty if
+// unknown), is outside p's geofence. Policies without a geofence fence
+// nothing in.
+func (p *Policy) Outside(addr netip.Addr, country string) bool {
+	if p == nil || p.Geofence == nil {
+		return false
+	}
+	addr = addr.Unmap()
+	if slices.ContainsFunc(p.Geofence.Networks, func(pfx netip.Prefix) bool { return pfx.Contains(addr) }) {
+		return false
+	}
+	return country == "" || !slices.Contains(p.Geofence.Countries, country)
+}
+
+// RejectsOutside reports whether p refuses devices outside its geofence
+// rather than flagging them.
+func (p *Policy) RejectsOutside() bool {
+	return p != nil && p.Geofence != nil && p.Geofence.Action == GeofenceReject
+}
+
+// Allow takes a token from p's rate limit, reporting false when none is
+// left. Policies without a rate limit always allow.
+func (p *Policy) Allow(ctx context.Context) bool {
+	if p == nil || p.limiter == nil {
+		return true
+	}
+	return p.limiter.Allow(ctx, "policy:"+p.Name, p.rate)
+}
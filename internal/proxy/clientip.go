@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// TrustProxies has the proxy take a device's address from X-Forwarded-For
+// when its connection comes from one of prefixes, such as a load balancer
+// in front of the listener. Middleware, source matching and the session
+// records then see the device rather than the load balancer.
+func (p *FDOProxy) TrustProxies(prefixes []netip.Prefix) {
+	p.trusted = prefixes
+}
+
+// clientAddr resolves the address req comes from: the connection's peer,
+// or, while that is a trusted proxy, the nearest X-Forwarded-For hop that
+// is not. The result keeps the host:port form of http.Request.RemoteAddr.
+func (p *FDOProxy) clientAddr(req *http.Request) string {
+	if len(p.trusted) == 0 {
+		return req.RemoteAddr
+	}
+	peer, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil || !p.isTrusted(peer.Addr()) {
+		return req.RemoteAddr
+	}
+	var hops []string
+	for _, v := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	// The rightmost hops were added by the proxies we trust
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		if !p.isTrusted(addr) {
+			return netip.AddrPortFrom(addr.Unmap(), 0).String()
+		}
+	}
+	return req.RemoteAddr
+}
+
+func (p *FDOProxy) isTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return slices.ContainsFunc(p.trusted, func(pfx netip.Prefix) bool { return pfx.Contains(addr) })
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/fdo-server-wrapper/internal/coap"
+)
+
+// FDO over CoAP carries what HTTP sends in headers in CoAP options from
+// the experimental range (RFC 7252 section 12.2). Devices onboarding
+// through the CoAP gateway must use them.
+const (
+	// CoAPOptAuthorization carries the Authorization header: the session
+	// token the server issues in its response, which the device returns
+	// with every later message of the session.
+	CoAPOptAuthorization = 65000
+	// CoAPOptMessageType carries the Message-Type of a response as an
+	// unsigned integer.
+	CoAPOptMessageType = 65004
+)
+
+// coapMaxBody bounds FDO messages through the CoAP gateway, either way.
+const coapMaxBody = 1 << 20
+
+var errCoAPTooLarge = errors.New("response exceeds the CoAP gateway limit")
+
+// coapCodes maps HTTP statuses to CoAP response codes; other 4xx become
+// 4.00 and 5xx 5.00.
+var coapCodes = map[int]coap.Code{
+	http.StatusBadRequest:            coap.BadRequest,
+	http.StatusUnauthorized:          coap.Unauthorized,
+	http.StatusForbidden:             coap.Forbidden,
+	http.StatusNotFound:              coap.NotFound,
+	http.StatusMethodNotAllowed:      coap.MethodNotAllowed,
+	http.StatusConflict:              coap.Conflict,
+	http.StatusRequestEntityTooLarge: coap.RequestEntityTooLarge,
+	http.StatusUnsupportedMediaType:  coap.UnsupportedContentFormat,
+	http.StatusBadGateway:            coap.BadGateway,
+	http.StatusServiceUnavailable:    coap.ServiceUnavailable,
+	http.StatusGatewayTimeout:        coap.GatewayTimeout,
+}
+
+func coapCode(status int) coap.Code {
+	switch c, ok := coapCodes[status]; {
+	case ok:
+		return c
+	case status < 300:
+		return coap.Changed
+	case status >= 500:
+		return coap.InternalServerError
+	}
+	return coap.BadRequest
+}
+
+// newCoAPServer creates the CoAP gateway of l. Each FDO message is turned
+// into the HTTP request a device would have sent and served by handler,
+// the proxy's HTTP handler, so it passes the same checks, middleware and
+// routing before reaching the backend over HTTP.
+func newCoAPServer(l *Listener, handler http.Handler) *coap.Server {
+	return &coap.Server{
+		Addr:    l.Addr,
+		MaxBody: coapMaxBody,
+		Handler: func(ctx context.Context, peer net.Addr, m *coap.Message) *coap.Message {
+			resp := serveCoAP(context.WithValue(ctx, listenerKey{}, l), handler, peer, m)
+			coapRequests.Inc(resp.Code.String())
+			return resp
+		},
+	}
+}
+
+// serveCoAP translates the FDO message m from peer to HTTP and back.
+func serveCoAP(ctx context.Context, handler http.Handler, peer net.Addr, m *coap.Message) *coap.Message {
+	if m.Code != coap.POST {
+		return &coap.Message{Code: coap.MethodNotAllowed}
+	}
+	if f, ok := m.Uint(coap.OptContentFormat); ok && f != coap.FormatCBOR {
+		return &coap.Message{Code: coap.UnsupportedContentFormat}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://coap/", bytes.NewReader(m.Payload))
+	if err != nil {
+		return &coap.Message{Code: coap.InternalServerError}
+	}
+	req.URL.Path = m.Path()
+	req.RequestURI = req.URL.RequestURI()
+	req.RemoteAddr = peer.String()
+	req.Header.Set("Content-Type", "application/cbor")
+	if auth, ok := m.Option(CoAPOptAuthorization); ok {
+		req.Header.Set("Authorization", string(auth))
+	}
+
+	w := &coapResponse{header: make(http.Header)}
+	func() {
+		// The reverse proxy aborts a response it cannot finish copying.
+		defer func() {
+			if v := recover(); v != nil {
+				if v != http.ErrAbortHandler {
+					panic(v)
+				}
+				w.aborted = true
+			}
+		}()
+		handler.ServeHTTP(w, req)
+	}()
+	if w.aborted || w.overflow {
+		slog.Warn("CoAP gateway could not relay the response", "remote_addr", req.RemoteAddr, "path", m.Path(), "aborted", w.aborted, "too_large", w.overflow)
+		return &coap.Message{Code: coap.BadGateway}
+	}
+	return w.message()
+}
+
+// coapResponse is the http.ResponseWriter a CoAP message is served with.
+type coapResponse struct {
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	overflow bool
+	aborted  bool
+}
+
+func (w *coapResponse) Header() http.Header { return w.header }
+
+func (w *coapResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *coapResponse) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.body.Len()+len(b) > coapMaxBody {
+		w.overflow = true
+		return 0, errCoAPTooLarge
+	}
+	return w.body.Write(b)
+}
+
+// Flush is a no-op: the response is sent once complete.
+func (w *coapResponse) Flush() {}
+
+// message returns the CoAP response for what was written.
+func (w *coapResponse) message() *coap.Message {
+	w.WriteHeader(http.StatusOK)
+	m := &coap.Message{Code: coapCode(w.status), Payload: w.body.Bytes()}
+	if w.header.Get("Content-Type") == "application/cbor" {
+		m.SetUint(coap.OptContentFormat, coap.FormatCBOR)
+	}
+	if mt, err := strconv.Atoi(w.header.Get("Message-Type")); err == nil && mt >= 0 {
+		m.SetUint(CoAPOptMessageType, uint32(mt))
+	}
+	if auth := w.header.Get("Authorization"); auth != "" {
+		m.SetOption(CoAPOptAuthorization, []byte(auth))
+	}
+	return m
+}
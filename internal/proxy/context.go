@@ -0,0 +1,407 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+const (
+	// sessionContextTTL bounds how long a session context survives without
+	// messages, comfortably longer than a TO2 exchange.
+	sessionContextTTL = 10 * time.Minute
+	// deviceValuesTTL bounds how long values stashed for a device GUID wait
+	// for its next session.
+	deviceValuesTTL = 24 * time.Hour
+	// sweepInterval limits how often expired contexts are looked for.
+	sweepInterval = time.Minute
+)
+
+// SessionContext is state shared by every middleware across the messages
+// of one FDO protocol session. The proxy creates it for the first message
+// of a session, binds it to the session token the backend returns, and hands
+// the same value to every later message carrying that token. It is dropped
+// once the session ends (DI.Done, TO0.AcceptOwner, TO1.RVRedirect,
+// TO2.Done2 or an ErrorMessage).
+//
+// Values set with Set live as long as the session. Values set with
+// DeviceSet are kept under the device GUID once SetGUID has been called, so
+// the device's later sessions see them: DI can leave the product ID and
+// serial number for TO2.
+type SessionContext struct {
+	reg *sessionContexts
+
+	mu        sync.Mutex
+	token     string
+	protocol  string
+	guid      string
+	startedAt time.Time
+	usedAt    time.Time
+	values    map[string]any
+	// device holds device values until the GUID is known.
+	device map[string]any
+	// backend is where the session started, if its role has a standby.
+	backend *backendTarget
+	// member is the pool member serving the session.
+	member *poolMember
+	// reserved is set while the session holds a slot under the session
+	// limit that bind has not taken up yet. It is guarded by reg.mu.
+	reserved bool
+}
+
+// NewSessionContext returns the context of a session of protocol ("di",
+// "to0", "to1", "to2") that no proxy tracks, for running middleware on
+// their own, e.g. in tests. Its device values are kept for it alone.
+func NewSessionContext(protocol string) *SessionContext {
+	now := time.Now()
+	return &SessionContext{reg: newSessionContexts(), protocol: protocol, startedAt: now, usedAt: now}
+}
+
+// Token returns the FDO session token, or "" before the backend issued one.
+func (s *SessionContext) Token() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token
+}
+
+// Protocol returns the FDO protocol of the session ("di", "to0", "to1",
+// "to2"), or "" for requests outside FDO.
+func (s *SessionContext) Protocol() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.protocol
+}
+
+// StartedAt returns when the session's first message arrived.
+func (s *SessionContext) StartedAt() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.startedAt
+}
+
+// GUID returns the device GUID, once a middleware has set it.
+func (s *SessionContext) GUID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.guid
+}
+
+// Get returns the session value for key.
+func (s *SessionContext) Get(key string) (any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+// Set stores a session value under key.
+func (s *SessionContext) Set(key string, v any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]any)
+	}
+	s.values[key] = v
+}
+
+// SetGUID ties the session to a device. Device values set so far are kept
+// under guid, replacing older values for the same keys, and values left by
+// the device's earlier sessions become visible through DeviceGet.
+func (s *SessionContext) SetGUID(guid string) {
+	s.mu.Lock()
+	s.guid = guid
+	pending := s.device
+	s.device = nil
+	s.mu.Unlock()
+	for k, v := range pending {
+		s.reg.setDevice(guid, k, v)
+	}
+}
+
+// DeviceGet returns the device value for key, from this session or an
+// earlier one for the same GUID.
+func (s *SessionContext) DeviceGet(key string) (any, bool) {
+	s.mu.Lock()
+	guid := s.guid
+	if guid == "" {
+		v, ok := s.device[key]
+		s.mu.Unlock()
+		return v, ok
+	}
+	s.mu.Unlock()
+	return s.reg.getDevice(guid, key)
+}
+
+// DeviceSet stores a device value under key.
+func (s *SessionContext) DeviceSet(key string, v any) {
+	s.mu.Lock()
+	guid := s.guid
+	if guid == "" {
+		if s.device == nil {
+			s.device = make(map[string]any)
+		}
+		s.device[key] = v
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	s.reg.setDevice(guid, key, v)
+}
+
+// deviceValues are the values kept for one device GUID.
+type deviceValues struct {
+	values map[string]any
+	usedAt time.Time
+}
+
+// sessionContexts tracks session contexts by token and device values by
+// GUID.
+type sessionContexts struct {
+	mu        sync.Mutex
+	byToken   map[string]*SessionContext
+	devices   map[string]*deviceValues
+	lastSweep time.Time
+	// active counts byToken per protocol; max bounds their total with the
+	// pending sessions admitted but not yet bound, 0 is unbounded.
+	active  map[string]int
+	pending int
+	max     int
+	// drain, while set, refuses new DI and TO2 sessions.
+	drain *drainState
+}
+
+func newSessionContexts() *sessionContexts {
+	return &sessionContexts{
+		byToken: make(map[string]*SessionContext),
+		devices: make(map[string]*deviceValues),
+		active:  make(map[string]int),
+	}
+}
+
+// limit bounds the sessions in flight to max, 0 for no bound.
+func (c *sessionContexts) limit(max int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.max = max
+	maxSessions.Set(float64(max))
+	c.reportLocked()
+}
+
+// admit refuses req, the first message of sc, if it opens a session while
+// the limit is reached. Otherwise sc holds a slot until bind registers it
+// or release gives it back, so sessions starting at once cannot overshoot
+// the limit. Messages of sessions already in flight always pass.
+func (c *sessionContexts) admit(sc *SessionContext, req *http.Request) error {
+	msgType, ok := fdo.MessageType(req.URL.Path)
+	if !ok || !sessionStart(msgType) {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.drain != nil && drained(msgType) {
+		c.drain.refused++
+		drainRefused.Inc(fdo.Protocol(msgType))
+		return fmt.Errorf("maintenance mode: %s", c.drain.reason)
+	}
+	if c.max == 0 {
+		return nil
+	}
+	if n := len(c.byToken) + c.pending; n >= c.max {
+		sessionsRefused.Inc(fdo.Protocol(msgType))
+		return fmt.Errorf("%d sessions in flight, limit %d", n, c.max)
+	}
+	if !sc.reserved {
+		sc.reserved = true
+		c.pending++
+		c.reportLocked()
+	}
+	return nil
+}
+
+// release gives back the slot admit reserved for sc if no session token
+// was bound to it, e.g. because middleware or the backend refused the
+// first message.
+func (c *sessionContexts) release(sc *SessionContext) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.releaseLocked(sc)
+}
+
+// releaseLocked gives back the slot of sc, if it holds one. The caller must
+// hold c.mu.
+func (c *sessionContexts) releaseLocked(sc *SessionContext) {
+	if sc.reserved {
+		sc.reserved = false
+		c.pending--
+		c.reportLocked()
+	}
+}
+
+// addLocked registers sc under token. The caller must hold c.mu.
+func (c *sessionContexts) addLocked(token string, sc *SessionContext) {
+	if old, ok := c.byToken[token]; ok {
+		c.active[old.protocol]--
+	}
+	c.byToken[token] = sc
+	c.active[sc.protocol]++
+	c.reportLocked()
+}
+
+// removeLocked drops the context under token. The caller must hold c.mu.
+func (c *sessionContexts) removeLocked(token string) {
+	if sc, ok := c.byToken[token]; ok {
+		delete(c.byToken, token)
+		c.active[sc.protocol]--
+		c.reportLocked()
+	}
+}
+
+// reportLocked updates the session gauges. The caller must hold c.mu.
+func (c *sessionContexts) reportLocked() {
+	for _, p := range []string{"di", "to0", "to1", "to2"} {
+		activeSessions.Set(float64(c.active[p]), p)
+	}
+	if c.max > 0 {
+		sessionHeadroom.Set(float64(max(c.max-len(c.byToken)-c.pending, 0)))
+	}
+}
+
+// forRequest returns the context for the session req belongs to, or a new
+// one for the first message of a session. Tokens the backend did not issue
+// through bind are anyone's to make up, so their messages get an anonymous
+// context, registered only if the backend answers with a token of its own,
+// and never count toward the session limit.
+func (c *sessionContexts) forRequest(req *http.Request) *SessionContext {
+	now := time.Now()
+	token := fdo.SessionToken(req.Header)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweepLocked(now)
+	if sc, ok := c.byToken[token]; ok && token != "" {
+		sc.mu.Lock()
+		sc.usedAt = now
+		sc.mu.Unlock()
+		return sc
+	}
+	sc := &SessionContext{reg: c, startedAt: now, usedAt: now}
+	if msgType, ok := fdo.MessageType(req.URL.Path); ok {
+		sc.protocol = fdo.Protocol(msgType)
+	}
+	return sc
+}
+
+// bind registers sc under the session token in resp, if the backend just
+// issued one, taking up the slot admit reserved for it.
+func (c *sessionContexts) bind(sc *SessionContext, resp *http.Response) {
+	token := fdo.SessionToken(resp.Header)
+	if token == "" {
+		return
+	}
+	sc.mu.Lock()
+	if sc.token != "" {
+		sc.mu.Unlock()
+		return
+	}
+	sc.token = token
+	sc.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.releaseLocked(sc)
+	c.addLocked(token, sc)
+}
+
+// end drops sc once its session is over. Device values are kept.
+func (c *sessionContexts) end(sc *SessionContext) {
+	token := sc.Token()
+	if token == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.byToken[token] == sc {
+		c.removeLocked(token)
+	}
+}
+
+func (c *sessionContexts) getDevice(guid, key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.devices[guid]
+	if !ok {
+		return nil, false
+	}
+	d.usedAt = time.Now()
+	v, ok := d.values[key]
+	return v, ok
+}
+
+func (c *sessionContexts) setDevice(guid, key string, v any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.devices[guid]
+	if !ok {
+		d = &deviceValues{values: make(map[string]any)}
+		c.devices[guid] = d
+	}
+	d.values[key] = v
+	d.usedAt = time.Now()
+}
+
+// sweepLocked drops idle session contexts and device values. The caller
+// must hold c.mu.
+func (c *sessionContexts) sweepLocked(now time.Time) {
+	if now.Sub(c.lastSweep) < sweepInterval {
+		return
+	}
+	c.lastSweep = now
+	for token, sc := range c.byToken {
+		sc.mu.Lock()
+		idle := now.Sub(sc.usedAt)
+		sc.mu.Unlock()
+		if idle > sessionContextTTL {
+			c.removeLocked(token)
+		}
+	}
+	for guid, d := range c.devices {
+		if now.Sub(d.usedAt) > deviceValuesTTL {
+			delete(c.devices, guid)
+		}
+	}
+}
+
+// sessionStart reports whether a request of msgType opens a session.
+func sessionStart(msgType int) bool {
+	switch msgType {
+	case fdo.MsgDIAppStart, fdo.MsgTO0Hello, fdo.MsgTO1HelloRV, fdo.MsgTO2HelloDevice:
+		return true
+	}
+	return false
+}
+
+// sessionEnded reports whether a response of msgType ends the session.
+func sessionEnded(msgType int) bool {
+	switch msgType {
+	case fdo.MsgDIDone, fdo.MsgTO0AcceptOwner, fdo.MsgTO1RVRedirect, fdo.MsgTO2Done2, fdo.MsgError:
+		return true
+	}
+	return false
+}
+
+type sessionContextKey struct{}
+
+// withSessionContext carries sc on the outbound request so modifyResponse
+// can find it.
+func withSessionContext(ctx context.Context, sc *SessionContext) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, sc)
+}
+
+func sessionContextFrom(ctx context.Context) (*SessionContext, bool) {
+	sc, ok := ctx.Value(sessionContextKey{}).(*SessionContext)
+	return sc, ok
+}
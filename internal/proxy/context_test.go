@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// startRequest is the first message of a TO2 session.
+func startRequest() *http.Request {
+	return httptest.NewRequest(http.MethodPost, "/fdo/101/msg/60", nil)
+}
+
+// tokenResponse is a backend answer issuing token.
+func tokenResponse(token string) *http.Response {
+	return &http.Response{Header: http.Header{"Authorization": {"Bearer " + token}}}
+}
+
+func TestSessionLimitConcurrentStarts(t *testing.T) {
+	const limit = 8
+	c := newSessionContexts()
+	c.limit(limit)
+
+	// Every start is admitted before any backend answers, as when devices
+	// arrive together and the backend is slow
+	var (
+		admitted sync.WaitGroup
+		done     sync.WaitGroup
+		mu       sync.Mutex
+		ok       []*SessionContext
+	)
+	admitted.Add(limit + 1)
+	done.Add(limit + 1)
+	for i := 0; i <= limit; i++ {
+		go func() {
+			defer done.Done()
+			req := startRequest()
+			sc := c.forRequest(req)
+			err := c.admit(sc, req)
+			admitted.Done()
+			admitted.Wait()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			ok = append(ok, sc)
+			n := len(ok)
+			mu.Unlock()
+			c.bind(sc, tokenResponse(fmt.Sprintf("token-%d", n)))
+		}()
+	}
+	done.Wait()
+
+	if len(ok) != limit {
+		t.Errorf("%d of %d concurrent starts admitted, want %d", len(ok), limit+1, limit)
+	}
+	if len(c.byToken) != limit || c.pending != 0 {
+		t.Errorf("%d sessions bound, %d pending, want %d and 0", len(c.byToken), c.pending, limit)
+	}
+	req := startRequest()
+	if err := c.admit(c.forRequest(req), req); err == nil {
+		t.Error("start admitted over the limit")
+	}
+
+	// An ended session makes room for the next
+	c.end(ok[0])
+	req = startRequest()
+	if err := c.admit(c.forRequest(req), req); err != nil {
+		t.Errorf("start after a session ended refused: %v", err)
+	}
+}
+
+func TestSessionLimitRelease(t *testing.T) {
+	c := newSessionContexts()
+	c.limit(1)
+
+	req := startRequest()
+	sc := c.forRequest(req)
+	if err := c.admit(sc, req); err != nil {
+		t.Fatalf("first start refused: %v", err)
+	}
+	req = startRequest()
+	if err := c.admit(c.forRequest(req), req); err == nil {
+		t.Error("second start admitted while the first holds the only slot")
+	}
+
+	// The backend refused the first start without issuing a token
+	c.bind(sc, &http.Response{Header: http.Header{}})
+	c.release(sc)
+	c.release(sc)
+	if c.pending != 0 {
+		t.Errorf("pending = %d after release, want 0", c.pending)
+	}
+	req = startRequest()
+	sc = c.forRequest(req)
+	if err := c.admit(sc, req); err != nil {
+		t.Fatalf("start after release refused: %v", err)
+	}
+
+	// A bound session keeps its slot once the request is over
+	c.bind(sc, tokenResponse("token-1"))
+	c.release(sc)
+	if len(c.byToken) != 1 || c.pending != 0 {
+		t.Errorf("%d sessions bound, %d pending, want 1 and 0", len(c.byToken), c.pending)
+	}
+	req = startRequest()
+	if err := c.admit(c.forRequest(req), req); err == nil {
+		t.Error("start admitted while a bound session holds the only slot")
+	}
+}
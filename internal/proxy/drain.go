@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+// drainState is maintenance mode, while it is on.
+type drainState struct {
+	since   time.Time
+	reason  string
+	refused int
+}
+
+// DrainStatus reports maintenance mode and how far sessions in flight
+// have drained.
+type DrainStatus struct {
+	Maintenance bool      `json:"maintenance"`
+	Since       time.Time `json:"since,omitzero"`
+	Reason      string    `json:"reason,omitempty"`
+	// Sessions counts the FDO sessions still in flight by protocol.
+	Sessions map[string]int `json:"sessions"`
+	// Drained is set in maintenance mode once no DI or TO2 session is left,
+	// so the backend can be taken down.
+	Drained bool `json:"drained"`
+	// Refused counts sessions refused since maintenance mode went on.
+	Refused int `json:"refused"`
+}
+
+// SetMaintenance turns maintenance mode on or off. While on, the first
+// message of a new DI or TO2 session is refused with 503 and FDO error
+// 500, which devices retry later, and sessions in flight run to their end;
+// TO0 and TO1 are not affected. reason is logged and reported.
+func (p *FDOProxy) SetMaintenance(on bool, reason string) {
+	c := p.contexts
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case on && c.drain == nil:
+		c.drain = &drainState{since: time.Now(), reason: reason}
+		maintenanceMode.Set(1)
+		slog.Warn("Maintenance mode on, refusing new DI and TO2 sessions", "reason", reason, "di_sessions", c.active["di"], "to2_sessions", c.active["to2"])
+	case on:
+		c.drain.reason = reason
+	case c.drain != nil:
+		slog.Info("Maintenance mode off", "refused", c.drain.refused, "duration", time.Since(c.drain.since).Round(time.Second))
+		c.drain = nil
+		maintenanceMode.Set(0)
+	}
+}
+
+// Maintenance returns the maintenance mode status.
+func (p *FDOProxy) Maintenance() DrainStatus {
+	c := p.contexts
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweepLocked(time.Now())
+	st := DrainStatus{Sessions: make(map[string]int)}
+	for _, proto := range []string{"di", "to0", "to1", "to2"} {
+		st.Sessions[proto] = c.active[proto]
+	}
+	if c.drain != nil {
+		st.Maintenance = true
+		st.Since = c.drain.since
+		st.Reason = c.drain.reason
+		st.Refused = c.drain.refused
+		st.Drained = c.active["di"] == 0 && c.active["to2"] == 0
+	}
+	return st
+}
+
+// drained reports whether maintenance mode refuses sessions opened by
+// msgType.
+func drained(msgType int) bool {
+	return msgType == fdo.MsgDIAppStart || msgType == fdo.MsgTO2HelloDevice
+}
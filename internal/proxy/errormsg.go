@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+// errorCode picks the FDO error code for a refusal with HTTP status.
+func errorCode(status int) uint64 {
+	switch {
+	case status == http.StatusUnauthorized:
+		return fdo.CodeInvalidJWTToken
+	case status == http.StatusNotFound:
+		return fdo.CodeResourceNotFound
+	case status == http.StatusConflict:
+		return fdo.CodeCredReuseError
+	case status == http.StatusBadRequest || status == http.StatusRequestEntityTooLarge:
+		return fdo.CodeMessageBodyError
+	case status >= 500:
+		return fdo.CodeInternalServerError
+	}
+	return fdo.CodeInvalidMessageError
+}
+
+// CorrelationID is the ErrorMessage correlation ID sent for a message the
+// proxy refused, derived from its request ID so the two can be matched up.
+func CorrelationID(requestID string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(requestID))
+	return h.Sum64()
+}
+
+// writeError answers r with status. FDO messages get an ErrorMessage the
+// device stack can interpret, with code or else one chosen from status; the
+// reason for refusing stays out of it, only the request ID is given.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code uint64, requestID string) {
+	msgType, ok := fdo.MessageType(r.URL.Path)
+	if !ok {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if code == 0 {
+		code = errorCode(status)
+	}
+	body := fdo.EncodeErrorMessage(&fdo.ErrorMessage{
+		Code:          code,
+		PrevMsgID:     uint64(msgType),
+		Message:       fmt.Sprintf("%s (request %s)", http.StatusText(status), requestID),
+		CorrelationID: CorrelationID(requestID),
+	})
+	w.Header().Set("Content-Type", "application/cbor")
+	w.Header().Set("Message-Type", strconv.Itoa(fdo.MsgError))
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// failoverAfter is how many health checks in a row a backend must fail
+// before new sessions go to its standby.
+const failoverAfter = 3
+
+// AddStandby sends new sessions of role to the FDO server at rawURL, which
+// the proxy does not run, while the role's backend fails its health checks
+// every interval (default 10s). Sessions stay on the backend they started
+// on. role "" is the backend given to NewFDOProxy or UseBackend.
+func (p *FDOProxy) AddStandby(role, rawURL string, interval time.Duration) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid standby URL %q", rawURL)
+	}
+	if _, dup := p.standbys[role]; dup {
+		return fmt.Errorf("standby for %q added twice", role)
+	}
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	if p.standbys == nil {
+		p.standbys = make(map[string]*standby)
+	}
+	p.standbys[role] = &standby{target: &backendTarget{role: role, url: u}, interval: interval}
+	return nil
+}
+
+// WatchBackends health-checks every backend the proxy runs every interval
+// (default 10s), not only those with a standby, and exports whether each
+// is up as fdo_proxy_backend_up; a backend is down after failoverAfter
+// failed checks in a row. In-process backends cannot fail apart from the
+// proxy and are not watched, and pools watch their own members.
+func (p *FDOProxy) WatchBackends(interval time.Duration) {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	p.watchInterval = interval
+}
+
+// standby is the fallback of a backend.
+type standby struct {
+	target   *backendTarget
+	interval time.Duration
+}
+
+// startStandbys attaches standbys to their backends and starts watching
+// the health of those backends and, with WatchBackends, the others.
+func (p *FDOProxy) startStandbys(ctx context.Context, targets []*backendTarget) error {
+	for role, sb := range p.standbys {
+		var t *backendTarget
+		for _, c := range targets {
+			if c.role == role {
+				t = c
+			}
+		}
+		switch {
+		case t == nil:
+			return fmt.Errorf("standby for role %q: no such backend", role)
+		case t.pool != nil:
+			return fmt.Errorf("standby for role %s: pools fail over between their members", role)
+		}
+		if err := p.newReverseProxy(sb.target); err != nil {
+			return err
+		}
+		t.standby = sb.target
+		failoverActive.Set(0, role)
+		if _, ok := t.backend.(http.RoundTripper); !ok {
+			backendUp.Set(1, role)
+			go p.watchBackend(ctx, t, sb.interval)
+		}
+	}
+	if p.watchInterval <= 0 {
+		return nil
+	}
+	for _, t := range targets {
+		if _, ok := t.backend.(http.RoundTripper); ok || t.pool != nil || t.standby != nil {
+			continue
+		}
+		backendUp.Set(1, t.role)
+		go p.watchBackend(ctx, t, p.watchInterval)
+	}
+	return nil
+}
+
+// watchBackend health-checks t until ctx is done, marking it down after
+// failoverAfter failures and up on the first success. New sessions go to
+// t's standby, if it has one, while it is down.
+func (p *FDOProxy) watchBackend(ctx context.Context, t *backendTarget, interval time.Duration) {
+	healthURL := fmt.Sprintf("http://localhost:%d/health", t.port)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := checkHealth(ctx, healthURL, min(interval, 5*time.Second))
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			failures = 0
+			if !t.down.Swap(false) {
+				continue
+			}
+			backendUp.Set(1, t.role)
+			if t.standby == nil {
+				slog.Info("Backend healthy again", "role", t.role, "backend_port", t.port)
+				continue
+			}
+			failoverActive.Set(0, t.role)
+			slog.Info("Backend healthy again, new sessions go back to it", "role", t.role, "backend_port", t.port)
+			continue
+		}
+		failures++
+		if failures < failoverAfter || t.down.Swap(true) {
+			continue
+		}
+		backendUp.Set(0, t.role)
+		if t.standby == nil {
+			slog.Error("Backend failed its health checks", "role", t.role, "backend_port", t.port, "error", err)
+			continue
+		}
+		failoverActive.Set(1, t.role)
+		failovers.Inc(t.role)
+		slog.Error("Backend failed its health checks, new sessions go to the standby", "role", t.role, "backend_port", t.port, "standby", t.standby.url.String(), "error", err)
+	}
+}
+
+// sessionTarget returns the backend for a message of sc routed to t: the
+// one its session started on, or else t's standby while t is down.
+func (p *FDOProxy) sessionTarget(sc *SessionContext, t *backendTarget) *backendTarget {
+	if t.standby == nil {
+		return t
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.backend != nil {
+		return sc.backend
+	}
+	sc.backend = t
+	if t.down.Load() {
+		sc.backend = t.standby
+	}
+	return sc.backend
+}
+
+// checkHealth GETs rawURL, expecting 200 within timeout.
+func checkHealth(ctx context.Context, rawURL string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+
+	"github.com/fdo-server-wrapper/internal/coap"
+)
+
+// Listener is an address the proxy serves besides the one given to Start,
+// e.g. plain HTTP for DI on a factory network next to TLS for TO2 from the
+// field. SNI routes and virtual hosts apply to the main listener only.
+type Listener struct {
+	// Addr is the address to listen on, e.g. "10.1.0.1:8080".
+	Addr string
+	// TLS, if set, serves the listener over TLS.
+	TLS *tls.Config
+	// Site routes every request on the listener: Role or URL pick its
+	// backend, and Middleware replaces the proxy's chain.
+	Site Site
+	// AcceptRoles limits the FDO messages taken on the listener as
+	// FDOProxy.AcceptRoles does (default: those the proxy accepts).
+	AcceptRoles []string
+	// SourceRules, if set, decide which clients may reach the listener
+	// instead of the rules given to FDOProxy.RestrictSources.
+	SourceRules *SourceRules
+	// CoAP serves FDO over CoAP on the UDP address Addr instead of HTTP,
+	// for constrained devices; see the CoAP gateway. It excludes TLS.
+	CoAP bool
+
+	accepted map[string]bool
+	server   *http.Server
+	coap     *coap.Server
+}
+
+type listenerKey struct{}
+
+// AddListener serves l alongside the main listener once the proxy starts.
+func (p *FDOProxy) AddListener(l Listener) error {
+	name := "listener " + l.Addr
+	if l.Addr == "" {
+		return fmt.Errorf("listener without an address")
+	}
+	if slices.ContainsFunc(p.listeners, func(o *Listener) bool { return o.Addr == l.Addr }) {
+		return fmt.Errorf("%s added twice", name)
+	}
+	if l.CoAP && l.TLS != nil {
+		return fmt.Errorf("%s: CoAP is served without DTLS and cannot take TLS", name)
+	}
+	if err := l.Site.prepare("listener", l.Addr); err != nil {
+		return err
+	}
+	var err error
+	if l.accepted, err = roleSet(l.AcceptRoles); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	p.listeners = append(p.listeners, &l)
+	return nil
+}
+
+// listenerOf returns the added listener r came in on, nil for the main one.
+func listenerOf(r *http.Request) *Listener {
+	l, _ := r.Context().Value(listenerKey{}).(*Listener)
+	return l
+}
+
+// newServer creates the server of l, handing its requests to handler.
+func (l *Listener) newServer(handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:    l.Addr,
+		Handler: handler,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), listenerKey{}, l)
+		},
+	}
+	configureTLS(srv, l.TLS)
+	return srv
+}
+
+// serve runs srv until it is shut down.
+func serve(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
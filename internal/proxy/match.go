@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+// Match selects the FDO exchanges a middleware runs for. Every field that is
+// set must match; a response is matched by the request it answers.
+type Match struct {
+	// Protocols are di, to0, to1 and to2.
+	Protocols []string `json:"protocols,omitempty"`
+	// MessageTypes are request message types, e.g. 60 for TO2.HelloDevice.
+	MessageTypes []int `json:"message_types,omitempty"`
+	// Hosts are request host names, for tenants served on their own name.
+	Hosts []string `json:"hosts,omitempty"`
+	// Sources are client networks; a single address is written as /32 or /128.
+	Sources []netip.Prefix `json:"sources,omitempty"`
+}
+
+// Validate reports fields that can never match.
+func (m *Match) Validate() error {
+	for _, p := range m.Protocols {
+		switch p {
+		case "di", "to0", "to1", "to2":
+		default:
+			return fmt.Errorf("unknown protocol %q", p)
+		}
+	}
+	for _, t := range m.MessageTypes {
+		if fdo.Protocol(t) == "" {
+			return fmt.Errorf("unknown message type %d", t)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether req falls within m.
+func (m *Match) Matches(req *http.Request) bool {
+	msgType, ok := fdo.MessageType(req.URL.Path)
+	if len(m.MessageTypes) > 0 && (!ok || !slices.Contains(m.MessageTypes, msgType)) {
+		return false
+	}
+	if len(m.Protocols) > 0 && (!ok || !slices.Contains(m.Protocols, fdo.Protocol(msgType))) {
+		return false
+	}
+	if len(m.Hosts) > 0 {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !slices.ContainsFunc(m.Hosts, func(h string) bool { return strings.EqualFold(h, host) }) {
+			return false
+		}
+	}
+	if len(m.Sources) > 0 {
+		ap, err := netip.ParseAddrPort(req.RemoteAddr)
+		if err != nil {
+			return false
+		}
+		addr := ap.Addr().Unmap()
+		if !slices.ContainsFunc(m.Sources, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// When restricts mw to the exchanges m matches. Other messages never reach
+// mw, so it does not read their bodies.
+func When(mw Middleware, m *Match) Middleware {
+	return &conditional{mw: mw, match: m}
+}
+
+type conditional struct {
+	mw    Middleware
+	match *Match
+}
+
+func (c *conditional) ProcessRequest(ctx context.Context, sc *SessionContext, req *http.Request) error {
+	if !c.match.Matches(req) {
+		return nil
+	}
+	return c.mw.ProcessRequest(ctx, sc, req)
+}
+
+func (c *conditional) ProcessResponse(ctx context.Context, sc *SessionContext, resp *http.Response) error {
+	if resp.Request == nil || !c.match.Matches(resp.Request) {
+		return nil
+	}
+	return c.mw.ProcessResponse(ctx, sc, resp)
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+var (
+	proxyRequests = metrics.Default.NewCounterVec(
+		"fdo_proxy_requests_total",
+		"Requests handled by the proxy listener by HTTP status code.",
+		"code")
+	proxyLatency = metrics.Default.NewHistogramVec(
+		"fdo_proxy_request_duration_seconds",
+		"End-to-end request latency through the proxy, including middleware and backend.",
+		metrics.DefBuckets)
+	proxyMessages = metrics.Default.NewCounterVec(
+		"fdo_proxy_messages_total",
+		"FDO messages handled by request message type and outcome (ok, error for an ErrorMessage answer, http_error otherwise).",
+		"msg_type", "outcome")
+	proxyRejections = metrics.Default.NewCounterVec(
+		"fdo_proxy_rejections_total",
+		"FDO messages refused by middleware, by request message type.",
+		"msg_type")
+	activeSessions = metrics.Default.NewGaugeVec(
+		"fdo_proxy_active_sessions",
+		"FDO sessions in flight (issued a session token and not yet ended) by protocol.",
+		"protocol")
+	maxSessions = metrics.Default.NewGaugeVec(
+		"fdo_proxy_max_sessions",
+		"Configured limit on FDO sessions in flight, 0 if unlimited.")
+	sessionHeadroom = metrics.Default.NewGaugeVec(
+		"fdo_proxy_session_headroom",
+		"Sessions that can still start before the limit is reached; exported only with a limit.")
+	sessionsRefused = metrics.Default.NewCounterVec(
+		"fdo_proxy_sessions_refused_total",
+		"Sessions refused at their first message because the limit was reached, by protocol.",
+		"protocol")
+	rateLimited = metrics.Default.NewCounterVec(
+		"fdo_proxy_rate_limited_total",
+		"Sessions refused at their first message because their client address or device was over its rate limit, by limit (source, device) and protocol.",
+		"limit", "protocol")
+	bannedStarts = metrics.Default.NewCounterVec(
+		"fdo_proxy_banned_total",
+		"Sessions refused at their first message because their client address or device was banned, by kind (ip, serial, guid), source of the ban (admin, penalty) and protocol.",
+		"kind", "source", "protocol")
+	sourcesDenied = metrics.Default.NewCounterVec(
+		"fdo_proxy_sources_denied_total",
+		"Requests refused by -source-rules before reaching middleware, by protocol (empty for non-FDO paths).",
+		"protocol")
+	noncanonicalPaths = metrics.Default.NewCounterVec(
+		"fdo_proxy_noncanonical_paths_total",
+		"Requests whose path was not in canonical form, by action (normalized, or refused for a malformed FDO path).",
+		"action")
+	unforwardedPaths = metrics.Default.NewCounterVec(
+		"fdo_proxy_unforwarded_paths_total",
+		"Requests answered 404 because their path is neither an FDO message nor allowed by -forward-paths.")
+	roleRefused = metrics.Default.NewCounterVec(
+		"fdo_proxy_role_refused_total",
+		"FDO messages refused because no role the proxy serves handles their protocol, by message type.",
+		"msg_type")
+	coapRequests = metrics.Default.NewCounterVec(
+		"fdo_proxy_coap_requests_total",
+		"Requests taken by CoAP listeners, by CoAP response code (e.g. 2.04).",
+		"code")
+	drainRefused = metrics.Default.NewCounterVec(
+		"fdo_proxy_maintenance_refused_total",
+		"Sessions refused at their first message because maintenance mode is on, by protocol.",
+		"protocol")
+	maintenanceMode = metrics.Default.NewGaugeVec(
+		"fdo_proxy_maintenance_mode",
+		"Whether maintenance mode refuses new DI and TO2 sessions (1) or not (0).")
+	poolRequests = metrics.Default.NewCounterVec(
+		"fdo_proxy_pool_requests_total",
+		"Requests forwarded to a backend pool member, by role and member URL.",
+		"role", "url")
+	poolMemberUp = metrics.Default.NewGaugeVec(
+		"fdo_proxy_pool_member_up",
+		"Whether a backend pool member passed its last health check (1) or not (0), by role and member URL.",
+		"role", "url")
+	backendUp = metrics.Default.NewGaugeVec(
+		"fdo_proxy_backend_up",
+		"Whether a health-checked backend the proxy runs passes its health checks (1) or not (0); role is empty for the single backend.",
+		"role")
+	failoverActive = metrics.Default.NewGaugeVec(
+		"fdo_proxy_backend_failover_active",
+		"Whether new sessions of a role go to its standby because the backend fails its health checks (1) or not (0); role is empty for the single backend.",
+		"role")
+	failovers = metrics.Default.NewCounterVec(
+		"fdo_proxy_backend_failovers_total",
+		"Switches of new sessions to a standby backend, by role.",
+		"role")
+)
+
+// statusRecorder captures the status code written by downstream handlers.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Flush forwards to the underlying writer so streamed responses still flush.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument records request counts and latency for next.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		proxyRequests.Inc(strconv.Itoa(rec.status))
+		proxyLatency.Observe(time.Since(start).Seconds())
+		if msgType, ok := fdo.MessageType(r.URL.Path); ok {
+			proxyMessages.Inc(strconv.Itoa(msgType), messageOutcome(rec))
+		}
+	})
+}
+
+// messageOutcome classifies the answer to an FDO message.
+func messageOutcome(rec *statusRecorder) string {
+	switch {
+	case rec.Header().Get("Message-Type") == strconv.Itoa(fdo.MsgError):
+		return "error"
+	case rec.status >= 400:
+		return "http_error"
+	}
+	return "ok"
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+// canonicalize rewrites the path of r in place to its canonical form before
+// anything looks at it, so source rules, middleware, routing and the backend
+// all see the same message. A path spelled differently, such as
+// //fdo/101/msg/010/, could otherwise skip middleware matching the FDO path
+// yet still be routed by the backend. It reports false, having answered r
+// with 404, for a path under /fdo/ that is not an FDO message.
+func canonicalize(w http.ResponseWriter, r *http.Request) bool {
+	requestID := correlation.RequestID(r.Context())
+	c, ok := fdo.CanonicalPath(r.URL.Path)
+	if !ok {
+		slog.Warn("Request refused for a malformed FDO path", "request_id", requestID, "remote_addr", r.RemoteAddr, "path", r.URL.EscapedPath())
+		noncanonicalPaths.Inc("refused")
+		writeError(w, r, http.StatusNotFound, 0, requestID)
+		return false
+	}
+	// An FDO message path has nothing to escape; a RawPath means it was
+	// sent percent-encoded
+	encoded := r.URL.RawPath != "" && strings.HasPrefix(c, "/fdo/")
+	if c == r.URL.Path && !encoded {
+		return true
+	}
+	slog.Warn("Request path normalized", "request_id", requestID, "remote_addr", r.RemoteAddr, "path", r.URL.EscapedPath(), "canonical", c)
+	noncanonicalPaths.Inc("normalized")
+	r.URL.Path = c
+	r.URL.RawPath = ""
+	return true
+}
+
+// pathAllowlist is the paths besides FDO messages forwarded to a backend.
+type pathAllowlist struct {
+	exact    map[string]bool
+	prefixes []string
+}
+
+// RestrictPaths forwards only FDO messages and the extra paths to a backend,
+// answering anything else 404 before source rules, middleware or routing
+// see it. An entry ending in "/*" allows every path below it, e.g.
+// "/api/v1/*". Without a call every path is forwarded.
+func (p *FDOProxy) RestrictPaths(extra []string) error {
+	a := &pathAllowlist{exact: make(map[string]bool)}
+	for _, e := range extra {
+		prefix, isPrefix := strings.CutSuffix(e, "/*")
+		check := prefix
+		if !isPrefix {
+			check = e
+		}
+		if c, ok := fdo.CanonicalPath(check); !strings.HasPrefix(e, "/") || !ok || c != check {
+			return fmt.Errorf("invalid path %q: want a canonical absolute path, optionally ending in /*", e)
+		}
+		if isPrefix {
+			a.prefixes = append(a.prefixes, prefix+"/")
+		} else {
+			a.exact[e] = true
+		}
+	}
+	p.paths = a
+	return nil
+}
+
+// allows reports whether a request for the canonical path may be
+// forwarded.
+func (a *pathAllowlist) allows(path string) bool {
+	if _, ok := fdo.MessageType(path); ok || a.exact[path] {
+		return true
+	}
+	for _, prefix := range a.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve has the proxy answer requests for pattern itself instead of
+// forwarding them, e.g. the onboarding receipts devices fetch. Patterns
+// are those of http.ServeMux, without a method. Source rules apply as to
+// forwarded paths; middleware, bans and rate limits do not.
+func (p *FDOProxy) Serve(pattern string, h http.Handler) {
+	if p.local == nil {
+		p.local = http.NewServeMux()
+	}
+	p.local.Handle(pattern, h)
+}
+
+// localHandler returns the handler Serve registered for r, nil if none.
+func (p *FDOProxy) localHandler(r *http.Request) http.Handler {
+	if p.local == nil {
+		return nil
+	}
+	if h, pattern := p.local.Handler(r); pattern != "" {
+		return h
+	}
+	return nil
+}
+
+// forwards reports whether r may reach a backend, or is served by the
+// proxy itself, answering it with 404 if not.
+func (p *FDOProxy) forwards(w http.ResponseWriter, r *http.Request) bool {
+	if p.paths == nil || p.paths.allows(r.URL.Path) || p.localHandler(r) != nil {
+		return true
+	}
+	requestID := correlation.RequestID(r.Context())
+	slog.Debug("Request refused for a path not forwarded", "request_id", requestID, "remote_addr", r.RemoteAddr, "method", r.Method, "path", r.URL.EscapedPath())
+	unforwardedPaths.Inc()
+	writeError(w, r, http.StatusNotFound, 0, requestID)
+	return false
+}
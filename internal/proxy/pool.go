@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+)
+
+// Pool load-balancing strategies.
+const (
+	RoundRobin       = "round-robin"
+	LeastConnections = "least-connections"
+)
+
+// Pool is a set of equivalent FDO servers, such as several go-fdo owner
+// instances, that the proxy spreads a role's sessions over. The proxy does
+// not run them; it health-checks each and skips members that fail. Since
+// FDO servers keep session state, every message of a session goes to the
+// member its first message went to.
+type Pool struct {
+	// Strategy is RoundRobin (weighted, the default) or LeastConnections
+	// (fewest requests in flight per unit of weight), applied to the first
+	// message of each session.
+	Strategy string
+	Members  []PoolMember
+	// HealthPath is requested on each member; a 200 answer means healthy
+	// (default /health).
+	HealthPath string
+	// HealthInterval is the time between checks (default 10s).
+	HealthInterval time.Duration
+}
+
+// PoolMember is one server of a Pool.
+type PoolMember struct {
+	URL string
+	// Weight is the member's share of requests relative to the others
+	// (default 1).
+	Weight int
+}
+
+// AddPool serves role, one of the Role constants, by pool instead of a
+// backend the proxy runs.
+func (p *FDOProxy) AddPool(role string, pool Pool) error {
+	switch role {
+	case RoleManufacturer, RoleRendezvous, RoleOwner:
+	default:
+		return fmt.Errorf("unknown backend role %q", role)
+	}
+	if p.roleTarget(role) != nil {
+		return fmt.Errorf("backend role %s added twice", role)
+	}
+	bp, err := newBackendPool(role, pool)
+	if err != nil {
+		return err
+	}
+	p.roles = append(p.roles, &backendTarget{role: role, pool: bp})
+	return nil
+}
+
+// backendPool balances requests over the members of a Pool.
+type backendPool struct {
+	role     string
+	strategy string
+	path     string
+	interval time.Duration
+	members  []*poolMember
+
+	mu sync.Mutex
+}
+
+type poolMember struct {
+	url     *url.URL
+	weight  int
+	proxy   http.Handler
+	healthy atomic.Bool
+	active  atomic.Int64
+	// current is the smooth weighted round-robin state, guarded by
+	// backendPool.mu.
+	current int
+}
+
+func newBackendPool(role string, pool Pool) (*backendPool, error) {
+	bp := &backendPool{
+		role:     role,
+		strategy: pool.Strategy,
+		path:     pool.HealthPath,
+		interval: pool.HealthInterval,
+	}
+	switch bp.strategy {
+	case "":
+		bp.strategy = RoundRobin
+	case RoundRobin, LeastConnections:
+	default:
+		return nil, fmt.Errorf("%s pool: unknown strategy %q: want %s or %s", role, pool.Strategy, RoundRobin, LeastConnections)
+	}
+	if bp.path == "" {
+		bp.path = "/health"
+	}
+	if bp.interval <= 0 {
+		bp.interval = 10 * time.Second
+	}
+	if len(pool.Members) == 0 {
+		return nil, fmt.Errorf("%s pool: no members", role)
+	}
+	for _, m := range pool.Members {
+		u, err := url.Parse(m.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s pool: invalid member URL %q", role, m.URL)
+		}
+		if m.Weight < 0 {
+			return nil, fmt.Errorf("%s pool: member %s: negative weight", role, m.URL)
+		}
+		pm := &poolMember{url: u, weight: max(m.Weight, 1)}
+		pm.healthy.Store(true)
+		bp.members = append(bp.members, pm)
+	}
+	return bp, nil
+}
+
+// pick chooses the member for the next request, nil if none is healthy.
+func (bp *backendPool) pick() *poolMember {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	var best *poolMember
+	if bp.strategy == LeastConnections {
+		for _, m := range bp.members {
+			if !m.healthy.Load() {
+				continue
+			}
+			// Compare active/weight without dividing
+			if best == nil || m.active.Load()*int64(best.weight) < best.active.Load()*int64(m.weight) {
+				best = m
+			}
+		}
+		return best
+	}
+	// Smooth weighted round-robin: members are picked in proportion to
+	// their weight, interleaved rather than in bursts
+	total := 0
+	for _, m := range bp.members {
+		if !m.healthy.Load() {
+			continue
+		}
+		m.current += m.weight
+		total += m.weight
+		if best == nil || m.current > best.current {
+			best = m
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+// memberFor returns the member serving the session sc, picking one for a
+// new session. A session stays on its member even if that turns unhealthy.
+func (bp *backendPool) memberFor(sc *SessionContext) *poolMember {
+	if sc == nil {
+		return bp.pick()
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.member == nil {
+		sc.member = bp.pick()
+	}
+	return sc.member
+}
+
+func (bp *backendPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sc, _ := sessionContextFrom(r.Context())
+	m := bp.memberFor(sc)
+	if m == nil {
+		requestID := correlation.RequestID(r.Context())
+		slog.Warn("No healthy pool member", "request_id", requestID, "role", bp.role)
+		writeError(w, r, http.StatusServiceUnavailable, 0, requestID)
+		return
+	}
+	m.active.Add(1)
+	defer m.active.Add(-1)
+	poolRequests.Inc(bp.role, m.url.String())
+	m.proxy.ServeHTTP(w, r)
+}
+
+// run checks the members until ctx is done.
+func (bp *backendPool) run(ctx context.Context) {
+	bp.check(ctx)
+	ticker := time.NewTicker(bp.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			bp.check(ctx)
+		}
+	}
+}
+
+// check health-checks every member once, concurrently.
+func (bp *backendPool) check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, m := range bp.members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := bp.probe(ctx, m)
+			if ctx.Err() != nil {
+				return
+			}
+			up := err == nil
+			if was := m.healthy.Swap(up); was != up {
+				if up {
+					slog.Info("Pool member healthy", "role", bp.role, "url", m.url.String())
+				} else {
+					slog.Warn("Pool member unhealthy", "role", bp.role, "url", m.url.String(), "error", err)
+				}
+			}
+			poolMemberUp.Set(boolGauge(up), bp.role, m.url.String())
+		}()
+	}
+	wg.Wait()
+}
+
+func (bp *backendPool) probe(ctx context.Context, m *poolMember) error {
+	return checkHealth(ctx, m.url.JoinPath(bp.path).String(), min(bp.interval, 5*time.Second))
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/ban"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/ratelimit"
+)
+
+// RateLimits bound how often new FDO sessions may start.
+type RateLimits struct {
+	// Source limits the sessions started from one client address.
+	Source ratelimit.Rate
+	// Device limits the sessions started by one device, known by its GUID
+	// in TO1 and TO2 and by its serial number in DI. TO0 sessions are
+	// started by owners, not devices, and are not counted.
+	Device ratelimit.Rate
+}
+
+// rateLimiter applies RateLimits with the buckets of a Limiter.
+type rateLimiter struct {
+	l      ratelimit.Limiter
+	limits RateLimits
+}
+
+// LimitRates refuses the first message of a session with 429 when its
+// client address or device is over its rate in limits, taking tokens from
+// the buckets of l. The client address is the one TrustProxies resolves.
+// A nil l removes the limits.
+func (p *FDOProxy) LimitRates(l ratelimit.Limiter, limits RateLimits) {
+	if l == nil {
+		p.rates = nil
+		return
+	}
+	p.rates = &rateLimiter{l: l, limits: limits}
+}
+
+// maxStartPeek bounds how much of a session's first message is read to
+// find the device; the messages that carry it are far smaller.
+const maxStartPeek = 64 << 10
+
+// Ban refuses the first message of a session with 429 while its client
+// address or device is banned in l, telling it with Retry-After when the
+// ban ends if it does. The client address and device are known as for
+// RateLimits; sessions already started run to the end. A nil l lifts the
+// bans.
+func (p *FDOProxy) Ban(l *ban.List) {
+	p.bans = l
+}
+
+// admitStart refuses req if it starts a session for a banned client or
+// device or over a rate limit, returning how long the client should wait
+// if that is known.
+func (p *FDOProxy) admitStart(ctx context.Context, req *http.Request) (time.Duration, error) {
+	msgType, ok := fdo.MessageType(req.URL.Path)
+	if !ok || !sessionStart(msgType) || p.rates == nil && p.bans == nil {
+		return 0, nil
+	}
+	protocol := fdo.Protocol(msgType)
+	rl := p.rates
+	addr := sourceAddr(req.RemoteAddr)
+	var key string
+	if p.bans != nil || rl != nil && !rl.limits.Device.IsZero() {
+		key = deviceKey(req, msgType)
+	}
+	if p.bans != nil {
+		keys := []string{ban.KindIP + ":" + addr}
+		if key != "" {
+			keys = append(keys, key)
+		}
+		if e, banned := p.bans.Check(ctx, keys...); banned {
+			bannedStarts.Inc(e.Kind, e.Source, protocol)
+			var wait time.Duration
+			if !e.Until.IsZero() {
+				wait = time.Until(e.Until)
+			}
+			return wait, fmt.Errorf("%s banned by %s", e.Key(), e.Source)
+		}
+	}
+	if rl == nil {
+		return 0, nil
+	}
+	if !rl.limits.Source.IsZero() && !rl.l.Allow(ctx, ban.KindIP+":"+addr, rl.limits.Source) {
+		rateLimited.Inc("source", protocol)
+		return 0, fmt.Errorf("client %s over its rate limit", addr)
+	}
+	if key != "" && !rl.limits.Device.IsZero() && !rl.l.Allow(ctx, key, rl.limits.Device) {
+		rateLimited.Inc("device", protocol)
+		return 0, fmt.Errorf("device %s over its rate limit", key)
+	}
+	return 0, nil
+}
+
+// sourceAddr is the address of a host:port RemoteAddr, without the port.
+func sourceAddr(remoteAddr string) string {
+	if ap, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		return ap.Addr().Unmap().String()
+	}
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// deviceKey names the device starting a session with req as its bucket
+// and ban do, "" if the message does not identify one. The body is read as far as
+// needed and left for the backend as it was.
+func deviceKey(req *http.Request, msgType int) string {
+	if req.Body == nil || msgType == fdo.MsgTO0Hello {
+		return ""
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxStartPeek))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	if err != nil {
+		return ""
+	}
+	switch msgType {
+	case fdo.MsgDIAppStart:
+		if a, err := fdo.DecodeAppStart(body); err == nil {
+			return ban.KindSerial + ":" + a.SerialNumber
+		}
+	case fdo.MsgTO1HelloRV:
+		if h, err := fdo.DecodeHelloRV(body); err == nil {
+			return ban.KindGUID + ":" + h.GUID.String()
+		}
+	case fdo.MsgTO2HelloDevice:
+		if h, err := fdo.DecodeHelloDevice(body); err == nil {
+			return ban.KindGUID + ":" + h.GUID.String()
+		}
+	}
+	return ""
+}
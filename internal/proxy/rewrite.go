@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ReplaceResponseBody replaces the body of resp, as returned to the device,
+// with body and fixes up the framing headers to match. Middleware rewriting
+// a response must use it rather than assigning resp.Body, or the client
+// sees a Content-Length for the old body.
+func ReplaceResponseBody(resp *http.Response, body []byte) {
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Transfer-Encoding")
+	resp.TransferEncoding = nil
+}
+
+// ReplaceRequestBody is ReplaceResponseBody for a request on its way to
+// the backend.
+func ReplaceRequestBody(req *http.Request, body []byte) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	req.TransferEncoding = nil
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+}
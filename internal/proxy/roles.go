@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+// FDO server roles. With a backend per role the proxy fronts the complete
+// flow: DI goes to the manufacturer, TO0 and TO1 to the rendezvous server
+// and TO2 to the owner.
+const (
+	RoleManufacturer = "manufacturer"
+	RoleRendezvous   = "rendezvous"
+	RoleOwner        = "owner"
+)
+
+// backendTarget is a backend and the reverse proxy forwarding to it. A
+// target with a URL or a pool is served by servers the proxy does not run.
+type backendTarget struct {
+	role    string
+	backend Backend
+	port    int
+	url     *url.URL
+	pool    *backendPool
+	proxy   http.Handler
+	// standby takes new sessions while down is set.
+	standby *backendTarget
+	down    atomic.Bool
+}
+
+// managed reports whether the proxy runs t's backend.
+func (t *backendTarget) managed() bool {
+	return t.url == nil && t.pool == nil
+}
+
+// AddBackend runs b on port as the backend for role, one of the Role
+// constants. Once a role has a backend, the one given to NewFDOProxy or
+// UseBackend is not started; messages of a role without a backend are
+// refused with 404. port is ignored for an in-process backend, one that is
+// an http.RoundTripper.
+func (p *FDOProxy) AddBackend(role string, b Backend, port int) error {
+	switch role {
+	case RoleManufacturer, RoleRendezvous, RoleOwner:
+	default:
+		return fmt.Errorf("unknown backend role %q", role)
+	}
+	if p.roleTarget(role) != nil {
+		return fmt.Errorf("backend role %s added twice", role)
+	}
+	for _, t := range p.roles {
+		// In-process backends take no port
+		if _, ok := b.(http.RoundTripper); ok {
+			break
+		}
+		if t.port == port {
+			return fmt.Errorf("backend port %d used by %s and %s", port, t.role, role)
+		}
+	}
+	p.roles = append(p.roles, &backendTarget{role: role, backend: b, port: port})
+	return nil
+}
+
+// targets lists the backends to run: one per role, or else the single
+// backend serving every protocol.
+func (p *FDOProxy) targets() []*backendTarget {
+	if len(p.roles) > 0 {
+		return p.roles
+	}
+	if p.single == nil {
+		p.single = &backendTarget{backend: p.backend, port: p.backendPort}
+	}
+	return []*backendTarget{p.single}
+}
+
+// newReverseProxy creates the reverse proxy forwarding to t.
+func (p *FDOProxy) newReverseProxy(t *backendTarget) error {
+	if t.pool != nil {
+		for _, m := range t.pool.members {
+			m.proxy = p.reverseProxy(m.url, nil)
+		}
+		t.proxy = t.pool
+		return nil
+	}
+	backendURL := t.url
+	if backendURL == nil {
+		u, err := url.Parse(fmt.Sprintf("http://localhost:%d", t.port))
+		if err != nil {
+			return fmt.Errorf("invalid backend URL: %w", err)
+		}
+		backendURL = u
+	}
+	t.proxy = p.reverseProxy(backendURL, t.backend)
+	return nil
+}
+
+// BackendVersion is the version of an FDO server the proxy forwards to, as
+// far as it can be detected.
+type BackendVersion struct {
+	// Role is empty for the backend serving every protocol.
+	Role string `json:"role,omitempty"`
+	// URL is set for servers the proxy does not run; their version is not
+	// known.
+	URL     string `json:"url,omitempty"`
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// versioner is a Backend that can tell the version of its server.
+type versioner interface {
+	Version(ctx context.Context) (string, error)
+}
+
+// BackendVersions detects the version of every backend, each pool member
+// listed on its own.
+func (p *FDOProxy) BackendVersions(ctx context.Context) []BackendVersion {
+	targets := p.roles
+	if len(targets) == 0 {
+		targets = []*backendTarget{{backend: p.backend}}
+	}
+	var out []BackendVersion
+	for _, t := range targets {
+		switch {
+		case t.pool != nil:
+			for _, m := range t.pool.members {
+				out = append(out, BackendVersion{Role: t.role, URL: m.url.String()})
+			}
+			continue
+		case t.url != nil:
+			out = append(out, BackendVersion{Role: t.role, URL: t.url.String()})
+			continue
+		}
+		v := BackendVersion{Role: t.role}
+		if b, ok := t.backend.(versioner); ok {
+			version, err := b.Version(ctx)
+			if err != nil {
+				v.Error = err.Error()
+			}
+			v.Version = version
+		} else {
+			v.Error = fmt.Sprintf("version of %T backends cannot be detected", t.backend)
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// reverseProxy forwards to u, or through b if it serves messages itself.
+func (p *FDOProxy) reverseProxy(u *url.URL, b Backend) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.ModifyResponse = p.modifyResponse
+	proxy.FlushInterval = p.flushInterval
+	proxy.BufferPool = p.bufferPool
+	proxy.Transport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+	}
+	// An in-process backend serves messages without a listener
+	if rt, ok := b.(http.RoundTripper); ok {
+		proxy.Transport = rt
+	}
+	return proxy
+}
+
+// route picks the backend for a message of the session sc. Requests outside
+// FDO, such as health checks, go to the owner if there is one. It returns
+// nil if the role of the message has no backend.
+func (p *FDOProxy) route(sc *SessionContext) *backendTarget {
+	if len(p.roles) == 0 {
+		return p.single
+	}
+	if role := roleOf(sc.Protocol()); role != "" {
+		return p.roleTarget(role)
+	}
+	for _, role := range []string{RoleOwner, RoleRendezvous, RoleManufacturer} {
+		if t := p.roleTarget(role); t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+func (p *FDOProxy) roleTarget(role string) *backendTarget {
+	for _, t := range p.roles {
+		if t.role == role {
+			return t
+		}
+	}
+	return nil
+}
+
+// roleOf returns the role serving an FDO protocol, "" for none.
+func roleOf(protocol string) string {
+	switch protocol {
+	case "di":
+		return RoleManufacturer
+	case "to0", "to1":
+		return RoleRendezvous
+	case "to2":
+		return RoleOwner
+	}
+	return ""
+}
+
+// AcceptRoles refuses FDO messages of protocols none of roles serves with
+// 403 before they reach middleware or a backend, e.g. TO2 sent to a proxy
+// deployed as a manufacturer. ErrorMessages, which devices send in any
+// protocol, are always accepted. Without roles every message is.
+func (p *FDOProxy) AcceptRoles(roles []string) error {
+	accepted, err := roleSet(roles)
+	if err != nil {
+		return err
+	}
+	p.accepted = accepted
+	return nil
+}
+
+// roleSet checks roles, returning nil for none.
+func roleSet(roles []string) (map[string]bool, error) {
+	if len(roles) == 0 {
+		return nil, nil
+	}
+	set := make(map[string]bool)
+	for _, role := range roles {
+		switch role {
+		case RoleManufacturer, RoleRendezvous, RoleOwner:
+		default:
+			return nil, fmt.Errorf("unknown role %q", role)
+		}
+		set[role] = true
+	}
+	return set, nil
+}
+
+// accepts reports whether the roles served on the listener r came in on
+// take r, answering it with an ErrorMessage if not. Paths other than FDO
+// messages are left to RestrictPaths.
+func (p *FDOProxy) accepts(w http.ResponseWriter, r *http.Request) bool {
+	accepted := p.accepted
+	if l := listenerOf(r); l != nil && l.accepted != nil {
+		accepted = l.accepted
+	}
+	msgType, ok := fdo.MessageType(r.URL.Path)
+	if accepted == nil || !ok || msgType == fdo.MsgError || accepted[roleOf(fdo.Protocol(msgType))] {
+		return true
+	}
+	requestID := correlation.RequestID(r.Context())
+	slog.Warn("Message refused outside the roles served", "request_id", requestID, "correlation_id", CorrelationID(requestID), "remote_addr", r.RemoteAddr, "msg_type", msgType)
+	roleRefused.Inc(strconv.Itoa(msgType))
+	writeError(w, r, http.StatusForbidden, fdo.CodeInvalidMessageError, requestID)
+	return false
+}
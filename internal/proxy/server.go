@@ -2,28 +2,53 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
-	"os"
-	"os/exec"
+	"net/netip"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/fdo-server-wrapper/internal/backend"
+	"github.com/fdo-server-wrapper/internal/ban"
+	"github.com/fdo-server-wrapper/internal/coap"
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/fdo"
 	"github.com/fdo-server-wrapper/internal/ledger"
 )
 
 // FDOProxy represents a reverse proxy that runs the FDO server as a backend
 type FDOProxy struct {
-	backendURL   *url.URL
-	backendCmd   *exec.Cmd
+	backend      Backend
 	backendPort  int
+	roles        []*backendTarget
+	single       *backendTarget
 	ledgerClient LedgerClient
 	middleware   []Middleware
+	contexts     *sessionContexts
 	server       *http.Server
 	mu           sync.Mutex
+
+	flushInterval time.Duration
+	bufferPool    httputil.BufferPool
+	trusted       []netip.Prefix
+	sources       *SourceRules
+	rates         *rateLimiter
+	bans          *ban.List
+	paths         *pathAllowlist
+	local         *http.ServeMux
+	accepted      map[string]bool
+	listeners     []*Listener
+	tlsConfig     *tls.Config
+	sites         map[string]*Site
+	hosts         map[string]*Site
+	standbys      map[string]*standby
+	watchInterval time.Duration
 }
 
 // LedgerClient defines the minimal surface the proxy needs from the ledger layer
@@ -34,12 +59,39 @@ type LedgerClient interface {
 
 // Data models live in the ledger package to avoid duplication
 
-// Middleware interface for request/response processing
+// Backend runs the FDO server the proxy forwards to. Start returns once the
+// server is launched; the proxy then waits for localhost:port/health. A
+// Backend that is also an http.RoundTripper serves messages itself and is
+// neither health-checked nor reached over the network.
+type Backend interface {
+	Start(ctx context.Context, port int) error
+	Stop(ctx context.Context) error
+}
+
+// Middleware interface for request/response processing. sc is the state of
+// the FDO session the message belongs to, shared by all middleware; it is
+// never nil. ProcessResponse may rewrite the response headers and, through
+// ReplaceResponseBody, its body before it reaches the device; middleware
+// later in the chain sees the rewritten response.
 type Middleware interface {
-	ProcessRequest(ctx context.Context, req *http.Request) error
-	ProcessResponse(ctx context.Context, resp *http.Response) error
+	ProcessRequest(ctx context.Context, sc *SessionContext, req *http.Request) error
+	ProcessResponse(ctx context.Context, sc *SessionContext, resp *http.Response) error
+}
+
+// RejectError is returned by middleware ProcessRequest to refuse a request
+// with a specific HTTP status instead of the generic 500. The request is not
+// forwarded to the backend; the device receives an FDO ErrorMessage.
+type RejectError struct {
+	Status int
+	// Code is the FDO error code sent to the device; 0 picks one from Status.
+	Code uint64
+	Err  error
 }
 
+func (e *RejectError) Error() string { return e.Err.Error() }
+
+func (e *RejectError) Unwrap() error { return e.Err }
+
 // NewFDOProxy creates a new FDO proxy server
 func NewFDOProxy(
 	fdoServerPath string,
@@ -49,55 +101,184 @@ func NewFDOProxy(
 	middleware []Middleware,
 ) *FDOProxy {
 	return &FDOProxy{
+		backend:      backend.NewProcess(fdoServerPath, "", fdoArgs),
 		backendPort:  8081, // FDO server will run on this port
 		ledgerClient: ledgerClient,
 		middleware:   middleware,
+		contexts:     newSessionContexts(),
+	}
+}
+
+// EnableStreaming sets how response bodies are copied to devices.
+// flushInterval is passed to httputil.ReverseProxy: 0 flushes only when the
+// copy buffer fills or the body ends, a negative value after every write.
+// bufferSize > 0 copies through pooled buffers of that size instead of a new
+// 32 KiB buffer per response.
+func (p *FDOProxy) EnableStreaming(flushInterval time.Duration, bufferSize int) {
+	p.flushInterval = flushInterval
+	if bufferSize > 0 {
+		p.bufferPool = newBufferPool(bufferSize)
 	}
 }
 
+// UseBackend runs b instead of the go-fdo source tree given to NewFDOProxy.
+func (p *FDOProxy) UseBackend(b Backend) {
+	p.backend = b
+}
+
+// LimitSessions refuses the first message of a new FDO session while n
+// sessions are in flight, so a saturated line sheds new devices rather than
+// slowing down every device. n <= 0 removes the limit.
+func (p *FDOProxy) LimitSessions(n int) {
+	p.contexts.limit(max(n, 0))
+}
+
 // Start starts the proxy server and the backend FDO server
 func (p *FDOProxy) Start(ctx context.Context, listenAddr string) error {
-	// Start the backend FDO server
-	if err := p.startBackendServer(ctx); err != nil {
-		return fmt.Errorf("failed to start backend FDO server: %w", err)
+	// Start the backend FDO servers
+	targets := p.targets()
+	for _, t := range targets {
+		if !t.managed() {
+			continue
+		}
+		if err := p.startBackendServer(ctx, t); err != nil {
+			return fmt.Errorf("failed to start backend FDO server: %w", err)
+		}
 	}
 
-	// Wait for backend to be ready
-	if err := p.waitForBackend(); err != nil {
-		return fmt.Errorf("backend server not ready: %w", err)
+	// Wait for backends to be ready; an in-process backend is served
+	// without a listener, and pools are health-checked on their own
+	for _, t := range targets {
+		if t.pool != nil {
+			go t.pool.run(ctx)
+		} else if _, ok := t.backend.(http.RoundTripper); !ok {
+			if err := waitForBackend(t.port); err != nil {
+				return fmt.Errorf("backend server not ready: %w", err)
+			}
+		}
+		if err := p.newReverseProxy(t); err != nil {
+			return err
+		}
 	}
-
-	// Create reverse proxy
-	backendURL, err := url.Parse(fmt.Sprintf("http://localhost:%d", p.backendPort))
-	if err != nil {
-		return fmt.Errorf("invalid backend URL: %w", err)
+	if err := p.startSites(); err != nil {
+		return err
 	}
-	p.backendURL = backendURL
-
-	// Create proxy handler
-	proxy := httputil.NewSingleHostReverseProxy(backendURL)
-	proxy.ModifyResponse = p.modifyResponse
-	proxy.Transport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
+	if err := p.startStandbys(ctx, targets); err != nil {
+		return err
 	}
 
 	// Create server with middleware
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if err := p.processRequest(ctx, r); err != nil {
-			slog.Error("Request processing failed", "error", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		r.RemoteAddr = p.clientAddr(r)
+		// Tag the request so middleware and ledger calls share its correlation ID
+		r = r.WithContext(correlation.FromRequest(r))
+		reqCtx := r.Context()
+		requestID := correlation.RequestID(reqCtx)
+		w.Header().Set(correlation.RequestIDHeader, requestID)
+		r.Header.Set(correlation.RequestIDHeader, requestID)
+		if tc, ok := correlation.Trace(reqCtx); ok {
+			r.Header.Set(correlation.TraceparentHeader, tc.String())
+		}
+		if !canonicalize(w, r) || !p.forwards(w, r) || !p.accepts(w, r) || !p.allowsSource(w, r) {
+			return
+		}
+		if h := p.localHandler(r); h != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if site := p.siteFor(r); site != nil {
+			reqCtx = withSite(reqCtx, site)
+			r = r.WithContext(reqCtx)
+		}
+		sc := p.contexts.forRequest(r)
+		r = r.WithContext(withSessionContext(reqCtx, sc))
+
+		if err := p.contexts.admit(sc, r); err != nil {
+			slog.Warn("Session refused", "request_id", requestID, "correlation_id", CorrelationID(requestID), "error", err)
+			writeError(w, r, http.StatusServiceUnavailable, 0, requestID)
+			return
+		}
+		// Unless the backend issued a token, the session never started
+		defer p.contexts.release(sc)
+		if wait, err := p.admitStart(reqCtx, r); err != nil {
+			slog.Warn("Session refused", "request_id", requestID, "correlation_id", CorrelationID(requestID), "error", err)
+			if wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			}
+			// Error 500 has devices retry later, as for a policy rate limit
+			writeError(w, r, http.StatusTooManyRequests, fdo.CodeInternalServerError, requestID)
+			return
+		}
+		if err := p.processRequest(reqCtx, sc, r); err != nil {
+			// A refused message ends the session as far as the proxy is concerned
+			p.contexts.end(sc)
+			var rej *RejectError
+			if errors.As(err, &rej) {
+				slog.Warn("Request rejected by middleware", "request_id", requestID, "correlation_id", CorrelationID(requestID), "status", rej.Status, "error", rej.Err)
+				if msgType, ok := fdo.MessageType(r.URL.Path); ok {
+					proxyRejections.Inc(strconv.Itoa(msgType))
+				}
+				writeError(w, r, rej.Status, rej.Code, requestID)
+				return
+			}
+			slog.Error("Request processing failed", "request_id", requestID, "correlation_id", CorrelationID(requestID), "error", err)
+			writeError(w, r, http.StatusInternalServerError, 0, requestID)
+			return
+		}
+		target := p.siteTarget(reqCtx)
+		if target == nil {
+			target = p.route(sc)
+		}
+		if target == nil {
+			slog.Warn("No backend for FDO role", "request_id", requestID, "protocol", sc.Protocol(), "role", roleOf(sc.Protocol()))
+			writeError(w, r, http.StatusNotFound, 0, requestID)
 			return
 		}
-		proxy.ServeHTTP(w, r)
+		target = p.sessionTarget(sc, target)
+		target.proxy.ServeHTTP(w, r)
 	})
 
 	p.server = &http.Server{
 		Addr:    listenAddr,
-		Handler: handler,
+		Handler: instrument(handler),
 	}
+	configureTLS(p.server, p.tlsConfig)
 
-	slog.Info("FDO proxy server starting", "listen_addr", listenAddr, "backend_port", p.backendPort)
-	return p.server.ListenAndServe()
+	for _, t := range targets {
+		slog.Info("FDO proxy server starting", "listen_addr", listenAddr, "tls", p.tlsConfig != nil, "backend_role", t.role, "backend_port", t.port)
+	}
+	for name, s := range p.sites {
+		slog.Info("Server name routed", "server_name", name, "backend_role", s.Role, "backend_url", s.URL, "own_middleware", s.Middleware != nil)
+	}
+	for name, s := range p.hosts {
+		slog.Info("Host routed", "host", name, "backend_role", s.Role, "backend_url", s.URL, "own_middleware", s.Middleware != nil)
+	}
+
+	// Serve until the first listener stops, which Stop makes all do
+	errs := make(chan error, 1+len(p.listeners))
+	for _, l := range p.listeners {
+		if l.CoAP {
+			l.coap = newCoAPServer(l, instrument(handler))
+			slog.Info("FDO proxy CoAP listener starting", "listen_addr", l.Addr, "accept_roles", l.AcceptRoles, "backend_role", l.Site.Role, "backend_url", l.Site.URL, "own_middleware", l.Site.Middleware != nil)
+			go func() {
+				err := l.coap.ListenAndServe()
+				if errors.Is(err, coap.ErrServerClosed) {
+					err = http.ErrServerClosed
+				}
+				errs <- fmt.Errorf("listener %s: %w", l.Addr, err)
+			}()
+			continue
+		}
+		l.server = l.newServer(instrument(handler))
+		slog.Info("FDO proxy listener starting", "listen_addr", l.Addr, "tls", l.TLS != nil, "accept_roles", l.AcceptRoles, "backend_role", l.Site.Role, "backend_url", l.Site.URL, "own_middleware", l.Site.Middleware != nil)
+		go func() {
+			if err := serve(l.server); err != nil {
+				errs <- fmt.Errorf("listener %s: %w", l.Addr, err)
+			}
+		}()
+	}
+	go func() { errs <- serve(p.server) }()
+	return <-errs
 }
 
 // Stop stops the proxy server and the backend FDO server
@@ -111,46 +292,41 @@ func (p *FDOProxy) Stop(ctx context.Context) error {
 			slog.Error("Failed to shutdown proxy server", "error", err)
 		}
 	}
+	for _, l := range p.listeners {
+		var err error
+		switch {
+		case l.server != nil:
+			err = l.server.Shutdown(ctx)
+		case l.coap != nil:
+			err = l.coap.Shutdown(ctx)
+		}
+		if err != nil {
+			slog.Error("Failed to shutdown proxy listener", "listen_addr", l.Addr, "error", err)
+		}
+	}
 
-	// Stop backend server
-	if p.backendCmd != nil && p.backendCmd.Process != nil {
-		if err := p.backendCmd.Process.Kill(); err != nil {
-			slog.Error("Failed to kill backend process", "error", err)
+	// Stop backend servers
+	for _, t := range p.targets() {
+		if !t.managed() {
+			continue
+		}
+		if err := t.backend.Stop(ctx); err != nil {
+			slog.Error("Failed to stop backend server", "role", t.role, "error", err)
 		}
 	}
 
 	return nil
 }
 
-// startBackendServer starts the FDO server as a backend process
-func (p *FDOProxy) startBackendServer(ctx context.Context) error {
+// startBackendServer starts the FDO server backend t
+func (p *FDOProxy) startBackendServer(ctx context.Context, t *backendTarget) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-
-	// Build FDO server command
-	args := []string{
-		"-db", "./fdo-backend.db",
-		"-http", fmt.Sprintf("localhost:%d", p.backendPort),
-		"-debug",
-	}
-
-	// Create command
-	p.backendCmd = exec.CommandContext(ctx, "go", append([]string{"run", "./cmd/server"}, args...)...)
-	p.backendCmd.Dir = "../go-fdo" // Path to go-fdo repository
-	p.backendCmd.Stdout = os.Stdout
-	p.backendCmd.Stderr = os.Stderr
-
-	// Start the backend server
-	if err := p.backendCmd.Start(); err != nil {
-		return fmt.Errorf("failed to start FDO server: %w", err)
-	}
-
-	slog.Info("Backend FDO server started", "pid", p.backendCmd.Process.Pid, "port", p.backendPort)
-	return nil
+	return t.backend.Start(ctx, t.port)
 }
 
-// waitForBackend waits for the backend server to be ready
-func (p *FDOProxy) waitForBackend() error {
+// waitForBackend waits for the backend server on port to be ready
+func waitForBackend(port int) error {
 	timeout := time.After(30 * time.Second)
 	ticker := time.NewTicker(100 * time.Millisecond)
 	defer ticker.Stop()
@@ -160,7 +336,7 @@ func (p *FDOProxy) waitForBackend() error {
 		case <-timeout:
 			return fmt.Errorf("timeout waiting for backend server")
 		case <-ticker.C:
-			resp, err := http.Get(fmt.Sprintf("http://localhost:%d/health", p.backendPort))
+			resp, err := http.Get(fmt.Sprintf("http://localhost:%d/health", port))
 			if err == nil && resp.StatusCode == http.StatusOK {
 				resp.Body.Close()
 				return nil
@@ -170,9 +346,9 @@ func (p *FDOProxy) waitForBackend() error {
 }
 
 // processRequest processes the request through middleware
-func (p *FDOProxy) processRequest(ctx context.Context, req *http.Request) error {
-	for _, mw := range p.middleware {
-		if err := mw.ProcessRequest(ctx, req); err != nil {
+func (p *FDOProxy) processRequest(ctx context.Context, sc *SessionContext, req *http.Request) error {
+	for _, mw := range p.chain(ctx) {
+		if err := mw.ProcessRequest(ctx, sc, req); err != nil {
 			return fmt.Errorf("middleware request processing failed: %w", err)
 		}
 	}
@@ -181,12 +357,56 @@ func (p *FDOProxy) processRequest(ctx context.Context, req *http.Request) error
 
 // modifyResponse processes the response through middleware
 func (p *FDOProxy) modifyResponse(resp *http.Response) error {
+	// The outbound request carries the correlation values set by the handler
 	ctx := context.Background()
-	for _, mw := range p.middleware {
-		if err := mw.ProcessResponse(ctx, resp); err != nil {
-			slog.Error("Middleware response processing failed", "error", err)
+	if resp.Request != nil {
+		ctx = resp.Request.Context()
+		if msgType, ok := fdo.MessageType(resp.Request.URL.Path); ok {
+			slog.Debug("FDO message proxied",
+				"msg_type", msgType,
+				"response_type", resp.Header.Get("Message-Type"),
+				"status", resp.StatusCode,
+				"request_id", correlation.RequestID(ctx))
+		}
+	}
+	sc, ok := sessionContextFrom(ctx)
+	if !ok {
+		sc = &SessionContext{reg: p.contexts, startedAt: time.Now()}
+	}
+	// Bind before middleware runs so they all see the issued token
+	p.contexts.bind(sc, resp)
+
+	for _, mw := range p.chain(ctx) {
+		if err := mw.ProcessResponse(ctx, sc, resp); err != nil {
+			slog.Error("Middleware response processing failed", "request_id", correlation.RequestID(ctx), "error", err)
 			// Don't fail the response, just log the error
 		}
 	}
+	if msgType, err := strconv.Atoi(resp.Header.Get("Message-Type")); err == nil && sessionEnded(msgType) {
+		p.contexts.end(sc)
+	}
 	return nil
 }
+
+// bufferPool is an httputil.BufferPool of fixed-size buffers.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{size: size}
+}
+
+func (b *bufferPool) Get() []byte {
+	if buf, ok := b.pool.Get().(*[]byte); ok {
+		return *buf
+	}
+	return make([]byte, b.size)
+}
+
+func (b *bufferPool) Put(buf []byte) {
+	if len(buf) == b.size {
+		b.pool.Put(&buf)
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Site is how the proxy serves requests for one name, so one listener can
+// front e.g. mfg.example.com and owner.example.com. Sites are selected by
+// TLS server name (SNI) or by Host header.
+type Site struct {
+	// Role, if set, sends every request for the name to that role's
+	// backend instead of routing by protocol.
+	Role string
+	// URL, if set, sends every request for the name to an FDO server the
+	// proxy does not run, e.g. http://10.0.0.5:8080. It excludes Role.
+	URL string
+	// Middleware replaces the proxy's chain for the name; nil keeps it.
+	Middleware []Middleware
+
+	target *backendTarget
+}
+
+type siteKey struct{}
+
+// RouteServerName serves requests whose TLS server name is name as s
+// describes. Names are matched case-insensitively; requests without TLS or
+// for other names keep the proxy's routing and middleware.
+func (p *FDOProxy) RouteServerName(name string, s Site) error {
+	if p.sites == nil {
+		p.sites = make(map[string]*Site)
+	}
+	return addSite(p.sites, "server name", name, s)
+}
+
+// RouteHost serves requests whose Host header is host, without the port,
+// as s describes. A site for the TLS server name takes precedence.
+func (p *FDOProxy) RouteHost(host string, s Site) error {
+	if p.hosts == nil {
+		p.hosts = make(map[string]*Site)
+	}
+	return addSite(p.hosts, "host", host, s)
+}
+
+func addSite(sites map[string]*Site, kind, name string, s Site) error {
+	if err := s.prepare(kind, name); err != nil {
+		return err
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return fmt.Errorf("empty %s", kind)
+	}
+	if _, dup := sites[name]; dup {
+		return fmt.Errorf("%s %s routed twice", kind, name)
+	}
+	sites[name] = &s
+	return nil
+}
+
+// prepare checks s, the site of the kind of route name, and creates the
+// target of its URL.
+func (s *Site) prepare(kind, name string) error {
+	switch s.Role {
+	case "", RoleManufacturer, RoleRendezvous, RoleOwner:
+	default:
+		return fmt.Errorf("%s %s: unknown backend role %q", kind, name, s.Role)
+	}
+	if s.URL != "" {
+		if s.Role != "" {
+			return fmt.Errorf("%s %s: role and URL are exclusive", kind, name)
+		}
+		u, err := url.Parse(s.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s %s: invalid backend URL %q", kind, name, s.URL)
+		}
+		s.target = &backendTarget{role: kind + " " + name, url: u}
+	}
+	return nil
+}
+
+// startSites checks that roles of sites, and of listeners, have a backend
+// and creates the reverse proxies of those with a URL.
+func (p *FDOProxy) startSites() error {
+	if len(p.sites) > 0 && p.tlsConfig == nil {
+		return fmt.Errorf("server name routes need TLS on the listener")
+	}
+	for _, sites := range []map[string]*Site{p.sites, p.hosts} {
+		for name, s := range sites {
+			if err := p.startSite(name, s); err != nil {
+				return err
+			}
+		}
+	}
+	for _, l := range p.listeners {
+		if err := p.startSite("listener "+l.Addr, &l.Site); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *FDOProxy) startSite(name string, s *Site) error {
+	if s.Role != "" && p.roleTarget(s.Role) == nil {
+		return fmt.Errorf("%s: no backend for role %s", name, s.Role)
+	}
+	if s.target != nil {
+		return p.newReverseProxy(s.target)
+	}
+	return nil
+}
+
+// siteFor returns the site r was sent to, nil for none. Requests to an
+// added listener are served as its site, whatever their name.
+func (p *FDOProxy) siteFor(r *http.Request) *Site {
+	if l := listenerOf(r); l != nil {
+		return &l.Site
+	}
+	if len(p.sites) == 0 && len(p.hosts) == 0 {
+		return nil
+	}
+	if r.TLS != nil {
+		if s, ok := p.sites[strings.ToLower(r.TLS.ServerName)]; ok {
+			return s
+		}
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return p.hosts[strings.ToLower(strings.TrimSuffix(host, "."))]
+}
+
+func withSite(ctx context.Context, s *Site) context.Context {
+	return context.WithValue(ctx, siteKey{}, s)
+}
+
+// chain returns the middleware for the request carrying ctx.
+func (p *FDOProxy) chain(ctx context.Context) []Middleware {
+	if s, ok := ctx.Value(siteKey{}).(*Site); ok && s.Middleware != nil {
+		return s.Middleware
+	}
+	return p.middleware
+}
+
+// siteTarget returns the backend of the site the request carrying ctx was
+// sent to, nil if it does not pin one.
+func (p *FDOProxy) siteTarget(ctx context.Context) *backendTarget {
+	s, ok := ctx.Value(siteKey{}).(*Site)
+	switch {
+	case !ok:
+		return nil
+	case s.target != nil:
+		return s.target
+	case s.Role != "":
+		return p.roleTarget(s.Role)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+// SourceRule allows or denies the requests it matches. Rules usually match
+// on Sources, optionally narrowed to protocols or hosts, e.g. only the
+// factory subnet may reach DI.
+type SourceRule struct {
+	// Action is allow or deny.
+	Action string `json:"action"`
+	Match
+}
+
+// SourceRules decide which clients may reach the proxy listener at all,
+// before any session or device identity is considered. The first matching
+// rule applies; Default applies when none does.
+type SourceRules struct {
+	Rules []SourceRule `json:"rules"`
+	// Default is allow (the default) or deny.
+	Default string `json:"default,omitempty"`
+}
+
+// LoadSourceRules reads source rules from a JSON file.
+func LoadSourceRules(path string) (*SourceRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var s SourceRules
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("parse source rules %s: %w", path, err)
+	}
+	switch s.Default {
+	case "":
+		s.Default = "allow"
+	case "allow", "deny":
+	default:
+		return nil, fmt.Errorf("source rules %s: unknown default %q", path, s.Default)
+	}
+	for i := range s.Rules {
+		r := &s.Rules[i]
+		if r.Action != "allow" && r.Action != "deny" {
+			return nil, fmt.Errorf("source rules %s: rule %d: unknown action %q", path, i, r.Action)
+		}
+		if err := r.Validate(); err != nil {
+			return nil, fmt.Errorf("source rules %s: rule %d: %w", path, i, err)
+		}
+	}
+	return &s, nil
+}
+
+// Allows reports whether req may be served.
+func (s *SourceRules) Allows(req *http.Request) bool {
+	for i := range s.Rules {
+		if s.Rules[i].Matches(req) {
+			return s.Rules[i].Action == "allow"
+		}
+	}
+	return s.Default != "deny"
+}
+
+// RestrictSources refuses requests rules deny with an FDO ErrorMessage
+// before they reach middleware or a backend. The client address is the
+// one TrustProxies resolves. nil serves every client. Listeners with
+// SourceRules of their own are not covered.
+func (p *FDOProxy) RestrictSources(rules *SourceRules) {
+	p.sources = rules
+}
+
+// allowsSource answers r with an ErrorMessage and returns false if the
+// source rules of the listener it came in on deny it.
+func (p *FDOProxy) allowsSource(w http.ResponseWriter, r *http.Request) bool {
+	rules := p.sources
+	if l := listenerOf(r); l != nil && l.SourceRules != nil {
+		rules = l.SourceRules
+	}
+	if rules == nil || rules.Allows(r) {
+		return true
+	}
+	requestID := correlation.RequestID(r.Context())
+	msgType, _ := fdo.MessageType(r.URL.Path)
+	slog.Warn("Request refused by source rules", "request_id", requestID, "correlation_id", CorrelationID(requestID), "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+	sourcesDenied.Inc(fdo.Protocol(msgType))
+	writeError(w, r, http.StatusForbidden, fdo.CodeInvalidIPAddress, requestID)
+	return false
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// TLSPolicy restricts what the proxy listener negotiates with devices.
+// Zero fields keep the Go defaults.
+type TLSPolicy struct {
+	// MinVersion is 1.2 or 1.3 (default 1.2).
+	MinVersion string
+	// CipherSuites are IANA names such as
+	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. They apply to TLS 1.2;
+	// TLS 1.3 suites are not configurable.
+	CipherSuites []string
+	// Curves are key exchange groups in preference order: X25519, P256,
+	// P384 or P521.
+	Curves []string
+	// ALPN lists application protocols in preference order: h2 and
+	// http/1.1. Without h2 the listener serves HTTP/1.1 only.
+	ALPN []string
+	// ClientCAs, when set, requires every device to present a certificate
+	// chaining to one of them.
+	ClientCAs *x509.CertPool
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// Config builds a server tls.Config carrying certs and the policy.
+// Cipher suites Go considers insecure are refused.
+func (t *TLSPolicy) Config(certs []tls.Certificate) (*tls.Config, error) {
+	cfg := &tls.Config{
+		Certificates: certs,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.MinVersion != "" {
+		v, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS minimum version %q (want 1.2 or 1.3)", t.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	for _, name := range t.CipherSuites {
+		i := slices.IndexFunc(tls.CipherSuites(), func(cs *tls.CipherSuite) bool { return cs.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		cs := tls.CipherSuites()[i]
+		if !slices.Contains(cs.SupportedVersions, tls.VersionTLS12) {
+			return nil, fmt.Errorf("cipher suite %s is TLS 1.3 only and always enabled", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, cs.ID)
+	}
+	for _, name := range t.Curves {
+		id, ok := tlsCurves[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+	}
+	for _, proto := range t.ALPN {
+		if proto != "h2" && proto != "http/1.1" {
+			return nil, fmt.Errorf("unsupported ALPN protocol %q", proto)
+		}
+	}
+	cfg.NextProtos = t.ALPN
+	if t.ClientCAs != nil {
+		cfg.ClientCAs = t.ClientCAs
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// EnableTLS serves the proxy listener over TLS with cfg, typically built
+// by TLSPolicy.Config. Unless cfg.NextProtos is empty or offers h2, HTTP/2
+// is not served.
+func (p *FDOProxy) EnableTLS(cfg *tls.Config) {
+	p.tlsConfig = cfg
+}
+
+// configureTLS serves srv over TLS with cfg, if set.
+func configureTLS(srv *http.Server, cfg *tls.Config) {
+	if cfg == nil {
+		return
+	}
+	srv.TLSConfig = cfg
+	if len(cfg.NextProtos) > 0 && !slices.Contains(cfg.NextProtos, "h2") {
+		// A non-nil map stops net/http from adding HTTP/2
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+}
@@ -0,0 +1,366 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+// Message is an FDO message as handed to typed handlers. The decoded form
+// is passed alongside; it is nil when the body could not be decoded, with
+// the reason in DecodeErr (fdo.ErrEncrypted for protected ServiceInfo).
+type Message struct {
+	// Type is the FDO message type.
+	Type int
+	// InReplyTo is the type of the request a response answers, 0 for
+	// requests.
+	InReplyTo int
+	// Body is the raw message body, already restored for the backend or
+	// client. Handlers must not modify it in place; use Rewrite.
+	Body      []byte
+	DecodeErr error
+	// Truncated is set when the body exceeded the dispatcher's inspection
+	// limit: Body is then only its start, the rest streams through unseen,
+	// and DecodeErr is ErrBodyTooLarge (fdo.ErrEncrypted for protected
+	// ServiceInfo).
+	Truncated bool
+	// Size is the full body length, or -1 if a truncated body was sent
+	// without Content-Length.
+	Size int64
+
+	// Request is the device's request, also set for responses.
+	Request *http.Request
+	// Response is the backend's response, nil for requests.
+	Response *http.Response
+}
+
+// ErrBodyTooLarge is the DecodeErr of a truncated message.
+var ErrBodyTooLarge = errors.New("body exceeds inspection limit")
+
+// Rewrite replaces the message body forwarded to the backend (requests) or
+// returned to the device (responses), fixing up Content-Length. Handlers
+// running later see the new Body, but the decoded message they are passed
+// still describes the original.
+func (m *Message) Rewrite(body []byte) {
+	m.Body = body
+	m.Truncated = false
+	m.Size = int64(len(body))
+	if m.Response != nil {
+		ReplaceResponseBody(m.Response, body)
+		return
+	}
+	ReplaceRequestBody(m.Request, body)
+}
+
+// Typed handlers receive FDO messages the proxy has already decoded, so a
+// body is read and parsed once however many handlers want it. A handler
+// implements any subset of the interfaces below and is installed with
+// NewDispatcher. Request handlers may refuse the message by returning a
+// *RejectError; errors from response handlers are logged and do not
+// interrupt the FDO flow.
+//
+// Contract, for every handler method:
+//
+//	Preconditions:
+//	  - ctx, sc and m are not nil
+//	  - the decoded message is nil exactly when m.DecodeErr is set
+//
+//	Postconditions:
+//	  - Returns nil if processing succeeds or the message is of no interest
+//	  - Returns *RejectError (request handlers) to refuse the message
+
+// DIAppStartHandler receives DI.AppStart (msg 10) requests.
+type DIAppStartHandler interface {
+	OnDIAppStart(ctx context.Context, sc *SessionContext, msg *fdo.AppStart, m *Message) error
+}
+
+// DISetCredentialsHandler receives DI.SetCredentials (msg 11) responses.
+type DISetCredentialsHandler interface {
+	OnDISetCredentials(ctx context.Context, sc *SessionContext, msg *fdo.SetCredentials, m *Message) error
+}
+
+// DIDoneHandler receives DI.Done (msg 13) responses.
+type DIDoneHandler interface {
+	OnDIDone(ctx context.Context, sc *SessionContext, m *Message) error
+}
+
+// TO2HelloDeviceHandler receives TO2.HelloDevice (msg 60) requests.
+type TO2HelloDeviceHandler interface {
+	OnTO2HelloDevice(ctx context.Context, sc *SessionContext, msg *fdo.HelloDevice, m *Message) error
+}
+
+// TO2ProveOVHdrHandler receives TO2.ProveOVHdr (msg 61) responses. The
+// session token the backend issued with it is already bound to sc.
+type TO2ProveOVHdrHandler interface {
+	OnTO2ProveOVHdr(ctx context.Context, sc *SessionContext, msg *fdo.ProveOVHdr, m *Message) error
+}
+
+// TO2ProveDeviceHandler receives TO2.ProveDevice (msg 64) requests.
+type TO2ProveDeviceHandler interface {
+	OnTO2ProveDevice(ctx context.Context, sc *SessionContext, msg *fdo.ProveDevice, m *Message) error
+}
+
+// TO2ServiceInfoHandler receives TO2.DeviceServiceInfo (msg 68) requests
+// and TO2.OwnerServiceInfo (msg 69) responses; m.Type tells them apart.
+type TO2ServiceInfoHandler interface {
+	OnTO2ServiceInfo(ctx context.Context, sc *SessionContext, kvs []fdo.ServiceInfoKV, m *Message) error
+}
+
+// TO2Done2Handler receives TO2.Done2 (msg 71) responses.
+type TO2Done2Handler interface {
+	OnTO2Done2(ctx context.Context, sc *SessionContext, m *Message) error
+}
+
+// ErrorMessageHandler receives ErrorMessage (msg 255) responses for every
+// protocol; sc.Protocol and m.InReplyTo tell which exchange failed.
+type ErrorMessageHandler interface {
+	OnErrorMessage(ctx context.Context, sc *SessionContext, msg *fdo.ErrorMessage, m *Message) error
+}
+
+// Dispatcher is a Middleware that decodes FDO messages and hands them to
+// typed handlers in the order given.
+type Dispatcher struct {
+	handlers []any
+	// requests and responses are the message types some handler wants.
+	requests  map[int]bool
+	responses map[int]bool
+	// limit bounds the bytes of a body held in memory; 0 is unbounded.
+	limit int
+}
+
+// NewDispatcher creates a dispatcher for handlers, each implementing one or
+// more of the typed handler interfaces.
+func NewDispatcher(handlers ...any) (*Dispatcher, error) {
+	d := &Dispatcher{handlers: handlers, requests: make(map[int]bool), responses: make(map[int]bool)}
+	for _, h := range handlers {
+		n := 0
+		want := func(ok bool, set map[int]bool, types ...int) {
+			if !ok {
+				return
+			}
+			n++
+			for _, t := range types {
+				set[t] = true
+			}
+		}
+		_, ok := h.(DIAppStartHandler)
+		want(ok, d.requests, fdo.MsgDIAppStart)
+		_, ok = h.(DISetCredentialsHandler)
+		want(ok, d.responses, fdo.MsgDISetCredentials)
+		_, ok = h.(DIDoneHandler)
+		want(ok, d.responses, fdo.MsgDIDone)
+		_, ok = h.(TO2HelloDeviceHandler)
+		want(ok, d.requests, fdo.MsgTO2HelloDevice)
+		_, ok = h.(TO2ProveOVHdrHandler)
+		want(ok, d.responses, fdo.MsgTO2ProveOVHdr)
+		_, ok = h.(TO2ProveDeviceHandler)
+		want(ok, d.requests, fdo.MsgTO2ProveDevice)
+		_, ok = h.(TO2ServiceInfoHandler)
+		want(ok, d.requests, fdo.MsgTO2DeviceServiceInfo)
+		want(ok, d.responses, fdo.MsgTO2OwnerServiceInfo)
+		_, ok = h.(TO2Done2Handler)
+		want(ok, d.responses, fdo.MsgTO2Done2)
+		_, ok = h.(ErrorMessageHandler)
+		want(ok, d.responses, fdo.MsgError)
+		if n == 0 {
+			return nil, fmt.Errorf("%T implements no typed handler interface", h)
+		}
+	}
+	return d, nil
+}
+
+// LimitInspection has handlers see at most the first n bytes of a body.
+// Larger bodies, such as firmware carried in ServiceInfo, stream between
+// device and backend instead of being buffered whole. n <= 0 removes the
+// limit.
+func (d *Dispatcher) LimitInspection(n int) {
+	d.limit = max(n, 0)
+}
+
+// ProcessRequest implements Middleware.
+func (d *Dispatcher) ProcessRequest(ctx context.Context, sc *SessionContext, req *http.Request) error {
+	msgType, ok := fdo.MessageType(req.URL.Path)
+	if !ok || !d.requests[msgType] {
+		return nil
+	}
+	m := &Message{Type: msgType, Request: req}
+	if err := d.inspect(m, &req.Body, req.ContentLength); err != nil {
+		return fmt.Errorf("read request body: %w", err)
+	}
+	if m.Truncated {
+		return d.truncated(ctx, sc, m)
+	}
+	body := m.Body
+
+	switch msgType {
+	case fdo.MsgDIAppStart:
+		msg, err := fdo.DecodeAppStart(body)
+		m.DecodeErr = err
+		return each(d.handlers, func(h DIAppStartHandler) error { return h.OnDIAppStart(ctx, sc, msg, m) })
+	case fdo.MsgTO2HelloDevice:
+		msg, err := fdo.DecodeHelloDevice(body)
+		m.DecodeErr = err
+		return each(d.handlers, func(h TO2HelloDeviceHandler) error { return h.OnTO2HelloDevice(ctx, sc, msg, m) })
+	case fdo.MsgTO2ProveDevice:
+		msg, err := fdo.DecodeProveDevice(body)
+		m.DecodeErr = err
+		return each(d.handlers, func(h TO2ProveDeviceHandler) error { return h.OnTO2ProveDevice(ctx, sc, msg, m) })
+	case fdo.MsgTO2DeviceServiceInfo:
+		kvs, err := fdo.DecodeServiceInfo(msgType, body)
+		m.DecodeErr = err
+		return each(d.handlers, func(h TO2ServiceInfoHandler) error { return h.OnTO2ServiceInfo(ctx, sc, kvs, m) })
+	}
+	return nil
+}
+
+// ProcessResponse implements Middleware. Every handler runs even if an
+// earlier one fails; their errors are joined.
+func (d *Dispatcher) ProcessResponse(ctx context.Context, sc *SessionContext, resp *http.Response) error {
+	msgType, err := strconv.Atoi(resp.Header.Get("Message-Type"))
+	if err != nil || !d.responses[msgType] || resp.Request == nil {
+		return nil
+	}
+	m := &Message{Type: msgType, Request: resp.Request, Response: resp}
+	m.InReplyTo, _ = fdo.MessageType(resp.Request.URL.Path)
+	if err := d.inspect(m, &resp.Body, resp.ContentLength); err != nil {
+		return fmt.Errorf("read response body: %w", err)
+	}
+	if m.Truncated {
+		return d.truncated(ctx, sc, m)
+	}
+	body := m.Body
+
+	switch msgType {
+	case fdo.MsgDISetCredentials:
+		msg, err := fdo.DecodeSetCredentials(body)
+		m.DecodeErr = err
+		return eachAll(d.handlers, func(h DISetCredentialsHandler) error { return h.OnDISetCredentials(ctx, sc, msg, m) })
+	case fdo.MsgDIDone:
+		return eachAll(d.handlers, func(h DIDoneHandler) error { return h.OnDIDone(ctx, sc, m) })
+	case fdo.MsgTO2ProveOVHdr:
+		msg, err := fdo.DecodeProveOVHdr(body)
+		m.DecodeErr = err
+		return eachAll(d.handlers, func(h TO2ProveOVHdrHandler) error { return h.OnTO2ProveOVHdr(ctx, sc, msg, m) })
+	case fdo.MsgTO2OwnerServiceInfo:
+		kvs, err := fdo.DecodeServiceInfo(msgType, body)
+		m.DecodeErr = err
+		return eachAll(d.handlers, func(h TO2ServiceInfoHandler) error { return h.OnTO2ServiceInfo(ctx, sc, kvs, m) })
+	case fdo.MsgTO2Done2:
+		return eachAll(d.handlers, func(h TO2Done2Handler) error { return h.OnTO2Done2(ctx, sc, m) })
+	case fdo.MsgError:
+		msg, err := fdo.DecodeErrorMessage(body)
+		m.DecodeErr = err
+		return eachAll(d.handlers, func(h ErrorMessageHandler) error { return h.OnErrorMessage(ctx, sc, msg, m) })
+	}
+	return nil
+}
+
+// each calls fn for every handler implementing H, stopping at the first
+// error.
+func each[H any](handlers []any, fn func(H) error) error {
+	for _, h := range handlers {
+		if x, ok := h.(H); ok {
+			if err := fn(x); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// eachAll calls fn for every handler implementing H and joins their errors.
+func eachAll[H any](handlers []any, fn func(H) error) error {
+	var errs []error
+	for _, h := range handlers {
+		if x, ok := h.(H); ok {
+			if err := fn(x); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// truncated hands a message too large to decode to the handlers that want
+// its type, undecoded. Only ServiceInfo can be told apart as encrypted.
+func (d *Dispatcher) truncated(ctx context.Context, sc *SessionContext, m *Message) error {
+	m.DecodeErr = ErrBodyTooLarge
+	switch m.Type {
+	case fdo.MsgDIAppStart:
+		return each(d.handlers, func(h DIAppStartHandler) error { return h.OnDIAppStart(ctx, sc, nil, m) })
+	case fdo.MsgTO2HelloDevice:
+		return each(d.handlers, func(h TO2HelloDeviceHandler) error { return h.OnTO2HelloDevice(ctx, sc, nil, m) })
+	case fdo.MsgTO2ProveDevice:
+		return each(d.handlers, func(h TO2ProveDeviceHandler) error { return h.OnTO2ProveDevice(ctx, sc, nil, m) })
+	case fdo.MsgTO2DeviceServiceInfo, fdo.MsgTO2OwnerServiceInfo:
+		if fdo.IsEncryptedPrefix(m.Body) {
+			m.DecodeErr = fdo.ErrEncrypted
+		}
+		if m.Response == nil {
+			return each(d.handlers, func(h TO2ServiceInfoHandler) error { return h.OnTO2ServiceInfo(ctx, sc, nil, m) })
+		}
+		return eachAll(d.handlers, func(h TO2ServiceInfoHandler) error { return h.OnTO2ServiceInfo(ctx, sc, nil, m) })
+	case fdo.MsgDISetCredentials:
+		return eachAll(d.handlers, func(h DISetCredentialsHandler) error { return h.OnDISetCredentials(ctx, sc, nil, m) })
+	case fdo.MsgDIDone:
+		return eachAll(d.handlers, func(h DIDoneHandler) error { return h.OnDIDone(ctx, sc, m) })
+	case fdo.MsgTO2ProveOVHdr:
+		return eachAll(d.handlers, func(h TO2ProveOVHdrHandler) error { return h.OnTO2ProveOVHdr(ctx, sc, nil, m) })
+	case fdo.MsgTO2Done2:
+		return eachAll(d.handlers, func(h TO2Done2Handler) error { return h.OnTO2Done2(ctx, sc, m) })
+	case fdo.MsgError:
+		return eachAll(d.handlers, func(h ErrorMessageHandler) error { return h.OnErrorMessage(ctx, sc, nil, m) })
+	}
+	return nil
+}
+
+// inspect reads *body into m, or with a limit set only its start, and
+// replaces *body with a reader yielding the same bytes. size is the
+// declared length, -1 if unknown.
+func (d *Dispatcher) inspect(m *Message, body *io.ReadCloser, size int64) error {
+	m.Size = size
+	if *body == nil {
+		m.Size = 0
+		return nil
+	}
+	if d.limit == 0 || (size >= 0 && size <= int64(d.limit)) {
+		b, err := io.ReadAll(*body)
+		(*body).Close()
+		if err != nil {
+			return err
+		}
+		*body = io.NopCloser(bytes.NewReader(b))
+		m.Body, m.Size = b, int64(len(b))
+		return nil
+	}
+
+	// Read one byte past the limit to learn whether anything is left
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, *body, int64(d.limit)+1)
+	if err != nil && err != io.EOF {
+		(*body).Close()
+		return err
+	}
+	if n <= int64(d.limit) {
+		(*body).Close()
+		*body = io.NopCloser(bytes.NewReader(buf.Bytes()))
+		m.Body, m.Size = buf.Bytes(), n
+		return nil
+	}
+	*body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(buf.Bytes()), *body), Closer: *body}
+	m.Body = buf.Bytes()[:d.limit]
+	m.Truncated = true
+	return nil
+}
+
+// prefixedBody is a body whose start was read ahead for inspection.
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+// appStartHex is a DI.AppStart for serial SN-0001.
+const appStartHex = "8157850a0167534e2d30303031686f6e69652d783836423081"
+
+// recorder is a typed handler noting what it was handed, failing with err.
+type recorder struct {
+	name  string
+	calls *[]string
+	err   error
+
+	app  *fdo.AppStart
+	msg  *Message
+	body []byte
+}
+
+func (h *recorder) OnDIAppStart(_ context.Context, _ *SessionContext, app *fdo.AppStart, m *Message) error {
+	*h.calls = append(*h.calls, h.name)
+	h.app, h.msg, h.body = app, m, m.Body
+	return h.err
+}
+
+func (h *recorder) OnDIDone(_ context.Context, _ *SessionContext, m *Message) error {
+	*h.calls = append(*h.calls, h.name)
+	h.msg = m
+	return h.err
+}
+
+func appStartRequest(t *testing.T, body []byte) *http.Request {
+	t.Helper()
+	return httptest.NewRequest(http.MethodPost, "/fdo/101/msg/"+strconv.Itoa(fdo.MsgDIAppStart), bytes.NewReader(body))
+}
+
+func TestNewDispatcherNoInterface(t *testing.T) {
+	if _, err := NewDispatcher(struct{}{}); err == nil {
+		t.Error("NewDispatcher accepted a handler implementing no typed interface")
+	}
+}
+
+func TestDispatcherRequest(t *testing.T) {
+	body, _ := hex.DecodeString(appStartHex)
+	var calls []string
+	refuse := &RejectError{Status: http.StatusForbidden, Err: errors.New("refused")}
+	first := &recorder{name: "first", calls: &calls}
+	second := &recorder{name: "second", calls: &calls, err: refuse}
+	third := &recorder{name: "third", calls: &calls}
+	d, err := NewDispatcher(first, second, third)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := appStartRequest(t, body)
+	err = d.ProcessRequest(context.Background(), NewSessionContext("di"), req)
+	if !errors.Is(err, refuse) {
+		t.Fatalf("ProcessRequest = %v, want the second handler's rejection", err)
+	}
+	if len(calls) != 2 || calls[0] != "first" || calls[1] != "second" {
+		t.Errorf("handlers called = %v, want [first second]", calls)
+	}
+	if first.app == nil || first.app.SerialNumber != "SN-0001" || first.msg.DecodeErr != nil {
+		t.Errorf("decoded = %+v, %v, want serial SN-0001", first.app, first.msg.DecodeErr)
+	}
+	if first.msg.Type != fdo.MsgDIAppStart || first.msg.Request != req || first.msg.Size != int64(len(body)) {
+		t.Errorf("message = type %d, size %d, want %d, %d", first.msg.Type, first.msg.Size, fdo.MsgDIAppStart, len(body))
+	}
+
+	// The backend still gets the whole body
+	if got, _ := io.ReadAll(req.Body); !bytes.Equal(got, body) {
+		t.Errorf("forwarded body = %x, want %x", got, body)
+	}
+}
+
+func TestDispatcherUndecodable(t *testing.T) {
+	var calls []string
+	h := &recorder{name: "h", calls: &calls}
+	d, err := NewDispatcher(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ProcessRequest(context.Background(), NewSessionContext("di"), appStartRequest(t, []byte{0x81, 0x41})); err != nil {
+		t.Fatal(err)
+	}
+	if h.app != nil || h.msg == nil || h.msg.DecodeErr == nil {
+		t.Errorf("handed %+v with error %v, want nil and the decode error", h.app, h.msg.DecodeErr)
+	}
+}
+
+func TestDispatcherResponse(t *testing.T) {
+	var calls []string
+	errA, errB := errors.New("a"), errors.New("b")
+	a := &recorder{name: "a", calls: &calls, err: errA}
+	b := &recorder{name: "b", calls: &calls, err: errB}
+	d, err := NewDispatcher(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &http.Response{
+		Header:  http.Header{"Message-Type": {strconv.Itoa(fdo.MsgDIDone)}},
+		Body:    io.NopCloser(bytes.NewReader([]byte{0xf6})),
+		Request: httptest.NewRequest(http.MethodPost, "/fdo/101/msg/"+strconv.Itoa(fdo.MsgDISetHMAC), nil),
+	}
+	err = d.ProcessResponse(context.Background(), NewSessionContext("di"), resp)
+	if !errors.Is(err, errA) || !errors.Is(err, errB) {
+		t.Errorf("ProcessResponse = %v, want both handlers' errors", err)
+	}
+	if len(calls) != 2 {
+		t.Errorf("handlers called = %v, want both", calls)
+	}
+	if a.msg.InReplyTo != fdo.MsgDISetHMAC || a.msg.Response != resp {
+		t.Errorf("InReplyTo = %d, want %d", a.msg.InReplyTo, fdo.MsgDISetHMAC)
+	}
+
+	// Types no handler wants are left alone
+	calls = nil
+	resp.Header.Set("Message-Type", strconv.Itoa(fdo.MsgDISetCredentials))
+	if err := d.ProcessResponse(context.Background(), NewSessionContext("di"), resp); err != nil || len(calls) != 0 {
+		t.Errorf("unwanted type = %v with calls %v, want nil and none", err, calls)
+	}
+}
+
+func TestDispatcherInspectionLimit(t *testing.T) {
+	body, _ := hex.DecodeString(appStartHex)
+	var calls []string
+	h := &recorder{name: "h", calls: &calls}
+	d, err := NewDispatcher(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.LimitInspection(8)
+
+	req := appStartRequest(t, body)
+	if err := d.ProcessRequest(context.Background(), NewSessionContext("di"), req); err != nil {
+		t.Fatal(err)
+	}
+	if !h.msg.Truncated || !errors.Is(h.msg.DecodeErr, ErrBodyTooLarge) || h.app != nil {
+		t.Errorf("truncated, error = %v, %v, want true, ErrBodyTooLarge", h.msg.Truncated, h.msg.DecodeErr)
+	}
+	if !bytes.Equal(h.body, body[:8]) || h.msg.Size != int64(len(body)) {
+		t.Errorf("inspected %x of %d bytes, want %x of %d", h.body, h.msg.Size, body[:8], len(body))
+	}
+	if got, _ := io.ReadAll(req.Body); !bytes.Equal(got, body) {
+		t.Errorf("forwarded body = %x, want %x", got, body)
+	}
+
+	// A body within the limit is decoded as usual
+	d.LimitInspection(len(body))
+	if err := d.ProcessRequest(context.Background(), NewSessionContext("di"), appStartRequest(t, body)); err != nil {
+		t.Fatal(err)
+	}
+	if h.msg.Truncated || h.app == nil {
+		t.Errorf("body at the limit truncated = %v, decoded %+v", h.msg.Truncated, h.app)
+	}
+}
+
+func TestMessageRewrite(t *testing.T) {
+	req := appStartRequest(t, []byte("old"))
+	m := &Message{Type: fdo.MsgDIAppStart, Body: []byte("old"), Request: req, Truncated: true}
+	m.Rewrite([]byte("rewritten"))
+	if m.Truncated || m.Size != 9 || req.ContentLength != 9 {
+		t.Errorf("truncated, size, Content-Length = %v, %d, %d, want false, 9, 9", m.Truncated, m.Size, req.ContentLength)
+	}
+	if got, _ := io.ReadAll(req.Body); string(got) != "rewritten" {
+		t.Errorf("forwarded body = %q, want rewritten", got)
+	}
+}
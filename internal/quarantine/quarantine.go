@@ -0,0 +1,168 @@
+// Package quarantine keeps the list of devices the proxy refuses to onboard,
+// either because an operator blocked them or because they failed too many
+// times in a row.
+package quarantine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+	"github.com/fdo-server-wrapper/internal/store"
+)
+
+var quarantined = metrics.Default.NewGaugeVec(
+	"fdo_proxy_quarantined_devices",
+	"Devices currently quarantined.")
+
+// Entry is one quarantined device.
+type Entry struct {
+	GUID   string    `json:"guid"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+	// Auto is set when the device was quarantined by the failure threshold
+	// rather than by an operator.
+	Auto bool `json:"auto"`
+}
+
+// List is the set of quarantined devices, optionally persisted to a JSON
+// file so quarantines survive restarts.
+type List struct {
+	path string
+
+	mu      sync.RWMutex
+	entries map[string]Entry
+}
+
+// Open loads the list from path, which need not exist yet. An empty path
+// keeps the list in memory only.
+func Open(path string) (*List, error) {
+	l := &List{path: path, entries: make(map[string]Entry)}
+	if path == "" {
+		return l, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read quarantine list: %w", err)
+	}
+	var entries []Entry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("parse quarantine list: %w", err)
+	}
+	for _, e := range entries {
+		l.entries[e.GUID] = e
+	}
+	quarantined.Set(float64(len(l.entries)))
+	return l, nil
+}
+
+// Get returns the entry for guid, if quarantined. A nil list holds nothing.
+func (l *List) Get(guid string) (Entry, bool) {
+	if l == nil {
+		return Entry{}, false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	e, ok := l.entries[guid]
+	return e, ok
+}
+
+// All returns every entry sorted by GUID.
+func (l *List) All() []Entry {
+	l.mu.RLock()
+	out := make([]Entry, 0, len(l.entries))
+	for _, e := range l.entries {
+		out = append(out, e)
+	}
+	l.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].GUID < out[j].GUID })
+	return out
+}
+
+// Add quarantines e.GUID. It reports false if the device already was.
+func (l *List) Add(e Entry) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries[e.GUID]; ok {
+		return false, nil
+	}
+	l.entries[e.GUID] = e
+	return true, l.saveLocked()
+}
+
+// Remove releases guid. It reports false if the device was not quarantined.
+func (l *List) Remove(guid string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries[guid]; !ok {
+		return false, nil
+	}
+	delete(l.entries, guid)
+	return true, l.saveLocked()
+}
+
+// saveLocked atomically rewrites the file. The caller must hold l.mu.
+func (l *List) saveLocked() error {
+	quarantined.Set(float64(len(l.entries)))
+	if l.path == "" {
+		return nil
+	}
+	entries := make([]Entry, 0, len(l.entries))
+	for _, e := range l.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].GUID < entries[j].GUID })
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("write quarantine list: %w", err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return fmt.Errorf("replace quarantine list: %w", err)
+	}
+	return nil
+}
+
+// Escalate returns a store.Recorder hook that quarantines a device once its
+// consecutive failures in st reach threshold.
+func Escalate(l *List, st store.Store, threshold int) func(context.Context, *store.Record) {
+	return func(ctx context.Context, rec *store.Record) {
+		if rec.Outcome != store.OutcomeFailed || rec.GUID == "" {
+			return
+		}
+		stats, err := store.DeviceStatsFor(ctx, st, rec.GUID)
+		if err != nil {
+			slog.Warn("Could not count device failures", "guid", rec.GUID, "error", err)
+			return
+		}
+		if stats.ConsecutiveFailures < threshold {
+			return
+		}
+		added, err := l.Add(Entry{
+			GUID:   rec.GUID,
+			Reason: fmt.Sprintf("%d consecutive failed onboardings, last: %s", stats.ConsecutiveFailures, rec.Failure),
+			Since:  time.Now().UTC(),
+			Auto:   true,
+		})
+		if err != nil {
+			slog.Error("Failed to persist quarantine", "guid", rec.GUID, "error", err)
+		}
+		if added {
+			slog.Warn("Device quarantined", "guid", rec.GUID, "consecutive_failures", stats.ConsecutiveFailures)
+		}
+	}
+}
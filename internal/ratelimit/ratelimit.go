@@ -0,0 +1,187 @@
+// Package ratelimit takes tokens from named token buckets, kept in the
+// proxy's memory or, so that several proxies enforce one limit together,
+// in Redis.
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+	"github.com/fdo-server-wrapper/internal/redis"
+)
+
+var (
+	redisErrors = metrics.Default.NewCounterVec(
+		"fdo_proxy_rate_limit_redis_errors_total",
+		"Rate limit checks that could not reach Redis and fell back to the proxy's own buckets.")
+)
+
+// Rate is a token bucket refilled at PerSecond tokens per second up to
+// Burst. The zero Rate imposes no limit.
+type Rate struct {
+	PerSecond float64
+	Burst     float64
+}
+
+// PerMinute is a rate of n per minute with bursts of burst, or of a
+// minute's worth if burst is 0.
+func PerMinute(n float64, burst int) Rate {
+	if n <= 0 {
+		return Rate{}
+	}
+	b := float64(burst)
+	if b == 0 {
+		b = math.Max(1, math.Ceil(n))
+	}
+	return Rate{PerSecond: n / 60, Burst: b}
+}
+
+// IsZero reports whether r imposes no limit.
+func (r Rate) IsZero() bool {
+	return r.PerSecond <= 0
+}
+
+// Limiter takes tokens from buckets named by key, such as "source:10.0.0.7".
+type Limiter interface {
+	// Allow takes a token from the bucket of key, filled at r, reporting
+	// false when none is left. A zero r always allows.
+	Allow(ctx context.Context, key string, r Rate) bool
+}
+
+// sweepInterval limits how often Local looks for buckets to drop.
+const sweepInterval = time.Minute
+
+// Local keeps buckets in memory, so each proxy enforces its limits alone.
+type Local struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+// NewLocal returns a Limiter with buckets of its own.
+func NewLocal() *Local {
+	return &Local{buckets: make(map[string]*bucket)}
+}
+
+// Allow implements Limiter.
+func (l *Local) Allow(_ context.Context, key string, r Rate) bool {
+	if r.IsZero() {
+		return true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweepLocked(now)
+	b := l.buckets[key]
+	if b == nil || b.rate != r {
+		b = &bucket{rate: r, tokens: r.Burst, last: now}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *bucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.rate.Burst, b.tokens+now.Sub(b.last).Seconds()*b.rate.PerSecond)
+		b.last = now
+	}
+}
+
+// sweepLocked drops the buckets that have filled up again, which are as
+// good as new. The caller must hold l.mu.
+func (l *Local) sweepLocked(now time.Time) {
+	if now.Sub(l.swept) < sweepInterval {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= b.rate.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// keyPrefix namespaces the proxy's keys in a Redis database it may share.
+const keyPrefix = "fdo-proxy:rate:"
+
+// bucketScript takes a token from the bucket in hash KEYS[1], refilled at
+// ARGV[1] tokens per second up to ARGV[2], and returns 1 if it got one.
+// Time is the server's, so proxies with skewed clocks agree; the key
+// expires once the bucket would be full again.
+var bucketScript = redis.NewScript(`
+local rate, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens, at = tonumber(b[1]), tonumber(b[2])
+if tokens == nil or at == nil then
+  tokens, at = burst, now
+elseif now > at then
+  tokens = math.min(burst, tokens + (now - at) * rate)
+  at = now
+end
+local ok = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  ok = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', tostring(at))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return ok
+`)
+
+// warnInterval limits how often a Redis limiter logs that its server cannot
+// be reached.
+const warnInterval = time.Minute
+
+// Redis keeps buckets in Redis, shared by every proxy using the server, so
+// a limit holds across them. While Redis cannot be reached each proxy
+// falls back to buckets of its own, failing open rather than refusing
+// every device.
+type Redis struct {
+	client *redis.Client
+	local  *Local
+	mu     sync.Mutex
+	warned time.Time
+}
+
+// NewRedis returns a Limiter keeping its buckets in c.
+func NewRedis(c *redis.Client) *Redis {
+	return &Redis{client: c, local: NewLocal()}
+}
+
+// Allow implements Limiter.
+func (l *Redis) Allow(ctx context.Context, key string, r Rate) bool {
+	if r.IsZero() {
+		return true
+	}
+	v, err := bucketScript.Run(ctx, l.client, []string{keyPrefix + key}, r.PerSecond, r.Burst)
+	if err != nil {
+		redisErrors.Inc()
+		l.mu.Lock()
+		if time.Since(l.warned) >= warnInterval {
+			l.warned = time.Now()
+			slog.Warn("Rate limit store unreachable, limiting per proxy", "redis", l.client.String(), "error", err)
+		}
+		l.mu.Unlock()
+		return l.local.Allow(ctx, key, r)
+	}
+	n, _ := v.(int64)
+	return n == 1
+}
@@ -0,0 +1,368 @@
+// Package receipt issues onboarding receipts: COSE_Sign1 messages (RFC
+// 9052) in which the proxy attests that a device completed TO2 with an
+// owner, for the device to fetch and keep as its own proof of
+// commissioning. A receipt verifies with the public key of the signing key
+// alone, so it stays valid offline and after the proxy is gone.
+//
+// The payload is a CBOR map:
+//
+//	"guid":            bstr, the device GUID as in FDO messages
+//	"owner":           tstr
+//	"onboarded_at":    uint, Unix seconds
+//	"product":         tstr, the product item passport UUID, if known
+//	"passport_hash":   bstr, SHA-256 of the commissioning passport JSON,
+//	                   as anchored by package anchor
+//	"passport_sent":   bool, whether the passport service recorded it
+//	"voucher_hash":    tstr, if known
+//	"request_id":      tstr
+//
+// A device fetches its receipt with the NonceTO2ProveOV it sent in
+// TO2.HelloDevice, as it asks for its onboarding status (package status),
+// so a GUID alone reveals nothing of its owner or passport.
+package receipt
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/cbor"
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/metrics"
+	"github.com/fdo-server-wrapper/internal/ratelimit"
+	"github.com/fdo-server-wrapper/internal/vc"
+)
+
+// ContentType is the media type of a receipt.
+const ContentType = `application/cose; cose-type="cose-sign1"`
+
+// maxHeld bounds the receipts kept in memory without a directory.
+const maxHeld = 100000
+
+var (
+	issued = metrics.Default.NewCounterVec(
+		"fdo_proxy_receipts_issued_total",
+		"Onboarding receipts signed for devices that completed TO2, by outcome (success, error).",
+		"outcome")
+	fetched = metrics.Default.NewCounterVec(
+		"fdo_proxy_receipt_fetches_total",
+		"Onboarding receipt requests by outcome (found, not_found, invalid, limited).",
+		"outcome")
+)
+
+// ErrNotFound is returned by Get for a device without a receipt, or for a
+// nonce of another session.
+var ErrNotFound = errors.New("no onboarding receipt")
+
+// COSE algorithm identifiers of the JWS algorithms vc.Signer uses.
+var coseAlgs = map[string]int64{
+	"ES256": -7,
+	"ES384": -35,
+	"EdDSA": -8,
+	"RS256": -257,
+}
+
+// Receipt is what a receipt attests.
+type Receipt struct {
+	GUID        fdo.GUID
+	OwnerID     string
+	OnboardedAt time.Time
+	ProductID   string
+	// PassportHash is the SHA-256 of the commissioning passport JSON, nil
+	// without one.
+	PassportHash []byte
+	PassportSent bool
+	VoucherHash  string
+	RequestID    string
+	// Nonce is the hex NonceTO2ProveOV of the device's TO2 session, which
+	// it presents to fetch the receipt. It is not part of the receipt.
+	Nonce string
+}
+
+// kept is a device's latest receipt and the SHA-256 of the nonce that
+// fetches it.
+type kept struct {
+	receipt []byte
+	nonce   []byte
+}
+
+// Issuer signs receipts and keeps the latest for each device. It
+// implements events.Sink, issuing one for every commissioned event.
+type Issuer struct {
+	signer *vc.Signer
+	alg    int64
+	dir    string
+
+	mu    sync.Mutex
+	held  map[fdo.GUID]kept
+	order []fdo.GUID
+}
+
+// New returns an Issuer signing with signer and keeping receipts in dir as
+// <guid>.cose, with the digest of the session nonce as <guid>.nonce. An
+// empty dir keeps the last 100000 in memory, so devices must fetch theirs
+// before a restart.
+func New(signer *vc.Signer, dir string) (*Issuer, error) {
+	alg, ok := coseAlgs[signer.Alg()]
+	if !ok {
+		return nil, fmt.Errorf("receipt signing key: no COSE algorithm for %s", signer.Alg())
+	}
+	i := &Issuer{signer: signer, alg: alg, dir: dir}
+	if dir == "" {
+		i.held = make(map[fdo.GUID]kept)
+		return i, nil
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("create receipt dir: %w", err)
+	}
+	return i, nil
+}
+
+// Name implements events.Sink.
+func (i *Issuer) Name() string { return "receipt" }
+
+// Publish implements events.Sink.
+func (i *Issuer) Publish(ctx context.Context, ev *events.Event) error {
+	if ev.Type != events.Commissioned {
+		return nil
+	}
+	guid, err := fdo.ParseGUID(ev.GUID)
+	if err != nil {
+		return err
+	}
+	r := &Receipt{
+		GUID:         guid,
+		OwnerID:      ev.OwnerID,
+		OnboardedAt:  ev.Time,
+		RequestID:    ev.RequestID,
+		PassportSent: ev.PassportSent && ev.PassportErr == nil,
+	}
+	if ev.Passport != nil {
+		b, err := json.Marshal(ev.Passport)
+		if err != nil {
+			return fmt.Errorf("encode passport: %w", err)
+		}
+		sum := sha256.Sum256(b)
+		r.PassportHash = sum[:]
+		r.ProductID = ev.Passport.ProductID
+	}
+	if ev.Session != nil {
+		r.VoucherHash = ev.Session.VoucherHash
+		r.Nonce = ev.Session.HelloNonce
+		if r.ProductID == "" {
+			r.ProductID = ev.Session.ProductID
+		}
+	}
+	if _, err := i.Issue(r); err != nil {
+		slog.Warn("Failed to issue onboarding receipt", "guid", ev.GUID, "request_id", ev.RequestID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// Issue signs a receipt for r, keeps it as the device's latest and
+// returns it, tagged COSE_Sign1. Without r.Nonce the receipt is kept but
+// cannot be fetched.
+func (i *Issuer) Issue(r *Receipt) ([]byte, error) {
+	b, err := i.sign(r)
+	if err == nil {
+		err = i.keep(r.GUID, b, nonceDigest(r.Nonce))
+	}
+	if err != nil {
+		issued.Inc("error")
+		return nil, err
+	}
+	issued.Inc("success")
+	return b, nil
+}
+
+// sign encodes r and signs it.
+func (i *Issuer) sign(r *Receipt) ([]byte, error) {
+	claims := map[any]any{
+		"guid":          r.GUID[:],
+		"owner":         r.OwnerID,
+		"onboarded_at":  r.OnboardedAt.Unix(),
+		"passport_sent": r.PassportSent,
+		"request_id":    r.RequestID,
+	}
+	if r.ProductID != "" {
+		claims["product"] = r.ProductID
+	}
+	if r.PassportHash != nil {
+		claims["passport_hash"] = r.PassportHash
+	}
+	if r.VoucherHash != "" {
+		claims["voucher_hash"] = r.VoucherHash
+	}
+	payload, err := cbor.Marshal(claims)
+	if err != nil {
+		return nil, fmt.Errorf("encode receipt: %w", err)
+	}
+	// alg (1) and content type (3) protected, kid (4) if set
+	header := map[any]any{int64(1): i.alg, int64(3): "application/cbor"}
+	if kid := i.signer.KeyID(); kid != "" {
+		header[int64(4)] = []byte(kid)
+	}
+	protected, err := cbor.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("encode receipt header: %w", err)
+	}
+	toSign, err := cbor.Marshal([]any{"Signature1", protected, []byte{}, payload})
+	if err != nil {
+		return nil, fmt.Errorf("encode receipt: %w", err)
+	}
+	sig, err := i.signer.SignRaw(toSign)
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(cbor.Tag{Number: 18, Content: []any{protected, map[any]any{}, payload, sig}})
+}
+
+// nonceDigest returns the SHA-256 of a hex nonce, nil without one, so the
+// nonce itself is not kept.
+func nonceDigest(nonce string) []byte {
+	if nonce == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(nonce)))
+	return sum[:]
+}
+
+// keep stores b as the receipt of guid, fetched with the nonce whose
+// digest is nonce, replacing any earlier one.
+func (i *Issuer) keep(guid fdo.GUID, b, nonce []byte) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.dir == "" {
+		if _, ok := i.held[guid]; !ok {
+			if len(i.order) >= maxHeld {
+				delete(i.held, i.order[0])
+				i.order = i.order[1:]
+			}
+			i.order = append(i.order, guid)
+		}
+		i.held[guid] = kept{receipt: b, nonce: nonce}
+		return nil
+	}
+	// The nonce first, so a new receipt is never served to the last session
+	if err := writeFile(i.path(guid, ".nonce"), []byte(hex.EncodeToString(nonce))); err != nil {
+		return fmt.Errorf("write receipt nonce: %w", err)
+	}
+	if err := writeFile(i.path(guid, ".cose"), b); err != nil {
+		return fmt.Errorf("write receipt: %w", err)
+	}
+	return nil
+}
+
+// writeFile atomically replaces path with b.
+func writeFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Get returns the latest receipt of guid if nonce is the hex
+// NonceTO2ProveOV of the session it was issued for, ErrNotFound if the
+// device has none or nonce is another's.
+func (i *Issuer) Get(guid fdo.GUID, nonce string) ([]byte, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var k kept
+	if i.dir == "" {
+		var ok bool
+		if k, ok = i.held[guid]; !ok {
+			return nil, ErrNotFound
+		}
+	} else {
+		want, err := os.ReadFile(i.path(guid, ".nonce"))
+		if errors.Is(err, fs.ErrNotExist) {
+			// Receipts kept by earlier versions have no nonce to match
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read receipt nonce: %w", err)
+		}
+		k.nonce, _ = hex.DecodeString(strings.TrimSpace(string(want)))
+		k.receipt, err = os.ReadFile(i.path(guid, ".cose"))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read receipt: %w", err)
+		}
+	}
+	if len(k.nonce) == 0 || subtle.ConstantTimeCompare(k.nonce, nonceDigest(nonce)) != 1 {
+		return nil, ErrNotFound
+	}
+	return k.receipt, nil
+}
+
+func (i *Issuer) path(guid fdo.GUID, ext string) string {
+	return filepath.Join(i.dir, guid.String()+ext)
+}
+
+// Handler serves GET /receipts/{guid}?nonce=<hex> on the device-facing
+// listener: the device's latest receipt, for the NonceTO2ProveOV of the
+// session it was issued in. The GUID is in UUID form or 32 hex digits.
+// Devices without a receipt and wrong nonces are both answered 404, and
+// each client address may ask at rate, taking tokens from l.
+func Handler(i *Issuer, l ratelimit.Limiter, rate ratelimit.Rate) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !l.Allow(r.Context(), "receipt:"+host(r.RemoteAddr), rate) {
+			fetched.Inc("limited")
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		guid, err := fdo.ParseGUID(strings.TrimPrefix(r.URL.Path, "/receipts/"))
+		nonce := r.URL.Query().Get("nonce")
+		if err != nil || nonce == "" {
+			fetched.Inc("invalid")
+			http.Error(w, "want /receipts/{guid}?nonce=<NonceTO2ProveOV in hex>", http.StatusBadRequest)
+			return
+		}
+		b, err := i.Get(guid, nonce)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			fetched.Inc("not_found")
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		case err != nil:
+			slog.Error("Failed to read onboarding receipt", "guid", guid.String(), "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		fetched.Inc("found")
+		w.Header().Set("Content-Type", ContentType)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(b)
+	})
+}
+
+// host strips the port from addr, if it has one.
+func host(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return addr
+}
@@ -0,0 +1,307 @@
+// Package reconcile compares the commissioning passports recorded in the
+// local store with those the passport service lists, so passports that
+// never reached the service, or that it lost, do not go unnoticed. Missing
+// passports can be created again from the local records.
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/metrics"
+	"github.com/fdo-server-wrapper/internal/store"
+)
+
+// maxListed bounds the discrepancies listed in a report; all are counted.
+const maxListed = 1000
+
+var (
+	reconcileRuns = metrics.Default.NewCounterVec(
+		"fdo_proxy_reconcile_runs_total",
+		"Reconciliation runs against the passport service by outcome (success, error).",
+		"outcome")
+	reconcileDiscrepancies = metrics.Default.NewGaugeVec(
+		"fdo_proxy_reconcile_discrepancies",
+		"Discrepancies found by the last reconciliation run, by kind.",
+		"kind")
+	reconcileRepairs = metrics.Default.NewCounterVec(
+		"fdo_proxy_reconcile_repairs_total",
+		"Commissioning passports created again by reconciliation, by outcome (success, error, exists).",
+		"outcome")
+)
+
+// Discrepancy kinds.
+const (
+	// Missing is a passport the local record says was created but the
+	// service does not list: a silent write failure.
+	Missing = "missing"
+	// NotCreated is a passport whose creation failed and that the service
+	// still does not list.
+	NotCreated = "not_created"
+	// Late is a passport whose creation failed locally but that the service
+	// lists, e.g. because it arrived after a timeout.
+	Late = "late"
+	// Unrecorded is a passport the service lists for a device the store has
+	// no successful onboarding of, e.g. one written by another proxy.
+	Unrecorded = "unrecorded"
+)
+
+var kinds = []string{Missing, NotCreated, Late, Unrecorded}
+
+// Ledger is what reconciliation needs from the passport service.
+type Ledger interface {
+	ListCommissioningPassports(ctx context.Context, from, to time.Time) ([]ledger.CommissioningEntry, error)
+	CreateCommissioningPassport(ctx context.Context, req *ledger.CommissioningCreateRequest) error
+}
+
+// existenceChecker is a Ledger that can tell whether one passport exists,
+// checked before a repair so a passport the listing missed is not created
+// twice.
+type existenceChecker interface {
+	CommissioningQueryEnabled() bool
+	GetCommissioningPassports(ctx context.Context, controllerUUID string) ([]ledger.CommissioningEntry, error)
+}
+
+// Options configures reconciliation.
+type Options struct {
+	// Window is how far back onboardings are compared. Defaults to 7 days.
+	Window time.Duration
+	// Grace leaves out onboardings more recent than this, whose passports
+	// may still be on their way. Defaults to 10 minutes.
+	Grace time.Duration
+	// Repair creates Missing and NotCreated passports again from the local
+	// records. Certificates and credentials are not stored locally, so
+	// repaired passports carry neither.
+	Repair bool
+	// Exclude, if set, leaves out records whose passport is not expected
+	// in the service, e.g. those a policy sends to another ledger.
+	Exclude func(*store.Record) bool
+}
+
+// Discrepancy is one device the store and the service disagree about.
+type Discrepancy struct {
+	Kind string `json:"kind"`
+	GUID string `json:"guid"`
+	// CompletedAt is when the device onboarded, from the local record.
+	CompletedAt time.Time `json:"completed_at,omitzero"`
+	// PassportError is why creation failed, from the local record.
+	PassportError string `json:"passport_error,omitempty"`
+	// Timestamp is the passport's timestamp, from the service.
+	Timestamp string `json:"timestamp,omitempty"`
+	// Repair is "repaired", "exists" for a passport the service holds
+	// although it did not list it, or why repairing failed, when attempted.
+	Repair string `json:"repair,omitempty"`
+}
+
+// Report is the result of a run.
+type Report struct {
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at"`
+	// From and To bound the onboardings compared.
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Local counts the devices the store expects passports for, Listed the
+	// passports the service listed.
+	Local    int            `json:"local"`
+	Listed   int            `json:"listed"`
+	Counts   map[string]int `json:"counts"`
+	Repaired int            `json:"repaired"`
+	// Discrepancies lists the first 1000, oldest onboarding first.
+	Discrepancies []Discrepancy `json:"discrepancies"`
+	Error         string        `json:"error,omitempty"`
+}
+
+// Reconciler compares the store with the service.
+type Reconciler struct {
+	st   store.Store
+	l    Ledger
+	opts Options
+	// running serializes runs.
+	running sync.Mutex
+
+	mu   sync.Mutex
+	last *Report
+}
+
+// New creates a Reconciler.
+func New(st store.Store, l Ledger, opts Options) *Reconciler {
+	if opts.Window <= 0 {
+		opts.Window = 7 * 24 * time.Hour
+	}
+	if opts.Grace <= 0 {
+		opts.Grace = 10 * time.Minute
+	}
+	return &Reconciler{st: st, l: l, opts: opts}
+}
+
+// Last returns the report of the last run, nil before the first.
+func (r *Reconciler) Last() *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// Run reconciles once, as the scheduler's reconcile job, failing if the
+// run did.
+func (r *Reconciler) Run(ctx context.Context) error {
+	if rep := r.Reconcile(ctx); rep.Error != "" {
+		return errors.New(rep.Error)
+	}
+	return nil
+}
+
+// Reconcile compares the onboardings of the window with the passports the
+// service lists, repairing them if configured, and returns the report.
+func (r *Reconciler) Reconcile(ctx context.Context) *Report {
+	r.running.Lock()
+	defer r.running.Unlock()
+
+	now := time.Now().UTC()
+	rep := &Report{StartedAt: now, From: now.Add(-r.opts.Window), To: now.Add(-r.opts.Grace), Counts: make(map[string]int)}
+	err := r.compare(ctx, rep)
+	rep.CompletedAt = time.Now().UTC()
+	if err != nil {
+		rep.Error = err.Error()
+		reconcileRuns.Inc("error")
+		slog.Warn("Reconciliation with the passport service failed", "error", err)
+	} else {
+		reconcileRuns.Inc("success")
+		for _, k := range kinds {
+			reconcileDiscrepancies.Set(float64(rep.Counts[k]), k)
+		}
+		slog.Info("Reconciled local records with the passport service",
+			"from", rep.From, "to", rep.To, "local", rep.Local, "listed", rep.Listed,
+			"missing", rep.Counts[Missing], "not_created", rep.Counts[NotCreated],
+			"late", rep.Counts[Late], "unrecorded", rep.Counts[Unrecorded], "repaired", rep.Repaired)
+	}
+
+	r.mu.Lock()
+	r.last = rep
+	r.mu.Unlock()
+	return rep
+}
+
+// compare fills in rep.
+func (r *Reconciler) compare(ctx context.Context, rep *Report) error {
+	// Devices the store expects passports for, and every device that
+	// onboarded around the window, so passports stamped just outside it
+	// are not taken for unrecorded ones
+	expected := make(map[string]*store.Record)
+	onboarded := make(map[string]bool)
+	q := store.Query{From: rep.From.Add(-r.opts.Grace)}
+	err := r.st.Each(ctx, q, func(rec *store.Record) error {
+		if rec.Outcome != store.OutcomeSucceeded || rec.GUID == "" {
+			return nil
+		}
+		onboarded[rec.GUID] = true
+		if rec.CompletedAt.Before(rep.From) || !rec.CompletedAt.Before(rep.To) {
+			return nil
+		}
+		if rec.PassportStatus != store.PassportCreated && rec.PassportStatus != store.PassportFailed {
+			return nil
+		}
+		if r.opts.Exclude != nil && r.opts.Exclude(rec) {
+			return nil
+		}
+		// The latest onboarding of a device decides
+		expected[rec.GUID] = rec
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("read local store: %w", err)
+	}
+	rep.Local = len(expected)
+
+	entries, err := r.l.ListCommissioningPassports(ctx, rep.From, rep.StartedAt)
+	if err != nil {
+		return fmt.Errorf("list commissioning passports: %w", err)
+	}
+	listed := make(map[string]ledger.CommissioningEntry, len(entries))
+	for _, e := range entries {
+		listed[e.ControllerUUID] = e
+	}
+	rep.Listed = len(listed)
+
+	var found []Discrepancy
+	for guid, rec := range expected {
+		e, ok := listed[guid]
+		switch {
+		case ok && rec.PassportStatus == store.PassportFailed:
+			found = append(found, Discrepancy{Kind: Late, GUID: guid, CompletedAt: rec.CompletedAt, PassportError: rec.PassportError, Timestamp: e.Timestamp})
+		case !ok && rec.PassportStatus == store.PassportFailed:
+			found = append(found, r.repair(ctx, rep, Discrepancy{Kind: NotCreated, GUID: guid, CompletedAt: rec.CompletedAt, PassportError: rec.PassportError}, rec))
+		case !ok:
+			found = append(found, r.repair(ctx, rep, Discrepancy{Kind: Missing, GUID: guid, CompletedAt: rec.CompletedAt}, rec))
+		}
+	}
+	for guid, e := range listed {
+		if !onboarded[guid] {
+			found = append(found, Discrepancy{Kind: Unrecorded, GUID: guid, Timestamp: e.Timestamp})
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		if !a.CompletedAt.Equal(b.CompletedAt) {
+			return a.CompletedAt.Before(b.CompletedAt)
+		}
+		return a.GUID < b.GUID
+	})
+	for _, d := range found {
+		rep.Counts[d.Kind]++
+		if d.Kind != Late {
+			slog.Warn("Commissioning passport discrepancy", "kind", d.Kind, "guid", d.GUID, "completed_at", d.CompletedAt, "repair", d.Repair)
+		}
+	}
+	rep.Discrepancies = found[:min(len(found), maxListed)]
+	return nil
+}
+
+// repair creates the passport of d again from rec, if configured.
+func (r *Reconciler) repair(ctx context.Context, rep *Report, d Discrepancy, rec *store.Record) Discrepancy {
+	if !r.opts.Repair {
+		return d
+	}
+	if c, ok := r.l.(existenceChecker); ok && c.CommissioningQueryEnabled() {
+		entries, err := c.GetCommissioningPassports(ctx, rec.GUID)
+		if err != nil {
+			reconcileRepairs.Inc("error")
+			d.Repair = "existence check: " + err.Error()
+			return d
+		}
+		// A passport of an onboarding before the window is not this one
+		for _, e := range entries {
+			ns, err := strconv.ParseInt(e.Timestamp, 10, 64)
+			if err != nil || !time.Unix(0, ns).Before(rep.From) {
+				reconcileRepairs.Inc("exists")
+				d.Repair = "exists"
+				return d
+			}
+		}
+	}
+	req := &ledger.CommissioningCreateRequest{
+		ControllerUUID:   rec.GUID,
+		OwnerID:          rec.OwnerID,
+		DeployedLocation: rec.Country,
+		Timestamp:        fmt.Sprintf("%d", rec.CompletedAt.UnixNano()),
+		Evidence:         rec.Evidence,
+		Serial:           rec.Serial,
+		Tags:             rec.Tags,
+	}
+	if err := r.l.CreateCommissioningPassport(ctx, req); err != nil {
+		reconcileRepairs.Inc("error")
+		d.Repair = err.Error()
+		return d
+	}
+	reconcileRepairs.Inc("success")
+	rep.Repaired++
+	d.Repair = "repaired"
+	return d
+}
@@ -0,0 +1,247 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serve runs a fake server answering each command with reply, and returns
+// its URL.
+func serve(t *testing.T, reply func(cmd []string) string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer nc.Close()
+				nc.SetDeadline(time.Now().Add(10 * time.Second))
+				r := bufio.NewReader(nc)
+				for {
+					cmd, err := readCommand(r)
+					if err != nil {
+						return
+					}
+					io.WriteString(nc, reply(cmd))
+				}
+			}()
+		}
+	}()
+	return "redis://" + ln.Addr().String()
+}
+
+// readCommand reads a command as clients send it: an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("command header %q", line)
+	}
+	n, _ := strconv.Atoi(line[1 : len(line)-2])
+	cmd := make([]string, n)
+	for i := range cmd {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("bulk header %q", line)
+		}
+		l, _ := strconv.Atoi(line[1 : len(line)-2])
+		b := make([]byte, l+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if string(b[l:]) != "\r\n" {
+			return nil, fmt.Errorf("bulk string not terminated")
+		}
+		cmd[i] = string(b[:l])
+	}
+	return cmd, nil
+}
+
+func TestReplies(t *testing.T) {
+	replies := map[string]string{
+		"PING":   "+PONG\r\n",
+		"INCR":   ":-42\r\n",
+		"GET":    "$12\r\nhello\r\nworld\r\n",
+		"EMPTY":  "$0\r\n\r\n",
+		"NIL":    "$-1\r\n",
+		"NILARR": "*-1\r\n",
+		"ARR":    "*4\r\n:1\r\n$1\r\nx\r\n-ERR inner\r\n*1\r\n+ok\r\n",
+		"FAIL":   "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+		"BAD":    "?\r\n",
+	}
+	url := serve(t, func(cmd []string) string { return replies[cmd[0]] })
+	ctx := context.Background()
+	c, err := Open(ctx, url)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer c.Close()
+
+	tests := []struct {
+		cmd  string
+		want any
+	}{
+		{"PING", "PONG"},
+		{"INCR", int64(-42)},
+		{"GET", "hello\r\nworld"},
+		{"EMPTY", ""},
+		{"NIL", nil},
+		{"NILARR", nil},
+		{"ARR", []any{int64(1), "x", Error("ERR inner"), []any{"ok"}}},
+	}
+	for _, tt := range tests {
+		got, err := c.Do(ctx, tt.cmd)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %#v, %v, want %#v", tt.cmd, got, err, tt.want)
+		}
+	}
+
+	_, err = c.Do(ctx, "FAIL")
+	var rerr Error
+	if !errors.As(err, &rerr) || !strings.HasPrefix(string(rerr), "WRONGTYPE") {
+		t.Errorf("FAIL error = %v, want WRONGTYPE", err)
+	}
+	if _, err := c.Do(ctx, "BAD"); err == nil {
+		t.Error("unknown reply type accepted")
+	}
+	// Connections are still good after error replies and replaced after
+	// protocol errors
+	if got, err := c.Do(ctx, "PING"); got != "PONG" || err != nil {
+		t.Errorf("PING after errors = %v, %v", got, err)
+	}
+}
+
+func TestArguments(t *testing.T) {
+	got := make(chan []string, 1)
+	url := serve(t, func(cmd []string) string {
+		if cmd[0] == "SET" {
+			got <- cmd
+		}
+		return "+OK\r\n"
+	})
+	ctx := context.Background()
+	c, err := Open(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Do(ctx, "SET", "k", []byte("a\r\nb"), 7, int64(-8), 0.5); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"SET", "k", "a\r\nb", "7", "-8", "0.5"}
+	if cmd := <-got; !reflect.DeepEqual(cmd, want) {
+		t.Errorf("command = %q, want %q", cmd, want)
+	}
+	if _, err := c.Do(ctx, "SET", struct{}{}); err == nil {
+		t.Error("unsupported argument type accepted")
+	}
+}
+
+func TestAuthAndSelect(t *testing.T) {
+	cmds := make(chan []string, 8)
+	url := serve(t, func(cmd []string) string {
+		cmds <- cmd
+		return "+OK\r\n"
+	})
+	url = strings.Replace(url, "redis://", "redis://svc:pw@", 1) + "/3"
+	c, err := Open(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, want := range [][]string{{"AUTH", "svc", "pw"}, {"SELECT", "3"}, {"PING"}} {
+		if cmd := <-cmds; !reflect.DeepEqual(cmd, want) {
+			t.Errorf("command = %q, want %q", cmd, want)
+		}
+	}
+}
+
+func TestScriptLoadsOnNoScript(t *testing.T) {
+	const src = "return redis.call('INCR', KEYS[1])"
+	s := NewScript(src)
+	var (
+		mu   sync.Mutex
+		cmds [][]string
+	)
+	url := serve(t, func(cmd []string) string {
+		mu.Lock()
+		cmds = append(cmds, cmd)
+		mu.Unlock()
+		switch cmd[0] {
+		case "EVALSHA":
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		case "EVAL":
+			return ":1\r\n"
+		}
+		return "+PONG\r\n"
+	})
+	ctx := context.Background()
+	c, err := Open(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	v, err := s.Run(ctx, c, []string{"k"}, "arg")
+	if err != nil || v != int64(1) {
+		t.Fatalf("Run = %v, %v, want 1", v, err)
+	}
+	// The SHA1 of src
+	want := [][]string{
+		{"PING"},
+		{"EVALSHA", "61636018f4e6b5817b89791bbed242f93fa089e3", "1", "k", "arg"},
+		{"EVAL", src, "1", "k", "arg"},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(cmds, want) {
+		t.Errorf("commands = %q, want %q", cmds, want)
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	cfg, err := ParseURL("rediss://u:p@cache.example:6380/2?timeout=250ms&pool_max_conns=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != "cache.example:6380" || cfg.Username != "u" || cfg.Password != "p" || cfg.DB != 2 ||
+		cfg.Timeout != 250*time.Millisecond || cfg.MaxConns != 3 || cfg.TLS == nil || cfg.TLS.ServerName != "cache.example" {
+		t.Errorf("ParseURL = %+v", cfg)
+	}
+	if cfg, err := ParseURL("redis://"); err != nil || cfg.Addr != "localhost:6379" || cfg.TLS != nil {
+		t.Errorf("ParseURL(redis://) = %+v, %v", cfg, err)
+	}
+	for _, bad := range []string{
+		"http://localhost",
+		"redis://localhost/x",
+		"redis://localhost?timeout=0s",
+		"redis://localhost?pool_max_conns=0",
+		"redis://localhost?tls_ca=ca.pem",
+		"redis://localhost?db=1",
+	} {
+		if _, err := ParseURL(bad); err == nil {
+			t.Errorf("ParseURL(%q) succeeded", bad)
+		}
+	}
+}
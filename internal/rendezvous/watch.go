@@ -0,0 +1,157 @@
+// Package rendezvous tracks how long the rendezvous server keeps each
+// device's TO0 registration and warns before a registration lapses while
+// the device has still not completed TO2. A device whose registration
+// expires can no longer find its owner through TO1.
+package rendezvous
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+var expired = metrics.Default.NewCounterVec(
+	"fdo_proxy_rendezvous_expired_total",
+	"TO0 registrations that lapsed before the device completed TO2.")
+
+// registration is a tracked TO0 registration.
+type registration struct {
+	ownerID   string
+	productID string
+	expires   time.Time
+	warned    bool
+}
+
+// Watch follows TO0 registrations from events.Registered and forgets them
+// once the device is commissioned or decommissioned. Run publishes an
+// events.Expiring event for each registration that enters the warning
+// window. It implements events.Sink.
+type Watch struct {
+	bus     *events.Bus
+	warning time.Duration
+
+	mu   sync.Mutex
+	regs map[string]*registration
+}
+
+// NewWatch creates a watch warning this long before a registration expires
+// and publishing on bus.
+func NewWatch(bus *events.Bus, warning time.Duration) *Watch {
+	w := &Watch{bus: bus, warning: warning, regs: make(map[string]*registration)}
+	metrics.Default.NewGaugeFunc(
+		"fdo_proxy_rendezvous_registrations",
+		"TO0 registrations being watched for devices that have not completed TO2.",
+		func() float64 { return float64(w.Len()) })
+	metrics.Default.NewGaugeFunc(
+		"fdo_proxy_rendezvous_expiring",
+		"Watched TO0 registrations expiring within the warning window.",
+		func() float64 { return float64(w.Expiring(time.Now())) })
+	return w
+}
+
+// Name implements events.Sink.
+func (w *Watch) Name() string { return "rendezvous_watch" }
+
+// Publish implements events.Sink.
+func (w *Watch) Publish(ctx context.Context, ev *events.Event) error {
+	if ev.GUID == "" {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch ev.Type {
+	case events.Registered:
+		if ev.WaitSeconds <= 0 {
+			// Without a lifetime there is nothing to watch; a fresh
+			// registration still replaces an older one
+			delete(w.regs, ev.GUID)
+			return nil
+		}
+		w.regs[ev.GUID] = &registration{
+			ownerID:   ev.OwnerID,
+			productID: ev.ProductID,
+			expires:   ev.Time.Add(time.Duration(ev.WaitSeconds) * time.Second),
+		}
+	case events.Commissioned, events.Decommissioned:
+		delete(w.regs, ev.GUID)
+	}
+	return nil
+}
+
+// Len returns the number of registrations being watched.
+func (w *Watch) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.regs)
+}
+
+// Expiring returns the number of watched registrations expiring within the
+// warning window at now.
+func (w *Watch) Expiring(now time.Time) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := 0
+	for _, r := range w.regs {
+		if r.expires.Sub(now) <= w.warning {
+			n++
+		}
+	}
+	return n
+}
+
+// Run checks the registrations every interval until ctx is cancelled. A
+// non-positive interval defaults to a minute.
+func (w *Watch) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			w.check(ctx, now)
+		}
+	}
+}
+
+// check warns once for each registration entering the warning window and
+// drops the ones that have lapsed.
+func (w *Watch) check(ctx context.Context, now time.Time) {
+	var warn []*events.Event
+	w.mu.Lock()
+	for guid, r := range w.regs {
+		left := r.expires.Sub(now)
+		if left <= 0 {
+			delete(w.regs, guid)
+			expired.Inc()
+			slog.Warn("Rendezvous registration expired before TO2", "guid", guid, "expired_at", r.expires)
+			continue
+		}
+		if r.warned || left > w.warning {
+			continue
+		}
+		r.warned = true
+		warn = append(warn, &events.Event{
+			Type:        events.Expiring,
+			GUID:        guid,
+			OwnerID:     r.ownerID,
+			Time:        now,
+			Protocol:    "to0",
+			ProductID:   r.productID,
+			WaitSeconds: int(left / time.Second),
+		})
+	}
+	w.mu.Unlock()
+
+	for _, ev := range warn {
+		slog.Warn("Rendezvous registration about to expire before TO2", "guid", ev.GUID, "seconds_left", ev.WaitSeconds)
+		w.bus.Publish(ctx, ev)
+	}
+}
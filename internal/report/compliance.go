@@ -0,0 +1,97 @@
+// Package report builds audit reports from the local onboarding history.
+package report
+
+import (
+	"context"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/store"
+)
+
+// Compliance summarizes every onboarding attempt in a time range.
+type Compliance struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	OwnerID     string    `json:"owner_id,omitempty"`
+	Summary     Summary   `json:"summary"`
+	Devices     []Device  `json:"devices"`
+}
+
+// Summary counts outcomes over the report range.
+type Summary struct {
+	Attempts    int            `json:"attempts"`
+	Devices     int            `json:"devices"`
+	Succeeded   int            `json:"succeeded"`
+	Failed      int            `json:"failed"`
+	Passports   map[string]int `json:"passports"`
+	Attestation map[string]int `json:"attestation,omitempty"`
+}
+
+// Device is one onboarding attempt as it appears in the report.
+type Device struct {
+	GUID              string    `json:"guid"`
+	CompletedAt       time.Time `json:"completed_at"`
+	Outcome           string    `json:"outcome"`
+	PassportStatus    string    `json:"passport_status,omitempty"`
+	PassportError     string    `json:"passport_error,omitempty"`
+	AttestationResult string    `json:"attestation_result,omitempty"`
+	VoucherHash       string    `json:"voucher_hash,omitempty"`
+	Failure           string    `json:"failure,omitempty"`
+	Erased            bool      `json:"erased,omitempty"`
+}
+
+// BuildCompliance collects the records completed in [from, to).
+func BuildCompliance(ctx context.Context, st store.Store, from, to time.Time, ownerID string) (*Compliance, error) {
+	rep := &Compliance{
+		GeneratedAt: time.Now().UTC(),
+		From:        from.UTC(),
+		To:          to.UTC(),
+		OwnerID:     ownerID,
+		Summary: Summary{
+			Passports:   map[string]int{},
+			Attestation: map[string]int{},
+		},
+		Devices: []Device{},
+	}
+	seen := map[string]bool{}
+	err := st.Each(ctx, store.Query{From: from, To: to}, func(r *store.Record) error {
+		rep.Summary.Attempts++
+		if !seen[r.GUID] {
+			seen[r.GUID] = true
+			rep.Summary.Devices++
+		}
+		switch r.Outcome {
+		case store.OutcomeSucceeded:
+			rep.Summary.Succeeded++
+		case store.OutcomeFailed:
+			rep.Summary.Failed++
+		}
+		if r.PassportStatus != "" {
+			rep.Summary.Passports[r.PassportStatus]++
+		}
+		if r.AttestationResult != "" {
+			rep.Summary.Attestation[r.AttestationResult]++
+		}
+
+		d := Device{
+			GUID:              r.GUID,
+			CompletedAt:       r.CompletedAt.UTC(),
+			Outcome:           r.Outcome,
+			PassportStatus:    r.PassportStatus,
+			PassportError:     r.PassportError,
+			AttestationResult: r.AttestationResult,
+			Failure:           r.Failure,
+			Erased:            r.ErasedAt != nil,
+		}
+		if r.Evidence != nil {
+			d.VoucherHash = r.Evidence.VoucherHash
+		}
+		rep.Devices = append(rep.Devices, d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
@@ -0,0 +1,82 @@
+package revocation
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxCRLSize bounds downloaded CRLs.
+const maxCRLSize = 32 << 20
+
+// cachedCRL is a CRL verified against its issuer, kept until its next
+// update or the TTL.
+type cachedCRL struct {
+	crl     *x509.RevocationList
+	expires time.Time
+}
+
+// checkCRL looks cert up in the CRL at url, downloading it unless a
+// current copy is cached. Only HTTP distribution points are supported.
+func (c *Checker) checkCRL(ctx context.Context, url string, cert, issuer *x509.Certificate) (Status, time.Time, error) {
+	crl, err := c.fetchCRL(ctx, url, issuer)
+	if err != nil {
+		return Unknown, time.Time{}, err
+	}
+	for _, e := range crl.RevokedCertificateEntries {
+		if e.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return Revoked, crl.NextUpdate, nil
+		}
+	}
+	return Good, crl.NextUpdate, nil
+}
+
+func (c *Checker) fetchCRL(ctx context.Context, url string, issuer *x509.Certificate) (*x509.RevocationList, error) {
+	c.mu.Lock()
+	e, ok := c.crls[url]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.crl, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	der, err := io.ReadAll(io.LimitReader(resp.Body, maxCRLSize))
+	if err != nil {
+		return nil, err
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	now := time.Now()
+	if !crl.NextUpdate.IsZero() && crl.NextUpdate.Before(now) {
+		return nil, errors.New("CRL expired")
+	}
+
+	expires := now.Add(c.ttl)
+	if !crl.NextUpdate.IsZero() && crl.NextUpdate.Before(expires) {
+		expires = crl.NextUpdate
+	}
+	c.mu.Lock()
+	c.crls[url] = cachedCRL{crl: crl, expires: expires}
+	c.mu.Unlock()
+	return crl, nil
+}
@@ -0,0 +1,242 @@
+package revocation
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// OCSP structures from RFC 6960, enough to ask for one certificate and
+// read a basic response.
+
+type certID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest tbsRequest
+}
+
+type tbsRequest struct {
+	RequestList []request
+}
+
+type request struct {
+	Cert certID
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response responseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type responseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type basicResponse struct {
+	TBSResponseData    responseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type responseData struct {
+	Raw                asn1.RawContent
+	Version            int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID     asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []singleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type singleResponse struct {
+	CertID           certID
+	Good             asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked          revokedInfo      `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type revokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+var (
+	oidSHA1          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidBasicResponse = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+)
+
+// signatureAlgorithms maps the response signature algorithms responders
+// use to the x509 constants CheckSignature takes.
+var signatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+	"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+	"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+	"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+	"1.2.840.10045.4.1":     x509.ECDSAWithSHA1,
+	"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+	"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+	"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+	"1.3.101.112":           x509.PureEd25519,
+}
+
+// allowedSkew tolerates responder clocks slightly ahead of ours.
+const allowedSkew = 5 * time.Minute
+
+// queryOCSP asks the responder at url for cert's status, returning the
+// status and when the responder will next update it.
+func (c *Checker) queryOCSP(ctx context.Context, url string, cert, issuer *x509.Certificate) (Status, time.Time, error) {
+	id, err := newCertID(cert, issuer)
+	if err != nil {
+		return Unknown, time.Time{}, err
+	}
+	body, err := asn1.Marshal(ocspRequest{TBSRequest: tbsRequest{RequestList: []request{{Cert: id}}}})
+	if err != nil {
+		return Unknown, time.Time{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return Unknown, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return Unknown, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Unknown, time.Time{}, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	der, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return Unknown, time.Time{}, err
+	}
+	return parseOCSPResponse(der, id, issuer, time.Now())
+}
+
+// newCertID identifies cert to its issuer's responder by SHA-1 hashes,
+// which every responder supports.
+func newCertID(cert, issuer *x509.Certificate) (certID, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return certID{}, fmt.Errorf("parse issuer key: %w", err)
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+	return certID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash[:],
+		IssuerKeyHash: keyHash[:],
+		SerialNumber:  cert.SerialNumber,
+	}, nil
+}
+
+// parseOCSPResponse reads the status of id from a DER OCSP response,
+// checking it was signed by issuer or a responder issuer delegated to.
+func parseOCSPResponse(der []byte, id certID, issuer *x509.Certificate, now time.Time) (Status, time.Time, error) {
+	var resp ocspResponse
+	if rest, err := asn1.Unmarshal(der, &resp); err != nil {
+		return Unknown, time.Time{}, fmt.Errorf("parse response: %w", err)
+	} else if len(rest) > 0 {
+		return Unknown, time.Time{}, errors.New("trailing data after response")
+	}
+	if resp.Status != 0 {
+		return Unknown, time.Time{}, fmt.Errorf("responder status %d", resp.Status)
+	}
+	if !resp.Response.ResponseType.Equal(oidBasicResponse) {
+		return Unknown, time.Time{}, fmt.Errorf("unsupported response type %v", resp.Response.ResponseType)
+	}
+	var basic basicResponse
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return Unknown, time.Time{}, fmt.Errorf("parse basic response: %w", err)
+	}
+	if err := checkResponseSignature(&basic, issuer, now); err != nil {
+		return Unknown, time.Time{}, err
+	}
+	for _, r := range basic.TBSResponseData.Responses {
+		if !sameCert(r.CertID, id) {
+			continue
+		}
+		if r.ThisUpdate.After(now.Add(allowedSkew)) {
+			return Unknown, time.Time{}, errors.New("response not yet valid")
+		}
+		if !r.NextUpdate.IsZero() && r.NextUpdate.Before(now) {
+			return Unknown, time.Time{}, errors.New("response expired")
+		}
+		switch {
+		case bool(r.Good):
+			return Good, r.NextUpdate, nil
+		case !r.Revoked.RevocationTime.IsZero():
+			return Revoked, r.NextUpdate, nil
+		default:
+			return Unknown, r.NextUpdate, errors.New("responder does not know the certificate")
+		}
+	}
+	return Unknown, time.Time{}, errors.New("response does not cover the certificate")
+}
+
+func sameCert(a, b certID) bool {
+	return a.HashAlgorithm.Algorithm.Equal(b.HashAlgorithm.Algorithm) &&
+		bytes.Equal(a.NameHash, b.NameHash) &&
+		bytes.Equal(a.IssuerKeyHash, b.IssuerKeyHash) &&
+		a.SerialNumber.Cmp(b.SerialNumber) == 0
+}
+
+// checkResponseSignature verifies basic was signed by issuer or by a
+// certificate in the response that issuer signed for OCSP signing.
+func checkResponseSignature(basic *basicResponse, issuer *x509.Certificate, now time.Time) error {
+	algo, ok := signatureAlgorithms[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return fmt.Errorf("unsupported response signature algorithm %v", basic.SignatureAlgorithm.Algorithm)
+	}
+	signed, sig := basic.TBSResponseData.Raw, basic.Signature.RightAlign()
+	if issuer.CheckSignature(algo, signed, sig) == nil {
+		return nil
+	}
+	for _, raw := range basic.Certificates {
+		responder, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			continue
+		}
+		if now.Before(responder.NotBefore) || now.After(responder.NotAfter) {
+			continue
+		}
+		if responder.CheckSignatureFrom(issuer) != nil || !hasOCSPSigning(responder) {
+			continue
+		}
+		if responder.CheckSignature(algo, signed, sig) == nil {
+			return nil
+		}
+	}
+	return errors.New("response not signed by the issuer or a delegated responder")
+}
+
+func hasOCSPSigning(cert *x509.Certificate) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == x509.ExtKeyUsageOCSPSigning {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+// Package revocation checks whether TLS peer certificates were revoked,
+// through OCSP responders and CRL distribution points named in the
+// certificates.
+package revocation
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+var checks = metrics.Default.NewCounterVec(
+	"fdo_proxy_revocation_checks_total",
+	"Certificate revocation checks by peer (passport_service, device) and result (good, revoked, unknown, none).",
+	"peer", "result")
+
+// Mode decides what happens when revocation status cannot be determined,
+// e.g. the responder is unreachable. A revoked certificate is always refused.
+type Mode string
+
+const (
+	// ModeSoft lets the handshake proceed with a warning.
+	ModeSoft Mode = "soft"
+	// ModeHard refuses the handshake.
+	ModeHard Mode = "hard"
+)
+
+// ParseMode parses soft or hard.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case ModeSoft, ModeHard:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown revocation mode %q (want soft or hard)", s)
+}
+
+// Status is the revocation status of one certificate.
+type Status int
+
+const (
+	Unknown Status = iota
+	Good
+	Revoked
+)
+
+func (s Status) String() string {
+	switch s {
+	case Good:
+		return "good"
+	case Revoked:
+		return "revoked"
+	}
+	return "unknown"
+}
+
+// ErrRevoked fails handshakes with a revoked peer certificate.
+var ErrRevoked = errors.New("certificate revoked")
+
+// failureTTL is how long a failed check is remembered, so an unreachable
+// responder does not delay every handshake.
+const failureTTL = time.Minute
+
+// maxEntries bounds the cache; expired entries are dropped when it fills.
+const maxEntries = 10000
+
+// Checker checks certificate chains, caching answers until the responder's
+// next update or the configured TTL, whichever comes first.
+type Checker struct {
+	mode   Mode
+	ttl    time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cached
+	crls  map[string]cachedCRL
+}
+
+type cached struct {
+	status  Status
+	err     error
+	expires time.Time
+}
+
+// NewChecker creates a Checker. timeout bounds each responder request.
+func NewChecker(mode Mode, ttl, timeout time.Duration) *Checker {
+	return &Checker{
+		mode:   mode,
+		ttl:    ttl,
+		client: &http.Client{Timeout: timeout},
+		cache:  make(map[string]cached),
+		crls:   make(map[string]cachedCRL),
+	}
+}
+
+// VerifyConnection returns a tls.Config.VerifyConnection hook checking the
+// verified chain of the peer, labelled peer in metrics and logs.
+func (c *Checker) VerifyConnection(peer string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.VerifiedChains) == 0 {
+			return nil
+		}
+		return c.CheckChain(context.Background(), peer, cs.VerifiedChains[0])
+	}
+}
+
+// CheckChain checks every certificate of chain against its issuer, the
+// next certificate; the root is trusted as configured. Certificates naming
+// neither an OCSP responder nor a CRL are not checked.
+func (c *Checker) CheckChain(ctx context.Context, peer string, chain []*x509.Certificate) error {
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		if len(cert.OCSPServer) == 0 && len(cert.CRLDistributionPoints) == 0 {
+			checks.Inc(peer, "none")
+			continue
+		}
+		status, err := c.status(ctx, cert, issuer)
+		checks.Inc(peer, status.String())
+		switch {
+		case status == Revoked:
+			slog.Warn("Peer certificate revoked", "peer", peer, "subject", cert.Subject.String(), "serial", cert.SerialNumber.String())
+			return fmt.Errorf("%s: %w", cert.Subject, ErrRevoked)
+		case status == Unknown && c.mode == ModeHard:
+			slog.Warn("Peer certificate revocation status unknown, refusing", "peer", peer, "subject", cert.Subject.String(), "error", err)
+			return fmt.Errorf("%s: revocation status unknown: %w", cert.Subject, err)
+		case status == Unknown:
+			slog.Warn("Peer certificate revocation status unknown, allowing", "peer", peer, "subject", cert.Subject.String(), "error", err)
+		}
+	}
+	return nil
+}
+
+// status asks the certificate's OCSP responders, then its CRLs.
+func (c *Checker) status(ctx context.Context, cert, issuer *x509.Certificate) (Status, error) {
+	key := string(issuer.RawSubjectPublicKeyInfo) + "/" + cert.SerialNumber.String()
+	if e, ok := c.lookup(key); ok {
+		return e.status, e.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.client.Timeout)
+	defer cancel()
+
+	var errs []error
+	for _, url := range cert.OCSPServer {
+		s, next, err := c.queryOCSP(ctx, url, cert, issuer)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("ocsp %s: %w", url, err))
+			continue
+		}
+		c.store(key, cached{status: s}, next)
+		return s, nil
+	}
+	for _, url := range cert.CRLDistributionPoints {
+		s, next, err := c.checkCRL(ctx, url, cert, issuer)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("crl %s: %w", url, err))
+			continue
+		}
+		c.store(key, cached{status: s}, next)
+		return s, nil
+	}
+	err := errors.Join(errs...)
+	c.store(key, cached{status: Unknown, err: err}, time.Now().Add(failureTTL))
+	return Unknown, err
+}
+
+func (c *Checker) lookup(key string) (cached, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.cache[key]
+	if !ok || time.Now().After(e.expires) {
+		return cached{}, false
+	}
+	return e, true
+}
+
+// store caches e until next, capped at the TTL.
+func (c *Checker) store(key string, e cached, next time.Time) {
+	expires := time.Now().Add(c.ttl)
+	if !next.IsZero() && next.Before(expires) {
+		expires = next
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.cache) >= maxEntries {
+		now := time.Now()
+		for k, e := range c.cache {
+			if now.After(e.expires) {
+				delete(c.cache, k)
+			}
+		}
+		if len(c.cache) >= maxEntries {
+			c.cache = make(map[string]cached)
+		}
+	}
+	e.expires = expires
+	c.cache[key] = e
+}
@@ -0,0 +1,102 @@
+// Package rvinfo reads and updates the rendezvous info (RVInfo) the
+// manufacturer backend embeds in new vouchers, and keeps an audit trail of
+// every change made through the proxy.
+package rvinfo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/audit"
+	"github.com/fdo-server-wrapper/internal/correlation"
+)
+
+// Client talks to the manufacturer backend's RVInfo configuration endpoint,
+// which answers GET with the current RVInfo as JSON and accepts the
+// replacement with PUT. The JSON is passed through as is.
+type Client struct {
+	url  string
+	http *http.Client
+}
+
+// NewClient creates a client for the endpoint at url. A non-positive
+// timeout defaults to 10 seconds.
+func NewClient(url string, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &Client{url: url, http: &http.Client{Timeout: timeout}}
+}
+
+// Get returns the backend's current RVInfo.
+func (c *Client) Get(ctx context.Context) (json.RawMessage, error) {
+	return c.do(ctx, http.MethodGet, nil)
+}
+
+// Put replaces the backend's RVInfo with rv. Vouchers issued from then on
+// carry it; existing vouchers are unchanged.
+func (c *Client) Put(ctx context.Context, rv json.RawMessage) error {
+	_, err := c.do(ctx, http.MethodPut, rv)
+	return err
+}
+
+func (c *Client) do(ctx context.Context, method string, body []byte) (json.RawMessage, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url, r)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	correlation.Inject(ctx, req.Header)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("backend request: %w", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("read backend response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("backend status %d: %s", resp.StatusCode, bytes.TrimSpace(b))
+	}
+	if method != http.MethodGet || len(bytes.TrimSpace(b)) == 0 {
+		return nil, nil
+	}
+	if !json.Valid(b) {
+		return nil, errors.New("backend returned invalid JSON")
+	}
+	return json.RawMessage(b), nil
+}
+
+// Change is one audited RVInfo update.
+type Change struct {
+	Time       time.Time       `json:"time"`
+	RequestID  string          `json:"request_id,omitempty"`
+	RemoteAddr string          `json:"remote_addr,omitempty"`
+	Reason     string          `json:"reason,omitempty"`
+	Previous   json.RawMessage `json:"previous,omitempty"`
+	RVInfo     json.RawMessage `json:"rvinfo"`
+}
+
+// Audit is the RVInfo change history.
+type Audit = audit.Log[Change]
+
+// OpenAudit loads the history from path, which need not exist yet. An
+// empty path keeps the history in memory only.
+func OpenAudit(path string) (*Audit, error) {
+	return audit.Open[Change](path, "rvinfo audit")
+}
@@ -0,0 +1,380 @@
+// Package schedule runs the proxy's recurring jobs, such as store pruning
+// and passport service sync, on cron-style schedules, and keeps the status
+// of their last runs for the admin API.
+package schedule
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+var (
+	jobRuns = metrics.Default.NewCounterVec(
+		"fdo_proxy_job_runs_total",
+		"Scheduled job runs by job and outcome (success, error, skipped, locked).",
+		"job", "outcome")
+	jobLastSuccess = metrics.Default.NewGaugeVec(
+		"fdo_proxy_job_last_success_timestamp",
+		"Completion time of the last successful run of each job, in seconds since 1970.",
+		"job")
+)
+
+var (
+	// ErrUnknown is returned for a job that was not added.
+	ErrUnknown = errors.New("unknown job")
+	// ErrRunning is returned when a job is started while it runs.
+	ErrRunning = errors.New("job already running")
+	// ErrLocked is returned when a singleton job is started while another
+	// proxy runs it.
+	ErrLocked = errors.New("job running on another proxy")
+)
+
+// Func is the work of a job. Its error fails the run.
+type Func func(ctx context.Context) error
+
+// Locker coordinates singleton jobs between the proxies of a deployment.
+type Locker interface {
+	// Exclusive runs fn holding the lock name, or reports false without
+	// running it while another holder has the lock.
+	Exclusive(ctx context.Context, name string, fn func(context.Context) error) (bool, error)
+}
+
+// Job is a recurring task.
+type Job struct {
+	Name string
+	// Schedule is the default schedule, see Parse.
+	Schedule string
+	// RunAtStart also runs the job when the scheduler starts.
+	RunAtStart bool
+	// Singleton jobs work on state the proxies share, so with a Locker
+	// only one proxy runs them at a time; the others skip the run.
+	Singleton bool
+	Run       Func
+}
+
+// JobConfig overrides the defaults of a job; it is one entry of a jobs
+// file.
+type JobConfig struct {
+	// Schedule replaces the job's schedule, see Parse.
+	Schedule string `json:"schedule,omitempty"`
+	// Enabled false stops the job from running on its own; it can still be
+	// run through the admin API.
+	Enabled *bool `json:"enabled,omitempty"`
+	// RunAtStart replaces whether the job runs at startup.
+	RunAtStart *bool `json:"run_at_start,omitempty"`
+}
+
+// Config is a jobs file, keyed by job name.
+type Config map[string]JobConfig
+
+// LoadConfig reads a jobs file of the form
+//
+//	{
+//	  "prune": {"schedule": "30 2 * * *"},
+//	  "reconcile": {"schedule": "0 6 * * 1-5", "run_at_start": false},
+//	  "anchor": {"enabled": false}
+//	}
+//
+// and checks its schedules. Job names are checked when jobs are added.
+func LoadConfig(path string) (Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read jobs: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("parse jobs: %w", err)
+	}
+	for name, jc := range c {
+		if jc.Schedule == "" {
+			continue
+		}
+		if _, err := Parse(jc.Schedule); err != nil {
+			return nil, fmt.Errorf("job %s: %w", name, err)
+		}
+	}
+	return c, nil
+}
+
+// Status is the state of a job.
+type Status struct {
+	Name       string `json:"name"`
+	Schedule   string `json:"schedule"`
+	Enabled    bool   `json:"enabled"`
+	RunAtStart bool   `json:"run_at_start"`
+	// Singleton is set for a job that takes a lock shared with other
+	// proxies.
+	Singleton bool `json:"singleton,omitempty"`
+	Running   bool `json:"running"`
+	// NextRun is when the job runs next on its own.
+	NextRun time.Time `json:"next_run,omitzero"`
+	// LastStart and LastEnd bound the last completed run, LastError is
+	// why it failed.
+	LastStart   time.Time `json:"last_start,omitzero"`
+	LastEnd     time.Time `json:"last_end,omitzero"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	Runs        int       `json:"runs"`
+	Failures    int       `json:"failures"`
+	// Skipped counts scheduled runs dropped because the job still ran.
+	Skipped int `json:"skipped"`
+	// Locked counts runs left to another proxy holding the job's lock.
+	Locked int `json:"locked,omitempty"`
+}
+
+type job struct {
+	Job
+	sched  Schedule
+	locker Locker // nil unless Singleton
+
+	mu     sync.Mutex
+	status Status
+}
+
+// Scheduler runs jobs on their schedules.
+type Scheduler struct {
+	cfg    Config
+	locker Locker
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// New creates a Scheduler applying cfg, which may be nil.
+func New(cfg Config) *Scheduler {
+	return &Scheduler{cfg: cfg, jobs: make(map[string]*job)}
+}
+
+// EnableLocking makes singleton jobs added afterwards take a lock from l
+// for each run, so only one of the proxies sharing l runs them at a time.
+func (s *Scheduler) EnableLocking(l Locker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locker = l
+}
+
+// Add adds j, applying the configuration of its name. Jobs added after
+// Start do not run on their own.
+func (s *Scheduler) Add(j Job) error {
+	st := Status{Name: j.Name, Schedule: j.Schedule, Enabled: true, RunAtStart: j.RunAtStart}
+	if jc, ok := s.cfg[j.Name]; ok {
+		if jc.Schedule != "" {
+			st.Schedule = jc.Schedule
+		}
+		if jc.Enabled != nil {
+			st.Enabled = *jc.Enabled
+		}
+		if jc.RunAtStart != nil {
+			st.RunAtStart = *jc.RunAtStart
+		}
+	}
+	sched, err := Parse(st.Schedule)
+	if err != nil {
+		return fmt.Errorf("job %s: %w", j.Name, err)
+	}
+	j.Schedule, j.RunAtStart = st.Schedule, st.RunAtStart
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[j.Name]; ok {
+		return fmt.Errorf("job %s added twice", j.Name)
+	}
+	nj := &job{Job: j, sched: sched, status: st}
+	if j.Singleton && s.locker != nil {
+		nj.locker = s.locker
+		nj.status.Singleton = true
+	}
+	s.jobs[j.Name] = nj
+	return nil
+}
+
+// Unused returns the configured job names that were not added, sorted.
+func (s *Scheduler) Unused() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []string
+	for name := range s.cfg {
+		if _, ok := s.jobs[name]; !ok {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Start runs every enabled job on its schedule until ctx is cancelled.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if !j.status.Enabled {
+			slog.Info("Scheduled job disabled", "job", j.Name)
+			continue
+		}
+		slog.Info("Scheduled job started", "job", j.Name, "schedule", j.Schedule, "run_at_start", j.RunAtStart)
+		go j.loop(ctx)
+	}
+}
+
+// Status returns the state of every job, sorted by name.
+func (s *Scheduler) Status() []Status {
+	s.mu.Lock()
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	s.mu.Unlock()
+
+	out := make([]Status, len(jobs))
+	for i, j := range jobs {
+		out[i] = j.snapshot()
+	}
+	sort.Slice(out, func(i, k int) bool { return out[i].Name < out[k].Name })
+	return out
+}
+
+// Get returns the state of the named job.
+func (s *Scheduler) Get(name string) (Status, error) {
+	j, err := s.job(name)
+	if err != nil {
+		return Status{}, err
+	}
+	return j.snapshot(), nil
+}
+
+// RunNow runs the named job, enabled or not, and returns its state
+// afterwards. It fails with ErrRunning rather than wait for a run in
+// progress, and with ErrLocked if another proxy runs a singleton job.
+func (s *Scheduler) RunNow(ctx context.Context, name string) (Status, error) {
+	j, err := s.job(name)
+	if err != nil {
+		return Status{}, err
+	}
+	if err := j.run(ctx); err != nil {
+		return Status{}, err
+	}
+	return j.snapshot(), nil
+}
+
+func (s *Scheduler) job(name string) (*job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknown, name)
+	}
+	return j, nil
+}
+
+// loop runs j at startup if configured, then at every scheduled time.
+func (j *job) loop(ctx context.Context) {
+	if j.RunAtStart {
+		j.scheduled(ctx)
+	}
+	for {
+		next := j.sched.Next(time.Now())
+		j.mu.Lock()
+		j.status.NextRun = next.UTC()
+		j.mu.Unlock()
+		if next.IsZero() {
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			j.scheduled(ctx)
+		}
+	}
+}
+
+// scheduled runs j on its own, skipping the run while a manual one is in
+// progress.
+func (j *job) scheduled(ctx context.Context) {
+	if errors.Is(j.run(ctx), ErrRunning) {
+		j.mu.Lock()
+		j.status.Skipped++
+		j.mu.Unlock()
+		jobRuns.Inc(j.Name, "skipped")
+		slog.Warn("Scheduled job skipped, previous run still in progress", "job", j.Name)
+	}
+}
+
+// run runs j once and records the outcome. Without running, it returns
+// ErrRunning if j is already running and ErrLocked if another proxy holds
+// its lock; the error of the run itself is only recorded.
+func (j *job) run(ctx context.Context) error {
+	j.mu.Lock()
+	if j.status.Running {
+		j.mu.Unlock()
+		return ErrRunning
+	}
+	j.status.Running = true
+	j.mu.Unlock()
+
+	var start time.Time
+	work := func(ctx context.Context) error {
+		start = time.Now().UTC()
+		return j.Run(ctx)
+	}
+	var err error
+	if j.locker != nil {
+		var ran bool
+		ran, err = j.locker.Exclusive(ctx, "job:"+j.Name, work)
+		if !ran && err == nil {
+			j.mu.Lock()
+			j.status.Running = false
+			j.status.Locked++
+			j.mu.Unlock()
+			jobRuns.Inc(j.Name, "locked")
+			slog.Debug("Scheduled job left to the proxy holding its lock", "job", j.Name)
+			return ErrLocked
+		}
+		if !ran {
+			// The lock itself failed
+			start = time.Now().UTC()
+		}
+	} else {
+		err = work(ctx)
+	}
+	end := time.Now().UTC()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastStart, j.status.LastEnd = start, end
+	if err != nil {
+		j.status.Failures++
+		j.status.LastError = err.Error()
+		jobRuns.Inc(j.Name, "error")
+		slog.Warn("Scheduled job failed", "job", j.Name, "duration", end.Sub(start), "error", err)
+		return nil
+	}
+	j.status.LastError = ""
+	j.status.LastSuccess = end
+	jobRuns.Inc(j.Name, "success")
+	jobLastSuccess.Set(float64(end.Unix()), j.Name)
+	slog.Debug("Scheduled job completed", "job", j.Name, "duration", end.Sub(start))
+	return nil
+}
+
+func (j *job) snapshot() Status {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS fdo_proxy_store_meta;
+DROP TABLE IF EXISTS fdo_proxy_records;
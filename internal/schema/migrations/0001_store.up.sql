@@ -0,0 +1,18 @@
+-- Onboarding history of -store-db, one row per attempt. Tables created by
+-- builds from before migrations are adopted as they are.
+CREATE TABLE IF NOT EXISTS fdo_proxy_records (
+	seq bigserial PRIMARY KEY,
+	id text NOT NULL UNIQUE,
+	guid text,
+	completed_at timestamptz NOT NULL,
+	stripped boolean NOT NULL DEFAULT false,
+	record text NOT NULL
+);
+CREATE INDEX IF NOT EXISTS fdo_proxy_records_completed_at ON fdo_proxy_records (completed_at);
+CREATE INDEX IF NOT EXISTS fdo_proxy_records_guid ON fdo_proxy_records (guid);
+
+-- The wrapped data key of an encrypted store
+CREATE TABLE IF NOT EXISTS fdo_proxy_store_meta (
+	name text PRIMARY KEY,
+	value text NOT NULL
+);
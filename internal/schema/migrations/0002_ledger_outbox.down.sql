@@ -0,0 +1 @@
+DROP TABLE IF EXISTS fdo_proxy_ledger_outbox;
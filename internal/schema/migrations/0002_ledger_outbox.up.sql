@@ -0,0 +1,6 @@
+-- The -ledger-offline outbox shared by the proxies, one JSON document
+CREATE TABLE IF NOT EXISTS fdo_proxy_ledger_outbox (
+	id integer PRIMARY KEY CHECK (id = 1),
+	state text NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT now()
+);
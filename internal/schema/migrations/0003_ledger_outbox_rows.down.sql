@@ -0,0 +1,8 @@
+-- Work still queued is dropped with the tables; sync it before reverting.
+DROP TABLE IF EXISTS fdo_proxy_ledger_lookups;
+DROP TABLE IF EXISTS fdo_proxy_ledger_writes;
+CREATE TABLE IF NOT EXISTS fdo_proxy_ledger_outbox (
+	id integer PRIMARY KEY CHECK (id = 1),
+	state text NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1,37 @@
+-- The shared -ledger-offline outbox as one row per queued write and per
+-- deferred lookup, so proxies queue and sync without contending for one
+-- document. The writes queued in 0002's document are carried over.
+CREATE TABLE IF NOT EXISTS fdo_proxy_ledger_writes (
+	id bigserial PRIMARY KEY,
+	-- The QueuedWrite as JSON, sealed as store records are in an
+	-- encrypted store
+	record text NOT NULL,
+	-- Set once the passport service refused the write on sync
+	rejected_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS fdo_proxy_ledger_writes_queued ON fdo_proxy_ledger_writes (id) WHERE rejected_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS fdo_proxy_ledger_lookups (
+	uuid text PRIMARY KEY,
+	deferred_at timestamptz NOT NULL
+);
+
+INSERT INTO fdo_proxy_ledger_writes (id, record)
+SELECT (w->>'id')::bigint, w::text
+FROM fdo_proxy_ledger_outbox o,
+	json_array_elements(CASE WHEN json_typeof(o.state::json->'writes') = 'array' THEN o.state::json->'writes' ELSE '[]' END) w;
+
+INSERT INTO fdo_proxy_ledger_writes (id, record, rejected_at)
+SELECT (w->>'id')::bigint, w::text, now()
+FROM fdo_proxy_ledger_outbox o,
+	json_array_elements(CASE WHEN json_typeof(o.state::json->'rejected') = 'array' THEN o.state::json->'rejected' ELSE '[]' END) w;
+
+INSERT INTO fdo_proxy_ledger_lookups (uuid, deferred_at)
+SELECT l->>'uuid', (l->>'deferred_at')::timestamptz
+FROM fdo_proxy_ledger_outbox o,
+	json_array_elements(CASE WHEN json_typeof(o.state::json->'lookups') = 'array' THEN o.state::json->'lookups' ELSE '[]' END) l
+ON CONFLICT (uuid) DO NOTHING;
+
+SELECT setval(pg_get_serial_sequence('fdo_proxy_ledger_writes', 'id'), coalesce(max(id), 0) + 1, false) FROM fdo_proxy_ledger_writes;
+
+DROP TABLE IF EXISTS fdo_proxy_ledger_outbox;
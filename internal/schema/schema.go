@@ -0,0 +1,22 @@
+// Package schema holds the migrations of the proxy's own database
+// (-store-db), embedded in the binary so a build always carries the schema
+// it expects.
+//
+// A schema change is a new pair of files in migrations, numbered after the
+// last: NNNN_name.up.sql applies it and NNNN_name.down.sql reverts it.
+// Released migrations are never edited; a change to one is a new migration.
+package schema
+
+import (
+	"embed"
+
+	"github.com/fdo-server-wrapper/internal/pg"
+)
+
+//go:embed migrations/*.sql
+var files embed.FS
+
+// Migrations returns the migrations in version order.
+func Migrations() ([]pg.Migration, error) {
+	return pg.LoadMigrations(files, "migrations")
+}
@@ -0,0 +1,123 @@
+// Package serials remembers which device serial numbers completed DI at
+// this proxy, so a serial showing up on the line again can be flagged as a
+// possible re-flash, clone or process error.
+package serials
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+var initialized = metrics.Default.NewGaugeVec(
+	"fdo_proxy_initialized_serials",
+	"Distinct serial numbers that completed DI.")
+
+// Entry records the DI history of one serial number.
+type Entry struct {
+	Serial string `json:"serial"`
+	// GUID is the device GUID issued by the most recent DI.
+	GUID  string    `json:"guid,omitempty"`
+	First time.Time `json:"first_initialized"`
+	Last  time.Time `json:"last_initialized"`
+	// Count is the number of completed DI exchanges for the serial.
+	Count int `json:"count"`
+}
+
+// Registry is the set of initialized serial numbers, optionally persisted to
+// a JSON Lines file that is appended to on every completed DI.
+type Registry struct {
+	path string
+
+	mu      sync.RWMutex
+	entries map[string]Entry
+}
+
+// Open loads the registry from path, which need not exist yet. Later lines
+// for a serial supersede earlier ones. An empty path keeps the registry in
+// memory only.
+func Open(path string) (*Registry, error) {
+	r := &Registry{path: path, entries: make(map[string]Entry)}
+	if path == "" {
+		return r, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open serial registry: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("parse serial registry: %w", err)
+		}
+		r.entries[e.Serial] = e
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read serial registry: %w", err)
+	}
+	initialized.Set(float64(len(r.entries)))
+	return r, nil
+}
+
+// Get returns the entry for serial, if it completed DI before. A nil
+// registry holds nothing.
+func (r *Registry) Get(serial string) (Entry, bool) {
+	if r == nil {
+		return Entry{}, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.entries[serial]
+	return e, ok
+}
+
+// Record notes a completed DI for serial and returns the updated entry.
+func (r *Registry) Record(serial, guid string, at time.Time) (Entry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[serial]
+	if !ok {
+		e = Entry{Serial: serial, First: at.UTC()}
+	}
+	e.GUID = guid
+	e.Last = at.UTC()
+	e.Count++
+	r.entries[serial] = e
+	initialized.Set(float64(len(r.entries)))
+	return e, r.appendLocked(e)
+}
+
+// appendLocked writes e to the end of the file. The caller must hold r.mu.
+func (r *Registry) appendLocked(e Entry) error {
+	if r.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open serial registry: %w", err)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("write serial registry: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,306 @@
+// Package session tracks in-flight FDO protocol sessions so facts observed in
+// one message (e.g. the GUID in TO2.HelloDevice) can be used when handling a
+// later one (e.g. TO2.Done2). Sessions are keyed by the bearer token the
+// backend issues in its first response.
+package session
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/geo"
+)
+
+// ServiceInfoSummary describes the ServiceInfo exchanged during TO2.
+type ServiceInfoSummary struct {
+	DeviceMessages int           `json:"device_messages"`
+	OwnerMessages  int           `json:"owner_messages"`
+	DeviceBytes    int           `json:"device_bytes"`
+	OwnerBytes     int           `json:"owner_bytes"`
+	Encrypted      bool          `json:"encrypted"`
+	Modules        []ModuleUsage `json:"modules,omitempty"`
+}
+
+// ModuleUsage counts the ServiceInfo entries seen for one FSIM module.
+type ModuleUsage struct {
+	Name     string `json:"name"`
+	Messages int    `json:"messages"`
+	Bytes    int    `json:"bytes"`
+}
+
+// Attestation is the device attestation evidence from TO2.ProveDevice.
+type Attestation struct {
+	// Type is the attestation family: "ecdsa", "rsa" or "epid".
+	Type string `json:"type"`
+	// Algorithm is the signature algorithm name, e.g. "ES384".
+	Algorithm string `json:"algorithm"`
+	// Nonce is the hex NonceTO2ProveDv the device signed.
+	Nonce string `json:"nonce,omitempty"`
+	// ClaimsDigest is the hex SHA-256 of the encoded EAT claims.
+	ClaimsDigest string `json:"claims_digest,omitempty"`
+	// Verification is the external verifier's result, if one is configured.
+	Verification string `json:"verification,omitempty"`
+}
+
+// Session is the state recorded for one FDO protocol session.
+type Session struct {
+	Token     string    `json:"-"`
+	Protocol  string    `json:"protocol"`
+	GUID      string    `json:"guid,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// HelloNonce is the hex NonceTO2ProveOV of a TO2 session, which the
+	// device knows; it is never shown or stored, as it authenticates
+	// status requests for the session.
+	HelloNonce string `json:"-"`
+	// RemoteAddr is the device's source IP.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Location is where RemoteAddr is located, when a GeoIP database is
+	// configured and knows it.
+	Location *geo.Location `json:"location,omitempty"`
+	// OutsideGeofence is set when the device's policy did not expect it
+	// to onboard from RemoteAddr.
+	OutsideGeofence bool `json:"outside_geofence,omitempty"`
+
+	// TO2 evidence
+	KexSuite     string             `json:"kex_suite,omitempty"`
+	CipherSuite  string             `json:"cipher_suite,omitempty"`
+	VoucherHash  string             `json:"voucher_hash,omitempty"`
+	OwnerKeyHash string             `json:"owner_key_hash,omitempty"`
+	ServiceInfo  ServiceInfoSummary `json:"service_info"`
+	Attestation  *Attestation       `json:"attestation,omitempty"`
+
+	// DeviceCert is the PEM device operational certificate issued through
+	// the fdo.csr ServiceInfo module, if one was observed.
+	DeviceCert string `json:"device_cert,omitempty"`
+	// Serial is the device serial number from the issued certificate's
+	// subject, if present, or else from the device's DI.
+	Serial string `json:"serial,omitempty"`
+	// ProductID is the product UUID seen in the device's DI, when DI ran
+	// through this proxy.
+	ProductID string `json:"product_id,omitempty"`
+	// OwnerID is the owner the device is being onboarded to.
+	OwnerID string `json:"owner_id,omitempty"`
+	// Tags group the device for policy and reporting (see package tags).
+	Tags []string `json:"tags,omitempty"`
+	// Policy names the policy the device's tags selected (see package
+	// policy), if any.
+	Policy string `json:"policy,omitempty"`
+	// Transfers are the files delivered through fdo.download and fdo.wget,
+	// when ServiceInfo was readable.
+	Transfers []Transfer `json:"transfers,omitempty"`
+}
+
+// Transfer verification results.
+const (
+	// TransferVerified matches the digest the product passport lists.
+	TransferVerified = "verified"
+	// TransferMismatch differs from the passport digest, or the relayed
+	// data differs from the digest the owner announced.
+	TransferMismatch = "mismatch"
+	// TransferUnlisted is a file the product passport does not list.
+	TransferUnlisted = "unlisted"
+	// TransferUnverified is a listed file for which no digest was seen,
+	// e.g. fdo.wget without sha-384.
+	TransferUnverified = "unverified"
+	// TransferFailed is a transfer the device reported as failed.
+	TransferFailed = "failed"
+	// TransferPending is a transfer the device has not finished.
+	TransferPending = "pending"
+)
+
+// Transfer is a file delivered to the device during TO2. Digests are hex
+// SHA-384.
+type Transfer struct {
+	Module string `json:"module"`
+	Name   string `json:"name,omitempty"`
+	// URL is where fdo.wget had the device fetch the file.
+	URL    string `json:"url,omitempty"`
+	Length int64  `json:"length,omitempty"`
+	// AnnouncedSHA384 is the digest the owner sent with the file.
+	AnnouncedSHA384 string `json:"announced_sha384,omitempty"`
+	// ExpectedSHA384 is the digest the product passport lists for it.
+	ExpectedSHA384 string `json:"expected_sha384,omitempty"`
+	// ObservedSHA384 is the digest of the fdo.download data the proxy
+	// relayed, when all of it was seen.
+	ObservedSHA384 string `json:"observed_sha384,omitempty"`
+	// DeviceResult is the device's done value: the bytes it received, or -1
+	// on failure.
+	DeviceResult int64  `json:"device_result"`
+	Error        string `json:"error,omitempty"`
+	Done         bool   `json:"done"`
+	Verification string `json:"verification"`
+}
+
+// clone returns a deep copy safe to hand out of the store.
+func (s *Session) clone() *Session {
+	c := *s
+	c.ServiceInfo.Modules = append([]ModuleUsage(nil), s.ServiceInfo.Modules...)
+	c.Transfers = append([]Transfer(nil), s.Transfers...)
+	c.Tags = append([]string(nil), s.Tags...)
+	if s.Attestation != nil {
+		a := *s.Attestation
+		c.Attestation = &a
+	}
+	if s.Location != nil {
+		l := *s.Location
+		c.Location = &l
+	}
+	return &c
+}
+
+// RecordModule counts one ServiceInfo entry of size bytes for module name.
+func (s *Session) RecordModule(name string, bytes int) {
+	for i := range s.ServiceInfo.Modules {
+		if s.ServiceInfo.Modules[i].Name == name {
+			s.ServiceInfo.Modules[i].Messages++
+			s.ServiceInfo.Modules[i].Bytes += bytes
+			return
+		}
+	}
+	s.ServiceInfo.Modules = append(s.ServiceInfo.Modules, ModuleUsage{Name: name, Messages: 1, Bytes: bytes})
+	sort.Slice(s.ServiceInfo.Modules, func(i, j int) bool {
+		return s.ServiceInfo.Modules[i].Name < s.ServiceInfo.Modules[j].Name
+	})
+}
+
+// Store holds sessions in memory, expiring those idle for longer than ttl.
+type Store struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*Session
+}
+
+// NewStore creates a session store. A non-positive ttl defaults to 10 minutes,
+// comfortably longer than a TO2 exchange.
+func NewStore(ttl time.Duration) *Store {
+	if ttl <= 0 {
+		ttl = 10 * time.Minute
+	}
+	return &Store{ttl: ttl, sessions: make(map[string]*Session)}
+}
+
+// Put stores s under its token, replacing any existing session.
+func (st *Store) Put(s *Session) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	if s.StartedAt.IsZero() {
+		s.StartedAt = now
+	}
+	s.UpdatedAt = now
+	st.sessions[s.Token] = s.clone()
+	st.sweepLocked(now)
+}
+
+// Get returns a copy of the session for token.
+func (st *Store) Get(token string) (*Session, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	s, ok := st.sessions[token]
+	if !ok || time.Since(s.UpdatedAt) > st.ttl {
+		return nil, false
+	}
+	return s.clone(), true
+}
+
+// Update applies fn to the session for token under the store lock.
+// It reports whether the session existed.
+func (st *Store) Update(token string, fn func(*Session)) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	s, ok := st.sessions[token]
+	if !ok {
+		return false
+	}
+	fn(s)
+	s.UpdatedAt = time.Now()
+	return true
+}
+
+// Upsert applies fn to the session for token, creating it with protocol if
+// it does not exist yet.
+func (st *Store) Upsert(token, protocol string, fn func(*Session)) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	s, ok := st.sessions[token]
+	if !ok {
+		s = &Session{Token: token, Protocol: protocol, StartedAt: now}
+		st.sessions[token] = s
+	}
+	fn(s)
+	s.UpdatedAt = now
+}
+
+// Delete removes the session for token.
+func (st *Store) Delete(token string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.sessions, token)
+}
+
+// DeleteGUID removes every session for the device guid and returns how many
+// were removed.
+func (st *Store) DeleteGUID(guid string) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	n := 0
+	for token, s := range st.sessions {
+		if s.GUID == guid {
+			delete(st.sessions, token)
+			n++
+		}
+	}
+	return n
+}
+
+// Latest returns a copy of the live session for the device guid updated
+// last.
+func (st *Store) Latest(guid string) (*Session, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var latest *Session
+	for _, s := range st.sessions {
+		if s.GUID != guid || time.Since(s.UpdatedAt) > st.ttl {
+			continue
+		}
+		if latest == nil || s.UpdatedAt.After(latest.UpdatedAt) {
+			latest = s
+		}
+	}
+	if latest == nil {
+		return nil, false
+	}
+	return latest.clone(), true
+}
+
+// List returns copies of all live sessions, oldest first.
+func (st *Store) List() []*Session {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.sweepLocked(time.Now())
+	out := make([]*Session, 0, len(st.sessions))
+	for _, s := range st.sessions {
+		out = append(out, s.clone())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	return out
+}
+
+// sweepLocked drops expired sessions. The caller must hold st.mu.
+func (st *Store) sweepLocked(now time.Time) {
+	for token, s := range st.sessions {
+		if now.Sub(s.UpdatedAt) > st.ttl {
+			delete(st.sessions, token)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+// Package slo tracks onboarding against service level objectives: the share
+// of TO2 attempts that succeed, and the share of successful onboardings
+// that complete within a duration (their p95). It reports how much of each
+// objective's error budget is left over the SLO window and how fast recent
+// failures are burning it, so operators see when the onboarding pipeline
+// is out of SLO before the window is.
+package slo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/metrics"
+	"github.com/fdo-server-wrapper/internal/store"
+)
+
+// Objectives.
+const (
+	// Success is the share of TO2 attempts that complete.
+	Success = "success"
+	// Duration is the share of completed TO2 sessions that take no longer
+	// than the threshold; its target is DurationTarget.
+	Duration = "duration"
+)
+
+// DurationTarget is the target of the Duration objective: the threshold
+// is the p95 onboarding duration.
+const DurationTarget = 0.95
+
+// bucketWidth is the resolution of the tracked history.
+const bucketWidth = 5 * time.Minute
+
+// burnWindows are the recent windows burn rates are reported over, long
+// and short enough for the usual multi-window alerts.
+var burnWindows = []struct {
+	label string
+	d     time.Duration
+}{{"1h", time.Hour}, {"6h", 6 * time.Hour}, {"24h", 24 * time.Hour}}
+
+// bounds are the upper bounds, in seconds, of the duration histogram the
+// p95 is estimated from.
+var bounds = [...]float64{1, 2, 5, 10, 15, 20, 30, 45, 60, 90, 120, 180, 300, 600, 1200, 1800, 3600}
+
+var (
+	targetGauge = metrics.Default.NewGaugeVec(
+		"fdo_proxy_slo_target",
+		"Target of each onboarding objective (success, duration).",
+		"slo")
+	sliGauge = metrics.Default.NewGaugeVec(
+		"fdo_proxy_slo_sli",
+		"Share of good onboardings per objective over each window (1h, 6h, 24h, slo for the whole SLO window); 1 with none.",
+		"slo", "window")
+	burnGauge = metrics.Default.NewGaugeVec(
+		"fdo_proxy_slo_burn_rate",
+		"Rate each objective's error budget is being spent over each window; 1 spends it exactly over the SLO window.",
+		"slo", "window")
+	budgetGauge = metrics.Default.NewGaugeVec(
+		"fdo_proxy_slo_error_budget_remaining",
+		"Share of each objective's error budget left over the SLO window; negative when overspent.",
+		"slo")
+	metGauge = metrics.Default.NewGaugeVec(
+		"fdo_proxy_slo_met",
+		"1 while an objective is met over the SLO window, 0 when it is not.",
+		"slo")
+	p95Gauge = metrics.Default.NewGaugeVec(
+		"fdo_proxy_onboarding_duration_p95_seconds",
+		"Estimated p95 duration of completed TO2 sessions over each window.",
+		"window")
+)
+
+// Options are the objectives.
+type Options struct {
+	// Success is the target share of TO2 attempts that complete, e.g.
+	// 0.99; zero does not track it.
+	Success float64
+	// Duration is the p95 threshold of completed TO2 sessions; zero does
+	// not track it.
+	Duration time.Duration
+	// Window is the SLO window budgets are counted over.
+	Window time.Duration
+}
+
+// bucket counts the onboardings that ended in one bucketWidth.
+type bucket struct {
+	total, failed int
+	// timed counts completions of known duration, slow those over the
+	// Duration threshold, and hist their durations by bounds.
+	timed, slow int
+	hist        [len(bounds) + 1]int
+}
+
+// Tracker counts onboarding outcomes. It implements events.Sink.
+type Tracker struct {
+	o Options
+
+	mu      sync.Mutex
+	buckets map[int64]*bucket // by start time / bucketWidth
+
+	met map[string]bool // by objective, as of the last refresh; Run only
+}
+
+// New returns a Tracker for the objectives in o.
+func New(o Options) (*Tracker, error) {
+	if o.Success == 0 && o.Duration == 0 {
+		return nil, errors.New("slo: no objective")
+	}
+	if o.Success < 0 || o.Success >= 1 {
+		return nil, fmt.Errorf("slo: success target %v is not between 0 and 1", o.Success)
+	}
+	if o.Duration < 0 {
+		return nil, fmt.Errorf("slo: negative duration %s", o.Duration)
+	}
+	if o.Window < 24*time.Hour {
+		return nil, fmt.Errorf("slo: window %s is shorter than 24h", o.Window)
+	}
+	t := &Tracker{o: o, buckets: make(map[int64]*bucket), met: make(map[string]bool)}
+	for _, obj := range t.objectives() {
+		targetGauge.Set(obj.target, obj.name)
+	}
+	return t, nil
+}
+
+// objective is one tracked objective.
+type objective struct {
+	name   string
+	target float64
+}
+
+// objectives lists the objectives t tracks.
+func (t *Tracker) objectives() []objective {
+	var out []objective
+	if t.o.Success > 0 {
+		out = append(out, objective{Success, t.o.Success})
+	}
+	if t.o.Duration > 0 {
+		out = append(out, objective{Duration, DurationTarget})
+	}
+	return out
+}
+
+// Seed counts the TO2 attempts in st's history over the SLO window, so a
+// restart does not empty it. It is called before events are published;
+// with a shared store it counts every proxy's onboardings, after which
+// each proxy counts its own.
+func (t *Tracker) Seed(ctx context.Context, st store.Store) (int, error) {
+	n := 0
+	err := st.Each(ctx, store.Query{From: time.Now().Add(-t.o.Window)}, func(r *store.Record) error {
+		switch {
+		case r.Outcome == store.OutcomeSucceeded:
+			var d time.Duration
+			if r.StartedAt.Before(r.CompletedAt) {
+				d = r.CompletedAt.Sub(r.StartedAt)
+			}
+			t.add(r.CompletedAt, true, d)
+		case r.Outcome == store.OutcomeFailed && r.Protocol == "to2":
+			t.add(r.CompletedAt, false, 0)
+		default:
+			return nil
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, fmt.Errorf("seed slo: %w", err)
+	}
+	return n, nil
+}
+
+// Name implements events.Sink.
+func (t *Tracker) Name() string { return "slo" }
+
+// Publish implements events.Sink.
+func (t *Tracker) Publish(_ context.Context, ev *events.Event) error {
+	switch {
+	case ev.Type == events.Commissioned:
+		var d time.Duration
+		if s := ev.Session; s != nil && !s.StartedAt.IsZero() && s.StartedAt.Before(ev.Time) {
+			d = ev.Time.Sub(s.StartedAt)
+		}
+		t.add(ev.Time, true, d)
+	case ev.Type == events.Failed && ev.Protocol == "to2":
+		t.add(ev.Time, false, 0)
+	}
+	return nil
+}
+
+// add counts an onboarding that ended at at; d is zero if its duration is
+// not known.
+func (t *Tracker) add(at time.Time, ok bool, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := at.UnixNano() / int64(bucketWidth)
+	b := t.buckets[k]
+	if b == nil {
+		b = &bucket{}
+		t.buckets[k] = b
+	}
+	b.total++
+	if !ok {
+		b.failed++
+		return
+	}
+	if d <= 0 {
+		return
+	}
+	b.timed++
+	if t.o.Duration > 0 && d > t.o.Duration {
+		b.slow++
+	}
+	i := 0
+	for i < len(bounds) && d.Seconds() > bounds[i] {
+		i++
+	}
+	b.hist[i]++
+}
+
+// Objective is the state of one objective.
+type Objective struct {
+	Name   string  `json:"name"`
+	Target float64 `json:"target"`
+	// Threshold is the duration of the Duration objective.
+	Threshold string `json:"threshold,omitempty"`
+	// Good and Total count the onboardings over the SLO window, and SLI is
+	// their ratio, 1 with none.
+	Good  int     `json:"good"`
+	Total int     `json:"total"`
+	SLI   float64 `json:"sli"`
+	// BudgetRemaining is the share of the error budget left, negative when
+	// overspent.
+	BudgetRemaining float64 `json:"error_budget_remaining"`
+	Met             bool    `json:"met"`
+	// Recent is the objective over each recent window (1h, 6h, 24h).
+	Recent map[string]Recent `json:"recent"`
+}
+
+// Recent is an objective over a recent window. A BurnRate of 1 spends the
+// error budget exactly over the SLO window.
+type Recent struct {
+	SLI      float64 `json:"sli"`
+	BurnRate float64 `json:"burn_rate"`
+}
+
+// Report summarizes the SLO window.
+type Report struct {
+	Window      string    `json:"window"`
+	From        time.Time `json:"from"`
+	Onboardings int       `json:"onboardings"`
+	Failed      int       `json:"failed"`
+	// P95 is the estimated p95 duration of completed sessions in seconds,
+	// by window (1h, 6h, 24h, slo for the SLO window), for the windows with
+	// durations known.
+	P95        map[string]float64 `json:"p95_seconds"`
+	Objectives []Objective        `json:"objectives"`
+}
+
+// Report returns the state of the objectives at now.
+func (t *Tracker) Report(now time.Time) Report {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	full := t.sumLocked(now, t.o.Window)
+	recent := make(map[string]bucket, len(burnWindows))
+	for _, w := range burnWindows {
+		recent[w.label] = t.sumLocked(now, w.d)
+	}
+	rep := Report{
+		Window:      t.o.Window.String(),
+		From:        now.Add(-t.o.Window).UTC(),
+		Onboardings: full.total,
+		Failed:      full.failed,
+		P95:         make(map[string]float64),
+	}
+	if full.timed > 0 {
+		rep.P95["slo"] = full.p95()
+	}
+	for label, b := range recent {
+		if b.timed > 0 {
+			rep.P95[label] = b.p95()
+		}
+	}
+	for _, obj := range t.objectives() {
+		good, total := t.counts(obj.name, full)
+		o := Objective{
+			Name:            obj.name,
+			Target:          obj.target,
+			Good:            good,
+			Total:           total,
+			SLI:             ratio(good, total),
+			BudgetRemaining: 1 - burnRate(good, total, obj.target),
+			Recent:          make(map[string]Recent, len(recent)),
+		}
+		if obj.name == Duration {
+			o.Threshold = t.o.Duration.String()
+		}
+		o.Met = o.SLI >= obj.target
+		for label, b := range recent {
+			good, total := t.counts(obj.name, b)
+			o.Recent[label] = Recent{SLI: ratio(good, total), BurnRate: burnRate(good, total, obj.target)}
+		}
+		rep.Objectives = append(rep.Objectives, o)
+	}
+	return rep
+}
+
+// counts returns the good and total onboardings of an objective in b.
+func (t *Tracker) counts(name string, b bucket) (int, int) {
+	if name == Duration {
+		return b.timed - b.slow, b.timed
+	}
+	return b.total - b.failed, b.total
+}
+
+// sumLocked adds up the buckets of the window d before now.
+func (t *Tracker) sumLocked(now time.Time, d time.Duration) bucket {
+	from := now.Add(-d).UnixNano() / int64(bucketWidth)
+	var sum bucket
+	for k, b := range t.buckets {
+		if k <= from {
+			continue
+		}
+		sum.total += b.total
+		sum.failed += b.failed
+		sum.timed += b.timed
+		sum.slow += b.slow
+		for i, n := range b.hist {
+			sum.hist[i] += n
+		}
+	}
+	return sum
+}
+
+// p95 estimates the p95 duration in seconds from the histogram,
+// interpolating within the bound it falls in; zero with no durations.
+func (b bucket) p95() float64 {
+	if b.timed == 0 {
+		return 0
+	}
+	rank := math.Ceil(DurationTarget * float64(b.timed))
+	seen := 0.0
+	for i, n := range b.hist {
+		if n == 0 || seen+float64(n) < rank {
+			seen += float64(n)
+			continue
+		}
+		if i == len(bounds) {
+			return bounds[len(bounds)-1]
+		}
+		lo := 0.0
+		if i > 0 {
+			lo = bounds[i-1]
+		}
+		return lo + (bounds[i]-lo)*(rank-seen)/float64(n)
+	}
+	return bounds[len(bounds)-1]
+}
+
+// ratio is good/total, 1 with none.
+func ratio(good, total int) float64 {
+	if total == 0 {
+		return 1
+	}
+	return float64(good) / float64(total)
+}
+
+// burnRate is the error ratio over the error budget 1-target.
+func burnRate(good, total int, target float64) float64 {
+	return (1 - ratio(good, total)) / (1 - target)
+}
+
+// Run refreshes the SLO metrics every interval and forgets onboardings
+// older than the window until ctx is done.
+func (t *Tracker) Run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		t.refresh(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// refresh prunes the history and sets the gauges, logging objectives
+// that went out of SLO or came back.
+func (t *Tracker) refresh(now time.Time) {
+	t.mu.Lock()
+	oldest := now.Add(-t.o.Window).UnixNano() / int64(bucketWidth)
+	for k := range t.buckets {
+		if k <= oldest {
+			delete(t.buckets, k)
+		}
+	}
+	t.mu.Unlock()
+
+	rep := t.Report(now)
+	for _, window := range append([]string{"slo"}, recentLabels()...) {
+		p95Gauge.Set(rep.P95[window], window)
+	}
+	for _, o := range rep.Objectives {
+		sliGauge.Set(o.SLI, o.Name, "slo")
+		budgetGauge.Set(o.BudgetRemaining, o.Name)
+		for label, r := range o.Recent {
+			sliGauge.Set(r.SLI, o.Name, label)
+			burnGauge.Set(r.BurnRate, o.Name, label)
+		}
+		met := 0.0
+		if o.Met {
+			met = 1
+		}
+		metGauge.Set(met, o.Name)
+		if was, ok := t.met[o.Name]; ok && was != o.Met {
+			if o.Met {
+				slog.Info("Onboarding back within SLO", "slo", o.Name, "sli", o.SLI, "target", o.Target, "window", rep.Window)
+			} else {
+				slog.Warn("Onboarding out of SLO", "slo", o.Name, "sli", o.SLI, "target", o.Target, "window", rep.Window)
+			}
+		}
+		t.met[o.Name] = o.Met
+	}
+}
+
+// recentLabels lists the labels of burnWindows.
+func recentLabels() []string {
+	out := make([]string, len(burnWindows))
+	for i, w := range burnWindows {
+		out[i] = w.label
+	}
+	return out
+}
@@ -0,0 +1,143 @@
+package spiffe
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The Workload API's X509SVIDResponse, decoded by hand so the proxy needs
+// no protobuf or gRPC dependency. Only the fields used are read:
+//
+//	message X509SVIDResponse { repeated X509SVID svids = 1; ... }
+//	message X509SVID {
+//	  string spiffe_id = 1;
+//	  bytes x509_svid = 2;     // ASN.1 DER certificates, leaf first
+//	  bytes x509_svid_key = 3; // PKCS#8 DER private key
+//	  bytes bundle = 4;        // ASN.1 DER CA certificates
+//	}
+
+// SVID is an X.509 SPIFFE verifiable identity document.
+type SVID struct {
+	ID          string
+	Certificate tls.Certificate
+	// Bundle holds the trust domain's CA certificates.
+	Bundle *x509.CertPool
+}
+
+// parseResponse returns the first SVID of an X509SVIDResponse, the
+// workload's default identity.
+func parseResponse(msg []byte) (*SVID, error) {
+	var first []byte
+	err := eachField(msg, func(num int, v []byte) error {
+		if num == 1 && first == nil {
+			first = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if first == nil {
+		return nil, errors.New("response has no SVID")
+	}
+	return parseSVID(first)
+}
+
+func parseSVID(msg []byte) (*SVID, error) {
+	var id string
+	var certs, key, bundle []byte
+	err := eachField(msg, func(num int, v []byte) error {
+		switch num {
+		case 1:
+			id = string(v)
+		case 2:
+			certs = v
+		case 3:
+			key = v
+		case 4:
+			bundle = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	chain, err := x509.ParseCertificates(certs)
+	if err != nil || len(chain) == 0 {
+		return nil, fmt.Errorf("svid %s: certificates: %v", id, err)
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("svid %s: key: %w", id, err)
+	}
+	if _, ok := priv.(crypto.Signer); !ok {
+		return nil, fmt.Errorf("svid %s: key cannot sign", id)
+	}
+	cas, err := x509.ParseCertificates(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("svid %s: bundle: %w", id, err)
+	}
+	svid := &SVID{
+		ID: id,
+		Certificate: tls.Certificate{
+			PrivateKey: priv,
+			Leaf:       chain[0],
+		},
+		Bundle: x509.NewCertPool(),
+	}
+	for _, c := range chain {
+		svid.Certificate.Certificate = append(svid.Certificate.Certificate, c.Raw)
+	}
+	for _, c := range cas {
+		svid.Bundle.AddCert(c)
+	}
+	return svid, nil
+}
+
+// eachField calls fn with the length-delimited fields of a protobuf
+// message, skipping fields of other wire types.
+func eachField(msg []byte, fn func(num int, v []byte) error) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errors.New("malformed protobuf tag")
+		}
+		msg = msg[n:]
+		num, wire := int(tag>>3), tag&7
+		switch wire {
+		case 0: // varint
+			_, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return errors.New("malformed protobuf varint")
+			}
+			msg = msg[n:]
+		case 1: // fixed64
+			if len(msg) < 8 {
+				return errors.New("truncated protobuf field")
+			}
+			msg = msg[8:]
+		case 5: // fixed32
+			if len(msg) < 4 {
+				return errors.New("truncated protobuf field")
+			}
+			msg = msg[4:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return errors.New("truncated protobuf field")
+			}
+			v := msg[n : n+int(l)]
+			msg = msg[n+int(l):]
+			if err := fn(num, v); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", wire)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package spiffe
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testID = "spiffe://example.org/fdo-proxy"
+
+// testSVID returns a CA certificate, and a leaf certificate and PKCS#8 key
+// for testID issued by it.
+func testSVID(t *testing.T) (ca, leaf, key []byte) {
+	t.Helper()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "example.org CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	ca, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	id, _ := url.Parse(testID)
+	leaf, err = x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{id},
+	}, caTmpl, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err = x509.MarshalPKCS8PrivateKey(leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, leaf, key
+}
+
+// bytesField appends field num of wire type 2 holding v.
+func bytesField(b []byte, num int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// testResponse returns an X509SVIDResponse for testID, with fields of
+// every wire type the decoder must skip.
+func testResponse(t *testing.T) []byte {
+	ca, leaf, key := testSVID(t)
+	var svid []byte
+	svid = bytesField(svid, 1, []byte(testID))
+	svid = bytesField(svid, 2, append(leaf, ca...))
+	svid = bytesField(svid, 3, key)
+	svid = bytesField(svid, 4, ca)
+	svid = bytesField(svid, 5, []byte("hint")) // unknown field
+	var resp []byte
+	resp = binary.AppendUvarint(resp, 9<<3|0) // varint
+	resp = binary.AppendUvarint(resp, 300)
+	resp = binary.AppendUvarint(resp, 10<<3|1) // fixed64
+	resp = append(resp, make([]byte, 8)...)
+	resp = binary.AppendUvarint(resp, 11<<3|5) // fixed32
+	resp = append(resp, make([]byte, 4)...)
+	resp = bytesField(resp, 1, svid)
+	// A second SVID is ignored; the first is the default identity
+	resp = bytesField(resp, 1, bytesField(nil, 1, []byte("spiffe://example.org/other")))
+	return resp
+}
+
+func TestParseResponse(t *testing.T) {
+	svid, err := parseResponse(testResponse(t))
+	if err != nil {
+		t.Fatalf("parseResponse: %v", err)
+	}
+	if svid.ID != testID {
+		t.Errorf("ID = %q, want %q", svid.ID, testID)
+	}
+	if n := len(svid.Certificate.Certificate); n != 2 {
+		t.Errorf("chain has %d certificates, want 2", n)
+	}
+	if got := svid.Certificate.Leaf.URIs; len(got) != 1 || got[0].String() != testID {
+		t.Errorf("leaf URIs = %v", got)
+	}
+	if _, err := svid.Certificate.Leaf.Verify(x509.VerifyOptions{Roots: svid.Bundle}); err != nil {
+		t.Errorf("leaf does not verify against the bundle: %v", err)
+	}
+}
+
+func TestParseResponseMalformed(t *testing.T) {
+	good := testResponse(t)
+	tests := map[string][]byte{
+		"no SVID":          bytesField(nil, 2, []byte("x")),
+		"truncated":        good[:len(good)/2],
+		"bad tag":          {0x80},
+		"bad varint":       {0x08, 0x80},
+		"short fixed64":    {0x09, 0, 0},
+		"short fixed32":    {0x0d, 0},
+		"group wire type":  {0x0b},
+		"length past end":  {0x0a, 0x05, 1},
+		"no certificates":  bytesField(nil, 1, bytesField(nil, 1, []byte(testID))),
+		"certificate junk": bytesField(nil, 1, bytesField(nil, 2, []byte("junk"))),
+	}
+	for name, msg := range tests {
+		if _, err := parseResponse(msg); err == nil {
+			t.Errorf("%s: parseResponse succeeded", name)
+		}
+	}
+}
+
+// frame wraps msg in gRPC message framing.
+func frame(msg []byte) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg))), msg...)
+}
+
+func TestNext(t *testing.T) {
+	var s Source
+	if err := s.next(bytes.NewReader(frame(testResponse(t)))); err != nil {
+		t.Fatalf("next: %v", err)
+	}
+	if s.SVID().ID != testID {
+		t.Errorf("SVID = %q", s.SVID().ID)
+	}
+	tests := map[string][]byte{
+		"closed":     nil,
+		"compressed": {1, 0, 0, 0, 0},
+		"too large":  binary.BigEndian.AppendUint32([]byte{0}, maxMessage+1),
+		"truncated":  frame(testResponse(t))[:100],
+	}
+	for name, b := range tests {
+		if err := s.next(bytes.NewReader(b)); err == nil {
+			t.Errorf("%s: next succeeded", name)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	resp := testResponse(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{
+		Protocols: protocols,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/SpiffeWorkloadAPI/FetchX509SVID" || r.Header.Get("workload.spiffe.io") != "true" ||
+				!strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") || r.ProtoMajor != 2 {
+				w.Header().Set("Grpc-Status", "7")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Write(frame(resp))
+			w.Header().Set("Grpc-Status", "0")
+		}),
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	ctx := context.Background()
+	s, err := Open(ctx, "tcp://"+ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	cert, err := s.GetClientCertificate(nil)
+	if err != nil || cert.Leaf.URIs[0].String() != testID {
+		t.Errorf("GetClientCertificate = %v, %v", cert, err)
+	}
+
+	if _, err := Open(ctx, "http://"+ln.Addr().String()); err == nil {
+		t.Error("Open with an http:// endpoint succeeded")
+	}
+}
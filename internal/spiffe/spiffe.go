@@ -0,0 +1,208 @@
+// Package spiffe sources the proxy's X.509 identity from the SPIFFE
+// Workload API, e.g. a SPIRE agent, following its rotations.
+package spiffe
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+var (
+	updates = metrics.Default.NewCounterVec(
+		"fdo_proxy_spiffe_updates_total",
+		"X.509 SVIDs received from the Workload API, by outcome (success, error).",
+		"outcome")
+	svidExpiry = metrics.Default.NewGaugeVec(
+		"fdo_proxy_spiffe_svid_expiry_timestamp",
+		"Expiry of the current X.509 SVID, in seconds since 1970.")
+)
+
+// EndpointEnv names the environment variable holding the Workload API
+// address in SPIFFE deployments.
+const EndpointEnv = "SPIFFE_ENDPOINT_SOCKET"
+
+// maxMessage bounds Workload API messages.
+const maxMessage = 4 << 20
+
+// Source is the workload's current X.509 SVID, replaced whenever the
+// Workload API pushes a rotated one.
+type Source struct {
+	client *http.Client
+	svid   atomic.Pointer[SVID]
+}
+
+// Open connects to the Workload API at endpoint ("unix:///path" or
+// "tcp://host:port") and waits for the first SVID. Run keeps it current.
+func Open(ctx context.Context, endpoint string) (*Source, error) {
+	network, addr, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	s := &Source{client: &http.Client{Transport: &http.Transport{
+		Protocols: protocols,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	body, err := s.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if err := s.next(body); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parseEndpoint(endpoint string) (network, addr string, err error) {
+	switch {
+	case strings.HasPrefix(endpoint, "unix://"):
+		return "unix", strings.TrimPrefix(endpoint, "unix://"), nil
+	case strings.HasPrefix(endpoint, "unix:"):
+		return "unix", strings.TrimPrefix(endpoint, "unix:"), nil
+	case strings.HasPrefix(endpoint, "tcp://"):
+		return "tcp", strings.TrimPrefix(endpoint, "tcp://"), nil
+	}
+	return "", "", fmt.Errorf("workload API endpoint %q: want unix:///path or tcp://host:port", endpoint)
+}
+
+// SVID returns the current SVID.
+func (s *Source) SVID() *SVID {
+	return s.svid.Load()
+}
+
+// GetCertificate serves the current SVID from a TLS listener.
+func (s *Source) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return &s.svid.Load().Certificate, nil
+}
+
+// GetClientCertificate presents the current SVID to TLS servers.
+func (s *Source) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return &s.svid.Load().Certificate, nil
+}
+
+// Run follows SVID rotations until ctx is done, reconnecting with backoff
+// when the stream breaks. The last SVID stays in use meanwhile.
+func (s *Source) Run(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := s.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		updates.Inc("error")
+		slog.Warn("Workload API stream ended, reconnecting", "error", err, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// watch reads SVID updates from one stream until it ends.
+func (s *Source) watch(ctx context.Context) error {
+	body, err := s.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	for {
+		if err := s.next(body); err != nil {
+			return err
+		}
+	}
+}
+
+// fetch starts the FetchX509SVID server stream.
+func (s *Source) fetch(ctx context.Context) (io.ReadCloser, error) {
+	// An empty X509SVIDRequest in gRPC framing: uncompressed, length 0
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/SpiffeWorkloadAPI/FetchX509SVID", bytes.NewReader(make([]byte, 5)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("workload.spiffe.io", "true")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("workload API: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("workload API: status %d", resp.StatusCode)
+	}
+	if code := resp.Header.Get("Grpc-Status"); code != "" && code != "0" {
+		resp.Body.Close()
+		return nil, fmt.Errorf("workload API: grpc status %s: %s", code, resp.Header.Get("Grpc-Message"))
+	}
+	return &stream{ReadCloser: resp.Body, trailer: resp}, nil
+}
+
+// stream reports the gRPC status from the trailers once the body ends.
+type stream struct {
+	io.ReadCloser
+	trailer *http.Response
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if err == io.EOF {
+		if code := s.trailer.Trailer.Get("Grpc-Status"); code != "" && code != "0" {
+			return n, fmt.Errorf("workload API: grpc status %s: %s", code, s.trailer.Trailer.Get("Grpc-Message"))
+		}
+	}
+	return n, err
+}
+
+// next reads one X509SVIDResponse from body and makes its SVID current.
+func (s *Source) next(body io.Reader) error {
+	var hdr [5]byte
+	if _, err := io.ReadFull(body, hdr[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("workload API closed the stream")
+		}
+		return err
+	}
+	if hdr[0] != 0 {
+		return errors.New("workload API: compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(hdr[1:])
+	if size > maxMessage {
+		return fmt.Errorf("workload API: %d byte message too large", size)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return err
+	}
+	svid, err := parseResponse(msg)
+	if err != nil {
+		return fmt.Errorf("workload API: %w", err)
+	}
+	s.svid.Store(svid)
+	updates.Inc("success")
+	svidExpiry.Set(float64(svid.Certificate.Leaf.NotAfter.Unix()))
+	slog.Info("X.509 SVID updated", "spiffe_id", svid.ID, "expires", svid.Certificate.Leaf.NotAfter)
+	return nil
+}
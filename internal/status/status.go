@@ -0,0 +1,191 @@
+// Package status tells a device, or the installer app standing next to
+// it, whether it is onboarded and, if not, what failed, on the proxy's own
+// listeners. Answers come from the live TO2 sessions in the session store
+// and the outcome of each device's last TO2, and are given only to a
+// caller presenting the NonceTO2ProveOV the device sent in TO2.HelloDevice
+// for that session: a random value only the device, and whoever it shares
+// it with, knows.
+package status
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/metrics"
+	"github.com/fdo-server-wrapper/internal/ratelimit"
+	"github.com/fdo-server-wrapper/internal/session"
+)
+
+// States a device can be in.
+const (
+	// InProgress is a TO2 session the device has not finished.
+	InProgress = "in_progress"
+	// Onboarded is a device whose last TO2 completed.
+	Onboarded = "onboarded"
+	// Failed is a device whose last TO2 failed.
+	Failed = "failed"
+)
+
+// maxHeld bounds the devices whose last outcome is remembered.
+const maxHeld = 100000
+
+var requests = metrics.Default.NewCounterVec(
+	"fdo_proxy_device_status_requests_total",
+	"Device onboarding status requests by outcome (found, not_found, invalid, limited).",
+	"outcome")
+
+// Failure is what stopped a failed TO2, without the backend's own words.
+type Failure struct {
+	// Kind classifies the failure (see ledger.Failure*).
+	Kind string `json:"kind"`
+	// Stage is the FDO message type the session stopped at, if known.
+	Stage int `json:"stage,omitempty"`
+	// ErrorCode is the FDO ErrorMessage code, if any.
+	ErrorCode uint64 `json:"error_code,omitempty"`
+}
+
+// Status is the answer to a status request.
+type Status struct {
+	GUID      string    `json:"guid"`
+	State     string    `json:"state"`
+	StartedAt time.Time `json:"started_at"`
+	// UpdatedAt is the last message of a session in progress, or when a
+	// finished one ended.
+	UpdatedAt time.Time `json:"updated_at"`
+	Failure   *Failure  `json:"failure,omitempty"`
+}
+
+// outcome is the end of a device's last TO2.
+type outcome struct {
+	nonce  string
+	status Status
+}
+
+// Tracker answers status requests. It implements events.Sink, learning
+// the outcome of each TO2 from the commissioned and failed events.
+type Tracker struct {
+	sessions *session.Store
+
+	mu    sync.Mutex
+	last  map[string]*outcome
+	order []string
+}
+
+// New returns a Tracker reading live sessions from sessions.
+func New(sessions *session.Store) *Tracker {
+	return &Tracker{sessions: sessions, last: make(map[string]*outcome)}
+}
+
+// Name implements events.Sink.
+func (t *Tracker) Name() string { return "status" }
+
+// Publish implements events.Sink.
+func (t *Tracker) Publish(_ context.Context, ev *events.Event) error {
+	if ev.Session == nil || ev.Session.Protocol != "to2" || ev.Session.HelloNonce == "" {
+		return nil
+	}
+	o := &outcome{
+		nonce: ev.Session.HelloNonce,
+		status: Status{
+			GUID:      ev.GUID,
+			StartedAt: ev.Session.StartedAt,
+			UpdatedAt: ev.Time,
+		},
+	}
+	switch ev.Type {
+	case events.Commissioned:
+		o.status.State = Onboarded
+	case events.Failed:
+		o.status.State = Failed
+		o.status.Failure = &Failure{Kind: ev.FailureKind, Stage: ev.Stage, ErrorCode: ev.ErrorCode}
+	default:
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.last[ev.GUID]; !ok {
+		if len(t.order) >= maxHeld {
+			delete(t.last, t.order[0])
+			t.order = t.order[1:]
+		}
+		t.order = append(t.order, ev.GUID)
+	}
+	t.last[ev.GUID] = o
+	return nil
+}
+
+// Lookup returns the status of the device guid in the session nonce
+// belongs to, the hex NonceTO2ProveOV of its TO2.HelloDevice. It reports
+// false for a device it knows nothing of and for a nonce of another
+// session alike.
+func (t *Tracker) Lookup(guid, nonce string) (Status, bool) {
+	if s, ok := t.sessions.Latest(guid); ok && s.Protocol == "to2" && matches(s.HelloNonce, nonce) {
+		return Status{GUID: guid, State: InProgress, StartedAt: s.StartedAt, UpdatedAt: s.UpdatedAt}, true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if o, ok := t.last[guid]; ok && matches(o.nonce, nonce) {
+		return o.status, true
+	}
+	return Status{}, false
+}
+
+// matches compares nonces in constant time.
+func matches(want, got string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(strings.ToLower(want)), []byte(strings.ToLower(got))) == 1
+}
+
+// Handler serves GET /status/{guid}?nonce=<hex> on the device-facing
+// listener. The GUID is in UUID form or 32 hex digits. Unknown devices and
+// wrong nonces are both answered 404, and each client address may ask at
+// rate, taking tokens from l.
+func Handler(t *Tracker, l ratelimit.Limiter, rate ratelimit.Rate) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !l.Allow(r.Context(), "status:"+host(r.RemoteAddr), rate) {
+			requests.Inc("limited")
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		guid, err := fdo.ParseGUID(strings.TrimPrefix(r.URL.Path, "/status/"))
+		nonce := r.URL.Query().Get("nonce")
+		if err != nil || nonce == "" {
+			requests.Inc("invalid")
+			http.Error(w, "want /status/{guid}?nonce=<NonceTO2ProveOV in hex>", http.StatusBadRequest)
+			return
+		}
+		st, ok := t.Lookup(guid.String(), nonce)
+		if !ok {
+			requests.Inc("not_found")
+			slog.Debug("Device status not found", "guid", guid.String(), "remote_addr", r.RemoteAddr)
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		requests.Inc("found")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(st)
+	})
+}
+
+// host strips the port from addr, if it has one.
+func host(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return addr
+}
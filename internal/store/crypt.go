@@ -0,0 +1,23 @@
+package store
+
+import "github.com/fdo-server-wrapper/internal/linecrypt"
+
+// KeyWrapper protects the store's data encryption key (DEK) with a key
+// encryption key held elsewhere: a local key file, or a KMS behind the same
+// interface.
+type KeyWrapper = linecrypt.KeyWrapper
+
+// NewLocalKeyWrapper creates a KeyWrapper from a 32-byte key.
+func NewLocalKeyWrapper(kek []byte) (KeyWrapper, error) {
+	return linecrypt.NewLocalKeyWrapper(kek)
+}
+
+// LoadKeyFile reads a 32-byte key stored as hex, base64 or raw bytes.
+func LoadKeyFile(path string) ([]byte, error) {
+	return linecrypt.LoadKeyFile(path)
+}
+
+// ParseKey decodes a 32-byte key given as hex, base64 or raw bytes.
+func ParseKey(b []byte) ([]byte, error) {
+	return linecrypt.ParseKey(b)
+}
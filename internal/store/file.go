@@ -0,0 +1,295 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/linecrypt"
+)
+
+// FileStore keeps records in memory and appends them to a JSON Lines file,
+// one record per line. It suits a single gateway's onboarding volume
+// without needing a database. With a KeyWrapper the file is encrypted:
+// its first line carries the wrapped data key and every record line is
+// sealed with it.
+type FileStore struct {
+	path string
+	kw   KeyWrapper
+	c    *linecrypt.Cipher // nil for a plaintext store
+
+	mu      sync.RWMutex
+	f       *os.File
+	records []*Record // sorted by CompletedAt
+}
+
+// OpenFile opens (or creates) the store at path and loads existing records.
+// If kw is non-nil the store is encrypted at rest; an existing plaintext
+// store is encrypted in place. A nil kw opens a plaintext store and fails
+// on an encrypted one.
+func OpenFile(path string, kw KeyWrapper) (*FileStore, error) {
+	s := &FileStore{path: path, kw: kw}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if kw != nil && s.c == nil {
+		c, err := linecrypt.New(kw)
+		if err != nil {
+			return nil, err
+		}
+		s.c = c
+		if len(s.records) > 0 {
+			slog.Info("Encrypting plaintext store", "path", path, "records", len(s.records))
+		}
+		if err := s.rewriteLocked(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open store: %w", err)
+	}
+	s.f = f
+	return s, nil
+}
+
+func (s *FileStore) load() error {
+	f, err := os.Open(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open store: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	line := 0
+	for sc.Scan() {
+		line++
+		b := sc.Bytes()
+		if len(b) == 0 {
+			continue
+		}
+		if len(s.records) == 0 && s.c == nil {
+			c, ok, err := linecrypt.ParseHeader(b, s.kw)
+			if err != nil {
+				return fmt.Errorf("open store %s: %w", s.path, err)
+			}
+			if ok {
+				s.c = c
+				continue
+			}
+		}
+		if s.c != nil {
+			if b, err = s.c.Open(b); err != nil {
+				slog.Warn("Skipping undecryptable store record", "path", s.path, "line", line, "error", err)
+				continue
+			}
+		}
+		var r Record
+		if err := json.Unmarshal(b, &r); err != nil {
+			// A torn final write shouldn't make the whole history unreadable
+			slog.Warn("Skipping unreadable store record", "path", s.path, "line", line, "error", err)
+			continue
+		}
+		s.records = append(s.records, &r)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("read store: %w", err)
+	}
+	sort.SliceStable(s.records, func(i, j int) bool {
+		return s.records[i].CompletedAt.Before(s.records[j].CompletedAt)
+	})
+	return nil
+}
+
+// Add implements Store.
+func (s *FileStore) Add(ctx context.Context, r *Record) error {
+	if r.ID == "" {
+		r.ID = newID()
+	}
+	line, err := s.encode(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("append record: %w", err)
+	}
+
+	c := *r
+	i := sort.Search(len(s.records), func(i int) bool {
+		return s.records[i].CompletedAt.After(c.CompletedAt)
+	})
+	s.records = append(s.records, nil)
+	copy(s.records[i+1:], s.records[i:])
+	s.records[i] = &c
+	return nil
+}
+
+// Each implements Store.
+func (s *FileStore) Each(ctx context.Context, q Query, fn func(*Record) error) error {
+	s.mu.RLock()
+	matched := make([]*Record, 0, len(s.records))
+	for _, r := range s.records {
+		if q.Match(r) {
+			c := *r
+			matched = append(matched, &c)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, r := range matched {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune implements Store. The file is rewritten when anything changed.
+func (s *FileStore) Prune(ctx context.Context, detailsBefore, recordsBefore time.Time) (PruneResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var res PruneResult
+	kept := s.records[:0]
+	for _, r := range s.records {
+		if !recordsBefore.IsZero() && r.CompletedAt.Before(recordsBefore) {
+			res.Deleted++
+			continue
+		}
+		if !detailsBefore.IsZero() && r.CompletedAt.Before(detailsBefore) && stripDetails(r) {
+			res.Stripped++
+		}
+		kept = append(kept, r)
+	}
+	for i := len(kept); i < len(s.records); i++ {
+		s.records[i] = nil
+	}
+	s.records = kept
+
+	if res.Stripped == 0 && res.Deleted == 0 {
+		return res, nil
+	}
+	return res, s.rewriteLocked()
+}
+
+// Erase implements Store. The file is rewritten so no scrubbed data
+// remains on disk.
+func (s *FileStore) Erase(ctx context.Context, guid string, at time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, r := range s.records {
+		if r.GUID == guid {
+			eraseRecord(r, at)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.rewriteLocked()
+}
+
+// rewriteLocked atomically replaces the file with the in-memory records and
+// reopens it for appending. The caller must hold s.mu.
+func (s *FileStore) rewriteLocked() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("rewrite store: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	if s.c != nil {
+		w.Write(s.c.Header())
+		w.WriteByte('\n')
+	}
+	for _, r := range s.records {
+		line, err := s.encode(r)
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("rewrite store: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("rewrite store: %w", err)
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("replace store: %w", err)
+	}
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("reopen store: %w", err)
+	}
+	return nil
+}
+
+// encode renders r as one store line, sealed if the store is encrypted.
+func (s *FileStore) encode(r *Record) ([]byte, error) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("encode record: %w", err)
+	}
+	if s.c == nil {
+		return line, nil
+	}
+	sealed, err := s.c.Seal(line)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt record: %w", err)
+	}
+	return sealed, nil
+}
+
+// Close implements Store.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+func newID() string {
+	var b [12]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
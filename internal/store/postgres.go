@@ -0,0 +1,320 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/linecrypt"
+	"github.com/fdo-server-wrapper/internal/pg"
+)
+
+// pgBatch is how many records a PostgresStore reads per query.
+const pgBatch = 500
+
+// PostgresStore keeps records in a PostgreSQL table, so several proxies
+// behind a load balancer share one onboarding history and it is backed up
+// and replicated with the rest of the database. Records are stored as the
+// same JSON, or sealed lines with a KeyWrapper, as a FileStore's; the
+// wrapped data key is kept in a second table. An encrypted store does not
+// keep GUIDs in the clear, so Erase and GUID queries read every record.
+type PostgresStore struct {
+	db *pg.DB
+	c  *linecrypt.Cipher // nil for a plaintext store
+}
+
+// OpenPostgres opens the store in db, whose schema the caller has migrated
+// (see package schema). kw works as for OpenFile: an existing plaintext
+// store is encrypted in place, and a nil kw fails on an encrypted store.
+// The caller closes db.
+func OpenPostgres(ctx context.Context, db *pg.DB, kw KeyWrapper) (*PostgresStore, error) {
+	s := &PostgresStore{db: db}
+	header, err := s.header(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("open store: %w", err)
+	}
+	if header == nil && kw != nil {
+		return s, s.encrypt(ctx, kw)
+	}
+	if header != nil {
+		if s.c, _, err = linecrypt.ParseHeader(header, kw); err != nil {
+			return nil, fmt.Errorf("open store %s: %w", db, err)
+		}
+	}
+	return s, nil
+}
+
+// querier is a DB or a transaction.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (*pg.Result, error)
+}
+
+// header returns the encrypted store header, nil for a plaintext store.
+func (s *PostgresStore) header(ctx context.Context, q querier) ([]byte, error) {
+	res, err := q.Query(ctx, `SELECT value FROM fdo_proxy_store_meta WHERE name = 'header'`)
+	if err != nil || len(res.Rows) == 0 {
+		return nil, err
+	}
+	return []byte(*res.Rows[0][0]), nil
+}
+
+// encrypt seals every record with a new data key wrapped by kw and stores
+// its header, in one transaction so a store is never half encrypted.
+func (s *PostgresStore) encrypt(ctx context.Context, kw KeyWrapper) error {
+	n := 0
+	err := s.db.Tx(ctx, func(tx *pg.Tx) error {
+		// A proxy starting at the same time waits here, then finds the
+		// store encrypted by the first
+		if _, err := tx.Exec(ctx, `LOCK TABLE fdo_proxy_store_meta`); err != nil {
+			return err
+		}
+		header, err := s.header(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if header != nil {
+			s.c, _, err = linecrypt.ParseHeader(header, kw)
+			return err
+		}
+		c, err := linecrypt.New(kw)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Query(ctx, `SELECT seq, record FROM fdo_proxy_records`)
+		if err != nil {
+			return err
+		}
+		for _, row := range res.Rows {
+			sealed, err := c.Seal([]byte(*row[1]))
+			if err != nil {
+				return fmt.Errorf("encrypt record: %w", err)
+			}
+			if _, err := tx.Exec(ctx, `UPDATE fdo_proxy_records SET record = $1, guid = NULL WHERE seq = $2`, string(sealed), *row[0]); err != nil {
+				return err
+			}
+			n++
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO fdo_proxy_store_meta (name, value) VALUES ('header', $1)`, string(c.Header())); err != nil {
+			return err
+		}
+		s.c = c
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("encrypt store: %w", err)
+	}
+	if n > 0 {
+		slog.Info("Encrypted plaintext store", "database", s.db.String(), "records", n)
+	}
+	return nil
+}
+
+// Add implements Store.
+func (s *PostgresStore) Add(ctx context.Context, r *Record) error {
+	if r.ID == "" {
+		r.ID = newID()
+	}
+	line, err := s.encode(r)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(ctx, `INSERT INTO fdo_proxy_records (id, guid, completed_at, record) VALUES ($1, $2, $3, $4)`,
+		r.ID, s.guidColumn(r.GUID), r.CompletedAt, string(line))
+	if err != nil {
+		return fmt.Errorf("insert record: %w", err)
+	}
+	return nil
+}
+
+// Each implements Store. Records are read in batches, so fn sees those
+// added while it runs if they sort after the current one.
+func (s *PostgresStore) Each(ctx context.Context, q Query, fn func(*Record) error) error {
+	// The database keeps microseconds; the bounds are widened by one and
+	// applied exactly by q.Match
+	from, to := time.Unix(0, 0), time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	if !q.From.IsZero() {
+		from = q.From.Add(-time.Microsecond)
+	}
+	if !q.To.IsZero() {
+		to = q.To.Add(time.Microsecond)
+	}
+	var guid any
+	if q.GUID != "" && s.c == nil {
+		guid = q.GUID
+	}
+
+	var afterTime, afterSeq any
+	for {
+		res, err := s.db.Query(ctx, `SELECT seq, completed_at, record FROM fdo_proxy_records
+			WHERE completed_at >= $1 AND completed_at < $2
+			AND ($3::text IS NULL OR guid = $3)
+			AND ($4::timestamptz IS NULL OR (completed_at, seq) > ($4, $5::bigint))
+			ORDER BY completed_at, seq LIMIT `+fmt.Sprint(pgBatch),
+			from, to, guid, afterTime, afterSeq)
+		if err != nil {
+			return fmt.Errorf("read store: %w", err)
+		}
+		for _, row := range res.Rows {
+			afterSeq, afterTime = *row[0], *row[1]
+			r, ok := s.decode(*row[2], *row[0])
+			if !ok || !q.Match(r) {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		if len(res.Rows) < pgBatch {
+			return nil
+		}
+	}
+}
+
+// Prune implements Store. Each batch of stripped records is updated in
+// its own transaction.
+func (s *PostgresStore) Prune(ctx context.Context, detailsBefore, recordsBefore time.Time) (PruneResult, error) {
+	var res PruneResult
+	if !recordsBefore.IsZero() {
+		n, err := s.db.Exec(ctx, `DELETE FROM fdo_proxy_records WHERE completed_at < $1`, recordsBefore)
+		if err != nil {
+			return res, fmt.Errorf("prune store: %w", err)
+		}
+		res.Deleted = int(n)
+	}
+	if detailsBefore.IsZero() {
+		return res, nil
+	}
+	for {
+		done := false
+		err := s.db.Tx(ctx, func(tx *pg.Tx) error {
+			rows, err := tx.Query(ctx, `SELECT seq, record FROM fdo_proxy_records
+				WHERE NOT stripped AND completed_at < $1
+				ORDER BY seq LIMIT `+fmt.Sprint(pgBatch)+` FOR UPDATE SKIP LOCKED`, detailsBefore)
+			if err != nil {
+				return err
+			}
+			done = len(rows.Rows) < pgBatch
+			for _, row := range rows.Rows {
+				r, ok := s.decode(*row[1], *row[0])
+				var line []byte
+				if ok && stripDetails(r) {
+					if line, err = s.encode(r); err != nil {
+						return err
+					}
+					res.Stripped++
+				}
+				// Unchanged and unreadable records are only marked, so they
+				// are not read again
+				if _, err := tx.Exec(ctx, `UPDATE fdo_proxy_records SET stripped = true, record = coalesce($1, record) WHERE seq = $2`,
+					nullString(line), *row[0]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return res, fmt.Errorf("prune store: %w", err)
+		}
+		if done {
+			return res, nil
+		}
+	}
+}
+
+// Erase implements Store.
+func (s *PostgresStore) Erase(ctx context.Context, guid string, at time.Time) (int, error) {
+	n := 0
+	err := s.db.Tx(ctx, func(tx *pg.Tx) error {
+		var rows *pg.Result
+		var err error
+		if s.c == nil {
+			rows, err = tx.Query(ctx, `SELECT seq, record FROM fdo_proxy_records WHERE guid = $1 FOR UPDATE`, guid)
+		} else {
+			rows, err = tx.Query(ctx, `SELECT seq, record FROM fdo_proxy_records FOR UPDATE`)
+		}
+		if err != nil {
+			return err
+		}
+		for _, row := range rows.Rows {
+			r, ok := s.decode(*row[1], *row[0])
+			if !ok || r.GUID != guid {
+				continue
+			}
+			eraseRecord(r, at)
+			line, err := s.encode(r)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, `UPDATE fdo_proxy_records SET stripped = true, record = $1 WHERE seq = $2`, string(line), *row[0]); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("erase records: %w", err)
+	}
+	return n, nil
+}
+
+// Close implements Store. The database is left open for its other users.
+func (s *PostgresStore) Close() error {
+	return nil
+}
+
+// guidColumn is the value of the guid column, NULL in an encrypted store.
+func (s *PostgresStore) guidColumn(guid string) any {
+	if s.c != nil {
+		return nil
+	}
+	return guid
+}
+
+// encode renders r as it is stored, sealed if the store is encrypted.
+func (s *PostgresStore) encode(r *Record) ([]byte, error) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("encode record: %w", err)
+	}
+	if s.c == nil {
+		return line, nil
+	}
+	sealed, err := s.c.Seal(line)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt record: %w", err)
+	}
+	return sealed, nil
+}
+
+// decode parses a stored record, logging and skipping one that cannot be
+// read, as FileStore does.
+func (s *PostgresStore) decode(stored, seq string) (*Record, bool) {
+	b := []byte(stored)
+	if s.c != nil {
+		var err error
+		if b, err = s.c.Open(b); err != nil {
+			slog.Warn("Skipping undecryptable store record", "database", s.db.String(), "seq", seq, "error", err)
+			return nil, false
+		}
+	}
+	var r Record
+	if err := json.Unmarshal(b, &r); err != nil {
+		slog.Warn("Skipping unreadable store record", "database", s.db.String(), "seq", seq, "error", err)
+		return nil, false
+	}
+	return &r, true
+}
+
+// nullString is b as a query argument, NULL if b is nil.
+func nullString(b []byte) any {
+	if b == nil {
+		return nil
+	}
+	return string(b)
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+var prunedTotal = metrics.Default.NewCounterVec(
+	"fdo_proxy_store_pruned_total",
+	"Local store records pruned by retention, by kind (details, records).",
+	"kind")
+
+// Retention says how long each tier of the history is kept. Zero keeps it
+// forever.
+type Retention struct {
+	// Details is how long per-session detail (evidence, source address,
+	// serial) is kept.
+	Details time.Duration
+	// Records is how long record summaries are kept.
+	Records time.Duration
+}
+
+// Enabled reports whether any pruning is configured.
+func (p Retention) Enabled() bool {
+	return p.Details > 0 || p.Records > 0
+}
+
+// PruneOnce applies p to st as of now.
+func PruneOnce(ctx context.Context, st Store, p Retention, now time.Time) (PruneResult, error) {
+	var detailsBefore, recordsBefore time.Time
+	if p.Details > 0 {
+		detailsBefore = now.Add(-p.Details)
+	}
+	if p.Records > 0 {
+		recordsBefore = now.Add(-p.Records)
+	}
+	res, err := st.Prune(ctx, detailsBefore, recordsBefore)
+	prunedTotal.Add(float64(res.Stripped), "details")
+	prunedTotal.Add(float64(res.Deleted), "records")
+	return res, err
+}
+
+// Pruner returns the scheduler's prune job, applying p to st as of each
+// run.
+func Pruner(st Store, p Retention) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		res, err := PruneOnce(ctx, st, p, time.Now())
+		if err != nil {
+			return err
+		}
+		if res.Stripped > 0 || res.Deleted > 0 {
+			slog.Info("Pruned local store", "details_stripped", res.Stripped, "records_deleted", res.Deleted)
+		}
+		return nil
+	}
+}
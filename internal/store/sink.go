@@ -0,0 +1,88 @@
+package store
+
+import (
+	"context"
+
+	"github.com/fdo-server-wrapper/internal/events"
+)
+
+// Recorder writes onboarding outcomes published on the event bus to a Store.
+// It implements events.Sink.
+type Recorder struct {
+	store Store
+	onAdd []func(context.Context, *Record)
+}
+
+// NewRecorder creates a sink that records events into st.
+func NewRecorder(st Store) *Recorder {
+	return &Recorder{store: st}
+}
+
+// OnAdd calls fn with every record after it has been stored, so policies
+// such as quarantine can act on the updated history.
+func (r *Recorder) OnAdd(fn func(context.Context, *Record)) {
+	r.onAdd = append(r.onAdd, fn)
+}
+
+// Name implements events.Sink.
+func (r *Recorder) Name() string { return "store" }
+
+// Publish implements events.Sink.
+func (r *Recorder) Publish(ctx context.Context, ev *events.Event) error {
+	rec := &Record{
+		GUID:        ev.GUID,
+		OwnerID:     ev.OwnerID,
+		CompletedAt: ev.Time,
+		StartedAt:   ev.Time,
+		RequestID:   ev.RequestID,
+		Tags:        ev.Tags,
+	}
+	switch ev.Type {
+	case events.Commissioned:
+		rec.Outcome = OutcomeSucceeded
+		switch {
+		case !ev.PassportSent:
+			rec.PassportStatus = PassportNotConfigured
+		case ev.PassportErr != nil:
+			rec.PassportStatus = PassportFailed
+			rec.PassportError = ev.PassportErr.Error()
+		default:
+			rec.PassportStatus = PassportCreated
+		}
+		if ev.Passport != nil {
+			rec.Evidence = ev.Passport.Evidence
+		}
+	case events.Failed:
+		if ev.GUID == "" {
+			// History is per device; failures before a GUID exists (DI
+			// rejections, missing product passports) have nothing to key on
+			return nil
+		}
+		rec.Outcome = OutcomeFailed
+		rec.Failure = ev.Reason
+		rec.Protocol = ev.Protocol
+	default:
+		return nil
+	}
+
+	if ev.Location != nil {
+		rec.Country = ev.Location.Country
+	}
+	if s := ev.Session; s != nil {
+		rec.Protocol = s.Protocol
+		rec.StartedAt = s.StartedAt
+		rec.RemoteAddr = s.RemoteAddr
+		rec.Serial = s.Serial
+		rec.Policy = s.Policy
+		if s.Attestation != nil {
+			rec.AttestationResult = s.Attestation.Verification
+		}
+	}
+	if err := r.store.Add(ctx, rec); err != nil {
+		return err
+	}
+	for _, fn := range r.onAdd {
+		fn(ctx, rec)
+	}
+	return nil
+}
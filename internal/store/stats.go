@@ -0,0 +1,80 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// DeviceStats summarizes the onboarding attempts recorded for one device.
+type DeviceStats struct {
+	GUID   string `json:"guid"`
+	Serial string `json:"serial,omitempty"`
+	// Tags are the tags recorded with the device's latest tagged attempt.
+	Tags []string `json:"tags,omitempty"`
+
+	Attempts int `json:"attempts"`
+	Failures int `json:"failures"`
+	// ConsecutiveFailures counts failures since the last success.
+	ConsecutiveFailures int `json:"consecutive_failures"`
+
+	LastAttempt time.Time  `json:"last_attempt"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	// LastReason is the cause of the most recent failure.
+	LastReason string `json:"last_reason,omitempty"`
+}
+
+// Stats computes per-device statistics over the records matching q, sorted
+// by GUID.
+func Stats(ctx context.Context, st Store, q Query) ([]*DeviceStats, error) {
+	byGUID := make(map[string]*DeviceStats)
+	err := st.Each(ctx, q, func(r *Record) error {
+		d := byGUID[r.GUID]
+		if d == nil {
+			d = &DeviceStats{GUID: r.GUID}
+			byGUID[r.GUID] = d
+		}
+		if r.Serial != "" {
+			d.Serial = r.Serial
+		}
+		if len(r.Tags) > 0 {
+			d.Tags = r.Tags
+		}
+		d.Attempts++
+		d.LastAttempt = r.CompletedAt
+		t := r.CompletedAt
+		if r.Outcome == OutcomeFailed {
+			d.Failures++
+			d.ConsecutiveFailures++
+			d.LastFailure = &t
+			d.LastReason = r.Failure
+		} else {
+			d.ConsecutiveFailures = 0
+			d.LastSuccess = &t
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*DeviceStats, 0, len(byGUID))
+	for _, d := range byGUID {
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].GUID < out[j].GUID })
+	return out, nil
+}
+
+// DeviceStatsFor returns the statistics for guid, or ErrNotFound if it has
+// no records.
+func DeviceStatsFor(ctx context.Context, st Store, guid string) (*DeviceStats, error) {
+	stats, err := Stats(ctx, st, Query{GUID: guid})
+	if err != nil {
+		return nil, err
+	}
+	if len(stats) == 0 {
+		return nil, ErrNotFound
+	}
+	return stats[0], nil
+}
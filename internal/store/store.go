@@ -0,0 +1,149 @@
+// Package store persists onboarding history on the proxy host so it can be
+// reported on, exported and pruned independently of the passport service.
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/ledger"
+)
+
+// Onboarding outcomes.
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+)
+
+// Passport creation statuses.
+const (
+	PassportCreated       = "created"
+	PassportFailed        = "failed"
+	PassportNotConfigured = "not_configured"
+)
+
+// ErrNotFound is returned when a record does not exist.
+var ErrNotFound = errors.New("store: not found")
+
+// Record is one completed or failed onboarding attempt.
+type Record struct {
+	ID          string    `json:"id"`
+	GUID        string    `json:"guid"`
+	Protocol    string    `json:"protocol"`
+	Outcome     string    `json:"outcome"`
+	OwnerID     string    `json:"owner_id,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at"`
+	RequestID   string    `json:"request_id,omitempty"`
+
+	// RemoteAddr is the device's source address.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Serial is the device serial number, when known.
+	Serial string `json:"serial,omitempty"`
+	// Country is where RemoteAddr is located, when known.
+	Country string `json:"country,omitempty"`
+	// Tags are the device's tags at the time of the attempt.
+	Tags []string `json:"tags,omitempty"`
+	// Policy names the policy the tags selected, if any.
+	Policy string `json:"policy,omitempty"`
+
+	PassportStatus string `json:"passport_status,omitempty"`
+	PassportError  string `json:"passport_error,omitempty"`
+	// AttestationResult is the external verifier's result, if configured.
+	AttestationResult string `json:"attestation_result,omitempty"`
+	// Failure describes why a failed attempt did not complete.
+	Failure string `json:"failure,omitempty"`
+
+	Evidence *ledger.OnboardingEvidence `json:"evidence,omitempty"`
+
+	// ErasedAt is set when the device's data was scrubbed on request. The
+	// record remains as a tombstone.
+	ErasedAt *time.Time `json:"erased_at,omitempty"`
+}
+
+// Query selects records. Zero fields match everything; From is inclusive
+// and To exclusive, both applied to CompletedAt.
+type Query struct {
+	From   time.Time
+	To     time.Time
+	GUID   string
+	Serial string
+	Tag    string
+}
+
+// Match reports whether r satisfies q.
+func (q Query) Match(r *Record) bool {
+	if !q.From.IsZero() && r.CompletedAt.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !r.CompletedAt.Before(q.To) {
+		return false
+	}
+	if q.Serial != "" && r.Serial != q.Serial {
+		return false
+	}
+	if q.Tag != "" && !slices.Contains(r.Tags, q.Tag) {
+		return false
+	}
+	return q.GUID == "" || r.GUID == q.GUID
+}
+
+// Store is the persistent onboarding history.
+type Store interface {
+	// Add stores r, assigning an ID if it has none.
+	Add(ctx context.Context, r *Record) error
+	// Each calls fn for every record matching q in CompletedAt order,
+	// stopping at the first error fn returns.
+	Each(ctx context.Context, q Query, fn func(*Record) error) error
+	// Prune applies retention: records completed before detailsBefore lose
+	// their detail (evidence, source address and country, serial), and records completed
+	// before recordsBefore are deleted. Zero times skip that step.
+	Prune(ctx context.Context, detailsBefore, recordsBefore time.Time) (PruneResult, error)
+	// Erase scrubs the detail of every record for guid, marking each as a
+	// tombstone, and returns how many records were affected.
+	Erase(ctx context.Context, guid string, at time.Time) (int, error)
+	// Close flushes and releases the store.
+	Close() error
+}
+
+// PruneResult counts what a Prune removed.
+type PruneResult struct {
+	Stripped int
+	Deleted  int
+}
+
+// eraseRecord scrubs everything in r that could identify the device beyond
+// its GUID and marks it erased.
+func eraseRecord(r *Record, at time.Time) {
+	stripDetails(r)
+	r.RequestID = ""
+	r.PassportError = ""
+	r.Failure = ""
+	t := at.UTC()
+	r.ErasedAt = &t
+}
+
+// stripDetails removes the per-session detail from r, keeping the summary.
+// It reports whether anything was removed.
+func stripDetails(r *Record) bool {
+	if r.Evidence == nil && r.RemoteAddr == "" && r.Serial == "" && r.Country == "" {
+		return false
+	}
+	r.Evidence = nil
+	r.RemoteAddr = ""
+	r.Serial = ""
+	r.Country = ""
+	return true
+}
+
+// List collects the records matching q.
+func List(ctx context.Context, st Store, q Query) ([]*Record, error) {
+	var out []*Record
+	err := st.Each(ctx, q, func(r *Record) error {
+		out = append(out, r)
+		return nil
+	})
+	return out, err
+}
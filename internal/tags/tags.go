@@ -0,0 +1,228 @@
+// Package tags groups devices into batches, SKUs or any other set an
+// operator cares about. Tags come from rules matching serial number
+// prefixes and product IDs, from the product item passport, and from
+// assignments made through the admin API, which are kept in a JSON file.
+package tags
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MaxLen is the longest tag accepted.
+const MaxLen = 64
+
+// Valid reports whether t can be used as a tag: 1 to MaxLen letters,
+// digits, '.', '_', ':' or '-'. Tags become metric label values, so they
+// are kept short and plain.
+func Valid(t string) bool {
+	if t == "" || len(t) > MaxLen {
+		return false
+	}
+	for _, c := range t {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == ':', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Merge returns the distinct valid tags of sets, sorted. It returns nil
+// when there are none.
+func Merge(sets ...[]string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, set := range sets {
+		for _, t := range set {
+			if Valid(t) && !seen[t] {
+				seen[t] = true
+				out = append(out, t)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Rules tag devices by serial number prefix and by product ID.
+type Rules struct {
+	SerialPrefixes map[string][]string `json:"serial_prefixes"`
+	Products       map[string][]string `json:"products"`
+}
+
+// LoadRules reads a rules file of the form
+//
+//	{"serial_prefixes": {"SN-24": ["batch-24"]}, "products": {"product-uuid": ["sku-a"]}}
+//
+// Both sections are optional. Every tag must be Valid.
+func LoadRules(path string) (*Rules, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read tag rules: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var r Rules
+	if err := dec.Decode(&r); err != nil {
+		return nil, fmt.Errorf("parse tag rules: %w", err)
+	}
+	for _, section := range []map[string][]string{r.SerialPrefixes, r.Products} {
+		for key, set := range section {
+			for _, t := range set {
+				if !Valid(t) {
+					return nil, fmt.Errorf("parse tag rules: invalid tag %q for %q", t, key)
+				}
+			}
+		}
+	}
+	return &r, nil
+}
+
+// Len returns the number of rules in r.
+func (r *Rules) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.SerialPrefixes) + len(r.Products)
+}
+
+// match returns the tags of every rule matching serial or productID.
+func (r *Rules) match(serial, productID string) []string {
+	if r == nil {
+		return nil
+	}
+	var out []string
+	if serial != "" {
+		for prefix, set := range r.SerialPrefixes {
+			if strings.HasPrefix(serial, prefix) {
+				out = append(out, set...)
+			}
+		}
+	}
+	if productID != "" {
+		out = append(out, r.Products[productID]...)
+	}
+	return out
+}
+
+// Tagger resolves the tags of a device and keeps the tags operators
+// assigned by hand, optionally persisted to a JSON file so they survive
+// restarts. A nil *Tagger tags nothing.
+type Tagger struct {
+	rules *Rules
+	path  string
+
+	mu       sync.RWMutex
+	assigned map[string][]string
+}
+
+// Open creates a tagger applying rules, which may be nil, and loads the
+// assigned tags from path, which need not exist yet. An empty path keeps
+// assignments in memory only.
+func Open(path string, rules *Rules) (*Tagger, error) {
+	t := &Tagger{rules: rules, path: path, assigned: make(map[string][]string)}
+	if path == "" {
+		return t, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read device tags: %w", err)
+	}
+	if err := json.Unmarshal(b, &t.assigned); err != nil {
+		return nil, fmt.Errorf("parse device tags: %w", err)
+	}
+	return t, nil
+}
+
+// For returns the tags of a device: those assigned to guid, those of the
+// rules matching serial or productID, and passport, the tags its product
+// item passport lists. Empty keys never match.
+func (t *Tagger) For(guid, serial, productID string, passport []string) []string {
+	if t == nil {
+		return Merge(passport)
+	}
+	return Merge(t.Assigned(guid), t.rules.match(serial, productID), passport)
+}
+
+// Assigned returns the tags assigned to guid by hand.
+func (t *Tagger) Assigned(guid string) []string {
+	if t == nil || guid == "" {
+		return nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]string(nil), t.assigned[guid]...)
+}
+
+// All returns every assignment by GUID.
+func (t *Tagger) All() map[string][]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	out := make(map[string][]string, len(t.assigned))
+	for guid, set := range t.assigned {
+		out[guid] = append([]string(nil), set...)
+	}
+	return out
+}
+
+// Assign replaces the tags assigned to guid with set, which must only hold
+// Valid tags. An empty set removes the assignment.
+func (t *Tagger) Assign(guid string, set []string) error {
+	for _, tag := range set {
+		if !Valid(tag) {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if set = Merge(set); len(set) == 0 {
+		delete(t.assigned, guid)
+	} else {
+		t.assigned[guid] = set
+	}
+	return t.saveLocked()
+}
+
+// Unassign removes the tags assigned to guid. It reports false if there
+// were none.
+func (t *Tagger) Unassign(guid string) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.assigned[guid]; !ok {
+		return false, nil
+	}
+	delete(t.assigned, guid)
+	return true, t.saveLocked()
+}
+
+// saveLocked atomically rewrites the file. The caller must hold t.mu.
+func (t *Tagger) saveLocked() error {
+	if t.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(t.assigned, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("write device tags: %w", err)
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		return fmt.Errorf("replace device tags: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+// Package to0 has the owner backend register devices at the rendezvous
+// server (TO0) as soon as they complete DI, so they can be resolved by TO1
+// without a manual step.
+package to0
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/correlation"
+	"github.com/fdo-server-wrapper/internal/events"
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+var triggers = metrics.Default.NewCounterVec(
+	"fdo_proxy_to0_triggers_total",
+	"TO0 registrations requested from the owner backend by outcome (registered, failed).",
+	"outcome")
+
+// retryDelay is the pause before the first retry; it doubles per attempt.
+const retryDelay = time.Second
+
+// Trigger asks the owner backend to run TO0 for every device completing
+// DI, then publishes an events.Registered event. It implements events.Sink.
+//
+// The owner is reached with a POST of {"guid": ...} to a URL in which
+// "{guid}" is replaced, and may answer {"wait_seconds": n}. The voucher may
+// reach the owner a little after DI ends, so 404, 409 and 5xx answers are
+// retried while the delivery lasts.
+type Trigger struct {
+	url     string
+	ownerID string
+	bus     *events.Bus
+	http    *http.Client
+	retries int
+}
+
+// NewTrigger creates a trigger posting to url and publishing the outcome on
+// bus. A non-positive timeout defaults to 10 seconds per attempt.
+func NewTrigger(url, ownerID string, bus *events.Bus, retries int, timeout time.Duration) *Trigger {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &Trigger{
+		url:     url,
+		ownerID: ownerID,
+		bus:     bus,
+		http:    &http.Client{Timeout: timeout},
+		retries: max(retries, 0),
+	}
+}
+
+// Name implements events.Sink.
+func (t *Trigger) Name() string { return "to0_trigger" }
+
+// Publish implements events.Sink.
+func (t *Trigger) Publish(ctx context.Context, ev *events.Event) error {
+	if ev.Type != events.Initialized || ev.GUID == "" {
+		return nil
+	}
+	_, err := t.Register(ctx, ev.GUID, ev.OwnerID, ev.ProductID, ev.RequestID)
+	return err
+}
+
+// Register asks the owner to run TO0 for guid now, as after DI, and
+// publishes the events.Registered event for ownerID, or the trigger's owner
+// if empty. It returns the wait seconds the owner reported.
+func (t *Trigger) Register(ctx context.Context, guid, ownerID, productID, requestID string) (int, error) {
+	wait, err := t.register(ctx, guid)
+	if err != nil {
+		triggers.Inc("failed")
+		return 0, fmt.Errorf("TO0 for %s: %w", guid, err)
+	}
+	triggers.Inc("registered")
+	slog.Info("Device registered at rendezvous", "guid", guid, "wait_seconds", wait)
+	if ownerID == "" {
+		ownerID = t.ownerID
+	}
+	t.bus.Publish(ctx, &events.Event{
+		Type:        events.Registered,
+		GUID:        guid,
+		OwnerID:     ownerID,
+		Time:        time.Now(),
+		RequestID:   requestID,
+		Protocol:    "to0",
+		ProductID:   productID,
+		WaitSeconds: wait,
+	})
+	return wait, nil
+}
+
+// errRetry marks an owner answer worth retrying.
+var errRetry = errors.New("retryable")
+
+// register asks the owner to run TO0 for guid, retrying per t.retries, and
+// returns the wait seconds it reported.
+func (t *Trigger) register(ctx context.Context, guid string) (int, error) {
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		wait, err := t.post(ctx, guid)
+		if err == nil || !errors.Is(err, errRetry) || attempt >= t.retries {
+			return wait, err
+		}
+		select {
+		case <-ctx.Done():
+			return 0, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (t *Trigger) post(ctx context.Context, guid string) (int, error) {
+	payload, err := json.Marshal(map[string]string{"guid": guid})
+	if err != nil {
+		return 0, fmt.Errorf("encode request: %w", err)
+	}
+	url := strings.ReplaceAll(t.url, "{guid}", guid)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	correlation.Inject(ctx, req.Header)
+
+	resp, err := t.http.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("owner request: %w: %w", errRetry, err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err := fmt.Errorf("owner status %d: %s", resp.StatusCode, string(b))
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusConflict || resp.StatusCode >= 500 {
+			err = fmt.Errorf("%w: %w", errRetry, err)
+		}
+		return 0, err
+	}
+
+	// The answer is optional; owners that send nothing still registered
+	var out struct {
+		WaitSeconds int `json:"wait_seconds"`
+	}
+	json.Unmarshal(b, &out)
+	return out.WaitSeconds, nil
+}
@@ -0,0 +1,110 @@
+// Package vc issues W3C Verifiable Credentials (VC-JWT) asserting that a
+// device was onboarded to an owner.
+package vc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Onboarding is the claim a credential asserts.
+type Onboarding struct {
+	GUID        string
+	OwnerID     string
+	OnboardedAt time.Time
+	// VoucherHash optionally binds the credential to the ownership voucher.
+	VoucherHash string
+}
+
+// Issuer signs onboarding credentials with a fixed key.
+type Issuer struct {
+	id     string
+	signer *Signer
+	outDir string
+}
+
+// NewIssuer loads a PEM private key (PKCS#8, SEC1 EC or PKCS#1 RSA) from
+// keyPath. id is the issuer identifier placed in "iss", typically a DID or
+// URL. kid, if non-empty, is set in the JWT header to help verifiers locate
+// the public key.
+func NewIssuer(id, kid, keyPath string) (*Issuer, error) {
+	if id == "" {
+		return nil, errors.New("issuer id is required")
+	}
+	signer, err := LoadSigner(keyPath, kid)
+	if err != nil {
+		return nil, err
+	}
+	return &Issuer{id: id, signer: signer}, nil
+}
+
+// StoreIn has Issue also write each credential to dir as <guid>.jwt.
+func (i *Issuer) StoreIn(dir string) error {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("create credential dir: %w", err)
+	}
+	i.outDir = dir
+	return nil
+}
+
+// Issue signs a credential for o and returns it in compact JWS form.
+func (i *Issuer) Issue(o *Onboarding) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("credential id: %w", err)
+	}
+	subject := "urn:uuid:" + o.GUID
+	at := o.OnboardedAt.UTC()
+
+	credentialSubject := map[string]any{
+		"id":          subject,
+		"owner":       o.OwnerID,
+		"onboardedAt": at.Format(time.RFC3339Nano),
+	}
+	if o.VoucherHash != "" {
+		credentialSubject["voucherHash"] = o.VoucherHash
+	}
+
+	claims := map[string]any{
+		"iss": i.id,
+		"sub": subject,
+		"jti": "urn:uuid:" + formatUUID(jti),
+		"iat": at.Unix(),
+		"nbf": at.Unix(),
+		"vc": map[string]any{
+			"@context":          []string{"https://www.w3.org/2018/credentials/v1"},
+			"type":              []string{"VerifiableCredential", "DeviceOnboardingCredential"},
+			"issuer":            i.id,
+			"issuanceDate":      at.Format(time.RFC3339),
+			"credentialSubject": credentialSubject,
+		},
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("encode claims: %w", err)
+	}
+	token, err := i.signer.Sign("JWT", payload)
+	if err != nil {
+		return "", err
+	}
+	if i.outDir != "" {
+		path := filepath.Join(i.outDir, o.GUID+".jwt")
+		if err := os.WriteFile(path, []byte(token), 0o640); err != nil {
+			return token, fmt.Errorf("store credential: %w", err)
+		}
+	}
+	return token, nil
+}
+
+func formatUUID(b []byte) string {
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
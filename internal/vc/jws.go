@@ -0,0 +1,172 @@
+package vc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// Signer produces JWS signatures with a fixed key.
+type Signer struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+// LoadSigner loads a PEM private key (PKCS#8, SEC1 EC or PKCS#1 RSA) from
+// keyPath. Supported keys are EC P-256 (ES256), EC P-384 (ES384), Ed25519
+// (EdDSA) and RSA (RS256). kid, if non-empty, is set in JWS headers to help
+// verifiers locate the public key.
+func LoadSigner(keyPath, kid string) (*Signer, error) {
+	pemBytes, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read signing key: %w", err)
+	}
+	key, err := parseKey(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	alg, err := algFor(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{kid: kid, alg: alg, key: key}, nil
+}
+
+// Alg returns the JWS algorithm of the signing key.
+func (s *Signer) Alg() string { return s.alg }
+
+// KeyID returns the key ID given to LoadSigner.
+func (s *Signer) KeyID() string { return s.kid }
+
+// SignRaw signs input as is with the key's algorithm. The signature has
+// the form JWS and COSE share: fixed-width r||s for ECDSA.
+func (s *Signer) SignRaw(input []byte) ([]byte, error) {
+	return s.signInput(input)
+}
+
+// Sign returns payload as a compact JWS (header.payload.signature) with the
+// given "typ" header, omitted if empty.
+func (s *Signer) Sign(typ string, payload []byte) (string, error) {
+	header := map[string]any{"alg": s.alg}
+	if typ != "" {
+		header["typ"] = typ
+	}
+	if s.kid != "" {
+		header["kid"] = s.kid
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", fmt.Errorf("encode header: %w", err)
+	}
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString(h) + "." + enc.EncodeToString(payload)
+	sig, err := s.signInput([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + enc.EncodeToString(sig), nil
+}
+
+// SignDetached signs payload and returns the JWS with the payload segment
+// removed (header..signature, RFC 7515 Appendix F). Verifiers reinsert the
+// base64url payload before checking.
+func (s *Signer) SignDetached(payload []byte) (string, error) {
+	jws, err := s.Sign("", payload)
+	if err != nil {
+		return "", err
+	}
+	first, last := strings.Index(jws, "."), strings.LastIndex(jws, ".")
+	return jws[:first+1] + jws[last:], nil
+}
+
+// signInput signs the JWS signing input with the key's algorithm.
+func (s *Signer) signInput(input []byte) ([]byte, error) {
+	var sig []byte
+	var err error
+	switch k := s.key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, input)
+	case *ecdsa.PrivateKey:
+		var digest []byte
+		if k.Curve == elliptic.P384() {
+			sum := sha512.Sum384(input)
+			digest = sum[:]
+		} else {
+			sum := sha256.Sum256(input)
+			digest = sum[:]
+		}
+		r, ss, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			return nil, fmt.Errorf("sign: %w", err)
+		}
+		// JWS wants the fixed-width r||s form, not ASN.1
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = append(padded(r, size), padded(ss, size)...)
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256(input)
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+		if err != nil {
+			return nil, fmt.Errorf("sign: %w", err)
+		}
+	}
+	return sig, nil
+}
+
+func parseKey(pemBytes []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("signing key: no PEM block")
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if s, ok := k.(crypto.Signer); ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("signing key: unsupported type %T", k)
+	}
+	if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	return nil, errors.New("signing key: unrecognized private key format")
+}
+
+// algFor picks the JWS algorithm for a key.
+func algFor(s crypto.Signer) (string, error) {
+	switch k := s.(type) {
+	case ed25519.PrivateKey:
+		return "EdDSA", nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return "ES256", nil
+		case elliptic.P384():
+			return "ES384", nil
+		}
+		return "", fmt.Errorf("signing key: unsupported curve %s", k.Curve.Params().Name)
+	case *rsa.PrivateKey:
+		return "RS256", nil
+	}
+	return "", fmt.Errorf("signing key: unsupported type %T", s)
+}
+
+func padded(n *big.Int, size int) []byte {
+	b := make([]byte, size)
+	return n.FillBytes(b)
+}
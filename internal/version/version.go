@@ -0,0 +1,80 @@
+// Package version identifies the build of the proxy, so support can tie
+// behavior to an exact build.
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+// Version is the release of the proxy, set at build time with
+//
+//	go build -ldflags "-X github.com/fdo-server-wrapper/internal/version.Version=v1.4.0"
+var Version = "dev"
+
+var buildInfo = metrics.Default.NewGaugeVec(
+	"fdo_proxy_build_info",
+	"Always 1, labeled with the version and commit of the running proxy.",
+	"version", "commit", "go_version")
+
+func init() {
+	info := Get()
+	buildInfo.Set(1, info.Version, info.Commit, info.GoVersion)
+}
+
+// Info describes the build.
+type Info struct {
+	Version string `json:"version"`
+	// Commit is the git commit built, with Modified set if the tree had
+	// uncommitted changes. Both are unknown for builds outside a git tree.
+	Commit     string    `json:"commit,omitempty"`
+	CommitTime time.Time `json:"commit_time,omitzero"`
+	Modified   bool      `json:"modified,omitempty"`
+	GoVersion  string    `json:"go_version"`
+	Platform   string    `json:"platform"`
+}
+
+// Get returns the build information embedded in the binary.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Commit = s.Value
+		case "vcs.time":
+			info.CommitTime, _ = time.Parse(time.RFC3339, s.Value)
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+// String formats the build for -version and logs, e.g.
+// "v1.4.0 (commit 1a2b3c4d5e6f, go1.24.1 linux/amd64)".
+func (i Info) String() string {
+	s := i.Version + " ("
+	if i.Commit != "" {
+		commit := i.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		s += "commit " + commit
+		if i.Modified {
+			s += "-dirty"
+		}
+		s += ", "
+	}
+	return s + i.GoVersion + " " + i.Platform + ")"
+}